@@ -5,6 +5,7 @@ import (
 	rdb "github.com/hdt3213/rdb/core"
 	"goRedisPlus/config"
 	"goRedisPlus/interface/database"
+	"goRedisPlus/lib/latency"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/utils"
 	"goRedisPlus/redis/connection"
@@ -15,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -59,8 +61,8 @@ type Persister struct {
 	aofFile *os.File
 	// aofFilename is the path of aof file
 	aofFilename string
-	// aofFsync is the strategy of fsync
-	aofFsync string
+	// aofFsync is the strategy of fsync, it may be changed by SetFsync at runtime
+	aofFsync atomic.Value
 	// aof goroutine will send msg to main goroutine through this channel when aof tasks finished and ready to shut down
 	aofFinished chan struct{}
 	// pause aof for start/finish aof rewrite progress
@@ -75,7 +77,7 @@ type Persister struct {
 func NewPersister(db database.DBEngine, filename string, load bool, fsync string, tmpDBMaker func() database.DBEngine) (*Persister, error) {
 	persister := &Persister{}
 	persister.aofFilename = filename
-	persister.aofFsync = strings.ToLower(fsync)
+	persister.aofFsync.Store(strings.ToLower(fsync))
 	persister.db = db
 	persister.tmpDBMaker = tmpDBMaker // 为什么需要这个临时的整个redis数据库
 	persister.currentDB = 0
@@ -98,10 +100,8 @@ func NewPersister(db database.DBEngine, filename string, load bool, fsync string
 	ctx, cancel := context.WithCancel(context.Background())
 	persister.ctx = ctx
 	persister.cancel = cancel
-	// fsync every second if needed
-	if persister.aofFsync == FsyncEverySec {
-		persister.fsyncEverySecond()
-	}
+	// fsync every second if needed, the strategy is checked at each tick since it may be changed
+	persister.fsyncEverySecond()
 	return persister, nil
 }
 
@@ -119,7 +119,7 @@ func (persister *Persister) SaveCmdLine(dbIndex int, cmdLine CmdLine) {
 		return
 	}
 
-	if persister.aofFsync == FsyncAlways {
+	if persister.getFsync() == FsyncAlways {
 		p := &payload{
 			cmdLine: cmdLine,
 			dbIndex: dbIndex,
@@ -135,9 +135,36 @@ func (persister *Persister) SaveCmdLine(dbIndex int, cmdLine CmdLine) {
 
 }
 
+// Flush blocks until all commands saved before have been written into aof file and sent to listeners
+func (persister *Persister) Flush() {
+	if persister.aofChan == nil || persister.getFsync() == FsyncAlways {
+		// commands have been written synchronously
+		return
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	persister.aofChan <- &payload{
+		wg: wg,
+	}
+	wg.Wait()
+}
+
+// FlushAndFsync blocks until all commands saved before have been fsynced into aof file
+func (persister *Persister) FlushAndFsync() error {
+	persister.Flush()
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	return persister.aofFile.Sync()
+}
+
 // listenCmd listen aof channel and write into file
 func (persister *Persister) listenCmd() {
 	for p := range persister.aofChan {
+		if p.cmdLine == nil && p.wg != nil {
+			// barrier payload, see Persister.Flush
+			p.wg.Done()
+			continue
+		}
 		persister.writeAof(p)
 	}
 	persister.aofFinished <- struct{}{}
@@ -170,8 +197,10 @@ func (persister *Persister) writeAof(p *payload) {
 	for listener := range persister.listeners {
 		listener.Callback(persister.buffer)
 	}
-	if persister.aofFsync == FsyncAlways {
+	if persister.getFsync() == FsyncAlways {
+		start := time.Now()
 		_ = persister.aofFile.Sync()
+		latency.Record("aof-fsync-always", time.Since(start))
 	}
 }
 
@@ -248,12 +277,26 @@ func (persister *Persister) LoadAof(maxBytes int) {
 // Fsync flushes aof file to disk
 func (persister *Persister) Fsync() {
 	persister.pausingAof.Lock()
+	start := time.Now()
 	if err := persister.aofFile.Sync(); err != nil {
 		logger.Errorf("fsync failed: %v", err)
 	}
+	latency.Record("aof-fsync", time.Since(start))
 	persister.pausingAof.Unlock()
 }
 
+func (persister *Persister) getFsync() string {
+	fsync, _ := persister.aofFsync.Load().(string)
+	return fsync
+}
+
+// SetFsync changes strategy of fsync at runtime, see CONFIG SET appendfsync
+func (persister *Persister) SetFsync(fsync string) {
+	// drain aofChan, commands written synchronously under FsyncAlways must not overtake queued ones
+	persister.Flush()
+	persister.aofFsync.Store(strings.ToLower(fsync))
+}
+
 // Close gracefully stops aof persistence procedure
 func (persister *Persister) Close() {
 	if persister.aofFile != nil {
@@ -274,7 +317,9 @@ func (persister *Persister) fsyncEverySecond() {
 		for {
 			select {
 			case <-ticker.C:
-				persister.Fsync()
+				if persister.getFsync() == FsyncEverySec {
+					persister.Fsync()
+				}
 			case <-persister.ctx.Done():
 				return
 			}
@@ -5,6 +5,7 @@ import (
 	List "goRedisPlus/datastruct/list"
 	"goRedisPlus/datastruct/set"
 	SortedSet "goRedisPlus/datastruct/sortedset"
+	"goRedisPlus/datastruct/strobj"
 	"goRedisPlus/interface/database"
 	"goRedisPlus/redis/protocol"
 	"strconv"
@@ -18,8 +19,9 @@ func EntityToCmd(key string, entity *database.DataEntity) *protocol.MultiBulkRep
 	}
 	var cmd *protocol.MultiBulkReply
 	switch val := entity.Data.(type) {
-	case []byte:
-		cmd = stringToCmd(key, val)
+	case []byte, strobj.Int, strobj.Embedded:
+		bytes, _ := strobj.Bytes(val)
+		cmd = stringToCmd(key, bytes)
 	case List.List:
 		cmd = listToCmd(key, val)
 	case *set.Set:
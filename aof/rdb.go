@@ -8,8 +8,11 @@ import (
 	List "goRedisPlus/datastruct/list"
 	"goRedisPlus/datastruct/set"
 	SortedSet "goRedisPlus/datastruct/sortedset"
+	"goRedisPlus/datastruct/strobj"
 	"goRedisPlus/interface/database"
+	"goRedisPlus/lib/latency"
 	"goRedisPlus/lib/logger"
+	"io"
 	"os"
 	"strconv"
 	"time"
@@ -62,44 +65,82 @@ func (persister *Persister) GenerateRDBForReplication(rdbFilename string, listen
 	return nil
 }
 
+// AddListener registers a listener which would receive all following updates
+func (persister *Persister) AddListener(listener Listener) {
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	persister.listeners[listener] = struct{}{}
+}
+
 func (persister *Persister) startGenerateRDB(newListener Listener, hook func()) (*RewriteCtx, error) {
+	filesize, err := persister.pauseAndSnapshot(newListener, hook)
+	if err != nil {
+		return nil, err
+	}
+	// create tmp file
+	file, err := os.CreateTemp(config.GetTmpDir(), "*.aof")
+	if err != nil {
+		logger.Warn("tmp file create failed")
+		return nil, err
+	}
+	return &RewriteCtx{
+		tmpFile:  file,
+		fileSize: filesize,
+	}, nil
+}
+
+// pauseAndSnapshot returns current size of aof file, and registers listener during aof pausing
+func (persister *Persister) pauseAndSnapshot(newListener Listener, hook func()) (int64, error) {
 	persister.pausingAof.Lock() // pausing aof
 	defer persister.pausingAof.Unlock()
+	defer recordSnapshotPause(time.Now())
 
 	err := persister.aofFile.Sync()
 	if err != nil {
 		logger.Warn("fsync failed")
-		return nil, err
+		return 0, err
 	}
 
 	// get current aof file size
 	fileInfo, _ := os.Stat(persister.aofFilename)
 	filesize := fileInfo.Size()
-	// create tmp file
-	file, err := os.CreateTemp(config.GetTmpDir(), "*.aof")
-	if err != nil {
-		logger.Warn("tmp file create failed")
-		return nil, err
-	}
 	if newListener != nil {
 		persister.listeners[newListener] = struct{}{}
 	}
 	if hook != nil {
 		hook()
 	}
-	return &RewriteCtx{
-		tmpFile:  file,
-		fileSize: filesize,
-	}, nil
+	return filesize, nil
+}
+
+// recordSnapshotPause records how long aof has been paused to take a snapshot,
+// it is reported as fork event since the pause plays the role of fork in redis
+func recordSnapshotPause(start time.Time) {
+	latency.Record("fork", time.Since(start))
 }
 
 // generateRDB generates rdb file from aof file
 func (persister *Persister) generateRDB(ctx *RewriteCtx) error {
+	return persister.encodeRDB(ctx.fileSize, ctx.tmpFile)
+}
+
+// encodeRDB loads the first fileSize bytes of aof file and encodes them into rdb
+func (persister *Persister) encodeRDB(fileSize int64, w io.Writer) error {
 	// load aof tmpFile
 	tmpHandler := persister.newRewriteHandler()
-	tmpHandler.LoadAof(int(ctx.fileSize))
+	tmpHandler.LoadAof(int(fileSize))
+	return WriteRDB(w, tmpHandler.db)
+}
+
+// RDBSource is a data set which could be encoded into rdb
+type RDBSource interface {
+	ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool)
+	GetDBSize(dbIndex int) (int, int)
+}
 
-	encoder := rdb.NewEncoder(ctx.tmpFile).EnableCompress()
+// WriteRDB encodes all databases of source into rdb and writes it into w
+func WriteRDB(w io.Writer, source RDBSource) error {
+	encoder := rdb.NewEncoder(w).EnableCompress()
 	err := encoder.WriteHeader()
 	if err != nil {
 		return err
@@ -124,7 +165,7 @@ func (persister *Persister) generateRDB(ctx *RewriteCtx) error {
 	}
 
 	for i := 0; i < config.Properties.Databases; i++ {
-		keyCount, ttlCount := tmpHandler.db.GetDBSize(i)
+		keyCount, ttlCount := source.GetDBSize(i)
 		if keyCount == 0 {
 			continue
 		}
@@ -134,48 +175,12 @@ func (persister *Persister) generateRDB(ctx *RewriteCtx) error {
 		}
 		// dump db
 		var err2 error
-		tmpHandler.db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+		source.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
 			var opts []interface{}
 			if expiration != nil {
 				opts = append(opts, rdb.WithTTL(uint64(expiration.UnixNano()/1e6)))
 			}
-			switch obj := entity.Data.(type) {
-			case []byte:
-				err = encoder.WriteStringObject(key, obj, opts...)
-			case List.List:
-				vals := make([][]byte, 0, obj.Len())
-				obj.ForEach(func(i int, v interface{}) bool {
-					bytes, _ := v.([]byte)
-					vals = append(vals, bytes)
-					return true
-				})
-				err = encoder.WriteListObject(key, vals, opts...)
-			case *set.Set:
-				vals := make([][]byte, 0, obj.Len())
-				obj.ForEach(func(m string) bool {
-					vals = append(vals, []byte(m))
-					return true
-				})
-				err = encoder.WriteSetObject(key, vals, opts...)
-			case dict.Dict:
-				hash := make(map[string][]byte)
-				obj.ForEach(func(key string, val interface{}) bool {
-					bytes, _ := val.([]byte)
-					hash[key] = bytes
-					return true
-				})
-				err = encoder.WriteHashMapObject(key, hash, opts...)
-			case *SortedSet.SortedSet:
-				var entries []*model.ZSetEntry
-				obj.ForEachByRank(int64(0), obj.Len(), true, func(element *SortedSet.Element) bool {
-					entries = append(entries, &model.ZSetEntry{
-						Member: element.Member,
-						Score:  element.Score,
-					})
-					return true
-				})
-				err = encoder.WriteZSetObject(key, entries, opts...)
-			}
+			err = EncodeEntity(encoder, key, entity, opts...)
 			if err != nil {
 				err2 = err
 				return false
@@ -192,3 +197,47 @@ func (persister *Persister) generateRDB(ctx *RewriteCtx) error {
 	}
 	return nil
 }
+
+// EncodeEntity writes a key and its value into rdb encoder
+func EncodeEntity(encoder *rdb.Encoder, key string, entity *database.DataEntity, opts ...interface{}) error {
+	var err error
+	switch obj := entity.Data.(type) {
+	case []byte, strobj.Int, strobj.Embedded:
+		bytes, _ := strobj.Bytes(obj)
+		err = encoder.WriteStringObject(key, bytes, opts...)
+	case List.List:
+		vals := make([][]byte, 0, obj.Len())
+		obj.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			vals = append(vals, bytes)
+			return true
+		})
+		err = encoder.WriteListObject(key, vals, opts...)
+	case *set.Set:
+		vals := make([][]byte, 0, obj.Len())
+		obj.ForEach(func(m string) bool {
+			vals = append(vals, []byte(m))
+			return true
+		})
+		err = encoder.WriteSetObject(key, vals, opts...)
+	case dict.Dict:
+		hash := make(map[string][]byte)
+		obj.ForEach(func(key string, val interface{}) bool {
+			bytes, _ := val.([]byte)
+			hash[key] = bytes
+			return true
+		})
+		err = encoder.WriteHashMapObject(key, hash, opts...)
+	case *SortedSet.SortedSet:
+		var entries []*model.ZSetEntry
+		obj.ForEachByRank(int64(0), obj.Len(), true, func(element *SortedSet.Element) bool {
+			entries = append(entries, &model.ZSetEntry{
+				Member: element.Member,
+				Score:  element.Score,
+			})
+			return true
+		})
+		err = encoder.WriteZSetObject(key, entries, opts...)
+	}
+	return err
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"time"
 )
 
 func (persister *Persister) newRewriteHandler() *Persister {
@@ -58,6 +59,7 @@ func (persister *Persister) StartRewrite() (*RewriteCtx, error) {
 	// pausing aof
 	persister.pausingAof.Lock() // rewrite write Fsync 这三个操作是互斥的
 	defer persister.pausingAof.Unlock()
+	defer recordSnapshotPause(time.Now())
 
 	err := persister.aofFile.Sync() // 重写之前先落盘
 	if err != nil {
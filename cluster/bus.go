@@ -0,0 +1,470 @@
+package cluster
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"goRedisPlus/config"
+	database2 "goRedisPlus/database"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/tlsutil"
+	"goRedisPlus/redis/client"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/parser"
+	"goRedisPlus/redis/protocol"
+	"io"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster bus:
+// Internal commands between nodes (raft and gcluster, including gossip, migration control and topology) are sent to
+// a dedicated port (client port + busPortOffset) instead of the client port, just like redis cluster.
+// Migration stream and relayed client commands still use the client port.
+//
+// Messages of cluster bus are length prefixed binary frames, all integers are big endian:
+//   frame:   [uint32 body length][body]
+//   request: [uint32 argc]([uint32 len][arg])...
+//   reply:   [uint8 type][payload], payload of multi bulk reply is encoded as request, int reply is an int64,
+//            complex replies (such as MultiRawReply) are encoded in RESP
+//
+// Cluster bus is secured by TLS if tls-cluster is yes. If requirepass is set, peers must send AUTH
+// (with cluster-auth-user and cluster-auth-pass) before any internal command.
+
+const (
+	busReplyStatus byte = iota
+	busReplyError
+	busReplyInt
+	busReplyBulk
+	busReplyNullBulk
+	busReplyMultiBulk
+	busReplyEmptyMultiBulk
+	busReplyRaw
+)
+
+const (
+	maxBusFrameSize = 512 * 1024 * 1024
+	busTimeout      = 3 * time.Second
+)
+
+// isBusCommand returns whether the command should be sent by cluster bus
+func isBusCommand(cmdLine CmdLine) bool {
+	if len(cmdLine) == 0 {
+		return false
+	}
+	name := strings.ToLower(string(cmdLine[0]))
+	return name == "raft" || name == "gcluster"
+}
+
+// getBusAddr returns cluster bus address of the node listening on addr
+func getBusAddr(addr string) string {
+	host, port := splitAddr(addr)
+	return net.JoinHostPort(host, strconv.Itoa(port+busPortOffset))
+}
+
+// Nodes behind NAT may announce a cluster bus port other than client port + busPortOffset (cluster-announce-bus-port),
+// it is saved in topology as Node.BusAddr. Before a node is known by topology, such as seed of joining or CLUSTER MEET,
+// its address could carry the bus port like redis cluster: 127.0.0.1:6399@16399
+
+// parseSeedAddr splits addr[@busport] into node address and cluster bus address, bus address is empty if not given
+func parseSeedAddr(seed string) (string, string) {
+	i := strings.LastIndexByte(seed, '@')
+	if i < 0 {
+		return seed, ""
+	}
+	addr := seed[:i]
+	host, _ := splitAddr(addr)
+	return addr, net.JoinHostPort(host, seed[i+1:])
+}
+
+// getAnnounceBusAddr returns cluster bus address advertised by current node listening on addr,
+// it returns empty string if cluster-announce-bus-port is not set
+func getAnnounceBusAddr(addr string) string {
+	if config.Properties.AnnounceBusPort <= 0 {
+		return ""
+	}
+	host, _ := splitAddr(addr)
+	return net.JoinHostPort(host, strconv.Itoa(config.Properties.AnnounceBusPort))
+}
+
+// makeSeedAddr appends advertised cluster bus port to addr of current node if cluster-announce-bus-port is set
+func makeSeedAddr(addr string) string {
+	if config.Properties.AnnounceBusPort <= 0 {
+		return addr
+	}
+	return addr + "@" + strconv.Itoa(config.Properties.AnnounceBusPort)
+}
+
+// getPeerBusAddr returns cluster bus address of peer, peerAddr is a node id or an address of seed
+func (cluster *Cluster) getPeerBusAddr(peerAddr string) string {
+	addr, busAddr := parseSeedAddr(peerAddr)
+	if busAddr != "" {
+		return busAddr
+	}
+	if node := cluster.topology.GetNode(addr); node != nil && node.BusAddr != "" {
+		return node.BusAddr
+	}
+	return getBusAddr(addr)
+}
+
+// getNodeBusPort returns cluster bus port of node, it is shown in CLUSTER NODES
+func getNodeBusPort(node *Node) int {
+	busAddr := node.BusAddr
+	if busAddr == "" {
+		busAddr = getBusAddr(node.Addr)
+	}
+	_, port := splitAddr(busAddr)
+	return port
+}
+
+/* ---- codec ---- */
+
+func writeFrame(w io.Writer, body []byte) error {
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[4:], body)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxBusFrameSize {
+		return nil, fmt.Errorf("bus frame too large: %d", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return append(buf, b...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return append(buf, b...)
+}
+
+func encodeArgs(buf []byte, args [][]byte) []byte {
+	buf = appendUint32(buf, uint32(len(args)))
+	for _, arg := range args {
+		buf = appendUint32(buf, uint32(len(arg)))
+		buf = append(buf, arg...)
+	}
+	return buf
+}
+
+var errIllegalFrame = errors.New("illegal bus frame")
+
+func decodeArgs(body []byte) ([][]byte, error) {
+	if len(body) < 4 {
+		return nil, errIllegalFrame
+	}
+	argc := binary.BigEndian.Uint32(body)
+	body = body[4:]
+	if uint64(argc)*4 > uint64(len(body)) {
+		return nil, errIllegalFrame
+	}
+	args := make([][]byte, 0, argc)
+	for i := uint32(0); i < argc; i++ {
+		if len(body) < 4 {
+			return nil, errIllegalFrame
+		}
+		size := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		if uint64(size) > uint64(len(body)) {
+			return nil, errIllegalFrame
+		}
+		args = append(args, body[:size])
+		body = body[size:]
+	}
+	return args, nil
+}
+
+func encodeReply(reply redis.Reply) []byte {
+	switch r := reply.(type) {
+	case *protocol.MultiBulkReply:
+		return encodeArgs([]byte{busReplyMultiBulk}, r.Args)
+	case *protocol.BulkReply:
+		if r.Arg == nil {
+			return []byte{busReplyNullBulk}
+		}
+		return append([]byte{busReplyBulk}, r.Arg...)
+	case *protocol.NullBulkReply:
+		return []byte{busReplyNullBulk}
+	case *protocol.EmptyMultiBulkReply:
+		return []byte{busReplyEmptyMultiBulk}
+	case *protocol.IntReply:
+		return appendUint64([]byte{busReplyInt}, uint64(r.Code))
+	case *protocol.StatusReply:
+		return append([]byte{busReplyStatus}, r.Status...)
+	case *protocol.OkReply:
+		return append([]byte{busReplyStatus}, "OK"...)
+	case protocol.ErrorReply:
+		msg := strings.TrimSuffix(strings.TrimPrefix(string(reply.ToBytes()), "-"), protocol.CRLF)
+		return append([]byte{busReplyError}, msg...)
+	}
+	return append([]byte{busReplyRaw}, reply.ToBytes()...)
+}
+
+func decodeReply(body []byte) (redis.Reply, error) {
+	if len(body) == 0 {
+		return nil, errIllegalFrame
+	}
+	payload := body[1:]
+	switch body[0] {
+	case busReplyStatus:
+		return protocol.MakeStatusReply(string(payload)), nil
+	case busReplyError:
+		return protocol.MakeErrReply(string(payload)), nil
+	case busReplyInt:
+		if len(payload) != 8 {
+			return nil, errIllegalFrame
+		}
+		return protocol.MakeIntReply(int64(binary.BigEndian.Uint64(payload))), nil
+	case busReplyBulk:
+		return protocol.MakeBulkReply(payload), nil
+	case busReplyNullBulk:
+		return protocol.MakeNullBulkReply(), nil
+	case busReplyMultiBulk:
+		args, err := decodeArgs(payload)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.MakeMultiBulkReply(args), nil
+	case busReplyEmptyMultiBulk:
+		return protocol.MakeEmptyMultiBulkReply(), nil
+	case busReplyRaw:
+		return parser.ParseOne(payload)
+	}
+	return nil, fmt.Errorf("unknown bus reply type %d", body[0])
+}
+
+/* ---- server ---- */
+
+type busServer struct {
+	cluster  *Cluster
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// startBus listens cluster bus port and serves internal commands from other nodes
+func (cluster *Cluster) startBus() error {
+	addr := config.Properties.BindAddresses(config.Properties.Port + busPortOffset)[0]
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen cluster bus %s failed: %v", addr, err)
+	}
+	if config.Properties.TLSCluster {
+		tlsConfig, err := tlsutil.MakeServerConfig(config.Properties.TLSCertFile, config.Properties.TLSKeyFile,
+			config.Properties.TLSCACertFile, config.Properties.TLSAuthClients)
+		if err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("tls of cluster bus: %v", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	logger.Info("cluster bus listening on " + addr)
+	cluster.bus = &busServer{
+		cluster:  cluster,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go cluster.bus.serve()
+	return nil
+}
+
+func (bus *busServer) serve() {
+	for {
+		conn, err := bus.listener.Accept()
+		if err != nil {
+			bus.mu.Lock()
+			closed := bus.closed
+			bus.mu.Unlock()
+			if !closed {
+				logger.Errorf("cluster bus accept error: %v", err)
+			}
+			return
+		}
+		bus.mu.Lock()
+		bus.conns[conn] = struct{}{}
+		bus.mu.Unlock()
+		go bus.handle(conn)
+	}
+}
+
+func (bus *busServer) handle(conn net.Conn) {
+	defer func() {
+		bus.mu.Lock()
+		delete(bus.conns, conn)
+		bus.mu.Unlock()
+		_ = conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	fakeConn := connection.NewFakeConn()
+	for {
+		body, err := readFrame(reader)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("cluster bus read from %s failed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		var reply redis.Reply
+		cmdLine, err := decodeArgs(body)
+		if err != nil {
+			reply = protocol.MakeErrReply("ERR " + err.Error())
+		} else {
+			reply = bus.exec(fakeConn, cmdLine)
+		}
+		if err := writeFrame(conn, encodeReply(reply)); err != nil {
+			logger.Debugf("cluster bus write to %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// exec executes internal commands only, cluster bus does not accept commands of clients
+func (bus *busServer) exec(c redis.Connection, cmdLine CmdLine) (result redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &protocol.UnknownErrReply{}
+		}
+	}()
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if cmdName == "auth" {
+		return database2.Auth(c, cmdLine[1:])
+	}
+	if !database2.IsAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH Authentication required")
+	}
+	if cmdName == "ping" {
+		// health check of connection pool
+		return &protocol.PongReply{}
+	}
+	if !isBusCommand(cmdLine) {
+		return protocol.MakeErrReply("ERR only internal commands are allowed on cluster bus")
+	}
+	cmdFunc := router[cmdName]
+	return cmdFunc(bus.cluster, c, cmdLine)
+}
+
+func (bus *busServer) Close() {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.closed = true
+	_ = bus.listener.Close()
+	for conn := range bus.conns {
+		_ = conn.Close()
+	}
+}
+
+/* ---- client ---- */
+
+// busClient sends internal commands to cluster bus of a peer, it is not safe for concurrent use, see connection pool
+type busClient struct {
+	addr   string
+	config *client.Config
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func makeBusClient(addr string, cfg *client.Config) (*busClient, error) {
+	cli := &busClient{
+		addr:   addr,
+		config: cfg,
+	}
+	if err := cli.connect(); err != nil {
+		return nil, err
+	}
+	return cli, nil
+}
+
+func (cli *busClient) connect() error {
+	conn, err := tlsutil.Dial(cli.addr, cli.config.TLS, busTimeout)
+	if err != nil {
+		return err
+	}
+	cli.conn = conn
+	cli.reader = bufio.NewReader(conn)
+	if cli.config.Password == "" {
+		return nil
+	}
+	authCmd := [][]byte{[]byte("auth"), []byte(cli.config.Password)}
+	if cli.config.User != "" {
+		authCmd = [][]byte{[]byte("auth"), []byte(cli.config.User), []byte(cli.config.Password)}
+	}
+	reply, err := cli.doRequest(authCmd)
+	if err == nil && !protocol.IsOKReply(reply) {
+		err = fmt.Errorf("auth failed, resp: %s", string(reply.ToBytes()))
+	}
+	if err != nil {
+		cli.Close()
+		return err
+	}
+	return nil
+}
+
+// Send sends a command and waits for its reply, the connection would be re-established on next call if failed
+func (cli *busClient) Send(args [][]byte) redis.Reply {
+	if cli.conn == nil {
+		if err := cli.connect(); err != nil {
+			return protocol.MakeErrReply("ERR connect with cluster bus " + cli.addr + " failed: " + err.Error())
+		}
+	}
+	reply, err := cli.doRequest(args)
+	if err != nil {
+		cli.Close()
+		return protocol.MakeErrReply("ERR cluster bus " + cli.addr + ": " + err.Error())
+	}
+	return reply
+}
+
+func (cli *busClient) doRequest(args [][]byte) (redis.Reply, error) {
+	_ = cli.conn.SetDeadline(time.Now().Add(busTimeout))
+	defer func() {
+		if cli.conn != nil {
+			_ = cli.conn.SetDeadline(time.Time{})
+		}
+	}()
+	if err := writeFrame(cli.conn, encodeArgs(nil, args)); err != nil {
+		return nil, err
+	}
+	body, err := readFrame(cli.reader)
+	if err != nil {
+		return nil, err
+	}
+	return decodeReply(body)
+}
+
+// Broken returns whether the last request failed, the connection should be replaced
+func (cli *busClient) Broken() bool {
+	return cli.conn == nil
+}
+
+func (cli *busClient) Close() {
+	if cli.conn != nil {
+		_ = cli.conn.Close()
+		cli.conn = nil
+	}
+}
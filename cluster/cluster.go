@@ -35,7 +35,18 @@ type Cluster struct {
 	slots         map[uint32]*hostSlot // redis中的槽位
 	idGenerator   *idgenerator.IDGenerator
 
-	clientFactory clientFactory // 连接工厂
+	clientFactory clientFactory    // 连接工厂
+	masterID      string           // 当前节点是从节点时, 主节点的id
+	detector      *failureDetector // 故障检测, see gossip.go
+	bus           *busServer
+	closeChan     chan struct{}
+	migrationLog  *migrationLog  // 迁移进度持久化, see migration_log.go
+	migrationStat *migrationStat // 迁移进度统计, see migration_stat.go
+
+	keyspaceForwarder *keyspaceForwarder // 转发键空间通知, see notify.go
+	rebalancer        *rebalancer        // 根据负载自动迁移槽位, see rebalancer.go
+	slotMetrics       *slotMetrics       // 槽位的命令统计, see slot_stats.go
+	txLog             *txLog             // 分布式事务日志, see tcc_log.go
 }
 
 type peerClient interface {
@@ -50,7 +61,11 @@ type peerStream interface {
 type clientFactory interface {
 	GetPeerClient(peerAddr string) (peerClient, error)
 	ReturnPeerClient(peerAddr string, peerClient peerClient) error
+	GetMuxClient(peerAddr string) (peerClient, error) // shared client which needs not to be returned, see peer_mux.go
+	GetBusClient(peerAddr string) (peerClient, error) // client of cluster bus, see bus.go
+	ReturnBusClient(peerAddr string, peerClient peerClient) error
 	NewStream(peerAddr string, cmdLine CmdLine) (peerStream, error)
+	PoolStats() []*peerPoolStat
 	Close() error
 }
 
@@ -80,11 +95,23 @@ type hostSlot struct {
 	 * In a migrating slot, the slot on the old node is immutable, we only delete a key in the new node.
 	 * Therefore, we must distinguish between non-migrated key and deleted key.
 	 * Even if a key has been deleted, it still exists in importedKeys, so we can distinguish between non-migrated and deleted.
+	 * importedKeys and keys may hold millions of keys of a huge slot, they use set.CompactSet to save memory.
 	 */
-	importedKeys *set.Set
+	importedKeys *set.CompactSet
 	// keys stores all keys in this slot
 	// Cluster.makeInsertCallback and Cluster.makeDeleteCallback will keep keys up to time
-	keys *set.Set
+	keys *set.CompactSet
+	// epoch is the config epoch of current node when topology confirmed it owns this slot, 0 if not confirmed yet
+	// see slot_epoch.go
+	epoch uint64
+
+	// exportMu guards exporting and exportedKeys of moving out slot, which decide keys served in redirect mode
+	// see Cluster.redirect
+	exportMu sync.RWMutex
+	// exporting is set once the importing node starts to copy all keys in this slot, see execGClusterMigrate
+	exporting bool
+	// exportedKeys stores keys fetched by the importing node before exporting, see execDumpKey
+	exportedKeys map[string]struct{}
 }
 
 // if only one node involved in a transaction, just execute the command don't apply tcc procedure
@@ -99,23 +126,65 @@ func MakeCluster() *Cluster {
 		transactions:  dict.MakeSimple(),
 		idGenerator:   idgenerator.MakeGenerator(config.Properties.Self),
 		clientFactory: newDefaultClientFactory(), // 默认连接池
+		masterID:      getMasterIDFromConfig(),
+		detector:      makeFailureDetector(),
+		closeChan:     make(chan struct{}),
+		migrationLog:  makeMigrationLog(),
+		migrationStat: makeMigrationStat(),
+
+		keyspaceForwarder: makeKeyspaceForwarder(),
+		rebalancer:        makeRebalancer(),
+		slotMetrics:       makeSlotMetrics(),
+		txLog:             makeTxLog(),
+	}
+	if factory, ok := cluster.clientFactory.(*defaultClientFactory); ok {
+		factory.resolveBusAddr = cluster.getPeerBusAddr
 	}
 	topologyPersistFile := path.Join(config.Properties.Dir, config.Properties.ClusterConfigFile) // 拓扑持久化文件
-	cluster.topology = newRaft(cluster, topologyPersistFile)
+	useEtcd := strings.ToLower(config.Properties.ClusterBackend) == "etcd"
+	if useEtcd {
+		cluster.topology = newEtcdTopology(cluster)
+	} else {
+		cluster.topology = newRaft(cluster, topologyPersistFile)
+	}
 	cluster.db.SetKeyInsertedCallback(cluster.makeInsertCallback()) // 每次插入key之后都要把key插入到对应的slot的set中
 	cluster.db.SetKeyDeletedCallback(cluster.makeDeleteCallback())  // 每次删除key之后都要把key从对应的slot的set中删除
+	cluster.db.SetKeyspaceEventCallback(cluster.onKeyspaceEvent)
+	database2.RegisterInfoSection("peers", true, func(*database2.Server) []byte {
+		return cluster.genPeersInfo()
+	})
 	cluster.slots = make(map[uint32]*hostSlot)
-	var err error
-	if topologyPersistFile != "" && fileExists(topologyPersistFile) {
+	err := cluster.startBus()
+	if err != nil {
+		panic(err)
+	}
+	if useEtcd {
+		// topology is kept in etcd, rejoin if current node is a member
+		err = cluster.LoadConfig()
+		if err == errConfigFileNotExist {
+			if config.Properties.ClusterAsSeed {
+				err = cluster.startAsSeed(config.Properties.AnnounceAddress())
+			} else {
+				err = cluster.Join(config.Properties.ClusterSeed)
+			}
+		}
+	} else if topologyPersistFile != "" && fileExists(topologyPersistFile) {
 		err = cluster.LoadConfig()
 	} else if config.Properties.ClusterAsSeed { // 作为初始节点启动
 		err = cluster.startAsSeed(config.Properties.AnnounceAddress())
-	} else {
+	} else if config.Properties.ClusterSeed != "" {
 		err = cluster.Join(config.Properties.ClusterSeed)
-	}
+	} // otherwise wait for CLUSTER MEET
 	if err != nil {
 		panic(err)
 	}
+	if err := cluster.txLog.load(); err != nil {
+		logger.Errorf("load transaction log failed: %v", err)
+	}
+	go cluster.gossipCron()
+	go cluster.forwardKeyspaceEvents()
+	go cluster.rebalanceCron()
+	go cluster.txRecoveryCron()
 	return cluster
 }
 
@@ -124,16 +193,12 @@ type CmdFunc func(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.R
 
 // Close stops current node of cluster
 func (cluster *Cluster) Close() {
+	close(cluster.closeChan)
+	cluster.bus.Close()
 	_ = cluster.topology.Close()
 	cluster.db.Close()
 	cluster.clientFactory.Close()
-}
-
-func isAuthenticated(c redis.Connection) bool {
-	if config.Properties.RequirePass == "" {
-		return true
-	}
-	return c.GetPassword() == config.Properties.RequirePass
+	cluster.txLog.close()
 }
 
 // Exec executes command on cluster
@@ -153,10 +218,32 @@ func (cluster *Cluster) Exec(c redis.Connection, cmdLine [][]byte) (result redis
 	if cmdName == "auth" {
 		return database2.Auth(c, cmdLine[1:])
 	}
-	if !isAuthenticated(c) {
+	if cmdName == "hello" {
+		if ser, ok := cluster.db.(*database2.Server); ok {
+			return database2.Hello(ser, c, cmdLine[1:])
+		}
+	}
+	if !database2.IsAuthenticated(c) {
 		return protocol.MakeErrReply("NOAUTH Authentication required")
 	}
+	if errReply := database2.CheckPermission(c, cmdLine); errReply != nil {
+		if c.InMultiState() {
+			c.AddTxError(errReply) // EXEC would be aborted
+		}
+		return errReply
+	}
+	return cluster.exec(c, cmdLine)
+}
 
+// exec executes command without checking permission, commands relayed to current node are executed by it
+func (cluster *Cluster) exec(c redis.Connection, cmdLine [][]byte) (result redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &protocol.UnknownErrReply{}
+		}
+	}()
+	cmdName := strings.ToLower(string(cmdLine[0]))
 	if cmdName == "multi" {
 		if len(cmdLine) != 1 {
 			return protocol.MakeArgNumErrReply(cmdName)
@@ -0,0 +1,508 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CLUSTER commands allow cluster-aware clients (and redis-cli --cluster) to discover the topology.
+// Node id in godis cluster is the address of node, but redis cluster uses 40 characters hex string as node id,
+// so CLUSTER commands show sha1 of the godis node id and accept both of them.
+
+// busPortOffset is the offset of cluster bus port in redis cluster, it is only shown in CLUSTER NODES
+const busPortOffset = 10000
+
+func init() {
+	registerCmd("Cluster", execCluster)
+}
+
+func execCluster(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("cluster")
+	}
+	subCmd := strings.ToLower(string(args[1]))
+	switch subCmd {
+	case "info":
+		return execClusterInfo(cluster, args[2:])
+	case "nodes":
+		return execClusterNodes(cluster, args[2:])
+	case "slots":
+		return execClusterSlots(cluster, args[2:])
+	case "shards":
+		return execClusterShards(cluster, args[2:])
+	case "meet":
+		return execClusterMeet(cluster, args[2:])
+	case "forget":
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("cluster|forget")
+		}
+		if err := cluster.Forget(string(args[2])); err != nil {
+			return err
+		}
+		return protocol.MakeOkReply()
+	case "transfer-leader":
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("cluster|transfer-leader")
+		}
+		node := cluster.findNode(string(args[2]))
+		if node == nil {
+			return protocol.MakeErrReply("ERR Unknown node " + string(args[2]))
+		}
+		if err := cluster.topology.TransferLeader(node.ID); err != nil {
+			return err
+		}
+		return protocol.MakeOkReply()
+	case "promote-learner":
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("cluster|promote-learner")
+		}
+		node := cluster.findNode(string(args[2]))
+		if node == nil {
+			return protocol.MakeErrReply("ERR Unknown node " + string(args[2]))
+		}
+		if err := cluster.topology.PromoteLearner(node.ID); err != nil {
+			return err
+		}
+		return protocol.MakeOkReply()
+	case "setslot":
+		return execClusterSetSlot(cluster, args[2:])
+	case "reshard":
+		return execClusterReshard(cluster, args[2:])
+	case "migration":
+		return execClusterMigration(cluster, args[2:])
+	case "rebalance":
+		return execClusterRebalance(cluster, args[2:])
+	case "slot-stats":
+		return execClusterSlotStats(cluster, args[2:])
+	case "keyslot":
+		if len(args) != 3 {
+			return protocol.MakeArgNumErrReply("cluster|keyslot")
+		}
+		return protocol.MakeIntReply(int64(getSlot(string(args[2]))))
+	case "countkeysinslot":
+		return execClusterCountKeysInSlot(cluster, args[2:])
+	case "getkeysinslot":
+		return execClusterGetKeysInSlot(cluster, args[2:])
+	case "replicate":
+		return execClusterReplicate(cluster, args[2:])
+	case "replicas", "slaves":
+		return execClusterReplicas(cluster, args[2:])
+	case "myid":
+		return protocol.MakeBulkReply([]byte(getHexNodeID(cluster.self)))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[1]) + "'. Try CLUSTER HELP.")
+}
+
+// getHexNodeID converts godis node id to redis cluster node id
+func getHexNodeID(nodeID string) string {
+	sum := sha1.Sum([]byte(nodeID))
+	return hex.EncodeToString(sum[:])
+}
+
+// findNode finds node by godis node id or redis cluster node id
+func (cluster *Cluster) findNode(id string) *Node {
+	if node := cluster.topology.GetNode(id); node != nil {
+		return node
+	}
+	for _, node := range cluster.topology.GetNodes() {
+		if getHexNodeID(node.ID) == id {
+			return node
+		}
+	}
+	return nil
+}
+
+// slotRange is a continuous range of slots hosted by the same node, both sides are inclusive
+type slotRange struct {
+	begin  uint32
+	end    uint32
+	nodeID string
+}
+
+// getSlotRanges returns continuous slot ranges in ascending order, slots without host are skipped
+func (cluster *Cluster) getSlotRanges() []*slotRange {
+	var ranges []*slotRange
+	var current *slotRange
+	for _, slot := range cluster.topology.GetSlots() {
+		if slot == nil || slot.NodeID == "" {
+			current = nil
+			continue
+		}
+		if current != nil && current.nodeID == slot.NodeID && current.end+1 == slot.ID {
+			current.end = slot.ID
+			continue
+		}
+		current = &slotRange{
+			begin:  slot.ID,
+			end:    slot.ID,
+			nodeID: slot.NodeID,
+		}
+		ranges = append(ranges, current)
+	}
+	return ranges
+}
+
+// getSortedNodes returns nodes in ascending order of id
+func (cluster *Cluster) getSortedNodes() []*Node {
+	nodes := cluster.topology.GetNodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+// getEpoch returns term of raft (or revision of etcd topology) as epoch of cluster
+func (cluster *Cluster) getEpoch() int {
+	if topo, ok := cluster.topology.(*etcdTopology); ok {
+		return int(topo.getRevision())
+	}
+	raft, ok := cluster.topology.(*Raft)
+	if !ok {
+		return 0
+	}
+	raft.mu.RLock()
+	defer raft.mu.RUnlock()
+	return raft.term
+}
+
+// toUnixMilli returns 0 for zero time
+func toUnixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / 1e6
+}
+
+func splitAddr(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+func execClusterInfo(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("cluster|info")
+	}
+	ranges := cluster.getSlotRanges()
+	assigned, pfail, fail := 0, 0, 0
+	masters := make(map[string]struct{})
+	for _, r := range ranges {
+		count := int(r.end-r.begin) + 1
+		assigned += count
+		masters[r.nodeID] = struct{}{}
+		health, _, _ := cluster.getNodeHealth(r.nodeID)
+		if health == nodeHealthPFail {
+			pfail += count
+		} else if health == nodeHealthFail {
+			fail += count
+		}
+	}
+	state := "ok"
+	if assigned < slotCount || fail > 0 {
+		state = "fail"
+	}
+	currentEpoch := uint64(cluster.getEpoch())
+	var myEpoch uint64
+	for _, node := range cluster.topology.GetNodes() {
+		if node.ConfigEpoch > currentEpoch {
+			currentEpoch = node.ConfigEpoch
+		}
+		if node.ID == cluster.self {
+			myEpoch = node.ConfigEpoch
+		}
+	}
+	info := fmt.Sprintf("cluster_state:%s\r\n"+
+		"cluster_slots_assigned:%d\r\n"+
+		"cluster_slots_ok:%d\r\n"+
+		"cluster_slots_pfail:%d\r\n"+
+		"cluster_slots_fail:%d\r\n"+
+		"cluster_known_nodes:%d\r\n"+
+		"cluster_size:%d\r\n"+
+		"cluster_current_epoch:%d\r\n"+
+		"cluster_my_epoch:%d\r\n",
+		state,
+		assigned,
+		assigned-pfail-fail,
+		pfail,
+		fail,
+		len(cluster.topology.GetNodes()),
+		len(masters),
+		currentEpoch,
+		myEpoch)
+	return protocol.MakeBulkReply([]byte(info))
+}
+
+// execClusterNodes returns topology in the format of redis cluster config file
+func execClusterNodes(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("cluster|nodes")
+	}
+	ranges := cluster.getSlotRanges()
+	sb := strings.Builder{}
+	for _, node := range cluster.getSortedNodes() {
+		sb.WriteString(cluster.makeNodeDesc(node, ranges))
+		sb.WriteString("\n")
+	}
+	return protocol.MakeBulkReply([]byte(sb.String()))
+}
+
+// makeNodeDesc returns a line of CLUSTER NODES
+func (cluster *Cluster) makeNodeDesc(node *Node, ranges []*slotRange) string {
+	host, port := splitAddr(node.Addr)
+	var flags []string
+	if node.ID == cluster.self {
+		flags = append(flags, "myself")
+	}
+	if node.getState() == learner {
+		flags = append(flags, "learner")
+	}
+	master := "-"
+	if node.MasterID != "" {
+		flags = append(flags, "slave")
+		master = getHexNodeID(node.MasterID)
+	} else {
+		flags = append(flags, "master")
+	}
+	state, pingSent, pongRecv := cluster.getNodeHealth(node.ID)
+	link := "connected"
+	switch state {
+	case nodeHealthPFail:
+		flags = append(flags, "fail?")
+		link = "disconnected"
+	case nodeHealthFail:
+		flags = append(flags, "fail")
+		link = "disconnected"
+	}
+	sb := strings.Builder{}
+	sb.WriteString(fmt.Sprintf("%s %s:%d@%d %s %s %d %d %d %s",
+		getHexNodeID(node.ID), host, port, getNodeBusPort(node), strings.Join(flags, ","), master,
+		toUnixMilli(pingSent), toUnixMilli(pongRecv), node.ConfigEpoch, link))
+	for _, r := range ranges {
+		if r.nodeID != node.ID {
+			continue
+		}
+		if r.begin == r.end {
+			sb.WriteString(" " + strconv.Itoa(int(r.begin)))
+		} else {
+			sb.WriteString(fmt.Sprintf(" %d-%d", r.begin, r.end))
+		}
+	}
+	if node.ID == cluster.self {
+		sb.WriteString(cluster.getMigratingSlotsDesc())
+	}
+	return sb.String()
+}
+
+// getMigratingSlotsDesc returns importing and migrating slots of current node, like ` [1->-nodeid] [2-<-nodeid]`
+func (cluster *Cluster) getMigratingSlotsDesc() string {
+	cluster.slotMu.RLock()
+	defer cluster.slotMu.RUnlock()
+	slotIDs := make([]int, 0)
+	for slotID, slot := range cluster.slots {
+		if slot.state != slotStateHost {
+			slotIDs = append(slotIDs, int(slotID))
+		}
+	}
+	sort.Ints(slotIDs)
+	sb := strings.Builder{}
+	for _, slotID := range slotIDs {
+		slot := cluster.slots[uint32(slotID)]
+		if slot.state == slotStateMovingOut {
+			sb.WriteString(fmt.Sprintf(" [%d->-%s]", slotID, getHexNodeID(slot.newNodeID)))
+		} else if slot.state == slotStateImporting {
+			sb.WriteString(fmt.Sprintf(" [%d-<-%s]", slotID, getHexNodeID(slot.oldNodeID)))
+		}
+	}
+	return sb.String()
+}
+
+// getReplicaIDs returns replicas of the given node in ascending order
+func (cluster *Cluster) getReplicaIDs(nodeID string) []string {
+	var result []string
+	for _, node := range cluster.getSortedNodes() {
+		if node.MasterID == nodeID {
+			result = append(result, node.ID)
+		}
+	}
+	return result
+}
+
+func makeNodeEndpointReply(node *Node) redis.Reply {
+	host, port := splitAddr(node.Addr)
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(host)),
+		protocol.MakeIntReply(int64(port)),
+		protocol.MakeBulkReply([]byte(getHexNodeID(node.ID))),
+	})
+}
+
+// execClusterSlots returns hosts of each slot range: [begin, end, master, replicas...]
+func execClusterSlots(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("cluster|slots")
+	}
+	ranges := cluster.getSlotRanges()
+	result := make([]redis.Reply, 0, len(ranges))
+	for _, r := range ranges {
+		node := cluster.topology.GetNode(r.nodeID)
+		if node == nil {
+			continue
+		}
+		item := []redis.Reply{
+			protocol.MakeIntReply(int64(r.begin)),
+			protocol.MakeIntReply(int64(r.end)),
+			makeNodeEndpointReply(node),
+		}
+		for _, replicaID := range cluster.getReplicaIDs(node.ID) {
+			if replica := cluster.topology.GetNode(replicaID); replica != nil {
+				item = append(item, makeNodeEndpointReply(replica))
+			}
+		}
+		result = append(result, protocol.MakeMultiRawReply(item))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+func (cluster *Cluster) makeShardNodeReply(node *Node, role string) redis.Reply {
+	host, port := splitAddr(node.Addr)
+	health := "online"
+	if cluster.isNodeFailed(node.ID) {
+		health = "failed"
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("id")),
+		protocol.MakeBulkReply([]byte(getHexNodeID(node.ID))),
+		protocol.MakeBulkReply([]byte("port")),
+		protocol.MakeIntReply(int64(port)),
+		protocol.MakeBulkReply([]byte("ip")),
+		protocol.MakeBulkReply([]byte(host)),
+		protocol.MakeBulkReply([]byte("endpoint")),
+		protocol.MakeBulkReply([]byte(host)),
+		protocol.MakeBulkReply([]byte("role")),
+		protocol.MakeBulkReply([]byte(role)),
+		protocol.MakeBulkReply([]byte("replication-offset")),
+		protocol.MakeIntReply(cluster.getNodeReplOffset(node.ID)),
+		protocol.MakeBulkReply([]byte("health")),
+		protocol.MakeBulkReply([]byte(health)),
+	})
+}
+
+// execClusterShards returns slots and nodes of each shard
+func execClusterShards(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("cluster|shards")
+	}
+	ranges := cluster.getSlotRanges()
+	var result []redis.Reply
+	for _, node := range cluster.getSortedNodes() {
+		if node.MasterID != "" {
+			continue // shown in the shard of its master
+		}
+		var slots []redis.Reply
+		for _, r := range ranges {
+			if r.nodeID == node.ID {
+				slots = append(slots, protocol.MakeIntReply(int64(r.begin)), protocol.MakeIntReply(int64(r.end)))
+			}
+		}
+		nodes := []redis.Reply{cluster.makeShardNodeReply(node, "master")}
+		for _, replicaID := range cluster.getReplicaIDs(node.ID) {
+			if replica := cluster.topology.GetNode(replicaID); replica != nil {
+				nodes = append(nodes, cluster.makeShardNodeReply(replica, "replica"))
+			}
+		}
+		result = append(result, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("slots")),
+			protocol.MakeMultiRawReply(slots),
+			protocol.MakeBulkReply([]byte("nodes")),
+			protocol.MakeMultiRawReply(nodes),
+		}))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+// execClusterMeet command line: cluster meet <ip> <port> [<cluster-bus-port>]
+func execClusterMeet(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 2 && len(args) != 3 {
+		return protocol.MakeArgNumErrReply("cluster|meet")
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return protocol.MakeErrReply("ERR Invalid node address specified: " + string(args[0]) + ":" + string(args[1]))
+	}
+	addr := net.JoinHostPort(string(args[0]), strconv.Itoa(port))
+	if len(args) == 3 {
+		busPort, err := strconv.Atoi(string(args[2]))
+		if err != nil || busPort <= 0 || busPort > 65535 {
+			return protocol.MakeErrReply("ERR Invalid cluster bus port specified: " + string(args[2]))
+		}
+		addr += "@" + strconv.Itoa(busPort)
+	}
+	if errReply := cluster.Meet(addr); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeOkReply()
+}
+
+// countKeysInSlot returns count of keys in the slot hosted by current node
+func (cluster *Cluster) countKeysInSlot(slotID uint32) int {
+	slot := cluster.getHostSlot(slotID)
+	if slot == nil {
+		return 0
+	}
+	slot.mu.RLock()
+	defer slot.mu.RUnlock()
+	return slot.keys.Len()
+}
+
+// execClusterCountKeysInSlot command line: cluster countkeysinslot <slot>
+func execClusterCountKeysInSlot(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("cluster|countkeysinslot")
+	}
+	slotID, errReply := parseSlotID(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	return protocol.MakeIntReply(int64(cluster.countKeysInSlot(slotID)))
+}
+
+// execClusterGetKeysInSlot command line: cluster getkeysinslot <slot> <count>
+func execClusterGetKeysInSlot(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("cluster|getkeysinslot")
+	}
+	slotID, errReply := parseSlotID(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil || count < 0 {
+		return protocol.MakeErrReply("ERR Invalid number of keys")
+	}
+	slot := cluster.getHostSlot(slotID)
+	if slot == nil || count == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	slot.mu.RLock()
+	defer slot.mu.RUnlock()
+	var keys [][]byte
+	slot.keys.ForEach(func(key string) bool {
+		keys = append(keys, []byte(key))
+		return len(keys) < count
+	})
+	if len(keys) == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	return protocol.MakeMultiBulkReply(keys)
+}
@@ -12,16 +12,23 @@ func (cluster *Cluster) relay(peerId string, c redis.Connection, cmdLine [][]byt
 	// use a variable to allow injecting stub for testing, see defaultRelayImpl
 	if peerId == cluster.self {
 		// to self db
-		return cluster.Exec(c, cmdLine)
+		return cluster.exec(c, cmdLine)
 	}
 	// peerId is peer.Addr
-	cli, err := cluster.clientFactory.GetPeerClient(peerId)
+	if isBusCommand(cmdLine) {
+		cli, err := cluster.clientFactory.GetBusClient(peerId)
+		if err != nil {
+			return protocol.MakeErrReply(err.Error())
+		}
+		defer func() {
+			_ = cluster.clientFactory.ReturnBusClient(peerId, cli)
+		}()
+		return cli.Send(cmdLine)
+	}
+	cli, err := cluster.clientFactory.GetMuxClient(peerId)
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
-	defer func() {
-		_ = cluster.clientFactory.ReturnPeerClient(peerId, cli)
-	}()
 	return cli.Send(cmdLine)
 }
 
@@ -68,8 +75,8 @@ func (cluster *Cluster) ensureKey(key string) protocol.ErrorReply {
 	if len(dumpResp.Args) != 2 {
 		return protocol.MakeErrReply("illegal dump key response")
 	}
-	// reuse copy to command ^_^
-	resp = cluster.db.Exec(connection.NewFakeConn(), [][]byte{
+	// reuse copy to command ^_^, the key has been locked by invoker
+	resp = cluster.db.ExecWithLock(connection.NewFakeConn(), [][]byte{
 		[]byte("CopyTo"), []byte(key), dumpResp.Args[0], dumpResp.Args[1],
 	})
 	if protocol.IsErrorReply(resp) {
@@ -1,62 +1,129 @@
 package cluster
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"goRedisPlus/config"
+	"goRedisPlus/database"
 	"goRedisPlus/datastruct/dict"
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/pool"
+	"goRedisPlus/lib/tlsutil"
 	"goRedisPlus/lib/utils"
 	"goRedisPlus/redis/client"
 	"goRedisPlus/redis/parser"
 	"goRedisPlus/redis/protocol"
 	"net"
+	"sort"
+	"time"
 )
 
 type defaultClientFactory struct {
 	nodeConnections dict.Dict // map[string]*pool.Pool
+	busConnections  dict.Dict // map[string]*pool.Pool, connections with cluster bus of peers
+	muxConnections  dict.Dict // map[string]*peerMux, shared connections to relay commands, see peer_mux.go
+	tlsConfig       *tls.Config
+	resolveBusAddr  func(peerAddr string) string // returns cluster bus address of peer
 }
 
-var connectionPoolConfig = pool.Config{
-	MaxIdle:   1,
-	MaxActive: 16,
+const (
+	defaultPeerMaxIdleTime   = 300 // seconds
+	defaultPeerCheckInterval = 10  // seconds
+)
+
+// makePoolConfig returns config of connection pools with peers, idle connections are examined by check periodically
+func makePoolConfig(check func(x interface{}) error) pool.Config {
+	maxIdleTime := config.Properties.PeerMaxIdleTime
+	if maxIdleTime == 0 {
+		maxIdleTime = defaultPeerMaxIdleTime
+	}
+	checkInterval := config.Properties.PeerCheckInterval
+	if checkInterval == 0 {
+		checkInterval = defaultPeerCheckInterval
+	}
+	cfg := pool.Config{
+		MaxIdle:   1,
+		MaxActive: 16,
+		Check:     check,
+	}
+	if maxIdleTime > 0 {
+		cfg.MaxIdleTime = time.Duration(maxIdleTime) * time.Second
+	}
+	if config.Properties.PeerMaxLifetime > 0 {
+		cfg.MaxLifetime = time.Duration(config.Properties.PeerMaxLifetime) * time.Second
+	}
+	if checkInterval > 0 {
+		cfg.CheckInterval = time.Duration(checkInterval) * time.Second
+	}
+	return cfg
+}
+
+// pingPeer is health check of idle connections
+func pingPeer(x interface{}) error {
+	cli, ok := x.(peerClient)
+	if !ok {
+		return errors.New("connection pool make wrong type")
+	}
+	reply := cli.Send(utils.ToCmdLine("PING"))
+	if protocol.IsErrorReply(reply) {
+		return errors.New(string(reply.ToBytes()))
+	}
+	return nil
+}
+
+// getPool returns connection pool of peer, makePool is called if the pool not exists
+func getPool(pools dict.Dict, peerAddr string, makePool func() *pool.Pool) *pool.Pool {
+	if raw, ok := pools.Get(peerAddr); ok {
+		return raw.(*pool.Pool)
+	}
+	connectionPool := makePool()
+	if pools.PutIfAbsent(peerAddr, connectionPool) == 0 {
+		// another goroutine has made one
+		connectionPool.Close()
+		raw, _ := pools.Get(peerAddr)
+		return raw.(*pool.Pool)
+	}
+	return connectionPool
+}
+
+// returnToPool puts client back to pool, or destroys it if its connection is broken
+func returnToPool(pools dict.Dict, peerAddr string, peerClient peerClient) error {
+	raw, ok := pools.Get(peerAddr)
+	if !ok {
+		return errors.New("connection pool not found")
+	}
+	if cli, ok := peerClient.(interface{ Broken() bool }); ok && cli.Broken() {
+		raw.(*pool.Pool).Discard(peerClient)
+		return nil
+	}
+	raw.(*pool.Pool).Put(peerClient)
+	return nil
 }
 
 // GetPeerClient gets a client with peer form pool
 func (factory *defaultClientFactory) GetPeerClient(peerAddr string) (peerClient, error) {
-	var connectionPool *pool.Pool
-	raw, ok := factory.nodeConnections.Get(peerAddr)
-	if !ok {
+	connectionPool := getPool(factory.nodeConnections, peerAddr, func() *pool.Pool {
 		creator := func() (interface{}, error) {
-			c, err := client.MakeClient(peerAddr)
+			c, err := client.MakeClientWithConfig(peerAddr, factory.getPeerConfig())
 			if err != nil {
 				return nil, err
 			}
 			c.Start()
-			// all peers of cluster should use the same password
-			if config.Properties.RequirePass != "" {
-				authResp := c.Send(utils.ToCmdLine("AUTH", config.Properties.RequirePass))
-				if !protocol.IsOKReply(authResp) {
-					return nil, fmt.Errorf("auth failed, resp: %s", string(authResp.ToBytes()))
-				}
-			}
 			return c, nil
 		}
 		finalizer := func(x interface{}) {
 			logger.Debug("destroy client")
-			cli, ok := x.(client.Client)
+			cli, ok := x.(*client.Client)
 			if !ok {
 				return
 			}
 			cli.Close()
 		}
-		connectionPool = pool.New(creator, finalizer, connectionPoolConfig)
-		factory.nodeConnections.Put(peerAddr, connectionPool)
-	} else {
-		connectionPool = raw.(*pool.Pool)
-	}
+		return pool.New(creator, finalizer, makePoolConfig(pingPeer))
+	})
 	raw, err := connectionPool.Get()
 	if err != nil {
 		return nil, err
@@ -70,12 +137,77 @@ func (factory *defaultClientFactory) GetPeerClient(peerAddr string) (peerClient,
 
 // ReturnPeerClient returns client to pool
 func (factory *defaultClientFactory) ReturnPeerClient(peer string, peerClient peerClient) error {
-	raw, ok := factory.nodeConnections.Get(peer)
+	return returnToPool(factory.nodeConnections, peer, peerClient)
+}
+
+// GetBusClient gets a client with cluster bus of peer from pool
+func (factory *defaultClientFactory) GetBusClient(peerAddr string) (peerClient, error) {
+	connectionPool := getPool(factory.busConnections, peerAddr, func() *pool.Pool {
+		creator := func() (interface{}, error) {
+			// resolve every time, bus address of the peer may be learned from topology later
+			return makeBusClient(factory.resolveBusAddr(peerAddr), factory.getBusConfig())
+		}
+		finalizer := func(x interface{}) {
+			if cli, ok := x.(*busClient); ok {
+				cli.Close()
+			}
+		}
+		return pool.New(creator, finalizer, makePoolConfig(pingPeer))
+	})
+	raw, err := connectionPool.Get()
+	if err != nil {
+		return nil, err
+	}
+	cli, ok := raw.(*busClient)
 	if !ok {
-		return errors.New("connection pool not found")
+		return nil, errors.New("connection pool make wrong type")
 	}
-	raw.(*pool.Pool).Put(peerClient)
-	return nil
+	return cli, nil
+}
+
+// ReturnBusClient returns client of cluster bus to pool
+func (factory *defaultClientFactory) ReturnBusClient(peer string, peerClient peerClient) error {
+	return returnToPool(factory.busConnections, peer, peerClient)
+}
+
+const (
+	poolTypeClient = "client"
+	poolTypeBus    = "bus"
+	poolTypeMux    = "mux"
+)
+
+// peerPoolStat is statistics of connection pool with a peer
+type peerPoolStat struct {
+	peerAddr string
+	poolType string
+	stats    pool.Stats
+}
+
+// PoolStats returns statistics of connection pools, sorted by address of peer
+func (factory *defaultClientFactory) PoolStats() []*peerPoolStat {
+	var result []*peerPoolStat
+	collect := func(pools dict.Dict, poolType string) {
+		pools.ForEach(func(key string, val interface{}) bool {
+			stat := &peerPoolStat{
+				peerAddr: key,
+				poolType: poolType,
+			}
+			if mux, ok := val.(*peerMux); ok {
+				stat.stats = mux.stats()
+			} else {
+				stat.stats = val.(*pool.Pool).Stats()
+			}
+			result = append(result, stat)
+			return true
+		})
+	}
+	collect(factory.nodeConnections, poolTypeClient)
+	collect(factory.busConnections, poolTypeBus)
+	collect(factory.muxConnections, poolTypeMux)
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].peerAddr < result[j].peerAddr
+	})
+	return result
 }
 
 type tcpStream struct {
@@ -93,7 +225,8 @@ func (s *tcpStream) Close() error {
 
 func (factory *defaultClientFactory) NewStream(peerAddr string, cmdLine CmdLine) (peerStream, error) {
 	// todo: reuse connection
-	conn, err := net.Dial("tcp", peerAddr)
+	cfg := factory.getPeerConfig()
+	conn, err := tlsutil.Dial(peerAddr, cfg.TLS, peerDialTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("connect with %s failed: %v", peerAddr, err)
 	}
@@ -110,9 +243,14 @@ func (factory *defaultClientFactory) NewStream(peerAddr string, cmdLine CmdLine)
 		}
 		return resp.Data
 	}
-	if config.Properties.RequirePass != "" {
-		authResp := send2node(utils.ToCmdLine("AUTH", config.Properties.RequirePass))
+	if cfg.Password != "" {
+		authCmd := utils.ToCmdLine("AUTH", cfg.Password)
+		if cfg.User != "" {
+			authCmd = utils.ToCmdLine("AUTH", cfg.User, cfg.Password)
+		}
+		authResp := send2node(authCmd)
 		if !protocol.IsOKReply(authResp) {
+			_ = conn.Close()
 			return nil, fmt.Errorf("auth failed, resp: %s", string(authResp.ToBytes()))
 		}
 	}
@@ -127,10 +265,62 @@ func (factory *defaultClientFactory) NewStream(peerAddr string, cmdLine CmdLine)
 	}, nil
 }
 
+const peerDialTimeout = 3 * time.Second
+
 func newDefaultClientFactory() *defaultClientFactory {
-	return &defaultClientFactory{
+	factory := &defaultClientFactory{
 		nodeConnections: dict.MakeConcurrent(1),
+		busConnections:  dict.MakeConcurrent(1),
+		muxConnections:  dict.MakeConcurrent(1),
+		resolveBusAddr:  getBusAddr,
+	}
+	if config.Properties.TLSEnabled || config.Properties.TLSCluster {
+		tlsConfig, err := tlsutil.MakeClientConfig(config.Properties.TLSCertFile, config.Properties.TLSKeyFile,
+			config.Properties.TLSCACertFile)
+		if err != nil {
+			panic(fmt.Errorf("tls of peer connections: %v", err))
+		}
+		factory.tlsConfig = tlsConfig
 	}
+	return factory
+}
+
+// getPeerAuth returns credential to authenticate with peers, all peers of cluster should accept the same credential
+func getPeerAuth() (string, string) {
+	if config.Properties.ClusterAuthPass != "" {
+		return config.Properties.ClusterAuthUser, config.Properties.ClusterAuthPass
+	}
+	if database.IsPasswordHash(config.Properties.RequirePass) {
+		// plaintext of hashed requirepass is unknown, cluster-auth-pass is required
+		return "", ""
+	}
+	return "", config.Properties.RequirePass
+}
+
+// getPeerConfig returns config of connections with client port of peers
+func (factory *defaultClientFactory) getPeerConfig() *client.Config {
+	user, password := getPeerAuth()
+	cfg := &client.Config{
+		User:     user,
+		Password: password,
+	}
+	if config.Properties.TLSEnabled {
+		cfg.TLS = factory.tlsConfig
+	}
+	return cfg
+}
+
+// getBusConfig returns config of connections with cluster bus of peers
+func (factory *defaultClientFactory) getBusConfig() *client.Config {
+	user, password := getPeerAuth()
+	cfg := &client.Config{
+		User:     user,
+		Password: password,
+	}
+	if config.Properties.TLSCluster {
+		cfg.TLS = factory.tlsConfig
+	}
+	return cfg
 }
 
 func (factory *defaultClientFactory) Close() error {
@@ -138,5 +328,29 @@ func (factory *defaultClientFactory) Close() error {
 		val.(*pool.Pool).Close()
 		return true
 	})
+	factory.busConnections.ForEach(func(key string, val interface{}) bool {
+		val.(*pool.Pool).Close()
+		return true
+	})
+	factory.muxConnections.ForEach(func(key string, val interface{}) bool {
+		val.(*peerMux).close()
+		return true
+	})
 	return nil
 }
+
+// genPeersInfo returns statistics of connection pools with peers in format of INFO:
+// peer0:addr=127.0.0.1:6399,type=mux,active=2,idle=0,waiting=0,created=3,destroyed=1,broken=1
+// type is client (pooled connections), bus (pooled connections with cluster bus) or mux (see peer_mux.go)
+func (cluster *Cluster) genPeersInfo() []byte {
+	stats := cluster.clientFactory.PoolStats()
+	buf := &bytes.Buffer{}
+	buf.WriteString("# Peers\r\n")
+	buf.WriteString(fmt.Sprintf("peer_pools:%d\r\n", len(stats)))
+	for i, stat := range stats {
+		buf.WriteString(fmt.Sprintf("peer%d:addr=%s,type=%s,active=%d,idle=%d,waiting=%d,created=%d,destroyed=%d,broken=%d\r\n",
+			i, stat.peerAddr, stat.poolType, stat.stats.Active, stat.stats.Idle, stat.stats.Waiting,
+			stat.stats.Created, stat.stats.Destroyed, stat.stats.Broken))
+	}
+	return buf.Bytes()
+}
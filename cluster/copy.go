@@ -45,7 +45,7 @@ func Copy(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		destNode: {destKey},
 	}
 
-	txID := cluster.idGenerator.NextID()
+	txID := cluster.beginTransaction(groupMap)
 	txIDStr := strconv.FormatInt(txID, 10)
 	// prepare Copy from
 	srcPrepareResp := cluster.relay(srcNode, c, makeArgs("Prepare", txIDStr, "CopyFrom", srcKey))
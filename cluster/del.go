@@ -4,13 +4,24 @@ import (
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/redis/protocol"
 	"strconv"
+	"strings"
 )
 
 // Del atomically removes given writeKeys from cluster, writeKeys can be distributed on any node
 // if the given writeKeys are distributed on different node, Del will use try-commit-catch to remove them
 func Del(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return cluster.removeKeys(c, "Del", args)
+}
+
+// Unlink removes keys like Del, big values are freed in background by nodes owning them
+func Unlink(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return cluster.removeKeys(c, "Unlink", args)
+}
+
+// removeKeys executes Del or Unlink on nodes owning keys
+func (cluster *Cluster) removeKeys(c redis.Connection, cmdName string, args [][]byte) redis.Reply {
 	if len(args) < 2 {
-		return protocol.MakeErrReply("ERR wrong number of arguments for 'del' command")
+		return protocol.MakeArgNumErrReply(strings.ToLower(cmdName))
 	}
 	keys := make([]string, len(args)-1)
 	for i := 1; i < len(args); i++ {
@@ -19,17 +30,17 @@ func Del(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	groupMap := cluster.groupBy(keys)
 	if len(groupMap) == 1 && allowFastTransaction { // do fast
 		for peer, group := range groupMap { // only one peerKeys
-			return cluster.relay(peer, c, makeArgs("Del_", group...))
+			return cluster.relay(peer, c, makeArgs(cmdName+"_", group...))
 		}
 	}
 	// prepare
 	var errReply redis.Reply
-	txID := cluster.idGenerator.NextID()
+	txID := cluster.beginTransaction(groupMap)
 	txIDStr := strconv.FormatInt(txID, 10)
 	rollback := false
-	for peer, peerKeys := range groupMap {
-		peerArgs := []string{txIDStr, "DEL"}
-		peerArgs = append(peerArgs, peerKeys...)
+	for _, peer := range prepareOrder(groupMap) {
+		peerArgs := []string{txIDStr, strings.ToUpper(cmdName)}
+		peerArgs = append(peerArgs, groupMap[peer]...)
 		var resp redis.Reply
 		resp = cluster.relay(peer, c, makeArgs("Prepare", peerArgs...))
 		if protocol.IsErrorReply(resp) {
@@ -0,0 +1,142 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etcdClient is a minimal client of etcd v3 based on its JSON gateway (/v3/kv/*),
+// so that we don't have to depend on the grpc client of etcd
+type etcdClient struct {
+	endpoints  []string
+	httpClient *http.Client
+}
+
+const etcdRequestTimeout = 3 * time.Second
+
+func makeEtcdClient(endpoints []string) *etcdClient {
+	var urls []string
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+			endpoint = "http://" + endpoint
+		}
+		urls = append(urls, strings.TrimSuffix(endpoint, "/"))
+	}
+	return &etcdClient{
+		endpoints: urls,
+		httpClient: &http.Client{
+			Timeout: etcdRequestTimeout,
+		},
+	}
+}
+
+type etcdKeyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []*etcdKeyValue `json:"kvs"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+// post sends request to endpoints in order until one of them replies
+func (cli *etcdClient) post(path string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if len(cli.endpoints) == 0 {
+		return errors.New("no etcd endpoint")
+	}
+	var lastErr error
+	for _, endpoint := range cli.endpoints {
+		httpResp, err := cli.httpClient.Post(endpoint+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		err = func() error {
+			defer func() {
+				_ = httpResp.Body.Close()
+			}()
+			if httpResp.StatusCode != http.StatusOK {
+				return fmt.Errorf("etcd %s replies %s", endpoint, httpResp.Status)
+			}
+			return json.NewDecoder(httpResp.Body).Decode(resp)
+		}()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// get returns value and mod revision of key, revision is 0 if key not exists
+func (cli *etcdClient) get(key string) ([]byte, int64, error) {
+	req := map[string]interface{}{
+		"key": base64.StdEncoding.EncodeToString([]byte(key)),
+	}
+	resp := &etcdRangeResponse{}
+	if err := cli.post("/v3/kv/range", req, resp); err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	kv := resp.Kvs[0]
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("illegal value from etcd: %v", err)
+	}
+	revision, err := strconv.ParseInt(kv.ModRevision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("illegal revision from etcd: %s", kv.ModRevision)
+	}
+	return value, revision, nil
+}
+
+// compareAndSwap puts value if mod revision of key is still the given revision, 0 means key not exists
+func (cli *etcdClient) compareAndSwap(key string, revision int64, value []byte) (bool, error) {
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	req := map[string]interface{}{
+		"compare": []map[string]interface{}{
+			{
+				"key":          encodedKey,
+				"target":       "MOD",
+				"result":       "EQUAL",
+				"mod_revision": strconv.FormatInt(revision, 10),
+			},
+		},
+		"success": []map[string]interface{}{
+			{
+				"request_put": map[string]interface{}{
+					"key":   encodedKey,
+					"value": base64.StdEncoding.EncodeToString(value),
+				},
+			},
+		},
+	}
+	resp := &etcdTxnResponse{}
+	if err := cli.post("/v3/kv/txn", req, resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
@@ -0,0 +1,431 @@
+package cluster
+
+import (
+	"bytes"
+	"goRedisPlus/config"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/redis/protocol"
+	"sort"
+	"sync"
+	"time"
+)
+
+// etcdTopology delegates consensus of membership and slot map to etcd instead of embedded raft.
+// The whole topology is stored in key <cluster-etcd-prefix>topology as lines of nodes (see marshalNodes),
+// every change is a read-modify-write guarded by the mod revision of the key, so concurrent changes will retry.
+// Nodes poll the key to find changes made by others.
+type etcdTopology struct {
+	cluster *Cluster
+	client  *etcdClient
+	key     string
+
+	mu         sync.RWMutex
+	selfNodeID string
+	nodes      map[string]*Node
+	slots      []*Slot
+	revision   int64 // mod revision of the topology key applied
+
+	watching  bool
+	closeChan chan struct{}
+}
+
+const (
+	etcdPollInterval   = time.Second
+	etcdMaxCASAttempts = 16
+	etcdDefaultPrefix  = "/godis/"
+)
+
+func newEtcdTopology(cluster *Cluster) *etcdTopology {
+	prefix := config.Properties.EtcdPrefix
+	if prefix == "" {
+		prefix = etcdDefaultPrefix
+	}
+	return &etcdTopology{
+		cluster:   cluster,
+		client:    makeEtcdClient(config.Properties.EtcdEndpoints),
+		key:       prefix + "topology",
+		nodes:     make(map[string]*Node),
+		slots:     make([]*Slot, slotCount),
+		closeChan: make(chan struct{}),
+	}
+}
+
+func marshalTopology(nodes map[string]*Node) []byte {
+	return bytes.Join(marshalNodes(nodes), []byte{'\n'})
+}
+
+func unmarshalTopology(value []byte) (map[string]*Node, error) {
+	if len(value) == 0 {
+		return make(map[string]*Node), nil
+	}
+	return unmarshalNodes(bytes.Split(value, []byte{'\n'}))
+}
+
+// makeSlotsOfNodes returns slots indexed by id, slot objects are shared with node.Slots
+func makeSlotsOfNodes(nodes map[string]*Node) []*Slot {
+	slots := make([]*Slot, slotCount)
+	for _, node := range nodes {
+		for _, slot := range node.Slots {
+			slots[int(slot.ID)] = slot
+		}
+	}
+	return slots
+}
+
+// fetch reads the latest topology from etcd
+func (topo *etcdTopology) fetch() (map[string]*Node, int64, error) {
+	value, revision, err := topo.client.get(topo.key)
+	if err != nil {
+		return nil, 0, err
+	}
+	nodes, err := unmarshalTopology(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return nodes, revision, nil
+}
+
+// install replaces local topology if it is newer, and notifies subscribers of changes
+func (topo *etcdTopology) install(nodes map[string]*Node, revision int64) {
+	topo.mu.Lock()
+	if revision <= topo.revision {
+		topo.mu.Unlock()
+		return
+	}
+	for id, node := range nodes {
+		if old := topo.nodes[id]; old != nil {
+			node.lastHeard = old.lastHeard
+		}
+	}
+	messages := diffTopology(topo.nodes, nodes)
+	topo.nodes = nodes
+	topo.slots = makeSlotsOfNodes(nodes)
+	topo.revision = revision
+	topo.mu.Unlock()
+	if len(messages) > 0 {
+		go topo.cluster.publishTopologyMessages(messages)
+	}
+}
+
+// update applies change to the latest topology in etcd, retries if others have changed it meanwhile
+func (topo *etcdTopology) update(change func(nodes map[string]*Node) protocol.ErrorReply) protocol.ErrorReply {
+	for i := 0; i < etcdMaxCASAttempts; i++ {
+		nodes, revision, err := topo.fetch()
+		if err != nil {
+			return protocol.MakeErrReply("ERR read topology from etcd failed: " + err.Error())
+		}
+		if errReply := change(nodes); errReply != nil {
+			return errReply
+		}
+		value := marshalTopology(nodes)
+		ok, err := topo.client.compareAndSwap(topo.key, revision, value)
+		if err != nil {
+			return protocol.MakeErrReply("ERR write topology to etcd failed: " + err.Error())
+		}
+		if ok {
+			// fetch again to get the new revision
+			if nodes, revision, err := topo.fetch(); err == nil {
+				topo.install(nodes, revision)
+			}
+			return nil
+		}
+	}
+	return protocol.MakeErrReply("ERR topology in etcd is changing too frequently, try later")
+}
+
+// watch polls etcd for changes made by other nodes
+func (topo *etcdTopology) watch() {
+	topo.mu.Lock()
+	if topo.watching {
+		topo.mu.Unlock()
+		return
+	}
+	topo.watching = true
+	topo.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(etcdPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				nodes, revision, err := topo.fetch()
+				if err != nil {
+					logger.Warn("read topology from etcd failed: " + err.Error())
+					continue
+				}
+				topo.install(nodes, revision)
+			case <-topo.closeChan:
+				return
+			}
+		}
+	}()
+}
+
+func (topo *etcdTopology) GetSelfNodeID() string {
+	topo.mu.RLock()
+	defer topo.mu.RUnlock()
+	return topo.selfNodeID
+}
+
+func (topo *etcdTopology) GetNodes() []*Node {
+	topo.mu.RLock()
+	defer topo.mu.RUnlock()
+	result := make([]*Node, 0, len(topo.nodes))
+	for _, v := range topo.nodes {
+		result = append(result, v)
+	}
+	return result
+}
+
+func (topo *etcdTopology) GetNode(nodeID string) *Node {
+	topo.mu.RLock()
+	defer topo.mu.RUnlock()
+	return topo.nodes[nodeID]
+}
+
+func (topo *etcdTopology) GetSlots() []*Slot {
+	topo.mu.RLock()
+	defer topo.mu.RUnlock()
+	return topo.slots
+}
+
+// getRevision returns mod revision of topology, it is shown as epoch of cluster
+func (topo *etcdTopology) getRevision() int64 {
+	topo.mu.RLock()
+	defer topo.mu.RUnlock()
+	return topo.revision
+}
+
+func (topo *etcdTopology) setSelf(nodeID string) {
+	topo.mu.Lock()
+	topo.selfNodeID = nodeID
+	topo.mu.Unlock()
+	topo.cluster.self = nodeID
+}
+
+// StartAsSeed creates topology in etcd, current node claims all slots
+func (topo *etcdTopology) StartAsSeed(addr string) protocol.ErrorReply {
+	err := topo.update(func(nodes map[string]*Node) protocol.ErrorReply {
+		if len(nodes) > 0 {
+			return protocol.MakeErrReply("ERR topology exists in etcd, join it instead of starting as seed")
+		}
+		node := &Node{
+			ID:          addr,
+			Addr:        addr,
+			BusAddr:     getAnnounceBusAddr(addr),
+			ConfigEpoch: 1,
+		}
+		for i := 0; i < slotCount; i++ {
+			node.Slots = append(node.Slots, &Slot{
+				ID:     uint32(i),
+				NodeID: addr,
+			})
+		}
+		nodes[addr] = node
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	topo.setSelf(addr)
+	topo.watch()
+	return nil
+}
+
+// LoadConfigFile loads topology from etcd, returns errConfigFileNotExist if current node is not a member
+func (topo *etcdTopology) LoadConfigFile() protocol.ErrorReply {
+	nodes, revision, err := topo.fetch()
+	if err != nil {
+		return protocol.MakeErrReply("ERR read topology from etcd failed: " + err.Error())
+	}
+	selfNodeID := topo.cluster.addr
+	if nodes[selfNodeID] == nil {
+		return errConfigFileNotExist
+	}
+	topo.install(nodes, revision)
+	topo.setSelf(selfNodeID)
+	topo.watch()
+	return nil
+}
+
+// Join adds current node into topology in etcd, seed is useless since etcd knows all members
+func (topo *etcdTopology) Join(seed string) protocol.ErrorReply {
+	selfNodeID := topo.cluster.addr
+	err := topo.update(func(nodes map[string]*Node) protocol.ErrorReply {
+		if len(nodes) == 0 {
+			return protocol.MakeErrReply("ERR no topology in etcd, start a node as seed first")
+		}
+		if nodes[selfNodeID] == nil {
+			nodes[selfNodeID] = &Node{
+				ID:      selfNodeID,
+				Addr:    selfNodeID,
+				BusAddr: getAnnounceBusAddr(selfNodeID),
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	topo.setSelf(selfNodeID)
+	topo.watch()
+	return nil
+}
+
+func (topo *etcdTopology) SetSlot(slotIDs []uint32, newNodeID string) protocol.ErrorReply {
+	return topo.update(func(nodes map[string]*Node) protocol.ErrorReply {
+		newNode := nodes[newNodeID]
+		if newNode == nil {
+			return protocol.MakeErrReply("ERR Unknown node " + newNodeID)
+		}
+		slots := makeSlotsOfNodes(nodes)
+		moving := make(map[uint32]struct{}, len(slotIDs))
+		for _, slotID := range slotIDs {
+			moving[slotID] = struct{}{}
+		}
+		for _, node := range nodes {
+			if node == newNode {
+				continue
+			}
+			remaining := node.Slots[:0]
+			for _, slot := range node.Slots {
+				if _, ok := moving[slot.ID]; !ok {
+					remaining = append(remaining, slot)
+				}
+			}
+			node.Slots = remaining
+		}
+		for _, slotID := range slotIDs {
+			slot := slots[slotID]
+			if slot != nil && slot.NodeID == newNodeID {
+				continue
+			}
+			newNode.Slots = append(newNode.Slots, &Slot{
+				ID:     slotID,
+				NodeID: newNodeID,
+			})
+		}
+		if len(slotIDs) > 0 {
+			bumpConfigEpoch(nodes, newNode)
+		}
+		return nil
+	})
+}
+
+func (topo *etcdTopology) RemoveNode(nodeID string) protocol.ErrorReply {
+	return topo.update(func(nodes map[string]*Node) protocol.ErrorReply {
+		delete(nodes, nodeID)
+		return nil
+	})
+}
+
+func (topo *etcdTopology) SetMaster(nodeID string, masterID string) protocol.ErrorReply {
+	return topo.update(func(nodes map[string]*Node) protocol.ErrorReply {
+		node := nodes[nodeID]
+		if node == nil {
+			return protocol.MakeErrReply("ERR Unknown node " + nodeID)
+		}
+		node.MasterID = masterID
+		return nil
+	})
+}
+
+// Failover promotes replica nodeID to take over slots of its master masterID, the former master becomes its replica
+func (topo *etcdTopology) Failover(nodeID string, masterID string) protocol.ErrorReply {
+	return topo.update(func(nodes map[string]*Node) protocol.ErrorReply {
+		replica := nodes[nodeID]
+		if replica == nil || replica.MasterID != masterID {
+			return protocol.MakeErrReply("ERR " + nodeID + " is not a replica of " + masterID)
+		}
+		for _, node := range nodes {
+			if node.MasterID == masterID {
+				node.MasterID = replica.ID
+			}
+		}
+		replica.MasterID = ""
+		bumpConfigEpoch(nodes, replica)
+		if master := nodes[masterID]; master != nil {
+			for _, slot := range master.Slots {
+				slot.NodeID = replica.ID
+				replica.Slots = append(replica.Slots, slot)
+			}
+			master.Slots = nil
+			master.MasterID = replica.ID
+		}
+		return nil
+	})
+}
+
+func (topo *etcdTopology) TransferLeader(nodeID string) protocol.ErrorReply {
+	return protocol.MakeErrReply("ERR etcd topology has no leader")
+}
+
+func (topo *etcdTopology) PromoteLearner(nodeID string) protocol.ErrorReply {
+	return protocol.MakeErrReply("ERR etcd topology does not support learners")
+}
+
+func (topo *etcdTopology) Close() error {
+	close(topo.closeChan)
+	return nil
+}
+
+// diffTopology returns topology notifications for changes from old nodes to new nodes, see topo_notify.go
+func diffTopology(oldNodes, newNodes map[string]*Node) []string {
+	var messages []string
+	var added, removed []string
+	for id := range newNodes {
+		if oldNodes[id] == nil {
+			added = append(added, id)
+		}
+	}
+	for id := range oldNodes {
+		if newNodes[id] == nil {
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	for _, id := range added {
+		messages = append(messages, makeTopologyMessage(&logEntry{Event: eventNewNode, NodeID: id}))
+	}
+
+	// slots moved to each node
+	oldSlots := makeSlotsOfNodes(oldNodes)
+	moved := make(map[string][]uint32)
+	var targets []string
+	for _, node := range newNodes {
+		for _, slot := range node.Slots {
+			old := oldSlots[int(slot.ID)]
+			if old != nil && old.NodeID == node.ID {
+				continue
+			}
+			if len(moved[node.ID]) == 0 {
+				targets = append(targets, node.ID)
+			}
+			moved[node.ID] = append(moved[node.ID], slot.ID)
+		}
+	}
+	sort.Strings(targets)
+	for _, id := range targets {
+		messages = append(messages, makeTopologyMessage(&logEntry{Event: eventSetSlot, NodeID: id, SlotIDs: moved[id]}))
+	}
+
+	var ids []string
+	for id := range newNodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		node := newNodes[id]
+		old := oldNodes[id]
+		if old == nil && node.MasterID == "" || old != nil && old.MasterID == node.MasterID {
+			continue
+		}
+		messages = append(messages, makeTopologyMessage(&logEntry{Event: eventSetMaster, NodeID: id, MasterID: node.MasterID}))
+	}
+
+	for _, id := range removed {
+		messages = append(messages, makeTopologyMessage(&logEntry{Event: eventRemoveNode, NodeID: id}))
+	}
+	return messages
+}
@@ -53,6 +53,26 @@ func (fixed *fixedTopology) SetSlot(slotIDs []uint32, newNodeID string) protocol
 	return protocol.MakeErrReply("fixed topology does not support set slots")
 }
 
+func (fixed *fixedTopology) RemoveNode(nodeID string) protocol.ErrorReply {
+	return protocol.MakeErrReply("fixed topology does not support remove node")
+}
+
+func (fixed *fixedTopology) SetMaster(nodeID string, masterID string) protocol.ErrorReply {
+	return protocol.MakeErrReply("fixed topology does not support replicas")
+}
+
+func (fixed *fixedTopology) Failover(nodeID string, masterID string) protocol.ErrorReply {
+	return protocol.MakeErrReply("fixed topology does not support failover")
+}
+
+func (fixed *fixedTopology) TransferLeader(nodeID string) protocol.ErrorReply {
+	return protocol.MakeErrReply("fixed topology does not support leadership transfer")
+}
+
+func (fixed *fixedTopology) PromoteLearner(nodeID string) protocol.ErrorReply {
+	return protocol.MakeErrReply("fixed topology does not support learners")
+}
+
 func (fixed *fixedTopology) Close() error {
 	return nil
 }
@@ -0,0 +1,307 @@
+package cluster
+
+import (
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Failure detection:
+// Every node pings other nodes each second by `gcluster ping`, ping and pong carry states of all nodes in the view of sender.
+// If a node does not reply pong within cluster-node-timeout, current node marks it as PFAIL (possible failure).
+// A PFAIL node is promoted to FAIL once majority of masters (nodes hosting slots) report it as PFAIL or FAIL,
+// a report expires after 2 * cluster-node-timeout.
+// FAIL state spreads to nodes which also consider the node as PFAIL, and it is cleared when the node is reachable again.
+// Ping and pong also carry slots claimed by sender with their epochs to resolve ownership conflicts, see slot_epoch.go.
+// And replication offset of sender, which is reported by CLUSTER SHARDS.
+
+const (
+	nodeHealthOK = iota
+	nodeHealthPFail
+	nodeHealthFail
+)
+
+var healthNames = map[int]string{
+	nodeHealthOK:    "ok",
+	nodeHealthPFail: "pfail",
+	nodeHealthFail:  "fail",
+}
+
+const (
+	gossipPeriod       = time.Second
+	defaultNodeTimeout = 15 * time.Second
+)
+
+type nodeHealth struct {
+	state       int
+	pingSent    time.Time // zero if there is no ping waiting for pong
+	pongRecv    time.Time
+	pinging     bool                 // a ping goroutine is running
+	failReports map[string]time.Time // reporter node id -> last report time
+	replOffset  int64                // replication offset carried by the last ping or pong from the node
+}
+
+type failureDetector struct {
+	mu    sync.Mutex
+	nodes map[string]*nodeHealth
+}
+
+func makeFailureDetector() *failureDetector {
+	return &failureDetector{
+		nodes: make(map[string]*nodeHealth),
+	}
+}
+
+func getNodeTimeout() time.Duration {
+	if config.Properties.ClusterNodeTimeout <= 0 {
+		return defaultNodeTimeout
+	}
+	return time.Duration(config.Properties.ClusterNodeTimeout) * time.Millisecond
+}
+
+// getWithinLock returns health of the node, invoker should provide lock
+func (fd *failureDetector) getWithinLock(nodeID string) *nodeHealth {
+	health := fd.nodes[nodeID]
+	if health == nil {
+		health = &nodeHealth{
+			pongRecv:    time.Now(), // give new node a full timeout
+			failReports: make(map[string]time.Time),
+		}
+		fd.nodes[nodeID] = health
+	}
+	return health
+}
+
+// getNodeHealth returns failure state, ping sent time and pong received time of the node
+func (cluster *Cluster) getNodeHealth(nodeID string) (int, time.Time, time.Time) {
+	fd := cluster.detector
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	health := fd.nodes[nodeID]
+	if health == nil {
+		return nodeHealthOK, time.Time{}, time.Time{}
+	}
+	return health.state, health.pingSent, health.pongRecv
+}
+
+// getNodeReplOffset returns replication offset of the node, offsets of other nodes come from gossip
+func (cluster *Cluster) getNodeReplOffset(nodeID string) int64 {
+	if nodeID == cluster.self {
+		return cluster.db.GetReplOffset()
+	}
+	fd := cluster.detector
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if health := fd.nodes[nodeID]; health != nil {
+		return health.replOffset
+	}
+	return 0
+}
+
+// isNodeFailed returns whether the node has been marked as FAIL
+func (cluster *Cluster) isNodeFailed(nodeID string) bool {
+	state, _, _ := cluster.getNodeHealth(nodeID)
+	return state == nodeHealthFail
+}
+
+func (cluster *Cluster) gossipCron() {
+	ticker := time.NewTicker(gossipPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if cluster.topology.GetSelfNodeID() == "" {
+				continue // not joined any cluster yet
+			}
+			cluster.checkNodeHealth()
+			cluster.resolveSlotConflicts()
+			cluster.sendPings()
+			cluster.syncReplicaRole()
+			cluster.tryFailover()
+			cluster.advertiseKeyspaceSubs()
+		case <-cluster.closeChan:
+			return
+		}
+	}
+}
+
+// makeGossip returns slots claimed by current node, its replication offset and states of all known nodes:
+// claims replOffset [nodeID, state]...
+func (cluster *Cluster) makeGossip() [][]byte {
+	claims := marshalSlotClaims(cluster.getSlotClaims())
+	replOffset := cluster.db.GetReplOffset()
+	nodes := cluster.topology.GetNodes()
+	fd := cluster.detector
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	result := make([][]byte, 0, 2*len(nodes)+2)
+	result = append(result, []byte(claims), []byte(strconv.FormatInt(replOffset, 10)))
+	for _, node := range nodes {
+		state := nodeHealthOK
+		if health := fd.nodes[node.ID]; health != nil {
+			state = health.state
+		}
+		result = append(result, []byte(node.ID), []byte(healthNames[state]))
+	}
+	return result
+}
+
+func (cluster *Cluster) sendPings() {
+	cmdLine := append(utils.ToCmdLine("gcluster", "ping", cluster.self), cluster.makeGossip()...)
+	fd := cluster.detector
+	for _, node := range cluster.topology.GetNodes() {
+		if node.ID == cluster.self {
+			continue
+		}
+		nodeID := node.ID
+		fd.mu.Lock()
+		health := fd.getWithinLock(nodeID)
+		if health.pinging {
+			fd.mu.Unlock()
+			continue
+		}
+		health.pinging = true
+		if health.pingSent.IsZero() {
+			health.pingSent = time.Now()
+		}
+		fd.mu.Unlock()
+		go func() {
+			reply := cluster.relay(nodeID, connection.NewFakeConn(), cmdLine)
+			fd.mu.Lock()
+			fd.getWithinLock(nodeID).pinging = false
+			fd.mu.Unlock()
+			if protocol.IsErrorReply(reply) {
+				logger.Debugf("ping %s failed: %s", nodeID, string(reply.ToBytes()))
+				return
+			}
+			var gossip [][]byte
+			if pong, ok := reply.(*protocol.MultiBulkReply); ok {
+				gossip = pong.Args
+			}
+			cluster.receiveGossip(nodeID, gossip)
+		}()
+	}
+}
+
+// receiveGossip handles ping or pong from sender
+func (cluster *Cluster) receiveGossip(sender string, gossip [][]byte) {
+	if len(gossip) > 0 {
+		claims, err := unmarshalSlotClaims(string(gossip[0]))
+		if err != nil {
+			logger.Warn(fmt.Sprintf("illegal slot claims from %s: %v", sender, err))
+		} else if cluster.topology.GetNode(sender) != nil {
+			cluster.receiveSlotClaims(sender, claims)
+		}
+		gossip = gossip[1:]
+	}
+	var replOffset int64
+	if len(gossip) > 0 {
+		replOffset, _ = strconv.ParseInt(string(gossip[0]), 10, 64)
+		gossip = gossip[1:]
+	}
+	fd := cluster.detector
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	now := time.Now()
+	health := fd.getWithinLock(sender)
+	health.replOffset = replOffset
+	health.pongRecv = now
+	health.pingSent = time.Time{}
+	if health.state != nodeHealthOK {
+		logger.Infof("node %s is reachable again, clear %s state", sender, healthNames[health.state])
+		health.state = nodeHealthOK
+		health.failReports = make(map[string]time.Time)
+	}
+	for i := 0; i+1 < len(gossip); i += 2 {
+		nodeID := string(gossip[i])
+		if nodeID == cluster.self || nodeID == sender || cluster.topology.GetNode(nodeID) == nil {
+			continue
+		}
+		target := fd.getWithinLock(nodeID)
+		switch string(gossip[i+1]) {
+		case healthNames[nodeHealthOK]:
+			delete(target.failReports, sender)
+		case healthNames[nodeHealthPFail]:
+			target.failReports[sender] = now
+		case healthNames[nodeHealthFail]:
+			target.failReports[sender] = now
+			// accept FAIL only if current node could not reach it either
+			if target.state == nodeHealthPFail {
+				logger.Warn(fmt.Sprintf("node %s is marked as FAIL by %s", nodeID, sender))
+				target.state = nodeHealthFail
+			}
+		}
+	}
+}
+
+// checkNodeHealth marks timeout nodes as PFAIL and promotes PFAIL nodes to FAIL if reached quorum
+func (cluster *Cluster) checkNodeHealth() {
+	nodes := cluster.topology.GetNodes()
+	masters := make(map[string]struct{})
+	for _, r := range cluster.getSlotRanges() {
+		masters[r.nodeID] = struct{}{}
+	}
+	quorum := len(masters)/2 + 1
+	timeout := getNodeTimeout()
+	now := time.Now()
+
+	fd := cluster.detector
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	known := make(map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		known[node.ID] = struct{}{}
+		if node.ID == cluster.self {
+			continue
+		}
+		health := fd.getWithinLock(node.ID)
+		for reporter, reportTime := range health.failReports {
+			if now.Sub(reportTime) > 2*timeout {
+				delete(health.failReports, reporter)
+			}
+		}
+		if health.state == nodeHealthOK && !health.pingSent.IsZero() && now.Sub(health.pingSent) > timeout {
+			logger.Infof("node %s is not reachable for %s, mark it as PFAIL", node.ID, now.Sub(health.pingSent))
+			health.state = nodeHealthPFail
+		}
+		if health.state != nodeHealthPFail || len(masters) == 0 {
+			continue
+		}
+		votes := 0
+		if _, ok := masters[cluster.self]; ok {
+			votes++
+		}
+		for reporter := range health.failReports {
+			if _, ok := masters[reporter]; ok {
+				votes++
+			}
+		}
+		if votes >= quorum {
+			logger.Warn(fmt.Sprintf("node %s is marked as FAIL, %d of %d masters agree", node.ID, votes, len(masters)))
+			health.state = nodeHealthFail
+		}
+	}
+	// forget removed nodes
+	for nodeID := range fd.nodes {
+		if _, ok := known[nodeID]; !ok {
+			delete(fd.nodes, nodeID)
+		}
+	}
+}
+
+// execGClusterPing command line: gcluster ping <sender> <claims> <replOffset> [<nodeID> <state>]...
+// replies claims and replication offset of current node and states of nodes in the view of current node as pong
+func execGClusterPing(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return protocol.MakeArgNumErrReply("gcluster")
+	}
+	cluster.receiveGossip(string(args[0]), args[1:])
+	return protocol.MakeMultiBulkReply(cluster.makeGossip())
+}
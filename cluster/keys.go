@@ -1,27 +1,175 @@
 package cluster
 
 import (
+	"goRedisPlus/config"
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/redis/protocol"
+	"strconv"
+	"strings"
 )
 
-// FlushDB removes all data in current database
+// Commands operating whole keyspace are executed on all master nodes, replicas follow their masters.
+// FlushDB and FlushAll use try-commit-catch, so that no node would be flushed if any master is unavailable.
+
+// FlushDB removes all data in current database of all nodes
 func FlushDB(cluster *Cluster, c redis.Connection, cmdLine [][]byte) redis.Reply {
-	replies := cluster.broadcast(c, modifyCmd(cmdLine, "FlushDB_"))
-	var errReply protocol.ErrorReply
-	for _, v := range replies {
-		if protocol.IsErrorReply(v) {
-			errReply = v.(protocol.ErrorReply)
-			break
-		}
+	if len(cmdLine) > 2 {
+		return protocol.MakeArgNumErrReply("flushdb")
 	}
-	if errReply == nil {
-		return &protocol.OkReply{}
+	if !isFlushMode(cmdLine) {
+		return protocol.MakeSyntaxErrReply()
 	}
-	return protocol.MakeErrReply("error occurs: " + errReply.Error())
+	return cluster.flushMasters(c, cmdLine)
 }
 
 // FlushAll removes all data in cluster
-func FlushAll(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
-	return FlushDB(cluster, c, args)
+func FlushAll(cluster *Cluster, c redis.Connection, cmdLine [][]byte) redis.Reply {
+	if len(cmdLine) > 2 {
+		return protocol.MakeArgNumErrReply("flushall")
+	}
+	if !isFlushMode(cmdLine) {
+		return protocol.MakeSyntaxErrReply()
+	}
+	return cluster.flushMasters(c, cmdLine)
+}
+
+// isFlushMode checks the optional ASYNC or SYNC of FlushDB and FlushAll before starting transaction
+func isFlushMode(cmdLine [][]byte) bool {
+	if len(cmdLine) < 2 {
+		return true
+	}
+	mode := strings.ToLower(string(cmdLine[1]))
+	return mode == "async" || mode == "sync"
+}
+
+// flushMasters executes cmdLine with its ASYNC or SYNC option on all masters
+func (cluster *Cluster) flushMasters(c redis.Connection, cmdLine [][]byte) redis.Reply {
+	cmdName := string(cmdLine[0])
+	groupMap := make(map[string][]string)
+	for _, node := range cluster.getMasterNodes() {
+		groupMap[node.ID] = nil
+	}
+	txID := cluster.beginTransaction(groupMap)
+	txIDStr := strconv.FormatInt(txID, 10)
+	for _, peer := range prepareOrder(groupMap) {
+		prepareArgs := append([][]byte{[]byte("Prepare"), []byte(txIDStr)}, cmdLine...)
+		resp := cluster.relay(peer, c, prepareArgs)
+		if protocol.IsErrorReply(resp) {
+			requestRollback(cluster, c, txID, groupMap)
+			return protocol.MakeErrReply("ERR prepare " + cmdName + " on " + peer + " failed: " + resp.(protocol.ErrorReply).Error())
+		}
+	}
+	if _, errReply := requestCommit(cluster, c, txID, groupMap); errReply != nil {
+		return protocol.MakeErrReply("ERR commit " + cmdName + " failed: " + errReply.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// commitFlush flushes local database as a participant of FlushDB or FlushAll transaction
+func commitFlush(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	return cluster.db.Exec(c, cmdLine)
+}
+
+// DBSize returns count of keys in cluster
+func DBSize(cluster *Cluster, c redis.Connection, cmdLine [][]byte) redis.Reply {
+	if len(cmdLine) != 1 {
+		return protocol.MakeArgNumErrReply("dbsize")
+	}
+	var size int64
+	for _, node := range cluster.getMasterNodes() {
+		reply := cluster.relay(node.ID, c, makeArgs("DBSize_"))
+		if protocol.IsErrorReply(reply) {
+			return reply
+		}
+		intReply, ok := reply.(*protocol.IntReply)
+		if !ok {
+			return protocol.MakeErrReply("ERR illegal dbsize reply from " + node.ID)
+		}
+		size += intReply.Code
+	}
+	return protocol.MakeIntReply(size)
+}
+
+// Keys returns keys matching pattern in all nodes
+func Keys(cluster *Cluster, c redis.Connection, cmdLine [][]byte) redis.Reply {
+	if len(cmdLine) != 2 {
+		return protocol.MakeArgNumErrReply("keys")
+	}
+	var result [][]byte
+	for _, node := range cluster.getMasterNodes() {
+		reply := cluster.relay(node.ID, c, makeArgs("Keys_", string(cmdLine[1])))
+		if protocol.IsErrorReply(reply) {
+			return reply
+		}
+		if keys, ok := reply.(*protocol.MultiBulkReply); ok {
+			result = append(result, keys.Args...)
+		}
+	}
+	if len(result) == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execKeysLocal returns keys matching pattern in slots served by current node
+func execKeysLocal(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	reply := cluster.db.Exec(c, modifyCmd(cmdLine, "Keys"))
+	keys, ok := reply.(*protocol.MultiBulkReply)
+	if !ok {
+		return reply
+	}
+	result := make([][]byte, 0, len(keys.Args))
+	for _, key := range keys.Args {
+		if cluster.isServedKey(string(key)) {
+			result = append(result, key)
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execDBSizeLocal returns count of keys in slots served by current node
+func execDBSizeLocal(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if c.GetDBIndex() != 0 {
+		// slots only track keys of db 0
+		return cluster.db.Exec(c, modifyCmd(cmdLine, "DBSize"))
+	}
+	var slotIDs []uint32
+	cluster.slotMu.RLock()
+	for slotID, slot := range cluster.slots {
+		if slot.state != slotStateMovingOut {
+			slotIDs = append(slotIDs, slotID)
+		}
+	}
+	cluster.slotMu.RUnlock()
+	size := 0
+	for _, slotID := range slotIDs {
+		size += cluster.countKeysInSlot(slotID)
+	}
+	return protocol.MakeIntReply(int64(size))
+}
+
+// isServedKey returns whether the key belongs to a slot served by current node
+func (cluster *Cluster) isServedKey(key string) bool {
+	node := cluster.pickNode(getSlot(key))
+	return node != nil && node.ID == cluster.self
+}
+
+// execMemory routes MEMORY USAGE to the node serving the key, other subcommands report memory of current node
+func execMemory(cluster *Cluster, c redis.Connection, cmdLine [][]byte) redis.Reply {
+	if len(cmdLine) < 3 || strings.ToLower(string(cmdLine[1])) != "usage" {
+		return cluster.db.Exec(c, cmdLine)
+	}
+	key := string(cmdLine[2])
+	slotId := getSlot(key)
+	peer := cluster.pickNode(slotId)
+	if peer.ID == cluster.self {
+		if err := cluster.ensureKeyWithoutLock(key); err != nil {
+			return err
+		}
+		return cluster.db.Exec(c, cmdLine)
+	}
+	if config.Properties.ClusterRedirect {
+		return cluster.redirect(c, cmdLine, slotId, []string{key}, peer)
+	}
+	return cluster.relay(peer.ID, c, cmdLine)
 }
@@ -0,0 +1,253 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/database"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Migration log:
+// Progress of slot migration is persisted in <cluster-config-file>.migration on both source node and target node,
+// so that a migration interrupted by restart would be resumed or rolled back instead of being left half-imported.
+// Source node sends keys in ascending order, so target node only needs to remember the last imported key (watermark).
+// After restart:
+//   - target node resumes importing keys after the watermark if the slot has been routed to it,
+//     otherwise drops imported keys and asks source node to take the slot back
+//   - source node keeps the slot as migrating if the slot has been routed to target node,
+//     otherwise takes the slot back
+
+const migrationResumeDelay = time.Second
+
+type migrationRecord struct {
+	SlotID    uint32 `json:"slot"`
+	Importing bool   `json:"importing"`           // true on target node, false on source node
+	PeerID    string `json:"peer"`                // source node if importing, otherwise target node
+	Watermark string `json:"watermark,omitempty"` // last imported key, only used by target node
+}
+
+type migrationLog struct {
+	mu       sync.Mutex
+	filename string // empty means migration progress is not persisted
+	records  map[uint32]*migrationRecord
+}
+
+func makeMigrationLog() *migrationLog {
+	filename := ""
+	if config.Properties.ClusterConfigFile != "" {
+		filename = path.Join(config.Properties.Dir, config.Properties.ClusterConfigFile+".migration")
+	}
+	return &migrationLog{
+		filename: filename,
+		records:  make(map[uint32]*migrationRecord),
+	}
+}
+
+// load reads migration records from file, it returns nil if there is no unfinished migration
+func (ml *migrationLog) load() ([]*migrationRecord, error) {
+	if ml.filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(ml.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []*migrationRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("illegal migration log %s: %v", ml.filename, err)
+	}
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	for _, record := range records {
+		ml.records[record.SlotID] = record
+	}
+	return records, nil
+}
+
+// persistWithinLock writes all records into file, invoker should provide lock
+func (ml *migrationLog) persistWithinLock() {
+	if ml.filename == "" {
+		return
+	}
+	if len(ml.records) == 0 {
+		if err := os.Remove(ml.filename); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("remove migration log failed: %v", err)
+		}
+		return
+	}
+	records := make([]*migrationRecord, 0, len(ml.records))
+	for _, record := range ml.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].SlotID < records[j].SlotID
+	})
+	data, _ := json.Marshal(records)
+	tmpFile, err := os.CreateTemp(config.Properties.Dir, "tmp-migration-*.json")
+	if err != nil {
+		logger.Errorf("persist migration log failed: %v", err)
+		return
+	}
+	_, err = tmpFile.Write(data)
+	_ = tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), ml.filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		logger.Errorf("persist migration log failed: %v", err)
+	}
+}
+
+// begin records that slot starts migrating, watermark is kept if the same migration has been recorded
+func (ml *migrationLog) begin(slotID uint32, importing bool, peerID string) {
+	ml.beginBatch([]uint32{slotID}, importing, peerID)
+}
+
+// beginBatch records that slots start migrating with the same peer, the file is written only once
+func (ml *migrationLog) beginBatch(slotIDs []uint32, importing bool, peerID string) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	changed := false
+	for _, slotID := range slotIDs {
+		record := ml.records[slotID]
+		if record != nil && record.Importing == importing && record.PeerID == peerID {
+			continue
+		}
+		ml.records[slotID] = &migrationRecord{
+			SlotID:    slotID,
+			Importing: importing,
+			PeerID:    peerID,
+		}
+		changed = true
+	}
+	if changed {
+		ml.persistWithinLock()
+	}
+}
+
+// setWatermark records the last key imported into slot
+func (ml *migrationLog) setWatermark(slotID uint32, key string) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	record := ml.records[slotID]
+	if record == nil || !record.Importing || record.Watermark == key {
+		return
+	}
+	record.Watermark = key
+	ml.persistWithinLock()
+}
+
+func (ml *migrationLog) getWatermark(slotID uint32) string {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if record := ml.records[slotID]; record != nil && record.Importing {
+		return record.Watermark
+	}
+	return ""
+}
+
+// finish removes record of slot after migration finished or aborted
+func (ml *migrationLog) finish(slotID uint32) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if _, ok := ml.records[slotID]; !ok {
+		return
+	}
+	delete(ml.records, slotID)
+	ml.persistWithinLock()
+}
+
+// recoverMigration resumes or rolls back migrations interrupted by restart, slots in topology should have been loaded
+func (cluster *Cluster) recoverMigration() error {
+	records, err := cluster.migrationLog.load()
+	if err != nil {
+		return err
+	}
+	slots := cluster.topology.GetSlots()
+	var resumed []*migrationRecord
+	for _, record := range records {
+		slotID := record.SlotID
+		owner := slots[int(slotID)].NodeID
+		switch {
+		case record.Importing && owner == cluster.self:
+			logger.Infof("resume importing slot %d from %s after key '%s'", slotID, record.PeerID, record.Watermark)
+			cluster.setLocalSlotImporting(slotID, record.PeerID)
+			resumed = append(resumed, record)
+		case record.Importing:
+			logger.Infof("roll back importing slot %d from %s", slotID, record.PeerID)
+			cluster.slotMu.Lock()
+			delete(cluster.slots, slotID)
+			cluster.slotMu.Unlock()
+			cluster.dropSlotKeys(slotID)
+			cluster.migrationLog.finish(slotID)
+			peerID := record.PeerID
+			go func() {
+				// source node may still wait for this node, ask it to take the slot back
+				cmdLine := utils.ToCmdLine("cluster", "setslot", strconv.Itoa(int(slotID)), "stable")
+				reply := cluster.relay(peerID, connection.NewFakeConn(), cmdLine)
+				if err, ok := reply.(protocol.ErrorReply); ok {
+					logger.Errorf("ask %s to take back slot %d failed: %s", peerID, slotID, err.Error())
+				}
+			}()
+		case owner == cluster.self:
+			// route has not been changed, target node will roll back too
+			logger.Infof("take back migrating slot %d", slotID)
+			cluster.migrationLog.finish(slotID)
+		default:
+			logger.Infof("slot %d is still migrating to %s", slotID, record.PeerID)
+			cluster.setSlotMovingOut(slotID, record.PeerID)
+		}
+	}
+	cluster.collectSlotKeys()
+	for _, record := range resumed {
+		slotID, peerID := record.SlotID, record.PeerID
+		// keys exist before restart have been imported or written by clients, never overwrite them
+		slot := cluster.getHostSlot(slotID)
+		slot.mu.RLock()
+		importedKeys := slot.keys.ShallowCopy()
+		slot.mu.RUnlock()
+		cluster.slotMu.Lock()
+		slot.importedKeys = importedKeys
+		cluster.slotMu.Unlock()
+		go func() {
+			// wait for source node and cluster bus getting ready
+			time.Sleep(migrationResumeDelay)
+			err := cluster.importSlot(&Slot{
+				ID:     slotID,
+				NodeID: peerID,
+			})
+			if err != nil {
+				logger.Errorf("resume importing slot %d failed: %v", slotID, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// dropSlotKeys deletes all keys belonging to the slot, it is used when current node does not track the slot
+func (cluster *Cluster) dropSlotKeys(slotID uint32) {
+	var keys []string
+	cluster.db.ForEach(0, func(key string, data *database.DataEntity, expiration *time.Time) bool {
+		if getSlot(key) == slotID {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	c := connection.NewFakeConn()
+	for _, key := range keys {
+		cluster.db.Exec(c, utils.ToCmdLine("DEL", key))
+	}
+}
@@ -0,0 +1,208 @@
+package cluster
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Migration throttling and progress:
+// Source node limits the rate of migration stream by cluster-migration-keys-per-sec and cluster-migration-bytes-per-sec,
+// so that moving slots will not starve requests of clients.
+// Both source node and target node record progress of each slot, see CLUSTER MIGRATION STATUS
+// Progress also shows keys tracked for the slot and memory used to track them (bookkeeping-bytes),
+// which grows with imported keys on target node.
+
+const (
+	migrationRunning = "running"
+	migrationDone    = "done"
+	migrationFailed  = "failed"
+)
+
+type migrationProgress struct {
+	slotID     uint32
+	importing  bool
+	peerID     string
+	state      string
+	totalKeys  int // count of keys to send, only known by source node
+	keys       int
+	bytes      int64
+	startTime  time.Time
+	finishTime time.Time
+	err        string
+}
+
+type migrationStat struct {
+	mu    sync.Mutex
+	slots map[uint32]*migrationProgress
+}
+
+func makeMigrationStat() *migrationStat {
+	return &migrationStat{
+		slots: make(map[uint32]*migrationProgress),
+	}
+}
+
+// start begins recording progress of the slot, previous progress of the slot is dropped
+func (stat *migrationStat) start(slotID uint32, importing bool, peerID string, totalKeys int) {
+	stat.mu.Lock()
+	defer stat.mu.Unlock()
+	stat.slots[slotID] = &migrationProgress{
+		slotID:    slotID,
+		importing: importing,
+		peerID:    peerID,
+		state:     migrationRunning,
+		totalKeys: totalKeys,
+		startTime: time.Now(),
+	}
+}
+
+func (stat *migrationStat) add(slotID uint32, keys int, bytes int64) {
+	stat.mu.Lock()
+	defer stat.mu.Unlock()
+	if progress := stat.slots[slotID]; progress != nil {
+		progress.keys += keys
+		progress.bytes += bytes
+	}
+}
+
+// finish marks migration of slot as done, or failed if err is not nil
+func (stat *migrationStat) finish(slotID uint32, err error) {
+	stat.mu.Lock()
+	defer stat.mu.Unlock()
+	progress := stat.slots[slotID]
+	if progress == nil {
+		return
+	}
+	progress.state = migrationDone
+	if err != nil {
+		progress.state = migrationFailed
+		progress.err = err.Error()
+	}
+	progress.finishTime = time.Now()
+}
+
+// migrationThrottle blocks migration stream to keep its rate under the limits in config
+type migrationThrottle struct {
+	keysPerSec  int
+	bytesPerSec int
+	startTime   time.Time
+	keys        int
+	bytes       int64
+}
+
+func makeMigrationThrottle() *migrationThrottle {
+	return &migrationThrottle{
+		keysPerSec:  config.Properties.MigrateKeysPerSec,
+		bytesPerSec: config.Properties.MigrateBytesPerSec,
+		startTime:   time.Now(),
+	}
+}
+
+// wait records sent keys and bytes, and sleeps until the average rate since start is under the limits
+func (throttle *migrationThrottle) wait(keys int, bytes int) {
+	throttle.keys += keys
+	throttle.bytes += int64(bytes)
+	var expected time.Duration
+	if throttle.keysPerSec > 0 {
+		expected = time.Duration(throttle.keys) * time.Second / time.Duration(throttle.keysPerSec)
+	}
+	if throttle.bytesPerSec > 0 {
+		d := time.Duration(throttle.bytes) * time.Second / time.Duration(throttle.bytesPerSec)
+		if d > expected {
+			expected = d
+		}
+	}
+	if elapsed := time.Since(throttle.startTime); expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// execClusterMigration command line: cluster migration status [<slot>]
+// shows progress of slots migrating into or out of current node
+func execClusterMigration(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) < 1 || strings.ToLower(string(args[0])) != "status" {
+		return protocol.MakeErrReply("ERR Unknown CLUSTER MIGRATION subcommand. Try CLUSTER HELP")
+	}
+	if len(args) > 2 {
+		return protocol.MakeArgNumErrReply("cluster|migration")
+	}
+	filter := -1
+	if len(args) == 2 {
+		slotID, errReply := parseSlotID(args[1])
+		if errReply != nil {
+			return errReply
+		}
+		filter = int(slotID)
+	}
+	stat := cluster.migrationStat
+	stat.mu.Lock()
+	progresses := make([]migrationProgress, 0, len(stat.slots))
+	for _, progress := range stat.slots {
+		if filter < 0 || int(progress.slotID) == filter {
+			progresses = append(progresses, *progress)
+		}
+	}
+	stat.mu.Unlock()
+	bookkeeping := make(map[uint32][2]int64, len(progresses))
+	for _, progress := range progresses {
+		if slot := cluster.getHostSlot(progress.slotID); slot != nil {
+			bookkeeping[progress.slotID] = cluster.getSlotBookkeeping(slot)
+		}
+	}
+	sort.Slice(progresses, func(i, j int) bool {
+		return progresses[i].slotID < progresses[j].slotID
+	})
+	result := make([]redis.Reply, 0, len(progresses))
+	for _, progress := range progresses {
+		result = append(result, makeMigrationProgressReply(&progress, bookkeeping[progress.slotID]))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+// getSlotBookkeeping returns count of keys tracked for the slot and bytes used to track them
+func (cluster *Cluster) getSlotBookkeeping(slot *hostSlot) [2]int64 {
+	cluster.slotMu.RLock()
+	importedKeys := slot.importedKeys
+	cluster.slotMu.RUnlock()
+	slot.mu.RLock()
+	defer slot.mu.RUnlock()
+	tracked := int64(slot.keys.Len() + importedKeys.Len())
+	return [2]int64{tracked, slot.keys.MemoryUsage() + importedKeys.MemoryUsage()}
+}
+
+// makeMigrationProgressReply returns progress of slot, bookkeeping is the result of getSlotBookkeeping
+func makeMigrationProgressReply(progress *migrationProgress, bookkeeping [2]int64) redis.Reply {
+	direction, total := "migrating", strconv.Itoa(progress.totalKeys)
+	if progress.importing {
+		direction, total = "importing", "unknown"
+	}
+	end := progress.finishTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(progress.startTime)
+	var keysPerSec int64
+	if elapsed > 0 {
+		keysPerSec = int64(float64(progress.keys) / elapsed.Seconds())
+	}
+	return protocol.MakeMultiBulkReply([][]byte{
+		[]byte("slot"), []byte(strconv.Itoa(int(progress.slotID))),
+		[]byte("direction"), []byte(direction),
+		[]byte("node"), []byte(progress.peerID),
+		[]byte("state"), []byte(progress.state),
+		[]byte("keys"), []byte(strconv.Itoa(progress.keys)),
+		[]byte("total-keys"), []byte(total),
+		[]byte("bytes"), []byte(strconv.FormatInt(progress.bytes, 10)),
+		[]byte("elapsed-ms"), []byte(strconv.FormatInt(int64(elapsed/time.Millisecond), 10)),
+		[]byte("keys-per-sec"), []byte(strconv.FormatInt(keysPerSec, 10)),
+		[]byte("tracked-keys"), []byte(strconv.FormatInt(bookkeeping[0], 10)),
+		[]byte("bookkeeping-bytes"), []byte(strconv.FormatInt(bookkeeping[1], 10)),
+		[]byte("error"), []byte(progress.err),
+	})
+}
@@ -65,12 +65,12 @@ func MSet(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 
 	//prepare
 	var errReply redis.Reply
-	txID := cluster.idGenerator.NextID()
+	txID := cluster.beginTransaction(groupMap)
 	txIDStr := strconv.FormatInt(txID, 10)
 	rollback := false
-	for peer, group := range groupMap {
+	for _, peer := range prepareOrder(groupMap) {
 		peerArgs := []string{txIDStr, "MSET"}
-		for _, k := range group {
+		for _, k := range groupMap[peer] {
 			peerArgs = append(peerArgs, k, valueMap[k])
 		}
 		resp := cluster.relay(peer, c, makeArgs("Prepare", peerArgs...))
@@ -120,12 +120,12 @@ func MSetNX(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 	// 1. Normal tcc preparation (undo log and lock related keys)
 	// 2. Peer checks whether any key already exists, If so it will return keyExistsErr. Then coordinator will request rollback over all participated nodes
 	var errReply redis.Reply
-	txID := cluster.idGenerator.NextID()
+	txID := cluster.beginTransaction(groupMap)
 	txIDStr := strconv.FormatInt(txID, 10)
 	rollback := false
-	for node, group := range groupMap {
+	for _, node := range prepareOrder(groupMap) {
 		nodeArgs := []string{txIDStr, "MSETNX"}
-		for _, k := range group {
+		for _, k := range groupMap[node] {
 			nodeArgs = append(nodeArgs, k, valueMap[k])
 		}
 		resp := cluster.relay(node, c, makeArgs("Prepare", nodeArgs...))
@@ -41,7 +41,7 @@ func execMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.R
 	}
 	groupMap := cluster.groupBy(keys)
 	if len(groupMap) > 1 {
-		return protocol.MakeErrReply("ERR MULTI commands transaction must within one slot in cluster mode")
+		return errCrossSlot
 	}
 	var peer string
 	// assert len(groupMap) == 1
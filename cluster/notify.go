@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"sync"
+	"time"
+)
+
+// Keyspace notification forwarding:
+// Keyspace events are published on the node hosting the key, so clients subscribed on other nodes would miss them.
+// Every node advertises its keyspace channels having subscribers by `gcluster keyspace-subs` each gossip period,
+// and master nodes forward events to nodes subscribing the channel by `publish_`.
+
+const (
+	keyspaceChannelPrefix  = "__key"
+	keyspaceSubsTTL        = 5 * gossipPeriod
+	keyspaceEventQueueSize = 1024
+)
+
+type keyspaceEvent struct {
+	channel string
+	message string
+}
+
+type remoteSubs struct {
+	channels map[string]struct{}
+	updated  time.Time
+}
+
+type keyspaceForwarder struct {
+	mu         sync.Mutex
+	subs       map[string]*remoteSubs // node id -> subscribed keyspace channels
+	advertised bool                   // whether current node advertised any channel last time
+	events     chan *keyspaceEvent
+}
+
+func makeKeyspaceForwarder() *keyspaceForwarder {
+	return &keyspaceForwarder{
+		subs:   make(map[string]*remoteSubs),
+		events: make(chan *keyspaceEvent, keyspaceEventQueueSize),
+	}
+}
+
+// getSubscribers returns nodes subscribing the channel
+func (kf *keyspaceForwarder) getSubscribers(channel string) []string {
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+	var nodes []string
+	now := time.Now()
+	for nodeID, subs := range kf.subs {
+		if now.Sub(subs.updated) > keyspaceSubsTTL {
+			delete(kf.subs, nodeID)
+			continue
+		}
+		if _, ok := subs.channels[channel]; ok {
+			nodes = append(nodes, nodeID)
+		}
+	}
+	return nodes
+}
+
+// onKeyspaceEvent is called after a keyspace event published on current node
+func (cluster *Cluster) onKeyspaceEvent(channel string, message string) {
+	if cluster.masterID != "" {
+		return // replicas fire the same events as their master
+	}
+	kf := cluster.keyspaceForwarder
+	if len(kf.getSubscribers(channel)) == 0 {
+		return
+	}
+	select {
+	case kf.events <- &keyspaceEvent{channel: channel, message: message}:
+	default:
+		logger.Warn("keyspace event queue is full, drop event of " + channel)
+	}
+}
+
+// forwardKeyspaceEvents sends events to subscribing nodes in order
+func (cluster *Cluster) forwardKeyspaceEvents() {
+	kf := cluster.keyspaceForwarder
+	for {
+		select {
+		case event := <-kf.events:
+			cmdLine := utils.ToCmdLine(relayPublish, event.channel, event.message)
+			for _, nodeID := range kf.getSubscribers(event.channel) {
+				reply := cluster.relay(nodeID, connection.NewFakeConn(), cmdLine)
+				if errReply, ok := reply.(protocol.ErrorReply); ok {
+					logger.Debugf("forward keyspace event to %s failed: %s", nodeID, errReply.Error())
+				}
+			}
+		case <-cluster.closeChan:
+			return
+		}
+	}
+}
+
+// advertiseKeyspaceSubs tells other nodes which keyspace channels are subscribed on current node
+func (cluster *Cluster) advertiseKeyspaceSubs() {
+	channels := cluster.db.GetSubscribedChannels(keyspaceChannelPrefix)
+	kf := cluster.keyspaceForwarder
+	kf.mu.Lock()
+	if len(channels) == 0 && !kf.advertised {
+		kf.mu.Unlock()
+		return
+	}
+	kf.advertised = len(channels) > 0
+	kf.mu.Unlock()
+	cmdLine := utils.ToCmdLine("gcluster", "keyspace-subs", cluster.self)
+	cmdLine = append(cmdLine, utils.ToCmdLine(channels...)...)
+	for _, node := range cluster.topology.GetNodes() {
+		if node.ID == cluster.self {
+			continue
+		}
+		nodeID := node.ID
+		go func() {
+			reply := cluster.relay(nodeID, connection.NewFakeConn(), cmdLine)
+			if errReply, ok := reply.(protocol.ErrorReply); ok {
+				logger.Debugf("advertise keyspace channels to %s failed: %s", nodeID, errReply.Error())
+			}
+		}()
+	}
+}
+
+// execGClusterKeyspaceSubs command line: gcluster keyspace-subs <sender> [<channel>...]
+// replaces keyspace channels subscribed on sender
+func execGClusterKeyspaceSubs(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 1 {
+		return protocol.MakeArgNumErrReply("gcluster")
+	}
+	sender := string(args[0])
+	kf := cluster.keyspaceForwarder
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+	if len(args) == 1 {
+		delete(kf.subs, sender)
+		return protocol.MakeOkReply()
+	}
+	channels := make(map[string]struct{}, len(args)-1)
+	for _, channel := range args[1:] {
+		channels[string(channel)] = struct{}{}
+	}
+	kf.subs[sender] = &remoteSubs{
+		channels: channels,
+		updated:  time.Now(),
+	}
+	return protocol.MakeOkReply()
+}
@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/pool"
+	"goRedisPlus/redis/client"
+	"sync"
+	"time"
+)
+
+// Relay multiplexing:
+// Commands relayed to a peer are pipelined over a few shared connections (cluster-peer-connections) instead of
+// checking out a pooled connection per command, so concurrent relays don't wait for each other's round trips.
+// Replies are matched with requests by order (see client.SendWithTimeout), each request waits at most
+// cluster-relay-timeout. A connection timed out or failed is replaced by the next request picking it.
+
+const (
+	defaultPeerConnections = 2
+	defaultRelayTimeout    = 3000 // milliseconds
+)
+
+// peerMux holds shared connections with a peer
+type peerMux struct {
+	peerAddr  string
+	mu        sync.Mutex
+	clients   []*client.Client
+	next      int
+	created   uint64
+	destroyed uint64
+	broken    uint64
+}
+
+// muxClient sends requests by a shared connection with timeout of relay
+type muxClient struct {
+	cli     *client.Client
+	timeout time.Duration
+}
+
+func (c *muxClient) Send(args [][]byte) redis.Reply {
+	return c.cli.SendWithTimeout(args, c.timeout)
+}
+
+func makePeerMux(peerAddr string) *peerMux {
+	size := config.Properties.PeerConnections
+	if size <= 0 {
+		size = defaultPeerConnections
+	}
+	return &peerMux{
+		peerAddr: peerAddr,
+		clients:  make([]*client.Client, size),
+	}
+}
+
+func getRelayTimeout() time.Duration {
+	timeout := config.Properties.RelayTimeout
+	if timeout <= 0 {
+		timeout = defaultRelayTimeout
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// get picks connections in turn, broken connections are replaced
+func (mux *peerMux) get(cfg *client.Config) (*client.Client, error) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	i := mux.next
+	mux.next = (mux.next + 1) % len(mux.clients)
+	cli := mux.clients[i]
+	if cli != nil && !cli.Broken() {
+		return cli, nil
+	}
+	if cli != nil {
+		mux.clients[i] = nil
+		mux.destroyed++
+		mux.broken++
+		go cli.Close() // requests in flight would fail
+	}
+	cli, err := client.MakeClientWithConfig(mux.peerAddr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	cli.Start()
+	mux.clients[i] = cli
+	mux.created++
+	return cli, nil
+}
+
+func (mux *peerMux) stats() pool.Stats {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	stats := pool.Stats{
+		Created:   mux.created,
+		Destroyed: mux.destroyed,
+		Broken:    mux.broken,
+	}
+	for _, cli := range mux.clients {
+		if cli != nil {
+			stats.Active++
+		}
+	}
+	return stats
+}
+
+func (mux *peerMux) close() {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	for i, cli := range mux.clients {
+		if cli != nil {
+			cli.Close()
+			mux.clients[i] = nil
+		}
+	}
+}
+
+// GetMuxClient returns a client with peer which is shared with other goroutines, it needs not to be returned
+func (factory *defaultClientFactory) GetMuxClient(peerAddr string) (peerClient, error) {
+	raw, ok := factory.muxConnections.Get(peerAddr)
+	if !ok {
+		factory.muxConnections.PutIfAbsent(peerAddr, makePeerMux(peerAddr))
+		raw, _ = factory.muxConnections.Get(peerAddr)
+	}
+	cli, err := raw.(*peerMux).get(factory.getPeerConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &muxClient{
+		cli:     cli,
+		timeout: getRelayTimeout(),
+	}, nil
+}
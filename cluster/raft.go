@@ -19,6 +19,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -83,9 +84,12 @@ type logEntry struct {
 	Event int
 	wg    *sync.WaitGroup
 	// payload
-	SlotIDs []uint32
-	NodeID  string
-	Addr    string
+	SlotIDs  []uint32
+	NodeID   string
+	Addr     string
+	BusAddr  string `json:",omitempty"`
+	MasterID string
+	Learner  bool `json:",omitempty"`
 }
 
 func (e *logEntry) marshal() []byte {
@@ -126,6 +130,15 @@ type Raft struct {
 	// for leader
 	nodeIndexMap map[string]*nodeStatus
 	nodeLock     *lock.Locks
+
+	// bannedNodes stores forgotten nodes and when they could rejoin, see CLUSTER FORGET
+	bannedNodes map[string]time.Time
+
+	// transferee is the node which leader is transferring leadership to, proposals are rejected during transfer
+	transferee string
+	// skipPreVote is set when leader asks current node to start election immediately, see raft timeout-now
+	skipPreVote bool
+	electionNow chan struct{}
 }
 
 func newRaft(cluster *Cluster, persistFilename string) *Raft {
@@ -137,10 +150,11 @@ func newRaft(cluster *Cluster, persistFilename string) *Raft {
 }
 
 type heartbeat struct {
-	sender   string
-	term     int
-	entries  []*logEntry
-	commitTo int
+	sender       string
+	term         int
+	prevLogIndex int
+	entries      []*logEntry
+	commitTo     int
 }
 
 type nodeStatus struct {
@@ -163,6 +177,25 @@ func (raft *Raft) GetNode(nodeID string) *Node {
 	return raft.nodes[nodeID]
 }
 
+// isVoter returns whether the node takes part in elections and commitment, learners only receive log
+// invoker provide with lock
+func (raft *Raft) isVoter(nodeID string) bool {
+	node := raft.nodes[nodeID]
+	return node != nil && node.getState() != learner
+}
+
+// getVoters returns id of voting nodes
+// invoker provide with lock
+func (raft *Raft) getVoters() []string {
+	var voters []string
+	for nodeID := range raft.nodes {
+		if raft.isVoter(nodeID) {
+			voters = append(voters, nodeID)
+		}
+	}
+	return voters
+}
+
 func (raft *Raft) getLogEntries(beg, end int) []*logEntry {
 	if beg <= raft.baseIndex || end > raft.baseIndex+len(raft.log)+1 {
 		return nil
@@ -181,10 +214,22 @@ func (raft *Raft) getLogEntriesFrom(beg int) []*logEntry {
 }
 
 func (raft *Raft) getLogEntry(idx int) *logEntry {
-	if idx < raft.baseIndex || idx >= raft.baseIndex+len(raft.log) {
+	if idx <= raft.baseIndex || idx > raft.baseIndex+len(raft.log) {
 		return nil
 	}
-	return raft.log[idx-raft.baseIndex]
+	return raft.log[idx-raft.baseIndex-1]
+}
+
+// getLogTerm returns term of the log entry at idx, the entry may have been compacted into snapshot if idx is baseIndex
+func (raft *Raft) getLogTerm(idx int) (int, bool) {
+	if idx == raft.baseIndex {
+		return raft.baseTerm, true
+	}
+	entry := raft.getLogEntry(idx)
+	if entry == nil {
+		return 0, false
+	}
+	return entry.Term, true
 }
 
 func (raft *Raft) initLog(baseTerm, baseIndex int, entries []*logEntry) {
@@ -235,9 +280,11 @@ func (raft *Raft) StartAsSeed(listenAddr string) protocol.ErrorReply {
 	raft.leaderId = selfNodeID
 	raft.nodes = make(map[string]*Node)
 	raft.nodes[selfNodeID] = &Node{
-		ID:    selfNodeID,
-		Addr:  listenAddr,
-		Slots: raft.slots,
+		ID:          selfNodeID,
+		Addr:        listenAddr,
+		BusAddr:     getAnnounceBusAddr(listenAddr),
+		Slots:       raft.slots,
+		ConfigEpoch: 1,
 	}
 	raft.nodes[selfNodeID].setState(leader)
 	raft.nodeIndexMap = map[string]*nodeStatus{
@@ -264,6 +311,7 @@ const raftClosed = "ERR raft has closed"
 func (raft *Raft) start(state raftState) {
 	raft.state = state
 	raft.heartbeatChan = make(chan *heartbeat, 1)
+	raft.electionNow = make(chan struct{}, 1)
 	raft.electionAlarm = nextElectionAlarm()
 	//raft.nodeIndexMap = make(map[string]*nodeStatus)
 	go func() {
@@ -296,33 +344,73 @@ func (raft *Raft) followerJob() {
 	case hb := <-raft.heartbeatChan:
 		raft.mu.Lock()
 		nodeId := hb.sender
-		raft.nodes[nodeId].lastHeard = time.Now()
-		// todo: drop duplicate entry
-		raft.log = append(raft.log, hb.entries...)
-		raft.proposedIndex += len(hb.entries)
-		raft.applyLogEntries(raft.getLogEntries(raft.committedIndex+1, hb.commitTo+1))
-		raft.committedIndex = hb.commitTo
+		if node := raft.nodes[nodeId]; node != nil {
+			node.lastHeard = time.Now()
+		}
+		raft.appendEntries(hb.prevLogIndex, hb.entries)
+		commitTo := hb.commitTo
+		if commitTo > raft.proposedIndex {
+			commitTo = raft.proposedIndex // some entries have not been received
+		}
+		if commitTo > raft.committedIndex {
+			toCommit := raft.getLogEntries(raft.committedIndex+1, commitTo+1)
+			raft.committedIndex = commitTo
+			raft.applyLogEntries(toCommit)
+			raft.compactLog()
+		}
 		raft.electionAlarm = nextElectionAlarm()
 		raft.mu.Unlock()
 	case <-time.After(electionTimeout):
 		// change to candidate
 		logger.Info("raft leader timeout")
 		raft.mu.Lock()
-		raft.electionAlarm = nextElectionAlarm()
-		if raft.votedFor != "" {
+		if !raft.isVoter(raft.selfNodeID) {
+			// learner never starts election, just waits for the new leader
+			raft.electionAlarm = nextElectionAlarm()
+			raft.mu.Unlock()
+			return
+		}
+		if time.Now().Before(raft.electionAlarm) && raft.votedFor != "" {
 			// received request-vote and has voted during waiting timeout
 			raft.mu.Unlock()
 			logger.Infof("%s has voted for %s, give up being a candidate", raft.selfNodeID, raft.votedFor)
 			return
 		}
+		raft.electionAlarm = nextElectionAlarm()
 		logger.Info("change to candidate")
 		raft.state = candidate
 		raft.mu.Unlock()
+	case <-raft.electionNow:
+		raft.mu.Lock()
+		if raft.state == follower && raft.isVoter(raft.selfNodeID) {
+			logger.Info("leadership is transferred to current node, change to candidate")
+			raft.state = candidate
+		}
+		raft.mu.Unlock()
 	case <-raft.closeChan:
 		return
 	}
 }
 
+// appendEntries replaces entries after prevLogIndex, entries which have been compacted are skipped
+// invoker provide with lock
+func (raft *Raft) appendEntries(prevLogIndex int, entries []*logEntry) {
+	if len(entries) == 0 || prevLogIndex > raft.baseIndex+len(raft.log) {
+		return
+	}
+	if prevLogIndex < raft.baseIndex {
+		// log has been compacted since the heartbeat checked
+		skip := raft.baseIndex - prevLogIndex
+		if skip >= len(entries) {
+			return
+		}
+		entries = entries[skip:]
+		prevLogIndex = raft.baseIndex
+	}
+	raft.log = append(raft.log[:prevLogIndex-raft.baseIndex], entries...)
+	raft.proposedIndex = raft.baseIndex + len(raft.log)
+}
+
 func (raft *Raft) getLogProgressWithinLock() (int, int) {
 	var lastLogTerm, lastLogIndex int
 	if len(raft.log) > 0 {
@@ -336,8 +424,86 @@ func (raft *Raft) getLogProgressWithinLock() (int, int) {
 	return lastLogTerm, lastLogIndex
 }
 
+// stepDown turns leader or candidate into follower after finding a newer term
+// invoker provide with lock
+func (raft *Raft) stepDown() {
+	raft.state = follower
+	raft.votedFor = ""
+	raft.voteCount = 0
+	raft.nodeIndexMap = nil
+	raft.transferee = ""
+	raft.electionAlarm = nextElectionAlarm()
+}
+
+// preVote asks other nodes whether they would vote for current node without increasing term,
+// so that a node partitioned away cannot disrupt the stable leader with a higher term after it reconnects
+func (raft *Raft) preVote() bool {
+	raft.mu.RLock()
+	lastLogTerm, lastLogIndex := raft.getLogProgressWithinLock()
+	req := &voteReq{
+		nodeID:       raft.selfNodeID,
+		lastLogTerm:  lastLogTerm,
+		lastLogIndex: lastLogIndex,
+		term:         raft.term + 1,
+	}
+	var peers []string
+	voters := raft.getVoters()
+	for _, nodeID := range voters {
+		if nodeID != raft.selfNodeID {
+			peers = append(peers, nodeID)
+		}
+	}
+	raft.mu.RUnlock()
+
+	args := append(utils.ToCmdLine("raft", "pre-vote"), req.marshal()...)
+	granted := int32(1) // vote for self
+	wg := sync.WaitGroup{}
+	for _, nodeID := range peers {
+		nodeID := nodeID
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rawResp := raft.cluster.relay(nodeID, connection.NewFakeConn(), args)
+			respBody, ok := rawResp.(*protocol.MultiBulkReply)
+			if !ok {
+				logger.Info(fmt.Sprintf("cannot get pre-vote response from %s", nodeID))
+				return
+			}
+			resp := &voteResp{}
+			if err := resp.unmarshal(respBody.Args); err != nil {
+				logger.Info(fmt.Sprintf("cannot get pre-vote response from %s, %v", nodeID, err))
+				return
+			}
+			if resp.voteFor == raft.selfNodeID {
+				atomic.AddInt32(&granted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	return int(granted) >= len(voters)/2+1
+}
+
 func (raft *Raft) candidateJob() {
 	raft.mu.Lock()
+	if raft.skipPreVote {
+		raft.skipPreVote = false
+	} else {
+		raft.mu.Unlock()
+		ok := raft.preVote()
+		raft.mu.Lock()
+		if raft.state != candidate {
+			// received heartbeat of leader during pre-vote
+			raft.mu.Unlock()
+			return
+		}
+		if !ok {
+			logger.Infof("%s failed in pre-vote, back to follower", raft.selfNodeID)
+			raft.state = follower
+			raft.electionAlarm = nextElectionAlarm()
+			raft.mu.Unlock()
+			return
+		}
+	}
 
 	raft.term++
 	raft.votedFor = raft.selfNodeID
@@ -350,6 +516,7 @@ func (raft *Raft) candidateJob() {
 		lastLogIndex: lastLogIndex,
 		term:         raft.term,
 	}
+	voters := raft.getVoters() // learners do not vote
 	raft.mu.Unlock()
 	args := append([][]byte{
 		[]byte("raft"),
@@ -357,9 +524,9 @@ func (raft *Raft) candidateJob() {
 	}, req.marshal()...)
 	conn := connection.NewFakeConn()
 	wg := sync.WaitGroup{}
-	elected := make(chan struct{}, len(raft.nodes)) // may receive many elected message during an election, only handle the first one
+	elected := make(chan struct{}, len(voters)) // may receive many elected message during an election, only handle the first one
 	voteFinished := make(chan struct{})
-	for nodeID := range raft.nodes {
+	for _, nodeID := range voters {
 		if nodeID == raft.selfNodeID {
 			continue
 		}
@@ -405,7 +572,7 @@ func (raft *Raft) candidateJob() {
 			if resp.voteFor == raft.selfNodeID {
 				logger.Infof(fmt.Sprintf("get vote from %s", nodeID))
 				raft.voteCount++
-				if raft.voteCount >= len(raft.nodes)/2+1 {
+				if raft.voteCount >= len(voters)/2+1 {
 					logger.Info("elected to be the leader")
 					raft.state = leader
 					elected <- struct{}{} // notify the main goroutine to stop waiting
@@ -484,8 +651,10 @@ func (raft *Raft) leaderJob() {
 		raft.nodeLock = lock.Make(1024)
 	}
 	var recvedIndices []int
-	for _, status := range raft.nodeIndexMap {
-		recvedIndices = append(recvedIndices, status.receivedIndex)
+	for nodeID, status := range raft.nodeIndexMap {
+		if raft.isVoter(nodeID) {
+			recvedIndices = append(recvedIndices, status.receivedIndex)
+		}
 	}
 	sort.Slice(recvedIndices, func(i, j int) bool {
 		return recvedIndices[i] > recvedIndices[j]
@@ -498,17 +667,18 @@ func (raft *Raft) leaderJob() {
 	// new node (received index is 0) may cause commitTo less than raft.committedIndex
 	if commitTo > raft.committedIndex {
 		toCommit := raft.getLogEntries(raft.committedIndex+1, commitTo+1) // left inclusive, right exclusive
-		raft.applyLogEntries(toCommit)
 		raft.committedIndex = commitTo
+		raft.applyLogEntries(toCommit)
 		for _, entry := range toCommit {
 			if entry.wg != nil {
 				entry.wg.Done()
 			}
 		}
+		raft.compactLog()
 	}
 	// save receivedIndex in local variable in case changed by other goroutines
 	proposalIndex := raft.proposedIndex
-	snapshot := raft.makeSnapshot() // the snapshot is consistent with the committed log
+	installCmd := raft.makeInstallSnapshotCmd() // the snapshot is consistent with the committed log
 	for _, node := range raft.nodes {
 		if node.ID == raft.selfNodeID {
 			continue
@@ -518,30 +688,26 @@ func (raft *Raft) leaderJob() {
 		go func() {
 			raft.nodeLock.Lock(node.ID)
 			defer raft.nodeLock.UnLock(node.ID)
-			var cmdLine [][]byte
 			if status == nil {
 				logger.Debugf("node %s offline", node.ID)
 				status = raft.askNodeIndex(node)
 				if status != nil {
 					// get status, node has back online
 					raft.mu.Lock()
-					raft.nodeIndexMap[node.ID] = status
+					if raft.nodeIndexMap != nil {
+						raft.nodeIndexMap[node.ID] = status
+					}
 					raft.mu.Unlock()
 				} else {
 					// node still offline
 					return
 				}
 			}
-			if status.receivedIndex < raft.baseIndex {
-				// some entries are missed due to change of leader, send full snapshot
-				cmdLine = utils.ToCmdLine(
-					"raft",
-					"load-snapshot",
-					raft.selfNodeID,
-				)
-				// see makeSnapshotForFollower
-				cmdLine = append(cmdLine, []byte(node.ID), []byte(strconv.Itoa(int(follower))))
-				cmdLine = append(cmdLine, snapshot[2:]...)
+			var cmdLine [][]byte
+			raft.mu.RLock()
+			if status.receivedIndex < raft.baseIndex || status.receivedIndex > proposalIndex {
+				// entries needed by follower have been compacted, or follower has entries unknown to leader
+				cmdLine = installCmd
 			} else {
 				// leader has all needed entries, send normal heartbeat
 				req := &heartbeatRequest{
@@ -551,9 +717,9 @@ func (raft *Raft) leaderJob() {
 				}
 				// append new entries to heartbeat payload
 				if proposalIndex > status.receivedIndex {
-					req.prevLogTerm = raft.getLogEntry(status.receivedIndex).Term
+					req.prevLogTerm, _ = raft.getLogTerm(status.receivedIndex)
 					req.prevLogIndex = status.receivedIndex
-					req.entries = raft.getLogEntriesFrom(status.receivedIndex + 1)
+					req.entries = raft.getLogEntries(status.receivedIndex+1, proposalIndex+1)
 				}
 				cmdLine = utils.ToCmdLine(
 					"raft",
@@ -561,42 +727,38 @@ func (raft *Raft) leaderJob() {
 				)
 				cmdLine = append(cmdLine, req.marshal()...)
 			}
+			raft.mu.RUnlock()
 
 			conn := connection.NewFakeConn()
 			resp := raft.cluster.relay(node.ID, conn, cmdLine)
+			if errReply, ok := resp.(protocol.ErrorReply); ok && errReply.Error() == prevLogMismatch {
+				// follower has different entries, replace its log with snapshot
+				resp = raft.cluster.relay(node.ID, conn, installCmd)
+			}
 			switch respPayload := resp.(type) {
 			case *protocol.MultiBulkReply:
 				term, _ := strconv.Atoi(string(respPayload.Args[0]))
 				recvedIndex, _ := strconv.Atoi(string(respPayload.Args[1]))
+				raft.mu.Lock()
 				if term > raft.term {
-					// todo: rejoin as follower
+					logger.Infof("%s has newer term %d, step down", node.ID, term)
+					if raft.state == leader {
+						raft.stepDown()
+					}
+					raft.term = term
+					raft.mu.Unlock()
 					return
 				}
-				raft.mu.Lock()
-				raft.nodeIndexMap[node.ID].receivedIndex = recvedIndex
+				if status := raft.nodeIndexMap[node.ID]; status != nil {
+					status.receivedIndex = recvedIndex
+				}
 				raft.mu.Unlock()
 			case protocol.ErrorReply:
-				if respPayload.Error() == prevLogMismatch {
-					cmdLine = utils.ToCmdLine(
-						"raft",
-						"load-snapshot",
-						raft.selfNodeID,
-					)
-					cmdLine = append(cmdLine, []byte(node.ID), []byte(strconv.Itoa(int(follower))))
-					cmdLine = append(cmdLine, snapshot[2:]...)
-					resp := raft.cluster.relay(node.ID, conn, cmdLine)
-					if err, ok := resp.(protocol.ErrorReply); ok {
-						logger.Errorf("heartbeat to %s failed: %v", node.ID, err)
-						return
-					}
-				} else if respPayload.Error() == nodeNotReady {
+				if respPayload.Error() == nodeNotReady {
 					logger.Infof("%s is not ready yet", node.ID)
 					return
-				} else {
-					logger.Errorf("heartbeat to %s failed: %v", node.ID, respPayload.Error())
-					return
 				}
-
+				logger.Errorf("heartbeat to %s failed: %v", node.ID, respPayload.Error())
 			}
 		}()
 	}
@@ -609,7 +771,10 @@ func init() {
 }
 
 func execRaft(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
-	raft := cluster.asRaft()
+	raft, ok := cluster.topology.(*Raft)
+	if !ok {
+		return protocol.MakeErrReply("ERR raft is not enabled")
+	}
 	if raft.closed {
 		return protocol.MakeErrReply(raftClosed)
 	}
@@ -622,6 +787,18 @@ func execRaft(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		// command line: raft request-vote nodeId index term
 		// Decide whether to vote when other nodes solicit votes
 		return execRaftRequestVote(cluster, c, args[2:])
+	case "pre-vote":
+		// command line: raft pre-vote nodeId term index term
+		// Decide whether to vote without changing state
+		return execRaftPreVote(cluster, c, args[2:])
+	case "transfer-leader":
+		// execRaftTransferLeader hands leadership over to another node as leader
+		// command line: raft transfer-leader nodeID
+		return execRaftTransferLeader(cluster, c, args[2:])
+	case "timeout-now":
+		// execRaftTimeoutNow starts election immediately as the target of leadership transfer
+		// command line: raft timeout-now leaderId term
+		return execRaftTimeoutNow(cluster, c, args[2:])
 	case "heartbeat":
 		// execRaftHeartbeat handles heartbeat from leader as follower or learner
 		// command line: raft heartbeat nodeID term number-of-log-log log log
@@ -630,6 +807,10 @@ func execRaft(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 		// execRaftLoadSnapshot load snapshot from leader
 		// command line: raft load-snapshot leaderId snapshot(see raft.makeSnapshot)
 		return execRaftLoadSnapshot(cluster, c, args[2:])
+	case "install-snapshot":
+		// execRaftInstallSnapshot replaces log of follower fallen behind with snapshot of leader
+		// command line: raft install-snapshot leaderId term lastIndex lastTerm node...
+		return execRaftInstallSnapshot(cluster, c, args[2:])
 	case "propose":
 		// execRaftPropose handles event proposal as leader
 		// command line: raft propose <logEntry>
@@ -641,6 +822,10 @@ func execRaft(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	case "get-leader":
 		// execRaftGetLeader returns leader id and address
 		return execRaftGetLeader(cluster, c, args[2:])
+	case "promote":
+		// execRaftPromote turns a learner into voter as leader
+		// command line: raft promote nodeID
+		return execRaftPromote(cluster, c, args[2:])
 	case "get-offset":
 		// execRaftGetOffset returns log offset of current leader
 		return execRaftGetOffset(cluster, c, args[2:])
@@ -734,7 +919,15 @@ func execRaftRequestVote(cluster *Cluster, c redis.Connection, args [][]byte) re
 		logger.Info("deny request vote from " + req.nodeID + " for earlier term")
 		return protocol.MakeMultiBulkReply(resp.marshal())
 	}
-	// todo: if req.term > raft.term step down as leader?
+	if req.term > raft.term {
+		// a new term begins, votes of previous terms are out of date
+		if raft.state == leader || raft.state == candidate {
+			logger.Info("step down for newer term of " + req.nodeID)
+			raft.stepDown()
+		}
+		raft.term = req.term
+		raft.votedFor = ""
+	}
 	lastLogTerm, lastLogIndex := raft.getLogProgressWithinLock()
 	if compareLogIndex(req.lastLogTerm, req.lastLogIndex, lastLogTerm, lastLogIndex) < 0 {
 		resp.term = raft.term
@@ -764,6 +957,42 @@ func execRaftRequestVote(cluster *Cluster, c redis.Connection, args [][]byte) re
 	return protocol.MakeMultiBulkReply(resp.marshal())
 }
 
+// execRaftPreVote command line: raft pre-vote nodeID term index term
+// grants if the candidate could win an election, nothing is changed
+func execRaftPreVote(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 4 {
+		return protocol.MakeArgNumErrReply("raft pre-vote")
+	}
+	req := &voteReq{}
+	err := req.unmarshal(args)
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	raft := cluster.asRaft()
+	raft.mu.RLock()
+	defer raft.mu.RUnlock()
+	resp := &voteResp{
+		term: raft.term,
+	}
+	if req.term <= raft.term {
+		return protocol.MakeMultiBulkReply(resp.marshal())
+	}
+	// deny if leader is still alive
+	if raft.state == leader {
+		return protocol.MakeMultiBulkReply(resp.marshal())
+	}
+	if leaderNode := raft.nodes[raft.leaderId]; leaderNode != nil && raft.leaderId != req.nodeID &&
+		time.Since(leaderNode.lastHeard) < electionTimeoutMinMs*time.Millisecond {
+		return protocol.MakeMultiBulkReply(resp.marshal())
+	}
+	lastLogTerm, lastLogIndex := raft.getLogProgressWithinLock()
+	if compareLogIndex(req.lastLogTerm, req.lastLogIndex, lastLogTerm, lastLogIndex) < 0 {
+		return protocol.MakeMultiBulkReply(resp.marshal())
+	}
+	resp.voteFor = req.nodeID
+	return protocol.MakeMultiBulkReply(resp.marshal())
+}
+
 type heartbeatRequest struct {
 	leaderId     string
 	term         int
@@ -847,33 +1076,49 @@ func execRaftHeartbeat(cluster *Cluster, c redis.Connection, args [][]byte) redi
 	} else if req.term > raft.term {
 		logger.Info("accept new leader " + req.leaderId)
 		raft.mu.Lock()
-		// todo: if current node is not at follower state
 		raft.term = req.term
 		raft.votedFor = ""
 		raft.leaderId = req.leaderId
+		if raft.state == leader {
+			raft.stepDown()
+		}
 		raft.mu.Unlock()
 	}
+	raft.mu.Lock()
+	if raft.state == candidate {
+		// another node has won the election of current term
+		raft.stepDown()
+		raft.leaderId = req.leaderId
+	}
+	raft.mu.Unlock()
 	raft.mu.RLock()
 	// heartbeat may arrive earlier than follower ready
 	if raft.heartbeatChan == nil {
 		raft.mu.RUnlock()
 		return protocol.MakeErrReply(nodeNotReady)
 	}
-	if len(req.entries) > 0 && compareLogIndex(req.prevLogTerm, req.prevLogIndex, raft.baseTerm, raft.baseIndex) != 0 {
-		raft.mu.RUnlock()
-		return protocol.MakeErrReply(prevLogMismatch)
+	receivedIndex := raft.proposedIndex
+	if len(req.entries) > 0 {
+		// follower must have the entry right before the new entries
+		prevLogTerm, ok := raft.getLogTerm(req.prevLogIndex)
+		if !ok || prevLogTerm != req.prevLogTerm {
+			raft.mu.RUnlock()
+			return protocol.MakeErrReply(prevLogMismatch)
+		}
+		receivedIndex = req.prevLogIndex + len(req.entries)
 	}
 	raft.mu.RUnlock()
 
 	raft.heartbeatChan <- &heartbeat{
-		sender:   req.leaderId,
-		term:     req.term,
-		entries:  req.entries,
-		commitTo: req.commitTo,
+		sender:       req.leaderId,
+		term:         req.term,
+		prevLogIndex: req.prevLogIndex,
+		entries:      req.entries,
+		commitTo:     req.commitTo,
 	}
 	return protocol.MakeMultiBulkReply(utils.ToCmdLine(
 		strconv.Itoa(req.term),
-		strconv.Itoa(raft.proposedIndex+len(req.entries)), // new received index
+		strconv.Itoa(receivedIndex), // new received index
 	))
 }
 
@@ -994,6 +1239,14 @@ func (raft *Raft) propose(e *logEntry) protocol.ErrorReply {
 	defer wgPool.Put(wg)
 	e.wg = wg
 	raft.mu.Lock()
+	if raft.state != leader {
+		raft.mu.Unlock()
+		return protocol.MakeErrReply("ERR not leader")
+	}
+	if raft.transferee != "" {
+		raft.mu.Unlock()
+		return protocol.MakeErrReply("ERR leadership is transferring to " + raft.transferee)
+	}
 	raft.proposedIndex++
 	raft.log = append(raft.log, e)
 	raft.nodeIndexMap[raft.selfNodeID].receivedIndex = raft.proposedIndex
@@ -1009,11 +1262,11 @@ func (raft *Raft) Join(seed string) protocol.ErrorReply {
 	cluster := raft.cluster
 
 	/* STEP1: get leader from seed */
-	seedCli, err := cluster.clientFactory.GetPeerClient(seed)
+	seedCli, err := cluster.clientFactory.GetBusClient(seed)
 	if err != nil {
 		return protocol.MakeErrReply("connect with seed failed: " + err.Error())
 	}
-	defer cluster.clientFactory.ReturnPeerClient(seed, seedCli)
+	defer cluster.clientFactory.ReturnBusClient(seed, seedCli)
 	ret := seedCli.Send(utils.ToCmdLine("raft", "get-leader"))
 	if protocol.IsErrorReply(ret) {
 		return ret.(protocol.ErrorReply)
@@ -1025,12 +1278,16 @@ func (raft *Raft) Join(seed string) protocol.ErrorReply {
 	leaderAddr := string(leaderInfo.Args[1])
 
 	/* STEP2: join raft group */
-	leaderCli, err := cluster.clientFactory.GetPeerClient(leaderAddr)
+	leaderCli, err := cluster.clientFactory.GetBusClient(leaderAddr)
 	if err != nil {
 		return protocol.MakeErrReply("connect with seed failed: " + err.Error())
 	}
-	defer cluster.clientFactory.ReturnPeerClient(leaderAddr, leaderCli)
-	ret = leaderCli.Send(utils.ToCmdLine("raft", "join", cluster.addr))
+	defer cluster.clientFactory.ReturnBusClient(leaderAddr, leaderCli)
+	joinCmdLine := utils.ToCmdLine("raft", "join", makeSeedAddr(cluster.addr))
+	if config.Properties.ClusterLearner {
+		joinCmdLine = append(joinCmdLine, []byte("learner"))
+	}
+	ret = leaderCli.Send(joinCmdLine)
 	if protocol.IsErrorReply(ret) {
 		return ret.(protocol.ErrorReply)
 	}
@@ -1069,6 +1326,7 @@ func (raft *Raft) LoadConfigFile() protocol.ErrorReply {
 	if errReply := raft.loadSnapshot(snapshot); errReply != nil {
 		return errReply
 	}
+	raft.loadSnapshotFile()
 	raft.cluster.self = raft.selfNodeID
 	raft.start(raft.state)
 	return nil
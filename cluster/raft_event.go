@@ -7,21 +7,38 @@ import (
 	"goRedisPlus/lib/utils"
 	"goRedisPlus/redis/connection"
 	"goRedisPlus/redis/protocol"
+	"strings"
+	"time"
 )
 
 const (
 	eventNewNode = iota + 1
 	eventSetSlot
+	eventRemoveNode
+	eventSetMaster
+	eventFailover
+	eventPromoteLearner
 )
 
+// forgetBanPeriod is the period during which a forgotten node cannot rejoin the cluster, see CLUSTER FORGET
+const forgetBanPeriod = 60 * time.Second
+
 // invoker should provide with raft.mu lock
 func (raft *Raft) applyLogEntries(entries []*logEntry) {
+	var messages []string
 	for _, entry := range entries {
+		if msg := makeTopologyMessage(entry); msg != "" {
+			messages = append(messages, msg)
+		}
 		switch entry.Event {
 		case eventNewNode:
 			node := &Node{
-				ID:   entry.NodeID,
-				Addr: entry.Addr,
+				ID:      entry.NodeID,
+				Addr:    entry.Addr,
+				BusAddr: entry.BusAddr,
+			}
+			if entry.Learner {
+				node.setState(learner)
 			}
 			raft.nodes[node.ID] = node
 			if raft.state == leader {
@@ -47,12 +64,59 @@ func (raft *Raft) applyLogEntries(entries []*logEntry) {
 				newNode := raft.nodes[slot.NodeID]
 				newNode.Slots = append(newNode.Slots, slot)
 			}
+			if newNode := raft.nodes[entry.NodeID]; newNode != nil && len(entry.SlotIDs) > 0 {
+				bumpConfigEpoch(raft.nodes, newNode)
+			}
+		case eventRemoveNode:
+			delete(raft.nodes, entry.NodeID)
+			if raft.state == leader {
+				delete(raft.nodeIndexMap, entry.NodeID)
+			}
+			if raft.bannedNodes == nil {
+				raft.bannedNodes = make(map[string]time.Time)
+			}
+			raft.bannedNodes[entry.NodeID] = time.Now().Add(forgetBanPeriod)
+		case eventSetMaster:
+			if node := raft.nodes[entry.NodeID]; node != nil {
+				node.MasterID = entry.MasterID
+			}
+		case eventFailover:
+			// replica NodeID takes over slots of its master MasterID, the former master becomes its replica
+			replica := raft.nodes[entry.NodeID]
+			if replica == nil || replica.MasterID != entry.MasterID {
+				// another replica has taken over
+				logger.Infof("ignore failover of %s, it is not a replica of %s", entry.NodeID, entry.MasterID)
+				break
+			}
+			for _, node := range raft.nodes {
+				if node.MasterID == entry.MasterID {
+					node.MasterID = replica.ID
+				}
+			}
+			replica.MasterID = ""
+			// slots taken over must beat the claims of former master
+			bumpConfigEpoch(raft.nodes, replica)
+			if master := raft.nodes[entry.MasterID]; master != nil {
+				for _, slot := range master.Slots {
+					slot.NodeID = replica.ID
+					replica.Slots = append(replica.Slots, slot)
+				}
+				master.Slots = nil
+				master.MasterID = replica.ID
+			}
+		case eventPromoteLearner:
+			if node := raft.nodes[entry.NodeID]; node != nil && node.getState() == learner {
+				node.setState(follower)
+			}
 		}
 	}
 	if err := raft.persist(); err != nil {
 		logger.Errorf("persist raft error: %v", err)
 	}
-
+	if len(messages) > 0 {
+		// publish out of raft lock, subscribers may be slow
+		go raft.cluster.publishTopologyMessages(messages)
+	}
 }
 
 // NewNode creates a new Node when a node request self node for joining cluster
@@ -95,31 +159,152 @@ func (raft *Raft) SetSlot(slotIDs []uint32, newNodeID string) protocol.ErrorRepl
 	return nil
 }
 
+// RemoveNode propose to remove a node from the cluster
+func (raft *Raft) RemoveNode(nodeID string) protocol.ErrorReply {
+	proposal := &logEntry{
+		Event:  eventRemoveNode,
+		NodeID: nodeID,
+	}
+	conn := connection.NewFakeConn()
+	resp := raft.cluster.relay(raft.leaderId, conn,
+		utils.ToCmdLine("raft", "propose", string(proposal.marshal())))
+	if err, ok := resp.(protocol.ErrorReply); ok {
+		return err
+	}
+	return nil
+}
+
+// SetMaster propose to make node a replica of master, an empty masterID makes it a master
+func (raft *Raft) SetMaster(nodeID string, masterID string) protocol.ErrorReply {
+	proposal := &logEntry{
+		Event:    eventSetMaster,
+		NodeID:   nodeID,
+		MasterID: masterID,
+	}
+	conn := connection.NewFakeConn()
+	resp := raft.cluster.relay(raft.leaderId, conn,
+		utils.ToCmdLine("raft", "propose", string(proposal.marshal())))
+	if err, ok := resp.(protocol.ErrorReply); ok {
+		return err
+	}
+	return nil
+}
+
+// Failover propose to promote replica nodeID to take over slots of its master
+func (raft *Raft) Failover(nodeID string, masterID string) protocol.ErrorReply {
+	proposal := &logEntry{
+		Event:    eventFailover,
+		NodeID:   nodeID,
+		MasterID: masterID,
+	}
+	conn := connection.NewFakeConn()
+	resp := raft.cluster.relay(raft.leaderId, conn,
+		utils.ToCmdLine("raft", "propose", string(proposal.marshal())))
+	if err, ok := resp.(protocol.ErrorReply); ok {
+		return err
+	}
+	return nil
+}
+
+// PromoteLearner propose to turn a learner into voter
+func (raft *Raft) PromoteLearner(nodeID string) protocol.ErrorReply {
+	raft.mu.RLock()
+	leaderId := raft.leaderId
+	raft.mu.RUnlock()
+	conn := connection.NewFakeConn()
+	resp := raft.cluster.relay(leaderId, conn, utils.ToCmdLine("raft", "promote", nodeID))
+	if err, ok := resp.(protocol.ErrorReply); ok {
+		return err
+	}
+	return nil
+}
+
+// execRaftPromote handles requests to promote a learner, current node should be leader
+// command line: raft promote nodeID
+func execRaftPromote(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("raft promote")
+	}
+	raft := cluster.asRaft()
+	nodeID := string(args[0])
+	raft.mu.RLock()
+	if raft.state != leader {
+		leaderNode := raft.nodes[raft.leaderId]
+		raft.mu.RUnlock()
+		return protocol.MakeErrReply("NOT LEADER " + leaderNode.ID + " " + leaderNode.Addr)
+	}
+	node := raft.nodes[nodeID]
+	if node == nil {
+		raft.mu.RUnlock()
+		return protocol.MakeErrReply("ERR Unknown node " + nodeID)
+	}
+	if node.getState() != learner {
+		raft.mu.RUnlock()
+		return protocol.MakeErrReply("ERR " + nodeID + " is not a learner")
+	}
+	// a voter lagging behind would slow down commitment, or even stop the cluster if many of them
+	status := raft.nodeIndexMap[nodeID]
+	if status == nil || status.receivedIndex < raft.committedIndex {
+		raft.mu.RUnlock()
+		return protocol.MakeErrReply("ERR " + nodeID + " has not caught up with leader")
+	}
+	raft.mu.RUnlock()
+	proposal := &logEntry{
+		Event:  eventPromoteLearner,
+		NodeID: nodeID,
+	}
+	if err := raft.propose(proposal); err != nil {
+		return err
+	}
+	return protocol.MakeOkReply()
+}
+
+// isBanned returns whether the node has been forgotten recently
+// invoker should provide with raft.mu lock
+func (raft *Raft) isBanned(nodeID string) bool {
+	expireAt, ok := raft.bannedNodes[nodeID]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expireAt) {
+		delete(raft.bannedNodes, nodeID)
+		return false
+	}
+	return true
+}
+
 // execRaftJoin handles requests from a new node to join raft group, current node should be leader
-// command line: raft join addr
+// command line: raft join addr[@busport] [learner]
 func execRaftJoin(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		return protocol.MakeArgNumErrReply("raft join")
 	}
+	asLearner := len(args) == 2 && strings.ToLower(string(args[1])) == "learner"
 	raft := cluster.asRaft()
 	if raft.state != leader {
 		leaderNode := raft.nodes[raft.leaderId]
 		return protocol.MakeErrReply("NOT LEADER " + leaderNode.ID + " " + leaderNode.Addr)
 	}
-	addr := string(args[0])
+	addr, busAddr := parseSeedAddr(string(args[0]))
 	nodeID := addr
 
-	raft.mu.RLock()
+	raft.mu.Lock()
 	_, exist := raft.nodes[addr]
-	raft.mu.RUnlock()
+	banned := raft.isBanned(nodeID)
+	raft.mu.Unlock()
+	if banned {
+		return protocol.MakeErrReply("ERR node " + nodeID + " has been forgotten recently, try later")
+	}
 	// if node has joint cluster but terminated before persisting cluster config,
 	// it may try to join at next start.
 	// In this case, we only have to send a snapshot for it
 	if !exist {
 		proposal := &logEntry{
-			Event:  eventNewNode,
-			NodeID: nodeID,
-			Addr:   addr,
+			Event:   eventNewNode,
+			NodeID:  nodeID,
+			Addr:    addr,
+			BusAddr: busAddr,
+			Learner: asLearner,
 		}
 		if err := raft.propose(proposal); err != nil {
 			return err
@@ -1,9 +1,16 @@
 package cluster
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
 	"goRedisPlus/redis/protocol"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -85,8 +92,11 @@ func unmarshalSlotIds(args []string) ([]uint32, error) {
 type nodePayload struct {
 	ID       string   `json:"id"`
 	Addr     string   `json:"addr"`
+	BusAddr  string   `json:"busAddr,omitempty"`
 	SlotDesc []string `json:"slotDesc"`
 	Flags    uint32   `json:"flags"`
+	MasterID string   `json:"masterId,omitempty"`
+	Epoch    uint64   `json:"configEpoch,omitempty"`
 }
 
 func marshalNodes(nodes map[string]*Node) [][]byte {
@@ -96,8 +106,11 @@ func marshalNodes(nodes map[string]*Node) [][]byte {
 		payload := &nodePayload{
 			ID:       node.ID,
 			Addr:     node.Addr,
+			BusAddr:  node.BusAddr,
 			SlotDesc: slotLines,
 			Flags:    node.Flags,
+			MasterID: node.MasterID,
+			Epoch:    node.ConfigEpoch,
 		}
 		bin, _ := json.Marshal(payload)
 		args = append(args, bin)
@@ -118,9 +131,12 @@ func unmarshalNodes(args [][]byte) (map[string]*Node, error) {
 			return nil, err
 		}
 		node := &Node{
-			ID:    payload.ID,
-			Addr:  payload.Addr,
-			Flags: payload.Flags,
+			ID:          payload.ID,
+			Addr:        payload.Addr,
+			BusAddr:     payload.BusAddr,
+			Flags:       payload.Flags,
+			MasterID:    payload.MasterID,
+			ConfigEpoch: payload.Epoch,
 		}
 		for _, slotId := range slotIds {
 			node.Slots = append(node.Slots, &Slot{
@@ -202,3 +218,197 @@ func (raft *Raft) loadSnapshot(snapshot [][]byte) protocol.ErrorReply {
 	raft.nodes = nodes
 	return nil
 }
+
+// Log compaction:
+// Once more than raftLogCompactThreshold entries have been applied, the topology state is saved into the snapshot file
+// next to the topology file, and the applied entries are dropped from memory.
+// The snapshot file consists of index and term of the last entry it covers, followed by nodes (see marshalNodes).
+// Leader sends `raft install-snapshot` to followers which need compacted entries or have conflicting entries.
+
+// raftLogCompactThreshold is the count of applied entries kept in memory before compaction
+const raftLogCompactThreshold = 1000
+
+func (raft *Raft) snapshotFile() string {
+	if raft.persistFile == "" {
+		return ""
+	}
+	return raft.persistFile + ".snapshot"
+}
+
+// compactLog drops applied entries after saving snapshot
+// invoker provide with lock
+func (raft *Raft) compactLog() {
+	if raft.committedIndex-raft.baseIndex < raftLogCompactThreshold {
+		return
+	}
+	lastTerm, ok := raft.getLogTerm(raft.committedIndex)
+	if !ok {
+		return
+	}
+	if err := raft.persistSnapshot(raft.committedIndex, lastTerm); err != nil {
+		logger.Errorf("persist raft snapshot error: %v", err)
+		return
+	}
+	// copy remaining entries, so that the dropped entries could be collected
+	remaining := raft.getLogEntriesFrom(raft.committedIndex + 1)
+	raft.log = append([]*logEntry{}, remaining...)
+	raft.baseIndex = raft.committedIndex
+	raft.baseTerm = lastTerm
+	logger.Infof("raft log compacted to index %d", raft.baseIndex)
+}
+
+// persistSnapshot saves nodes into snapshot file
+// invoker provide with lock
+func (raft *Raft) persistSnapshot(lastIndex, lastTerm int) error {
+	filename := raft.snapshotFile()
+	if filename == "" {
+		return nil
+	}
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(strconv.Itoa(lastIndex) + "\n")
+	buf.WriteString(strconv.Itoa(lastTerm) + "\n")
+	for _, line := range marshalNodes(raft.nodes) {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmpFile, err := os.CreateTemp(config.Properties.Dir, "tmp-cluster-snapshot-*.conf")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(buf.Bytes())
+	_ = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+// loadSnapshotFile restores term of the last compacted entry after topology file loaded,
+// topology file only records the committed index
+// invoker provide with lock
+func (raft *Raft) loadSnapshotFile() {
+	filename := raft.snapshotFile()
+	if filename == "" {
+		return
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	var header []int
+	for len(header) < 2 && scanner.Scan() {
+		v, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			logger.Errorf("illegal raft snapshot file %s", filename)
+			return
+		}
+		header = append(header, v)
+	}
+	if len(header) == 2 && header[0] == raft.baseIndex {
+		raft.baseTerm = header[1]
+	}
+}
+
+// makeInstallSnapshotCmd returns command line of install-snapshot to send committed topology to followers
+// invoker provide with lock
+func (raft *Raft) makeInstallSnapshotCmd() [][]byte {
+	lastTerm, ok := raft.getLogTerm(raft.committedIndex)
+	if !ok {
+		lastTerm = raft.baseTerm
+	}
+	cmdLine := utils.ToCmdLine(
+		"raft",
+		"install-snapshot",
+		raft.selfNodeID,
+		strconv.Itoa(raft.term),
+		strconv.Itoa(raft.committedIndex),
+		strconv.Itoa(lastTerm),
+	)
+	return append(cmdLine, marshalNodes(raft.nodes)...)
+}
+
+// execRaftInstallSnapshot replaces log of follower with snapshot of leader
+// command line: raft install-snapshot leaderId term lastIndex lastTerm node...
+// returns term and received index
+func execRaftInstallSnapshot(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 5 {
+		return protocol.MakeArgNumErrReply("raft install-snapshot")
+	}
+	leaderId := string(args[0])
+	var nums [3]int
+	for i := range nums {
+		v, err := strconv.Atoi(string(args[i+1]))
+		if err != nil {
+			return protocol.MakeErrReply("illegal number: " + string(args[i+1]))
+		}
+		nums[i] = v
+	}
+	term, lastIndex, lastTerm := nums[0], nums[1], nums[2]
+	nodes, err := unmarshalNodes(args[4:])
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+
+	raft := cluster.asRaft()
+	raft.mu.Lock()
+	if term < raft.term {
+		defer raft.mu.Unlock()
+		return protocol.MakeMultiBulkReply(utils.ToCmdLine(
+			strconv.Itoa(raft.term),
+			strconv.Itoa(raft.proposedIndex),
+		))
+	}
+	if raft.heartbeatChan == nil {
+		raft.mu.Unlock()
+		return protocol.MakeErrReply(nodeNotReady)
+	}
+	if lastIndex < raft.committedIndex {
+		raft.mu.Unlock()
+		return protocol.MakeErrReply("ERR snapshot is older than committed log")
+	}
+	if term > raft.term {
+		raft.term = term
+		raft.votedFor = ""
+	}
+	raft.leaderId = leaderId
+	// make sure raft.slots and node.Slots is the same object
+	raft.slots = make([]*Slot, slotCount)
+	for _, node := range nodes {
+		for _, slot := range node.Slots {
+			raft.slots[int(slot.ID)] = slot
+		}
+		if old := raft.nodes[node.ID]; old != nil {
+			node.lastHeard = old.lastHeard
+		}
+	}
+	raft.nodes = nodes
+	// entries after snapshot may conflict with leader, leader will send them again
+	raft.initLog(lastTerm, lastIndex, nil)
+	raft.committedIndex = lastIndex
+	raft.proposedIndex = lastIndex
+	if err := raft.persist(); err != nil {
+		logger.Errorf("persist raft error: %v", err)
+	}
+	if err := raft.persistSnapshot(lastIndex, lastTerm); err != nil {
+		logger.Errorf("persist raft snapshot error: %v", err)
+	}
+	currentTerm := raft.term
+	heartbeatChan := raft.heartbeatChan
+	raft.mu.Unlock()
+	logger.Infof("installed raft snapshot of index %d from %s", lastIndex, leaderId)
+
+	// reset election timer
+	heartbeatChan <- &heartbeat{
+		sender:   leaderId,
+		term:     currentTerm,
+		commitTo: lastIndex,
+	}
+	return protocol.MakeMultiBulkReply(utils.ToCmdLine(
+		strconv.Itoa(currentTerm),
+		strconv.Itoa(lastIndex),
+	))
+}
@@ -0,0 +1,148 @@
+package cluster
+
+import (
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+	"time"
+)
+
+// Leadership transfer:
+// Before maintenance of the leader, operator could hand leadership over to another node by CLUSTER TRANSFER-LEADER.
+// The leader stops accepting proposals, waits for the target catching up with its log, then sends `raft timeout-now`
+// to let the target start election at once without pre-vote. The former leader steps down after seeing the newer term.
+
+const transferCheckInterval = 100 * time.Millisecond
+
+// TransferLeader asks leader to hand leadership over to the node
+func (raft *Raft) TransferLeader(nodeID string) protocol.ErrorReply {
+	raft.mu.RLock()
+	leaderId := raft.leaderId
+	raft.mu.RUnlock()
+	conn := connection.NewFakeConn()
+	resp := raft.cluster.relay(leaderId, conn, utils.ToCmdLine("raft", "transfer-leader", nodeID))
+	if err, ok := resp.(protocol.ErrorReply); ok {
+		return err
+	}
+	return nil
+}
+
+// execRaftTransferLeader command line: raft transfer-leader nodeID
+// returns after the target has started election
+func execRaftTransferLeader(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("raft transfer-leader")
+	}
+	target := string(args[0])
+	raft := cluster.asRaft()
+	raft.mu.Lock()
+	if raft.state != leader {
+		leaderNode := raft.nodes[raft.leaderId]
+		raft.mu.Unlock()
+		if leaderNode == nil {
+			return protocol.MakeErrReply("ERR no leader")
+		}
+		return protocol.MakeErrReply("NOT LEADER " + leaderNode.ID + " " + leaderNode.Addr)
+	}
+	if target == raft.selfNodeID {
+		raft.mu.Unlock()
+		return protocol.MakeOkReply()
+	}
+	if raft.nodes[target] == nil {
+		raft.mu.Unlock()
+		return protocol.MakeErrReply("ERR Unknown node " + target)
+	}
+	if !raft.isVoter(target) {
+		raft.mu.Unlock()
+		return protocol.MakeErrReply("ERR cannot transfer leadership to learner " + target)
+	}
+	if raft.transferee != "" {
+		raft.mu.Unlock()
+		return protocol.MakeErrReply("ERR leadership is transferring to " + raft.transferee)
+	}
+	raft.transferee = target
+	term := raft.term
+	raft.mu.Unlock()
+
+	// cancel transfer if leader is still in the same term when failed
+	cancel := func() {
+		raft.mu.Lock()
+		if raft.state == leader && raft.term == term {
+			raft.transferee = ""
+		}
+		raft.mu.Unlock()
+	}
+
+	// wait for target catching up, no more proposals are accepted
+	deadline := time.Now().Add(electionTimeoutMinMs * time.Millisecond)
+	for {
+		raft.mu.RLock()
+		stillLeader := raft.state == leader && raft.term == term
+		status := raft.nodeIndexMap[target]
+		caughtUp := status != nil && status.receivedIndex >= raft.proposedIndex
+		raft.mu.RUnlock()
+		if !stillLeader {
+			return protocol.MakeErrReply("ERR leadership changed during transfer")
+		}
+		if caughtUp {
+			break
+		}
+		if time.Now().After(deadline) {
+			cancel()
+			return protocol.MakeErrReply("ERR " + target + " cannot catch up with leader")
+		}
+		time.Sleep(transferCheckInterval)
+	}
+
+	conn := connection.NewFakeConn()
+	resp := raft.cluster.relay(target, conn, utils.ToCmdLine("raft", "timeout-now", raft.selfNodeID, strconv.Itoa(term)))
+	if err, ok := resp.(protocol.ErrorReply); ok {
+		cancel()
+		return err
+	}
+	logger.Infof("transfer leadership to %s", target)
+
+	// wait for target winning the election
+	deadline = time.Now().Add(electionTimeoutMaxMs * time.Millisecond)
+	for time.Now().Before(deadline) {
+		raft.mu.RLock()
+		stillLeader := raft.state == leader && raft.term == term
+		raft.mu.RUnlock()
+		if !stillLeader {
+			return protocol.MakeOkReply()
+		}
+		time.Sleep(transferCheckInterval)
+	}
+	cancel()
+	return protocol.MakeErrReply("ERR " + target + " did not take over leadership in time")
+}
+
+// execRaftTimeoutNow command line: raft timeout-now leaderId term
+// the target of leadership transfer starts election immediately
+func execRaftTimeoutNow(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("raft timeout-now")
+	}
+	leaderId := string(args[0])
+	term, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return protocol.MakeErrReply("illegal term: " + string(args[1]))
+	}
+	raft := cluster.asRaft()
+	raft.mu.Lock()
+	if raft.leaderId != leaderId || raft.term != term || raft.state != follower {
+		raft.mu.Unlock()
+		return protocol.MakeErrReply("ERR stale leadership transfer")
+	}
+	raft.skipPreVote = true
+	electionNow := raft.electionNow
+	raft.mu.Unlock()
+	select {
+	case electionNow <- struct{}{}:
+	default:
+	}
+	return protocol.MakeOkReply()
+}
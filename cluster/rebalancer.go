@@ -0,0 +1,352 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Automatic rebalancing:
+// If cluster-rebalance is propose or auto, the coordinator (raft leader, or the first master when topology is in etcd)
+// collects load of every slot from masters by `gcluster slot-load` each cluster-rebalance-period seconds.
+// When the heaviest master exceeds the average by cluster-rebalance-threshold percent for rebalanceConfirmRounds
+// rounds in a row, it plans to move slots from the heaviest to the lightest until the heaviest is within half of the
+// threshold. In propose mode the plan is only shown by CLUSTER REBALANCE STATUS, in auto mode it is executed like
+// CLUSTER RESHARD. Slots moved recently are not moved again during rebalanceCooldown, to avoid flapping.
+
+const (
+	rebalanceModeOff     = "off"
+	rebalanceModePropose = "propose"
+	rebalanceModeAuto    = "auto"
+
+	defaultRebalancePeriod    = 60 // seconds
+	defaultRebalanceThreshold = 20 // percent
+	rebalanceConfirmRounds    = 2
+	rebalanceMaxMoves         = 16
+	rebalanceMinTotalLoad     = 1000
+	rebalanceCooldown         = 30 * time.Minute
+)
+
+const (
+	moveStatePlanned = "planned"
+	moveStateDone    = "done"
+	moveStateFailed  = "failed"
+)
+
+type rebalanceMove struct {
+	slotID uint32
+	source string
+	target string
+	load   int
+	state  string
+	err    string
+}
+
+type rebalancer struct {
+	mu               sync.Mutex
+	imbalancedRounds int
+	lastMoved        map[uint32]time.Time
+	plan             []*rebalanceMove
+	planTime         time.Time
+}
+
+func makeRebalancer() *rebalancer {
+	return &rebalancer{
+		lastMoved: make(map[uint32]time.Time),
+	}
+}
+
+func getRebalanceMode() string {
+	mode := strings.ToLower(config.Properties.RebalanceMode)
+	if mode != rebalanceModePropose && mode != rebalanceModeAuto {
+		return rebalanceModeOff
+	}
+	return mode
+}
+
+// getSlotLoad returns load of slot hosted by current node, measured by cluster-rebalance-metric (see slot_stats.go)
+func (cluster *Cluster) getSlotLoad(slotID uint32, slot *hostSlot) int {
+	switch strings.ToLower(config.Properties.RebalanceMetric) {
+	case slotStatMemoryBytes:
+		return int(cluster.estimateSlotMemory(slot))
+	case slotStatOpsPerSec:
+		_, opsPerSec := cluster.slotMetrics.get(slotID)
+		return int(opsPerSec)
+	}
+	slot.mu.RLock()
+	defer slot.mu.RUnlock()
+	return slot.keys.Len()
+}
+
+// execGClusterSlotLoad command line: gcluster slot-load
+// returns count of slots in migration, then load of each slot hosted by current node: [migrating, slot, load, ...]
+func execGClusterSlotLoad(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cluster.slotMu.RLock()
+	slots := make(map[uint32]*hostSlot, len(cluster.slots))
+	for slotID, slot := range cluster.slots {
+		slots[slotID] = slot
+	}
+	cluster.slotMu.RUnlock()
+	migrating := 0
+	result := [][]byte{nil}
+	for slotID, slot := range slots {
+		if slot.state != slotStateHost {
+			migrating++
+			continue
+		}
+		result = append(result,
+			[]byte(strconv.Itoa(int(slotID))),
+			[]byte(strconv.Itoa(cluster.getSlotLoad(slotID, slot))),
+		)
+	}
+	result[0] = []byte(strconv.Itoa(migrating))
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// isCoordinator returns whether current node should run cluster-wide jobs such as rebalancing
+func (cluster *Cluster) isCoordinator() bool {
+	if raft, ok := cluster.topology.(*Raft); ok {
+		raft.mu.RLock()
+		defer raft.mu.RUnlock()
+		return raft.state == leader
+	}
+	masters := cluster.getMasterNodes()
+	return len(masters) > 0 && masters[0].ID == cluster.self
+}
+
+// collectSlotLoads returns load of slots on each master, it fails if any master is unreachable or migrating slots
+func (cluster *Cluster) collectSlotLoads() (map[string]map[uint32]int, error) {
+	result := make(map[string]map[uint32]int)
+	for _, node := range cluster.getMasterNodes() {
+		reply := cluster.relay(node.ID, connection.NewFakeConn(), utils.ToCmdLine("gcluster", "slot-load"))
+		if errReply, ok := reply.(protocol.ErrorReply); ok {
+			return nil, fmt.Errorf("get slot load from %s failed: %s", node.ID, errReply.Error())
+		}
+		payload, ok := reply.(*protocol.MultiBulkReply)
+		if !ok || len(payload.Args)%2 != 1 {
+			return nil, fmt.Errorf("get slot load from %s failed: illegal reply", node.ID)
+		}
+		if string(payload.Args[0]) != "0" {
+			return nil, fmt.Errorf("%s is migrating slots", node.ID)
+		}
+		loads := make(map[uint32]int, len(payload.Args)/2)
+		for i := 1; i+1 < len(payload.Args); i += 2 {
+			slotID, err1 := strconv.Atoi(string(payload.Args[i]))
+			load, err2 := strconv.Atoi(string(payload.Args[i+1]))
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("get slot load from %s failed: illegal reply", node.ID)
+			}
+			loads[uint32(slotID)] = load
+		}
+		result[node.ID] = loads
+	}
+	return result, nil
+}
+
+// planRebalance returns slot moves to even out load of nodes, or nil if nodes are balanced enough.
+// skip returns whether a slot should not be moved.
+func planRebalance(slotLoads map[string]map[uint32]int, threshold int, skip func(slotID uint32) bool) []*rebalanceMove {
+	if len(slotLoads) < 2 {
+		return nil
+	}
+	nodeIDs := make([]string, 0, len(slotLoads))
+	nodeLoads := make(map[string]int, len(slotLoads))
+	total := 0
+	for nodeID, slots := range slotLoads {
+		nodeIDs = append(nodeIDs, nodeID)
+		for _, load := range slots {
+			nodeLoads[nodeID] += load
+			total += load
+		}
+	}
+	if total < rebalanceMinTotalLoad {
+		return nil
+	}
+	sort.Strings(nodeIDs)
+	avg := float64(total) / float64(len(nodeIDs))
+	triggerLoad := avg * (1 + float64(threshold)/100)
+	targetLoad := avg * (1 + float64(threshold)/200) // stop at half of threshold for hysteresis
+
+	findExtremes := func() (string, string) {
+		heaviest, lightest := nodeIDs[0], nodeIDs[0]
+		for _, nodeID := range nodeIDs {
+			if nodeLoads[nodeID] > nodeLoads[heaviest] {
+				heaviest = nodeID
+			}
+			if nodeLoads[nodeID] < nodeLoads[lightest] {
+				lightest = nodeID
+			}
+		}
+		return heaviest, lightest
+	}
+	heaviest, _ := findExtremes()
+	if float64(nodeLoads[heaviest]) <= triggerLoad {
+		return nil
+	}
+
+	var moves []*rebalanceMove
+	planned := make(map[uint32]struct{})
+	for len(moves) < rebalanceMaxMoves {
+		heaviest, lightest := findExtremes()
+		if float64(nodeLoads[heaviest]) <= targetLoad {
+			break
+		}
+		gap := nodeLoads[heaviest] - nodeLoads[lightest]
+		// pick the heaviest slot which makes the two nodes closer
+		var candidate uint32
+		candidateLoad := 0
+		for slotID, load := range slotLoads[heaviest] {
+			if _, ok := planned[slotID]; ok || load <= 0 || load >= gap || skip(slotID) {
+				continue
+			}
+			if load > candidateLoad || load == candidateLoad && slotID < candidate {
+				candidate, candidateLoad = slotID, load
+			}
+		}
+		if candidateLoad == 0 {
+			break
+		}
+		planned[candidate] = struct{}{}
+		delete(slotLoads[heaviest], candidate)
+		slotLoads[lightest][candidate] = candidateLoad
+		nodeLoads[heaviest] -= candidateLoad
+		nodeLoads[lightest] += candidateLoad
+		moves = append(moves, &rebalanceMove{
+			slotID: candidate,
+			source: heaviest,
+			target: lightest,
+			load:   candidateLoad,
+			state:  moveStatePlanned,
+		})
+	}
+	return moves
+}
+
+func (rb *rebalancer) inCooldown(slotID uint32) bool {
+	movedAt, ok := rb.lastMoved[slotID]
+	return ok && time.Since(movedAt) < rebalanceCooldown
+}
+
+// rebalanceCron examines load periodically, it is started with cluster
+func (cluster *Cluster) rebalanceCron() {
+	period := config.Properties.RebalancePeriod
+	if period <= 0 {
+		period = defaultRebalancePeriod
+	}
+	ticker := time.NewTicker(time.Duration(period) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			mode := getRebalanceMode()
+			if mode == rebalanceModeOff || cluster.topology.GetSelfNodeID() == "" {
+				continue
+			}
+			if err := cluster.rebalance(mode == rebalanceModeAuto); err != nil {
+				logger.Warn("rebalance failed: " + err.Error())
+			}
+		case <-cluster.closeChan:
+			return
+		}
+	}
+}
+
+// rebalance runs a round of rebalancing, moves are executed if execute is true
+func (cluster *Cluster) rebalance(execute bool) error {
+	rb := cluster.rebalancer
+	if !cluster.isCoordinator() {
+		rb.mu.Lock()
+		rb.imbalancedRounds = 0
+		rb.mu.Unlock()
+		return nil
+	}
+	slotLoads, err := cluster.collectSlotLoads()
+	if err != nil {
+		return err
+	}
+	threshold := config.Properties.RebalanceThreshold
+	if threshold <= 0 {
+		threshold = defaultRebalanceThreshold
+	}
+	rb.mu.Lock()
+	moves := planRebalance(slotLoads, threshold, rb.inCooldown)
+	if len(moves) == 0 {
+		rb.imbalancedRounds = 0
+		rb.mu.Unlock()
+		return nil
+	}
+	rb.imbalancedRounds++
+	if rb.imbalancedRounds < rebalanceConfirmRounds {
+		rb.mu.Unlock()
+		return nil
+	}
+	rb.imbalancedRounds = 0
+	rb.plan = moves
+	rb.planTime = time.Now()
+	rb.mu.Unlock()
+	logger.Infof("rebalance planned %d slot moves", len(moves))
+	if !execute {
+		return nil
+	}
+
+	for _, move := range moves {
+		_, err := cluster.reshardSlot(move.slotID, move.source, move.target)
+		rb.mu.Lock()
+		rb.lastMoved[move.slotID] = time.Now()
+		if err != nil {
+			move.state = moveStateFailed
+			move.err = err.Error()
+		} else {
+			move.state = moveStateDone
+		}
+		rb.mu.Unlock()
+		if err != nil {
+			return errors.New("move slot " + strconv.Itoa(int(move.slotID)) + " failed: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// execClusterRebalance command line: cluster rebalance status
+// shows the latest plan of automatic rebalancing
+func execClusterRebalance(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 1 || strings.ToLower(string(args[0])) != "status" {
+		return protocol.MakeErrReply("ERR Unknown CLUSTER REBALANCE subcommand. Try CLUSTER HELP")
+	}
+	rb := cluster.rebalancer
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	var planTime int64
+	if !rb.planTime.IsZero() {
+		planTime = rb.planTime.Unix()
+	}
+	result := []redis.Reply{
+		protocol.MakeMultiBulkReply([][]byte{
+			[]byte("mode"), []byte(getRebalanceMode()),
+			[]byte("coordinator"), []byte(strconv.FormatBool(cluster.isCoordinator())),
+			[]byte("imbalanced-rounds"), []byte(strconv.Itoa(rb.imbalancedRounds)),
+			[]byte("plan-time"), []byte(strconv.FormatInt(planTime, 10)),
+		}),
+	}
+	for _, move := range rb.plan {
+		result = append(result, protocol.MakeMultiBulkReply([][]byte{
+			[]byte("slot"), []byte(strconv.Itoa(int(move.slotID))),
+			[]byte("source"), []byte(move.source),
+			[]byte("target"), []byte(move.target),
+			[]byte("load"), []byte(strconv.Itoa(move.load)),
+			[]byte("state"), []byte(move.state),
+			[]byte("error"), []byte(move.err),
+		}))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
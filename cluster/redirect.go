@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+)
+
+// Redirect mode (cluster-redirect yes):
+// Instead of relaying commands to the node hosting the slot, current node replies -MOVED or -ASK like redis cluster,
+// so that smart clients could route commands by themselves.
+
+func init() {
+	registerCmd("Asking", execAsking)
+}
+
+func makeMovedReply(slotID uint32, addr string) protocol.ErrorReply {
+	return protocol.MakeErrReply("MOVED " + strconv.Itoa(int(slotID)) + " " + addr)
+}
+
+func makeAskReply(slotID uint32, addr string) protocol.ErrorReply {
+	return protocol.MakeErrReply("ASK " + strconv.Itoa(int(slotID)) + " " + addr)
+}
+
+// redirect tells client which node is hosting the slot of keys, like redis a moving out slot is still served by
+// current node until route in topology has been changed: keys existing in current node are served here and others are
+// redirected by -ASK. Different from redis, keys are not removed from current node until the whole slot has been
+// migrated, so the keys taken by the importing node are redirected too, see execDumpKey and hostSlot.exporting.
+func (cluster *Cluster) redirect(c redis.Connection, cmdLine CmdLine, slotID uint32, keys []string, peer *Node) redis.Reply {
+	hSlot := cluster.getHostSlot(slotID)
+	if hSlot == nil || hSlot.state != slotStateMovingOut {
+		return makeMovedReply(slotID, peer.Addr)
+	}
+	slot := cluster.topology.GetSlots()[int(slotID)]
+	if slot.NodeID != cluster.self {
+		return makeMovedReply(slotID, peer.Addr)
+	}
+	// route in topology has not been changed yet, the redirection is temporary
+	// the importing node could not take keys until the command finished
+	hSlot.exportMu.RLock()
+	defer hSlot.exportMu.RUnlock()
+	if hSlot.exporting {
+		return makeAskReply(slotID, peer.Addr)
+	}
+	for _, key := range keys {
+		if _, taken := hSlot.exportedKeys[key]; taken {
+			return makeAskReply(slotID, peer.Addr)
+		}
+		if _, exists := cluster.db.GetEntity(0, key); !exists {
+			// the importing node fetches keys existing here by itself, see ensureKey
+			return makeAskReply(slotID, peer.Addr)
+		}
+	}
+	cluster.slotMetrics.record(slotID)
+	return cluster.db.Exec(c, cmdLine)
+}
+
+// execDumpKey command line: DumpKey_ key
+// It is sent by the importing node to fetch key from current node, the key is no longer served here, see redirect
+func execDumpKey(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 2 {
+		return protocol.MakeArgNumErrReply("dumpkey_")
+	}
+	key := string(cmdLine[1])
+	if hSlot := cluster.getHostSlot(getSlot(key)); hSlot != nil && hSlot.state == slotStateMovingOut {
+		hSlot.exportMu.Lock()
+		if hSlot.exportedKeys == nil {
+			hSlot.exportedKeys = make(map[string]struct{})
+		}
+		hSlot.exportedKeys[key] = struct{}{}
+		hSlot.exportMu.Unlock()
+	}
+	return cluster.db.Exec(c, modifyCmd(cmdLine, "DumpKey"))
+}
+
+// execAsking is sent by client before the command redirected by -ASK.
+// The importing node always serves its importing slots (missing keys are fetched by ensureKey), so it only replies OK
+func execAsking(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("asking")
+	}
+	return protocol.MakeOkReply()
+}
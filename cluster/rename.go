@@ -23,7 +23,7 @@ func Rename(cluster *Cluster, c redis.Connection, cmdLine [][]byte) redis.Reply
 		srcNode:  {srcKey},
 		destNode: {destKey},
 	}
-	txID := cluster.idGenerator.NextID()
+	txID := cluster.beginTransaction(groupMap)
 	txIDStr := strconv.FormatInt(txID, 10)
 	// prepare rename from
 	srcPrepareResp := cluster.relay(srcNode, c, makeArgs("Prepare", txIDStr, "RenameFrom", srcKey))
@@ -107,7 +107,7 @@ func RenameNx(cluster *Cluster, c redis.Connection, cmdLine [][]byte) redis.Repl
 		srcNode:  {srcKey},
 		destNode: {destKey},
 	}
-	txID := cluster.idGenerator.NextID()
+	txID := cluster.beginTransaction(groupMap)
 	txIDStr := strconv.FormatInt(txID, 10)
 	// prepare rename from
 	srcPrepareResp := cluster.relay(srcNode, c, makeArgs("Prepare", txIDStr, "RenameFrom", srcKey))
@@ -0,0 +1,183 @@
+package cluster
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// Replica in cluster mode:
+// A node configured with `replicaof <host> <port>` replicates the node whose address is host:port,
+// an empty node could also become a replica by CLUSTER REPLICATE <node-id>.
+// It joins the cluster without hosting any slot, clients sent READONLY could read slots of its master from it.
+// Master of each node is stored in topology (Node.MasterID), every node follows its role in topology, see syncReplicaRole.
+// Once the master is marked as FAIL (see gossip.go), its replica proposes a failover to take over all slots of the master,
+// the former master and other replicas become replicas of the new master.
+
+func init() {
+	registerCmd("ReadOnly", execReadOnly)
+	registerCmd("ReadWrite", execReadWrite)
+}
+
+// getMasterIDFromConfig returns node id of the master given by replicaof config, node id is the address of node
+func getMasterIDFromConfig() string {
+	fields := strings.Fields(config.Properties.ReplicaOf)
+	if len(fields) != 2 {
+		return ""
+	}
+	return fields[0] + ":" + fields[1]
+}
+
+// isReplica returns whether current node is a replica of another node in cluster
+func (cluster *Cluster) isReplica() bool {
+	return cluster.masterID != ""
+}
+
+// execReadOnly enables read queries for a connection to a replica node
+func execReadOnly(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("readonly")
+	}
+	c.SetReadOnly(true)
+	return protocol.MakeOkReply()
+}
+
+// execReadWrite disables read queries for a connection to a replica node
+func execReadWrite(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("readwrite")
+	}
+	c.SetReadOnly(false)
+	return protocol.MakeOkReply()
+}
+
+// execClusterReplicate command line: cluster replicate <node-id>
+func execClusterReplicate(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("cluster|replicate")
+	}
+	master := cluster.findNode(string(args[0]))
+	if master == nil {
+		return protocol.MakeErrReply("ERR Unknown node " + string(args[0]))
+	}
+	if master.ID == cluster.self {
+		return protocol.MakeErrReply("ERR Can't replicate myself")
+	}
+	if master.MasterID != "" {
+		return protocol.MakeErrReply("ERR I can only replicate a master, not a replica.")
+	}
+	if !cluster.isReplica() {
+		self := cluster.topology.GetNode(cluster.self)
+		keyCount, _ := cluster.db.GetDBSize(0)
+		if (self != nil && len(self.Slots) > 0) || keyCount > 0 {
+			return protocol.MakeErrReply("ERR To set a master the node must be empty and without assigned slots.")
+		}
+	}
+	if err := cluster.topology.SetMaster(cluster.self, master.ID); err != nil {
+		return err
+	}
+	cluster.setMaster(master.ID)
+	return protocol.MakeOkReply()
+}
+
+// execClusterReplicas command line: cluster replicas <node-id>
+// returns replicas of the given master in the format of CLUSTER NODES
+func execClusterReplicas(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("cluster|replicas")
+	}
+	master := cluster.findNode(string(args[0]))
+	if master == nil {
+		return protocol.MakeErrReply("ERR Unknown node " + string(args[0]))
+	}
+	if master.MasterID != "" {
+		return protocol.MakeErrReply("ERR The specified node is not a master")
+	}
+	ranges := cluster.getSlotRanges()
+	var result [][]byte
+	for _, replicaID := range cluster.getReplicaIDs(master.ID) {
+		if replica := cluster.topology.GetNode(replicaID); replica != nil {
+			result = append(result, []byte(cluster.makeNodeDesc(replica, ranges)))
+		}
+	}
+	if len(result) == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// setMaster changes role of current node, an empty masterID promotes current node to master
+func (cluster *Cluster) setMaster(masterID string) {
+	if cluster.masterID == masterID {
+		return
+	}
+	c := connection.NewFakeConn()
+	if masterID == "" {
+		logger.Infof("promoted to master, former master is %s", cluster.masterID)
+		cluster.masterID = ""
+		cluster.db.Exec(c, utils.ToCmdLine("slaveof", "no", "one"))
+		cluster.loadHostSlots()
+		return
+	}
+	master := cluster.topology.GetNode(masterID)
+	if master == nil {
+		logger.Errorf("master %s not found", masterID)
+		return
+	}
+	logger.Infof("become replica of %s", masterID)
+	// slots of current node have been taken over by others, data will be replaced by data of master
+	cluster.slotMu.Lock()
+	cluster.slots = make(map[uint32]*hostSlot)
+	cluster.slotMu.Unlock()
+	cluster.masterID = masterID
+	host, port := splitAddr(master.Addr)
+	reply := cluster.db.Exec(c, utils.ToCmdLine("slaveof", host, strconv.Itoa(port)))
+	if protocol.IsErrorReply(reply) {
+		logger.Errorf("replicate %s failed: %s", masterID, string(reply.ToBytes()))
+	}
+}
+
+// loadHostSlots inits slots hosted by current node in topology and collects keys in them
+func (cluster *Cluster) loadHostSlots() {
+	self := cluster.topology.GetNode(cluster.self)
+	if self == nil {
+		return
+	}
+	for _, slot := range self.Slots {
+		if cluster.getHostSlot(slot.ID) == nil {
+			cluster.initSlot(slot.ID, slotStateHost)
+		}
+	}
+	cluster.collectSlotKeys()
+}
+
+// syncReplicaRole makes current node follow its role in topology, which is changed by CLUSTER REPLICATE or failover
+func (cluster *Cluster) syncReplicaRole() {
+	self := cluster.topology.GetNode(cluster.self)
+	if self == nil || self.MasterID == cluster.masterID {
+		return
+	}
+	cluster.setMaster(self.MasterID)
+}
+
+// tryFailover takes over slots of the master if it has been marked as FAIL
+func (cluster *Cluster) tryFailover() {
+	if !cluster.isReplica() || config.Properties.ReplicaPriority == 0 {
+		return
+	}
+	masterID := cluster.masterID
+	if !cluster.isNodeFailed(masterID) {
+		return
+	}
+	logger.Infof("master %s is failed, start failover", masterID)
+	if err := cluster.topology.Failover(cluster.self, masterID); err != nil {
+		logger.Errorf("failover failed: %v", err)
+		return
+	}
+	cluster.syncReplicaRole()
+}
@@ -0,0 +1,267 @@
+package cluster
+
+import (
+	"fmt"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// Resharding moves slots between nodes like cluster.reBalance, but is driven by operator:
+//  1. CLUSTER SETSLOT <slot> IMPORTING <source> on target node
+//  2. CLUSTER SETSLOT <slot> MIGRATING <target> on source node
+//  3. CLUSTER SETSLOT <slot> NODE <target> changes route in topology, target node serves the slot since now
+//  4. target node imports keys from source node and tells source node to drop the slot (gcluster import-slot)
+//  5. verify both nodes finished migration (gcluster slot-state)
+// CLUSTER RESHARD <begin-slot> <end-slot> <target> does all of them
+
+func parseSlotID(arg []byte) (uint32, protocol.ErrorReply) {
+	slotID, err := strconv.Atoi(string(arg))
+	if err != nil || slotID < 0 || slotID >= slotCount {
+		return 0, protocol.MakeErrReply("ERR Invalid or out of range slot")
+	}
+	return uint32(slotID), nil
+}
+
+// execClusterSetSlot command line: cluster setslot <slot> IMPORTING|MIGRATING|NODE <node-id> or cluster setslot <slot> STABLE
+func execClusterSetSlot(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("cluster|setslot")
+	}
+	slotID, errReply := parseSlotID(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	action := strings.ToLower(string(args[1]))
+	if action == "stable" {
+		if len(args) != 2 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		cluster.setSlotStable(slotID)
+		return protocol.MakeOkReply()
+	}
+	if len(args) != 3 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	node := cluster.findNode(string(args[2]))
+	if node == nil {
+		return protocol.MakeErrReply("ERR I don't know about node " + string(args[2]))
+	}
+	hSlot := cluster.getHostSlot(slotID)
+	switch action {
+	case "importing":
+		if node.ID == cluster.self {
+			return protocol.MakeErrReply("ERR I'm already the owner of hash slot " + strconv.Itoa(int(slotID)))
+		}
+		if hSlot != nil && hSlot.state == slotStateHost {
+			return protocol.MakeErrReply("ERR I'm already the owner of hash slot " + strconv.Itoa(int(slotID)))
+		}
+		cluster.setLocalSlotImporting(slotID, node.ID)
+	case "migrating":
+		if hSlot == nil || hSlot.state == slotStateImporting {
+			return protocol.MakeErrReply("ERR I'm not the owner of hash slot " + strconv.Itoa(int(slotID)))
+		}
+		if node.ID == cluster.self {
+			return protocol.MakeErrReply("ERR Target node is myself")
+		}
+		cluster.setSlotMovingOut(slotID, node.ID)
+	case "node":
+		if node.ID != cluster.self && hSlot != nil && hSlot.state == slotStateHost && hSlot.keys.Len() > 0 {
+			return protocol.MakeErrReply("ERR Can't assign hashslot " + strconv.Itoa(int(slotID)) +
+				" to a different node while I still hold keys for this hash slot.")
+		}
+		if err := cluster.topology.SetSlot([]uint32{slotID}, node.ID); err != nil {
+			return err
+		}
+		if node.ID == cluster.self && hSlot == nil {
+			// claim an empty slot
+			cluster.initSlot(slotID, slotStateHost)
+		} else if node.ID != cluster.self && hSlot != nil && hSlot.state == slotStateHost {
+			cluster.slotMu.Lock()
+			delete(cluster.slots, slotID)
+			cluster.slotMu.Unlock()
+		}
+	default:
+		return protocol.MakeErrReply("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	return protocol.MakeOkReply()
+}
+
+// setSlotStable clears importing or migrating state of the slot
+func (cluster *Cluster) setSlotStable(slotID uint32) {
+	hSlot := cluster.getHostSlot(slotID)
+	if hSlot == nil {
+		return
+	}
+	owner := cluster.topology.GetSlots()[int(slotID)].NodeID
+	switch hSlot.state {
+	case slotStateMovingOut:
+		cluster.slotMu.Lock()
+		hSlot.state = slotStateHost
+		hSlot.newNodeID = ""
+		cluster.slotMu.Unlock()
+		hSlot.exportMu.Lock()
+		hSlot.exporting = false
+		hSlot.exportedKeys = nil
+		hSlot.exportMu.Unlock()
+		cluster.migrationLog.finish(slotID)
+	case slotStateImporting:
+		if owner == cluster.self {
+			cluster.finishSlotImport(slotID)
+			return
+		}
+		// abort importing, drop imported keys
+		cluster.cleanDroppedSlot(slotID)
+		cluster.slotMu.Lock()
+		delete(cluster.slots, slotID)
+		cluster.slotMu.Unlock()
+		cluster.migrationLog.finish(slotID)
+	}
+}
+
+// execClusterReshard command line: cluster reshard <begin-slot> <end-slot> <target-node-id>
+// moves slots in [begin-slot, end-slot] to target node, it returns after all slots have been moved and verified
+func execClusterReshard(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 3 {
+		return protocol.MakeArgNumErrReply("cluster|reshard")
+	}
+	begin, errReply := parseSlotID(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	end, errReply := parseSlotID(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	if begin > end {
+		return protocol.MakeErrReply("ERR begin slot is greater than end slot")
+	}
+	target := cluster.findNode(string(args[2]))
+	if target == nil {
+		return protocol.MakeErrReply("ERR I don't know about node " + string(args[2]))
+	}
+	moved, keys := 0, 0
+	slots := cluster.topology.GetSlots()
+	for slotID := begin; slotID <= end; slotID++ {
+		source := slots[int(slotID)].NodeID
+		if source == target.ID {
+			continue
+		}
+		n, err := cluster.reshardSlot(slotID, source, target.ID)
+		if err != nil {
+			return protocol.MakeErrReply(fmt.Sprintf("ERR move slot %d from %s to %s failed: %v", slotID, source, target.ID, err))
+		}
+		moved++
+		keys += n
+	}
+	return protocol.MakeStatusReply(fmt.Sprintf("moved %d slots, %d keys", moved, keys))
+}
+
+// reshardSlot moves one slot from source node to target node and returns count of keys in slot after moved
+func (cluster *Cluster) reshardSlot(slotID uint32, sourceID string, targetID string) (int, error) {
+	slot := strconv.Itoa(int(slotID))
+	conn := connection.NewFakeConn()
+	steps := []struct {
+		nodeID  string
+		cmdLine CmdLine
+	}{
+		{targetID, utils.ToCmdLine("cluster", "setslot", slot, "importing", sourceID)},
+		{sourceID, utils.ToCmdLine("cluster", "setslot", slot, "migrating", targetID)},
+		{targetID, utils.ToCmdLine("cluster", "setslot", slot, "node", targetID)},
+		{targetID, utils.ToCmdLine("gcluster", "import-slot", slot, sourceID)},
+	}
+	for _, step := range steps {
+		reply := cluster.relay(step.nodeID, conn, step.cmdLine)
+		if err, ok := reply.(protocol.ErrorReply); ok {
+			return 0, fmt.Errorf("%s %s on %s: %s", step.cmdLine[0], step.cmdLine[1], step.nodeID, err.Error())
+		}
+	}
+
+	// verify
+	sourceState, _, err := cluster.getRemoteSlotState(sourceID, slotID)
+	if err != nil {
+		return 0, err
+	}
+	if sourceState != "none" {
+		return 0, fmt.Errorf("slot is still in %s state on source node", sourceState)
+	}
+	targetState, keyCount, err := cluster.getRemoteSlotState(targetID, slotID)
+	if err != nil {
+		return 0, err
+	}
+	if targetState != "host" {
+		return 0, fmt.Errorf("slot is in %s state on target node", targetState)
+	}
+	logger.Infof("slot %d has been moved from %s to %s, %d keys", slotID, sourceID, targetID, keyCount)
+	return keyCount, nil
+}
+
+func getSlotStateName(slot *hostSlot) string {
+	if slot == nil {
+		return "none"
+	}
+	switch slot.state {
+	case slotStateImporting:
+		return "importing"
+	case slotStateMovingOut:
+		return "migrating"
+	}
+	return "host"
+}
+
+// getRemoteSlotState returns state of slot and count of keys in slot on the given node
+func (cluster *Cluster) getRemoteSlotState(nodeID string, slotID uint32) (string, int, error) {
+	reply := cluster.relay(nodeID, connection.NewFakeConn(), utils.ToCmdLine("gcluster", "slot-state", strconv.Itoa(int(slotID))))
+	if err, ok := reply.(protocol.ErrorReply); ok {
+		return "", 0, fmt.Errorf("get slot state from %s failed: %s", nodeID, err.Error())
+	}
+	result, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(result.Args) != 2 {
+		return "", 0, fmt.Errorf("get slot state from %s failed: illegal reply", nodeID)
+	}
+	keyCount, _ := strconv.Atoi(string(result.Args[1]))
+	return string(result.Args[0]), keyCount, nil
+}
+
+// execGClusterSlotState command line: gcluster slot-state <slotId>
+// returns state of slot (host, importing, migrating or none) and count of keys in the slot
+func execGClusterSlotState(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("gcluster")
+	}
+	slotID, errReply := parseSlotID(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	slot := cluster.getHostSlot(slotID)
+	keyCount := cluster.countKeysInSlot(slotID)
+	return protocol.MakeMultiBulkReply(utils.ToCmdLine(getSlotStateName(slot), strconv.Itoa(keyCount)))
+}
+
+// execGClusterImportSlot command line: gcluster import-slot <slotId> <sourceNodeId>
+// imports keys of an importing slot from source node, and tells source node to drop the slot
+func execGClusterImportSlot(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("gcluster")
+	}
+	slotID, errReply := parseSlotID(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	slot := cluster.getHostSlot(slotID)
+	if slot == nil || slot.state != slotStateImporting {
+		return protocol.MakeErrReply("ERR slot is not importing")
+	}
+	err := cluster.importSlot(&Slot{
+		ID:     slotID,
+		NodeID: string(args[1]),
+	})
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	return protocol.MakeOkReply()
+}
@@ -1,7 +1,10 @@
 package cluster
 
 import (
+	"goRedisPlus/config"
+	"goRedisPlus/database"
 	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
 	"strings"
 )
 
@@ -22,27 +25,75 @@ func registerDefaultCmd(name string) {
 // relay command to responsible peer, and return its protocol to client
 // 默认的函数就是走的转发命令
 func defaultFunc(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	keys := getCmdKeys(args)
+	if errReply := checkCrossSlot(keys); errReply != nil {
+		return errReply
+	}
 	key := string(args[1])
+	if len(keys) > 0 {
+		key = keys[0] // such as OBJECT FREQ key
+	}
 	slotId := getSlot(key)           // 获取key所在的槽位
 	peer := cluster.pickNode(slotId) // 判断槽位id属于哪一个node
 	if peer.ID == cluster.self {
-		err := cluster.ensureKeyWithoutLock(key)
-		if err != nil {
-			return err
+		if len(keys) == 0 {
+			keys = []string{key}
 		}
+		for _, k := range keys {
+			if err := cluster.ensureKeyWithoutLock(k); err != nil {
+				return err
+			}
+		}
+		cluster.slotMetrics.record(slotId)
 		// to self db
 		//return cluster.db.Exec(c, cmdLine)
 		return cluster.db.Exec(c, args)
 	}
+	if peer.ID == cluster.masterID && c != nil && c.IsReadOnly() {
+		// client allows reading from replica, see READONLY
+		if database.IsReadOnlyCommand(string(args[0])) {
+			return cluster.db.Exec(c, args)
+		}
+		return makeMovedReply(slotId, peer.Addr)
+	}
+	if config.Properties.ClusterRedirect {
+		if len(keys) == 0 {
+			keys = []string{key}
+		}
+		return cluster.redirect(c, args, slotId, keys, peer)
+	}
 	return cluster.relay(peer.ID, c, args)
 }
 
+var errCrossSlot = protocol.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+
+// getCmdKeys returns keys written or read by the command
+func getCmdKeys(cmdLine CmdLine) []string {
+	writeKeys, readKeys := database.GetRelatedKeys(cmdLine)
+	return append(writeKeys, readKeys...)
+}
+
+// checkCrossSlot makes sure all keys of a multi-key command (such as SInterStore) hash to one slot,
+// use hash tags ({tag}) to put related keys in the same slot.
+// Commands whose keys may be distributed, like MSet and Del, have their own executors using try-commit-catch
+func checkCrossSlot(keys []string) protocol.ErrorReply {
+	for i := 1; i < len(keys); i++ {
+		if getSlot(keys[i]) != getSlot(keys[0]) {
+			return errCrossSlot
+		}
+	}
+	return nil
+}
+
 func init() {
+	registerCommitFunc("FlushDB", commitFlush)
+	registerCommitFunc("FlushAll", commitFlush)
 	registerCmd("Ping", ping)
 	registerCmd("Prepare", execPrepare)
 	registerCmd("Commit", execCommit)
 	registerCmd("Rollback", execRollback)
 	registerCmd("Del", Del)
+	registerCmd("Unlink", Unlink)
 	registerCmd("Rename", Rename)
 	registerCmd("RenameNx", RenameNx)
 	registerCmd("Copy", Copy)
@@ -54,108 +105,46 @@ func init() {
 	registerCmd("Unsubscribe", UnSubscribe)
 	registerCmd("FlushDB", FlushDB)
 	registerCmd("FlushAll", FlushAll)
+	registerCmd("Scan", Scan)
+	registerCmd("Keys", Keys)
+	registerCmd("DBSize", DBSize)
+	registerCmd("Acl", genPenetratingExecutor("Acl"))
+	registerCmd("Config", genPenetratingExecutor("Config"))
+	registerCmd("Shutdown", genPenetratingExecutor("Shutdown"))
+	registerCmd("Client", genPenetratingExecutor("Client"))
+	registerCmd("Latency", genPenetratingExecutor("Latency"))
+	registerCmd("Memory", execMemory)
+	registerCmd("BigKeys", genPenetratingExecutor("BigKeys"))
+	registerCmd("HotKeys", genPenetratingExecutor("HotKeys"))
+	registerCmd("Command", genPenetratingExecutor("Command"))
 	registerCmd(relayMulti, execRelayedMulti)
 	registerCmd("Watch", execWatch)
 	registerCmd("FlushDB_", genPenetratingExecutor("FlushDB"))
+	registerCmd("Scan_", execScanLocal)
+	registerCmd("Keys_", execKeysLocal)
+	registerCmd("DBSize_", execDBSizeLocal)
 	registerCmd("Copy_", genPenetratingExecutor("Copy"))
 	registerCmd("Watch_", genPenetratingExecutor("Watch"))
 	registerCmd(relayPublish, genPenetratingExecutor("Publish"))
 	registerCmd("Del_", genPenetratingExecutor("Del"))
+	registerCmd("Unlink_", genPenetratingExecutor("Unlink"))
 	registerCmd("MSet_", genPenetratingExecutor("MSet"))
 	registerCmd("MSetNx_", genPenetratingExecutor("MSetNx"))
 	registerCmd("MGet_", genPenetratingExecutor("MGet"))
 	registerCmd("Rename_", genPenetratingExecutor("Rename"))
 	registerCmd("RenameNx_", genPenetratingExecutor("RenameNx"))
-	registerCmd("DumpKey_", genPenetratingExecutor("DumpKey"))
+	registerCmd("DumpKey_", execDumpKey)
 
-	defaultCmds := []string{
-		"expire",
-		"expireAt",
-		"pExpire",
-		"pExpireAt",
-		"ttl",
-		"PTtl",
-		"persist",
-		"exists",
-		"type",
-		"set",
-		"setNx",
-		"setEx",
-		"pSetEx",
-		"get",
-		"getEx",
-		"getSet",
-		"getDel",
-		"incr",
-		"incrBy",
-		"incrByFloat",
-		"decr",
-		"decrBy",
-		"lPush",
-		"lPushX",
-		"rPush",
-		"rPushX",
-		"LPop",
-		"RPop",
-		"LRem",
-		"LLen",
-		"LIndex",
-		"LSet",
-		"LRange",
-		"HSet",
-		"HSetNx",
-		"HGet",
-		"HExists",
-		"HDel",
-		"HLen",
-		"HStrLen",
-		"HMGet",
-		"HMSet",
-		"HKeys",
-		"HVals",
-		"HGetAll",
-		"HIncrBy",
-		"HIncrByFloat",
-		"HRandField",
-		"SAdd",
-		"SIsMember",
-		"SRem",
-		"SPop",
-		"SCard",
-		"SMembers",
-		"SInter",
-		"SInterStore",
-		"SUnion",
-		"SUnionStore",
-		"SDiff",
-		"SDiffStore",
-		"SRandMember",
-		"ZAdd",
-		"ZScore",
-		"ZIncrBy",
-		"ZRank",
-		"ZCount",
-		"ZRevRank",
-		"ZCard",
-		"ZRange",
-		"ZRevRange",
-		"ZRangeByScore",
-		"ZRevRangeByScore",
-		"ZRem",
-		"ZRemRangeByScore",
-		"ZRemRangeByRank",
-		"GeoAdd",
-		"GeoPos",
-		"GeoDist",
-		"GeoHash",
-		"GeoRadius",
-		"GeoRadiusByMember",
-		"GetVer",
-		"DumpKey",
-	}
-	for _, name := range defaultCmds {
-		registerDefaultCmd(name)
+	// commands declaring keys in the registry of database are relayed to the node owning their keys,
+	// those need special care such as MSet and Del are registered above
+	for _, name := range database.KeyedCommands() {
+		if _, ok := router[name]; !ok {
+			registerDefaultCmd(name)
+		}
 	}
+	// internal commands which declare no keys
+	registerDefaultCmd("GetVer")
+	registerDefaultCmd("DumpKey")
 
 }
 
@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+)
+
+// SCAN in cluster mode iterates keyspace of all master nodes one by one.
+// Cluster cursor consists of cursor of the node (high bits) and index of node in masters sorted by id (low 16 bits),
+// so the iteration could be continued through any node as long as the topology does not change.
+
+const (
+	scanNodeBits = 16
+	scanNodeMask = 1<<scanNodeBits - 1
+)
+
+// Scan command line: SCAN cursor [MATCH pattern] [COUNT count]
+func Scan(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 2 {
+		return protocol.MakeArgNumErrReply("scan")
+	}
+	cursor, err := strconv.ParseUint(string(cmdLine[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid cursor")
+	}
+	nodes := cluster.getMasterNodes()
+	nodeIndex := int(cursor & scanNodeMask)
+	nodeCursor := cursor >> scanNodeBits
+	if nodeIndex >= len(nodes) {
+		return makeScanReply(0, nil)
+	}
+	relayCmdLine := make(CmdLine, 0, len(cmdLine))
+	relayCmdLine = append(relayCmdLine, []byte("Scan_"), []byte(strconv.FormatUint(nodeCursor, 10)))
+	relayCmdLine = append(relayCmdLine, cmdLine[2:]...)
+	reply := cluster.relay(nodes[nodeIndex].ID, c, relayCmdLine)
+	if protocol.IsErrorReply(reply) {
+		return reply
+	}
+	var keys [][]byte
+	switch r := reply.(type) {
+	case *protocol.MultiBulkReply:
+		nodeCursor, err = strconv.ParseUint(string(r.Args[0]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR illegal scan reply from " + nodes[nodeIndex].ID)
+		}
+		keys = r.Args[1:]
+	default:
+		return protocol.MakeErrReply("ERR illegal scan reply from " + nodes[nodeIndex].ID)
+	}
+	if nodeCursor == 0 {
+		// current node finished, continue with next node
+		nodeIndex++
+		if nodeIndex >= len(nodes) {
+			return makeScanReply(0, keys)
+		}
+	}
+	return makeScanReply(nodeCursor<<scanNodeBits|uint64(nodeIndex), keys)
+}
+
+func makeScanReply(cursor uint64, keys [][]byte) redis.Reply {
+	if keys == nil {
+		keys = [][]byte{}
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(strconv.FormatUint(cursor, 10))),
+		protocol.MakeMultiBulkReply(keys),
+	})
+}
+
+// execScanLocal command line: Scan_ cursor [MATCH pattern] [COUNT count]
+// scans keys of slots served by current node, replies [next cursor, key...] since nested array cannot be relayed
+func execScanLocal(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
+	reply := cluster.db.Exec(c, modifyCmd(cmdLine, "Scan"))
+	result, ok := reply.(*protocol.MultiRawReply)
+	if !ok {
+		return reply
+	}
+	next, ok1 := result.Replies[0].(*protocol.BulkReply)
+	keys, ok2 := result.Replies[1].(*protocol.MultiBulkReply)
+	if !ok1 || !ok2 {
+		return protocol.MakeErrReply("ERR illegal scan reply")
+	}
+	args := [][]byte{next.Arg}
+	for _, key := range keys.Args {
+		// skip keys of slots have moved out or not imported yet
+		if cluster.isServedKey(string(key)) {
+			args = append(args, key)
+		}
+	}
+	return protocol.MakeMultiBulkReply(args)
+}
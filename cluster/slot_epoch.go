@@ -0,0 +1,187 @@
+package cluster
+
+import (
+	"fmt"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/connection"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Slot ownership epochs:
+// Every node has a config epoch (Node.ConfigEpoch), it is bumped to the highest epoch in topology plus one
+// whenever the node is assigned slots or takes over slots of its master by failover, so the latest assignment
+// always carries the highest epoch. Slots hosted by current node remember the epoch confirmed by topology.
+// After partitions, two nodes may both believe they own a slot, e.g. a former master which missed the failover.
+// Nodes claim their slots with epochs in gossip, and the claim with the highest epoch wins, ties are broken by
+// the smaller node id. The losing node releases the slot and drops keys in it, so the slot map converges.
+
+// maxConfigEpoch returns the highest config epoch of nodes
+func maxConfigEpoch(nodes map[string]*Node) uint64 {
+	var max uint64
+	for _, node := range nodes {
+		if node.ConfigEpoch > max {
+			max = node.ConfigEpoch
+		}
+	}
+	return max
+}
+
+// bumpConfigEpoch gives node a config epoch higher than any other node, invoker should provide lock of topology
+func bumpConfigEpoch(nodes map[string]*Node, node *Node) {
+	node.ConfigEpoch = maxConfigEpoch(nodes) + 1
+}
+
+// claimWins returns whether claim (epoch1, node1) beats claim (epoch2, node2)
+func claimWins(epoch1 uint64, node1 string, epoch2 uint64, node2 string) bool {
+	if epoch1 != epoch2 {
+		return epoch1 > epoch2
+	}
+	return node1 < node2
+}
+
+// getSlotClaims returns epochs of slots hosted by current node, slots not confirmed by topology yet are excluded
+func (cluster *Cluster) getSlotClaims() map[uint32]uint64 {
+	cluster.slotMu.RLock()
+	defer cluster.slotMu.RUnlock()
+	claims := make(map[uint32]uint64)
+	for slotID, slot := range cluster.slots {
+		if slot.state == slotStateHost && slot.epoch > 0 {
+			claims[slotID] = slot.epoch
+		}
+	}
+	return claims
+}
+
+// marshalSlotClaims serializes claims grouped by epoch, like `3:0-100,200;5:300`
+func marshalSlotClaims(claims map[uint32]uint64) string {
+	groups := make(map[uint64][]*Slot)
+	var epochs []uint64
+	for slotID, epoch := range claims {
+		if len(groups[epoch]) == 0 {
+			epochs = append(epochs, epoch)
+		}
+		groups[epoch] = append(groups[epoch], &Slot{ID: slotID})
+	}
+	sort.Slice(epochs, func(i, j int) bool {
+		return epochs[i] < epochs[j]
+	})
+	parts := make([]string, 0, len(epochs))
+	for _, epoch := range epochs {
+		parts = append(parts, strconv.FormatUint(epoch, 10)+":"+strings.Join(marshalSlotIds(groups[epoch]), ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+// unmarshalSlotClaims deserializes claims generated by marshalSlotClaims
+func unmarshalSlotClaims(s string) (map[uint32]uint64, error) {
+	claims := make(map[uint32]uint64)
+	if s == "" {
+		return claims, nil
+	}
+	for _, part := range strings.Split(s, ";") {
+		pivot := strings.IndexByte(part, ':')
+		if pivot <= 0 {
+			return nil, fmt.Errorf("illegal slot claim: %s", part)
+		}
+		epoch, err := strconv.ParseUint(part[:pivot], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("illegal epoch of slot claim: %s", part)
+		}
+		slotIDs, err := unmarshalSlotIds(strings.Split(part[pivot+1:], ","))
+		if err != nil {
+			return nil, err
+		}
+		for _, slotID := range slotIDs {
+			if slotID >= uint32(slotCount) {
+				return nil, fmt.Errorf("illegal slot id %d", slotID)
+			}
+			claims[slotID] = epoch
+		}
+	}
+	return claims, nil
+}
+
+// receiveSlotClaims releases slots which are claimed by sender with higher epoch
+func (cluster *Cluster) receiveSlotClaims(sender string, claims map[uint32]uint64) {
+	var lost []uint32
+	for slotID, epoch := range cluster.getSlotClaims() {
+		senderEpoch, ok := claims[slotID]
+		if ok && claimWins(senderEpoch, sender, epoch, cluster.self) {
+			lost = append(lost, slotID)
+		}
+	}
+	for _, slotID := range lost {
+		cluster.releaseSlot(slotID, sender)
+	}
+}
+
+// resolveSlotConflicts confirms epochs of slots assigned to current node by topology,
+// and releases slots which topology has assigned to others with higher epoch
+func (cluster *Cluster) resolveSlotConflicts() {
+	self := cluster.topology.GetNode(cluster.self)
+	if self == nil {
+		return
+	}
+	topoSlots := cluster.topology.GetSlots()
+	nodes := make(map[string]*Node)
+	for _, node := range cluster.topology.GetNodes() {
+		nodes[node.ID] = node
+	}
+	var lost []uint32
+	var winners []string
+	cluster.slotMu.Lock()
+	for slotID, slot := range cluster.slots {
+		if slot.state != slotStateHost {
+			continue
+		}
+		topoSlot := topoSlots[int(slotID)]
+		if topoSlot == nil {
+			continue
+		}
+		if topoSlot.NodeID == cluster.self {
+			slot.epoch = self.ConfigEpoch
+			continue
+		}
+		owner := nodes[topoSlot.NodeID]
+		if slot.epoch == 0 || owner == nil {
+			continue // not confirmed yet, topology may be catching up
+		}
+		if claimWins(owner.ConfigEpoch, owner.ID, slot.epoch, cluster.self) {
+			lost = append(lost, slotID)
+			winners = append(winners, owner.ID)
+		}
+	}
+	cluster.slotMu.Unlock()
+	for i, slotID := range lost {
+		cluster.releaseSlot(slotID, winners[i])
+	}
+}
+
+// releaseSlot stops hosting a slot lost in conflict, keys in it are dropped since the winner owns the data
+func (cluster *Cluster) releaseSlot(slotID uint32, winner string) {
+	cluster.slotMu.Lock()
+	slot := cluster.slots[slotID]
+	if slot == nil || slot.state != slotStateHost {
+		cluster.slotMu.Unlock()
+		return
+	}
+	delete(cluster.slots, slotID)
+	cluster.slotMu.Unlock()
+	logger.Warn(fmt.Sprintf("slot %d is owned by %s with higher epoch, release it", slotID, winner))
+
+	slot.mu.RLock()
+	keys := slot.keys.ToSlice()
+	slot.mu.RUnlock()
+	if len(keys) == 0 {
+		return
+	}
+	c := connection.NewFakeConn()
+	go func() {
+		for _, key := range keys {
+			cluster.db.Exec(c, utils.ToCmdLine("DEL", key))
+		}
+	}()
+}
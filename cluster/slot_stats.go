@@ -0,0 +1,245 @@
+package cluster
+
+import (
+	database2 "goRedisPlus/database"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-slot metrics:
+// Key count of slots comes from the key set maintained by insert/delete callbacks, memory is estimated by sampling
+// keys of the slot, and commands routed to slots hosted by current node are counted by router.
+// CLUSTER SLOT-STATS shows them for capacity planning and finding hot slots, rebalancer may use them as load too.
+
+const (
+	slotStatKeyCount    = "key-count"
+	slotStatMemoryBytes = "memory-bytes"
+	slotStatOps         = "ops"
+	slotStatOpsPerSec   = "ops-per-sec"
+
+	slotMemorySampleSize  = 8
+	slotStatsDefaultLimit = 16
+	slotOpsWindow         = time.Second
+)
+
+type slotMetric struct {
+	mu          sync.Mutex
+	ops         int64 // total commands executed since slot hosted
+	windowStart time.Time
+	windowOps   int64
+	opsPerSec   int64 // rate of the last full window
+}
+
+type slotMetrics struct {
+	slots [slotCount]slotMetric
+}
+
+func makeSlotMetrics() *slotMetrics {
+	return &slotMetrics{}
+}
+
+// record counts a command executed on slot
+func (m *slotMetrics) record(slotID uint32) {
+	metric := &m.slots[slotID]
+	now := time.Now()
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	metric.ops++
+	elapsed := now.Sub(metric.windowStart)
+	if elapsed >= slotOpsWindow {
+		if elapsed < 2*slotOpsWindow {
+			metric.opsPerSec = metric.windowOps * int64(time.Second) / int64(elapsed)
+		} else {
+			metric.opsPerSec = 0 // idle during the last window
+		}
+		metric.windowStart = now
+		metric.windowOps = 0
+	}
+	metric.windowOps++
+}
+
+// get returns total commands and commands per second of slot
+func (m *slotMetrics) get(slotID uint32) (int64, int64) {
+	metric := &m.slots[slotID]
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	if elapsed := time.Since(metric.windowStart); elapsed >= 2*slotOpsWindow {
+		return metric.ops, 0
+	} else if elapsed >= slotOpsWindow {
+		return metric.ops, metric.windowOps * int64(time.Second) / int64(elapsed)
+	}
+	return metric.ops, metric.opsPerSec
+}
+
+// reset clears metrics of slot, it is called when slot begins to be hosted by current node
+func (m *slotMetrics) reset(slotID uint32) {
+	metric := &m.slots[slotID]
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	metric.ops = 0
+	metric.windowStart = time.Time{}
+	metric.windowOps = 0
+	metric.opsPerSec = 0
+}
+
+// estimateSlotMemory returns estimated bytes of keys in slot by sampling
+func (cluster *Cluster) estimateSlotMemory(slot *hostSlot) int64 {
+	slot.mu.RLock()
+	count := slot.keys.Len()
+	samples := slot.keys.RandomDistinctMembers(slotMemorySampleSize)
+	slot.mu.RUnlock()
+	if count == 0 || len(samples) == 0 {
+		return 0
+	}
+	var total int64
+	for _, key := range samples {
+		entity, _ := cluster.db.GetEntity(0, key)
+		total += database2.EstimateEntitySize(key, entity)
+	}
+	return total * int64(count) / int64(len(samples))
+}
+
+type slotStat struct {
+	slotID      uint32
+	keyCount    int64
+	memoryBytes int64
+	ops         int64
+	opsPerSec   int64
+}
+
+func (stat *slotStat) getMetric(name string) int64 {
+	switch name {
+	case slotStatKeyCount:
+		return stat.keyCount
+	case slotStatMemoryBytes:
+		return stat.memoryBytes
+	case slotStatOps:
+		return stat.ops
+	case slotStatOpsPerSec:
+		return stat.opsPerSec
+	}
+	return 0
+}
+
+func (cluster *Cluster) getSlotStat(slotID uint32, slot *hostSlot) *slotStat {
+	slot.mu.RLock()
+	keyCount := slot.keys.Len()
+	slot.mu.RUnlock()
+	ops, opsPerSec := cluster.slotMetrics.get(slotID)
+	return &slotStat{
+		slotID:      slotID,
+		keyCount:    int64(keyCount),
+		memoryBytes: cluster.estimateSlotMemory(slot),
+		ops:         ops,
+		opsPerSec:   opsPerSec,
+	}
+}
+
+// getHostedSlots returns slots hosted by current node, excluding slots in migration
+func (cluster *Cluster) getHostedSlots() map[uint32]*hostSlot {
+	cluster.slotMu.RLock()
+	defer cluster.slotMu.RUnlock()
+	result := make(map[uint32]*hostSlot, len(cluster.slots))
+	for slotID, slot := range cluster.slots {
+		if slot.state == slotStateHost {
+			result[slotID] = slot
+		}
+	}
+	return result
+}
+
+func isSlotStatMetric(name string) bool {
+	return name == slotStatKeyCount || name == slotStatMemoryBytes || name == slotStatOps || name == slotStatOpsPerSec
+}
+
+// execClusterSlotStats command line:
+// cluster slot-stats slotsrange start end
+// cluster slot-stats orderby metric [limit n] [asc|desc]
+// metric is one of key-count, memory-bytes, ops and ops-per-sec, only slots hosted by current node are shown
+func execClusterSlotStats(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("cluster|slot-stats")
+	}
+	hosted := cluster.getHostedSlots()
+	var stats []*slotStat
+	switch strings.ToLower(string(args[0])) {
+	case "slotsrange":
+		if len(args) != 3 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		start, err1 := strconv.Atoi(string(args[1]))
+		end, err2 := strconv.Atoi(string(args[2]))
+		if err1 != nil || err2 != nil || start < 0 || end >= slotCount || start > end {
+			return protocol.MakeErrReply("ERR Invalid slot range")
+		}
+		for slotID := start; slotID <= end; slotID++ {
+			if slot := hosted[uint32(slotID)]; slot != nil {
+				stats = append(stats, cluster.getSlotStat(uint32(slotID), slot))
+			}
+		}
+	case "orderby":
+		metric := strings.ToLower(string(args[1]))
+		if !isSlotStatMetric(metric) {
+			return protocol.MakeErrReply("ERR Unrecognized sort metric " + string(args[1]))
+		}
+		limit := slotStatsDefaultLimit
+		desc := true
+		for i := 2; i < len(args); i++ {
+			switch strings.ToLower(string(args[i])) {
+			case "limit":
+				if i+1 >= len(args) {
+					return protocol.MakeSyntaxErrReply()
+				}
+				n, err := strconv.Atoi(string(args[i+1]))
+				if err != nil || n < 1 || n > slotCount {
+					return protocol.MakeErrReply("ERR Limit must be in range 1 to " + strconv.Itoa(slotCount))
+				}
+				limit = n
+				i++
+			case "asc":
+				desc = false
+			case "desc":
+				desc = true
+			default:
+				return protocol.MakeSyntaxErrReply()
+			}
+		}
+		for slotID, slot := range hosted {
+			stats = append(stats, cluster.getSlotStat(slotID, slot))
+		}
+		sort.Slice(stats, func(i, j int) bool {
+			a, b := stats[i].getMetric(metric), stats[j].getMetric(metric)
+			if a != b {
+				if desc {
+					return a > b
+				}
+				return a < b
+			}
+			return stats[i].slotID < stats[j].slotID
+		})
+		if len(stats) > limit {
+			stats = stats[:limit]
+		}
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+
+	result := make([]redis.Reply, 0, len(stats))
+	for _, stat := range stats {
+		result = append(result, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeIntReply(int64(stat.slotID)),
+			protocol.MakeMultiBulkReply([][]byte{
+				[]byte(slotStatKeyCount), []byte(strconv.FormatInt(stat.keyCount, 10)),
+				[]byte(slotStatMemoryBytes), []byte(strconv.FormatInt(stat.memoryBytes, 10)),
+				[]byte(slotStatOps), []byte(strconv.FormatInt(stat.ops, 10)),
+				[]byte(slotStatOpsPerSec), []byte(strconv.FormatInt(stat.opsPerSec, 10)),
+			}),
+		}))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
@@ -1,18 +1,27 @@
 package cluster
 
 import (
+	"errors"
 	"fmt"
+	"goRedisPlus/config"
 	"goRedisPlus/database"
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/timewheel"
 	"goRedisPlus/redis/protocol"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// Deadlock avoidance:
+// Participants lock keys in the order of lock shards (see ConcurrentDict.RWLocks), and coordinators prepare
+// participants in the order of node id (see prepareOrder), so transactions acquire locks in the same global order.
+// Some transactions can't follow the order, e.g. Rename has to prepare the source node first to dump the key,
+// so participants give up after waiting cluster-prepare-timeout for locks, then the coordinator rolls back.
+
 // prepareFunc executed after related key locked, and use additional logic to determine whether the transaction can be committed
 // For example, prepareMSetNX  will return error to prevent MSetNx transaction from committing if any related key already exists
 var prepareFuncMap = make(map[string]CmdFunc)
@@ -21,6 +30,14 @@ func registerPrepareFunc(cmdName string, fn CmdFunc) {
 	prepareFuncMap[strings.ToLower(cmdName)] = fn
 }
 
+// commitFunc executes commands which could not be executed with key locks, such as FlushDB
+// transaction of them has no undo log and will not be rolled back after committed
+var commitFuncMap = make(map[string]CmdFunc)
+
+func registerCommitFunc(cmdName string, fn CmdFunc) {
+	commitFuncMap[strings.ToLower(cmdName)] = fn
+}
+
 // Transaction stores state and data for a try-commit-catch distributed transaction
 type Transaction struct {
 	id      string   // transaction id
@@ -39,8 +56,9 @@ type Transaction struct {
 }
 
 const (
-	maxLockTime       = 3 * time.Second
-	waitBeforeCleanTx = 2 * maxLockTime
+	maxLockTime           = 3 * time.Second
+	waitBeforeCleanTx     = 2 * maxLockTime
+	defaultPrepareTimeout = 1000 // milliseconds
 
 	createdStatus    = 0
 	preparedStatus   = 1
@@ -48,10 +66,30 @@ const (
 	rolledBackStatus = 3
 )
 
+var errPrepareTimeout = errors.New("ERR prepare timeout, keys are locked by other transactions")
+
 func genTaskKey(txID string) string {
 	return "tx:" + txID
 }
 
+func getPrepareTimeout() time.Duration {
+	timeout := config.Properties.PrepareTimeout
+	if timeout <= 0 {
+		timeout = defaultPrepareTimeout
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// prepareOrder returns participants in the order coordinator should prepare them
+func prepareOrder(groupMap map[string][]string) []string {
+	nodes := make([]string, 0, len(groupMap))
+	for node := range groupMap {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
 // NewTransaction creates a try-commit-catch distributed transaction
 func NewTransaction(cluster *Cluster, c redis.Connection, id string, cmdLine [][]byte) *Transaction {
 	return &Transaction{
@@ -74,6 +112,18 @@ func (tx *Transaction) lockKeys() {
 	}
 }
 
+// tryLockKeys locks keys like lockKeys, but gives up after timeout
+// invoker should hold tx.mu
+func (tx *Transaction) tryLockKeys(timeout time.Duration) bool {
+	if !tx.keysLocked {
+		if !tx.cluster.db.TryRWLocks(tx.dbIndex, tx.writeKeys, tx.readKeys, timeout) {
+			return false
+		}
+		tx.keysLocked = true
+	}
+	return true
+}
+
 func (tx *Transaction) unLockKeys() {
 	if tx.keysLocked {
 		tx.cluster.db.RWUnLocks(tx.dbIndex, tx.writeKeys, tx.readKeys)
@@ -87,8 +137,11 @@ func (tx *Transaction) prepare() error {
 	defer tx.mu.Unlock()
 
 	tx.writeKeys, tx.readKeys = database.GetRelatedKeys(tx.cmdLine)
-	// lock writeKeys
-	tx.lockKeys()
+	// lock writeKeys, give up if they are held by other transactions too long, which may be a deadlock
+	if !tx.tryLockKeys(getPrepareTimeout()) {
+		tx.status = rolledBackStatus
+		return errPrepareTimeout
+	}
 
 	for _, key := range tx.writeKeys {
 		err := tx.cluster.ensureKey(key)
@@ -105,18 +158,46 @@ func (tx *Transaction) prepare() error {
 	// build undoLog
 	tx.undoLog = tx.cluster.db.GetUndoLogs(tx.dbIndex, tx.cmdLine)
 	tx.status = preparedStatus
-	taskKey := genTaskKey(tx.id)
-	timewheel.Delay(maxLockTime, taskKey, func() {
-		if tx.status == preparedStatus { // rollback transaction uncommitted until expire
-			logger.Info("abort transaction: " + tx.id)
-			tx.mu.Lock()
-			defer tx.mu.Unlock()
-			_ = tx.rollbackWithLock()
-		}
-	})
+	timewheel.Delay(maxLockTime, genTaskKey(tx.id), tx.resolveInDoubt)
 	return nil
 }
 
+// resolveInDoubt asks coordinator for decision of a transaction uncommitted until expire, see tcc_log.go
+func (tx *Transaction) resolveInDoubt() {
+	tx.mu.Lock()
+	status := tx.status
+	tx.mu.Unlock()
+	if status != preparedStatus {
+		return
+	}
+	txID, err := strconv.ParseInt(tx.id, 10, 64)
+	decision := txOpRollback
+	if err == nil {
+		decision = tx.cluster.queryTransaction(txID)
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status != preparedStatus {
+		return // coordinator has sent decision meanwhile
+	}
+	switch decision {
+	case txOpCommit:
+		logger.Info("commit in-doubt transaction: " + tx.id)
+		if result := tx.commitWithLock(tx.conn); protocol.IsErrorReply(result) {
+			logger.Errorf("commit in-doubt transaction %s failed: %s", tx.id, string(result.ToBytes()))
+		}
+	case txOpRollback:
+		logger.Info("abort transaction: " + tx.id)
+		_ = tx.rollbackWithLock()
+	default:
+		// coordinator is unreachable or has not decided, keep keys locked and ask again later
+		logger.Info("transaction " + tx.id + " is still in doubt")
+		timewheel.Delay(maxLockTime, genTaskKey(tx.id), tx.resolveInDoubt)
+		return
+	}
+	tx.cluster.delayCleanTransaction(tx.id)
+}
+
 func (tx *Transaction) rollbackWithLock() error {
 	curStatus := tx.status
 
@@ -126,6 +207,11 @@ func (tx *Transaction) rollbackWithLock() error {
 	if tx.status == rolledBackStatus { // no need to rollback a rolled-back transaction
 		return nil
 	}
+	if tx.status == createdStatus { // failed to prepare, nothing to undo
+		tx.unLockKeys()
+		tx.status = rolledBackStatus
+		return nil
+	}
 	tx.lockKeys()
 	for _, cmdLine := range tx.undoLog {
 		tx.cluster.db.ExecWithLock(tx.conn, cmdLine)
@@ -178,12 +264,17 @@ func execRollback(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.R
 		return protocol.MakeErrReply(err.Error())
 	}
 	// clean transaction
+	cluster.delayCleanTransaction(tx.id)
+	return protocol.MakeIntReply(1)
+}
+
+// delayCleanTransaction removes finished transaction later, in case of rollback or repeated decision
+func (cluster *Cluster) delayCleanTransaction(txID string) {
 	timewheel.Delay(waitBeforeCleanTx, "", func() {
 		cluster.transactionMu.Lock()
-		cluster.transactions.Remove(tx.id)
+		cluster.transactions.Remove(txID)
 		cluster.transactionMu.Unlock()
 	})
-	return protocol.MakeIntReply(1)
 }
 
 // execCommit commits local transaction as a worker when receive execCommit command from coordinator
@@ -202,8 +293,32 @@ func execCommit(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Rep
 
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
+	switch tx.status {
+	case committedStatus:
+		// decision is sent again by a recovered coordinator, or the transaction has been committed as in-doubt
+		return protocol.MakeIntReply(0)
+	case rolledBackStatus:
+		return protocol.MakeErrReply("ERR transaction " + tx.id + " has been rolled back")
+	}
+	result := tx.commitWithLock(c)
+	if protocol.IsErrorReply(result) {
+		return result
+	}
+	// clean finished transaction
+	// do not clean immediately, in case rollback
+	cluster.delayCleanTransaction(tx.id)
+	return result
+}
 
-	result := cluster.db.ExecWithLock(c, tx.cmdLine)
+// commitWithLock executes command of the transaction, it rolls back if failed
+// invoker should hold tx.mu
+func (tx *Transaction) commitWithLock(c redis.Connection) redis.Reply {
+	var result redis.Reply
+	if commitFunc, ok := commitFuncMap[strings.ToLower(string(tx.cmdLine[0]))]; ok {
+		result = commitFunc(tx.cluster, c, tx.cmdLine)
+	} else {
+		result = tx.cluster.db.ExecWithLock(c, tx.cmdLine)
+	}
 
 	if protocol.IsErrorReply(result) {
 		// failed
@@ -213,13 +328,6 @@ func execCommit(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Rep
 	// after committed
 	tx.unLockKeys()
 	tx.status = committedStatus
-	// clean finished transaction
-	// do not clean immediately, in case rollback
-	timewheel.Delay(waitBeforeCleanTx, "", func() {
-		cluster.transactionMu.Lock()
-		cluster.transactions.Remove(tx.id)
-		cluster.transactionMu.Unlock()
-	})
 	return result
 }
 
@@ -227,6 +335,8 @@ func execCommit(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Rep
 func requestCommit(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) ([]redis.Reply, protocol.ErrorReply) {
 	var errReply protocol.ErrorReply
 	txIDStr := strconv.FormatInt(txID, 10)
+	// decision must be durable before any participant commits, see tcc_log.go
+	cluster.txLog.decide(txID, txOpCommit)
 	respList := make([]redis.Reply, 0, len(groupMap))
 	for node := range groupMap {
 		resp := cluster.relay(node, c, makeArgs("commit", txIDStr))
@@ -240,14 +350,25 @@ func requestCommit(cluster *Cluster, c redis.Connection, txID int64, groupMap ma
 		requestRollback(cluster, c, txID, groupMap)
 		return nil, errReply
 	}
+	cluster.txLog.end(txID)
 	return respList, nil
 }
 
 // requestRollback requests all node rollback transaction as coordinator
 // groupMap: node -> keys
+// participants unreachable will be asked to rollback again by txRecoveryCron
 func requestRollback(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) {
 	txIDStr := strconv.FormatInt(txID, 10)
+	cluster.txLog.decide(txID, txOpRollback)
+	acked := true
 	for node := range groupMap {
-		cluster.relay(node, c, makeArgs("rollback", txIDStr))
+		if protocol.IsErrorReply(cluster.relay(node, c, makeArgs("rollback", txIDStr))) {
+			acked = false
+		}
+	}
+	if acked {
+		cluster.txLog.end(txID)
+	} else {
+		cluster.txLog.setActive(txID, false)
 	}
 }
@@ -0,0 +1,388 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transaction log:
+// Coordinator appends distributed transactions into <cluster-config-file>.tcc and syncs the file:
+// a begin entry with participants before sending Prepare, a decision entry (commit or rollback) before sending
+// the decision, and an end entry after all participants acknowledged it.
+// Participants do not roll back a prepared transaction blindly on timeout, they ask all nodes by
+// `gcluster tx-status` and follow the decision of coordinator. A transaction unknown to all nodes is rolled back,
+// since coordinator always knows transactions it began (presumed abort).
+// After restart, coordinator sends decisions of unfinished transactions again, transactions without decision are
+// rolled back, so that participants will not hold locks of in-doubt transactions forever.
+
+const (
+	txOpBegin    = "begin"
+	txOpCommit   = "commit"
+	txOpRollback = "rollback"
+	txOpEnd      = "end"
+
+	txStatusPending = "pending"
+	txStatusUnknown = "unknown"
+
+	txLogRewriteThreshold = 1000 // entries appended before rewriting the log file
+	txRetryPeriod         = time.Second
+)
+
+type txLogEntry struct {
+	Op    string   `json:"op"`
+	ID    int64    `json:"id"`
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+type txRecord struct {
+	id       int64
+	nodes    []string
+	decision string // txOpCommit or txOpRollback, empty before decided
+	active   bool   // coordinator is sending decision, recovery should not retry it
+}
+
+type txLog struct {
+	mu       sync.Mutex
+	filename string // empty means transactions are not persisted
+	file     *os.File
+	appended int
+	records  map[int64]*txRecord
+}
+
+func makeTxLog() *txLog {
+	filename := ""
+	if config.Properties.ClusterConfigFile != "" {
+		filename = path.Join(config.Properties.Dir, config.Properties.ClusterConfigFile+".tcc")
+	}
+	return &txLog{
+		filename: filename,
+		records:  make(map[int64]*txRecord),
+	}
+}
+
+// load replays log file, transactions loaded are left for recovery
+func (tl *txLog) load() error {
+	if tl.filename == "" {
+		return nil
+	}
+	f, err := os.Open(tl.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		entry := &txLogEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// the last entry may be incomplete if crashed during writing
+			logger.Warn(fmt.Sprintf("illegal transaction log at line %d: %v", line, err))
+			continue
+		}
+		tl.applyWithinLock(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, record := range tl.records {
+		record.active = false
+	}
+	tl.rewriteWithinLock()
+	return nil
+}
+
+// applyWithinLock updates records by entry, invoker should provide lock
+func (tl *txLog) applyWithinLock(entry *txLogEntry) {
+	switch entry.Op {
+	case txOpBegin:
+		tl.records[entry.ID] = &txRecord{
+			id:     entry.ID,
+			nodes:  entry.Nodes,
+			active: true,
+		}
+	case txOpCommit, txOpRollback:
+		if record := tl.records[entry.ID]; record != nil {
+			record.decision = entry.Op
+		}
+	case txOpEnd:
+		delete(tl.records, entry.ID)
+	}
+}
+
+// appendWithinLock applies entry and writes it into log file, invoker should provide lock
+func (tl *txLog) appendWithinLock(entry *txLogEntry) {
+	tl.applyWithinLock(entry)
+	if tl.filename == "" {
+		return
+	}
+	if tl.file == nil {
+		file, err := os.OpenFile(tl.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			logger.Errorf("open transaction log failed: %v", err)
+			return
+		}
+		tl.file = file
+	}
+	data, _ := json.Marshal(entry)
+	data = append(data, '\n')
+	if _, err := tl.file.Write(data); err != nil {
+		logger.Errorf("write transaction log failed: %v", err)
+		return
+	}
+	// begin and decision must be durable before participants act on them
+	if entry.Op != txOpEnd {
+		if err := tl.file.Sync(); err != nil {
+			logger.Errorf("sync transaction log failed: %v", err)
+		}
+	}
+	tl.appended++
+	if tl.appended >= txLogRewriteThreshold {
+		tl.rewriteWithinLock()
+	}
+}
+
+// rewriteWithinLock replaces log file with entries of unfinished transactions, invoker should provide lock
+func (tl *txLog) rewriteWithinLock() {
+	if tl.filename == "" {
+		return
+	}
+	if tl.file != nil {
+		_ = tl.file.Close()
+		tl.file = nil
+	}
+	tl.appended = 0
+	if len(tl.records) == 0 {
+		if err := os.Remove(tl.filename); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("remove transaction log failed: %v", err)
+		}
+		return
+	}
+	ids := make([]int64, 0, len(tl.records))
+	for id := range tl.records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	var data []byte
+	for _, id := range ids {
+		record := tl.records[id]
+		bin, _ := json.Marshal(&txLogEntry{Op: txOpBegin, ID: id, Nodes: record.nodes})
+		data = append(append(data, bin...), '\n')
+		if record.decision != "" {
+			bin, _ = json.Marshal(&txLogEntry{Op: record.decision, ID: id})
+			data = append(append(data, bin...), '\n')
+		}
+	}
+	tmpFile, err := os.CreateTemp(config.Properties.Dir, "tmp-tcc-*.log")
+	if err != nil {
+		logger.Errorf("rewrite transaction log failed: %v", err)
+		return
+	}
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	_ = tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), tl.filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		logger.Errorf("rewrite transaction log failed: %v", err)
+	}
+}
+
+// begin records a transaction and its participants before preparing
+func (tl *txLog) begin(txID int64, nodes []string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.appendWithinLock(&txLogEntry{Op: txOpBegin, ID: txID, Nodes: nodes})
+}
+
+// decide records decision of a transaction, decision is txOpCommit or txOpRollback
+func (tl *txLog) decide(txID int64, decision string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	record := tl.records[txID]
+	if record == nil || record.decision == decision {
+		return
+	}
+	tl.appendWithinLock(&txLogEntry{Op: decision, ID: txID})
+}
+
+// end records that all participants have acknowledged the decision
+func (tl *txLog) end(txID int64) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.records[txID] == nil {
+		return
+	}
+	tl.appendWithinLock(&txLogEntry{Op: txOpEnd, ID: txID})
+}
+
+// setActive marks whether coordinator is still working on the transaction
+func (tl *txLog) setActive(txID int64, active bool) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if record := tl.records[txID]; record != nil {
+		record.active = active
+	}
+}
+
+// getStatus returns decision of transaction, or txStatusPending if undecided, or txStatusUnknown
+func (tl *txLog) getStatus(txID int64) string {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	record := tl.records[txID]
+	if record == nil {
+		return txStatusUnknown
+	}
+	if record.decision == "" {
+		return txStatusPending
+	}
+	return record.decision
+}
+
+// getInactive returns unfinished transactions which coordinator is not working on
+func (tl *txLog) getInactive() []*txRecord {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	var result []*txRecord
+	for _, record := range tl.records {
+		if !record.active {
+			result = append(result, &txRecord{
+				id:       record.id,
+				nodes:    record.nodes,
+				decision: record.decision,
+			})
+		}
+	}
+	return result
+}
+
+func (tl *txLog) close() {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.file != nil {
+		_ = tl.file.Close()
+		tl.file = nil
+	}
+}
+
+// beginTransaction generates id of a distributed transaction and records participants in transaction log
+func (cluster *Cluster) beginTransaction(groupMap map[string][]string) int64 {
+	txID := cluster.idGenerator.NextID()
+	nodes := make([]string, 0, len(groupMap))
+	for node := range groupMap {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	cluster.txLog.begin(txID, nodes)
+	return txID
+}
+
+// txRecoveryCron sends decisions of unfinished transactions again until all participants acknowledged
+func (cluster *Cluster) txRecoveryCron() {
+	ticker := time.NewTicker(txRetryPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if cluster.topology.GetSelfNodeID() == "" {
+				continue
+			}
+			for _, record := range cluster.txLog.getInactive() {
+				cluster.recoverTransaction(record)
+			}
+		case <-cluster.closeChan:
+			return
+		}
+	}
+}
+
+func (cluster *Cluster) recoverTransaction(record *txRecord) {
+	if record.decision == "" {
+		// coordinator crashed before all participants prepared
+		record.decision = txOpRollback
+		cluster.txLog.decide(record.id, txOpRollback)
+	}
+	txIDStr := strconv.FormatInt(record.id, 10)
+	c := connection.NewFakeConn()
+	for _, node := range record.nodes {
+		if cluster.topology.GetNode(node) == nil {
+			continue // node has been removed, nothing to wait
+		}
+		resp := cluster.relay(node, c, makeArgs(record.decision, txIDStr))
+		if protocol.IsErrorReply(resp) {
+			logger.Warn(fmt.Sprintf("send %s of transaction %d to %s failed: %s",
+				record.decision, record.id, node, string(resp.ToBytes())))
+			return
+		}
+	}
+	logger.Infof("recovered transaction %d: %s", record.id, record.decision)
+	cluster.txLog.end(record.id)
+}
+
+// queryTransaction asks all nodes for decision of a transaction,
+// it returns txStatusPending if coordinator has not decided or some nodes are unreachable
+func (cluster *Cluster) queryTransaction(txID int64) string {
+	if status := cluster.txLog.getStatus(txID); status != txStatusUnknown {
+		return status
+	}
+	txIDStr := strconv.FormatInt(txID, 10)
+	c := connection.NewFakeConn()
+	result := txStatusUnknown
+	for _, node := range cluster.topology.GetNodes() {
+		if node.ID == cluster.self {
+			continue
+		}
+		resp := cluster.relay(node.ID, c, makeArgs("gcluster", "tx-status", txIDStr))
+		status, ok := resp.(*protocol.StatusReply)
+		if !ok {
+			result = txStatusPending // the unreachable node may be coordinator
+			continue
+		}
+		switch status.Status {
+		case txOpCommit, txOpRollback:
+			return status.Status
+		case txStatusPending:
+			result = txStatusPending
+		}
+	}
+	if result == txStatusUnknown {
+		return txOpRollback
+	}
+	return result
+}
+
+// execGClusterTxStatus command line: gcluster tx-status <txID>
+// returns commit, rollback, pending or unknown as the coordinator of the transaction
+func execGClusterTxStatus(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("gcluster")
+	}
+	txID, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return protocol.MakeStatusReply(cluster.txLog.getStatus(txID))
+}
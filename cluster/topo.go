@@ -2,6 +2,7 @@ package cluster
 
 import (
 	"fmt"
+	"goRedisPlus/config"
 	"goRedisPlus/database"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/utils"
@@ -26,6 +27,14 @@ func (cluster *Cluster) startAsSeed(listenAddr string) protocol.ErrorReply {
 func (cluster *Cluster) Join(seed string) protocol.ErrorReply {
 	err := cluster.topology.Join(seed)
 	if err != nil {
+		return err
+	}
+	if cluster.isReplica() {
+		// replica does not host slots
+		return cluster.topology.SetMaster(cluster.self, cluster.masterID)
+	}
+	if config.Properties.ClusterLearner {
+		// learner takes slots after promoted, see CLUSTER RESHARD
 		return nil
 	}
 	/* STEP3: asynchronous migrating slots */
@@ -36,6 +45,50 @@ func (cluster *Cluster) Join(seed string) protocol.ErrorReply {
 	return nil
 }
 
+// Meet introduces the node at addr to the cluster.
+// If current node has not joined any cluster, it joins the cluster of addr, otherwise it asks addr to join the cluster of current node
+func (cluster *Cluster) Meet(addr string) protocol.ErrorReply {
+	if cluster.topology.GetSelfNodeID() == "" {
+		return cluster.Join(addr)
+	}
+	if nodeID, _ := parseSeedAddr(addr); cluster.topology.GetNode(nodeID) != nil {
+		return nil // already in cluster
+	}
+	peerCli, err := cluster.clientFactory.GetBusClient(addr)
+	if err != nil {
+		return protocol.MakeErrReply("ERR connect with " + addr + " failed: " + err.Error())
+	}
+	defer cluster.clientFactory.ReturnBusClient(addr, peerCli)
+	ret := peerCli.Send(utils.ToCmdLine("gcluster", "join", makeSeedAddr(cluster.addr)))
+	if errReply, ok := ret.(protocol.ErrorReply); ok {
+		return errReply
+	}
+	return nil
+}
+
+// Forget removes a node from the cluster, the node cannot rejoin the cluster during forgetBanPeriod
+func (cluster *Cluster) Forget(nodeID string) protocol.ErrorReply {
+	node := cluster.findNode(nodeID)
+	if node == nil {
+		return protocol.MakeErrReply("ERR Unknown node " + nodeID)
+	}
+	if node.ID == cluster.self {
+		return protocol.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	if node.ID == cluster.masterID {
+		return protocol.MakeErrReply("ERR Can't forget my master!")
+	}
+	if node.getState() == leader {
+		return protocol.MakeErrReply("ERR Can't forget the raft leader")
+	}
+	for _, slot := range cluster.topology.GetSlots() {
+		if slot != nil && slot.NodeID == node.ID {
+			return protocol.MakeErrReply("ERR node " + nodeID + " is still hosting slots, migrate them before forgetting it")
+		}
+	}
+	return cluster.topology.RemoveNode(node.ID)
+}
+
 var errConfigFileNotExist = protocol.MakeErrReply("cluster config file not exist")
 
 // LoadConfig try to load cluster-config-file and re-join the cluster
@@ -52,6 +105,9 @@ func (cluster *Cluster) LoadConfig() protocol.ErrorReply {
 	for _, slot := range selfNode.Slots {
 		cluster.initSlot(slot.ID, slotStateHost)
 	}
+	if err := cluster.recoverMigration(); err != nil {
+		return protocol.MakeErrReply("ERR recover slot migration failed: " + err.Error())
+	}
 	return nil
 }
 
@@ -65,7 +121,7 @@ func (cluster *Cluster) reBalance() {
 			continue
 		}
 		node := node
-		peerCli, err := cluster.clientFactory.GetPeerClient(node.Addr)
+		peerCli, err := cluster.clientFactory.GetBusClient(node.Addr)
 		if err != nil {
 			logger.Errorf("get client of %s failed: %v", node.Addr, err)
 			continue
@@ -76,6 +132,7 @@ func (cluster *Cluster) reBalance() {
 			logger.Errorf("request donate to %s failed: %v", node.Addr, err)
 			continue
 		}
+		donated := make([]uint32, 0, len(payload.Args))
 		for _, bin := range payload.Args {
 			slotID64, err := strconv.ParseUint(string(bin), 10, 64)
 			if err != nil {
@@ -87,11 +144,12 @@ func (cluster *Cluster) reBalance() {
 				ID:     slotID,
 				NodeID: node.ID,
 			})
-			// Raft cannot guarantee the simultaneity and order of submissions to the source and destination nodes
-			// In some cases the source node thinks the slot belongs to the destination node, and the destination node thinks the slot belongs to the source node
-			// To avoid it, the source node and the destination node must reach a consensus  before propose to raft
-			cluster.setLocalSlotImporting(slotID, node.ID)
+			donated = append(donated, slotID)
 		}
+		// Raft cannot guarantee the simultaneity and order of submissions to the source and destination nodes
+		// In some cases the source node thinks the slot belongs to the destination node, and the destination node thinks the slot belongs to the source node
+		// To avoid it, the source node and the destination node must reach a consensus  before propose to raft
+		cluster.setLocalSlotsImporting(donated, node.ID)
 	}
 	if len(slots) == 0 {
 		return
@@ -131,12 +189,20 @@ func (cluster *Cluster) reBalance() {
 
 // importSlot do migrate slot into current node
 // the pseudo `slot` parameter is used to store slotID and former host node
-func (cluster *Cluster) importSlot(slot *Slot) error {
+func (cluster *Cluster) importSlot(slot *Slot) (err error) {
 	node := cluster.topology.GetNode(slot.NodeID)
+	cluster.migrationStat.start(slot.ID, true, slot.NodeID, 0)
+	defer func() {
+		cluster.migrationStat.finish(slot.ID, err)
+	}()
 
 	/* get migrate stream */
 	migrateCmdLine := utils.ToCmdLine(
 		"gcluster", "migrate", strconv.Itoa(int(slot.ID)))
+	if watermark := cluster.migrationLog.getWatermark(slot.ID); watermark != "" {
+		// continue from the last imported key if the migration was interrupted
+		migrateCmdLine = append(migrateCmdLine, []byte(watermark))
+	}
 	migrateStream, err := cluster.clientFactory.NewStream(node.Addr, migrateCmdLine)
 	if err != nil {
 		return err
@@ -144,10 +210,12 @@ func (cluster *Cluster) importSlot(slot *Slot) error {
 	defer migrateStream.Close()
 
 	fakeConn := connection.NewFakeConn()
+	batchSize := getMigrationBatchSize()
+	imported := 0
 slotLoop:
 	for proto := range migrateStream.Stream() {
 		if proto.Err != nil {
-			return fmt.Errorf("set slot %d error: %v", slot.ID, err)
+			return fmt.Errorf("set slot %d error: %v", slot.ID, proto.Err)
 		}
 		switch reply := proto.Data.(type) {
 		case *protocol.MultiBulkReply:
@@ -160,6 +228,15 @@ slotLoop:
 				cluster.setImportedKey(key)
 				_ = cluster.db.Exec(fakeConn, reply.Args)
 			}
+			size := 0
+			for _, arg := range reply.Args {
+				size += len(arg)
+			}
+			cluster.migrationStat.add(slot.ID, 1, int64(size))
+			imported++
+			if imported%batchSize == 0 {
+				cluster.migrationLog.setWatermark(slot.ID, key)
+			}
 		case *protocol.StatusReply:
 			if protocol.IsOKReply(reply) {
 				break slotLoop
@@ -179,11 +256,11 @@ slotLoop:
 	cluster.finishSlotImport(slot.ID)
 
 	// finish migration mode
-	peerCli, err := cluster.clientFactory.GetPeerClient(node.Addr)
+	peerCli, err := cluster.clientFactory.GetBusClient(node.Addr)
 	if err != nil {
 		return err
 	}
-	defer cluster.clientFactory.ReturnPeerClient(node.Addr, peerCli)
+	defer cluster.clientFactory.ReturnBusClient(node.Addr, peerCli)
 	peerCli.Send(utils.ToCmdLine("gcluster", "migrate-done", strconv.Itoa(int(slot.ID))))
 	return nil
 }
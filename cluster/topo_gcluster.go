@@ -1,11 +1,14 @@
 package cluster
 
 import (
+	"bytes"
 	"fmt"
-	"goRedisPlus/aof"
+	"goRedisPlus/config"
+	database2 "goRedisPlus/database"
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/redis/protocol"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -27,18 +30,46 @@ func execGCluster(cluster *Cluster, c redis.Connection, args [][]byte) redis.Rep
 		// After this function return, all requests of target slot will be routed to target node
 		return execGClusterSetSlot(cluster, c, args[2:])
 	case "migrate":
-		// Command line: gcluster migrate <slotId>
-		// Current node will  dump the given slot to the node sending this request
+		// Command line: gcluster migrate <slotId> [<afterKey>]
+		// Current node will  dump the given slot (keys greater than afterKey) to the node sending this request
 		// The given slot must in migrating state
 		return execGClusterMigrate(cluster, c, args[2:])
 	case "migrate-done":
 		// command line: gcluster migrate-done <slotId>
 		// The new node hosting given slot tells current node that migration has finished, remains data can be deleted
 		return execGClusterMigrateDone(cluster, c, args[2:])
+	case "join":
+		// command line: gcluster join <seed>
+		// Another node asks current node to join its cluster, see CLUSTER MEET
+		return execGClusterJoin(cluster, c, args[2:])
+	case "ping":
+		// command line: gcluster ping <sender> <claims> [<nodeID> <state>]...
+		// heartbeat gossip for failure detection, see gossip.go
+		return execGClusterPing(cluster, c, args[2:])
+	case "keyspace-subs":
+		// command line: gcluster keyspace-subs <sender> [<channel>...]
+		// sender tells keyspace channels subscribed on it, see notify.go
+		return execGClusterKeyspaceSubs(cluster, c, args[2:])
+	case "slot-state":
+		// command line: gcluster slot-state <slotId>
+		// returns state of slot and count of keys in it, used to verify resharding
+		return execGClusterSlotState(cluster, c, args[2:])
+	case "slot-load":
+		// command line: gcluster slot-load
+		// returns load of slots hosted by current node, see rebalancer.go
+		return execGClusterSlotLoad(cluster, c, args[2:])
+	case "import-slot":
+		// command line: gcluster import-slot <slotId> <sourceNodeId>
+		// imports an importing slot from source node, see CLUSTER RESHARD
+		return execGClusterImportSlot(cluster, c, args[2:])
 	case "request-donate":
 		// command line: gcluster donate <nodeID>
 		// picks some slots and gives them to the calling node for load balance
 		return execGClusterDonateSlot(cluster, c, args[2:])
+	case "tx-status":
+		// command line: gcluster tx-status <txID>
+		// participants ask decision of an in-doubt transaction, see tcc_log.go
+		return execGClusterTxStatus(cluster, c, args[2:])
 	}
 	return protocol.MakeErrReply(" ERR unknown gcluster sub command '" + subCmd + "'")
 }
@@ -64,6 +95,21 @@ func execGClusterSetSlot(cluster *Cluster, c redis.Connection, args [][]byte) re
 	return protocol.MakeOkReply()
 }
 
+// execGClusterJoin joins the cluster of seed, current node should not be in any cluster
+// args is [seed]
+func execGClusterJoin(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("gcluster")
+	}
+	if cluster.topology.GetSelfNodeID() != "" {
+		return protocol.MakeErrReply("ERR node has joined a cluster")
+	}
+	if err := cluster.Join(string(args[0])); err != nil {
+		return err
+	}
+	return protocol.MakeOkReply()
+}
+
 // execGClusterDonateSlot picks some slots and gives them to the calling node for load balance
 // args is [callingNodeId]
 func execGClusterDonateSlot(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
@@ -77,11 +123,13 @@ func execGClusterDonateSlot(cluster *Cluster, c redis.Connection, args [][]byte)
 		return protocol.MakeEmptyMultiBulkReply()
 	}
 	result := make([][]byte, 0, limit)
+	donated := make([]uint32, 0, limit)
 	// use the randomness of the for-each-in-map to randomly select slots
 	for slotID, slot := range cluster.slots {
 		if slot.state == slotStateHost {
 			slot.state = slotStateMovingOut
 			slot.newNodeID = targetNodeID
+			donated = append(donated, slotID)
 			slotIDBin := []byte(strconv.FormatUint(uint64(slotID), 10))
 			result = append(result, slotIDBin)
 			if len(result) == limit {
@@ -89,13 +137,32 @@ func execGClusterDonateSlot(cluster *Cluster, c redis.Connection, args [][]byte)
 			}
 		}
 	}
+	cluster.migrationLog.beginBatch(donated, false, targetNodeID)
 	return protocol.MakeMultiBulkReply(result)
 }
 
-// execGClusterMigrate Command line: gcluster migrate slotId
+const defaultMigrationBatchSize = 100
+
+// getMigrationBatchSize returns count of keys sent in a batch during migrating slot
+func getMigrationBatchSize() int {
+	if config.Properties.MigrateBatchSize <= 0 {
+		return defaultMigrationBatchSize
+	}
+	return config.Properties.MigrateBatchSize
+}
+
+// execGClusterMigrate Command line: gcluster migrate slotId [afterKey]
 // Current node will  dump data in the given slot to the node sending this request
 // The given slot must in migrating state
+// Keys are sent in ascending order, afterKey is the watermark of an interrupted migration, see migration_log.go
 func execGClusterMigrate(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 && len(args) != 2 {
+		return protocol.MakeArgNumErrReply("gcluster")
+	}
+	afterKey := ""
+	if len(args) == 2 {
+		afterKey = string(args[1])
+	}
 	slotId0, err := strconv.Atoi(string(args[0]))
 	if err != nil || slotId0 >= slotCount {
 		return protocol.MakeErrReply("ERR value is not a valid slot id")
@@ -105,23 +172,63 @@ func execGClusterMigrate(cluster *Cluster, c redis.Connection, args [][]byte) re
 	if slot == nil || slot.state != slotStateMovingOut {
 		return protocol.MakeErrReply("ERR only dump migrating slot")
 	}
-	// migrating slot is immutable
+	// migrating slot is immutable from now on, keys are no longer served by current node in redirect mode
+	// keys are sent as RESTORE commands (with ttl), and written into connection in batches
+	slot.exportMu.Lock()
+	slot.exporting = true
+	slot.exportMu.Unlock()
 	logger.Info("start dump slot", slotId)
-	slot.keys.ForEach(func(key string) bool {
+	slot.mu.RLock()
+	keys := slot.keys.ToSlice()
+	slot.mu.RUnlock()
+	sort.Strings(keys)
+	if afterKey != "" {
+		keys = keys[sort.Search(len(keys), func(i int) bool {
+			return keys[i] > afterKey
+		}):]
+	}
+	stat := cluster.migrationStat
+	stat.start(slotId, false, slot.newNodeID, len(keys))
+	throttle := makeMigrationThrottle()
+	batchSize := getMigrationBatchSize()
+	buf := &bytes.Buffer{}
+	count := 0
+	var writeErr error
+	flush := func() {
+		if buf.Len() > 0 {
+			size := buf.Len()
+			_, writeErr = c.Write(buf.Bytes())
+			stat.add(slotId, count, int64(size))
+			throttle.wait(count, size)
+			buf.Reset()
+			count = 0
+		}
+	}
+	for _, key := range keys {
 		entity, ok := cluster.db.GetEntity(0, key)
-		if ok {
-			ret := aof.EntityToCmd(key, entity)
-			// todo: handle error and close connection
-			_, _ = c.Write(ret.ToBytes())
-			expire := cluster.db.GetExpiration(0, key)
-			if expire != nil {
-				ret = aof.MakeExpireCmd(key, *expire)
-				_, _ = c.Write(ret.ToBytes())
-			}
-
+		if !ok {
+			continue
+		}
+		cmdLine, err := database2.MakeRestoreCmd(key, entity, cluster.db.GetExpiration(0, key))
+		if err != nil {
+			logger.Errorf("dump key %s failed: %v", key, err)
+			continue
+		}
+		buf.Write(protocol.MakeMultiBulkReply(cmdLine).ToBytes())
+		count++
+		if count >= batchSize {
+			flush()
 		}
-		return true
-	})
+		if writeErr != nil {
+			break
+		}
+	}
+	flush()
+	stat.finish(slotId, writeErr)
+	if writeErr != nil {
+		logger.Errorf("send slot %d failed: %v", slotId, writeErr)
+		return protocol.MakeErrReply("ERR send slot failed: " + writeErr.Error())
+	}
 	logger.Info("finish dump slot ", slotId)
 	// send a ok reply to tell requesting node dump finished
 	return protocol.MakeOkReply()
@@ -142,5 +249,6 @@ func execGClusterMigrateDone(cluster *Cluster, c redis.Connection, args [][]byte
 	cluster.slotMu.Lock()
 	delete(cluster.slots, slotId)
 	cluster.slotMu.Unlock()
+	cluster.migrationLog.finish(slotId)
 	return protocol.MakeOkReply()
 }
@@ -38,11 +38,15 @@ func getSlot(key string) uint32 {
 
 // Node represents a node and its slots, used in cluster internal messages
 type Node struct {
-	ID        string
-	Addr      string
-	Slots     []*Slot // ascending order by slot id
-	Flags     uint32
-	lastHeard time.Time
+	ID       string
+	Addr     string
+	BusAddr  string  // address of cluster bus, empty means port of Addr + busPortOffset
+	Slots    []*Slot // ascending order by slot id
+	Flags    uint32
+	MasterID string // id of master if the node is a replica
+	// ConfigEpoch is bumped when the node is assigned slots, the highest epoch wins if nodes claim the same slot
+	ConfigEpoch uint64
+	lastHeard   time.Time
 }
 
 type topology interface {
@@ -52,6 +56,11 @@ type topology interface {
 	GetSlots() []*Slot
 	StartAsSeed(addr string) protocol.ErrorReply
 	SetSlot(slotIDs []uint32, newNodeID string) protocol.ErrorReply
+	RemoveNode(nodeID string) protocol.ErrorReply
+	SetMaster(nodeID string, masterID string) protocol.ErrorReply
+	Failover(nodeID string, masterID string) protocol.ErrorReply
+	TransferLeader(nodeID string) protocol.ErrorReply
+	PromoteLearner(nodeID string) protocol.ErrorReply
 	LoadConfigFile() protocol.ErrorReply
 	Join(seed string) protocol.ErrorReply
 	Close() error
@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/connection"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Topology change notifications:
+// Clients caching slot routes could SUBSCRIBE __cluster__:topology on any node, every node publishes a message
+// to its local subscribers after applying a topology change, so that clients refresh CLUSTER SLOTS
+// before receiving a wave of MOVED errors. Messages are:
+//   node-added <node>
+//   node-removed <node>
+//   slots-moved <node> <slot ranges>, such as `slots-moved 127.0.0.1:6399 0-100,200`
+//   replica-of <node> <master|none>
+//   failover <new master> <former master>
+//   learner-promoted <node>
+
+const topologyChannel = "__cluster__:topology"
+
+// formatSlotIDs converts slot ids to ranges like 0-100,200
+func formatSlotIDs(slotIDs []uint32) string {
+	ids := make([]uint32, len(slotIDs))
+	copy(ids, slotIDs)
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	var ranges []string
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] <= ids[j]+1 {
+			j++
+		}
+		if ids[i] == ids[j] {
+			ranges = append(ranges, strconv.Itoa(int(ids[i])))
+		} else {
+			ranges = append(ranges, strconv.Itoa(int(ids[i]))+"-"+strconv.Itoa(int(ids[j])))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// makeTopologyMessage returns notification of the raft log entry, or empty string if nothing changed
+func makeTopologyMessage(entry *logEntry) string {
+	switch entry.Event {
+	case eventNewNode:
+		return "node-added " + entry.NodeID
+	case eventRemoveNode:
+		return "node-removed " + entry.NodeID
+	case eventSetSlot:
+		if len(entry.SlotIDs) == 0 {
+			return ""
+		}
+		return "slots-moved " + entry.NodeID + " " + formatSlotIDs(entry.SlotIDs)
+	case eventSetMaster:
+		master := entry.MasterID
+		if master == "" {
+			master = "none"
+		}
+		return "replica-of " + entry.NodeID + " " + master
+	case eventFailover:
+		return "failover " + entry.NodeID + " " + entry.MasterID
+	case eventPromoteLearner:
+		return "learner-promoted " + entry.NodeID
+	}
+	return ""
+}
+
+// publishTopologyMessages sends notifications to clients subscribed on current node
+func (cluster *Cluster) publishTopologyMessages(messages []string) {
+	c := connection.NewFakeConn()
+	for _, msg := range messages {
+		cluster.db.Exec(c, utils.ToCmdLine("publish", topologyChannel, msg))
+	}
+}
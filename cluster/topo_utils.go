@@ -2,8 +2,10 @@ package cluster
 
 import (
 	"goRedisPlus/datastruct/set"
+	"goRedisPlus/interface/database"
 	"goRedisPlus/lib/utils"
 	"goRedisPlus/redis/connection"
+	"time"
 )
 
 func (cluster *Cluster) isImportedKey(key string) bool {
@@ -27,10 +29,11 @@ func (cluster *Cluster) initSlot(slotId uint32, state uint32) {
 	cluster.slotMu.Lock()
 	defer cluster.slotMu.Unlock()
 	cluster.slots[slotId] = &hostSlot{
-		importedKeys: set.Make(),
-		keys:         set.Make(),
+		importedKeys: set.MakeCompact(),
+		keys:         set.MakeCompact(),
 		state:        state,
 	}
+	cluster.slotMetrics.reset(slotId)
 }
 
 func (cluster *Cluster) getHostSlot(slotId uint32) *hostSlot {
@@ -46,21 +49,30 @@ func (cluster *Cluster) finishSlotImport(slotID uint32) {
 	slot.state = slotStateHost
 	slot.importedKeys = nil
 	slot.oldNodeID = ""
+	cluster.migrationLog.finish(slotID)
 }
 
 func (cluster *Cluster) setLocalSlotImporting(slotID uint32, oldNodeID string) {
+	cluster.setLocalSlotsImporting([]uint32{slotID}, oldNodeID)
+}
+
+// setLocalSlotsImporting marks slots importing from the same node, migration log is persisted once
+func (cluster *Cluster) setLocalSlotsImporting(slotIDs []uint32, oldNodeID string) {
 	cluster.slotMu.Lock()
 	defer cluster.slotMu.Unlock()
-	slot := cluster.slots[slotID]
-	if slot == nil {
-		slot = &hostSlot{
-			importedKeys: set.Make(),
-			keys:         set.Make(),
+	for _, slotID := range slotIDs {
+		slot := cluster.slots[slotID]
+		if slot == nil {
+			slot = &hostSlot{
+				importedKeys: set.MakeCompact(),
+				keys:         set.MakeCompact(),
+			}
+			cluster.slots[slotID] = slot
 		}
-		cluster.slots[slotID] = slot
+		slot.state = slotStateImporting
+		slot.oldNodeID = oldNodeID
 	}
-	slot.state = slotStateImporting
-	slot.oldNodeID = oldNodeID
+	cluster.migrationLog.beginBatch(slotIDs, true, oldNodeID)
 }
 
 func (cluster *Cluster) setSlotMovingOut(slotID uint32, newNodeID string) {
@@ -69,13 +81,26 @@ func (cluster *Cluster) setSlotMovingOut(slotID uint32, newNodeID string) {
 	slot := cluster.slots[slotID]
 	if slot == nil {
 		slot = &hostSlot{
-			importedKeys: set.Make(),
-			keys:         set.Make(),
+			importedKeys: set.MakeCompact(),
+			keys:         set.MakeCompact(),
 		}
 		cluster.slots[slotID] = slot
 	}
 	slot.state = slotStateMovingOut
 	slot.newNodeID = newNodeID
+	cluster.migrationLog.begin(slotID, false, newNodeID)
+}
+
+// collectSlotKeys adds existing keys into hosted slots, keys loaded from aof or rdb before slots initialized are not tracked
+func (cluster *Cluster) collectSlotKeys() {
+	cluster.db.ForEach(0, func(key string, data *database.DataEntity, expiration *time.Time) bool {
+		if slot := cluster.getHostSlot(getSlot(key)); slot != nil {
+			slot.mu.Lock()
+			slot.keys.Add(key)
+			slot.mu.Unlock()
+		}
+		return true
+	})
 }
 
 // cleanDroppedSlot deletes keys when slot has moved out or failed to import
@@ -1,6 +1,9 @@
 package cluster
 
-import "goRedisPlus/interface/redis"
+import (
+	"goRedisPlus/interface/redis"
+	"sort"
+)
 
 func ping(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Reply {
 	return cluster.db.Exec(c, cmdLine)
@@ -71,3 +74,17 @@ func modifyCmd(cmdLine CmdLine, newCmd string) CmdLine {
 	cmdLine2[0] = []byte(newCmd)
 	return cmdLine2
 }
+
+// getMasterNodes returns master nodes sorted by id, keyspace of cluster is the union of them
+func (cluster *Cluster) getMasterNodes() []*Node {
+	var masters []*Node
+	for _, node := range cluster.topology.GetNodes() {
+		if node.MasterID == "" {
+			masters = append(masters, node)
+		}
+	}
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].ID < masters[j].ID
+	})
+	return masters
+}
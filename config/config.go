@@ -1,10 +1,12 @@
 package config
 
 import (
-	"bufio"
+	"errors"
+	"fmt"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/utils"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -21,27 +23,104 @@ var (
 // ServerProperties defines global config properties
 type ServerProperties struct {
 	// for Public configuration
-	RunID             string `cfg:"runid"` // runID always different at every exec.
-	Bind              string `cfg:"bind"`
-	Port              int    `cfg:"port"`
-	Dir               string `cfg:"dir"`
-	AnnounceHost      string `cfg:"announce-host"`
-	AppendOnly        bool   `cfg:"appendonly"`
-	AppendFilename    string `cfg:"appendfilename"`
-	AppendFsync       string `cfg:"appendfsync"`
-	AofUseRdbPreamble bool   `cfg:"aof-use-rdb-preamble"`
-	MaxClients        int    `cfg:"maxclients"`
-	RequirePass       string `cfg:"requirepass"`
-	Databases         int    `cfg:"databases"`
-	RDBFilename       string `cfg:"dbfilename"`
-	MasterAuth        string `cfg:"masterauth"`
-	SlaveAnnouncePort int    `cfg:"slave-announce-port"`
-	SlaveAnnounceIP   string `cfg:"slave-announce-ip"`
-	ReplTimeout       int    `cfg:"repl-timeout"`
-	ClusterEnable     bool   `cfg:"cluster-enable"`
-	ClusterAsSeed     bool   `cfg:"cluster-as-seed"`
-	ClusterSeed       string `cfg:"cluster-seed"`
-	ClusterConfigFile string `cfg:"cluster-config-file"`
+	RunID              string `cfg:"runid"`          // runID always different at every exec.
+	Bind               string `cfg:"bind"`           // one or more hosts separated by spaces
+	ProtectedMode      bool   `cfg:"protected-mode"` // refuse non-loopback clients if binding all interfaces without password, default yes
+	Port               int    `cfg:"port"`
+	Dir                string `cfg:"dir"`
+	AnnounceHost       string `cfg:"announce-host"`
+	LogLevel           string `cfg:"loglevel"` // debug (default), verbose, notice or warning
+	AppendOnly         bool   `cfg:"appendonly"`
+	AppendFilename     string `cfg:"appendfilename"`
+	AppendFsync        string `cfg:"appendfsync"`
+	AofUseRdbPreamble  bool   `cfg:"aof-use-rdb-preamble"`
+	MaxClients         int    `cfg:"maxclients"`
+	Timeout            int    `cfg:"timeout"`                   // seconds, normal clients idle longer than it are closed, 0 (default) means never
+	MaxClientsPerIP    int    `cfg:"maxclients-per-ip"`         // limit of connected clients from each ip, 0 (default) means unlimited
+	AcceptRateLimit    int    `cfg:"accept-rate-limit"`         // connections accepted per second, 0 (default) means unlimited
+	AcceptBurst        int    `cfg:"accept-burst"`              // connections accepted at most in a burst, default is accept-rate-limit
+	LatencyThreshold   int    `cfg:"latency-monitor-threshold"` // milliseconds, events taking longer are recorded, 0 (default) disables it
+	LatencyTracking    bool   `cfg:"latency-tracking"`          // track latency percentiles of commands, see INFO latencystats, default yes
+	RequirePass        string `cfg:"requirepass"`               // plaintext, or SHA-256 hash like #<64 hex digits>
+	AclFile            string `cfg:"aclfile"`                   // users of ACL, see ACL SAVE and ACL LOAD
+	Databases          int    `cfg:"databases"`
+	DictShards         int    `cfg:"dict-shards"`                 // shards of dicts of keys in each db, 0 (default) picks by GOMAXPROCS and grows with keys
+	KeyspaceIndex      bool   `cfg:"keyspace-index"`              // keep a radix tree of keys for KEYS and SCAN with prefix patterns like "user:*", default no
+	MaxMemory          int    `cfg:"maxmemory"`                   // bytes of estimated dataset, keys are evicted above it, 0 (default) means unlimited
+	MaxMemoryPolicy    string `cfg:"maxmemory-policy"`            // noeviction (default), allkeys-lru, volatile-lru, allkeys-lfu or volatile-lfu
+	MaxMemorySamples   int    `cfg:"maxmemory-samples"`           // keys sampled from each db to find eviction candidates, default 5
+	MaxMemoryTenacity  int    `cfg:"maxmemory-eviction-tenacity"` // 0-100, time spent in evicting before a command, the rest is evicted in background, default 10
+	LFULogFactor       int    `cfg:"lfu-log-factor"`              // the greater the more accesses to saturate LFU counter, default 10
+	LFUDecayTime       int    `cfg:"lfu-decay-time"`              // minutes to decrement LFU counter, default 1, 0 means never decay
+	MaxMemoryClients   string `cfg:"maxmemory-clients"`           // bytes, or percentage of maxmemory like 10%, held by all clients, 0 (default) means unlimited
+	GoMemoryLimit      int    `cfg:"go-memory-limit"`             // soft memory limit of go runtime, 0 (default) derives it from maxmemory, see GOMEMLIMIT
+	GoGC               int    `cfg:"gogc"`                        // percent of heap growth to trigger GC, -1 turns GC off until memory limit, 0 (default) keeps GOGC
+	ActiveDefrag       bool   `cfg:"activedefrag"`                // compact over-allocated structures in background, default no
+	DefragCycleMax     int    `cfg:"active-defrag-cycle-max"`     // 1-100, percent of CPU time spent in active defragmentation at most, default 25
+	ExpireEffort       int    `cfg:"active-expire-effort"`        // 1-10, the greater the more CPU spent in removing expired keys in background, default 1
+	SetMaxIntset       int    `cfg:"set-max-intset-entries"`      // sets of at most this many integers are encoded as intset, default 512
+	HashMaxListpack    int    `cfg:"hash-max-listpack-entries"`   // hashes of at most this many fields are encoded as listpack, default 128
+	HashListpackValue  int    `cfg:"hash-max-listpack-value"`     // bytes of fields and values of listpack encoded hashes at most, default 64
+	ZSetMaxListpack    int    `cfg:"zset-max-listpack-entries"`   // sorted sets of at most this many members are encoded as listpack, default 128
+	ZSetListpackValue  int    `cfg:"zset-max-listpack-value"`     // bytes of members of listpack encoded sorted sets at most, default 64
+	ListMaxListpack    int    `cfg:"list-max-listpack-size"`      // elements of listpack encoded lists at most, or -1 to -5 for 4KB to 64KB, default -2
+	HotKeysSampling    int    `cfg:"hotkeys-sampling"`            // one of every N accesses to keys is counted by HOTKEYS, default 10, 0 disables it
+	HotKeysInterval    int    `cfg:"hotkeys-interval"`            // seconds, HOTKEYS reports access rates over the last interval, default 60
+	RDBFilename        string `cfg:"dbfilename"`
+	Save               string `cfg:"save"`                       // save points like "3600 1 300 100", SHUTDOWN saves rdb if there is any
+	RenameCommand      string `cfg:"rename-command"`             // pairs of command and its new name, "" means disabled
+	OutputBufferLimit  string `cfg:"client-output-buffer-limit"` // <class> <hard limit> <soft limit> <soft seconds> of normal, replica and pubsub
+	KeyspaceEvents     string `cfg:"notify-keyspace-events"`     // keyspace notification classes, such as "KEA"
+	MasterAuth         string `cfg:"masterauth"`
+	MasterUser         string `cfg:"masteruser"`
+	ReplicaOf          string `cfg:"replicaof"` // "<host> <port>", master could be a real redis-server up to 7.0 (rdb version <= 10)
+	SlaveAnnouncePort  int    `cfg:"slave-announce-port"`
+	SlaveAnnounceIP    string `cfg:"slave-announce-ip"`
+	ReplTimeout        int    `cfg:"repl-timeout"`
+	ReplPingPeriod     int    `cfg:"repl-ping-replica-period"`
+	ReplDisklessSync   bool   `cfg:"repl-diskless-sync"`
+	ReplicaServeStale  string `cfg:"replica-serve-stale-data"` // default yes
+	ReplicaPriority    int    `cfg:"replica-priority"`         // slave with priority 0 will never be promoted
+	MinReplicasToWrite int    `cfg:"min-replicas-to-write"`
+	MinReplicasMaxLag  int    `cfg:"min-replicas-max-lag"`
+	ClusterEnable      bool   `cfg:"cluster-enable"`
+	ClusterAsSeed      bool   `cfg:"cluster-as-seed"`
+	ClusterSeed        string `cfg:"cluster-seed"`
+	ClusterConfigFile  string `cfg:"cluster-config-file"`
+	AnnounceIP         string `cfg:"cluster-announce-ip"`             // address advertised to other nodes, such as public ip of container
+	AnnouncePort       int    `cfg:"cluster-announce-port"`           // client port advertised to other nodes, default is port
+	AnnounceBusPort    int    `cfg:"cluster-announce-bus-port"`       // cluster bus port advertised to other nodes, default is advertised port + 10000
+	ClusterLearner     bool   `cfg:"cluster-learner"`                 // join raft group as non-voting learner, see CLUSTER PROMOTE-LEARNER
+	ClusterRedirect    bool   `cfg:"cluster-redirect"`                // reply MOVED/ASK instead of relaying commands
+	ClusterNodeTimeout int    `cfg:"cluster-node-timeout"`            // milliseconds, default 15000
+	MigrateBatchSize   int    `cfg:"cluster-migration-batch"`         // keys per batch during migrating slot, default 100
+	MigrateKeysPerSec  int    `cfg:"cluster-migration-keys-per-sec"`  // rate limit of migrating slot, 0 means unlimited
+	MigrateBytesPerSec int    `cfg:"cluster-migration-bytes-per-sec"` // rate limit of migrating slot, 0 means unlimited
+	PeerMaxIdleTime    int    `cfg:"cluster-peer-max-idle-time"`      // seconds, idle connections with peers are closed after it, default 300, -1 means never
+	PeerMaxLifetime    int    `cfg:"cluster-peer-max-lifetime"`       // seconds, connections with peers are replaced after it, 0 (default) means never
+	PeerCheckInterval  int    `cfg:"cluster-peer-check-interval"`     // seconds between health checks of idle connections with peers, default 10, -1 disables it
+	PeerConnections    int    `cfg:"cluster-peer-connections"`        // shared connections with each peer to relay commands, default 2
+	RelayTimeout       int    `cfg:"cluster-relay-timeout"`           // milliseconds to wait for reply of relayed command, default 3000
+	PrepareTimeout     int    `cfg:"cluster-prepare-timeout"`         // milliseconds to wait for key locks while preparing distributed transaction, default 1000
+	RebalanceMode      string `cfg:"cluster-rebalance"`               // off (default), propose or auto, see CLUSTER REBALANCE STATUS
+	RebalancePeriod    int    `cfg:"cluster-rebalance-period"`        // seconds between load examinations, default 60
+	RebalanceThreshold int    `cfg:"cluster-rebalance-threshold"`     // percent of load above average to start rebalancing, default 20
+	RebalanceMetric    string `cfg:"cluster-rebalance-metric"`        // load of slot: key-count (default), memory-bytes or ops-per-sec
+
+	// for topology backend of cluster
+	ClusterBackend string   `cfg:"cluster-backend"`        // consensus of topology, raft (default) or etcd
+	EtcdEndpoints  []string `cfg:"cluster-etcd-endpoints"` // such as 127.0.0.1:2379,127.0.0.1:22379
+	EtcdPrefix     string   `cfg:"cluster-etcd-prefix"`    // prefix of keys in etcd, default /godis/
+
+	// for TLS and authentication of connections
+	TLSEnabled      bool   `cfg:"tls"`               // serve clients with TLS, peers of cluster connect to each other with TLS as well
+	TLSCluster      bool   `cfg:"tls-cluster"`       // use TLS on cluster bus
+	TLSCertFile     string `cfg:"tls-cert-file"`     // certificate of server, it is the client certificate to peers too
+	TLSKeyFile      string `cfg:"tls-key-file"`      // private key of tls-cert-file
+	TLSCACertFile   string `cfg:"tls-ca-cert-file"`  // CA to verify certificates of clients and peers
+	TLSAuthClients  bool   `cfg:"tls-auth-clients"`  // require certificates of clients, aka mutual TLS
+	ClusterAuthUser string `cfg:"cluster-auth-user"` // user to authenticate with peers, empty means default user
+	ClusterAuthPass string `cfg:"cluster-auth-pass"` // password to authenticate with peers, default is requirepass unless it is hashed
 
 	// for cluster mode configuration
 	ClusterEnabled string   `cfg:"cluster-enabled"` // Not used at present.
@@ -56,8 +135,134 @@ type ServerInfo struct {
 	StartUpTime time.Time
 }
 
+// AnnounceAddress returns address advertised to other nodes of cluster, it is the id of current node
 func (p *ServerProperties) AnnounceAddress() string {
-	return p.AnnounceHost + ":" + strconv.Itoa(p.Port)
+	host := p.AnnounceHost
+	if p.AnnounceIP != "" {
+		host = p.AnnounceIP
+	}
+	port := p.Port
+	if p.AnnouncePort > 0 {
+		port = p.AnnouncePort
+	}
+	return host + ":" + strconv.Itoa(port)
+}
+
+// BindAddresses returns addresses to listen at the port, bind may have several hosts separated by spaces
+func (p *ServerProperties) BindAddresses(port int) []string {
+	hosts := strings.Fields(p.Bind)
+	if len(hosts) == 0 {
+		hosts = []string{""} // all interfaces
+	}
+	addresses := make([]string, len(hosts))
+	for i, host := range hosts {
+		addresses[i] = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return addresses
+}
+
+// BindsAllInterfaces returns whether bind puts no restriction on interfaces, such as empty bind and 0.0.0.0
+func (p *ServerProperties) BindsAllInterfaces() bool {
+	hosts := strings.Fields(p.Bind)
+	if len(hosts) == 0 {
+		return true
+	}
+	for _, host := range hosts {
+		if host == "*" || host == "::*" {
+			return true
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
+
+// RenamedCommands returns pairs of original name and new name of commands in rename-command directives
+func (p *ServerProperties) RenamedCommands() ([][2]string, error) {
+	args, err := splitArgs(p.RenameCommand)
+	if err != nil {
+		return nil, err
+	}
+	if len(args)%2 != 0 {
+		return nil, errors.New("rename-command requires a command and its new name")
+	}
+	pairs := make([][2]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		pairs = append(pairs, [2]string{strings.ToLower(args[i]), strings.ToLower(args[i+1])})
+	}
+	return pairs, nil
+}
+
+// OutputBufferLimit limits pending output of a class of clients, zero means no limit.
+// Clients are disconnected once their pending output exceeds hard limit or stays above soft limit for soft seconds.
+type OutputBufferLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int64
+}
+
+// OutputBufferLimits returns limits of client classes normal, replica and pubsub, defaults are the same as redis
+func (p *ServerProperties) OutputBufferLimits() (map[string]OutputBufferLimit, error) {
+	return parseOutputBufferLimits(p.OutputBufferLimit)
+}
+
+func parseOutputBufferLimits(value string) (map[string]OutputBufferLimit, error) {
+	limits := map[string]OutputBufferLimit{
+		"normal":  {},
+		"replica": {Hard: 256 * 1024 * 1024, Soft: 64 * 1024 * 1024, SoftSeconds: 60},
+		"pubsub":  {Hard: 32 * 1024 * 1024, Soft: 8 * 1024 * 1024, SoftSeconds: 60},
+	}
+	args, err := splitArgs(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(args)%4 != 0 {
+		return nil, errors.New("wrong number of arguments in buffer limit configuration")
+	}
+	for i := 0; i < len(args); i += 4 {
+		class := strings.ToLower(args[i])
+		if class == "slave" {
+			class = "replica"
+		}
+		if _, ok := limits[class]; !ok {
+			return nil, fmt.Errorf("invalid client class '%s'", args[i])
+		}
+		var values [3]int64
+		for j := range values {
+			values[j], err = parseMemory(args[i+1+j])
+			if err != nil || values[j] < 0 {
+				return nil, errors.New("error in hard, soft or soft_seconds setting in buffer limit configuration")
+			}
+		}
+		limits[class] = OutputBufferLimit{Hard: values[0], Soft: values[1], SoftSeconds: values[2]}
+	}
+	return limits, nil
+}
+
+// MaxMemoryClientsBytes returns the limit of memory held by all clients in bytes, 0 means unlimited.
+// A percentage is relative to maxmemory, so it is unlimited if maxmemory is unlimited.
+func (p *ServerProperties) MaxMemoryClientsBytes() (int64, error) {
+	return parseMaxMemoryClients(p.MaxMemoryClients, int64(p.MaxMemory))
+}
+
+func parseMaxMemoryClients(value string, maxMemory int64) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseInt(strings.TrimSuffix(value, "%"), 10, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, errors.New("percentage argument must be between 0 and 100")
+		}
+		return maxMemory * percent / 100, nil
+	}
+	limit, err := parseMemory(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("argument must be a memory or percent value")
+	}
+	return limit, nil
 }
 
 // Properties holds global config properties
@@ -72,88 +277,184 @@ func init() {
 
 	// default config
 	Properties = &ServerProperties{
-		Bind:       "127.0.0.1",
-		Port:       6379,
-		AppendOnly: false,
-		RunID:      utils.RandString(40),
+		Bind:               "127.0.0.1",
+		Port:               6379,
+		AppendOnly:         false,
+		RunID:              utils.RandString(40),
+		MinReplicasMaxLag:  10,
+		ReplicaPriority:    100,
+		ReplTimeout:        60,
+		ReplPingPeriod:     10,
+		ClusterNodeTimeout: 15000,
 	}
 }
 
-func parse(src io.Reader) *ServerProperties {
-	config := &ServerProperties{}
+// repeatableParams accumulate arguments of all their directives instead of keeping the last one
+var repeatableParams = map[string]bool{
+	"save":                       true,
+	"rename-command":             true,
+	"client-output-buffer-limit": true,
+}
+
+// multiArgParams are string params with several arguments separated by spaces
+var multiArgParams = map[string]bool{
+	"bind":                       true,
+	"client-output-buffer-limit": true,
+	"rename-command":             true,
+	"replicaof":                  true,
+	"save":                       true,
+}
 
-	// read config file
-	rawMap := make(map[string]string)
-	scanner := bufio.NewScanner(src)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) > 0 && strings.TrimLeft(line, " ")[0] == '#' {
-			continue
-		}
-		pivot := strings.IndexAny(line, " ")
-		if pivot > 0 && pivot < len(line)-1 { // separator found
-			key := line[0:pivot]
-			value := strings.Trim(line[pivot+1:], " ")
-			rawMap[strings.ToLower(key)] = value
-		}
+// directiveAliases are former names of directives
+var directiveAliases = map[string]string{
+	"slaveof": "replicaof",
+}
+
+// parse reads config from src, filename is used to locate included files and in warnings
+func parse(src io.Reader, filename string) (*ServerProperties, error) {
+	directives, err := readDirectives(src, filename, 0)
+	if err != nil {
+		return nil, err
 	}
-	if err := scanner.Err(); err != nil {
-		logger.Fatal(err)
+	return makeProperties(directives), nil
+}
+
+// makeProperties fills default properties with directives
+func makeProperties(directives []*directive) *ServerProperties {
+	config := &ServerProperties{
+		// zero values of these properties are meaningful, so they need defaults
+		MinReplicasMaxLag:  10,
+		ReplicaPriority:    100,
+		ReplTimeout:        60,
+		ReplPingPeriod:     10,
+		ClusterNodeTimeout: 15000,
+		ProtectedMode:      true,
+		LatencyTracking:    true,
+		MaxMemoryPolicy:    "noeviction",
+		MaxMemorySamples:   5,
+		MaxMemoryTenacity:  10,
+		MaxMemoryClients:   "0",
+		LFULogFactor:       10,
+		LFUDecayTime:       1,
+		SetMaxIntset:       512,
+		HashMaxListpack:    128,
+		HashListpackValue:  64,
+		ZSetMaxListpack:    128,
+		ZSetListpackValue:  64,
+		ListMaxListpack:    -2,
+		HotKeysSampling:    10,
+		HotKeysInterval:    60,
 	}
+	applyDirectives(config, directives)
+	return config
+}
 
-	// parse format
-	t := reflect.TypeOf(config)
-	v := reflect.ValueOf(config)
-	n := t.Elem().NumField()
-	for i := 0; i < n; i++ {
-		field := t.Elem().Field(i)
-		fieldVal := v.Elem().Field(i)
-		key, ok := field.Tag.Lookup("cfg")
+// applyDirectives fills properties with directives in order, invalid ones are ignored with warnings
+func applyDirectives(config *ServerProperties, directives []*directive) {
+	fields := make(map[string]reflect.Value)
+	t := reflect.TypeOf(config).Elem()
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		key, ok := t.Field(i).Tag.Lookup("cfg")
 		if !ok || strings.TrimLeft(key, " ") == "" {
-			key = field.Name
+			key = t.Field(i).Name
+		}
+		if strings.Contains(key, ",") {
+			continue // omitempty
+		}
+		fields[strings.ToLower(key)] = v.Field(i)
+	}
+	accumulated := make(map[string][]string)
+	for _, d := range directives {
+		if name, ok := directiveAliases[d.name]; ok {
+			d.name = name
 		}
-		value, ok := rawMap[strings.ToLower(key)]
-		if ok {
-			// fill config
-			switch field.Type.Kind() {
-			case reflect.String:
-				fieldVal.SetString(value)
-			case reflect.Int:
-				intValue, err := strconv.ParseInt(value, 10, 64)
-				if err == nil {
-					fieldVal.SetInt(intValue)
+		fieldVal, ok := fields[d.name]
+		if !ok {
+			logger.Warn(fmt.Sprintf("%s: unknown directive '%s' is ignored", d.position(), d.name))
+			continue
+		}
+		// fill config
+		switch fieldVal.Kind() {
+		case reflect.String:
+			if repeatableParams[d.name] {
+				accumulated[d.name] = append(accumulated[d.name], d.args...)
+				if len(d.args) == 1 && d.args[0] == "" {
+					accumulated[d.name] = nil // such as `save ""`
+				}
+				quoted := make([]string, len(accumulated[d.name]))
+				for i, arg := range accumulated[d.name] {
+					quoted[i] = quoteArg(arg)
 				}
-			case reflect.Bool:
-				boolValue := "yes" == value
-				fieldVal.SetBool(boolValue)
-			case reflect.Slice:
-				if field.Type.Elem().Kind() == reflect.String {
-					slice := strings.Split(value, ",")
-					fieldVal.Set(reflect.ValueOf(slice))
+				fieldVal.SetString(strings.Join(quoted, " "))
+			} else {
+				fieldVal.SetString(strings.Join(d.args, " "))
+			}
+		case reflect.Int:
+			if len(d.args) != 1 {
+				logger.Warn(fmt.Sprintf("%s: '%s' requires one argument", d.position(), d.name))
+				continue
+			}
+			intValue, err := parseMemory(d.args[0])
+			if err != nil {
+				logger.Warn(fmt.Sprintf("%s: invalid number of '%s': %v", d.position(), d.name, err))
+				continue
+			}
+			fieldVal.SetInt(intValue)
+		case reflect.Bool:
+			if len(d.args) != 1 || (!strings.EqualFold(d.args[0], "yes") && !strings.EqualFold(d.args[0], "no")) {
+				logger.Warn(fmt.Sprintf("%s: '%s' must be yes or no", d.position(), d.name))
+				continue
+			}
+			fieldVal.SetBool(strings.EqualFold(d.args[0], "yes"))
+		case reflect.Slice:
+			var slice []string
+			for _, arg := range d.args {
+				for _, item := range strings.Split(arg, ",") {
+					if item != "" {
+						slice = append(slice, item)
+					}
 				}
 			}
+			fieldVal.Set(reflect.ValueOf(slice))
 		}
 	}
-	return config
 }
 
 // SetupConfig read config file and store properties into Properties
 func SetupConfig(configFilename string) {
-	file, err := os.Open(configFilename)
+	properties, err := readConfigFile(configFilename)
 	if err != nil {
 		panic(err)
 	}
-	defer file.Close()
-	Properties = parse(file)
+	Properties = properties
 	Properties.RunID = utils.RandString(40)
 	configFilePath, err := filepath.Abs(configFilename)
 	if err != nil {
 		return
 	}
 	Properties.CfPath = configFilePath
-	if Properties.Dir == "" {
-		Properties.Dir = "."
+}
+
+// readConfigFile parses config file and applies overrides, RunID and CfPath are left empty
+func readConfigFile(configFilename string) (*ServerProperties, error) {
+	file, err := os.Open(configFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	directives, err := readDirectives(file, configFilename, 0)
+	if err != nil {
+		return nil, err
+	}
+	properties := makeProperties(append(directives, overrides...))
+	if properties.Dir == "" {
+		properties.Dir = "."
+	}
+	if properties.Databases == 0 {
+		properties.Databases = 16
 	}
+	return properties, nil
 }
 
 func GetTmpDir() string {
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Params could be overridden without editing config file, precedence from low to high is:
+// defaults, config file, environment variables, command line flags.
+// Environment variable of a param is its name in upper case with '-' replaced by '_' and prefixed by GOREDIS_,
+// such as GOREDIS_PORT and GOREDIS_APPENDONLY. Its value is split into arguments like a line of config file,
+// so `GOREDIS_BIND="127.0.0.1 ::1"` binds both addresses.
+// Command line flags look like `--port 6380 --bind 127.0.0.1 ::1`, a flag takes all arguments until next flag.
+// Overrides are kept after reloading config file.
+
+const envPrefix = "GOREDIS_"
+
+// overrides are directives from environment and command line, they are applied after config file
+var overrides []*directive
+
+// envName returns name of environment variable which overrides the param
+func envName(param string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(param, "-", "_"))
+}
+
+// ParseOverrides collects overrides from environment variables and command line args(without program name).
+// Like redis-server, the first arg may be path of config file, it is returned if given.
+func ParseOverrides(args []string) (string, error) {
+	var result []*directive
+	forEachParam(&ServerProperties{}, func(name string, _ reflect.Value) {
+		value, ok := os.LookupEnv(envName(name))
+		if !ok {
+			return
+		}
+		envArgs, err := splitArgs(value)
+		if err != nil {
+			envArgs = []string{value}
+		}
+		if len(envArgs) == 0 {
+			envArgs = []string{""}
+		}
+		result = append(result, &directive{
+			name: name,
+			args: envArgs,
+			file: "$" + envName(name),
+		})
+	})
+
+	var configFile string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		configFile = args[0]
+		args = args[1:]
+	}
+	var flag *directive
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			if arg == "--" {
+				return "", errors.New("empty flag name")
+			}
+			flag = &directive{
+				name: strings.ToLower(arg[2:]),
+				file: arg,
+			}
+			result = append(result, flag)
+			continue
+		}
+		if flag == nil {
+			return "", fmt.Errorf("unexpected argument '%s'", arg)
+		}
+		flag.args = append(flag.args, arg)
+	}
+	for _, d := range result {
+		if len(d.args) == 0 {
+			d.args = []string{""}
+		}
+		if d.name == "include" {
+			return "", fmt.Errorf("%s: include is not allowed here", d.position())
+		}
+	}
+	overrides = result
+	return configFile, nil
+}
+
+// ApplyOverrides applies overrides to properties which are not read from config file, such as default properties
+func ApplyOverrides(properties *ServerProperties) {
+	applyDirectives(properties, overrides)
+}
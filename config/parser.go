@@ -0,0 +1,251 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Format of config file is the same as redis.conf:
+// Each line is a directive and its arguments separated by spaces, lines starting with # are comments.
+// Arguments may be quoted, double quoted ones support escapes like \n, \t and \xff.
+// Numbers may have memory units: 1k = 1000, 1kb = 1024, 1m = 1000000, 1mb = 1024*1024 and so on.
+// `include <path>` reads another config file in place, relative path is relative to the including file.
+// Later directive overrides former one, except repeatable ones like `save` whose arguments are accumulated.
+
+const maxIncludeDepth = 10
+
+// directive is a line of config file
+type directive struct {
+	name string
+	args []string
+	file string
+	line int
+}
+
+func (d *directive) position() string {
+	if d.line == 0 {
+		return d.file // from environment or command line
+	}
+	return fmt.Sprintf("%s:%d", d.file, d.line)
+}
+
+// readDirectives reads directives of config file, included files are expanded
+func readDirectives(src io.Reader, filename string, depth int) ([]*directive, error) {
+	var directives []*directive
+	scanner := bufio.NewScanner(src)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		d := &directive{
+			name: strings.ToLower(args[0]),
+			args: args[1:],
+			file: filename,
+			line: lineNo,
+		}
+		if d.name != "include" {
+			directives = append(directives, d)
+			continue
+		}
+		if len(d.args) != 1 {
+			return nil, fmt.Errorf("%s: include requires exactly one file", d.position())
+		}
+		included, err := readIncludedFile(d.args[0], filename, depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", d.position(), err)
+		}
+		directives = append(directives, included...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return directives, nil
+}
+
+func readIncludedFile(path string, includer string, depth int) ([]*directive, error) {
+	if depth > maxIncludeDepth {
+		return nil, errors.New("too many nested includes")
+	}
+	if !filepath.IsAbs(path) && includer != "" {
+		path = filepath.Join(filepath.Dir(includer), path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readDirectives(file, path, depth)
+}
+
+// splitArgs splits a line into arguments like sdssplitargs of redis
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i == len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				ch := line[i]
+				if ch == '"' {
+					i++
+					break
+				}
+				if ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg = append(arg, byte(b))
+					i += 4
+					continue
+				}
+				if ch == '\\' && i+1 < len(line) {
+					i++
+					ch = unescape(line[i])
+				}
+				arg = append(arg, ch)
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i == len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				ch := line[i]
+				if ch == '\'' {
+					i++
+					break
+				}
+				if ch == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					ch = '\''
+				}
+				arg = append(arg, ch)
+				i++
+			}
+		default:
+			for i < len(line) && !isSpace(line[i]) {
+				arg = append(arg, line[i])
+				i++
+			}
+		}
+		if i < len(line) && !isSpace(line[i]) {
+			return nil, errors.New("closing quote must be followed by a space")
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n'
+}
+
+func isHexDigit(ch byte) bool {
+	return ('0' <= ch && ch <= '9') || ('a' <= ch && ch <= 'f') || ('A' <= ch && ch <= 'F')
+}
+
+func unescape(ch byte) byte {
+	switch ch {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return ch
+}
+
+// quoteArg quotes an argument if it could not be read back by splitArgs as it is
+func quoteArg(arg string) string {
+	needQuote := arg == ""
+	for i := 0; i < len(arg) && !needQuote; i++ {
+		ch := arg[i]
+		needQuote = ch == '"' || ch == '\'' || ch == '\\' || isSpace(ch) || ch < 0x20 || ch >= 0x7f
+	}
+	if !needQuote {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		ch := arg[i]
+		switch ch {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if ch < 0x20 || ch >= 0x7f {
+				b.WriteString(fmt.Sprintf(`\x%02x`, ch))
+			} else {
+				b.WriteByte(ch)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+var memoryUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1000,
+	"kb": 1024,
+	"m":  1000 * 1000,
+	"mb": 1024 * 1024,
+	"g":  1000 * 1000 * 1000,
+	"gb": 1024 * 1024 * 1024,
+}
+
+// parseMemory parses number with optional memory unit, such as 100, 1gb and 512mb
+func parseMemory(value string) (int64, error) {
+	value = strings.ToLower(value)
+	pivot := len(value)
+	for pivot > 0 && value[pivot-1] >= 'a' && value[pivot-1] <= 'z' {
+		pivot--
+	}
+	n, err := strconv.ParseInt(value[:pivot], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a number", value)
+	}
+	unit, ok := memoryUnits[value[pivot:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit of '%s'", value)
+	}
+	return n * unit, nil
+}
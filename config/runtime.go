@@ -0,0 +1,410 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"goRedisPlus/lib/wildcard"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Runtime configuration:
+// Params are properties named by their cfg tags, CONFIG GET reads all of them except runid.
+// CONFIG SET only changes params in mutableParams, they are read whenever they are used so changes take effect
+// immediately, others like port and databases require restart. CONFIG REWRITE writes current params back into
+// config file, comments and unknown lines are kept as they are.
+
+// paramValidator checks value of a param, the value has been checked against the type of property
+type paramValidator func(value string) error
+
+// mutableParams are params which could be changed by CONFIG SET, nil validator means any value of the type is valid
+var mutableParams = map[string]paramValidator{
+	"loglevel":                        oneOf("debug", "verbose", "notice", "warning"),
+	"appendfsync":                     oneOf("always", "everysec", "no"),
+	"aof-use-rdb-preamble":            nil,
+	"maxclients":                      intRange(0, math.MaxInt32),
+	"timeout":                         intRange(0, math.MaxInt32),
+	"maxclients-per-ip":               intRange(0, math.MaxInt32),
+	"accept-rate-limit":               intRange(0, math.MaxInt32),
+	"accept-burst":                    intRange(0, math.MaxInt32),
+	"client-output-buffer-limit":      validOutputBufferLimits,
+	"latency-monitor-threshold":       intRange(0, math.MaxInt32),
+	"latency-tracking":                nil,
+	"maxmemory":                       intRange(0, math.MaxInt64),
+	"maxmemory-policy":                oneOf("noeviction", "allkeys-lru", "volatile-lru", "allkeys-lfu", "volatile-lfu"),
+	"maxmemory-samples":               intRange(1, 64),
+	"maxmemory-eviction-tenacity":     intRange(0, 100),
+	"lfu-log-factor":                  intRange(0, math.MaxInt32),
+	"lfu-decay-time":                  intRange(0, math.MaxInt32),
+	"maxmemory-clients":               validMaxMemoryClients,
+	"go-memory-limit":                 intRange(0, math.MaxInt64),
+	"gogc":                            intRange(-1, math.MaxInt32),
+	"activedefrag":                    nil,
+	"active-defrag-cycle-max":         intRange(1, 100),
+	"active-expire-effort":            intRange(1, 10),
+	"set-max-intset-entries":          intRange(0, math.MaxInt32),
+	"hash-max-listpack-entries":       intRange(0, math.MaxInt32),
+	"hash-max-listpack-value":         intRange(0, math.MaxInt32),
+	"zset-max-listpack-entries":       intRange(0, math.MaxInt32),
+	"zset-max-listpack-value":         intRange(0, math.MaxInt32),
+	"list-max-listpack-size":          intRange(-5, math.MaxInt32),
+	"hotkeys-sampling":                intRange(0, math.MaxInt32),
+	"hotkeys-interval":                intRange(1, math.MaxInt32),
+	"requirepass":                     nil,
+	"protected-mode":                  nil,
+	"notify-keyspace-events":          validKeyspaceEvents,
+	"masterauth":                      nil,
+	"masteruser":                      nil,
+	"repl-timeout":                    intRange(1, math.MaxInt32),
+	"repl-ping-replica-period":        intRange(1, math.MaxInt32),
+	"repl-diskless-sync":              nil,
+	"replica-serve-stale-data":        oneOf("yes", "no"),
+	"replica-priority":                intRange(0, math.MaxInt32),
+	"min-replicas-to-write":           intRange(0, math.MaxInt32),
+	"min-replicas-max-lag":            intRange(0, math.MaxInt32),
+	"cluster-redirect":                nil,
+	"cluster-node-timeout":            intRange(1, math.MaxInt32),
+	"cluster-migration-batch":         intRange(1, math.MaxInt32),
+	"cluster-migration-keys-per-sec":  intRange(0, math.MaxInt32),
+	"cluster-migration-bytes-per-sec": intRange(0, math.MaxInt32),
+	"cluster-relay-timeout":           intRange(1, math.MaxInt32),
+	"cluster-prepare-timeout":         intRange(1, math.MaxInt32),
+	"cluster-rebalance":               oneOf("off", "propose", "auto"),
+	"cluster-rebalance-period":        intRange(1, math.MaxInt32),
+	"cluster-rebalance-threshold":     intRange(1, math.MaxInt32),
+	"cluster-rebalance-metric":        oneOf("key-count", "memory-bytes", "ops-per-sec"),
+}
+
+// runtimeMu serializes CONFIG SET and CONFIG REWRITE
+var runtimeMu sync.Mutex
+
+func oneOf(values ...string) paramValidator {
+	return func(value string) error {
+		for _, v := range values {
+			if strings.EqualFold(v, value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("argument must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+func intRange(min, max int64) paramValidator {
+	return func(value string) error {
+		n, _ := parseMemory(value)
+		if n < min || n > max {
+			return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+		}
+		return nil
+	}
+}
+
+func validOutputBufferLimits(value string) error {
+	_, err := parseOutputBufferLimits(value)
+	return err
+}
+
+func validMaxMemoryClients(value string) error {
+	_, err := parseMaxMemoryClients(value, 0)
+	return err
+}
+
+func validKeyspaceEvents(value string) error {
+	for i := 0; i < len(value); i++ {
+		if !strings.ContainsRune("KEg$lshzxeA", rune(value[i])) {
+			return fmt.Errorf("invalid event class character '%c'", value[i])
+		}
+	}
+	return nil
+}
+
+// paramName returns name of property in config file, empty if the property is not a param
+func paramName(field reflect.StructField) string {
+	tag, ok := field.Tag.Lookup("cfg")
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			return ""
+		}
+	}
+	name := strings.ToLower(strings.TrimSpace(parts[0]))
+	if name == "runid" {
+		return ""
+	}
+	return name
+}
+
+// forEachParam visits params of properties
+func forEachParam(properties *ServerProperties, consumer func(name string, value reflect.Value)) {
+	t := reflect.TypeOf(properties).Elem()
+	v := reflect.ValueOf(properties).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		if name := paramName(t.Field(i)); name != "" {
+			consumer(name, v.Field(i))
+		}
+	}
+}
+
+// findParam returns field of the param, it is invalid if param is unknown
+func findParam(properties *ServerProperties, name string) reflect.Value {
+	var result reflect.Value
+	forEachParam(properties, func(paramName string, value reflect.Value) {
+		if paramName == name {
+			result = value
+		}
+	})
+	return result
+}
+
+// formatParam formats value of param in the way of config file
+func formatParam(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			return "yes"
+		}
+		return "no"
+	case reflect.Int:
+		return strconv.FormatInt(value.Int(), 10)
+	case reflect.Slice:
+		return strings.Join(value.Interface().([]string), ",")
+	}
+	return value.String()
+}
+
+// parseParam converts value in the way of config file to the type of field
+func parseParam(kind reflect.Kind, value string) (interface{}, error) {
+	switch kind {
+	case reflect.Bool:
+		switch strings.ToLower(value) {
+		case "yes":
+			return true, nil
+		case "no":
+			return false, nil
+		}
+		return nil, errors.New("argument must be 'yes' or 'no'")
+	case reflect.Int:
+		n, err := parseMemory(value)
+		if err != nil {
+			return nil, errors.New("argument couldn't be parsed into an integer")
+		}
+		return int(n), nil
+	case reflect.Slice:
+		if value == "" {
+			return []string(nil), nil
+		}
+		return strings.Split(value, ","), nil
+	}
+	return value, nil
+}
+
+// GetParams returns name and value of params whose name matches the pattern, ordered by name
+func GetParams(pattern string) ([][2]string, error) {
+	p, err := wildcard.CompilePattern(strings.ToLower(pattern))
+	if err != nil {
+		return nil, err
+	}
+	var result [][2]string
+	forEachParam(Properties, func(name string, value reflect.Value) {
+		if p.IsMatch(name) {
+			result = append(result, [2]string{name, formatParam(value)})
+		}
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i][0] < result[j][0]
+	})
+	return result, nil
+}
+
+// ParamError is returned by SetParams, Param is the argument which causes the failure
+type ParamError struct {
+	Param string
+	Err   error
+}
+
+func (e *ParamError) Error() string {
+	return e.Err.Error()
+}
+
+// SetParams changes params at runtime, either all of them are changed or none of them if any is invalid.
+// pairs are name and value of params, names should be lower case
+func SetParams(pairs [][2]string) error {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	fields := make([]reflect.Value, len(pairs))
+	values := make([]interface{}, len(pairs))
+	seen := make(map[string]struct{}, len(pairs))
+	for i, pair := range pairs {
+		name, value := pair[0], pair[1]
+		if _, ok := seen[name]; ok {
+			return &ParamError{Param: name, Err: errors.New("duplicate parameter")}
+		}
+		seen[name] = struct{}{}
+		field := findParam(Properties, name)
+		if !field.IsValid() {
+			return &ParamError{Param: name, Err: errors.New("unknown parameter")}
+		}
+		validator, ok := mutableParams[name]
+		if !ok {
+			return &ParamError{Param: name, Err: errors.New("can't set immutable config")}
+		}
+		v, err := parseParam(field.Kind(), value)
+		if err != nil {
+			return &ParamError{Param: name, Err: err}
+		}
+		if validator != nil {
+			if err := validator(value); err != nil {
+				return &ParamError{Param: name, Err: err}
+			}
+		}
+		fields[i] = field
+		values[i] = v
+	}
+	for i, field := range fields {
+		field.Set(reflect.ValueOf(values[i]))
+	}
+	return nil
+}
+
+// ParamChange is a param whose value in config file differs from the running one
+type ParamChange struct {
+	Name     string
+	OldValue string
+	NewValue string
+	Mutable  bool // whether it could be applied by CONFIG SET, otherwise it takes effect after restart
+}
+
+// DiffConfigFile reads config file again and returns params which have been changed in it, ordered by name
+func DiffConfigFile() ([]*ParamChange, error) {
+	if Properties.CfPath == "" {
+		return nil, errors.New("the server is running without a config file")
+	}
+	properties, err := readConfigFile(Properties.CfPath)
+	if err != nil {
+		return nil, err
+	}
+	newValues := make(map[string]string)
+	forEachParam(properties, func(name string, value reflect.Value) {
+		newValues[name] = formatParam(value)
+	})
+	var changes []*ParamChange
+	forEachParam(Properties, func(name string, value reflect.Value) {
+		oldValue := formatParam(value)
+		if oldValue == newValues[name] {
+			return
+		}
+		_, mutable := mutableParams[name]
+		changes = append(changes, &ParamChange{
+			Name:     name,
+			OldValue: oldValue,
+			NewValue: newValues[name],
+			Mutable:  mutable,
+		})
+	})
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes, nil
+}
+
+// formatDirective formats a line of config file, value is quoted if needed
+func formatDirective(name string, value string) string {
+	if multiArgParams[name] {
+		return name + " " + value
+	}
+	return name + " " + quoteArg(value)
+}
+
+const rewriteSignature = "# Generated by CONFIG REWRITE"
+
+// Rewrite writes current params into config file.
+// Directives of known params are updated in place and duplicates of them are removed, mutable params which are
+// absent in the file are appended if they differ from defaults. Comments and unknown lines are kept.
+func Rewrite() error {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	if Properties.CfPath == "" {
+		return errors.New("the server is running without a config file")
+	}
+	current := make(map[string]string)
+	forEachParam(Properties, func(name string, value reflect.Value) {
+		current[name] = formatParam(value)
+	})
+
+	var lines []string
+	file, err := os.Open(Properties.CfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	written := make(map[string]bool)
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == rewriteSignature {
+			continue // appended again if needed
+		}
+		if trimmed == "" || trimmed[0] == '#' {
+			result = append(result, line)
+			continue
+		}
+		name := strings.ToLower(strings.Fields(trimmed)[0])
+		value, ok := current[name]
+		if !ok || name == "rename-command" {
+			// each rename-command directive is a pair, it could not be merged like save
+			result = append(result, line)
+			continue
+		}
+		if written[name] || value == "" {
+			continue
+		}
+		written[name] = true
+		result = append(result, formatDirective(name, value))
+	}
+
+	defaults := make(map[string]string)
+	defaultProperties, err := parse(strings.NewReader(""), "")
+	if err != nil {
+		return err
+	}
+	forEachParam(defaultProperties, func(name string, value reflect.Value) {
+		defaults[name] = formatParam(value)
+	})
+	var appended []string
+	for name := range mutableParams {
+		if !written[name] && current[name] != "" && current[name] != defaults[name] {
+			appended = append(appended, formatDirective(name, current[name]))
+		}
+	}
+	if len(appended) > 0 {
+		sort.Strings(appended)
+		result = append(result, rewriteSignature)
+		result = append(result, appended...)
+	}
+
+	tmpFile := Properties.CfPath + ".tmp"
+	content := strings.Join(result, "\n") + "\n"
+	if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, Properties.CfPath)
+}
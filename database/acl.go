@@ -0,0 +1,495 @@
+package database
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/wildcard"
+	"goRedisPlus/redis/protocol"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ACL (access control list):
+// A user is described by rules like `ACL SETUSER` and the aclfile take, such as `on >password ~cached:* +@read -keys`.
+// Command rules are kept in order and the last one matching a command decides whether it is permitted,
+// so `+@all -flushall` permits everything except FlushAll, see acl_category.go for categories.
+// Keys and channels accessed by a command must match one of the patterns of the user.
+// Connections act as the user authenticated by AUTH or HELLO, or the default user before authentication.
+// The default user is initialized by requirepass and is `nopass` if requirepass is empty.
+// Users are immutable once stored, ACL SETUSER stores a modified copy, so checking permission needs no lock of user.
+// Passwords are kept as SHA-256 hashes, rules and requirepass accept hashes like `#<64 hex digits>` instead of
+// plaintext, so that plaintext needs not to be written in redis.conf or aclfile.
+
+const defaultUser = "default"
+
+type aclPattern struct {
+	src     string
+	pattern *wildcard.Pattern
+}
+
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string // SHA-256 hashes in hex
+	cmdRules  []string // such as +@all, -flushall and +client|list
+	keys      []*aclPattern
+	channels  []*aclPattern
+}
+
+type aclStore struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+}
+
+var acl = &aclStore{
+	users: map[string]*aclUser{
+		defaultUser: makeDefaultUser(""),
+	},
+}
+
+// hashPassword returns SHA-256 hash of password in hex
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsPasswordHash returns whether s is a hashed password like `#<64 hex digits>`
+func IsPasswordHash(s string) bool {
+	if len(s) != 1+2*sha256.Size || s[0] != '#' {
+		return false
+	}
+	_, err := hex.DecodeString(s[1:])
+	return err == nil
+}
+
+// makeDefaultUser returns the default user permitted to do anything, it has no password if requirePass is empty
+// requirePass may be plaintext or hashed, see IsPasswordHash
+func makeDefaultUser(requirePass string) *aclUser {
+	user := &aclUser{
+		name:     defaultUser,
+		enabled:  true,
+		nopass:   requirePass == "",
+		cmdRules: []string{"+@all"},
+		keys:     []*aclPattern{mustCompileACLPattern("*")},
+		channels: []*aclPattern{mustCompileACLPattern("*")},
+	}
+	if IsPasswordHash(requirePass) {
+		user.passwords = []string{strings.ToLower(requirePass[1:])}
+	} else if requirePass != "" {
+		user.passwords = []string{hashPassword(requirePass)}
+	}
+	return user
+}
+
+// makeACLUser returns a new user which is disabled and permitted nothing
+func makeACLUser(name string) *aclUser {
+	return &aclUser{
+		name:     name,
+		cmdRules: []string{"-@all"},
+	}
+}
+
+func mustCompileACLPattern(src string) *aclPattern {
+	pattern, err := wildcard.CompilePattern(src)
+	if err != nil {
+		panic(err)
+	}
+	return &aclPattern{src: src, pattern: pattern}
+}
+
+func (store *aclStore) getUser(name string) *aclUser {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.users[name]
+}
+
+func (store *aclStore) setUser(user *aclUser) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.users[user.name] = user
+}
+
+// setRequirePass replaces passwords of the default user by requirepass, see CONFIG SET requirepass
+func (store *aclStore) setRequirePass(requirePass string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	user := store.users[defaultUser].clone()
+	user.nopass = requirePass == ""
+	user.passwords = makeDefaultUser(requirePass).passwords
+	store.users[defaultUser] = user
+}
+
+func (store *aclStore) listUsers() []*aclUser {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	users := make([]*aclUser, 0, len(store.users))
+	for _, user := range store.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].name < users[j].name
+	})
+	return users
+}
+
+func (user *aclUser) clone() *aclUser {
+	return &aclUser{
+		name:      user.name,
+		enabled:   user.enabled,
+		nopass:    user.nopass,
+		passwords: append([]string{}, user.passwords...),
+		cmdRules:  append([]string{}, user.cmdRules...),
+		keys:      append([]*aclPattern{}, user.keys...),
+		channels:  append([]*aclPattern{}, user.channels...),
+	}
+}
+
+// applyRule modifies user by a rule of ACL SETUSER
+func (user *aclUser) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		user.enabled = true
+		return nil
+	case "off":
+		user.enabled = false
+		return nil
+	case "nopass":
+		user.nopass = true
+		user.passwords = nil
+		return nil
+	case "resetpass":
+		user.nopass = false
+		user.passwords = nil
+		return nil
+	case "allkeys":
+		return user.applyRule("~*")
+	case "resetkeys":
+		user.keys = nil
+		return nil
+	case "allchannels":
+		return user.applyRule("&*")
+	case "resetchannels":
+		user.channels = nil
+		return nil
+	case "allcommands":
+		return user.applyRule("+@all")
+	case "nocommands":
+		return user.applyRule("-@all")
+	case "reset":
+		*user = *makeACLUser(user.name)
+		return nil
+	}
+	if rule == "" {
+		return errors.New("empty rule")
+	}
+	switch rule[0] {
+	case '>':
+		user.addPasswordHash(hashPassword(rule[1:]))
+	case '#':
+		if !IsPasswordHash(rule) {
+			return errors.New("the password hash must be exactly 64 hexadecimal characters")
+		}
+		user.addPasswordHash(strings.ToLower(rule[1:]))
+	case '<':
+		return user.removePasswordHash(hashPassword(rule[1:]))
+	case '!':
+		return user.removePasswordHash(strings.ToLower(rule[1:]))
+	case '~':
+		pattern, err := wildcard.CompilePattern(rule[1:])
+		if err != nil {
+			return err
+		}
+		user.keys = append(user.keys, &aclPattern{src: rule[1:], pattern: pattern})
+	case '&':
+		pattern, err := wildcard.CompilePattern(rule[1:])
+		if err != nil {
+			return err
+		}
+		user.channels = append(user.channels, &aclPattern{src: rule[1:], pattern: pattern})
+	case '+', '-':
+		target := strings.ToLower(rule[1:])
+		if target == "" {
+			return errors.New("empty command name")
+		}
+		// names of commands are not validated, commands of cluster are unknown here
+		if strings.HasPrefix(target, "@") {
+			if _, ok := aclCategories[target[1:]]; !ok {
+				return errors.New("unknown command category")
+			}
+		}
+		rule = rule[:1] + target
+		if target == "@all" {
+			// previous rules make no difference
+			user.cmdRules = []string{rule}
+		} else {
+			user.cmdRules = append(user.cmdRules, rule)
+		}
+	default:
+		return errors.New("syntax error")
+	}
+	return nil
+}
+
+func (user *aclUser) addPasswordHash(hash string) {
+	user.nopass = false
+	for _, p := range user.passwords {
+		if p == hash {
+			return
+		}
+	}
+	user.passwords = append(user.passwords, hash)
+}
+
+func (user *aclUser) removePasswordHash(hash string) error {
+	for i, p := range user.passwords {
+		if p == hash {
+			user.passwords = append(user.passwords[:i], user.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("no such password")
+}
+
+// describe returns rules which could rebuild a reset user, like a line of ACL LIST without `user <name>`
+func (user *aclUser) describe() string {
+	parts := make([]string, 0, 4+len(user.passwords)+len(user.keys)+len(user.channels)+len(user.cmdRules))
+	if user.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if user.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, hash := range user.passwords {
+		parts = append(parts, "#"+hash)
+	}
+	for _, key := range user.keys {
+		parts = append(parts, "~"+key.src)
+	}
+	for _, channel := range user.channels {
+		parts = append(parts, "&"+channel.src)
+	}
+	parts = append(parts, user.cmdRules...)
+	return strings.Join(parts, " ")
+}
+
+// checkPassword compares hashes in constant time, so time taken reveals nothing about passwords
+func (user *aclUser) checkPassword(password string) bool {
+	if user.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(password))
+	matched := false
+	for _, p := range user.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(p)) == 1 {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// canRun returns whether user is permitted to run the command, subName is the lower case first argument
+func (user *aclUser) canRun(cmdName string, subName string) bool {
+	permitted := false
+	for _, rule := range user.cmdRules {
+		if matchCmdRule(rule[1:], cmdName, subName) {
+			permitted = rule[0] == '+'
+		}
+	}
+	return permitted
+}
+
+// matchCmdRule returns whether target of rule, such as @read, get or client|list, covers the command
+func matchCmdRule(target string, cmdName string, subName string) bool {
+	if strings.HasPrefix(target, "@") {
+		return inACLCategory(target[1:], cmdName)
+	}
+	if i := strings.IndexByte(target, '|'); i >= 0 {
+		return target[:i] == cmdName && target[i+1:] == subName
+	}
+	return target == cmdName
+}
+
+func matchACLPatterns(patterns []*aclPattern, s string) bool {
+	for _, p := range patterns {
+		if p.pattern.IsMatch(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCmdChannels returns channels accessed by pub/sub command
+func getCmdChannels(cmdName string, cmdLine [][]byte) []string {
+	var args [][]byte
+	switch cmdName {
+	case "publish":
+		if len(cmdLine) > 1 {
+			args = cmdLine[1:2]
+		}
+	case "subscribe":
+		args = cmdLine[1:]
+	}
+	channels := make([]string, len(args))
+	for i, arg := range args {
+		channels[i] = string(arg)
+	}
+	return channels
+}
+
+// checkPermission returns NOPERM error if user is not permitted to run the command
+func (user *aclUser) checkPermission(cmdLine [][]byte) protocol.ErrorReply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	subName := ""
+	if len(cmdLine) > 1 {
+		subName = strings.ToLower(string(cmdLine[1]))
+	}
+	if !user.canRun(cmdName, subName) {
+		return protocol.MakeErrReply(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", user.name, cmdName))
+	}
+	writeKeys, readKeys := GetRelatedKeys(cmdLine)
+	for _, keys := range [][]string{writeKeys, readKeys} {
+		for _, key := range keys {
+			if !matchACLPatterns(user.keys, key) {
+				return protocol.MakeErrReply("NOPERM No permissions to access a key")
+			}
+		}
+	}
+	for _, channel := range getCmdChannels(cmdName, cmdLine) {
+		if !matchACLPatterns(user.channels, channel) {
+			return protocol.MakeErrReply("NOPERM No permissions to access a channel")
+		}
+	}
+	return nil
+}
+
+// getConnUser returns user of the connection, or nil if the user has been deleted
+func getConnUser(c redis.Connection) *aclUser {
+	if c == nil || c.GetUser() == "" {
+		return acl.getUser(defaultUser)
+	}
+	return acl.getUser(c.GetUser())
+}
+
+// DefaultUserNoPass returns whether the default user needs no password, see protected-mode
+func DefaultUserNoPass() bool {
+	user := acl.getUser(defaultUser)
+	return user != nil && user.nopass
+}
+
+// CheckPermission returns NOPERM error if user of connection is not permitted to run the command
+func CheckPermission(c redis.Connection, cmdLine [][]byte) protocol.ErrorReply {
+	if c == nil || isFakeConn(c) || c.IsMaster() {
+		// internal connections and replication stream
+		return nil
+	}
+	user := getConnUser(c)
+	if user == nil {
+		return protocol.MakeErrReply("NOPERM User has been deleted")
+	}
+	if errReply := user.checkPermission(cmdLine); errReply != nil {
+		return errReply
+	}
+	return nil
+}
+
+// parseACLLine parses a line of aclfile, like `user alice on >password ~* +@all`
+func parseACLLine(line string) (*aclUser, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "user" {
+		return nil, errors.New("line should start with 'user <name>'")
+	}
+	user := makeACLUser(fields[1])
+	for _, rule := range fields[2:] {
+		if err := user.applyRule(rule); err != nil {
+			return nil, fmt.Errorf("error in rule '%s': %v", rule, err)
+		}
+	}
+	return user, nil
+}
+
+// loadACLFile reads users from aclfile, the default user is made by requirepass if it is absent
+func loadACLFile(filename string) (map[string]*aclUser, error) {
+	users := map[string]*aclUser{
+		defaultUser: makeDefaultUser(config.Properties.RequirePass),
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, err := parseACLLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNo, err)
+		}
+		users[user.name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// saveACLFile writes all users to aclfile
+func (store *aclStore) saveACLFile(filename string) error {
+	var sb strings.Builder
+	for _, user := range store.listUsers() {
+		sb.WriteString("user " + user.name + " " + user.describe() + "\n")
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), "tmp-acl-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.WriteString(sb.String())
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	_ = tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// initACL loads users from aclfile, or makes the default user by requirepass
+func initACL() error {
+	users := map[string]*aclUser{
+		defaultUser: makeDefaultUser(config.Properties.RequirePass),
+	}
+	if config.Properties.AclFile != "" {
+		var err error
+		users, err = loadACLFile(config.Properties.AclFile)
+		if err != nil {
+			return err
+		}
+	}
+	acl.mu.Lock()
+	acl.users = users
+	acl.mu.Unlock()
+	return nil
+}
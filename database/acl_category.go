@@ -0,0 +1,127 @@
+package database
+
+import "sort"
+
+// aclCategories maps categories to their commands, nil means the category is derived from flags declared by commands
+var aclCategories = map[string][]string{
+	"all":       nil,
+	"read":      nil,
+	"write":     nil,
+	"fast":      nil,
+	"slow":      nil,
+	"admin":     nil,
+	"pubsub":    nil,
+	"blocking":  nil,
+	"dangerous": {"acl", "config", "flushall", "flushdb", "keys", "debug", "save", "bgsave", "shutdown", "latency", "bigkeys", "hotkeys", "bgrewriteaof", "rewriteaof", "psync", "replconf", "slaveof", "replicaof", "failover", "info", "role"},
+	"keyspace": {"del", "unlink", "expire", "expireat", "expiretime", "pexpire", "pexpireat", "pexpiretime", "ttl", "pttl", "persist",
+		"exists", "type", "rename", "renamenx", "keys", "dbsize", "scan", "randomkey", "dump", "restore", "copy", "object", "flushall", "flushdb", "select"},
+	"string": {"set", "setnx", "setex", "psetex", "mset", "mget", "msetnx", "get", "getex", "getset", "getdel", "incr", "incrby",
+		"incrbyfloat", "decr", "decrby", "strlen", "append", "setrange", "getrange"},
+	"bitmap": {"setbit", "getbit", "bitcount", "bitpos"},
+	"hash": {"hset", "hsetnx", "hget", "hexists", "hdel", "hlen", "hstrlen", "hmset", "hmget", "hkeys", "hvals", "hgetall",
+		"hincrby", "hincrbyfloat", "hrandfield", "hscan"},
+	"list": {"lpush", "lpushx", "rpush", "rpushx", "lpop", "rpop", "rpoplpush", "lrem", "llen", "lindex", "lset", "lrange",
+		"ltrim", "linsert"},
+	"set": {"sadd", "sismember", "srem", "spop", "scard", "smembers", "sinter", "sinterstore", "sunion", "sunionstore",
+		"sdiff", "sdiffstore", "srandmember", "sscan"},
+	"sortedset": {"zadd", "zscore", "zincrby", "zrank", "zcount", "zrevrank", "zcard", "zrange", "zrangebyscore", "zrevrange",
+		"zrevrangebyscore", "zpopmin", "zrem", "zremrangebyscore", "zremrangebyrank", "zlexcount", "zrangebylex",
+		"zremrangebylex", "zrevrangebylex", "zscan"},
+	"connection":  {"auth", "hello", "ping", "select", "command", "client"},
+	"transaction": {"multi", "exec", "discard", "watch", "unwatch"},
+}
+
+// aclCategoryIndex is category -> command set, built from aclCategories
+var aclCategoryIndex map[string]map[string]struct{}
+
+func init() {
+	aclCategoryIndex = make(map[string]map[string]struct{}, len(aclCategories))
+	for category, cmdNames := range aclCategories {
+		set := make(map[string]struct{}, len(cmdNames))
+		for _, name := range cmdNames {
+			set[name] = struct{}{}
+		}
+		aclCategoryIndex[category] = set
+	}
+}
+
+// inACLCategory returns whether the command belongs to the category
+func inACLCategory(category string, cmdName string) bool {
+	switch category {
+	case "all":
+		return true
+	case "read":
+		return isReadOnlyCommand(cmdName)
+	case "write":
+		return isWriteCommand(cmdName)
+	case "fast":
+		return hasRedisFlag(cmdName, redisFlagFast)
+	case "slow":
+		return !hasRedisFlag(cmdName, redisFlagFast)
+	case "admin":
+		return hasRedisFlag(cmdName, redisFlagAdmin)
+	case "pubsub":
+		return hasRedisFlag(cmdName, redisFlagPubSub)
+	case "blocking":
+		return hasRedisFlag(cmdName, redisFlagBlocking)
+	}
+	_, ok := aclCategoryIndex[category][cmdName]
+	return ok
+}
+
+// sortedACLCategories returns names of all categories in alphabetical order
+func sortedACLCategories() []string {
+	categories := make([]string, 0, len(aclCategories))
+	for category := range aclCategories {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// commandGroups maps categories to groups of COMMAND DOCS, commands belong to the first matched one
+var commandGroups = []struct {
+	category string
+	group    string
+}{
+	{"string", "string"},
+	{"bitmap", "bitmap"},
+	{"hash", "hash"},
+	{"list", "list"},
+	{"set", "set"},
+	{"sortedset", "sorted-set"},
+	{"pubsub", "pubsub"},
+	{"transaction", "transactions"},
+	{"connection", "connection"},
+	{"admin", "server"},
+	{"keyspace", "generic"},
+}
+
+// commandGroup returns group of the command in COMMAND DOCS
+func commandGroup(cmdName string) string {
+	for _, g := range commandGroups {
+		if inACLCategory(g.category, cmdName) {
+			return g.group
+		}
+	}
+	return "server"
+}
+
+// getACLCategoryCommands returns known commands in the category, for ACL CAT
+func getACLCategoryCommands(category string) []string {
+	names := make(map[string]struct{})
+	for name := range cmdTable {
+		if inACLCategory(category, name) {
+			names[name] = struct{}{}
+		}
+	}
+	for _, name := range aclCategories[category] {
+		names[name] = struct{}{}
+	}
+	result := make([]string, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,227 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+var errNoACLFile = protocol.MakeErrReply("ERR This instance is not configured to use an ACL file, see aclfile")
+
+// execACL executes ACL subcommands, command line: acl <subcommand> args...
+func execACL(c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("acl")
+	}
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "setuser":
+		if len(args) < 1 {
+			return protocol.MakeArgNumErrReply("acl|setuser")
+		}
+		return execACLSetUser(args)
+	case "getuser":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("acl|getuser")
+		}
+		return execACLGetUser(string(args[0]))
+	case "deluser":
+		if len(args) < 1 {
+			return protocol.MakeArgNumErrReply("acl|deluser")
+		}
+		return execACLDelUser(args)
+	case "list":
+		users := acl.listUsers()
+		result := make([][]byte, len(users))
+		for i, user := range users {
+			result[i] = []byte("user " + user.name + " " + user.describe())
+		}
+		return protocol.MakeMultiBulkReply(result)
+	case "users":
+		users := acl.listUsers()
+		result := make([][]byte, len(users))
+		for i, user := range users {
+			result[i] = []byte(user.name)
+		}
+		return protocol.MakeMultiBulkReply(result)
+	case "whoami":
+		user := getConnUser(c)
+		if user == nil {
+			return protocol.MakeNullBulkReply()
+		}
+		return protocol.MakeBulkReply([]byte(user.name))
+	case "cat":
+		if len(args) > 1 {
+			return protocol.MakeArgNumErrReply("acl|cat")
+		}
+		return execACLCat(args)
+	case "genpass":
+		if len(args) > 1 {
+			return protocol.MakeArgNumErrReply("acl|genpass")
+		}
+		return execACLGenPass(args)
+	case "save":
+		if config.Properties.AclFile == "" {
+			return errNoACLFile
+		}
+		if err := acl.saveACLFile(config.Properties.AclFile); err != nil {
+			return protocol.MakeErrReply("ERR There was an error trying to save the ACLs: " + err.Error())
+		}
+		return protocol.MakeOkReply()
+	case "load":
+		if config.Properties.AclFile == "" {
+			return errNoACLFile
+		}
+		users, err := loadACLFile(config.Properties.AclFile)
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		acl.mu.Lock()
+		acl.users = users
+		acl.mu.Unlock()
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try ACL HELP.")
+}
+
+// execACLSetUser creates or modifies user, command line: acl setuser name rules...
+func execACLSetUser(args [][]byte) redis.Reply {
+	name := string(args[0])
+	var user *aclUser
+	if existed := acl.getUser(name); existed != nil {
+		user = existed.clone()
+	} else {
+		user = makeACLUser(name)
+	}
+	for _, arg := range args[1:] {
+		if err := user.applyRule(string(arg)); err != nil {
+			return protocol.MakeErrReply(fmt.Sprintf("ERR Error in ACL SETUSER modifier '%s': %v", string(arg), err))
+		}
+	}
+	acl.setUser(user)
+	return protocol.MakeOkReply()
+}
+
+func execACLGetUser(name string) redis.Reply {
+	user := acl.getUser(name)
+	if user == nil {
+		return protocol.MakeNullBulkReply()
+	}
+	flags := make([][]byte, 0, 5)
+	if user.enabled {
+		flags = append(flags, []byte("on"))
+	} else {
+		flags = append(flags, []byte("off"))
+	}
+	if user.nopass {
+		flags = append(flags, []byte("nopass"))
+	}
+	if hasMatchAllPattern(user.keys) {
+		flags = append(flags, []byte("allkeys"))
+	}
+	if hasMatchAllPattern(user.channels) {
+		flags = append(flags, []byte("allchannels"))
+	}
+	if len(user.cmdRules) == 1 && user.cmdRules[0] == "+@all" {
+		flags = append(flags, []byte("allcommands"))
+	}
+	passwords := make([][]byte, len(user.passwords))
+	for i, password := range user.passwords {
+		passwords[i] = []byte(password)
+	}
+	keys := make([]string, len(user.keys))
+	for i, key := range user.keys {
+		keys[i] = "~" + key.src
+	}
+	channels := make([]string, len(user.channels))
+	for i, channel := range user.channels {
+		channels[i] = "&" + channel.src
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("flags")),
+		protocol.MakeMultiBulkReply(flags),
+		protocol.MakeBulkReply([]byte("passwords")),
+		protocol.MakeMultiBulkReply(passwords),
+		protocol.MakeBulkReply([]byte("commands")),
+		protocol.MakeBulkReply([]byte(strings.Join(user.cmdRules, " "))),
+		protocol.MakeBulkReply([]byte("keys")),
+		protocol.MakeBulkReply([]byte(strings.Join(keys, " "))),
+		protocol.MakeBulkReply([]byte("channels")),
+		protocol.MakeBulkReply([]byte(strings.Join(channels, " "))),
+	})
+}
+
+func hasMatchAllPattern(patterns []*aclPattern) bool {
+	for _, p := range patterns {
+		if p.src == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func execACLDelUser(args [][]byte) redis.Reply {
+	for _, arg := range args {
+		if string(arg) == defaultUser {
+			return protocol.MakeErrReply("ERR The 'default' user cannot be removed")
+		}
+	}
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	deleted := 0
+	for _, arg := range args {
+		if _, ok := acl.users[string(arg)]; ok {
+			delete(acl.users, string(arg))
+			deleted++
+		}
+	}
+	return protocol.MakeIntReply(int64(deleted))
+}
+
+const defaultGenPassBits = 256
+
+// execACLGenPass generates a random password in hex, command line: acl genpass [bits]
+func execACLGenPass(args [][]byte) redis.Reply {
+	bits := defaultGenPassBits
+	if len(args) == 1 {
+		var err error
+		bits, err = strconv.Atoi(string(args[0]))
+		if err != nil || bits <= 0 || bits > 4096 {
+			return protocol.MakeErrReply("ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096")
+		}
+	}
+	chars := (bits + 3) / 4 // each hex digit carries 4 bits
+	buf := make([]byte, (chars+1)/2)
+	if _, err := rand.Read(buf); err != nil {
+		return protocol.MakeErrReply("ERR generate password failed: " + err.Error())
+	}
+	return protocol.MakeBulkReply([]byte(hex.EncodeToString(buf)[:chars]))
+}
+
+// execACLCat lists categories, or commands in the given category
+func execACLCat(args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		categories := sortedACLCategories()
+		result := make([][]byte, len(categories))
+		for i, category := range categories {
+			result[i] = []byte(category)
+		}
+		return protocol.MakeMultiBulkReply(result)
+	}
+	category := strings.ToLower(string(args[0]))
+	if _, ok := aclCategories[category]; !ok {
+		return protocol.MakeErrReply("ERR Unknown category '" + category + "'")
+	}
+	names := getACLCategoryCommands(category)
+	result := make([][]byte, len(names))
+	for i, name := range names {
+		result[i] = []byte(name)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"goRedisPlus/datastruct/dict"
+	"goRedisPlus/datastruct/list"
+	"goRedisPlus/datastruct/set"
+	"goRedisPlus/datastruct/sortedset"
+	"goRedisPlus/datastruct/strobj"
+	"goRedisPlus/interface/database"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Big keys:
+// BIGKEYS scans all databases like SCAN and estimates every key like MEMORY USAGE. Keys are locked one by one while
+// being estimated, and the scanner yields between batches, so other commands are never blocked longer than
+// estimating a key. Unlike redis-cli --bigkeys it ranks keys by bytes rather than by length, and SAMPLES 0 estimates
+// all elements of collections accurately.
+
+const (
+	defaultBigKeysCount = 10
+	bigKeysScanBatch    = 1000
+)
+
+// bigKeysTypes lists types in reply order
+var bigKeysTypes = []string{"string", "list", "hash", "set", "zset"}
+
+type bigKey struct {
+	dbIndex int
+	key     string
+	size    int64
+	length  int64
+}
+
+// bigKeysSummary summarizes keys of a type, top is sorted by size in descending order
+type bigKeysSummary struct {
+	keys   int64
+	bytes  int64
+	length int64
+	top    []*bigKey
+}
+
+func (summary *bigKeysSummary) add(key *bigKey, count int) {
+	summary.keys++
+	summary.bytes += key.size
+	summary.length += key.length
+	if len(summary.top) >= count && key.size <= summary.top[len(summary.top)-1].size {
+		return
+	}
+	i := sort.Search(len(summary.top), func(i int) bool {
+		return summary.top[i].size < key.size
+	})
+	summary.top = append(summary.top, nil)
+	copy(summary.top[i+1:], summary.top[i:])
+	summary.top[i] = key
+	if len(summary.top) > count {
+		summary.top = summary.top[:count]
+	}
+}
+
+// getEntityLength returns bytes of string or number of elements of collection
+func getEntityLength(entity *database.DataEntity) int64 {
+	switch val := entity.Data.(type) {
+	case []byte, strobj.Int, strobj.Embedded:
+		return int64(strobj.Len(val))
+	case list.List:
+		return int64(val.Len())
+	case dict.Dict:
+		return int64(val.Len())
+	case *set.Set:
+		return int64(val.Len())
+	case *sortedset.SortedSet:
+		return val.Len()
+	}
+	return 0
+}
+
+// execBigKeys reports the biggest keys of each type in all databases,
+// command line: bigkeys [COUNT count] [SAMPLES count] [TYPE type]
+func (server *Server) execBigKeys(args [][]byte) redis.Reply {
+	count := defaultBigKeysCount
+	samples := defaultMemoryUsageSamples
+	typeFilter := ""
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return protocol.MakeSyntaxErrReply()
+		}
+		value := string(args[i+1])
+		switch strings.ToLower(string(args[i])) {
+		case "count":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if n < 1 {
+				return protocol.MakeSyntaxErrReply()
+			}
+			count = n
+		case "samples":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if n < 0 {
+				return protocol.MakeSyntaxErrReply()
+			}
+			samples = n
+			if samples == 0 {
+				samples = math.MaxInt32
+			}
+		case "type":
+			typeFilter = strings.ToLower(value)
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	summaries := make(map[string]*bigKeysSummary)
+	for _, typeName := range bigKeysTypes {
+		summaries[typeName] = &bigKeysSummary{}
+	}
+	for i := range server.dbSet {
+		server.mustSelectDB(i).scanBigKeys(func(key string, entity *database.DataEntity) {
+			typeName := getTypeName(entity)
+			summary := summaries[typeName]
+			if summary == nil || (typeFilter != "" && typeFilter != typeName) {
+				return
+			}
+			summary.add(&bigKey{
+				dbIndex: i,
+				key:     key,
+				size:    estimateEntitySize(key, entity, samples),
+				length:  getEntityLength(entity),
+			}, count)
+		})
+	}
+
+	var result []redis.Reply
+	for _, typeName := range bigKeysTypes {
+		if typeFilter != "" && typeFilter != typeName {
+			continue
+		}
+		result = append(result, protocol.MakeBulkReply([]byte(typeName)), summaries[typeName].toReply())
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+func (summary *bigKeysSummary) toReply() redis.Reply {
+	var avgBytes int64
+	if summary.keys > 0 {
+		avgBytes = summary.bytes / summary.keys
+	}
+	top := make([]redis.Reply, 0, len(summary.top))
+	for _, key := range summary.top {
+		top = append(top, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("db")),
+			protocol.MakeIntReply(int64(key.dbIndex)),
+			protocol.MakeBulkReply([]byte("key")),
+			protocol.MakeBulkReply([]byte(key.key)),
+			protocol.MakeBulkReply([]byte("bytes")),
+			protocol.MakeIntReply(key.size),
+			protocol.MakeBulkReply([]byte("length")),
+			protocol.MakeIntReply(key.length),
+		}))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("keys")),
+		protocol.MakeIntReply(summary.keys),
+		protocol.MakeBulkReply([]byte("bytes")),
+		protocol.MakeIntReply(summary.bytes),
+		protocol.MakeBulkReply([]byte("avg-bytes")),
+		protocol.MakeIntReply(avgBytes),
+		protocol.MakeBulkReply([]byte("length")),
+		protocol.MakeIntReply(summary.length),
+		protocol.MakeBulkReply([]byte("biggest")),
+		protocol.MakeMultiRawReply(top),
+	})
+}
+
+// scanBigKeys visits living keys of db in batches, consumer is invoked with the lock of key
+func (db *DB) scanBigKeys(consumer func(key string, entity *database.DataEntity)) {
+	cursor := 0
+	for {
+		if db.data.Len() == 0 {
+			return // scanning an empty dict traverses all of its shards
+		}
+		var keys []string
+		keys, cursor = db.data.DictScan(cursor, bigKeysScanBatch, nil)
+		for _, key := range keys {
+			readKeys := []string{key}
+			db.RWLocks(nil, readKeys)
+			if entity, exists := db.lookupEntity(key); exists {
+				consumer(key, entity)
+			}
+			db.RWUnLocks(nil, readKeys)
+		}
+		if cursor == 0 {
+			return
+		}
+		runtime.Gosched() // let other commands run between batches
+	}
+}
@@ -0,0 +1,332 @@
+package database
+
+import (
+	"fmt"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execClient executes CLIENT subcommands, command line: client list|id|setname|getname|info|kill|pause|unpause|reply|no-evict args...
+func (server *Server) execClient(c redis.Connection, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "list":
+		return execClientList(args)
+	case "id":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|id")
+		}
+		return protocol.MakeIntReply(int64(c.GetID()))
+	case "setname":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("client|setname")
+		}
+		name := string(args[0])
+		for i := 0; i < len(name); i++ {
+			if name[i] < '!' || name[i] > '~' {
+				return protocol.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+		}
+		c.SetClientName(name)
+		return protocol.MakeOkReply()
+	case "getname":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|getname")
+		}
+		name := c.GetClientName()
+		if name == "" {
+			return protocol.MakeNullBulkReply()
+		}
+		return protocol.MakeBulkReply([]byte(name))
+	case "kill":
+		if len(args) == 0 {
+			return protocol.MakeArgNumErrReply("client|kill")
+		}
+		return execClientKill(c, args)
+	case "pause":
+		if len(args) != 1 && len(args) != 2 {
+			return protocol.MakeArgNumErrReply("client|pause")
+		}
+		timeout, err := strconv.ParseInt(string(args[0]), 10, 64)
+		if err != nil || timeout < 0 {
+			return protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+		}
+		all := true
+		if len(args) == 2 {
+			switch strings.ToLower(string(args[1])) {
+			case "write":
+				all = false
+			case "all":
+			default:
+				return protocol.MakeSyntaxErrReply()
+			}
+		}
+		pauseClients(time.Duration(timeout)*time.Millisecond, all)
+		// data set must not change once replied
+		server.drainWrites()
+		return protocol.MakeOkReply()
+	case "unpause":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|unpause")
+		}
+		unpauseClients()
+		return protocol.MakeOkReply()
+	case "reply":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("client|reply")
+		}
+		switch strings.ToLower(string(args[0])) {
+		case "on":
+			c.SetReplyMode(redis.ReplyOn)
+			return protocol.MakeOkReply()
+		case "off":
+			c.SetReplyMode(redis.ReplyOff)
+		case "skip":
+			c.SetReplyMode(redis.ReplySkip)
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+		return &protocol.NoReply{}
+	case "no-evict":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("client|no-evict")
+		}
+		switch strings.ToLower(string(args[0])) {
+		case "on":
+			c.SetNoEvict(true)
+		case "off":
+			c.SetNoEvict(false)
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+		return protocol.MakeOkReply()
+	case "info":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("client|info")
+		}
+		conn, ok := c.(*connection.Connection)
+		if !ok {
+			return protocol.MakeBulkReply([]byte("id=0 addr= laddr= name= flags=N\n"))
+		}
+		return protocol.MakeBulkReply([]byte(describeClient(conn) + "\n"))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CLIENT HELP.")
+}
+
+// execClientList describes connections line by line, command line: client list [TYPE type] [ID id [id ...]]
+func execClientList(args [][]byte) redis.Reply {
+	clientType := ""
+	var ids map[uint64]struct{}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "type":
+			if i+1 >= len(args) {
+				return protocol.MakeSyntaxErrReply()
+			}
+			i++
+			clientType = strings.ToLower(string(args[i]))
+			if clientType == "slave" {
+				clientType = "replica"
+			}
+			if clientType != "normal" && clientType != "master" && clientType != "replica" && clientType != "pubsub" {
+				return protocol.MakeErrReply("ERR Unknown client type '" + string(args[i]) + "'")
+			}
+		case "id":
+			if i+1 >= len(args) {
+				return protocol.MakeSyntaxErrReply()
+			}
+			ids = make(map[uint64]struct{})
+			for i++; i < len(args); i++ {
+				id, err := strconv.ParseUint(string(args[i]), 10, 64)
+				if err != nil || id == 0 {
+					return protocol.MakeErrReply("ERR Invalid client ID")
+				}
+				ids[id] = struct{}{}
+			}
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	var b strings.Builder
+	connection.ForEach(func(conn *connection.Connection) bool {
+		if clientType != "" && getClientType(conn) != clientType {
+			return true
+		}
+		if ids != nil {
+			if _, ok := ids[conn.GetID()]; !ok {
+				return true
+			}
+		}
+		b.WriteString(describeClient(conn))
+		b.WriteByte('\n')
+		return true
+	})
+	return protocol.MakeBulkReply([]byte(b.String()))
+}
+
+// clientFilter matches connections by filters of CLIENT KILL, zero values match any connection
+type clientFilter struct {
+	id         uint64
+	addr       string
+	laddr      string
+	clientType string
+	user       string
+	maxAge     int64 // seconds
+	skipMe     bool
+}
+
+func (f *clientFilter) match(conn *connection.Connection, self uint64) bool {
+	return (f.id == 0 || conn.GetID() == f.id) &&
+		(f.addr == "" || conn.RemoteAddr() == f.addr) &&
+		(f.laddr == "" || conn.LocalAddr() == f.laddr) &&
+		(f.clientType == "" || getClientType(conn) == f.clientType) &&
+		(f.user == "" || conn.GetUser() == f.user || (conn.GetUser() == "" && f.user == defaultUser)) &&
+		(f.maxAge == 0 || int64(conn.Age().Seconds()) >= f.maxAge) &&
+		(!f.skipMe || conn.GetID() != self)
+}
+
+// execClientKill closes connections asynchronously, command line:
+// client kill addr:port, it replies OK or error if no such client
+// client kill [ID id] [ADDR addr] [LADDR addr] [TYPE type] [USER user] [MAXAGE seconds] [SKIPME yes|no],
+// it replies number of killed connections
+func execClientKill(c redis.Connection, args [][]byte) redis.Reply {
+	filter := &clientFilter{skipMe: true}
+	oldStyle := len(args) == 1
+	if oldStyle {
+		filter.addr = string(args[0])
+		filter.skipMe = false
+	} else {
+		if len(args)%2 != 0 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		for i := 0; i < len(args); i += 2 {
+			value := string(args[i+1])
+			switch strings.ToLower(string(args[i])) {
+			case "id":
+				id, err := strconv.ParseUint(value, 10, 64)
+				if err != nil || id == 0 {
+					return protocol.MakeErrReply("ERR client-id should be greater than 0")
+				}
+				filter.id = id
+			case "addr":
+				filter.addr = value
+			case "laddr":
+				filter.laddr = value
+			case "type":
+				filter.clientType = strings.ToLower(value)
+				if filter.clientType == "slave" {
+					filter.clientType = "replica"
+				}
+				if filter.clientType != "normal" && filter.clientType != "master" &&
+					filter.clientType != "replica" && filter.clientType != "pubsub" {
+					return protocol.MakeErrReply("ERR Unknown client type '" + value + "'")
+				}
+			case "user":
+				if acl.getUser(value) == nil {
+					return protocol.MakeErrReply("ERR No such user '" + value + "'")
+				}
+				filter.user = value
+			case "maxage":
+				maxAge, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || maxAge <= 0 {
+					return protocol.MakeErrReply("ERR value is out of range")
+				}
+				filter.maxAge = maxAge
+			case "skipme":
+				switch strings.ToLower(value) {
+				case "yes":
+					filter.skipMe = true
+				case "no":
+					filter.skipMe = false
+				default:
+					return protocol.MakeSyntaxErrReply()
+				}
+			default:
+				return protocol.MakeSyntaxErrReply()
+			}
+		}
+	}
+
+	self := c.GetID()
+	var ids []uint64
+	connection.ForEach(func(conn *connection.Connection) bool {
+		if filter.match(conn, self) {
+			ids = append(ids, conn.GetID())
+		}
+		return true
+	})
+	// close asynchronously, CLIENT KILL never waits for connections being closed
+	go func() {
+		for _, id := range ids {
+			connection.Kill(id)
+		}
+	}()
+	if oldStyle {
+		if len(ids) == 0 {
+			return protocol.MakeErrReply("ERR No such client")
+		}
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeIntReply(int64(len(ids)))
+}
+
+// getClientType returns normal, master, replica or pubsub
+func getClientType(conn *connection.Connection) string {
+	if conn.IsMaster() {
+		return "master"
+	}
+	if conn.IsSlave() {
+		return "replica"
+	}
+	if conn.SubsCount() > 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// describeClient formats the connection like a line of CLIENT LIST
+func describeClient(conn *connection.Connection) string {
+	flags := ""
+	if conn.IsMaster() {
+		flags += "M"
+	}
+	if conn.IsSlave() {
+		flags += "S"
+	}
+	if conn.SubsCount() > 0 {
+		flags += "P"
+	}
+	if conn.IsReadOnly() {
+		flags += "r"
+	}
+	if conn.IsNoEvict() {
+		flags += "e"
+	}
+	multi := -1
+	if conn.InMultiState() {
+		flags += "x"
+		multi = len(conn.GetQueuedCmdLine())
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	user := conn.GetUser()
+	if user == "" {
+		user = defaultUser
+	}
+	cmd := conn.GetLastCommand()
+	if cmd == "" {
+		cmd = "NULL"
+	}
+	netInput, netOutput, commands := conn.Traffic()
+	queryBuf, multiMemory := conn.CommandMemory()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=0 multi=%d qbuf=%d multi-mem=%d omem=%d tot-mem=%d tot-net-in=%d tot-net-out=%d tot-cmds=%d user=%s cmd=%s",
+		conn.GetID(), conn.RemoteAddr(), conn.LocalAddr(), conn.GetClientName(), int64(conn.Age().Seconds()),
+		int64(conn.Idle().Seconds()), flags, conn.GetDBIndex(), conn.SubsCount(), multi, queryBuf, multiMemory,
+		conn.PendingOutput(), conn.Memory(), netInput, netOutput, commands, user, cmd)
+}
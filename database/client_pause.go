@@ -0,0 +1,109 @@
+package database
+
+import (
+	"goRedisPlus/interface/redis"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CLIENT PAUSE suspends commands from clients until timeout or CLIENT UNPAUSE, commands from master, internal
+// connections and administrative commands dispatched before data commands, such as CLIENT and CONFIG, go on.
+// In WRITE mode only commands which may modify data are suspended, including EXEC of transactions with writes.
+// The data set must not change during pause in both modes, so expired keys are treated as absent but kept like
+// slaves do, and neither the active expire cycle nor eviction runs, see isWritePaused.
+// Status is published through atomic.Value since every command checks it, and CLIENT PAUSE replies only after
+// writes in progress finished, see Server.enterWrite and Server.drainWrites.
+
+type pauseStatus struct {
+	all   bool // pause all commands or only writes
+	until time.Time
+	done  chan struct{} // closed once the pause ends
+	timer *time.Timer
+}
+
+var clientPause = struct {
+	mu     sync.Mutex   // serializes pause and unpause
+	status atomic.Value // *pauseStatus, nil if not paused
+}{}
+
+func init() {
+	clientPause.status.Store((*pauseStatus)(nil))
+}
+
+// getPause returns current pause, or nil
+func getPause() *pauseStatus {
+	return clientPause.status.Load().(*pauseStatus)
+}
+
+// pauseClients starts or extends pause, the longer duration and the stricter mode win if there is a pause already
+func pauseClients(duration time.Duration, all bool) {
+	clientPause.mu.Lock()
+	defer clientPause.mu.Unlock()
+	until := time.Now().Add(duration)
+	if old := getPause(); old != nil {
+		all = all || old.all
+		if old.until.After(until) {
+			until = old.until
+		}
+		old.timer.Stop()
+		close(old.done) // waiters will wait for the new one
+	}
+	status := &pauseStatus{
+		all:   all,
+		until: until,
+		done:  make(chan struct{}),
+	}
+	status.timer = time.AfterFunc(time.Until(until), func() {
+		clientPause.mu.Lock()
+		defer clientPause.mu.Unlock()
+		if getPause() == status {
+			clientPause.status.Store((*pauseStatus)(nil))
+			close(status.done)
+		}
+	})
+	clientPause.status.Store(status)
+}
+
+// unpauseClients ends pause immediately
+func unpauseClients() {
+	clientPause.mu.Lock()
+	defer clientPause.mu.Unlock()
+	status := getPause()
+	if status == nil {
+		return
+	}
+	status.timer.Stop()
+	clientPause.status.Store((*pauseStatus)(nil))
+	close(status.done)
+}
+
+// isWritePaused returns whether writes are paused by CLIENT PAUSE, in either ALL or WRITE mode
+func isWritePaused() bool {
+	return getPause() != nil
+}
+
+// waitPause blocks until commands like cmdName are not paused
+func waitPause(c redis.Connection, cmdName string) {
+	for {
+		status := getPause()
+		if status == nil || (!status.all && !mayWrite(c, cmdName)) {
+			return
+		}
+		<-status.done
+	}
+}
+
+// mayWrite returns whether the command may modify data, EXEC may write if any queued command is a write
+func mayWrite(c redis.Connection, cmdName string) bool {
+	if cmdName == "exec" && c.InMultiState() {
+		for _, cmdLine := range c.GetQueuedCmdLine() {
+			if isWriteCommand(strings.ToLower(string(cmdLine[0]))) {
+				return true
+			}
+		}
+		return false
+	}
+	return isWriteCommand(cmdName)
+}
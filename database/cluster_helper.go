@@ -49,7 +49,7 @@ func execRenameFrom(db *DB, args [][]byte) redis.Reply {
 }
 
 // execRenameTo accepts result of execDumpKey and load the dumped key
-// args format: key dumpCmd ttlCmd
+// args format: key dumpCmd ttlCmd [replaceFlag], replaceFlag is checked in preparing of cluster copy
 // execRenameTo may be partially successful, do not use it without transaction
 func execRenameTo(db *DB, args [][]byte) redis.Reply {
 	key := args[0]
@@ -94,7 +94,7 @@ func execCopyFrom(db *DB, args [][]byte) redis.Reply {
 }
 
 // execCopyTo accepts result of execDumpKey and load the dumped key
-// args format: key dumpCmd ttlCmd
+// args format: key dumpCmd ttlCmd [replaceFlag], replaceFlag is checked in preparing of cluster copy
 // execCopyTo may be partially successful, do not use it without transaction
 func execCopyTo(db *DB, args [][]byte) redis.Reply {
 	key := args[0]
@@ -135,5 +135,5 @@ func init() {
 	registerCommand("RenameTo", execRenameTo, writeFirstKey, rollbackFirstKey, 4, flagWrite)
 	registerCommand("RenameNxTo", execRenameTo, writeFirstKey, rollbackFirstKey, 4, flagWrite)
 	registerCommand("CopyFrom", execCopyFrom, readFirstKey, nil, 2, flagReadOnly)
-	registerCommand("CopyTo", execCopyTo, writeFirstKey, rollbackFirstKey, 5, flagWrite)
+	registerCommand("CopyTo", execCopyTo, writeFirstKey, rollbackFirstKey, -4, flagWrite)
 }
@@ -3,6 +3,7 @@ package database
 import (
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/redis/protocol"
+	"sort"
 	"strings"
 )
 
@@ -21,17 +22,27 @@ const (
 	redisFlagAsking        = "asking"
 	redisFlagFast          = "fast"
 	redisFlagMovableKeys   = "movablekeys"
+	redisFlagBlocking      = "blocking"
 )
 
+// execCommand executes COMMAND and its subcommands, command line: command [info|count|docs|getkeys args...]
 func execCommand(args [][]byte) redis.Reply {
 	if len(args) == 0 {
 		return getAllGodisCommandReply()
 	}
 	subCommand := strings.ToLower(string(args[0]))
 	if subCommand == "info" {
+		if len(args) == 1 {
+			return getAllGodisCommandReply()
+		}
 		return getCommands(args[1:])
 	} else if subCommand == "count" {
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("command|count")
+		}
 		return protocol.MakeIntReply(int64(len(cmdTable)))
+	} else if subCommand == "docs" {
+		return getCommandDocs(args[1:])
 	} else if subCommand == "getkeys" {
 		if len(args) < 2 {
 			return protocol.MakeErrReply("wrong number of arguments for 'command|" + subCommand + "'")
@@ -42,21 +53,25 @@ func execCommand(args [][]byte) redis.Reply {
 	}
 }
 
+// getKeys extracts keys from a full command line, see COMMAND GETKEYS
 func getKeys(args [][]byte) redis.Reply {
-	cmdName := string(args[0])
+	cmdName := strings.ToLower(string(args[0]))
 	cmd, ok := cmdTable[cmdName]
 	if !ok {
-		return protocol.MakeErrReply("Invalid command specified")
+		return protocol.MakeErrReply("ERR Invalid command specified")
 	}
-	if !validateArity(cmd.arity, args[1:]) {
-		return protocol.MakeArgNumErrReply(cmdName)
+	if !validateArity(cmd.arity, args) {
+		return protocol.MakeErrReply("ERR Invalid number of arguments specified for command")
 	}
-
-	if cmd.prepare == nil {
-		return protocol.MakeErrReply("The command has no key arguments")
+	// keys are returned in order of arguments if their positions are declared
+	keys := cmd.keysByPosition(args)
+	if len(keys) == 0 && cmd.prepare != nil {
+		writeKeys, readKeys := cmd.prepare(args[1:])
+		keys = append(writeKeys, readKeys...)
+	}
+	if len(keys) == 0 {
+		return protocol.MakeErrReply("ERR The command has no key arguments")
 	}
-	writeKeys, readKeys := cmd.prepare(args[1:])
-	keys := append(writeKeys, readKeys...)
 	resp := make([][]byte, len(keys))
 	for i, key := range keys {
 		resp[i] = []byte(key)
@@ -67,7 +82,7 @@ func getKeys(args [][]byte) redis.Reply {
 func getCommands(args [][]byte) redis.Reply {
 	replies := make([]redis.Reply, len(args))
 	for i, v := range args {
-		cmd, ok := cmdTable[string(v)]
+		cmd, ok := cmdTable[strings.ToLower(string(v))]
 		if ok {
 			replies[i] = cmd.toDescReply()
 		} else {
@@ -79,39 +94,110 @@ func getCommands(args [][]byte) redis.Reply {
 
 func getAllGodisCommandReply() redis.Reply {
 	replies := make([]redis.Reply, 0, len(cmdTable))
-	for _, v := range cmdTable {
-		replies = append(replies, v.toDescReply())
+	for _, name := range sortedCommandNames() {
+		replies = append(replies, cmdTable[name].toDescReply())
 	}
 	return protocol.MakeMultiRawReply(replies)
 }
 
+// getCommandDocs returns name and documentation of given commands or all commands, unknown commands are skipped
+func getCommandDocs(args [][]byte) redis.Reply {
+	var names []string
+	if len(args) == 0 {
+		names = sortedCommandNames()
+	} else {
+		for _, arg := range args {
+			name := strings.ToLower(string(arg))
+			if _, ok := cmdTable[name]; ok {
+				names = append(names, name)
+			}
+		}
+	}
+	replies := make([]redis.Reply, 0, 2*len(names))
+	for _, name := range names {
+		replies = append(replies,
+			protocol.MakeBulkReply([]byte(name)),
+			cmdTable[name].toDocReply())
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(cmdTable))
+	for name := range cmdTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func init() {
 	registerSpecialCommand("Command", 0, 0).
 		attachCommandExtra([]string{redisFlagRandom, redisFlagLoading, redisFlagStale}, 0, 0, 0)
-	registerSpecialCommand("Keys", 2, 0).
-		attachCommandExtra([]string{redisFlagReadonly, redisFlagSortForScript}, 0, 0, 0)
-	registerSpecialCommand("Auth", 2, 0).
+	registerSpecialCommand("Ping", -1, 0).
+		attachCommandExtra([]string{redisFlagFast}, 0, 0, 0)
+	registerSpecialCommand("Auth", -2, 0).
 		attachCommandExtra([]string{redisFlagNoScript, redisFlagLoading, redisFlagStale, redisFlagSkipMonitor, redisFlagFast}, 0, 0, 0)
+	registerSpecialCommand("Hello", -1, 0).
+		attachCommandExtra([]string{redisFlagNoScript, redisFlagLoading, redisFlagStale, redisFlagSkipMonitor, redisFlagFast}, 0, 0, 0)
+	registerSpecialCommand("Acl", -2, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
+	registerSpecialCommand("Config", -2, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
 	registerSpecialCommand("Info", -1, 0).
 		attachCommandExtra([]string{redisFlagRandom, redisFlagLoading, redisFlagStale}, 0, 0, 0)
 	registerSpecialCommand("SlaveOf", 3, 0).
 		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagStale}, 0, 0, 0)
+	registerSpecialCommand("ReplicaOf", 3, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagStale}, 0, 0, 0)
 	registerSpecialCommand("Subscribe", -2, 0).
 		attachCommandExtra([]string{redisFlagPubSub, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
+	registerSpecialCommand("Unsubscribe", -1, 0).
+		attachCommandExtra([]string{redisFlagPubSub, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
 	registerSpecialCommand("Publish", 3, 0).
 		attachCommandExtra([]string{redisFlagPubSub, redisFlagNoScript, redisFlagLoading, redisFlagFast}, 0, 0, 0)
 	registerSpecialCommand("FlushAll", -1, 0).
 		attachCommandExtra([]string{redisFlagWrite}, 0, 0, 0)
 	registerSpecialCommand("FlushDB", -1, 0).
 		attachCommandExtra([]string{redisFlagWrite}, 0, 0, 0)
+	registerSpecialCommand("Copy", -3, 0).
+		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, 2, 1)
+	registerSpecialCommand("BgRewriteAof", 1, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript}, 0, 0, 0)
+	registerSpecialCommand("RewriteAof", 1, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript}, 0, 0, 0)
 	registerSpecialCommand("Save", -1, 0).
 		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript}, 0, 0, 0)
 	registerSpecialCommand("BgSave", 1, 0).
 		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript}, 0, 0, 0)
+	registerSpecialCommand("Client", -2, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
+	registerSpecialCommand("Latency", -2, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
+	registerSpecialCommand("Memory", -2, 0).
+		attachCommandExtra([]string{redisFlagReadonly}, 2, 2, 1)
+	registerSpecialCommand("BigKeys", -1, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript}, 0, 0, 0)
+	registerSpecialCommand("HotKeys", -1, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
+	registerSpecialCommand("Shutdown", -1, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
 	registerSpecialCommand("Select", 2, 0).
 		attachCommandExtra([]string{redisFlagLoading, redisFlagFast}, 0, 0, 0)
+	registerSpecialCommand("PSync", 3, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript}, 0, 0, 0)
 	registerSpecialCommand("ReplConf", -1, 0).
 		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
+	registerSpecialCommand("Role", 1, 0).
+		attachCommandExtra([]string{redisFlagNoScript, redisFlagLoading, redisFlagStale, redisFlagFast}, 0, 0, 0)
+	registerSpecialCommand("Failover", -1, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagStale}, 0, 0, 0)
+	registerSpecialCommand("Wait", 3, 0).
+		attachCommandExtra([]string{redisFlagNoScript, redisFlagBlocking}, 0, 0, 0)
+	registerSpecialCommand("WaitAof", 4, 0).
+		attachCommandExtra([]string{redisFlagNoScript, redisFlagBlocking}, 0, 0, 0)
+	registerSpecialCommand("Debug", -2, 0).
+		attachCommandExtra([]string{redisFlagAdmin, redisFlagNoScript, redisFlagLoading, redisFlagStale}, 0, 0, 0)
 	//attachCommandExtra("ReplConf", 3, []string{redisFlagReadonly, redisFlagAdmin, redisFlagNoScript}, 0, 0, 0, nil)
 
 	// transaction command
@@ -121,6 +207,6 @@ func init() {
 		attachCommandExtra([]string{redisFlagNoScript, redisFlagFast}, 0, 0, 0)
 	registerSpecialCommand("Exec", 1, 0).
 		attachCommandExtra([]string{redisFlagNoScript, redisFlagSkipMonitor}, 0, 0, 0)
-	registerSpecialCommand("Watch", 1, 0).
+	registerSpecialCommand("Watch", -2, 0).
 		attachCommandExtra([]string{redisFlagNoScript, redisFlagFast}, 1, -1, 1)
 }
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/latency"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"goRedisPlus/tcp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// commandStats counts calls of a command, see INFO commandstats
+type commandStats struct {
+	calls    int64
+	usec     int64 // total microseconds spent in executing
+	rejected int64 // calls refused before executing, such as wrong arity, NOPERM and READONLY
+	failed   int64 // calls executed but replied an error
+	// latencies in microseconds, see INFO latencystats
+	latencies *latency.Histogram
+}
+
+// latencyPercentiles are reported in INFO latencystats
+var latencyPercentiles = []float64{50, 99, 99.9}
+
+func init() {
+	RegisterInfoSection("commandstats", false, genCommandStatsInfo)
+	RegisterInfoSection("latencystats", false, genLatencyStatsInfo)
+}
+
+// recordCommandStats counts a call of known command, rejected calls take no time
+func recordCommandStats(cmdName string, elapsed time.Duration, result redis.Reply, rejected bool) {
+	cmd := lookupCommand(cmdName)
+	if cmd == nil {
+		return
+	}
+	if _, ok := result.(*protocol.ArgNumErrReply); ok || rejected {
+		atomic.AddInt64(&cmd.stats.rejected, 1)
+		return
+	}
+	atomic.AddInt64(&cmd.stats.calls, 1)
+	atomic.AddInt64(&cmd.stats.usec, elapsed.Microseconds())
+	if config.Properties.LatencyTracking {
+		cmd.stats.latencies.Record(elapsed.Microseconds())
+	}
+	if _, ok := result.(protocol.ErrorReply); ok {
+		atomic.AddInt64(&cmd.stats.failed, 1)
+	}
+}
+
+// genCommandStatsInfo returns commandstats section of INFO, commands never called are omitted
+func genCommandStatsInfo(server *Server) []byte {
+	s := &strings.Builder{}
+	s.WriteString("# Commandstats\r\n")
+	for _, name := range sortedCommandNames() {
+		stats := cmdTable[name].stats
+		calls := atomic.LoadInt64(&stats.calls)
+		rejected := atomic.LoadInt64(&stats.rejected)
+		if calls == 0 && rejected == 0 {
+			continue
+		}
+		usec := atomic.LoadInt64(&stats.usec)
+		var usecPerCall float64
+		if calls > 0 {
+			usecPerCall = float64(usec) / float64(calls)
+		}
+		_, _ = fmt.Fprintf(s, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+			name, calls, usec, usecPerCall, rejected, atomic.LoadInt64(&stats.failed))
+	}
+	return []byte(s.String())
+}
+
+// genLatencyStatsInfo returns latencystats section of INFO, commands never called are omitted
+func genLatencyStatsInfo(server *Server) []byte {
+	s := &strings.Builder{}
+	s.WriteString("# Latencystats\r\n")
+	for _, name := range sortedCommandNames() {
+		latencies := cmdTable[name].stats.latencies
+		if latencies.Count() == 0 {
+			continue
+		}
+		_, _ = fmt.Fprintf(s, "latency_percentiles_usec_%s:", name)
+		for i, value := range latencies.Percentiles(latencyPercentiles...) {
+			if i > 0 {
+				s.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(s, "p%s=%d", strconv.FormatFloat(latencyPercentiles[i], 'f', -1, 64), value)
+		}
+		s.WriteString("\r\n")
+	}
+	return []byte(s.String())
+}
+
+// resetStats clears command stats and counters of INFO stats, see CONFIG RESETSTAT
+func resetStats() {
+	for _, cmd := range cmdTable {
+		atomic.StoreInt64(&cmd.stats.calls, 0)
+		atomic.StoreInt64(&cmd.stats.usec, 0)
+		atomic.StoreInt64(&cmd.stats.rejected, 0)
+		atomic.StoreInt64(&cmd.stats.failed, 0)
+		cmd.stats.latencies.Reset()
+	}
+	atomic.StoreInt64(&tcp.AcceptedCounter, 0)
+	atomic.StoreInt64(&tcp.RejectedCounter, 0)
+	atomic.StoreInt64(&connection.TotalCommands, 0)
+	atomic.StoreInt64(&connection.TotalNetInput, 0)
+	atomic.StoreInt64(&connection.TotalNetOutput, 0)
+	resetKeyspaceStats()
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/latency"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/redis/connection"
+	"goRedisPlus/redis/protocol"
+	"strings"
+)
+
+// execConfig executes CONFIG subcommands, command line: config get|set|rewrite|resetstat args...
+func (server *Server) execConfig(args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "get":
+		if len(args) == 0 {
+			return protocol.MakeArgNumErrReply("config|get")
+		}
+		return execConfigGet(args)
+	case "set":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return protocol.MakeArgNumErrReply("config|set")
+		}
+		return server.execConfigSet(args)
+	case "rewrite":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("config|rewrite")
+		}
+		if err := config.Rewrite(); err != nil {
+			return protocol.MakeErrReply("ERR Rewriting config file: " + err.Error())
+		}
+		return protocol.MakeOkReply()
+	case "resetstat":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("config|resetstat")
+		}
+		resetStats()
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try CONFIG HELP.")
+}
+
+// execConfigGet returns name and value of params matching any of patterns, command line: config get pattern...
+func execConfigGet(patterns [][]byte) redis.Reply {
+	seen := make(map[string]struct{})
+	var result [][]byte
+	for _, pattern := range patterns {
+		params, err := config.GetParams(string(pattern))
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		for _, param := range params {
+			if _, ok := seen[param[0]]; ok {
+				continue
+			}
+			seen[param[0]] = struct{}{}
+			result = append(result, []byte(param[0]), []byte(param[1]))
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execConfigSet changes params atomically, command line: config set name value [name value ...]
+func (server *Server) execConfigSet(args [][]byte) redis.Reply {
+	pairs := make([][2]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		pairs = append(pairs, [2]string{strings.ToLower(string(args[i])), string(args[i+1])})
+	}
+	if err := config.SetParams(pairs); err != nil {
+		param := ""
+		if paramErr, ok := err.(*config.ParamError); ok {
+			param = paramErr.Param
+		}
+		return protocol.MakeErrReply("ERR CONFIG SET failed (possibly related to argument '" + param + "') - " + err.Error())
+	}
+	for _, pair := range pairs {
+		server.applyConfig(pair[0])
+	}
+	return protocol.MakeOkReply()
+}
+
+// applyConfig makes changed param take effect if it is not read whenever it is used
+func (server *Server) applyConfig(name string) {
+	switch name {
+	case "loglevel":
+		logger.SetLevel(config.Properties.LogLevel)
+	case "requirepass":
+		acl.setRequirePass(config.Properties.RequirePass)
+	case "client-output-buffer-limit":
+		if limits, err := config.Properties.OutputBufferLimits(); err == nil {
+			connection.SetOutputBufferLimits(limits)
+		}
+	case "latency-monitor-threshold":
+		latency.SetThreshold(int64(config.Properties.LatencyThreshold))
+	case "maxmemory-policy":
+		setMaxMemoryPolicy()
+	case "maxmemory", "maxmemory-clients":
+		if limit, err := config.Properties.MaxMemoryClientsBytes(); err == nil {
+			connection.SetMaxMemoryClients(limit)
+		}
+		if name == "maxmemory" {
+			applyRuntimeMemory()
+		}
+	case "go-memory-limit", "gogc":
+		applyRuntimeMemory()
+	case "set-max-intset-entries", "hash-max-listpack-entries", "hash-max-listpack-value",
+		"zset-max-listpack-entries", "zset-max-listpack-value", "list-max-listpack-size":
+		applyEncodingLimits()
+	case "hotkeys-sampling", "hotkeys-interval":
+		resetHotKeys()
+	case "appendfsync":
+		if server.persister != nil {
+			server.persister.SetFsync(config.Properties.AppendFsync)
+		}
+	}
+}
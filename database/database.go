@@ -1,19 +1,19 @@
 package database
 
 import (
+	"goRedisPlus/config"
 	"goRedisPlus/datastruct/dict"
 	"goRedisPlus/interface/database"
 	"goRedisPlus/interface/redis"
-	"goRedisPlus/lib/logger"
-	"goRedisPlus/lib/timewheel"
+	"goRedisPlus/lib/utils"
 	"goRedisPlus/redis/protocol"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	dataDictSize = 1 << 16
-	ttlDictSize  = 1 << 10
+	ttlDictSize = 1 << 10
 )
 
 // DB stores data and execute user's commands
@@ -22,17 +22,27 @@ type DB struct {
 	index int
 	// key -> DataEntity
 	data *dict.ConcurrentDict
-	// key -> expireTime (time.Time)
+	// expires dict: key -> expireTime (time.Time), see expire.go
 	ttlMap *dict.ConcurrentDict
+	// usedMemory is the sum of estimated sizes of keys, see evict.go
+	usedMemory int64
+	// expireSum is the sum of expire times in ttlMap in milliseconds since ttlEpoch, see avgTTL
+	expireSum int64
 	// key -> version(uint32)
 	versionMap *dict.ConcurrentDict
+	// keyIndex is the radix tree of keys, nil if keyspace-index is disabled, see index.go
+	keyIndex *keyIndex
 
 	// addaof is used to add command to aof
 	addAof func(CmdLine)
+	// isSlave returns whether the server is a slave now, slaves never expire keys by themselves
+	isSlave func() bool
 
 	// callbacks
 	insertCallback database.KeyEventCallback
 	deleteCallback database.KeyEventCallback
+	// publish sends keyspace notifications, see notify.go
+	publish func(channel string, message string)
 }
 
 // ExecFunc is interface for command executor
@@ -50,13 +60,23 @@ type CmdLine = [][]byte
 // execute from head to tail when undo
 type UndoFunc func(db *DB, args [][]byte) []CmdLine
 
+// makeKeyDict makes a dict of keys with the given shard count, or an adaptive one if dict-shards is not set
+func makeKeyDict(shardCount int) *dict.ConcurrentDict {
+	if config.Properties.DictShards <= 0 {
+		return dict.MakeAdaptive()
+	}
+	return dict.MakeConcurrent(shardCount)
+}
+
 // makeDB create DB instance
 func makeDB() *DB {
 	db := &DB{
-		data:       dict.MakeConcurrent(dataDictSize),
-		ttlMap:     dict.MakeConcurrent(ttlDictSize),
-		versionMap: dict.MakeConcurrent(dataDictSize),
+		data:       makeKeyDict(config.Properties.DictShards),
+		ttlMap:     makeKeyDict(ttlDictSize),
+		versionMap: makeKeyDict(config.Properties.DictShards),
+		keyIndex:   makeKeyIndex(),
 		addAof:     func(line CmdLine) {},
+		isSlave:    func() bool { return false },
 	}
 	return db
 }
@@ -64,10 +84,11 @@ func makeDB() *DB {
 // makeBasicDB create DB instance only with basic abilities.
 func makeBasicDB() *DB {
 	db := &DB{
-		data:       dict.MakeConcurrent(dataDictSize),
-		ttlMap:     dict.MakeConcurrent(ttlDictSize),
-		versionMap: dict.MakeConcurrent(dataDictSize),
+		data:       makeKeyDict(config.Properties.DictShards),
+		ttlMap:     makeKeyDict(ttlDictSize),
+		versionMap: makeKeyDict(config.Properties.DictShards),
 		addAof:     func(line CmdLine) {},
+		isSlave:    func() bool { return false },
 	}
 	return db
 }
@@ -107,7 +128,7 @@ func (db *DB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
 func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
 	cmdName := strings.ToLower(string(cmdLine[0])) // 获取要执行的指令的名称
 	cmd, ok := cmdTable[cmdName]                   // 去注册表中查询
-	if !ok {
+	if !ok || cmd.flags&flagSpecial > 0 {          // special commands are executed by Server
 		return protocol.MakeErrReply("ERR unknown command '" + cmdName + "'")
 	}
 	if !validateArity(cmd.arity, cmdLine) { // 注册的函数参数和传入的参数是否相同
@@ -119,22 +140,33 @@ func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
 	db.addVersion(write...)             // 把write中的key 放到versionMap中，可能是为了实现事务，
 	db.RWLocks(write, read)
 	defer db.RWUnLocks(write, read)
+	db.countKeyspaceLookups(cmd, read)
+	db.trackHotKeys(write, read)
 	fun := cmd.executor
-	return fun(db, cmdLine[1:])
+	result := fun(db, cmdLine[1:])
+	db.updateMemory(write...)
+	db.notifyCommand(cmdLine, write, result)
+	return result
 }
 
 // execWithLock executes normal commands, invoker should provide locks
 func (db *DB) execWithLock(cmdLine [][]byte) redis.Reply {
 	cmdName := strings.ToLower(string(cmdLine[0]))
 	cmd, ok := cmdTable[cmdName]
-	if !ok {
+	if !ok || cmd.flags&flagSpecial > 0 {
 		return protocol.MakeErrReply("ERR unknown command '" + cmdName + "'")
 	}
 	if !validateArity(cmd.arity, cmdLine) {
 		return protocol.MakeArgNumErrReply(cmdName)
 	}
+	write, read := cmd.prepare(cmdLine[1:])
+	db.countKeyspaceLookups(cmd, read)
+	db.trackHotKeys(write, read)
 	fun := cmd.executor
-	return fun(db, cmdLine[1:])
+	result := fun(db, cmdLine[1:])
+	db.updateMemory(write...)
+	db.notifyCommand(cmdLine, write, result)
+	return result
 }
 
 func validateArity(arity int, cmdArgs [][]byte) bool {
@@ -147,13 +179,22 @@ func validateArity(arity int, cmdArgs [][]byte) bool {
 
 /* ---- Data Access ----- */
 
-// GetEntity returns DataEntity bind to given key
+// GetEntity returns DataEntity bind to given key, and records the access for eviction
 func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
+	entity, ok := db.lookupEntity(key)
+	if ok {
+		touch(entity)
+	}
+	return entity, ok
+}
+
+// lookupEntity returns DataEntity bind to given key without recording the access, such as OBJECT IDLETIME
+func (db *DB) lookupEntity(key string) (*database.DataEntity, bool) {
 	raw, ok := db.data.GetWithLock(key)
 	if !ok {
 		return nil, false
 	}
-	if db.IsExpired(key) {
+	if db.expireLazily(key) {
 		return nil, false
 	}
 	entity, _ := raw.(*database.DataEntity)
@@ -162,7 +203,14 @@ func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
 
 // PutEntity a DataEntity into DB
 func (db *DB) PutEntity(key string, entity *database.DataEntity) int {
+	db.expireIfNeeded(key)
+	old, _ := db.data.GetWithLock(key)
+	initAccess(old, entity)
 	ret := db.data.PutWithLock(key, entity)
+	db.replaceMemory(key, old, entity)
+	if ret > 0 {
+		db.keyIndex.add(key)
+	}
 	// db.insertCallback may be set as nil, during `if` and actually callback
 	// so introduce a local variable `cb`
 	if cb := db.insertCallback; ret > 0 && cb != nil {
@@ -173,12 +221,25 @@ func (db *DB) PutEntity(key string, entity *database.DataEntity) int {
 
 // PutIfExists edit an existing DataEntity
 func (db *DB) PutIfExists(key string, entity *database.DataEntity) int {
-	return db.data.PutIfExistsWithLock(key, entity)
+	db.expireIfNeeded(key)
+	old, _ := db.data.GetWithLock(key)
+	initAccess(old, entity)
+	ret := db.data.PutIfExistsWithLock(key, entity)
+	if ret > 0 {
+		db.replaceMemory(key, old, entity)
+	}
+	return ret
 }
 
 // PutIfAbsent insert an DataEntity only if the key not exists
 func (db *DB) PutIfAbsent(key string, entity *database.DataEntity) int {
+	db.expireIfNeeded(key)
+	initAccess(nil, entity)
 	ret := db.data.PutIfAbsentWithLock(key, entity)
+	if ret > 0 {
+		db.replaceMemory(key, nil, entity)
+		db.keyIndex.add(key)
+	}
 	// db.insertCallback may be set as nil, during `if` and actually callback
 	// so introduce a local variable `cb`
 	if cb := db.insertCallback; ret > 0 && cb != nil {
@@ -190,9 +251,11 @@ func (db *DB) PutIfAbsent(key string, entity *database.DataEntity) int {
 // Remove the given key from db
 func (db *DB) Remove(key string) {
 	raw, deleted := db.data.RemoveWithLock(key)
-	db.ttlMap.Remove(key)
-	taskKey := genExpireTask(key)
-	timewheel.Cancel(taskKey)
+	if deleted > 0 {
+		db.replaceMemory(key, raw, nil)
+		db.keyIndex.remove(key)
+	}
+	db.removeTTL(key)
 	if cb := db.deleteCallback; cb != nil {
 		var entity *database.DataEntity
 		if deleted > 0 {
@@ -207,7 +270,7 @@ func (db *DB) Removes(keys ...string) (deleted int) {
 	deleted = 0
 	for _, key := range keys {
 		_, exists := db.data.GetWithLock(key)
-		if exists {
+		if exists && !db.expireIfNeeded(key) {
 			db.Remove(key)
 			deleted++
 		}
@@ -221,6 +284,9 @@ func (db *DB) Removes(keys ...string) (deleted int) {
 func (db *DB) Flush() {
 	db.data.Clear()
 	db.ttlMap.Clear()
+	db.keyIndex = makeKeyIndex()
+	atomic.StoreInt64(&db.expireSum, 0)
+	atomic.StoreInt64(&db.usedMemory, 0)
 }
 
 /* ---- Lock Function ----- */
@@ -235,53 +301,89 @@ func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
 	db.data.RWUnLocks(writeKeys, readKeys)
 }
 
+// TryRWLocks lock keys for writing and reading, returns false if failed to lock all of them within timeout
+func (db *DB) TryRWLocks(writeKeys []string, readKeys []string, timeout time.Duration) bool {
+	return db.data.TryRWLocks(writeKeys, readKeys, timeout)
+}
+
 /* ---- TTL Functions ---- */
 
-func genExpireTask(key string) string {
-	return "expire:" + key
+// ttlEpoch is the base of DB.expireSum, which keeps the sum far from overflow
+var ttlEpoch = time.Now()
+
+func sinceTTLEpoch(t time.Time) int64 {
+	return t.Sub(ttlEpoch).Milliseconds()
 }
 
-// Expire sets ttlCmd of key
+// Expire sets ttlCmd of key, the key is removed by active expire cycle or the first access after expireTime
 func (db *DB) Expire(key string, expireTime time.Time) {
+	if raw, ok := db.ttlMap.Get(key); ok {
+		atomic.AddInt64(&db.expireSum, -sinceTTLEpoch(raw.(time.Time)))
+	}
 	db.ttlMap.Put(key, expireTime) // 添加到ttlMap 也是concurrentMap 分片的
-	taskKey := genExpireTask(key)  // 拼接一个key
-	timewheel.At(expireTime, taskKey, func() {
-		keys := []string{key}
-		db.RWLocks(keys, nil)
-		defer db.RWUnLocks(keys, nil)
-		// check-lock-check, ttl may be updated during waiting lock
-		logger.Info("expire " + key)
-		rawExpireTime, ok := db.ttlMap.Get(key)
-		if !ok {
-			return
-		}
-		expireTime, _ := rawExpireTime.(time.Time)
-		expired := time.Now().After(expireTime) // 比较过期时间和当前时间的大小
-		if expired {
-			db.Remove(key) // 删除key
-		}
-	})
+	atomic.AddInt64(&db.expireSum, sinceTTLEpoch(expireTime))
+}
+
+// expireKey removes an expired key and propagates an explicit DEL to aof and slaves,
+// so that slaves never diverge from master on ttl races. All of lazy and active expiration remove keys by it, so that
+// they are counted by expired_keys and fire expired events.
+func (db *DB) expireKey(key string) {
+	db.Remove(key)
+	atomic.AddInt64(&expiredKeys, 1)
+	db.addAof(utils.ToCmdLine("DEL", key))
+	db.notifyKeyspaceEvent(notifyExpired, "expired", key)
 }
 
 // Persist cancel ttlCmd of key
 func (db *DB) Persist(key string) {
-	db.ttlMap.Remove(key)
-	taskKey := genExpireTask(key)
-	timewheel.Cancel(taskKey)
+	db.removeTTL(key)
+}
+
+// removeTTL removes key from ttlMap and keeps expireSum up to date
+func (db *DB) removeTTL(key string) {
+	if raw, removed := db.ttlMap.Remove(key); removed > 0 {
+		atomic.AddInt64(&db.expireSum, -sinceTTLEpoch(raw.(time.Time)))
+	}
+}
+
+// avgTTL returns the average remaining ttl in milliseconds of keys with ttl, see INFO keyspace
+func (db *DB) avgTTL() int64 {
+	count := int64(db.ttlMap.Len())
+	if count == 0 {
+		return 0
+	}
+	avg := atomic.LoadInt64(&db.expireSum)/count - sinceTTLEpoch(time.Now())
+	if avg < 0 {
+		// expired keys waiting for removal
+		return 0
+	}
+	return avg
 }
 
 // IsExpired check whether a key is expired
 func (db *DB) IsExpired(key string) bool {
+	if db.ttlMap.Len() == 0 {
+		return false // no key has ttl, skip locking shard of ttlMap
+	}
 	rawExpireTime, ok := db.ttlMap.Get(key)
 	if !ok {
 		return false
 	}
 	expireTime, _ := rawExpireTime.(time.Time)
-	expired := time.Now().After(expireTime)
-	if expired {
-		db.Remove(key)
+	return time.Now().After(expireTime)
+}
+
+// expireIfNeeded removes key if it is expired and returns whether it is expired, invoker should hold write lock of key.
+// Readers holding read lock only should use expireLazily instead.
+func (db *DB) expireIfNeeded(key string) bool {
+	if !db.IsExpired(key) {
+		return false
+	}
+	// slave treats the key as expired but waits for DEL from master, and so does master during CLIENT PAUSE
+	if !db.isSlave() && !isWritePaused() {
+		db.expireKey(key)
 	}
-	return expired
+	return true
 }
 
 /* --- add version --- */
@@ -304,7 +406,16 @@ func (db *DB) GetVersion(key string) uint32 {
 
 // ForEach traverses all the keys in the database
 func (db *DB) ForEach(cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
-	db.data.ForEach(func(key string, raw interface{}) bool {
+	db.data.ForEach(db.entryConsumer(cb))
+}
+
+// ForEachWithLock is like ForEach, but invoker should provide with locks of all keys, see snapshot.go
+func (db *DB) ForEachWithLock(cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	db.data.ForEachWithLock(db.entryConsumer(cb))
+}
+
+func (db *DB) entryConsumer(cb func(key string, data *database.DataEntity, expiration *time.Time) bool) dict.Consumer {
+	return func(key string, raw interface{}) bool {
 		entity, _ := raw.(*database.DataEntity)
 		var expiration *time.Time
 		rawExpireTime, ok := db.ttlMap.Get(key)
@@ -314,5 +425,5 @@ func (db *DB) ForEach(cb func(key string, data *database.DataEntity, expiration
 		}
 
 		return cb(key, entity, expiration)
-	})
+	}
 }
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"fmt"
+	"goRedisPlus/interface/database"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// execDebug executes DEBUG subcommands which are used for testing
+func (server *Server) execDebug(c redis.Connection, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	switch subCmd {
+	case "change-repl-id":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("debug|change-repl-id")
+		}
+		server.changeReplId()
+		return protocol.MakeOkReply()
+	case "set-active-expire":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("debug|set-active-expire")
+		}
+		switch string(args[1]) {
+		case "0":
+			atomic.StoreInt32(&server.activeExpireOff, 1)
+		case "1":
+			atomic.StoreInt32(&server.activeExpireOff, 0)
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+		return protocol.MakeOkReply()
+	case "object":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("debug|object")
+		}
+		db, errReply := server.selectDB(c.GetDBIndex())
+		if errReply != nil {
+			return errReply
+		}
+		return db.debugObject(string(args[1]))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try DEBUG HELP.")
+}
+
+// debugObject describes internals of key including its expiry bookkeeping. Unlike other commands, expired keys
+// which are not removed yet are described rather than treated as absent, with expired:1.
+// expires is the unix time in milliseconds in the expires dict, ttl is the remaining milliseconds which is negative
+// for expired keys, both of them are -1 if key has no ttl.
+func (db *DB) debugObject(key string) redis.Reply {
+	db.RWLocks(nil, []string{key})
+	defer db.RWUnLocks(nil, []string{key})
+	raw, exists := db.data.GetWithLock(key)
+	if !exists {
+		return protocol.MakeErrReply("ERR no such key")
+	}
+	entity := raw.(*database.DataEntity)
+	expires, ttl, expired := int64(-1), int64(-1), 0
+	if rawExpireTime, ok := db.ttlMap.Get(key); ok {
+		expireTime := rawExpireTime.(time.Time)
+		expires = expireTime.UnixNano() / int64(time.Millisecond)
+		ttl = int64(time.Until(expireTime) / time.Millisecond)
+		if db.IsExpired(key) {
+			expired = 1
+		}
+	}
+	return protocol.MakeStatusReply(fmt.Sprintf("Value at:%p refcount:1 encoding:%s lru_seconds_idle:%d expires:%d ttl:%d expired:%d",
+		entity, getEncoding(entity), idleTime(entity), expires, ttl, expired))
+}
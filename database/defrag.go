@@ -0,0 +1,178 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/datastruct/list"
+	"goRedisPlus/interface/database"
+	"goRedisPlus/lib/logger"
+	"sync/atomic"
+	"time"
+)
+
+// Active defragmentation:
+// Go runtime never moves live objects, and structures keep the memory they grew to: maps never shrink after
+// deletions, pages of quicklist stay allocated after elements are removed, and appended strings keep spare capacity.
+// With activedefrag enabled, a cycle runs every defragCycleInterval for at most active-defrag-cycle-max percent of it
+// and walks databases incrementally: keys of each db are scanned in batches and values worth compacting are copied
+// into new entities, then shards of dicts of the db are rebuilt if they hold much less than their peak. Values are
+// replaced instead of compacted in place, since COPY shares values between keys. A pass over all databases is
+// followed by a pause of defragPassInterval.
+
+const (
+	defragCycleInterval = 100 * time.Millisecond
+	defragPassInterval  = 10 * time.Second
+	// defaultDefragCycleMax is used if active-defrag-cycle-max is not set, the same as redis
+	defaultDefragCycleMax = 25
+	defragScanBatch       = 100  // keys compacted between checks of time
+	defragShrinkBatch     = 1024 // shards visited between checks of time
+	// defragStringMinSlack is the least spare capacity of strings worth trimming
+	defragStringMinSlack = 64
+)
+
+// stages of a pass over each db
+const (
+	defragStageKeys = iota
+	defragStageData
+	defragStageTTL
+	defragStageVersion
+)
+
+// counters of active defragmentation, see INFO stats
+var (
+	defragHits      int64 // values compacted and shards rebuilt
+	defragMisses    int64 // values scanned but not worth compacting
+	defragKeyHits   int64 // keys whose values are compacted
+	defragKeyMisses int64 // keys scanned but not compacted
+	defragTime      int64 // nanoseconds spent in cycles
+	defragRunning   int32 // active-defrag-cycle-max of the running pass, 0 if not running, see INFO memory
+)
+
+// defragCursor is the progress of a pass
+type defragCursor struct {
+	dbIndex int
+	stage   int
+	cursor  int
+}
+
+func defragCycleMax() int {
+	if config.Properties.DefragCycleMax <= 0 {
+		return defaultDefragCycleMax
+	}
+	return config.Properties.DefragCycleMax
+}
+
+// startDefragCron runs defragmentation cycles while activedefrag is enabled
+func (server *Server) startDefragCron() {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(err)
+			}
+		}()
+		ticker := time.NewTicker(defragCycleInterval)
+		defer ticker.Stop()
+		cursor := &defragCursor{}
+		var nextPass time.Time
+		for now := range ticker.C {
+			if !config.Properties.ActiveDefrag || now.Before(nextPass) {
+				atomic.StoreInt32(&defragRunning, 0)
+				continue
+			}
+			cycleMax := defragCycleMax()
+			atomic.StoreInt32(&defragRunning, int32(cycleMax))
+			if server.defragCycle(cursor, defragCycleInterval*time.Duration(cycleMax)/100) {
+				atomic.StoreInt32(&defragRunning, 0)
+				nextPass = now.Add(defragPassInterval)
+			}
+		}
+	}()
+}
+
+// defragCycle continues the pass from cursor for at most limit, returns true if the pass is finished
+func (server *Server) defragCycle(cursor *defragCursor, limit time.Duration) bool {
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&defragTime, int64(time.Since(start)))
+	}()
+	for time.Since(start) < limit {
+		if cursor.dbIndex >= len(server.dbSet) {
+			*cursor = defragCursor{}
+			return true
+		}
+		db := server.mustSelectDB(cursor.dbIndex)
+		var shrunk, next int
+		switch cursor.stage {
+		case defragStageKeys:
+			next = db.defragKeys(cursor.cursor)
+		case defragStageData:
+			shrunk, next = db.data.ShrinkShards(cursor.cursor, defragShrinkBatch)
+		case defragStageTTL:
+			shrunk, next = db.ttlMap.ShrinkShards(cursor.cursor, defragShrinkBatch)
+		case defragStageVersion:
+			shrunk, next = db.versionMap.ShrinkShards(cursor.cursor, defragShrinkBatch)
+		}
+		atomic.AddInt64(&defragHits, int64(shrunk))
+		cursor.cursor = next
+		if next == 0 {
+			cursor.stage++
+			if cursor.stage > defragStageVersion {
+				cursor.stage = defragStageKeys
+				cursor.dbIndex++
+			}
+		}
+	}
+	return false
+}
+
+// defragKeys compacts a batch of keys from cursor, returns cursor of the next batch, 0 means finished
+func (db *DB) defragKeys(cursor int) int {
+	if db.data.Len() == 0 {
+		return 0 // scanning an empty dict traverses all of its shards
+	}
+	keys, next := db.data.DictScan(cursor, defragScanBatch, nil)
+	for _, key := range keys {
+		db.defragKey(key)
+	}
+	return next
+}
+
+// defragKey replaces value of key with a compacted copy if it is worth compacting
+func (db *DB) defragKey(key string) {
+	writeKeys := []string{key}
+	db.RWLocks(writeKeys, nil)
+	defer db.RWUnLocks(writeKeys, nil)
+	entity, exists := db.lookupEntity(key)
+	if !exists {
+		return
+	}
+	data := compactValue(entity.Data)
+	if data == nil {
+		atomic.AddInt64(&defragMisses, 1)
+		atomic.AddInt64(&defragKeyMisses, 1)
+		return
+	}
+	db.PutIfExists(key, &database.DataEntity{
+		Data:   data,
+		Access: atomic.LoadUint32(&entity.Access),
+		Freq:   atomic.LoadUint32(&entity.Freq),
+	})
+	atomic.AddInt64(&defragHits, 1)
+	atomic.AddInt64(&defragKeyHits, 1)
+}
+
+// compactValue returns a compacted copy of value, or nil if it is not worth compacting
+func compactValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case []byte:
+		if slack := cap(val) - len(val); slack >= defragStringMinSlack && slack > len(val)/4 {
+			trimmed := make([]byte, len(val))
+			copy(trimmed, val)
+			return trimmed
+		}
+	case *list.QuickList:
+		if val.Sparse() {
+			return val.Compact()
+		}
+	}
+	return nil
+}
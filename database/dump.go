@@ -0,0 +1,175 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	rdbEncoder "github.com/hdt3213/rdb/encoder"
+	rdb "github.com/hdt3213/rdb/parser"
+	"goRedisPlus/aof"
+	"goRedisPlus/interface/database"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/protocol"
+	"hash/crc64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DUMP payload is a tiny rdb file containing only the value, followed by 2 bytes dump version and 8 bytes crc64 (little endian).
+// The rdb encoding is shared with bgsave, so the payload could only be restored by goRedisPlus.
+
+const dumpVersion = 1
+
+var dumpCrcTable = crc64.MakeTable(crc64.ECMA)
+
+var errDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// DumpEntity serializes the value of entity for RESTORE
+func DumpEntity(entity *database.DataEntity) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := rdbEncoder.NewEncoder(buf)
+	if err := encoder.WriteHeader(); err != nil {
+		return nil, err
+	}
+	if err := encoder.WriteDBHeader(0, 1, 0); err != nil {
+		return nil, err
+	}
+	if err := aof.EncodeEntity(encoder, "", entity); err != nil {
+		return nil, err
+	}
+	if err := encoder.WriteEnd(); err != nil {
+		return nil, err
+	}
+	payload := buf.Bytes()
+	payload = append(payload, byte(dumpVersion), byte(dumpVersion>>8))
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, crc64.Checksum(payload, dumpCrcTable))
+	return append(payload, checksum...), nil
+}
+
+// loadDumpPayload deserializes payload generated by DumpEntity
+func loadDumpPayload(payload []byte) (*database.DataEntity, error) {
+	if len(payload) < 10 {
+		return nil, errDumpPayload
+	}
+	body := payload[:len(payload)-8]
+	if crc64.Checksum(body, dumpCrcTable) != binary.LittleEndian.Uint64(payload[len(payload)-8:]) {
+		return nil, errDumpPayload
+	}
+	if binary.LittleEndian.Uint16(body[len(body)-2:]) != dumpVersion {
+		return nil, errDumpPayload
+	}
+	var entity *database.DataEntity
+	decoder := rdb.NewDecoder(bytes.NewReader(body[:len(body)-2]))
+	err := decoder.Parse(func(o rdb.RedisObject) bool {
+		entity = rdbObjectToEntity(o)
+		return false
+	})
+	if err != nil || entity == nil {
+		return nil, errDumpPayload
+	}
+	return entity, nil
+}
+
+// MakeRestoreCmd returns a RESTORE command which replaces the key with the given value and expiration
+func MakeRestoreCmd(key string, entity *database.DataEntity, expireAt *time.Time) (CmdLine, error) {
+	payload, err := DumpEntity(entity)
+	if err != nil {
+		return nil, err
+	}
+	ttl := "0"
+	if expireAt != nil {
+		ttl = strconv.FormatInt(expireAt.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return [][]byte{
+		[]byte("RESTORE"),
+		[]byte(key),
+		[]byte(ttl),
+		payload,
+		[]byte("REPLACE"),
+		[]byte("ABSTTL"),
+	}, nil
+}
+
+// execDump serializes the value stored at key
+func execDump(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeNullBulkReply()
+	}
+	payload, err := DumpEntity(entity)
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	return protocol.MakeBulkReply(payload)
+}
+
+// execRestore command line: RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func execRestore(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return protocol.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			// lru and lfu are not supported, just skip them
+			if i+1 >= len(args) {
+				return protocol.MakeSyntaxErrReply()
+			}
+			i++
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	if _, exists := db.GetEntity(key); exists && !replace {
+		return protocol.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	entity, err := loadDumpPayload(args[2])
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.Unix(0, ttl*int64(time.Millisecond))
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if expireAt.Before(time.Now()) {
+			// restored key has already expired
+			db.Remove(key)
+			db.addAof(utils.ToCmdLine("DEL", key))
+			return protocol.MakeOkReply()
+		}
+	}
+	db.PutEntity(key, entity)
+	db.addAof(utils.ToCmdLine("DEL", key))
+	db.addAof(aof.EntityToCmd(key, entity).Args)
+	if ttl > 0 {
+		db.Expire(key, expireAt)
+		db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
+	} else {
+		db.Persist(key)
+	}
+	return protocol.MakeOkReply()
+}
+
+func init() {
+	registerCommand("Dump", execDump, readFirstKey, nil, 2, flagReadOnly).
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagRandom}, 1, 1, 1)
+	registerCommand("Restore", execRestore, writeFirstKey, rollbackFirstKey, -4, flagWrite).
+		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, 1, 1)
+}
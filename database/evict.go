@@ -0,0 +1,354 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/datastruct/dict"
+	"goRedisPlus/interface/database"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/protocol"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Eviction:
+// Used memory is the sum of estimated sizes of keys (see EstimateEntitySize), sizes are updated whenever keys
+// are written. If it exceeds maxmemory, keys are evicted by maxmemory-policy before executing commands.
+// LRU and LFU are approximated like redis: every access records a clock or increments a counter on the entity
+// (see lfu.go), maxmemory-samples keys of each db are sampled into an eviction pool which keeps the best
+// candidates, and the best one is evicted. If evicting takes longer than maxmemory-eviction-tenacity allows,
+// commands proceed and the rest is evicted in background.
+
+const (
+	policyNoEviction  = "noeviction"
+	policyAllKeysLRU  = "allkeys-lru"
+	policyVolatileLRU = "volatile-lru"
+	policyAllKeysLFU  = "allkeys-lfu"
+	policyVolatileLFU = "volatile-lfu"
+)
+
+// results of performEvictions
+const (
+	evictOK      = iota // used memory is within maxmemory
+	evictRunning        // time limit exceeded, the rest is evicted in background
+	evictFail           // nothing could be evicted
+)
+
+const (
+	defaultMaxMemorySamples = 5
+	evictionPoolSize        = 16
+	// evictionLockTimeout skips candidates locked by others, such as keys prepared in transactions of cluster
+	evictionLockTimeout = 10 * time.Millisecond
+	// evictionBackgroundInterval lets commands run between rounds of background eviction
+	evictionBackgroundInterval = time.Millisecond
+)
+
+// errOOM refuses commands flagged denyoom when used memory exceeds maxmemory and nothing could be evicted
+var errOOM = protocol.MakeErrReply("OOM command not allowed when used memory > 'maxmemory'.")
+
+// evictionCandidate is a sampled key, the greater idle the better to evict.
+// idle is seconds since last access for LRU, or 255 minus the LFU counter for LFU
+type evictionCandidate struct {
+	dbIndex int
+	key     string
+	idle    int64
+}
+
+var (
+	evictedKeys int64 // counter of INFO stats
+
+	// evictionMu serializes evictions and guards evictionPool
+	evictionMu sync.Mutex
+	// evictionPool is sorted by idle in ascending order, candidates may be stale
+	evictionPool []*evictionCandidate
+	// evictionPoolPolicy is the policy sampling candidates in evictionPool
+	evictionPoolPolicy string
+	// evictionInBackground is 1 while keys are evicted in background, see maxmemory-eviction-tenacity
+	evictionInBackground int32
+	// lfuEnabled is 1 if maxmemory-policy is LFU, then accesses update LFU counters instead of LRU clocks
+	lfuEnabled int32
+)
+
+// isDenyOOMCommand returns whether the command may grow memory, EXEC is if any of queued commands is
+func isDenyOOMCommand(c redis.Connection, cmdName string) bool {
+	if cmdName == "exec" && c.InMultiState() {
+		for _, cmdLine := range c.GetQueuedCmdLine() {
+			if hasRedisFlag(string(cmdLine[0]), redisFlagDenyOOM) {
+				return true
+			}
+		}
+		return false
+	}
+	return hasRedisFlag(cmdName, redisFlagDenyOOM)
+}
+
+// lruClock returns the clock of LRU in seconds
+func lruClock() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+// touch records an access of entity
+func touch(entity *database.DataEntity) {
+	if entity == nil {
+		return
+	}
+	if atomic.LoadInt32(&lfuEnabled) == 1 {
+		updateLFU(entity)
+		return
+	}
+	atomic.StoreUint32(&entity.Access, lruClock())
+}
+
+// initAccess initializes clock and LFU counter of entity put into db,
+// a new value inherits LFU counter of the replaced one, entities moved from other keys keep theirs
+func initAccess(old interface{}, entity *database.DataEntity) {
+	if atomic.LoadUint32(&entity.Access) == 0 {
+		atomic.StoreUint32(&entity.Access, lruClock())
+	}
+	if atomic.LoadUint32(&entity.Freq) != 0 {
+		return
+	}
+	if oldEntity, ok := old.(*database.DataEntity); ok && oldEntity != nil {
+		atomic.StoreUint32(&entity.Freq, atomic.LoadUint32(&oldEntity.Freq))
+	} else {
+		atomic.StoreUint32(&entity.Freq, initLFU())
+	}
+}
+
+// idleTime returns seconds since last access of entity
+func idleTime(entity *database.DataEntity) int64 {
+	return int64(lruClock() - atomic.LoadUint32(&entity.Access))
+}
+
+// replaceMemory updates used memory when the value of key is replaced from old to entity, either may be nil
+func (db *DB) replaceMemory(key string, old interface{}, entity *database.DataEntity) {
+	var delta int64
+	if oldEntity, ok := old.(*database.DataEntity); ok && oldEntity != nil {
+		delta -= oldEntity.Size
+	}
+	if entity != nil {
+		entity.Size = EstimateEntitySize(key, entity)
+		delta += entity.Size
+	}
+	atomic.AddInt64(&db.usedMemory, delta)
+}
+
+// updateMemory estimates sizes of written keys again, since values such as lists are modified in place
+func (db *DB) updateMemory(keys ...string) {
+	for _, key := range keys {
+		raw, ok := db.data.GetWithLock(key)
+		if !ok {
+			continue
+		}
+		entity, _ := raw.(*database.DataEntity)
+		size := EstimateEntitySize(key, entity)
+		atomic.AddInt64(&db.usedMemory, size-entity.Size)
+		entity.Size = size
+	}
+}
+
+// usedMemory returns estimated bytes of keys in all databases
+func (server *Server) usedMemory() int64 {
+	var total int64
+	for i := range server.dbSet {
+		total += atomic.LoadInt64(&server.mustSelectDB(i).usedMemory)
+	}
+	return total
+}
+
+func getMaxMemoryPolicy() string {
+	if config.Properties.MaxMemoryPolicy == "" {
+		return policyNoEviction
+	}
+	return strings.ToLower(config.Properties.MaxMemoryPolicy)
+}
+
+func isLFUPolicy(policy string) bool {
+	return policy == policyAllKeysLFU || policy == policyVolatileLFU
+}
+
+// setMaxMemoryPolicy applies maxmemory-policy to tracking of accesses
+func setMaxMemoryPolicy() {
+	if isLFUPolicy(getMaxMemoryPolicy()) {
+		atomic.StoreInt32(&lfuEnabled, 1)
+	} else {
+		atomic.StoreInt32(&lfuEnabled, 0)
+	}
+}
+
+func getMaxMemorySamples() int {
+	if config.Properties.MaxMemorySamples <= 0 {
+		return defaultMaxMemorySamples
+	}
+	return config.Properties.MaxMemorySamples
+}
+
+// evictionTimeLimit returns time to spend in evicting before a command, according to maxmemory-eviction-tenacity.
+// It is the same as redis: 50us per tenacity up to 10, then grows by 15% per tenacity, 100 means unlimited.
+func evictionTimeLimit() time.Duration {
+	tenacity := config.Properties.MaxMemoryTenacity
+	if tenacity <= 10 {
+		return time.Duration(50*tenacity) * time.Microsecond
+	}
+	if tenacity < 100 {
+		return time.Duration(500*math.Pow(1.15, float64(tenacity-10))) * time.Microsecond
+	}
+	return time.Duration(math.MaxInt64)
+}
+
+// performEvictions evicts keys until used memory is within maxmemory, returns evictOK, evictRunning or evictFail.
+// Slaves never evict keys by themselves, they wait for DEL from master. Nothing is evicted during CLIENT PAUSE either,
+// as if eviction were not triggered.
+func (server *Server) performEvictions() int {
+	maxMemory := int64(config.Properties.MaxMemory)
+	if maxMemory <= 0 || server.isSlave() || isWritePaused() || server.usedMemory() <= maxMemory {
+		return evictOK
+	}
+	policy := getMaxMemoryPolicy()
+	if policy == policyNoEviction {
+		return evictFail
+	}
+	evictionMu.Lock()
+	defer evictionMu.Unlock()
+	start := time.Now()
+	limit := evictionTimeLimit()
+	for keysFreed := 1; server.usedMemory() > maxMemory; keysFreed++ {
+		if !server.evictOne(policy) {
+			return evictFail
+		}
+		// checking time is not free, check it every 16 keys like redis
+		if keysFreed%16 == 0 && time.Since(start) > limit {
+			server.startEvictionInBackground()
+			return evictRunning
+		}
+	}
+	return evictOK
+}
+
+// startEvictionInBackground keeps evicting keys in background until used memory is within maxmemory
+func (server *Server) startEvictionInBackground() {
+	if !atomic.CompareAndSwapInt32(&evictionInBackground, 0, 1) {
+		return
+	}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(err)
+			}
+			atomic.StoreInt32(&evictionInBackground, 0)
+		}()
+		for server.performEvictions() == evictRunning {
+			time.Sleep(evictionBackgroundInterval)
+		}
+	}()
+}
+
+// evictOne evicts the most idle candidate, invoker should hold evictionMu
+func (server *Server) evictOne(policy string) bool {
+	for attempt := 0; attempt < evictionPoolSize; attempt++ {
+		server.populateEvictionPool(policy)
+		for len(evictionPool) > 0 {
+			best := evictionPool[len(evictionPool)-1]
+			evictionPool = evictionPool[:len(evictionPool)-1]
+			if best.dbIndex >= len(server.dbSet) {
+				continue
+			}
+			if server.mustSelectDB(best.dbIndex).evictKey(best.key, strings.HasPrefix(policy, "volatile-")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// populateEvictionPool samples keys of each db into evictionPool
+func (server *Server) populateEvictionPool(policy string) {
+	if evictionPoolPolicy != policy {
+		// such as candidates of allkeys-lru may be keys without ttl
+		evictionPool = nil
+		evictionPoolPolicy = policy
+	}
+	samples := getMaxMemorySamples()
+	for i := range server.dbSet {
+		db := server.mustSelectDB(i)
+		var candidates *dict.ConcurrentDict
+		switch policy {
+		case policyAllKeysLRU, policyAllKeysLFU:
+			candidates = db.data
+		case policyVolatileLRU, policyVolatileLFU:
+			candidates = db.ttlMap
+		}
+		if candidates == nil || candidates.Len() == 0 {
+			continue // sampling an empty dict traverses all of its shards
+		}
+		keys := candidates.RandomDistinctKeys(samples)
+		for _, key := range keys {
+			raw, ok := db.data.Get(key)
+			if !ok {
+				continue
+			}
+			entity := raw.(*database.DataEntity)
+			idle := idleTime(entity)
+			if isLFUPolicy(policy) {
+				idle = lfuMaxCounter - int64(lfuDecrAndReturn(atomic.LoadUint32(&entity.Freq)))
+			}
+			addEvictionCandidate(&evictionCandidate{
+				dbIndex: i,
+				key:     key,
+				idle:    idle,
+			})
+		}
+	}
+}
+
+// addEvictionCandidate puts candidate into evictionPool if it is more idle than the least idle one in full pool
+func addEvictionCandidate(candidate *evictionCandidate) {
+	for i, c := range evictionPool {
+		if c.dbIndex == candidate.dbIndex && c.key == candidate.key {
+			evictionPool = append(evictionPool[:i], evictionPool[i+1:]...)
+			break
+		}
+	}
+	if len(evictionPool) >= evictionPoolSize {
+		if candidate.idle <= evictionPool[0].idle {
+			return
+		}
+		evictionPool = evictionPool[1:]
+	}
+	i := sort.Search(len(evictionPool), func(i int) bool {
+		return evictionPool[i].idle > candidate.idle
+	})
+	evictionPool = append(evictionPool, nil)
+	copy(evictionPool[i+1:], evictionPool[i:])
+	evictionPool[i] = candidate
+}
+
+// evictKey removes key and propagates an explicit DEL to aof and slaves,
+// returns false if key is gone, locked by others or has no ttl while volatileOnly.
+// Expired keys are removed as expired, so that they are counted and notified as expired rather than evicted.
+func (db *DB) evictKey(key string, volatileOnly bool) bool {
+	keys := []string{key}
+	if !db.TryRWLocks(keys, nil, evictionLockTimeout) {
+		return false
+	}
+	defer db.RWUnLocks(keys, nil)
+	if _, exists := db.data.GetWithLock(key); !exists {
+		return false
+	}
+	if _, hasTTL := db.ttlMap.Get(key); volatileOnly && !hasTTL {
+		return false
+	}
+	if !db.isSlave() && db.expireIfNeeded(key) {
+		return true
+	}
+	db.Remove(key)
+	db.addAof(utils.ToCmdLine("DEL", key))
+	atomic.AddInt64(&evictedKeys, 1)
+	db.notifyKeyspaceEvent(notifyEvicted, "evicted", key)
+	return true
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/lib/latency"
+	"goRedisPlus/lib/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Expiration:
+// Expire times are kept in ttlMap of each db, the expires dict. An expired key is removed by the first access to it,
+// or by the active expire cycle. Every lookup checks the expires dict and treats expired keys as absent. Writers
+// holding the write lock of the key remove it in place, see expireIfNeeded, while readers hold only the shared lock,
+// so they queue the key for the lazy expire goroutine which removes it with the write lock. The queue drops keys if
+// it is full, they are removed by later accesses or the cycle. Slaves treat expired keys as absent but wait for DEL
+// from master, and so does master during CLIENT PAUSE.
+//
+// Keys never accessed again are removed by the active expire cycle like redis, instead of a timer for each key. The
+// cycle runs every activeExpireInterval and visits databases in turn, sampling keys of the expires dict and removing
+// expired ones. A db is sampled again while the samples hold more expired keys than acceptable, so the fraction of
+// expired keys in memory is kept low without scanning the whole dict, and the cycle stops once it has run for its
+// share of CPU time. Both the number of samples, the acceptable fraction and the share of CPU time are scaled by
+// active-expire-effort.
+
+const lazyExpireQueueSize = 1024
+
+const (
+	activeExpireInterval = 100 * time.Millisecond
+	// defaultExpireEffort is used if active-expire-effort is not set, the same as redis
+	defaultExpireEffort = 1
+	// parameters at effort 1, each level of effort above it adds a quarter of keys per loop, takes 2% more CPU time
+	// and accepts 1% less expired keys
+	activeExpireKeysPerLoop = 20 // keys sampled from a db in a loop
+	activeExpireCyclePerc   = 25 // percent of activeExpireInterval spent in a cycle at most
+	activeExpireStalePerc   = 10 // percent of expired keys in samples to stop sampling the db
+	// expiredStaleSmoothing is the weight in percent of the last cycle in expired_stale_perc
+	expiredStaleSmoothing = 5
+)
+
+// counters of active expire cycle, see INFO stats
+var (
+	expiredStalePerc     int64 // estimated percent of expired keys in dbs, in hundredths
+	expiredTimeCapCycles int64 // cycles stopped by the time limit
+	expireCycleTime      int64 // nanoseconds spent in cycles
+)
+
+type lazyExpireRequest struct {
+	db  *DB
+	key string
+}
+
+var (
+	lazyExpireQueue = make(chan lazyExpireRequest, lazyExpireQueueSize)
+	lazyExpireOnce  sync.Once
+)
+
+// startLazyExpire starts the lazy expire goroutine
+func startLazyExpire() {
+	lazyExpireOnce.Do(func() {
+		go func() {
+			for req := range lazyExpireQueue {
+				keys := []string{req.key}
+				req.db.RWLocks(keys, nil)
+				req.db.expireIfNeeded(req.key)
+				req.db.RWUnLocks(keys, nil)
+			}
+		}()
+	})
+}
+
+// expireLazily returns whether key is expired, and queues expired keys for removal.
+// It is safe for invokers holding read lock of key or no lock at all.
+func (db *DB) expireLazily(key string) bool {
+	if !db.IsExpired(key) {
+		return false
+	}
+	if !db.isSlave() && !isWritePaused() {
+		select {
+		case lazyExpireQueue <- lazyExpireRequest{db: db, key: key}:
+		default:
+		}
+	}
+	return true
+}
+
+func activeExpireEffort() int {
+	if config.Properties.ExpireEffort <= 0 {
+		return defaultExpireEffort
+	}
+	return config.Properties.ExpireEffort
+}
+
+// startActiveExpireCron runs active expire cycles while the server is not a slave, writes are not paused by CLIENT PAUSE
+// and they are not disabled
+func (server *Server) startActiveExpireCron() {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(err)
+			}
+		}()
+		ticker := time.NewTicker(activeExpireInterval)
+		defer ticker.Stop()
+		nextDB := 0
+		for range ticker.C {
+			if server.isSlave() || atomic.LoadInt32(&server.activeExpireOff) != 0 || isWritePaused() {
+				continue
+			}
+			server.activeExpireCycle(&nextDB)
+		}
+	}()
+}
+
+// activeExpireCycle samples dbs from nextDB until the time limit of cycle, nextDB is where the next cycle starts
+func (server *Server) activeExpireCycle(nextDB *int) {
+	effort := activeExpireEffort() - 1
+	keysPerLoop := activeExpireKeysPerLoop + activeExpireKeysPerLoop/4*effort
+	stalePerc := activeExpireStalePerc - effort
+	limit := activeExpireInterval * time.Duration(activeExpireCyclePerc+2*effort) / 100
+
+	start := time.Now()
+	sampled, expired := 0, 0
+	timeCapReached := false
+	for i := 0; i < len(server.dbSet) && !timeCapReached; i++ {
+		db := server.mustSelectDB(*nextDB % len(server.dbSet))
+		*nextDB = (*nextDB + 1) % len(server.dbSet)
+		for db.ttlMap.Len() > 0 {
+			if time.Since(start) >= limit {
+				timeCapReached = true
+				break
+			}
+			s, e := db.sampleExpires(keysPerLoop)
+			sampled += s
+			expired += e
+			if e*100 <= s*stalePerc {
+				break
+			}
+		}
+	}
+	elapsed := time.Since(start)
+	atomic.AddInt64(&expireCycleTime, int64(elapsed))
+	latency.Record("expire-cycle", elapsed)
+	if timeCapReached {
+		atomic.AddInt64(&expiredTimeCapCycles, 1)
+	}
+	current := int64(0)
+	if sampled > 0 {
+		current = int64(expired) * 10000 / int64(sampled)
+	}
+	last := atomic.LoadInt64(&expiredStalePerc)
+	atomic.StoreInt64(&expiredStalePerc, (current*expiredStaleSmoothing+last*(100-expiredStaleSmoothing))/100)
+}
+
+// sampleExpires removes expired keys among count keys sampled from the expires dict, returns the number of keys
+// sampled and removed
+func (db *DB) sampleExpires(count int) (sampled int, expired int) {
+	for _, key := range db.ttlMap.RandomDistinctKeys(count) {
+		sampled++
+		if !db.IsExpired(key) {
+			continue
+		}
+		keys := []string{key}
+		db.RWLocks(keys, nil)
+		if db.expireIfNeeded(key) {
+			expired++
+		}
+		db.RWUnLocks(keys, nil)
+	}
+	return sampled, expired
+}
@@ -0,0 +1,312 @@
+package database
+
+import (
+	"errors"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	failoverWaitForSync = int32(iota)
+	failoverInProgress
+)
+
+// failoverHandshakeTimeout is the max time waiting for target slave to be promoted
+const failoverHandshakeTimeout = 5 * time.Second
+
+// makeFailoverCmd returns `REPLCONF FAILOVER host port` which is sent through replication stream, so offsets of all
+// slaves stay consistent. Only the slave of the given address will turn itself into master after receiving it
+func makeFailoverCmd(host string, port int) []byte {
+	return protocol.MakeMultiBulkReply(utils.ToCmdLine("REPLCONF", "FAILOVER", host, strconv.Itoa(port))).ToBytes()
+}
+
+var failoverAbortedErr = errors.New("failover aborted")
+
+// failoverStatus stores status of a running manual failover
+type failoverStatus struct {
+	state      int32
+	targetHost string
+	targetPort int
+	force      bool
+	// timeout of waiting for target slave to catch up, 0 means no timeout
+	timeout time.Duration
+	abort   chan struct{}
+	// abortOnce makes sure abort is closed only once
+	abortOnce sync.Once
+	// done will be closed after failover finished or aborted, paused writes will continue
+	done chan struct{}
+}
+
+// execFailover coordinates a manual failover
+// FAILOVER [TO host port [FORCE]] [ABORT] [TIMEOUT milliseconds]
+func (server *Server) execFailover(args [][]byte) redis.Reply {
+	var host string
+	var port int
+	var timeoutMs int64
+	var force, abort, hasTo bool
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToLower(string(args[i]))
+		switch arg {
+		case "to":
+			if i+2 >= len(args) {
+				return protocol.MakeSyntaxErrReply()
+			}
+			host = string(args[i+1])
+			p, err := strconv.Atoi(string(args[i+2]))
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			port = p
+			hasTo = true
+			i += 2
+		case "force":
+			force = true
+		case "abort":
+			abort = true
+		case "timeout":
+			if i+1 >= len(args) {
+				return protocol.MakeSyntaxErrReply()
+			}
+			t, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || t <= 0 {
+				return protocol.MakeErrReply("ERR FAILOVER timeout must be greater than 0")
+			}
+			timeoutMs = t
+			i++
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+
+	if abort {
+		if hasTo || force || timeoutMs > 0 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		fo := server.getFailover()
+		if fo == nil {
+			return protocol.MakeErrReply("ERR No failover in progress.")
+		}
+		if atomic.LoadInt32(&fo.state) == failoverInProgress {
+			return protocol.MakeErrReply("ERR FAILOVER cannot be aborted after the target replica has been promoted.")
+		}
+		fo.abortOnce.Do(func() {
+			close(fo.abort)
+		})
+		return protocol.MakeOkReply()
+	}
+	if force && (!hasTo || timeoutMs == 0) {
+		return protocol.MakeErrReply("ERR FAILOVER with force option requires both a timeout and target HOST and IP.")
+	}
+	if atomic.LoadInt32(&server.role) == slaveRole {
+		return protocol.MakeErrReply("ERR FAILOVER is not valid when server is a replica.")
+	}
+	if server.getFailover() != nil {
+		return protocol.MakeErrReply("ERR FAILOVER already in progress.")
+	}
+
+	// choose target slave
+	slaves := server.getSlaveInfos()
+	var target *slaveInfo
+	for _, slave := range slaves {
+		if slave.state != "online" {
+			continue
+		}
+		if hasTo {
+			if slave.ip == host && slave.port == port {
+				target = slave
+				break
+			}
+		} else if slave.priority > 0 && isBetterFailoverTarget(slave, target) {
+			target = slave
+		}
+	}
+	if target == nil {
+		if hasTo {
+			return protocol.MakeErrReply("ERR FAILOVER target HOST and PORT is not a replica.")
+		}
+		return protocol.MakeErrReply("ERR FAILOVER requires connected replicas.")
+	}
+	if target.priority == 0 {
+		return protocol.MakeErrReply("ERR FAILOVER target replica has priority 0 and cannot be promoted.")
+	}
+
+	fo := &failoverStatus{
+		state:      failoverWaitForSync,
+		targetHost: target.ip,
+		targetPort: target.port,
+		force:      force,
+		timeout:    time.Duration(timeoutMs) * time.Millisecond,
+		abort:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	server.failover.Store(fo)
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				logger.Errorf("panic: %v", e)
+			}
+			server.failover.Store((*failoverStatus)(nil))
+			close(fo.done) // resume paused writes
+		}()
+		if err := server.doFailover(fo); err != nil {
+			logger.Errorf("failover to %s:%d failed: %v", fo.targetHost, fo.targetPort, err)
+		}
+	}()
+	return protocol.MakeOkReply()
+}
+
+// isBetterFailoverTarget prefers slave with lower priority, then slave with greater offset
+func isBetterFailoverTarget(slave *slaveInfo, current *slaveInfo) bool {
+	if current == nil {
+		return true
+	}
+	if slave.priority != current.priority {
+		return slave.priority < current.priority
+	}
+	return slave.offset > current.offset
+}
+
+// getFailover returns running failover, or nil if there is no failover in progress
+func (server *Server) getFailover() *failoverStatus {
+	fo, _ := server.failover.Load().(*failoverStatus)
+	return fo
+}
+
+// waitFailover blocks writing clients until running failover finished
+func (server *Server) waitFailover() {
+	fo := server.getFailover()
+	if fo != nil {
+		<-fo.done
+	}
+}
+
+// enterWrite blocks until writes are paused by neither failover nor CLIENT PAUSE, then holds writeGate for reading
+// until the write finished. Pause is checked again holding writeGate, so a write either sees the pause or is waited
+// by drainWrites
+func (server *Server) enterWrite() {
+	for {
+		server.waitFailover()
+		if status := getPause(); status != nil {
+			<-status.done
+			continue
+		}
+		server.writeGate.RLock()
+		if server.getFailover() == nil && getPause() == nil {
+			return
+		}
+		server.writeGate.RUnlock()
+	}
+}
+
+// drainWrites waits for writes which entered before pause was published
+func (server *Server) drainWrites() {
+	server.writeGate.Lock()
+	server.writeGate.Unlock()
+}
+
+func (server *Server) findOnlineSlave(host string, port int) *slaveClient {
+	server.masterStatus.mu.RLock()
+	defer server.masterStatus.mu.RUnlock()
+	for slave := range server.masterStatus.onlineSlaves {
+		if slave.getIp() == host && slave.announcePort == port {
+			return slave
+		}
+	}
+	return nil
+}
+
+func (server *Server) doFailover(fo *failoverStatus) error {
+	// writes have been paused, wait for writes in progress, which may have been acknowledged, to reach backlog
+	server.drainWrites()
+	if server.persister != nil {
+		server.persister.Flush()
+	}
+	server.masterStatus.mu.RLock()
+	targetOffset := server.masterStatus.backlog.currentOffset
+	server.masterStatus.mu.RUnlock()
+	server.requestAckFromSlaves()
+	var deadline <-chan time.Time
+	if fo.timeout > 0 {
+		deadline = time.After(fo.timeout)
+	}
+	for {
+		slave := server.findOnlineSlave(fo.targetHost, fo.targetPort)
+		if slave == nil {
+			return errors.New("target slave disconnected")
+		}
+		server.masterStatus.mu.RLock()
+		synced := slave.ackOffset >= targetOffset
+		server.masterStatus.mu.RUnlock()
+		if synced {
+			break
+		}
+		select {
+		case <-fo.abort:
+			return failoverAbortedErr
+		case <-deadline:
+			if !fo.force {
+				return errors.New("timeout waiting for target slave to catch up")
+			}
+			logger.Info("failover timeout, force promoting target slave")
+		case <-time.After(waitPollInterval):
+			continue
+		}
+		break
+	}
+
+	// promote target slave
+	if server.findOnlineSlave(fo.targetHost, fo.targetPort) == nil {
+		return errors.New("target slave disconnected")
+	}
+	// target slave may have become master once the command is sent, this node must become its slave from now on
+	// whatever happens, otherwise there would be two masters. So abort and timeout are not honoured anymore
+	atomic.StoreInt32(&fo.state, failoverInProgress)
+	server.masterStatus.mu.Lock()
+	server.masterStatus.backlog.appendBytes(makeFailoverCmd(fo.targetHost, fo.targetPort))
+	server.masterStatus.mu.Unlock()
+	if err := server.masterSendUpdatesToSlave(); err != nil {
+		logger.Errorf("masterSendUpdatesToSlave error: %v", err)
+	}
+	// target slave closes the replication link after it becomes master
+	handshakeDeadline := time.After(failoverHandshakeTimeout)
+	for server.findOnlineSlave(fo.targetHost, fo.targetPort) != nil {
+		select {
+		case <-handshakeDeadline:
+			logger.Info("timeout waiting for target slave to be promoted, demote self anyway")
+		case <-time.After(waitPollInterval):
+			continue
+		}
+		break
+	}
+
+	// demote self
+	server.execSlaveOf(nil, utils.ToCmdLine(fo.targetHost, strconv.Itoa(fo.targetPort)))
+	logger.Infof("failover finished, new master is %s:%d", fo.targetHost, fo.targetPort)
+	return nil
+}
+
+// getFailoverStateName returns master_failover_state for INFO replication
+func (server *Server) getFailoverStateName() string {
+	fo := server.getFailover()
+	if fo == nil {
+		return "no-failover"
+	}
+	if atomic.LoadInt32(&fo.state) == failoverWaitForSync {
+		return "waiting-for-sync"
+	}
+	return "failover-in-progress"
+}
+
+// isFailoverCmd returns whether cmdLine is `REPLCONF FAILOVER host port` which is sent by master
+func isFailoverCmd(cmdLine CmdLine) bool {
+	return len(cmdLine) == 4 &&
+		strings.ToLower(string(cmdLine[0])) == "replconf" &&
+		strings.ToLower(string(cmdLine[1])) == "failover"
+}
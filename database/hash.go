@@ -29,7 +29,7 @@ func (db *DB) getOrInitDict(key string) (dict Dict.Dict, inited bool, errReply p
 	}
 	inited = false
 	if dict == nil {
-		dict = Dict.MakeSimple()
+		dict = Dict.MakePacked()
 		db.PutEntity(key, &database.DataEntity{
 			Data: dict,
 		})
@@ -407,6 +407,7 @@ func execHIncrByFloat(db *DB, args [][]byte) redis.Reply {
 	value, exists := dict.Get(field)
 	if !exists {
 		dict.Put(field, args[2])
+		db.addAof(utils.ToCmdLine3("hset", args[0], args[1], args[2]))
 		return protocol.MakeBulkReply(args[2])
 	}
 	val, err := strconv.ParseFloat(string(value.([]byte)), 64)
@@ -416,7 +417,8 @@ func execHIncrByFloat(db *DB, args [][]byte) redis.Reply {
 	result := val + delta
 	resultBytes := []byte(strconv.FormatFloat(result, 'f', -1, 64))
 	dict.Put(field, resultBytes)
-	db.addAof(utils.ToCmdLine3("hincrbyfloat", args...))
+	// propagate result instead of increment, so that replayed value is byte-identical
+	db.addAof(utils.ToCmdLine3("hset", args[0], args[1], resultBytes))
 	return protocol.MakeBulkReply(resultBytes)
 }
 
@@ -496,6 +498,41 @@ func execHRandField(db *DB, args [][]byte) redis.Reply {
 	return &protocol.EmptyMultiBulkReply{}
 }
 
+// execHScan iterates fields and values of hash, or fields only with NOVALUES,
+// command line: hscan key cursor [MATCH pattern] [COUNT count] [NOVALUES]
+func execHScan(db *DB, args [][]byte) redis.Reply {
+	cursor, opts, errReply := parseCollectionScan(args, scanWithNoValues)
+	if errReply != nil {
+		return errReply
+	}
+	dict, errReply := db.getAsDict(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if dict == nil {
+		return makeScanReply(0, nil)
+	}
+	fields, next := scanMembers(cursor, opts.count, dict.Len(), func(consumer func(member string) bool) {
+		dict.ForEach(func(field string, val interface{}) bool {
+			return consumer(field)
+		})
+	})
+	result := make([][]byte, 0, len(fields)*2)
+	for _, field := range fields {
+		if !opts.match(field) {
+			continue
+		}
+		if opts.noValues {
+			result = append(result, []byte(field))
+			continue
+		}
+		val, _ := dict.Get(field)
+		value, _ := val.([]byte)
+		result = append(result, []byte(field), value)
+	}
+	return makeScanReply(next, result)
+}
+
 func init() {
 	registerCommand("HSet", execHSet, writeFirstKey, undoHSet, 4, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM, redisFlagFast}, 1, 1, 1)
@@ -515,8 +552,6 @@ func init() {
 		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM, redisFlagFast}, 1, 1, 1)
 	registerCommand("HMGet", execHMGet, readFirstKey, nil, -3, flagReadOnly).
 		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, 1, 1)
-	registerCommand("HGet", execHGet, readFirstKey, nil, -3, flagReadOnly).
-		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, 1, 1)
 	registerCommand("HKeys", execHKeys, readFirstKey, nil, 2, flagReadOnly).
 		attachCommandExtra([]string{redisFlagReadonly, redisFlagSortForScript}, 1, 1, 1)
 	registerCommand("HVals", execHVals, readFirstKey, nil, 2, flagReadOnly).
@@ -529,4 +564,6 @@ func init() {
 		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM, redisFlagFast}, 1, 1, 1)
 	registerCommand("HRandField", execHRandField, readFirstKey, nil, -2, flagReadOnly).
 		attachCommandExtra([]string{redisFlagRandom, redisFlagReadonly}, 1, 1, 1)
+	registerCommand("HScan", execHScan, readFirstKey, nil, -3, flagReadOnly).
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagRandom}, 1, 1, 1)
 }
@@ -0,0 +1,216 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/metric"
+	"goRedisPlus/redis/protocol"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hot keys:
+// One of every hotkeys-sampling accesses to keys by commands is counted into a frequency sketch of the current
+// interval, see metric.TopK, keys are prefixed by index of db so that keys of different dbs are counted apart.
+// Intervals of hotkeys-interval seconds rotate, HOTKEYS estimates accesses in the last interval by sliding window:
+// accesses of the current interval plus those of the previous interval weighted by its part still in the window.
+// Sampling keeps the cost of tracking a random number for most accesses, rarely accessed keys are missed but
+// they are not what HOTKEYS looks for.
+
+const (
+	// hotKeysCapacity is the number of candidates kept in each interval, it is the most keys HOTKEYS reports
+	hotKeysCapacity     = 128
+	defaultHotKeysCount = 10
+	// defaultHotKeysInterval is used if hotkeys-interval is not set, such as properties not loaded from config file
+	defaultHotKeysInterval = 60 * time.Second
+)
+
+var (
+	hotKeysMu       sync.Mutex
+	hotKeysCurrent  = metric.NewTopK(hotKeysCapacity)
+	hotKeysPrevious *metric.TopK // nil if no access is counted in the previous interval
+	hotKeysStart    = time.Now() // start of the current interval
+)
+
+// trackHotKeys samples keys accessed by a command
+func (db *DB) trackHotKeys(write []string, read []string) {
+	sampling := config.Properties.HotKeysSampling
+	if sampling == 0 {
+		return
+	}
+	var sampled []string
+	for _, keys := range [][]string{write, read} {
+		for _, key := range keys {
+			// sampled randomly rather than every N-th access, which would miss keys accessed in the same period
+			if rand.Intn(sampling) == 0 {
+				sampled = append(sampled, key)
+			}
+		}
+	}
+	if len(sampled) == 0 {
+		return
+	}
+	prefix := strconv.Itoa(db.index) + ":"
+	hotKeysMu.Lock()
+	defer hotKeysMu.Unlock()
+	rotateHotKeys(time.Now())
+	for _, key := range sampled {
+		hotKeysCurrent.Add(prefix+key, 1)
+	}
+}
+
+func hotKeysInterval() time.Duration {
+	if config.Properties.HotKeysInterval <= 0 {
+		return defaultHotKeysInterval
+	}
+	return time.Duration(config.Properties.HotKeysInterval) * time.Second
+}
+
+// rotateHotKeys starts a new interval if the current one is over, invoker should hold hotKeysMu
+func rotateHotKeys(now time.Time) {
+	interval := hotKeysInterval()
+	elapsed := now.Sub(hotKeysStart)
+	if elapsed < interval {
+		return
+	}
+	if elapsed < 2*interval && hotKeysCurrent.Total() > 0 {
+		hotKeysPrevious = hotKeysCurrent
+		hotKeysStart = hotKeysStart.Add(interval)
+	} else {
+		hotKeysPrevious = nil
+		hotKeysStart = now
+	}
+	hotKeysCurrent = metric.NewTopK(hotKeysCapacity)
+}
+
+// resetHotKeys forgets all accesses, counts of different sampling rates or intervals are not comparable
+func resetHotKeys() {
+	hotKeysMu.Lock()
+	defer hotKeysMu.Unlock()
+	hotKeysCurrent = metric.NewTopK(hotKeysCapacity)
+	hotKeysPrevious = nil
+	hotKeysStart = time.Now()
+}
+
+type hotKey struct {
+	dbIndex  int
+	key      string
+	accesses float64
+}
+
+// hotKeys returns at most count keys with the most estimated accesses and the length of window in seconds
+func hotKeys(count int) ([]*hotKey, float64) {
+	hotKeysMu.Lock()
+	defer hotKeysMu.Unlock()
+	now := time.Now()
+	rotateHotKeys(now)
+	interval := hotKeysInterval()
+	elapsed := now.Sub(hotKeysStart)
+	window := elapsed
+	previousWeight := 0.0
+	if hotKeysPrevious != nil {
+		window = interval
+		previousWeight = 1 - float64(elapsed)/float64(interval)
+	}
+	if window < time.Second {
+		window = time.Second // avoid overestimated rates right after rotation
+	}
+
+	candidates := make(map[string]struct{})
+	for _, item := range hotKeysCurrent.Top(hotKeysCapacity) {
+		candidates[item.Key] = struct{}{}
+	}
+	if hotKeysPrevious != nil {
+		for _, item := range hotKeysPrevious.Top(hotKeysCapacity) {
+			candidates[item.Key] = struct{}{}
+		}
+	}
+	sampling := float64(config.Properties.HotKeysSampling)
+	summary := &hotKeysSummary{}
+	for prefixed := range candidates {
+		accesses := float64(hotKeysCurrent.Count(prefixed))
+		if hotKeysPrevious != nil {
+			accesses += float64(hotKeysPrevious.Count(prefixed)) * previousWeight
+		}
+		sep := strings.IndexByte(prefixed, ':')
+		dbIndex, _ := strconv.Atoi(prefixed[:sep])
+		summary.add(&hotKey{
+			dbIndex:  dbIndex,
+			key:      prefixed[sep+1:],
+			accesses: accesses * sampling,
+		}, count)
+	}
+	return summary.top, window.Seconds()
+}
+
+// hotKeysSummary keeps keys sorted by accesses in descending order
+type hotKeysSummary struct {
+	top []*hotKey
+}
+
+func (summary *hotKeysSummary) add(key *hotKey, count int) {
+	i := len(summary.top)
+	for i > 0 && summary.top[i-1].colderThan(key) {
+		i--
+	}
+	if i >= count {
+		return
+	}
+	summary.top = append(summary.top, nil)
+	copy(summary.top[i+1:], summary.top[i:])
+	summary.top[i] = key
+	if len(summary.top) > count {
+		summary.top = summary.top[:count]
+	}
+}
+
+// colderThan orders keys by accesses, ties are broken by db and key to make replies stable
+func (a *hotKey) colderThan(b *hotKey) bool {
+	if a.accesses != b.accesses {
+		return a.accesses < b.accesses
+	}
+	if a.dbIndex != b.dbIndex {
+		return a.dbIndex > b.dbIndex
+	}
+	return a.key > b.key
+}
+
+// execHotKeys reports keys accessed most frequently in the last interval, command line: hotkeys [COUNT count]
+func execHotKeys(args [][]byte) redis.Reply {
+	count := defaultHotKeysCount
+	if len(args) > 0 {
+		if len(args) != 2 || strings.ToLower(string(args[0])) != "count" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		n, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if n < 1 || n > hotKeysCapacity {
+			return protocol.MakeErrReply("ERR COUNT must be between 1 and " + strconv.Itoa(hotKeysCapacity))
+		}
+		count = n
+	}
+	if config.Properties.HotKeysSampling == 0 {
+		return protocol.MakeErrReply("ERR hot keys tracking is disabled, enable it by CONFIG SET hotkeys-sampling")
+	}
+	keys, window := hotKeys(count)
+	result := make([]redis.Reply, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("db")),
+			protocol.MakeIntReply(int64(key.dbIndex)),
+			protocol.MakeBulkReply([]byte("key")),
+			protocol.MakeBulkReply([]byte(key.key)),
+			protocol.MakeBulkReply([]byte("accesses")),
+			protocol.MakeIntReply(int64(math.Round(key.accesses))),
+			protocol.MakeBulkReply([]byte("ops-per-sec")),
+			formatRatio(key.accesses / window),
+		}))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
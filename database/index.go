@@ -0,0 +1,125 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/datastruct/radix"
+	"goRedisPlus/lib/wildcard"
+	"sync"
+)
+
+// Keyspace index:
+// With keyspace-index enabled, each db keeps a radix tree of its keys besides the dict, so that KEYS and SCAN with a
+// pattern of literal prefix such as "user:*" visit keys having the prefix only, instead of all shards of the dict.
+// Keys are added and removed by PutEntity and Remove. Writers of different keys run concurrently, so the tree is
+// guarded by its own lock which every insertion and deletion of keys has to take, that's why it is disabled by
+// default. SCAN over the tree visits keys in lexicographic order, its cursor refers to the last key visited, which
+// is kept in the index for the most recent maxIndexCursors cursors. Cursors of the index start from indexCursorBase,
+// so they never collide with cursors of the dict which are shard indexes. A cursor dropped by concurrent scanners
+// continues the iteration over the dict from its beginning, see execScan, so keys may be returned again, which SCAN
+// allows, but none is missed.
+
+const (
+	maxIndexCursors = 1024
+	// indexCursorBase is above cursors of dict (uint32) and leaves room for node index bits of SCAN in cluster mode
+	indexCursorBase = 1 << 32
+)
+
+// keyIndex is the radix tree of keys in a db, nil if keyspace-index is disabled
+type keyIndex struct {
+	mu         sync.RWMutex
+	tree       *radix.Tree
+	cursors    map[int]string // cursor of SCAN -> the last key visited
+	lastCursor int
+}
+
+func makeKeyIndex() *keyIndex {
+	if !config.Properties.KeyspaceIndex {
+		return nil
+	}
+	return &keyIndex{
+		tree:       radix.New(),
+		cursors:    make(map[int]string),
+		lastCursor: indexCursorBase - 1,
+	}
+}
+
+func (index *keyIndex) add(key string) {
+	if index == nil {
+		return
+	}
+	index.mu.Lock()
+	index.tree.Insert(key)
+	index.mu.Unlock()
+}
+
+func (index *keyIndex) remove(key string) {
+	if index == nil {
+		return
+	}
+	index.mu.Lock()
+	index.tree.Delete(key)
+	index.mu.Unlock()
+}
+
+// usable returns whether the index could find keys matching pattern faster than scanning the dict
+func (index *keyIndex) usable(pattern *wildcard.Pattern) bool {
+	return index != nil && pattern != nil && pattern.Prefix() != ""
+}
+
+// match returns all keys matching pattern
+func (index *keyIndex) match(pattern *wildcard.Pattern) []string {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	var keys []string
+	index.tree.Walk(pattern.Prefix(), "", func(key string) bool {
+		if pattern.IsMatch(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// isIndexCursor returns whether cursor is returned by keyIndex.scan
+func isIndexCursor(cursor int) bool {
+	return cursor >= indexCursorBase
+}
+
+// scan visits at most count keys having the literal prefix of pattern from cursor, it returns keys matching pattern
+// and cursor of the next call, 0 means the iteration is finished. ok is false if cursor is unknown.
+func (index *keyIndex) scan(cursor int, count int, pattern *wildcard.Pattern) (keys []string, next int, ok bool) {
+	visited := 0
+	last := ""
+	finished := true
+	index.mu.RLock()
+	after := ""
+	if cursor != 0 {
+		after, ok = index.cursors[cursor]
+		if !ok {
+			index.mu.RUnlock()
+			return nil, 0, false
+		}
+	}
+	index.tree.Walk(pattern.Prefix(), after, func(key string) bool {
+		if visited >= count {
+			finished = false
+			return false
+		}
+		visited++
+		last = key
+		if pattern.IsMatch(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	index.mu.RUnlock()
+	if finished {
+		return keys, 0, true
+	}
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.lastCursor++
+	index.cursors[index.lastCursor] = last
+	delete(index.cursors, index.lastCursor-maxIndexCursors)
+	return keys, index.lastCursor, true
+}
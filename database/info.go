@@ -0,0 +1,110 @@
+package database
+
+import (
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// InfoSectionGenerator returns content of an INFO section, beginning with its title such as "# Server\r\n"
+type InfoSectionGenerator func(server *Server) []byte
+
+type infoSection struct {
+	name      string
+	isDefault bool // listed by INFO without section and INFO default
+	generate  InfoSectionGenerator
+}
+
+var (
+	infoSectionsMu sync.RWMutex
+	infoSections   []*infoSection // sorted by infoSectionOrder, then by registering order
+)
+
+// infoSectionOrder lists built-in sections in the order of redis, sections registered by others follow them
+var infoSectionOrder = map[string]int{
+	"server":       0,
+	"clients":      1,
+	"memory":       2,
+	"persistence":  3,
+	"stats":        4,
+	"replication":  5,
+	"cluster":      6,
+	"keyspace":     7,
+	"commandstats": 8,
+	"latencystats": 9,
+}
+
+// infoSectionAliases maps legacy section names to registered names
+var infoSectionAliases = map[string]string{
+	"client": "clients",
+}
+
+func getInfoSectionOrder(name string) int {
+	if order, ok := infoSectionOrder[name]; ok {
+		return order
+	}
+	return len(infoSectionOrder)
+}
+
+// RegisterInfoSection adds a section to INFO, or replaces the registered section with the same name.
+// Default sections are listed by INFO without section, others must be selected by name, all or everything.
+func RegisterInfoSection(name string, isDefault bool, generate InfoSectionGenerator) {
+	name = strings.ToLower(name)
+	infoSectionsMu.Lock()
+	defer infoSectionsMu.Unlock()
+	for _, section := range infoSections {
+		if section.name == name {
+			section.isDefault = isDefault
+			section.generate = generate
+			return
+		}
+	}
+	infoSections = append(infoSections, &infoSection{
+		name:      name,
+		isDefault: isDefault,
+		generate:  generate,
+	})
+	sort.SliceStable(infoSections, func(i, j int) bool {
+		return getInfoSectionOrder(infoSections[i].name) < getInfoSectionOrder(infoSections[j].name)
+	})
+}
+
+// Info returns information of the server, command line: info [section [section ...]]
+// section may be a registered section name, default, all or everything. Unknown sections are ignored like redis.
+func Info(server *Server, args [][]byte) redis.Reply {
+	all := false
+	defaults := len(args) == 0
+	selected := make(map[string]bool, len(args))
+	for _, arg := range args {
+		name := strings.ToLower(string(arg))
+		switch name {
+		case "all", "everything":
+			all = true
+		case "default":
+			defaults = true
+		default:
+			if alias, ok := infoSectionAliases[name]; ok {
+				name = alias
+			}
+			selected[name] = true
+		}
+	}
+	infoSectionsMu.RLock()
+	sections := make([]*infoSection, 0, len(infoSections))
+	for _, section := range infoSections {
+		if all || (defaults && section.isDefault) || selected[section.name] {
+			sections = append(sections, section)
+		}
+	}
+	infoSectionsMu.RUnlock()
+	info := make([]byte, 0)
+	for _, section := range sections {
+		if len(info) > 0 {
+			info = append(info, "\r\n"...)
+		}
+		info = append(info, section.generate(server)...)
+	}
+	return protocol.MakeBulkReply(info)
+}
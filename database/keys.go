@@ -6,6 +6,8 @@ import (
 	"goRedisPlus/datastruct/list"
 	"goRedisPlus/datastruct/set"
 	"goRedisPlus/datastruct/sortedset"
+	"goRedisPlus/datastruct/strobj"
+	"goRedisPlus/interface/database"
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/lib/utils"
 	"goRedisPlus/lib/wildcard"
@@ -17,14 +19,35 @@ import (
 
 // execDel removes a key from db
 func execDel(db *DB, args [][]byte) redis.Reply {
+	return db.removeKeys("del", args, false)
+}
+
+// execUnlink removes keys like DEL, but frees big values in background, see lazyfree.go
+func execUnlink(db *DB, args [][]byte) redis.Reply {
+	return db.removeKeys("unlink", args, true)
+}
+
+// removeKeys removes keys for DEL and UNLINK, command line is propagated as cmdName
+func (db *DB) removeKeys(cmdName string, args [][]byte, async bool) redis.Reply {
 	keys := make([]string, len(args))
 	for i, v := range args {
 		keys[i] = string(v)
 	}
 
-	deleted := db.Removes(keys...)
+	deleted := 0
+	for _, key := range keys {
+		if raw, exists := db.data.GetWithLock(key); exists && !db.expireIfNeeded(key) {
+			db.Remove(key)
+			deleted++
+			if async {
+				freeEntityAsync(raw.(*database.DataEntity))
+			}
+			// notify here since only existing keys fire event
+			db.notifyKeyspaceEvent(notifyGeneric, "del", key)
+		}
+	}
 	if deleted > 0 {
-		db.addAof(utils.ToCmdLine3("del", args...))
+		db.addAof(utils.ToCmdLine3(cmdName, args...))
 	}
 	return protocol.MakeIntReply(int64(deleted))
 }
@@ -65,19 +88,28 @@ func execType(db *DB, args [][]byte) redis.Reply {
 	if !exists {
 		return protocol.MakeStatusReply("none")
 	}
+	typeName := getTypeName(entity)
+	if typeName == "" {
+		return &protocol.UnknownErrReply{}
+	}
+	return protocol.MakeStatusReply(typeName)
+}
+
+// getTypeName returns the type of entity reported by TYPE, or empty string if unknown
+func getTypeName(entity *database.DataEntity) string {
 	switch entity.Data.(type) {
-	case []byte:
-		return protocol.MakeStatusReply("string")
+	case []byte, strobj.Int, strobj.Embedded:
+		return "string"
 	case list.List:
-		return protocol.MakeStatusReply("list")
+		return "list"
 	case dict.Dict:
-		return protocol.MakeStatusReply("hash")
+		return "hash"
 	case *set.Set:
-		return protocol.MakeStatusReply("set")
+		return "set"
 	case *sortedset.SortedSet:
-		return protocol.MakeStatusReply("zset")
+		return "zset"
 	}
-	return &protocol.UnknownErrReply{}
+	return ""
 }
 
 func prepareRename(args [][]byte) ([]string, []string) {
@@ -320,11 +352,19 @@ func execKeys(db *DB, args [][]byte) redis.Reply {
 		return protocol.MakeErrReply("ERR illegal wildcard")
 	}
 	result := make([][]byte, 0)
+	if db.keyIndex.usable(pattern) {
+		for _, key := range db.keyIndex.match(pattern) {
+			if !db.expireLazily(key) {
+				result = append(result, []byte(key))
+			}
+		}
+		return protocol.MakeMultiBulkReply(result)
+	}
 	db.data.ForEach(func(key string, val interface{}) bool {
 		if !pattern.IsMatch(key) {
 			return true
 		}
-		if !db.IsExpired(key) {
+		if !db.expireLazily(key) {
 			result = append(result, []byte(key))
 		}
 		return true
@@ -332,6 +372,47 @@ func execKeys(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(result)
 }
 
+// execDBSize returns count of keys in selected database
+func execDBSize(db *DB, args [][]byte) redis.Reply {
+	return protocol.MakeIntReply(int64(db.data.Len()))
+}
+
+const defaultScanCount = 10
+
+// execScan command line: SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func execScan(db *DB, args [][]byte) redis.Reply {
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		return protocol.MakeErrReply("ERR invalid cursor")
+	}
+	opts, errReply := parseScanOptions(args[1:], scanWithType)
+	if errReply != nil {
+		return errReply
+	}
+	var keys []string
+	var next int
+	scanned := false
+	if db.keyIndex.usable(opts.pattern) && (cursor == 0 || isIndexCursor(cursor)) {
+		keys, next, scanned = db.keyIndex.scan(cursor, opts.count, opts.pattern)
+	}
+	if !scanned {
+		if isIndexCursor(cursor) {
+			// cursor has been dropped from index by other scanners, or index is not usable for pattern any longer.
+			// Iterate the dict from the beginning, keys may be returned again but none is missed
+			cursor = 0
+		}
+		keys, next = db.data.DictScan(cursor, opts.count, opts.match)
+	}
+	result := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		// check expiration and type out of the lock of dict shard
+		if !db.expireLazily(key) && opts.matchType(db, key) {
+			result = append(result, []byte(key))
+		}
+	}
+	return makeScanReply(uint64(next), result)
+}
+
 func toTTLCmd(db *DB, key string) *protocol.MultiBulkReply {
 	raw, exists := db.ttlMap.Get(key)
 	if !exists {
@@ -415,18 +496,20 @@ func execCopy(mdb *Server, conn redis.Connection, args [][]byte) redis.Reply {
 func init() {
 	registerCommand("Del", execDel, writeAllKeys, undoDel, -2, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite}, 1, -1, 1)
+	registerCommand("Unlink", execUnlink, writeAllKeys, undoDel, -2, flagWrite).
+		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, -1, 1)
 	registerCommand("Expire", execExpire, writeFirstKey, undoExpire, 3, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
 	registerCommand("ExpireAt", execExpireAt, writeFirstKey, undoExpire, 3, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
 	registerCommand("ExpireTime", execExpireTime, readFirstKey, nil, 2, flagReadOnly).
-		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, 1, 1)
 	registerCommand("PExpire", execPExpire, writeFirstKey, undoExpire, 3, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
 	registerCommand("PExpireAt", execPExpireAt, writeFirstKey, undoExpire, 3, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
 	registerCommand("PExpireTime", execPExpireTime, readFirstKey, nil, 2, flagReadOnly).
-		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, 1, 1)
 	registerCommand("TTL", execTTL, readFirstKey, nil, 2, flagReadOnly).
 		attachCommandExtra([]string{redisFlagReadonly, redisFlagRandom, redisFlagFast}, 1, 1, 1)
 	registerCommand("PTTL", execPTTL, readFirstKey, nil, 2, flagReadOnly).
@@ -434,13 +517,17 @@ func init() {
 	registerCommand("Persist", execPersist, writeFirstKey, undoExpire, 2, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
 	registerCommand("Exists", execExists, readAllKeys, nil, -2, flagReadOnly).
-		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, -1, 1)
 	registerCommand("Type", execType, readFirstKey, nil, 2, flagReadOnly).
 		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, 1, 1)
-	registerCommand("Rename", execRename, prepareRename, undoRename, 3, flagReadOnly).
-		attachCommandExtra([]string{redisFlagWrite}, 1, 1, 1)
-	registerCommand("RenameNx", execRenameNx, prepareRename, undoRename, 3, flagReadOnly).
-		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
+	registerCommand("Rename", execRename, prepareRename, undoRename, 3, flagWrite).
+		attachCommandExtra([]string{redisFlagWrite}, 1, 2, 1)
+	registerCommand("RenameNx", execRenameNx, prepareRename, undoRename, 3, flagWrite).
+		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 2, 1)
 	registerCommand("Keys", execKeys, noPrepare, nil, 2, flagReadOnly).
-		attachCommandExtra([]string{redisFlagReadonly, redisFlagSortForScript}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagSortForScript}, 0, 0, 0)
+	registerCommand("DBSize", execDBSize, noPrepare, nil, 1, flagReadOnly).
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 0, 0, 0)
+	registerCommand("Scan", execScan, noPrepare, nil, -2, flagReadOnly).
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagRandom}, 0, 0, 0)
 }
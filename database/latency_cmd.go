@@ -0,0 +1,116 @@
+package database
+
+import (
+	"fmt"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/latency"
+	"goRedisPlus/redis/protocol"
+	"strings"
+)
+
+// latencyAdvices explains how to reduce spikes of known events, see LATENCY DOCTOR
+var latencyAdvices = map[string]string{
+	"command":          "Some commands are slow, avoid O(N) commands like KEYS and HGETALL/SMEMBERS/LRANGE on big keys, use the SCAN family commands instead.",
+	"fork":             "Snapshots for SAVE, BGSAVE, BGREWRITEAOF and full resynchronization pause aof while flushing it to disk, a faster disk shortens the pause.",
+	"aof-fsync-always": "Fsync of every write is slow with 'appendfsync always', consider 'appendfsync everysec' or a faster disk.",
+	"aof-fsync":        "Fsync of aof file is slow, check the disk or other processes using it, 'appendfsync no' leaves fsync to the operating system.",
+	"expire-cycle":     "Expiring keys is slow, avoid setting the same expire time to many keys, and big keys take long to remove.",
+}
+
+// execLatency executes LATENCY subcommands, command line: latency latest|history|reset|doctor args...
+func execLatency(args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "latest":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("latency|latest")
+		}
+		events := latency.Latest()
+		result := make([]redis.Reply, 0, len(events))
+		for _, event := range events {
+			result = append(result, protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte(event.Name)),
+				protocol.MakeIntReply(event.Latest.Time),
+				protocol.MakeIntReply(event.Latest.Latency),
+				protocol.MakeIntReply(event.Max),
+			}))
+		}
+		return protocol.MakeMultiRawReply(result)
+	case "history":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("latency|history")
+		}
+		samples := latency.History(strings.ToLower(string(args[0])))
+		result := make([]redis.Reply, 0, len(samples))
+		for _, sample := range samples {
+			result = append(result, protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeIntReply(sample.Time),
+				protocol.MakeIntReply(sample.Latency),
+			}))
+		}
+		return protocol.MakeMultiRawReply(result)
+	case "reset":
+		events := make([]string, 0, len(args))
+		for _, arg := range args {
+			events = append(events, strings.ToLower(string(arg)))
+		}
+		return protocol.MakeIntReply(int64(latency.Reset(events...)))
+	case "doctor":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("latency|doctor")
+		}
+		return protocol.MakeBulkReply([]byte(latencyReport()))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try LATENCY HELP.")
+}
+
+// latencyReport analyses recorded events in human-readable text
+func latencyReport() string {
+	events := latency.Latest()
+	if len(events) == 0 {
+		if latency.Threshold() <= 0 {
+			return "Latency monitoring is disabled in this instance. " +
+				"You may use \"CONFIG SET latency-monitor-threshold <milliseconds>.\" if you want to enable it.\n"
+		}
+		return "No latency spike was observed during the lifetime of this instance.\n"
+	}
+	report := &strings.Builder{}
+	report.WriteString("Latency spikes are observed in this instance, here is the report of each event:\n\n")
+	for i, event := range events {
+		samples := latency.History(event.Name)
+		if len(samples) == 0 {
+			continue // reset after listed
+		}
+		var sum int64
+		for _, sample := range samples {
+			sum += sample.Latency
+		}
+		avg := float64(sum) / float64(len(samples))
+		var deviation float64
+		for _, sample := range samples {
+			d := float64(sample.Latency) - avg
+			if d < 0 {
+				d = -d
+			}
+			deviation += d
+		}
+		deviation /= float64(len(samples))
+		var period float64
+		if len(samples) > 1 {
+			period = float64(samples[len(samples)-1].Time-samples[0].Time) / float64(len(samples)-1)
+		}
+		_, _ = fmt.Fprintf(report, "%d. %s: %d latency spikes (average %.0fms, mean deviation %.0fms, period %.2f sec). Worst all time event %dms.\n",
+			i+1, event.Name, len(samples), avg, deviation, period, event.Max)
+	}
+	report.WriteString("\nAdvices:\n")
+	for _, event := range events {
+		if advice, ok := latencyAdvices[event.Name]; ok {
+			report.WriteString("- " + advice + "\n")
+		}
+	}
+	if threshold := latency.Threshold(); threshold > 0 {
+		_, _ = fmt.Fprintf(report, "- Events taking %dms or longer are recorded, tune latency-monitor-threshold to ignore shorter ones.\n", threshold)
+	}
+	return report.String()
+}
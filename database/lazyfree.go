@@ -0,0 +1,99 @@
+package database
+
+import (
+	"goRedisPlus/datastruct/dict"
+	"goRedisPlus/datastruct/list"
+	"goRedisPlus/datastruct/set"
+	"goRedisPlus/datastruct/sortedset"
+	"goRedisPlus/interface/database"
+	"sync"
+	"sync/atomic"
+)
+
+// Lazy freeing:
+// Removed values are reclaimed by go runtime once they are unreachable, what a deleting command does is dropping
+// the last references. UNLINK and FLUSHALL/FLUSHDB ASYNC remove keys from keyspace as DEL and FLUSH do, but hand
+// values with more than lazyfreeThreshold elements and flushed databases to the reclaim goroutine, which drops them
+// out of keyspace locks. Small values are cheaper to drop in place than to queue, the same as redis.
+
+const (
+	// lazyfreeThreshold is the effort above which a value is freed in background, the same as LAZYFREE_THRESHOLD of redis
+	lazyfreeThreshold = 64
+	lazyfreeQueueSize = 1024
+)
+
+var (
+	lazyfreePendingObjects int64 // objects queued but not freed yet, see INFO memory
+	lazyfreedObjects       int64 // objects freed by the reclaim goroutine, see INFO stats
+
+	lazyfreeQueue = make(chan interface{}, lazyfreeQueueSize)
+	lazyfreeOnce  sync.Once
+)
+
+// startLazyfree starts the reclaim goroutine
+func startLazyfree() {
+	lazyfreeOnce.Do(func() {
+		go func() {
+			for obj := range lazyfreeQueue {
+				freeObject(obj)
+			}
+		}()
+	})
+}
+
+// freeObject drops the last reference to obj held by the queue.
+// Flushed dbs are not cleared in place, commands started before flushing may still be using them.
+func freeObject(obj interface{}) {
+	_ = obj
+	atomic.AddInt64(&lazyfreePendingObjects, -1)
+	atomic.AddInt64(&lazyfreedObjects, 1)
+}
+
+// freeEffort returns the number of allocations to free for the value of entity
+func freeEffort(entity *database.DataEntity) int {
+	switch val := entity.Data.(type) {
+	case *list.QuickList:
+		if val.Listpack() != nil {
+			return 1 // a single array
+		}
+		return val.Len()
+	case list.List:
+		return val.Len()
+	case *set.Set:
+		if val.IntSet() != nil {
+			return 1 // a single array
+		}
+		return val.Len()
+	case *dict.PackedDict:
+		if val.Listpack() != nil {
+			return 1
+		}
+		return val.Len()
+	case dict.Dict:
+		return val.Len()
+	case *sortedset.SortedSet:
+		if val.Listpack() != nil {
+			return 1
+		}
+		return int(val.Len())
+	}
+	return 1
+}
+
+// freeAsync hands obj to the reclaim goroutine, obj is dropped in place if the queue is full
+func freeAsync(obj interface{}) {
+	atomic.AddInt64(&lazyfreePendingObjects, 1)
+	select {
+	case lazyfreeQueue <- obj:
+	default:
+		atomic.AddInt64(&lazyfreePendingObjects, -1)
+	}
+}
+
+// freeEntityAsync frees a removed value in background if it is big enough
+func freeEntityAsync(entity *database.DataEntity) {
+	if entity == nil || freeEffort(entity) <= lazyfreeThreshold {
+		return
+	}
+	freeAsync(entity)
+}
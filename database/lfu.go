@@ -0,0 +1,75 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/interface/database"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// LFU:
+// Access frequency is approximated by a Morris counter like redis. Freq of entity packs the time in minutes of
+// the last decrement (high 16 bits) and a logarithmic counter (low 8 bits). On access, the counter is incremented
+// with probability 1/((counter-lfuInitVal)*lfu-log-factor+1), and it is decremented by one every lfu-decay-time
+// minutes. New keys start at lfuInitVal, so they are not evicted before they have a chance to be accessed.
+
+const (
+	lfuInitVal    = 5
+	lfuMaxCounter = 255
+)
+
+// lfuTimeInMinutes returns the clock of LFU decrement, which wraps around in about 45 days
+func lfuTimeInMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 0xffff
+}
+
+// lfuTimeElapsed returns minutes since ldt, the clock may have wrapped around once
+func lfuTimeElapsed(ldt uint32) uint32 {
+	now := lfuTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 0xffff - ldt + now
+}
+
+// lfuLogIncr increments counter logarithmically
+func lfuLogIncr(counter uint32) uint32 {
+	if counter >= lfuMaxCounter {
+		return lfuMaxCounter
+	}
+	baseVal := float64(counter) - lfuInitVal
+	if baseVal < 0 {
+		baseVal = 0
+	}
+	p := 1.0 / (baseVal*float64(config.Properties.LFULogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+// lfuDecrAndReturn returns the counter in freq decremented by elapsed periods of lfu-decay-time
+func lfuDecrAndReturn(freq uint32) uint32 {
+	ldt := freq >> 8
+	counter := freq & lfuMaxCounter
+	if decayTime := config.Properties.LFUDecayTime; decayTime > 0 {
+		periods := lfuTimeElapsed(ldt) / uint32(decayTime)
+		if periods > counter {
+			return 0
+		}
+		counter -= periods
+	}
+	return counter
+}
+
+// initLFU returns Freq of a new key
+func initLFU() uint32 {
+	return lfuTimeInMinutes()<<8 | lfuInitVal
+}
+
+// updateLFU decrements LFU counter of entity by elapsed time, then increments it for the access
+func updateLFU(entity *database.DataEntity) {
+	counter := lfuLogIncr(lfuDecrAndReturn(atomic.LoadUint32(&entity.Freq)))
+	atomic.StoreUint32(&entity.Freq, lfuTimeInMinutes()<<8|counter)
+}
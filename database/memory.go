@@ -0,0 +1,105 @@
+package database
+
+import (
+	"goRedisPlus/datastruct/dict"
+	"goRedisPlus/datastruct/list"
+	"goRedisPlus/datastruct/set"
+	"goRedisPlus/datastruct/sortedset"
+	"goRedisPlus/datastruct/strobj"
+	"goRedisPlus/interface/database"
+)
+
+// Memory estimation:
+// Sizes are rough estimates for capacity planning, containers are sampled instead of traversed,
+// so estimating a big collection is as cheap as a small one.
+
+const (
+	entryOverhead   = 48 // key in dict, DataEntity and pointers
+	elementOverhead = 16 // pointers or slice header of an element in container
+	sampleSize      = 8
+)
+
+// EstimateEntitySize returns estimated bytes used by key and its value
+func EstimateEntitySize(key string, entity *database.DataEntity) int64 {
+	return estimateEntitySize(key, entity, sampleSize)
+}
+
+// estimateEntitySize estimates size of value by at most samples elements, see MEMORY USAGE
+func estimateEntitySize(key string, entity *database.DataEntity, samples int) int64 {
+	size := int64(entryOverhead + len(key))
+	if entity == nil {
+		return size
+	}
+	switch val := entity.Data.(type) {
+	case []byte:
+		size += int64(len(val))
+	case strobj.Int:
+		size += 8 // boxed int64
+	case strobj.Embedded:
+		size += int64(strobj.Len(val))
+	case list.List:
+		if ql, ok := val.(*list.QuickList); ok && ql.Listpack() != nil {
+			size += ql.Listpack().MemoryUsage()
+			break
+		}
+		var sampled, bytes int
+		val.ForEach(func(i int, v interface{}) bool {
+			if b, ok := v.([]byte); ok {
+				bytes += len(b)
+			}
+			sampled++
+			return sampled < samples
+		})
+		size += estimateContainerSize(val.Len(), sampled, bytes)
+	case *set.Set:
+		if intset := val.IntSet(); intset != nil {
+			size += intset.MemoryUsage()
+			break
+		}
+		var sampled, bytes int
+		val.ForEach(func(member string) bool {
+			bytes += len(member)
+			sampled++
+			return sampled < samples
+		})
+		size += estimateContainerSize(val.Len(), sampled, bytes)
+	case dict.Dict:
+		if packed, ok := val.(*dict.PackedDict); ok && packed.Listpack() != nil {
+			size += packed.Listpack().MemoryUsage()
+			break
+		}
+		var sampled, bytes int
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes += len(field)
+			if b, ok := v.([]byte); ok {
+				bytes += len(b)
+			}
+			sampled++
+			return sampled < samples
+		})
+		size += estimateContainerSize(val.Len(), sampled, bytes)
+	case *sortedset.SortedSet:
+		if lp := val.Listpack(); lp != nil {
+			size += lp.MemoryUsage()
+			break
+		}
+		var sampled, bytes int
+		val.ForEachByRank(0, val.Len(), false, func(element *sortedset.Element) bool {
+			bytes += len(element.Member) + 8 // score
+			sampled++
+			return sampled < samples
+		})
+		// skip list node and dict entry for each member
+		size += estimateContainerSize(int(val.Len()), sampled, bytes) + val.Len()*elementOverhead
+	}
+	return size
+}
+
+// estimateContainerSize extrapolates size of container by average size of sampled elements
+func estimateContainerSize(length int, sampled int, sampledBytes int) int64 {
+	if sampled == 0 {
+		return 0
+	}
+	avg := float64(sampledBytes)/float64(sampled) + elementOverhead
+	return int64(avg * float64(length))
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultMemoryUsageSamples is the number of sampled elements of MEMORY USAGE, the same as redis
+const defaultMemoryUsageSamples = 5
+
+// execMemory executes MEMORY subcommands, command line: memory usage|stats|doctor|purge args...
+func (server *Server) execMemory(c redis.Connection, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch subCmd {
+	case "usage":
+		return server.execMemoryUsage(c.GetDBIndex(), args)
+	case "stats":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("memory|stats")
+		}
+		return server.memoryStats()
+	case "doctor":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("memory|doctor")
+		}
+		return protocol.MakeBulkReply([]byte(server.memoryReport()))
+	case "purge":
+		if len(args) != 0 {
+			return protocol.MakeArgNumErrReply("memory|purge")
+		}
+		debug.FreeOSMemory()
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try MEMORY HELP.")
+}
+
+// execMemoryUsage estimates bytes of key and its value, command line: memory usage key [samples count]
+// count is the number of sampled elements of collections, 0 means all elements
+func (server *Server) execMemoryUsage(dbIndex int, args [][]byte) redis.Reply {
+	if len(args) != 1 && len(args) != 3 {
+		return protocol.MakeArgNumErrReply("memory|usage")
+	}
+	samples := defaultMemoryUsageSamples
+	if len(args) == 3 {
+		if strings.ToLower(string(args[1])) != "samples" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		n, err := strconv.Atoi(string(args[2]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if n < 0 {
+			return protocol.MakeSyntaxErrReply()
+		}
+		samples = n
+		if samples == 0 {
+			samples = math.MaxInt32
+		}
+	}
+	db, errReply := server.selectDB(dbIndex)
+	if errReply != nil {
+		return errReply
+	}
+	key := string(args[0])
+	db.RWLocks(nil, []string{key})
+	defer db.RWUnLocks(nil, []string{key})
+	entity, exists := db.lookupEntity(key)
+	if !exists {
+		return protocol.MakeNullBulkReply()
+	}
+	return protocol.MakeIntReply(estimateEntitySize(key, entity, samples))
+}
+
+func formatRatio(value float64) redis.Reply {
+	return protocol.MakeBulkReply([]byte(strconv.FormatFloat(value, 'f', 2, 64)))
+}
+
+func percentage(part uint64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
+
+// memoryStats returns breakdowns of memory in pairs of name and value like redis,
+// allocator.* are from heap of go runtime, dataset.* are estimated sizes of keys
+func (server *Server) memoryStats() redis.Reply {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	server.masterStatus.mu.RLock()
+	backlogSize := len(server.masterStatus.backlog.buf)
+	server.masterStatus.mu.RUnlock()
+
+	var result []redis.Reply
+	add := func(name string, value redis.Reply) {
+		result = append(result, protocol.MakeBulkReply([]byte(name)), value)
+	}
+	add("total.allocated", protocol.MakeIntReply(int64(stats.HeapAlloc)))
+	add("replication.backlog", protocol.MakeIntReply(int64(backlogSize)))
+	var totalKeys int64
+	for i := range server.dbSet {
+		keys, expires := server.GetDBSize(i)
+		if keys == 0 {
+			continue
+		}
+		totalKeys += int64(keys)
+		add("db."+strconv.Itoa(i), protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("keys")),
+			protocol.MakeIntReply(int64(keys)),
+			protocol.MakeBulkReply([]byte("expires")),
+			protocol.MakeIntReply(int64(expires)),
+			protocol.MakeBulkReply([]byte("dataset.bytes")),
+			protocol.MakeIntReply(atomic.LoadInt64(&server.mustSelectDB(i).usedMemory)),
+		}))
+	}
+	dataset := server.usedMemory()
+	var bytesPerKey int64
+	if totalKeys > 0 {
+		bytesPerKey = dataset / totalKeys
+	}
+	add("keys.count", protocol.MakeIntReply(totalKeys))
+	add("keys.bytes-per-key", protocol.MakeIntReply(bytesPerKey))
+	add("dataset.bytes", protocol.MakeIntReply(dataset))
+	add("dataset.percentage", formatRatio(percentage(uint64(dataset), stats.HeapAlloc)))
+	add("allocator.allocated", protocol.MakeIntReply(int64(stats.HeapAlloc)))
+	add("allocator.active", protocol.MakeIntReply(int64(stats.HeapInuse)))
+	add("allocator.resident", protocol.MakeIntReply(int64(stats.HeapSys-stats.HeapReleased)))
+	add("allocator.released", protocol.MakeIntReply(int64(stats.HeapReleased)))
+	add("allocator-fragmentation.ratio", formatRatio(fragmentationRatio(&stats)))
+	add("allocator-fragmentation.bytes", protocol.MakeIntReply(int64(stats.HeapInuse-stats.HeapAlloc)))
+	add("runtime.sys", protocol.MakeIntReply(int64(stats.Sys)))
+	add("runtime.stack", protocol.MakeIntReply(int64(stats.StackInuse)))
+	add("runtime.goroutines", protocol.MakeIntReply(int64(runtime.NumGoroutine())))
+	add("runtime.gc.count", protocol.MakeIntReply(int64(stats.NumGC)))
+	add("runtime.gc.next", protocol.MakeIntReply(int64(stats.NextGC)))
+	add("runtime.gc.pause-total-ms", protocol.MakeIntReply(int64(stats.PauseTotalNs/1e6)))
+	add("runtime.gc.cpu-percentage", formatRatio(stats.GCCPUFraction*100))
+	return protocol.MakeMultiRawReply(result)
+}
+
+// fragmentationRatio is the ratio of heap spans in use to allocated objects
+func fragmentationRatio(stats *runtime.MemStats) float64 {
+	if stats.HeapAlloc == 0 {
+		return 0
+	}
+	return float64(stats.HeapInuse) / float64(stats.HeapAlloc)
+}
+
+// memoryDoctorMinDataset is the dataset below which MEMORY DOCTOR finds nothing meaningful,
+// heap of an empty instance is dominated by shards of dicts and is not worth checking
+const memoryDoctorMinDataset = 5 << 20
+
+// memoryReport detects memory issues by heuristics in human-readable text, see MEMORY DOCTOR
+func (server *Server) memoryReport() string {
+	dataset := server.usedMemory()
+	if dataset < memoryDoctorMinDataset {
+		return "Hi Sam, this instance is empty or is using very little memory, my issues detector can't be used " +
+			"in these conditions. Please, leave for your mission on Earth and fill it with some data. " +
+			"The new Sam and I will be back to our programming as soon as I finished rebooting.\n"
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	var issues []string
+	if ratio := fragmentationRatio(&stats); ratio > 1.4 {
+		issues = append(issues, fmt.Sprintf("High allocator fragmentation: heap spans in use are %.2f times "+
+			"of allocated objects (%s wasted). It usually follows deleting many keys, and goes down as the heap "+
+			"is reused.", ratio, bytesToHuman(stats.HeapInuse-stats.HeapAlloc)))
+	}
+	if idle := stats.HeapIdle - stats.HeapReleased; idle > stats.HeapAlloc/2 && idle > 64<<20 {
+		issues = append(issues, fmt.Sprintf("Memory not returned to OS: %s of heap is free but still held "+
+			"by the go runtime. MEMORY PURGE returns it to the OS.", bytesToHuman(idle)))
+	}
+	if maxMemory := int64(config.Properties.MaxMemory); maxMemory > 0 && dataset > maxMemory/10*9 &&
+		getMaxMemoryPolicy() == policyNoEviction {
+		issues = append(issues, fmt.Sprintf("Near maxmemory: keys take %s of maxmemory %s while "+
+			"maxmemory-policy is noeviction, writes will be refused with OOM once it is exceeded.",
+			bytesToHuman(uint64(dataset)), bytesToHuman(uint64(maxMemory))))
+	}
+	if limit := getMemoryLimit(); limit != noMemoryLimit && float64(stats.HeapInuse) > float64(limit)*0.9 {
+		issues = append(issues, fmt.Sprintf("Near memory limit of go runtime: heap takes %s of the limit %s, "+
+			"GC runs frequently to stay under it. Consider a greater go-memory-limit or a smaller maxmemory.",
+			bytesToHuman(stats.HeapInuse), bytesToHuman(uint64(limit))))
+	}
+	if len(issues) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. " +
+			"I can only account for what occurs on this base.\n"
+	}
+	report := &strings.Builder{}
+	report.WriteString("Sam, I detected a few issues in this Redis instance memory implants:\n\n")
+	for _, issue := range issues {
+		report.WriteString(" * " + issue + "\n\n")
+	}
+	report.WriteString("I'm here to keep you safe, Sam. I want to help you.\n")
+	return report.String()
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/datastruct/dict"
+	"goRedisPlus/datastruct/list"
+	"goRedisPlus/datastruct/set"
+	"goRedisPlus/datastruct/sortedset"
+	"goRedisPlus/datastruct/strobj"
+	"goRedisPlus/interface/database"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// Keyspace notifications:
+// If notify-keyspace-events is set, write commands publish events to __keyspace@<db>__:<key> (K) and
+// __keyevent@<db>__:<event> (E) channels. Classes of events are the same as redis:
+// g (generic commands such as DEL, EXPIRE and RENAME), $ (string), l (list), s (set), h (hash), z (sorted set),
+// x (expired), e (evicted) and A (alias of g$lshzxe).
+// Name of event is the name of command, except rename_from, rename_to and expired.
+
+const (
+	notifyKeyspace = 1 << iota
+	notifyKeyevent
+	notifyGeneric
+	notifyString
+	notifyList
+	notifySet
+	notifyHash
+	notifyZSet
+	notifyExpired
+	notifyEvicted
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet | notifyExpired | notifyEvicted
+)
+
+var notifyFlagChars = map[byte]int{
+	'K': notifyKeyspace,
+	'E': notifyKeyevent,
+	'g': notifyGeneric,
+	'$': notifyString,
+	'l': notifyList,
+	's': notifySet,
+	'h': notifyHash,
+	'z': notifyZSet,
+	'x': notifyExpired,
+	'e': notifyEvicted,
+	'A': notifyAll,
+}
+
+// parseKeyspaceEvents converts notify-keyspace-events to flags, unknown characters are ignored
+func parseKeyspaceEvents(classes string) int {
+	flags := 0
+	for i := 0; i < len(classes); i++ {
+		flags |= notifyFlagChars[classes[i]]
+	}
+	return flags
+}
+
+// genericEvents are commands firing events of generic class, no event is fired if they reply 0.
+// DEL fires events by itself
+var genericEvents = map[string]bool{
+	"expire":    true,
+	"expireat":  true,
+	"pexpire":   true,
+	"pexpireat": true,
+	"persist":   true,
+	"copy":      true,
+	"restore":   true,
+}
+
+// notifyKeyspaceEvent publishes event of key if the class of event is enabled
+func (db *DB) notifyKeyspaceEvent(class int, event string, key string) {
+	flags := parseKeyspaceEvents(config.Properties.KeyspaceEvents)
+	if flags&class == 0 || db.publish == nil {
+		return
+	}
+	index := strconv.Itoa(db.index)
+	if flags&notifyKeyspace > 0 {
+		db.publish("__keyspace@"+index+"__:"+key, event)
+	}
+	if flags&notifyKeyevent > 0 {
+		db.publish("__keyevent@"+index+"__:"+event, key)
+	}
+}
+
+// notifyCommand fires events of keys written by a succeeded command
+func (db *DB) notifyCommand(cmdLine CmdLine, writeKeys []string, result redis.Reply) {
+	if config.Properties.KeyspaceEvents == "" || len(writeKeys) == 0 || protocol.IsErrorReply(result) {
+		return
+	}
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if cmdName == "del" || cmdName == "unlink" {
+		return // see removeKeys
+	}
+	if _, ok := result.(*protocol.NullBulkReply); ok {
+		return // such as SET NX failed
+	}
+	if intReply, ok := result.(*protocol.IntReply); ok && intReply.Code == 0 && (genericEvents[cmdName] || cmdName == "renamenx") {
+		return
+	}
+	if genericEvents[cmdName] {
+		for _, key := range writeKeys {
+			db.notifyKeyspaceEvent(notifyGeneric, cmdName, key)
+		}
+		return
+	}
+	if cmdName == "rename" || cmdName == "renamenx" {
+		db.notifyKeyspaceEvent(notifyGeneric, "rename_from", string(cmdLine[1]))
+		db.notifyKeyspaceEvent(notifyGeneric, "rename_to", string(cmdLine[2]))
+		return
+	}
+	for _, key := range writeKeys {
+		db.notifyKeyspaceEvent(db.getNotifyClass(key), cmdName, key)
+	}
+}
+
+// getNotifyClass returns event class by type of key, removed key is treated as generic
+func (db *DB) getNotifyClass(key string) int {
+	raw, ok := db.data.GetWithLock(key)
+	if !ok {
+		return notifyGeneric
+	}
+	switch raw.(*database.DataEntity).Data.(type) {
+	case []byte, strobj.Int, strobj.Embedded:
+		return notifyString
+	case list.List:
+		return notifyList
+	case *set.Set:
+		return notifySet
+	case dict.Dict:
+		return notifyHash
+	case *sortedset.SortedSet:
+		return notifyZSet
+	}
+	return notifyGeneric
+}
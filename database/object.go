@@ -0,0 +1,94 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/datastruct/dict"
+	"goRedisPlus/datastruct/list"
+	"goRedisPlus/datastruct/set"
+	"goRedisPlus/datastruct/sortedset"
+	"goRedisPlus/datastruct/strobj"
+	"goRedisPlus/interface/database"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	errLFUNotSelected = "ERR An LFU maxmemory policy is not selected, access frequency not tracked. " +
+		"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."
+	errLFUSelected = "ERR An LFU maxmemory policy is selected, idle time not tracked. " +
+		"Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust."
+)
+
+// applyEncodingLimits pushes limits of compact encodings into data structures
+func applyEncodingLimits() {
+	set.SetMaxIntsetEntries(config.Properties.SetMaxIntset)
+	dict.SetMaxListpackEntries(config.Properties.HashMaxListpack)
+	dict.SetMaxListpackValue(config.Properties.HashListpackValue)
+	sortedset.SetMaxListpackEntries(config.Properties.ZSetMaxListpack)
+	sortedset.SetMaxListpackValue(config.Properties.ZSetListpackValue)
+	list.SetMaxListpackSize(config.Properties.ListMaxListpack)
+}
+
+// getEncoding returns the internal representation of value, see OBJECT ENCODING
+func getEncoding(entity *database.DataEntity) string {
+	switch val := entity.Data.(type) {
+	case []byte, strobj.Int, strobj.Embedded:
+		return strobj.Encoding(val)
+	case *list.QuickList:
+		return val.Encoding()
+	case list.List:
+		return "linkedlist"
+	case *dict.PackedDict:
+		return val.Encoding()
+	case dict.Dict:
+		return "hashtable"
+	case *set.Set:
+		return val.Encoding()
+	case *sortedset.SortedSet:
+		return val.Encoding()
+	}
+	return "unknown"
+}
+
+// execObject inspects internals of a key without recording the access, command line: object freq|idletime|encoding key
+func execObject(db *DB, args [][]byte) redis.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	if len(args) != 2 {
+		return protocol.MakeErrReply("ERR unknown subcommand or wrong number of arguments for '" + subCmd + "'. Try OBJECT HELP.")
+	}
+	switch subCmd {
+	case "freq", "idletime", "encoding":
+	default:
+		return protocol.MakeErrReply("ERR unknown subcommand '" + subCmd + "'. Try OBJECT HELP.")
+	}
+	entity, exists := db.lookupEntity(string(args[1]))
+	if !exists {
+		return protocol.MakeNullBulkReply()
+	}
+	if subCmd == "encoding" {
+		return protocol.MakeBulkReply([]byte(getEncoding(entity)))
+	}
+	lfu := isLFUPolicy(getMaxMemoryPolicy())
+	if subCmd == "freq" {
+		if !lfu {
+			return protocol.MakeErrReply(errLFUNotSelected)
+		}
+		return protocol.MakeIntReply(int64(lfuDecrAndReturn(atomic.LoadUint32(&entity.Freq))))
+	}
+	if lfu {
+		return protocol.MakeErrReply(errLFUSelected)
+	}
+	return protocol.MakeIntReply(idleTime(entity))
+}
+
+// readObjectKey returns the key of OBJECT subcommands
+func readObjectKey(args [][]byte) ([]string, []string) {
+	return nil, []string{string(args[1])}
+}
+
+func init() {
+	registerCommand("Object", execObject, readObjectKey, nil, -3, flagReadOnly).
+		attachCommandExtra([]string{redisFlagReadonly}, 2, 2, 1)
+}
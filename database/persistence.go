@@ -10,6 +10,7 @@ import (
 	List "goRedisPlus/datastruct/list"
 	HashSet "goRedisPlus/datastruct/set"
 	SortedSet "goRedisPlus/datastruct/sortedset"
+	"goRedisPlus/datastruct/strobj"
 	"goRedisPlus/interface/database"
 	"os"
 	"sync/atomic"
@@ -36,50 +37,7 @@ func (server *Server) loadRdbFile() error {
 func (server *Server) LoadRDB(dec *core.Decoder) error {
 	return dec.Parse(func(o rdb.RedisObject) bool {
 		db := server.mustSelectDB(o.GetDBIndex())
-		var entity *database.DataEntity
-		switch o.GetType() {
-		case rdb.StringType:
-			str := o.(*rdb.StringObject)
-			entity = &database.DataEntity{
-				Data: str.Value,
-			}
-		case rdb.ListType:
-			listObj := o.(*rdb.ListObject)
-			list := List.NewQuickList()
-			for _, v := range listObj.Values {
-				list.Add(v)
-			}
-			entity = &database.DataEntity{
-				Data: list,
-			}
-		case rdb.HashType:
-			hashObj := o.(*rdb.HashObject)
-			hash := dict.MakeSimple()
-			for k, v := range hashObj.Hash {
-				hash.Put(k, v)
-			}
-			entity = &database.DataEntity{
-				Data: hash,
-			}
-		case rdb.SetType:
-			setObj := o.(*rdb.SetObject)
-			set := HashSet.Make()
-			for _, mem := range setObj.Members {
-				set.Add(string(mem))
-			}
-			entity = &database.DataEntity{
-				Data: set,
-			}
-		case rdb.ZSetType:
-			zsetObj := o.(*rdb.ZSetObject)
-			zSet := SortedSet.Make()
-			for _, e := range zsetObj.Entries {
-				zSet.Add(e.Member, e.Score)
-			}
-			entity = &database.DataEntity{
-				Data: zSet,
-			}
-		}
+		entity := rdbObjectToEntity(o)
 		if entity != nil {
 			db.PutEntity(o.GetKey(), entity)
 			if o.GetExpiration() != nil {
@@ -92,6 +50,54 @@ func (server *Server) LoadRDB(dec *core.Decoder) error {
 	})
 }
 
+// rdbObjectToEntity converts object parsed from rdb to DataEntity, returns nil for unsupported type
+func rdbObjectToEntity(o rdb.RedisObject) *database.DataEntity {
+	switch o.GetType() {
+	case rdb.StringType:
+		str := o.(*rdb.StringObject)
+		return &database.DataEntity{
+			Data: strobj.Encode(str.Value),
+		}
+	case rdb.ListType:
+		listObj := o.(*rdb.ListObject)
+		list := List.NewQuickList()
+		for _, v := range listObj.Values {
+			list.Add(v)
+		}
+		return &database.DataEntity{
+			Data: list,
+		}
+	case rdb.HashType:
+		hashObj := o.(*rdb.HashObject)
+		hash := dict.MakePacked()
+		for k, v := range hashObj.Hash {
+			hash.Put(k, v)
+		}
+		return &database.DataEntity{
+			Data: hash,
+		}
+	case rdb.SetType:
+		setObj := o.(*rdb.SetObject)
+		set := HashSet.Make()
+		for _, mem := range setObj.Members {
+			set.Add(string(mem))
+		}
+		return &database.DataEntity{
+			Data: set,
+		}
+	case rdb.ZSetType:
+		zsetObj := o.(*rdb.ZSetObject)
+		zSet := SortedSet.Make()
+		for _, e := range zsetObj.Entries {
+			zSet.Add(e.Member, e.Score)
+		}
+		return &database.DataEntity{
+			Data: zSet,
+		}
+	}
+	return nil
+}
+
 func NewPersister(db database.DBEngine, filename string, load bool, fsync string) (*aof.Persister, error) {
 	return aof.NewPersister(db, filename, load, fsync, func() database.DBEngine {
 		return MakeAuxiliaryServer()
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"strings"
+)
+
+// Commands could be renamed by `rename-command <command> <new-name>` in config file, and renaming to "" disables
+// the command. Clients could only call a renamed command by its new name, while internal callers such as
+// aof loader, replication and cluster keep using original names, so renaming is applied to commands from clients
+// only, see TranslateCommand.
+
+type commandRenames struct {
+	originals map[string]string   // new name -> original name
+	hidden    map[string]struct{} // original names of renamed or disabled commands
+}
+
+var renames = &commandRenames{}
+
+// initRenamedCommands loads rename-command directives of config
+func initRenamedCommands() error {
+	pairs, err := config.Properties.RenamedCommands()
+	if err != nil {
+		return err
+	}
+	result := &commandRenames{
+		originals: make(map[string]string),
+		hidden:    make(map[string]struct{}),
+	}
+	for _, pair := range pairs {
+		name, newName := pair[0], pair[1]
+		if _, ok := result.hidden[name]; ok {
+			return fmt.Errorf("command '%s' is renamed more than once", name)
+		}
+		result.hidden[name] = struct{}{}
+		if newName == "" {
+			continue
+		}
+		if _, ok := result.originals[newName]; ok {
+			return fmt.Errorf("more than one command are renamed to '%s'", newName)
+		}
+		result.originals[newName] = name
+	}
+	renames = result
+	return nil
+}
+
+// TranslateCommand replaces new name of a renamed command from client with its original name,
+// it returns error reply if the command is called by original name after renamed or disabled.
+func TranslateCommand(cmdLine [][]byte) ([][]byte, redis.Reply) {
+	if len(renames.hidden) == 0 || len(cmdLine) == 0 {
+		return cmdLine, nil
+	}
+	name := strings.ToLower(string(cmdLine[0]))
+	if original, ok := renames.originals[name]; ok {
+		translated := make([][]byte, len(cmdLine))
+		translated[0] = []byte(original)
+		copy(translated[1:], cmdLine[1:])
+		return translated, nil
+	}
+	if _, ok := renames.hidden[name]; ok {
+		return nil, protocol.MakeErrReply("ERR unknown command '" + string(cmdLine[0]) + "'")
+	}
+	return cmdLine, nil
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+)
+
+// Diskless replication (repl-diskless-sync yes):
+// master does not save rdb file for full re-sync, it takes an in-memory snapshot for each full re-sync and writes it into
+// slave socket directly, see writeSnapshot.
+// Replication backlog is collected since the first slave comes, and each snapshot records the offset of backlog when it is taken.
+
+// rdbEOFMarkLen is length of the mark in `$EOF:<mark>`, which ends rdb instead of its size in diskless replication
+const rdbEOFMarkLen = 40
+
+// bgStartDisklessReplication asynchronously starts collecting backlog and sends snapshots to waiting slaves
+func (server *Server) bgStartDisklessReplication() {
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				logger.Errorf("panic: %v", e)
+			}
+		}()
+		server.startDisklessReplication()
+	}()
+}
+
+func (server *Server) startDisklessReplication() {
+	server.masterStatus.mu.Lock()
+	server.masterStatus.bgSaveState = bgSaveRunning
+	server.masterStatus.rdbFilename = ""
+	aofListener := &replAofListener{
+		mdb:     server,
+		backlog: server.masterStatus.backlog,
+	}
+	server.masterStatus.aofListener = aofListener
+	server.masterStatus.mu.Unlock()
+
+	server.persister.AddListener(aofListener)
+	aofListener.readyToSend = true
+
+	waitSlaves := make(map[*slaveClient]struct{})
+	server.masterStatus.mu.Lock()
+	server.masterStatus.bgSaveState = bgSaveFinish
+	for slave := range server.masterStatus.waitSlaves {
+		waitSlaves[slave] = struct{}{}
+	}
+	server.masterStatus.waitSlaves = nil
+	server.masterStatus.mu.Unlock()
+
+	for slave := range waitSlaves {
+		err := server.masterDisklessFullReSyncWithSlave(slave)
+		if err != nil {
+			server.removeSlave(slave)
+			logger.Errorf("masterDisklessFullReSyncWithSlave error: %v", err)
+			continue
+		}
+	}
+}
+
+// masterDisklessFullReSyncWithSlave takes an in-memory snapshot and sends it to slave through socket, then sends following backlog
+func (server *Server) masterDisklessFullReSyncWithSlave(slave *slaveClient) error {
+	server.masterStatus.mu.Lock()
+	slave.state = slaveStateSendingRDB
+	server.masterStatus.mu.Unlock()
+	var snapshotOffset int64
+	var replId string
+	rdb := &bytes.Buffer{}
+	err := server.writeSnapshot(rdb, func() {
+		// writes are blocked now, the snapshot matches current offset of backlog once aof has been flushed into it
+		server.persister.Flush()
+		server.masterStatus.mu.RLock()
+		snapshotOffset = server.masterStatus.backlog.currentOffset
+		replId = server.masterStatus.replId
+		server.masterStatus.mu.RUnlock()
+	})
+	if err != nil {
+		return fmt.Errorf("generate rdb for slave failed: %v", err)
+	}
+	return server.sendSnapshotToSlave(slave, replId, snapshotOffset, rdb.Bytes())
+}
+
+// sendSnapshotToSlave sends replication header, rdb of the snapshot and backlog after the snapshot to slave
+func (server *Server) sendSnapshotToSlave(slave *slaveClient, replId string, snapshotOffset int64, rdb []byte) error {
+	header := "+FULLRESYNC " + replId + " " + strconv.FormatInt(snapshotOffset, 10) + protocol.CRLF
+	var mark []byte
+	if slave.capacity&slaveCapacityEOF > 0 {
+		// slave supports `$EOF:<mark>`, like redis does in diskless replication
+		mark = []byte(utils.RandHexString(rdbEOFMarkLen))
+		header += "$EOF:" + string(mark) + protocol.CRLF
+	} else {
+		header += "$" + strconv.Itoa(len(rdb)) + protocol.CRLF
+	}
+	if _, err := slave.conn.Write([]byte(header)); err != nil {
+		return fmt.Errorf("write replication header to slave failed: %v", err)
+	}
+	if _, err := slave.conn.Write(rdb); err != nil {
+		return fmt.Errorf("write rdb to slave failed: %v", err)
+	}
+	if mark != nil {
+		if _, err := slave.conn.Write(mark); err != nil {
+			return fmt.Errorf("write rdb eof mark to slave failed: %v", err)
+		}
+	}
+
+	// send backlog after snapshot
+	server.masterStatus.mu.RLock()
+	if !server.masterStatus.backlog.isValidOffset(snapshotOffset) {
+		server.masterStatus.mu.RUnlock()
+		return errors.New("backlog after snapshot has been trimmed")
+	}
+	backlog, currentOffset := server.masterStatus.backlog.getSnapshotAfter(snapshotOffset)
+	server.masterStatus.mu.RUnlock()
+	if _, err := slave.conn.Write(backlog); err != nil {
+		return fmt.Errorf("full resync write backlog to slave failed: %v", err)
+	}
+	server.setSlaveOnline(slave, currentOffset)
+	return nil
+}
+
+// trimBacklog drops the head of backlog which has been sent to all online slaves.
+// In diskless mode, there is no rdb file bound with backlog, so backlog could be trimmed directly
+func (server *Server) trimBacklog() {
+	server.masterStatus.mu.Lock()
+	defer server.masterStatus.mu.Unlock()
+	backlog := server.masterStatus.backlog
+	n := int64(len(backlog.buf) - maxBacklogSize/2)
+	for slave := range server.masterStatus.onlineSlaves {
+		if slave.offset-backlog.beginOffset < n {
+			n = slave.offset - backlog.beginOffset
+		}
+	}
+	if n <= 0 {
+		return
+	}
+	backlog.trimHead(n)
+}
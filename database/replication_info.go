@@ -0,0 +1,203 @@
+package database
+
+import (
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// slaveInfo is a snapshot of slaveClient for ROLE and INFO replication
+type slaveInfo struct {
+	ip       string
+	port     int
+	state    string
+	offset   int64
+	lag      int64
+	priority int
+}
+
+// getSlaveInfos returns snapshots of slaves which have finished handshake
+func (server *Server) getSlaveInfos() []*slaveInfo {
+	server.masterStatus.mu.RLock()
+	defer server.masterStatus.mu.RUnlock()
+	slaves := make([]*slaveClient, 0, len(server.masterStatus.slaveMap))
+	for _, slave := range server.masterStatus.slaveMap {
+		if slave.state == slaveStateHandShake {
+			continue
+		}
+		slaves = append(slaves, slave)
+	}
+	sort.Slice(slaves, func(i, j int) bool {
+		return slaves[i].conn.RemoteAddr() < slaves[j].conn.RemoteAddr()
+	})
+	infos := make([]*slaveInfo, len(slaves))
+	for i, slave := range slaves {
+		infos[i] = &slaveInfo{
+			ip:       slave.getIp(),
+			port:     slave.announcePort,
+			state:    slave.getStateName(),
+			offset:   slave.ackOffset,
+			lag:      slave.getLag(),
+			priority: slave.priority,
+		}
+	}
+	return infos
+}
+
+func getLinkStateName(state int32) string {
+	switch state {
+	case replStateConnect:
+		return "connect"
+	case replStateConnecting:
+		return "connecting"
+	case replStateSync:
+		return "sync"
+	case replStateConnected:
+		return "connected"
+	}
+	return "none"
+}
+
+// execRole returns role of this node
+// master: ["master", offset, [[ip, port, offset], ...]]
+// slave: ["slave", master host, master port, link state, offset]
+func (server *Server) execRole(args [][]byte) redis.Reply {
+	if atomic.LoadInt32(&server.role) == slaveRole {
+		repl := server.slaveStatus
+		repl.mutex.Lock()
+		host, port, offset := repl.masterHost, repl.masterPort, repl.replOffset
+		repl.mutex.Unlock()
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("slave")),
+			protocol.MakeBulkReply([]byte(host)),
+			protocol.MakeIntReply(int64(port)),
+			protocol.MakeBulkReply([]byte(getLinkStateName(atomic.LoadInt32(&repl.linkState)))),
+			protocol.MakeIntReply(offset),
+		})
+	}
+	server.masterStatus.mu.RLock()
+	offset := server.masterStatus.backlog.currentOffset
+	server.masterStatus.mu.RUnlock()
+	slaveReplies := make([]redis.Reply, 0)
+	for _, slave := range server.getSlaveInfos() {
+		slaveReplies = append(slaveReplies, protocol.MakeMultiBulkReply([][]byte{
+			[]byte(slave.ip),
+			[]byte(strconv.Itoa(slave.port)),
+			[]byte(strconv.FormatInt(slave.offset, 10)),
+		}))
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("master")),
+		protocol.MakeIntReply(offset),
+		protocol.MakeMultiRawReply(slaveReplies),
+	})
+}
+
+// GetReplOffset returns offset of the replication stream served by this node, see master_repl_offset of INFO
+func (server *Server) GetReplOffset() int64 {
+	server.masterStatus.mu.RLock()
+	defer server.masterStatus.mu.RUnlock()
+	return server.masterStatus.backlog.currentOffset
+}
+
+func init() {
+	RegisterInfoSection("replication", true, (*Server).genReplicationInfo)
+}
+
+// genReplicationInfo returns the replication section of INFO command
+func (server *Server) genReplicationInfo() []byte {
+	var sb strings.Builder
+	sb.WriteString("# Replication\r\n")
+	if atomic.LoadInt32(&server.role) == slaveRole {
+		repl := server.slaveStatus
+		repl.mutex.Lock()
+		linkState := atomic.LoadInt32(&repl.linkState)
+		linkStatus := "down"
+		if linkState == replStateConnected {
+			linkStatus = "up"
+		}
+		lastIO := int64(-1)
+		if !repl.lastRecvTime.IsZero() {
+			lastIO = int64(time.Since(repl.lastRecvTime) / time.Second)
+		}
+		syncInProgress := 0
+		if linkState == replStateSync {
+			syncInProgress = 1
+		}
+		sb.WriteString(fmt.Sprintf("role:slave\r\n"+
+			"master_host:%s\r\n"+
+			"master_port:%d\r\n"+
+			"master_link_status:%s\r\n"+
+			"master_last_io_seconds_ago:%d\r\n"+
+			"master_sync_in_progress:%d\r\n"+
+			"slave_read_repl_offset:%d\r\n"+
+			"slave_repl_offset:%d\r\n",
+			repl.masterHost,
+			repl.masterPort,
+			linkStatus,
+			lastIO,
+			syncInProgress,
+			repl.replOffset,
+			repl.replOffset))
+		if linkState != replStateConnected {
+			downSince := int64(-1)
+			if !repl.linkDownTime.IsZero() {
+				downSince = int64(time.Since(repl.linkDownTime) / time.Second)
+			}
+			sb.WriteString(fmt.Sprintf("master_link_down_since_seconds:%d\r\n", downSince))
+		}
+		sb.WriteString(fmt.Sprintf("slave_priority:%d\r\n"+
+			"slave_read_only:1\r\n",
+			config.Properties.ReplicaPriority))
+		repl.mutex.Unlock()
+	} else {
+		sb.WriteString("role:master\r\n")
+	}
+	slaves := server.getSlaveInfos()
+	sb.WriteString(fmt.Sprintf("connected_slaves:%d\r\n", len(slaves)))
+	if config.Properties.MinReplicasToWrite > 0 {
+		sb.WriteString(fmt.Sprintf("min_slaves_good_slaves:%d\r\n", server.countGoodSlaves()))
+	}
+	for i, slave := range slaves {
+		sb.WriteString(fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, slave.ip, slave.port, slave.state, slave.offset, slave.lag))
+	}
+	server.masterStatus.mu.RLock()
+	backlog := server.masterStatus.backlog
+	backlogActive := 0
+	if server.masterStatus.bgSaveState != bgSaveIdle {
+		backlogActive = 1
+	}
+	replId2 := strings.Repeat("0", 40)
+	secondOffset := int64(-1)
+	if server.masterStatus.replId2 != "" {
+		replId2 = server.masterStatus.replId2
+		secondOffset = server.masterStatus.secondOffset + 1 // offset of the first byte which is not from former master
+	}
+	sb.WriteString(fmt.Sprintf("master_failover_state:%s\r\n"+
+		"master_replid:%s\r\n"+
+		"master_replid2:%s\r\n"+
+		"master_repl_offset:%d\r\n"+
+		"second_repl_offset:%d\r\n"+
+		"repl_backlog_active:%d\r\n"+
+		"repl_backlog_size:%d\r\n"+
+		"repl_backlog_first_byte_offset:%d\r\n"+
+		"repl_backlog_histlen:%d\r\n",
+		server.getFailoverStateName(),
+		server.masterStatus.replId,
+		replId2,
+		backlog.currentOffset,
+		secondOffset,
+		backlogActive,
+		maxBacklogSize,
+		backlog.beginOffset+1,
+		len(backlog.buf)))
+	server.masterStatus.mu.RUnlock()
+	return []byte(sb.String())
+}
@@ -1,8 +1,10 @@
 package database
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"goRedisPlus/config"
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/sync/atomic"
@@ -10,6 +12,7 @@ import (
 	"goRedisPlus/redis/protocol"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -30,6 +33,9 @@ const (
 	bgSaveFinish
 )
 
+// defaultSlavePriority is used when slave does not report its priority
+const defaultSlavePriority = 100
+
 const (
 	slaveCapacityNone = 0
 	slaveCapacityEOF  = 1 << iota
@@ -38,13 +44,54 @@ const (
 
 // slaveClient stores slave status in the view of master
 type slaveClient struct {
-	conn         redis.Connection
-	state        uint8
-	offset       int64
+	conn  redis.Connection
+	state uint8
+	// offset is the replication offset which has been sent to slave
+	offset int64
+	// ackOffset is the replication offset which slave has acknowledged by REPLCONF ACK
+	ackOffset int64
+	// aofAckOffset is the replication offset which has been fsynced into aof of slave, reported by REPLCONF ACK <offset> FACK <offset>
+	aofAckOffset int64
 	lastAckTime  time.Time
 	announceIp   string
 	announcePort int
 	capacity     uint8
+	// priority is replica-priority of slave, slave with lower priority is preferred in failover, 0 means never be promoted
+	priority int
+}
+
+// getIp returns ip announced by slave, or remote ip of the connection
+func (slave *slaveClient) getIp() string {
+	if slave.announceIp != "" {
+		return slave.announceIp
+	}
+	host, _, err := net.SplitHostPort(slave.conn.RemoteAddr())
+	if err != nil {
+		return slave.conn.RemoteAddr()
+	}
+	return host
+}
+
+// getLag returns seconds since last REPLCONF ACK received from slave
+func (slave *slaveClient) getLag() int64 {
+	if slave.lastAckTime.IsZero() {
+		return 0
+	}
+	return int64(time.Since(slave.lastAckTime) / time.Second)
+}
+
+func (slave *slaveClient) getStateName() string {
+	switch slave.state {
+	case slaveStateHandShake:
+		return "handshake"
+	case slaveStateWaitSaveEnd:
+		return "wait_bgsave"
+	case slaveStateSendingRDB:
+		return "send_bulk"
+	case slaveStateOnline:
+		return "online"
+	}
+	return "unknown"
 }
 
 // aofListener is currently only responsible for updating the backlog
@@ -69,12 +116,20 @@ func (backlog *replBacklog) getSnapshotAfter(beginOffset int64) ([]byte, int64)
 }
 
 func (backlog *replBacklog) isValidOffset(offset int64) bool {
-	return offset >= backlog.beginOffset && offset < backlog.currentOffset
+	return offset >= backlog.beginOffset && offset <= backlog.currentOffset
+}
+
+// trimHead drops the first n bytes of backlog
+func (backlog *replBacklog) trimHead(n int64) {
+	backlog.buf = append([]byte(nil), backlog.buf[n:]...)
+	backlog.beginOffset += n
 }
 
 type masterStatus struct {
 	mu           sync.RWMutex
 	replId       string
+	replId2      string // replication id of the former master, it is valid until secondOffset. see shiftReplId
+	secondOffset int64
 	backlog      *replBacklog
 	slaveMap     map[redis.Connection]*slaveClient
 	waitSlaves   map[*slaveClient]struct{}
@@ -83,6 +138,7 @@ type masterStatus struct {
 	rdbFilename  string
 	aofListener  *replAofListener
 	rewriting    atomic.Boolean
+	lastPingTime time.Time
 }
 
 // bgSaveForReplication does bg-save and send rdb to waiting slaves
@@ -224,7 +280,8 @@ var cannotPartialSync = errors.New("cannot do partial sync")
 
 func (server *Server) masterTryPartialSyncWithSlave(slave *slaveClient, replId string, slaveOffset int64) error {
 	server.masterStatus.mu.RLock()
-	if replId != server.masterStatus.replId {
+	if replId != server.masterStatus.replId &&
+		(replId != server.masterStatus.replId2 || slaveOffset > server.masterStatus.secondOffset) {
 		server.masterStatus.mu.RUnlock()
 		return cannotPartialSync
 	}
@@ -264,6 +321,12 @@ func (server *Server) masterSendUpdatesToSlave() error {
 	}
 	server.masterStatus.mu.RUnlock()
 	for slave := range onlineSlaves {
+		if slave.offset < beginOffset {
+			// the stream slave needs has been dropped from backlog
+			logger.Errorf("slave %s is too far behind backlog", slave.conn.Name())
+			server.removeSlave(slave)
+			continue
+		}
 		slaveBeginOffset := slave.offset - beginOffset
 		_, err := slave.conn.Write(backlog[slaveBeginOffset:])
 		if err != nil {
@@ -282,20 +345,45 @@ func (server *Server) execPSync(c redis.Connection, args [][]byte) redis.Reply {
 	if err != nil {
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
+	if server.persister == nil && !server.isSlave() {
+		// replication stream of master comes from aof, see replAofListener
+		return protocol.MakeErrReply("ERR replication requires appendonly enabled")
+	}
 	server.masterStatus.mu.Lock()
 	defer server.masterStatus.mu.Unlock()
 	slave := server.masterStatus.slaveMap[c]
 	if slave == nil {
 		slave = &slaveClient{
-			conn: c,
+			conn:     c,
+			priority: defaultSlavePriority,
 		}
-		c.SetSlave()
 		server.masterStatus.slaveMap[c] = slave
 	}
+	c.SetSlave()
+	if server.isSlave() {
+		// chained replication, sub-slaves replicate the stream of upstream master, see relayUpstream
+		slave.state = slaveStateWaitSaveEnd
+		go func() {
+			defer func() {
+				if e := recover(); e != nil {
+					logger.Errorf("panic: %v", e)
+				}
+			}()
+			if err := server.syncWithSubSlave(slave, replId, replOffset); err != nil {
+				server.removeSlave(slave)
+				logger.Errorf("syncWithSubSlave error: %v", err)
+			}
+		}()
+		return &protocol.NoReply{}
+	}
 	if server.masterStatus.bgSaveState == bgSaveIdle {
 		slave.state = slaveStateWaitSaveEnd
 		server.masterStatus.waitSlaves[slave] = struct{}{}
-		server.bgSaveForReplication()
+		if config.Properties.ReplDisklessSync {
+			server.bgStartDisklessReplication()
+		} else {
+			server.bgSaveForReplication()
+		}
 	} else if server.masterStatus.bgSaveState == bgSaveRunning {
 		slave.state = slaveStateWaitSaveEnd
 		server.masterStatus.waitSlaves[slave] = struct{}{}
@@ -316,7 +404,13 @@ func (server *Server) execPSync(c redis.Connection, args [][]byte) redis.Reply {
 				return
 			}
 			// assert err == cannotPartialSync
-			if err := server.masterFullReSyncWithSlave(slave); err != nil {
+			if server.masterStatus.rdbFilename == "" {
+				// diskless replication, there is no rdb file
+				err = server.masterDisklessFullReSyncWithSlave(slave)
+			} else {
+				err = server.masterFullReSyncWithSlave(slave)
+			}
+			if err != nil {
 				server.removeSlave(slave)
 				logger.Errorf("masterFullReSyncWithSlave error: %v", err)
 				return
@@ -330,23 +424,65 @@ func (server *Server) execReplConf(c redis.Connection, args [][]byte) redis.Repl
 	if len(args)%2 != 0 {
 		return protocol.MakeSyntaxErrReply()
 	}
-	server.masterStatus.mu.RLock()
+	server.masterStatus.mu.Lock()
 	slave := server.masterStatus.slaveMap[c]
-	server.masterStatus.mu.RUnlock()
+	if slave == nil {
+		// slave sends REPLCONF before PSYNC during handshake
+		slave = &slaveClient{
+			conn:     c,
+			state:    slaveStateHandShake,
+			priority: defaultSlavePriority,
+		}
+		server.masterStatus.slaveMap[c] = slave
+	}
+	server.masterStatus.mu.Unlock()
+	isAck := false
 	for i := 0; i < len(args); i += 2 {
 		key := strings.ToLower(string(args[i]))
 		value := string(args[i+1])
 		switch key {
-		case "ack":
+		case "ack", "fack":
 			offset, err := strconv.ParseInt(value, 10, 64)
 			if err != nil {
 				return protocol.MakeErrReply("ERR value is not an integer or out of range")
 			}
-			slave.offset = offset
-			slave.lastAckTime = time.Now()
-			return &protocol.NoReply{}
+			server.masterStatus.mu.Lock()
+			if key == "ack" {
+				if offset > slave.ackOffset {
+					slave.ackOffset = offset
+				}
+				slave.lastAckTime = time.Now()
+			} else if offset > slave.aofAckOffset {
+				slave.aofAckOffset = offset
+			}
+			server.masterStatus.mu.Unlock()
+			isAck = true
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			slave.announcePort = port
+		case "priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil || priority < 0 {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			slave.priority = priority
+		case "ip-address":
+			slave.announceIp = value
+		case "capa":
+			if strings.ToLower(value) == "eof" {
+				slave.capacity |= slaveCapacityEOF
+			} else if strings.ToLower(value) == "psync2" {
+				slave.capacity |= slaveCapacityPsync2
+			}
 		}
 	}
+	if isAck {
+		// master never replies REPLCONF ACK
+		return &protocol.NoReply{}
+	}
 	return protocol.MakeOkReply()
 }
 
@@ -360,11 +496,51 @@ func (server *Server) removeSlave(slave *slaveClient) {
 	logger.Info("disconnect with slave " + slave.conn.Name())
 }
 
+// countGoodSlaves returns how many online slaves whose lag is not greater than min-replicas-max-lag
+func (server *Server) countGoodSlaves() int {
+	server.masterStatus.mu.RLock()
+	defer server.masterStatus.mu.RUnlock()
+	maxLag := int64(config.Properties.MinReplicasMaxLag)
+	count := 0
+	for slave := range server.masterStatus.onlineSlaves {
+		if slave.getLag() <= maxLag {
+			count++
+		}
+	}
+	return count
+}
+
+// checkMinReplicas returns error reply if there are not enough good slaves to accept writes
+// like redis, setting min-replicas-to-write or min-replicas-max-lag to 0 disables it
+func (server *Server) checkMinReplicas() redis.Reply {
+	if config.Properties.MinReplicasToWrite <= 0 || config.Properties.MinReplicasMaxLag <= 0 {
+		return nil
+	}
+	if server.countGoodSlaves() < config.Properties.MinReplicasToWrite {
+		return protocol.MakeErrReply("NOREPLICAS Not enough good replicas to write.")
+	}
+	return nil
+}
+
+// forgetSlave removes slave status of a closed connection
+func (server *Server) forgetSlave(c redis.Connection) {
+	server.masterStatus.mu.Lock()
+	defer server.masterStatus.mu.Unlock()
+	slave := server.masterStatus.slaveMap[c]
+	if slave == nil {
+		return
+	}
+	delete(server.masterStatus.slaveMap, c)
+	delete(server.masterStatus.waitSlaves, slave)
+	delete(server.masterStatus.onlineSlaves, slave)
+}
+
 func (server *Server) setSlaveOnline(slave *slaveClient, currentOffset int64) {
 	server.masterStatus.mu.Lock()
 	defer server.masterStatus.mu.Unlock()
 	slave.state = slaveStateOnline
 	slave.offset = currentOffset
+	slave.lastAckTime = time.Now() // start checking repl-timeout
 	server.masterStatus.onlineSlaves[slave] = struct{}{}
 }
 
@@ -372,21 +548,45 @@ var pingBytes = protocol.MakeMultiBulkReply(utils.ToCmdLine("ping")).ToBytes()
 
 const maxBacklogSize = 10 * 1024 * 1024 // 10MB
 
+// getReplPingPeriod returns repl-ping-replica-period, master sends PING to slaves in this period
+func getReplPingPeriod() time.Duration {
+	if config.Properties.ReplPingPeriod > 0 {
+		return time.Duration(config.Properties.ReplPingPeriod) * time.Second
+	}
+	return 10 * time.Second
+}
+
 func (server *Server) masterCron() {
 	server.masterStatus.mu.Lock()
 	if len(server.masterStatus.slaveMap) == 0 { // no slaves, do nothing
 		server.masterStatus.mu.Unlock()
 		return
 	}
-	if server.masterStatus.bgSaveState == bgSaveFinish {
+	if server.masterStatus.bgSaveState == bgSaveFinish &&
+		time.Since(server.masterStatus.lastPingTime) >= getReplPingPeriod() {
 		server.masterStatus.backlog.appendBytes(pingBytes)
+		server.masterStatus.lastPingTime = time.Now()
 	}
 	backlogSize := len(server.masterStatus.backlog.buf)
+	// slaves which have not sent REPLCONF ACK during repl-timeout are considered as down
+	var timeoutSlaves []*slaveClient
+	minLastAckTime := time.Now().Add(-getReplTimeout())
+	for slave := range server.masterStatus.onlineSlaves {
+		if slave.lastAckTime.Before(minLastAckTime) {
+			timeoutSlaves = append(timeoutSlaves, slave)
+		}
+	}
 	server.masterStatus.mu.Unlock()
+	for _, slave := range timeoutSlaves {
+		logger.Info("slave timeout " + slave.conn.Name())
+		server.removeSlave(slave)
+	}
 	if err := server.masterSendUpdatesToSlave(); err != nil {
 		logger.Errorf("masterSendUpdatesToSlave error: %v", err)
 	}
-	if backlogSize > maxBacklogSize && !server.masterStatus.rewriting.Get() {
+	if backlogSize > maxBacklogSize && config.Properties.ReplDisklessSync && server.masterStatus.rdbFilename == "" {
+		server.trimBacklog()
+	} else if backlogSize > maxBacklogSize && !server.masterStatus.rewriting.Get() {
 		go func() {
 			server.masterStatus.rewriting.Set(true)
 			defer server.masterStatus.rewriting.Set(false)
@@ -425,6 +625,7 @@ func (server *Server) initMaster() {
 	server.masterStatus = &masterStatus{
 		mu:           sync.RWMutex{},
 		replId:       utils.RandHexString(40),
+		secondOffset: -1,
 		backlog:      &replBacklog{},
 		slaveMap:     make(map[redis.Connection]*slaveClient),
 		waitSlaves:   make(map[*slaveClient]struct{}),
@@ -434,6 +635,101 @@ func (server *Server) initMaster() {
 	}
 }
 
+// relayUpstream makes this slave serve its own slaves (sub-slaves) with the replication stream of upstream master:
+// replication id, offsets and backlog are those received from upstream, see receiveAOF. It is invoked whenever they
+// change, sub-slaves are disconnected and they could continue by partial sync if the stream they got is still valid.
+// If replication id of upstream has changed, the former one is kept until current offset like shiftReplId.
+// invoker should provide with slaveStatus.mutex
+func (server *Server) relayUpstream() {
+	repl := server.slaveStatus
+	server.masterStatus.mu.RLock()
+	formerReplId := server.masterStatus.replId
+	formerBacklog := server.masterStatus.backlog
+	server.masterStatus.mu.RUnlock()
+	server.stopMaster()
+	if repl.backlog == nil {
+		// data set is being replaced by full re-sync, nothing could be served until it finished
+		return
+	}
+	server.masterStatus.mu.Lock()
+	defer server.masterStatus.mu.Unlock()
+	server.masterStatus.replId = repl.replId
+	server.masterStatus.backlog = repl.backlog
+	if formerReplId != "" && formerReplId != repl.replId && formerBacklog == repl.backlog {
+		server.masterStatus.replId2 = formerReplId
+		server.masterStatus.secondOffset = repl.backlog.currentOffset
+	}
+}
+
+// syncWithSubSlave does partial sync with sub-slave if it could continue the stream of upstream master, otherwise
+// full re-sync with an in-memory snapshot taken at current offset of the stream
+func (server *Server) syncWithSubSlave(slave *slaveClient, replId string, replOffset int64) error {
+	err := server.masterTryPartialSyncWithSlave(slave, replId, replOffset)
+	if err != cannotPartialSync {
+		return err
+	}
+	server.masterStatus.mu.Lock()
+	slave.state = slaveStateSendingRDB
+	server.masterStatus.mu.Unlock()
+	repl := server.slaveStatus
+	repl.mutex.Lock()
+	if repl.backlog == nil {
+		repl.mutex.Unlock()
+		return errors.New("data set is not synced with master")
+	}
+	// data set of slave is only changed by the stream from upstream, which is applied holding slaveStatus.mutex
+	upstreamReplId, snapshotOffset := repl.replId, repl.replOffset
+	rdb := &bytes.Buffer{}
+	err = server.writeSnapshot(rdb, nil)
+	repl.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("generate rdb for sub-slave failed: %v", err)
+	}
+	return server.sendSnapshotToSlave(slave, upstreamReplId, snapshotOffset, rdb.Bytes())
+}
+
+// shiftReplId is invoked when this slave is promoted to master.
+// Data set of this node is identical with the former master at offset, so a new replication id is generated
+// and slaves of the former master could continue partial sync with this node using masterReplId until offset.
+// parameter backlog is the replication stream received from the former master, it ends at offset
+func (server *Server) shiftReplId(masterReplId string, offset int64, backlog *replBacklog) {
+	server.stopMaster()
+	if server.persister != nil {
+		// commands received from former master have been in backlog, they should not be appended again
+		server.persister.Flush()
+	}
+	aofListener := &replAofListener{
+		mdb:         server,
+		backlog:     backlog,
+		readyToSend: true,
+	}
+	replId := utils.RandHexString(40)
+	server.masterStatus.mu.Lock()
+	server.masterStatus.replId = replId
+	server.masterStatus.replId2 = masterReplId
+	server.masterStatus.secondOffset = offset
+	server.masterStatus.backlog = backlog
+	if server.persister != nil {
+		// like diskless replication, snapshot for full re-sync would be generated on demand
+		server.masterStatus.aofListener = aofListener
+		server.masterStatus.bgSaveState = bgSaveFinish
+	}
+	server.masterStatus.mu.Unlock()
+	if server.persister != nil {
+		server.persister.AddListener(aofListener)
+	}
+	logger.Info(fmt.Sprintf("new replication id %s, former id %s until offset %d", replId, masterReplId, offset))
+}
+
+// changeReplId generates a new replication id and forgets the former one, slaves have to do full re-sync
+func (server *Server) changeReplId() {
+	server.masterStatus.mu.Lock()
+	defer server.masterStatus.mu.Unlock()
+	server.masterStatus.replId = utils.RandHexString(40)
+	server.masterStatus.replId2 = ""
+	server.masterStatus.secondOffset = -1
+}
+
 func (server *Server) stopMaster() {
 	server.masterStatus.mu.Lock()
 	defer server.masterStatus.mu.Unlock()
@@ -453,6 +749,8 @@ func (server *Server) stopMaster() {
 	_ = os.Remove(server.masterStatus.rdbFilename)
 	server.masterStatus.rdbFilename = ""
 	server.masterStatus.replId = ""
+	server.masterStatus.replId2 = ""
+	server.masterStatus.secondOffset = -1
 	server.masterStatus.backlog = &replBacklog{}
 	server.masterStatus.slaveMap = make(map[redis.Connection]*slaveClient)
 	server.masterStatus.waitSlaves = make(map[*slaveClient]struct{})
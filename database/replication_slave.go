@@ -29,6 +29,15 @@ const (
 	slaveRole
 )
 
+// states of the link with master, see ROLE command
+const (
+	replStateNone = int32(iota)
+	replStateConnect
+	replStateConnecting
+	replStateSync
+	replStateConnected
+)
+
 type slaveStatus struct {
 	mutex  sync.Mutex
 	ctx    context.Context
@@ -41,11 +50,23 @@ type slaveStatus struct {
 
 	masterHost string
 	masterPort int
-
-	masterConn   net.Conn
-	masterChan   <-chan *parser.Payload
-	replId       string
-	replOffset   int64
+	// linkState is state of the link with master, it should be accessed atomically
+	linkState int32
+	// linkDownTime is when the link with master became down
+	linkDownTime time.Time
+	// retryTimes is the times of continuous failed reconnecting, it decides backoff of the next reconnecting
+	retryTimes uint
+
+	masterConn net.Conn
+	masterChan <-chan *parser.Payload
+	replId     string
+	replOffset int64
+	// aofOffset is the replication offset which has been fsynced into local aof, reported to master by REPLCONF ACK FACK
+	aofOffset int64
+	// backlog stores replication stream received from master, it ends at replOffset.
+	// It is nil if data set is not consistent with replOffset, such as during full re-sync.
+	// It becomes backlog of this node after promoted, see shiftReplId
+	backlog      *replBacklog
 	lastRecvTime time.Time
 	running      sync.WaitGroup
 }
@@ -70,23 +91,73 @@ func (server *Server) execSlaveOf(c redis.Connection, args [][]byte) redis.Reply
 		return protocol.MakeErrReply("ERR value is not an integer or out of range")
 	}
 	server.slaveStatus.mutex.Lock()
-	atomic.StoreInt32(&server.role, slaveRole)
+	oldRole := atomic.SwapInt32(&server.role, slaveRole)
+	if oldRole == masterRole {
+		server.inheritReplId()
+		server.relayUpstream()
+	}
 	server.slaveStatus.masterHost = host
 	server.slaveStatus.masterPort = port
 	atomic.AddInt32(&server.slaveStatus.configVersion, 1)
+	atomic.StoreInt32(&server.slaveStatus.linkState, replStateConnect)
+	server.slaveStatus.linkDownTime = time.Now()
+	server.slaveStatus.retryTimes = 0
 	server.slaveStatus.mutex.Unlock()
 	go server.setupMaster()
 	return protocol.MakeOkReply()
 }
 
+// setupReplicaOf starts replication with the master given by `replicaof` config
+// The master could be a real redis-server, so that data could be migrated into goRedisPlus without downtime:
+// goRedisPlus loads rdb of redis-server and keeps applying its replication stream until `SLAVEOF NO ONE` is sent for cutover.
+// Only redis-server 7.0 or earlier is supported, since rdb of newer versions could not be loaded, see maxRDBVersion.
+func (server *Server) setupReplicaOf() {
+	fields := strings.Fields(config.Properties.ReplicaOf)
+	if len(fields) != 2 {
+		logger.Error("illegal replicaof config: " + config.Properties.ReplicaOf)
+		return
+	}
+	reply := server.execSlaveOf(nil, utils.ToCmdLine(fields[0], fields[1]))
+	if protocol.IsErrorReply(reply) {
+		logger.Error("replicaof failed: " + string(reply.ToBytes()))
+	}
+}
+
+// inheritReplId is invoked when a master becomes slave, it uses replication id and offset of itself for the first psync.
+// If the new master is a former slave of this node, partial sync could be done, see shiftReplId
+// invoker should provide with slaveStatus.mutex
+func (server *Server) inheritReplId() {
+	if server.persister != nil {
+		// make sure backlog has caught up with data set
+		server.persister.Flush()
+	}
+	server.masterStatus.mu.RLock()
+	defer server.masterStatus.mu.RUnlock()
+	if server.masterStatus.bgSaveState != bgSaveFinish {
+		// backlog is not collected
+		return
+	}
+	offset := server.masterStatus.backlog.currentOffset
+	server.slaveStatus.replId = server.masterStatus.replId
+	server.slaveStatus.replOffset = offset
+	// the stream in backlog is kept for slaves of this node, see relayUpstream
+	server.slaveStatus.backlog = server.masterStatus.backlog
+}
+
 func (server *Server) slaveOfNone() {
 	server.slaveStatus.mutex.Lock()
 	defer server.slaveStatus.mutex.Unlock()
+	server.slaveStatus.stopSlaveWithMutex()
+	if server.slaveStatus.backlog != nil && server.slaveStatus.replId != "" {
+		// slaves of the former master could continue partial sync with this node
+		server.shiftReplId(server.slaveStatus.replId, server.slaveStatus.replOffset, server.slaveStatus.backlog)
+	}
 	server.slaveStatus.masterHost = ""
 	server.slaveStatus.masterPort = 0
 	server.slaveStatus.replId = ""
 	server.slaveStatus.replOffset = -1
-	server.slaveStatus.stopSlaveWithMutex()
+	server.slaveStatus.backlog = nil
+	atomic.StoreInt32(&server.slaveStatus.linkState, replStateNone)
 	server.role = masterRole
 }
 
@@ -107,6 +178,9 @@ func (repl *slaveStatus) stopSlaveWithMutex() {
 	}
 	repl.masterConn = nil
 	repl.masterChan = nil
+	if atomic.SwapInt32(&repl.linkState, replStateConnect) == replStateConnected {
+		repl.linkDownTime = time.Now()
+	}
 }
 
 func (repl *slaveStatus) close() error {
@@ -130,39 +204,94 @@ func (server *Server) setupMaster() {
 	server.slaveStatus.cancel = cancel
 	configVersion = server.slaveStatus.configVersion
 	server.slaveStatus.mutex.Unlock()
+	atomic.StoreInt32(&server.slaveStatus.linkState, replStateConnecting)
 	isFullReSync, err := server.connectWithMaster(configVersion)
 	if err != nil {
-		// connect failed, abort master
+		// connect failed, retry later
 		logger.Error(err)
-		server.slaveOfNone()
+		server.reconnectLater(configVersion)
 		return
 	}
 	if isFullReSync {
+		atomic.StoreInt32(&server.slaveStatus.linkState, replStateSync)
 		err = server.loadMasterRDB(configVersion)
 		if err != nil {
-			// load failed, abort master
+			// load failed, retry later
 			logger.Error(err)
-			server.slaveOfNone()
+			server.reconnectLater(configVersion)
 			return
 		}
 	}
+	server.slaveStatus.mutex.Lock()
+	server.slaveStatus.retryTimes = 0
+	server.slaveStatus.mutex.Unlock()
+	atomic.StoreInt32(&server.slaveStatus.linkState, replStateConnected)
 	err = server.receiveAOF(ctx, configVersion)
 	if err != nil {
-		// full sync failed, abort
+		// link broken, retry later
 		logger.Error(err)
+		server.reconnectLater(configVersion)
+		return
+	}
+}
+
+const maxReconnectBackoff = 30 * time.Second
+
+// reconnectLater marks link with master down and reconnects after a backoff.
+// It does nothing if slaveof config has been changed
+func (server *Server) reconnectLater(configVersion int32) {
+	repl := server.slaveStatus
+	repl.mutex.Lock()
+	if repl.configVersion != configVersion {
+		repl.mutex.Unlock()
 		return
 	}
+	repl.stopSlaveWithMutex()
+	newVersion := repl.configVersion
+	backoff := time.Second << repl.retryTimes
+	if backoff > maxReconnectBackoff || backoff <= 0 {
+		backoff = maxReconnectBackoff
+	} else {
+		repl.retryTimes++
+	}
+	repl.mutex.Unlock()
+	logger.Info(fmt.Sprintf("reconnect with master after %v", backoff))
+	time.AfterFunc(backoff, func() {
+		repl.mutex.Lock()
+		changed := repl.configVersion != newVersion
+		repl.mutex.Unlock()
+		if changed || atomic.LoadInt32(&server.role) != slaveRole {
+			return
+		}
+		server.setupMaster()
+	})
+}
+
+// getReplTimeout returns repl-timeout, master and slave consider the link is down if no data received during it
+func getReplTimeout() time.Duration {
+	if config.Properties.ReplTimeout > 0 {
+		return time.Duration(config.Properties.ReplTimeout) * time.Second
+	}
+	return 60 * time.Second
 }
 
 // connectWithMaster finishes handshake with master
 // returns: isFullReSync, error
-func (server *Server) connectWithMaster(configVersion int32) (bool, error) {
+func (server *Server) connectWithMaster(configVersion int32) (isFullReSync bool, err error) {
 	addr := server.slaveStatus.masterHost + ":" + strconv.Itoa(server.slaveStatus.masterPort)
-	conn, err := net.Dial("tcp", addr)
+	conn, err := net.DialTimeout("tcp", addr, getReplTimeout())
 	if err != nil {
-		server.slaveOfNone() // abort
 		return false, errors.New("connect master failed " + err.Error())
 	}
+	// handshake should be finished in repl-timeout
+	_ = conn.SetDeadline(time.Now().Add(getReplTimeout()))
+	registered := false
+	defer func() {
+		// close connection if handshake failed before it becomes slaveStatus.masterConn
+		if err != nil && !registered {
+			_ = conn.Close()
+		}
+	}()
 	masterChan := parser.ParseStream(conn)
 
 	// ping
@@ -181,9 +310,7 @@ func (server *Server) connectWithMaster(configVersion int32) (bool, error) {
 		if !strings.HasPrefix(reply.Error(), "NOAUTH") &&
 			!strings.HasPrefix(reply.Error(), "NOPERM") &&
 			!strings.HasPrefix(reply.Error(), "ERR operation not permitted") {
-			logger.Error("Error reply to PING from master: " + string(reply.ToBytes()))
-			server.slaveOfNone() // abort
-			return false, nil
+			return false, errors.New("error reply to PING from master: " + string(reply.ToBytes()))
 		}
 	}
 
@@ -192,16 +319,13 @@ func (server *Server) connectWithMaster(configVersion int32) (bool, error) {
 		req := protocol.MakeMultiBulkReply(cmdLine)
 		_, err := conn.Write(req.ToBytes())
 		if err != nil {
-			server.slaveOfNone() // abort
 			return errors.New("send failed " + err.Error())
 		}
 		resp := <-masterChan
 		if resp.Err != nil {
-			server.slaveOfNone() // abort
 			return errors.New("read response failed: " + resp.Err.Error())
 		}
 		if !protocol.IsOKReply(resp.Data) {
-			server.slaveOfNone() // abort
 			return errors.New("unexpected auth response: " + string(resp.Data.ToBytes()))
 		}
 		return nil
@@ -210,6 +334,10 @@ func (server *Server) connectWithMaster(configVersion int32) (bool, error) {
 	// auth
 	if config.Properties.MasterAuth != "" {
 		authCmdLine := utils.ToCmdLine("auth", config.Properties.MasterAuth)
+		if config.Properties.MasterUser != "" {
+			// redis-server 6.0+ with acl
+			authCmdLine = utils.ToCmdLine("auth", config.Properties.MasterUser, config.Properties.MasterAuth)
+		}
 		err = sendCmdToMaster(conn, authCmdLine, masterChan)
 		if err != nil {
 			return false, err
@@ -217,13 +345,7 @@ func (server *Server) connectWithMaster(configVersion int32) (bool, error) {
 	}
 
 	// announce port
-	var port int
-	if config.Properties.SlaveAnnouncePort != 0 {
-		port = config.Properties.SlaveAnnouncePort
-	} else {
-		port = config.Properties.Port
-	}
-	portCmdLine := utils.ToCmdLine("REPLCONF", "listening-port", strconv.Itoa(port))
+	portCmdLine := utils.ToCmdLine("REPLCONF", "listening-port", strconv.Itoa(getSlaveAnnouncePort()))
 	err = sendCmdToMaster(conn, portCmdLine, masterChan)
 	if err != nil {
 		return false, err
@@ -238,8 +360,22 @@ func (server *Server) connectWithMaster(configVersion int32) (bool, error) {
 		}
 	}
 
+	// announce priority, it is not necessary for replication so errors are ignored (redis-server does not know this option)
+	priorityCmdLine := utils.ToCmdLine("REPLCONF", "priority", strconv.Itoa(config.Properties.ReplicaPriority))
+	_, err = conn.Write(protocol.MakeMultiBulkReply(priorityCmdLine).ToBytes())
+	if err != nil {
+		return false, errors.New("send failed " + err.Error())
+	}
+	priorityResp := <-masterChan
+	if priorityResp.Err != nil {
+		return false, errors.New("read response failed: " + priorityResp.Err.Error())
+	}
+	if !protocol.IsOKReply(priorityResp.Data) {
+		logger.Info("master does not accept replica priority: " + string(priorityResp.Data.ToBytes()))
+	}
+
 	// announce capacity
-	capaCmdLine := utils.ToCmdLine("REPLCONF", "capa", "psync2")
+	capaCmdLine := utils.ToCmdLine("REPLCONF", "capa", "eof", "capa", "psync2")
 	err = sendCmdToMaster(conn, capaCmdLine, masterChan)
 	if err != nil {
 		return false, err
@@ -255,6 +391,8 @@ func (server *Server) connectWithMaster(configVersion int32) (bool, error) {
 	server.slaveStatus.masterConn = conn
 	server.slaveStatus.masterChan = masterChan
 	server.slaveStatus.lastRecvTime = time.Now()
+	_ = conn.SetDeadline(time.Time{})
+	registered = true
 	return server.psyncHandshake()
 }
 
@@ -292,10 +430,18 @@ func (server *Server) psyncHandshake() (bool, error) {
 		logger.Info("full re-sync with master")
 		server.slaveStatus.replId = headers[1]
 		server.slaveStatus.replOffset, err = strconv.ParseInt(headers[2], 10, 64)
+		server.slaveStatus.aofOffset = 0
+		server.slaveStatus.backlog = nil // data set would be replaced
 		isFullReSync = true
 	} else if headers[0] == "CONTINUE" {
 		logger.Info("continue partial sync")
 		server.slaveStatus.replId = headers[1]
+		if server.slaveStatus.backlog == nil || server.slaveStatus.backlog.currentOffset != server.slaveStatus.replOffset {
+			server.slaveStatus.backlog = &replBacklog{
+				beginOffset:   server.slaveStatus.replOffset,
+				currentOffset: server.slaveStatus.replOffset,
+			}
+		}
 		isFullReSync = false
 	} else {
 		return false, errors.New("illegal psync resp: " + psyncHeader.Status)
@@ -305,6 +451,7 @@ func (server *Server) psyncHandshake() (bool, error) {
 		return false, errors.New("get illegal repl offset: " + headers[2])
 	}
 	logger.Info(fmt.Sprintf("repl id: %s, current offset: %d", server.slaveStatus.replId, server.slaveStatus.replOffset))
+	server.relayUpstream()
 	return isFullReSync, nil
 }
 
@@ -327,6 +474,26 @@ func makeRdbLoader(upgradeAof bool) (*Server, string, error) {
 	return rdbLoader, newAofFilename, nil
 }
 
+// maxRDBVersion is the latest rdb version the decoder understands, it is written by redis-server 7.0.
+// redis-server 7.2 and later write rdb version 11 or higher, they could not be replicated.
+const maxRDBVersion = 10
+
+// checkRDBVersion rejects rdb of unsupported version before loading it, header of rdb is "REDIS" and 4 digits of version
+func checkRDBVersion(rdb []byte) error {
+	if len(rdb) < 9 || string(rdb[:5]) != "REDIS" {
+		return errors.New("illegal rdb header from master")
+	}
+	version, err := strconv.Atoi(string(rdb[5:9]))
+	if err != nil {
+		return errors.New("illegal rdb version from master: " + string(rdb[5:9]))
+	}
+	if version > maxRDBVersion {
+		return fmt.Errorf("rdb version %d of master is not supported, only rdb version <= %d (redis-server 7.0 or earlier) could be loaded",
+			version, maxRDBVersion)
+	}
+	return nil
+}
+
 // loadMasterRDB downloads rdb after handshake has been done
 func (server *Server) loadMasterRDB(configVersion int32) error {
 	rdbPayload := <-server.slaveStatus.masterChan
@@ -339,6 +506,9 @@ func (server *Server) loadMasterRDB(configVersion int32) error {
 	}
 
 	logger.Info(fmt.Sprintf("receive %d bytes of rdb from master", len(rdbReply.Arg)))
+	if err := checkRDBVersion(rdbReply.Arg); err != nil {
+		return err
+	}
 	rdbDec := rdb.NewDecoder(bytes.NewReader(rdbReply.Arg))
 
 	rdbLoader, newAofFilename, err := makeRdbLoader(config.Properties.AppendOnly)
@@ -374,13 +544,19 @@ func (server *Server) loadMasterRDB(configVersion int32) error {
 		}
 		server.bindPersister(persister)
 	}
-
+	server.slaveStatus.backlog = &replBacklog{
+		beginOffset:   server.slaveStatus.replOffset,
+		currentOffset: server.slaveStatus.replOffset,
+	}
+	// data set has been replaced, sub-slaves of this node have to do full re-sync
+	server.relayUpstream()
 	return nil
 }
 
 func (server *Server) receiveAOF(ctx context.Context, configVersion int32) error {
 	conn := connection.NewConn(server.slaveStatus.masterConn)
 	conn.SetMaster()
+	defer conn.Close()
 	server.slaveStatus.running.Add(1)
 	defer server.slaveStatus.running.Done()
 	for {
@@ -399,12 +575,44 @@ func (server *Server) receiveAOF(ctx context.Context, configVersion int32) error
 			server.slaveStatus.mutex.Lock()
 			if server.slaveStatus.configVersion != configVersion {
 				// slaveStatus conf changed during connecting and waiting mutex
+				server.slaveStatus.mutex.Unlock()
 				return configChangedErr
 			}
-			server.Exec(conn, cmdLine.Args)
-			n := len(cmdLine.ToBytes()) // todo: directly get size from socket
+			isGetAck := isGetAckCmd(cmdLine.Args)
+			isFailover := isFailoverCmd(cmdLine.Args)
+			if !isGetAck && !isFailover {
+				server.Exec(conn, cmdLine.Args)
+			}
+			bin := cmdLine.ToBytes() // todo: directly get size from socket
+			n := len(bin)
 			server.slaveStatus.replOffset += int64(n)
+			server.masterStatus.mu.Lock() // backlog is shared with sub-slaves, see relayUpstream
+			server.slaveStatus.appendBacklog(bin)
+			server.masterStatus.mu.Unlock()
+			if err := server.masterSendUpdatesToSlave(); err != nil {
+				logger.Errorf("masterSendUpdatesToSlave error: %v", err)
+			}
 			server.slaveStatus.lastRecvTime = time.Now()
+			if isFailover && server.slaveStatus.isFailoverTarget(cmdLine.Args) {
+				// master asks this node to take over, see execFailover
+				logger.Info("promoted by master failover")
+				server.slaveStatus.mutex.Unlock()
+				go server.slaveOfNone()
+				return nil
+			}
+			if isGetAck {
+				// master is waiting for our offset, see execWait and execWaitAof
+				if config.Properties.AppendOnly && server.persister != nil {
+					if err := server.persister.FlushAndFsync(); err != nil {
+						logger.Error("fsync aof failed " + err.Error())
+					} else {
+						server.slaveStatus.aofOffset = server.slaveStatus.replOffset
+					}
+				}
+				if err := server.slaveStatus.sendAck2Master(); err != nil {
+					logger.Error("send failed " + err.Error())
+				}
+			}
 			logger.Info(fmt.Sprintf("receive %d bytes from master, current offset %d, %s",
 				n, server.slaveStatus.replOffset, strconv.Quote(string(cmdLine.ToBytes()))))
 			server.slaveStatus.mutex.Unlock()
@@ -415,6 +623,55 @@ func (server *Server) receiveAOF(ctx context.Context, configVersion int32) error
 	}
 }
 
+// appendBacklog appends replication stream into backlog and drops the head if backlog is too large
+// invoker should provide with slaveStatus.mutex
+func (repl *slaveStatus) appendBacklog(bin []byte) {
+	if repl.backlog == nil {
+		return
+	}
+	repl.backlog.appendBytes(bin)
+	if len(repl.backlog.buf) > maxBacklogSize {
+		repl.backlog.trimHead(int64(len(repl.backlog.buf) - maxBacklogSize/2))
+	}
+}
+
+// canServeStaleData returns whether this slave could serve data commands, see replica-serve-stale-data config
+func (server *Server) canServeStaleData() bool {
+	if strings.ToLower(config.Properties.ReplicaServeStale) != "no" {
+		return true
+	}
+	return atomic.LoadInt32(&server.slaveStatus.linkState) == replStateConnected
+}
+
+// isGetAckCmd returns whether cmdLine is `REPLCONF GETACK *` which is sent by master
+// getSlaveAnnouncePort returns the port which master knows this node by
+func getSlaveAnnouncePort() int {
+	if config.Properties.SlaveAnnouncePort != 0 {
+		return config.Properties.SlaveAnnouncePort
+	}
+	return config.Properties.Port
+}
+
+// isFailoverTarget returns whether address in `REPLCONF FAILOVER host port` is this node in the view of master
+// invoker should provide with slaveStatus.mutex
+func (repl *slaveStatus) isFailoverTarget(cmdLine CmdLine) bool {
+	if string(cmdLine[3]) != strconv.Itoa(getSlaveAnnouncePort()) {
+		return false
+	}
+	host := config.Properties.SlaveAnnounceIP
+	if host == "" && repl.masterConn != nil {
+		// master knows this node by remote address of the replication link
+		host, _, _ = net.SplitHostPort(repl.masterConn.LocalAddr().String())
+	}
+	return string(cmdLine[2]) == host
+}
+
+func isGetAckCmd(cmdLine CmdLine) bool {
+	return len(cmdLine) == 3 &&
+		strings.ToLower(string(cmdLine[0])) == "replconf" &&
+		strings.ToLower(string(cmdLine[1])) == "getack"
+}
+
 func (server *Server) slaveCron() {
 	repl := server.slaveStatus
 	if repl.masterConn == nil {
@@ -422,20 +679,24 @@ func (server *Server) slaveCron() {
 	}
 
 	// check master timeout
-	replTimeout := 60 * time.Second
-	if config.Properties.ReplTimeout != 0 {
-		replTimeout = time.Duration(config.Properties.ReplTimeout) * time.Second
-	}
-	minLastRecvTime := time.Now().Add(-replTimeout)
+	minLastRecvTime := time.Now().Add(-getReplTimeout())
 	if repl.lastRecvTime.Before(minLastRecvTime) {
 		// reconnect with master
 		err := server.reconnectWithMaster()
 		if err != nil {
 			logger.Error("send failed " + err.Error())
 		}
+	}
+}
+
+// slaveAckCron sends REPLCONF ACK to master periodically, so that master could track replication lag
+func (server *Server) slaveAckCron() {
+	repl := server.slaveStatus
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	if repl.masterConn == nil {
 		return
 	}
-	// send ack to master
 	err := repl.sendAck2Master()
 	if err != nil {
 		logger.Error("send failed " + err.Error())
@@ -443,9 +704,13 @@ func (server *Server) slaveCron() {
 }
 
 // Send a REPLCONF ACK command to the master to inform it about the current processed offset
+// invoker should provide with slaveStatus.mutex
 func (repl *slaveStatus) sendAck2Master() error {
 	psyncCmdLine := utils.ToCmdLine("REPLCONF", "ACK",
 		strconv.FormatInt(repl.replOffset, 10))
+	if config.Properties.AppendOnly {
+		psyncCmdLine = append(psyncCmdLine, []byte("FACK"), []byte(strconv.FormatInt(repl.aofOffset, 10)))
+	}
 	psyncReq := protocol.MakeMultiBulkReply(psyncCmdLine)
 	_, err := repl.masterConn.Write(psyncReq.ToBytes())
 	// logger.Info("send ack to master")
@@ -2,10 +2,14 @@ package database
 
 import (
 	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/latency"
 	"goRedisPlus/redis/protocol"
+	"sort"
 	"strings"
 )
 
+// cmdTable is the registry of commands, each command declares its arity, flags and positions of keys.
+// Server, cluster router, ACL and transactions consult these declarations instead of checking command names
 var cmdTable = make(map[string]*command)
 
 type command struct {
@@ -20,8 +24,10 @@ type command struct {
 	arity int
 	flags int
 	extra *commandExtra
+	stats *commandStats
 }
 
+// commandExtra declares redis flags of command, such as write, denyoom and pubsub, and positions of its keys
 type commandExtra struct {
 	signs    []string
 	firstKey int
@@ -38,61 +44,212 @@ const (
 
 // registerCommand registers a normal command, which only read or modify a limited number of keys
 func registerCommand(name string, executor ExecFunc, prepare PreFunc, rollback UndoFunc, arity int, flags int) *command {
-	name = strings.ToLower(name)
-	cmd := &command{
-		name:     name,
+	return addCommand(&command{
+		name:     strings.ToLower(name),
 		executor: executor,
 		prepare:  prepare,
 		undo:     rollback,
 		arity:    arity,
 		flags:    flags,
-	}
-	cmdTable[name] = cmd
-	return cmd
+	})
 }
 
 // registerSpecialCommand registers a special command, such as publish, select, keys, flushAll
 func registerSpecialCommand(name string, arity int, flags int) *command {
-	name = strings.ToLower(name)
-	flags |= flagSpecial
-	cmd := &command{
-		name:  name,
+	return addCommand(&command{
+		name:  strings.ToLower(name),
 		arity: arity,
-		flags: flags,
+		flags: flags | flagSpecial,
+	})
+}
+
+// addCommand puts command into registry, a name could only be registered once
+func addCommand(cmd *command) *command {
+	if _, ok := cmdTable[cmd.name]; ok {
+		panic("command " + cmd.name + " is registered twice")
 	}
-	cmdTable[name] = cmd
+	cmd.stats = &commandStats{latencies: latency.NewHistogram()}
+	cmdTable[cmd.name] = cmd
 	return cmd
 }
 
+// lookupCommand returns the registered command of case-insensitive name, or nil if not found
+func lookupCommand(name string) *command {
+	return cmdTable[strings.ToLower(name)]
+}
+
+// hasFlag returns whether the command declares the given redis flag, such as redisFlagDenyOOM
+func (cmd *command) hasFlag(flag string) bool {
+	if cmd.extra == nil {
+		return false
+	}
+	for _, sign := range cmd.extra.signs {
+		if sign == flag {
+			return true
+		}
+	}
+	return false
+}
+
 func isReadOnlyCommand(name string) bool {
-	name = strings.ToLower(name)
-	cmd := cmdTable[name]
+	cmd := lookupCommand(name)
 	if cmd == nil {
 		return false
 	}
 	return cmd.flags&flagReadOnly > 0
 }
 
+// IsReadOnlyCommand returns whether the command never modifies data, cluster uses it to serve reads on replica
+func IsReadOnlyCommand(name string) bool {
+	return isReadOnlyCommand(name)
+}
+
+// hasRedisFlag returns whether the command has the given redis flag, such as redisFlagWrite
+func hasRedisFlag(name string, flag string) bool {
+	cmd := lookupCommand(name)
+	return cmd != nil && cmd.hasFlag(flag)
+}
+
+// isWriteCommand returns whether the command may modify data
+func isWriteCommand(name string) bool {
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		return false
+	}
+	if cmd.flags&flagReadOnly > 0 {
+		return false
+	}
+	if cmd.flags&flagSpecial == 0 {
+		return true
+	}
+	// special commands declare whether they are writing by redis flags
+	return cmd.hasFlag(redisFlagWrite)
+}
+
+// KeyedCommands returns names of normal commands declaring positions of keys, cluster routes them by their keys
+func KeyedCommands() []string {
+	var names []string
+	for name, cmd := range cmdTable {
+		if cmd.flags&flagSpecial == 0 && cmd.extra != nil && cmd.extra.firstKey > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// toDescReply describes the command in the format of COMMAND INFO:
+// name, arity, flags, first key, last key, key step, acl categories, tips, key specs and subcommands
 func (cmd *command) toDescReply() redis.Reply {
-	args := make([]redis.Reply, 0, 6)
-	args = append(args,
-		protocol.MakeBulkReply([]byte(cmd.name)),
-		protocol.MakeIntReply(int64(cmd.arity)))
+	var signs []string
+	firstKey, lastKey, keyStep := 0, 0, 0
 	if cmd.extra != nil {
-		signs := make([][]byte, len(cmd.extra.signs))
-		for i, v := range cmd.extra.signs {
-			signs[i] = []byte(v)
+		signs = cmd.extra.signs
+		firstKey, lastKey, keyStep = cmd.extra.firstKey, cmd.extra.lastKey, cmd.extra.keyStep
+	} else if cmd.flags&flagReadOnly > 0 {
+		signs = []string{redisFlagReadonly}
+	} else if cmd.flags&flagSpecial == 0 {
+		signs = []string{redisFlagWrite}
+	}
+	flags := make([][]byte, len(signs))
+	for i, v := range signs {
+		flags[i] = []byte(v)
+	}
+	categories := make([][]byte, 0)
+	for _, category := range sortedACLCategories() {
+		if category != "all" && inACLCategory(category, cmd.name) {
+			categories = append(categories, []byte("@"+category))
 		}
-		args = append(args,
-			protocol.MakeMultiBulkReply(signs),
-			protocol.MakeIntReply(int64(cmd.extra.firstKey)),
-			protocol.MakeIntReply(int64(cmd.extra.lastKey)),
-			protocol.MakeIntReply(int64(cmd.extra.keyStep)),
-		)
 	}
-	return protocol.MakeMultiRawReply(args)
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(cmd.name)),
+		protocol.MakeIntReply(int64(cmd.arity)),
+		protocol.MakeMultiBulkReply(flags),
+		protocol.MakeIntReply(int64(firstKey)),
+		protocol.MakeIntReply(int64(lastKey)),
+		protocol.MakeIntReply(int64(keyStep)),
+		protocol.MakeMultiBulkReply(categories),
+		protocol.MakeEmptyMultiBulkReply(), // tips
+		cmd.keySpecsReply(),
+		protocol.MakeEmptyMultiBulkReply(), // subcommands
+	})
+}
+
+// keySpecsReply describes positions of keys as a range key spec, derived from first key, last key and key step
+func (cmd *command) keySpecsReply() redis.Reply {
+	if cmd.extra == nil || cmd.extra.firstKey <= 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	specFlags := [][]byte{[]byte("RW"), []byte("UPDATE")}
+	if cmd.flags&flagReadOnly > 0 {
+		specFlags = [][]byte{[]byte("RO"), []byte("ACCESS")}
+	}
+	// last key of range spec is relative to the first key, negative one counts from the end
+	lastKey := cmd.extra.lastKey
+	if lastKey >= 0 {
+		lastKey -= cmd.extra.firstKey
+	}
+	spec := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("flags")),
+		protocol.MakeMultiBulkReply(specFlags),
+		protocol.MakeBulkReply([]byte("begin_search")),
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("type")),
+			protocol.MakeBulkReply([]byte("index")),
+			protocol.MakeBulkReply([]byte("spec")),
+			protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte("index")),
+				protocol.MakeIntReply(int64(cmd.extra.firstKey)),
+			}),
+		}),
+		protocol.MakeBulkReply([]byte("find_keys")),
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("type")),
+			protocol.MakeBulkReply([]byte("range")),
+			protocol.MakeBulkReply([]byte("spec")),
+			protocol.MakeMultiRawReply([]redis.Reply{
+				protocol.MakeBulkReply([]byte("lastkey")),
+				protocol.MakeIntReply(int64(lastKey)),
+				protocol.MakeBulkReply([]byte("keystep")),
+				protocol.MakeIntReply(int64(cmd.extra.keyStep)),
+				protocol.MakeBulkReply([]byte("limit")),
+				protocol.MakeIntReply(0),
+			}),
+		}),
+	})
+	return protocol.MakeMultiRawReply([]redis.Reply{spec})
 }
 
+// toDocReply returns documentation of the command in the format of COMMAND DOCS
+func (cmd *command) toDocReply() redis.Reply {
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("group")),
+		protocol.MakeBulkReply([]byte(commandGroup(cmd.name))),
+	})
+}
+
+// keysByPosition returns keys at positions declared by first key, last key and key step of the command line
+func (cmd *command) keysByPosition(cmdLine [][]byte) []string {
+	if cmd.extra == nil || cmd.extra.firstKey <= 0 {
+		return nil
+	}
+	lastKey := cmd.extra.lastKey
+	if lastKey < 0 {
+		lastKey += len(cmdLine)
+	}
+	keyStep := cmd.extra.keyStep
+	if keyStep <= 0 {
+		keyStep = 1
+	}
+	var keys []string
+	for i := cmd.extra.firstKey; i <= lastKey && i < len(cmdLine); i += keyStep {
+		keys = append(keys, string(cmdLine[i]))
+	}
+	return keys
+}
+
+// attachCommandExtra declares redis flags and positions of keys, readonly and write flags must agree with
+// flags given at registering, so that the registry never describes a command in two ways
 func (cmd *command) attachCommandExtra(signs []string, firstKey int, lastKey int, keyStep int) {
 	cmd.extra = &commandExtra{
 		signs:    signs,
@@ -100,4 +257,17 @@ func (cmd *command) attachCommandExtra(signs []string, firstKey int, lastKey int
 		lastKey:  lastKey,
 		keyStep:  keyStep,
 	}
+	readOnly, write := cmd.hasFlag(redisFlagReadonly), cmd.hasFlag(redisFlagWrite)
+	if readOnly && write {
+		panic("command " + cmd.name + " declares both readonly and write")
+	}
+	if cmd.flags&flagSpecial > 0 {
+		if readOnly {
+			cmd.flags |= flagReadOnly
+		}
+		return
+	}
+	if readOnly == write || readOnly != (cmd.flags&flagReadOnly > 0) {
+		panic("command " + cmd.name + " declares inconsistent readonly or write flags")
+	}
 }
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/lib/logger"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+// Runtime memory:
+// maxmemory limits the estimated dataset, but the process also holds garbage, which grows as much as live heap
+// under GOGC=100 before GC runs. Without a limit go runtime lets the heap grow far beyond maxmemory while keys are
+// being evicted. So a soft memory limit of go runtime is derived from maxmemory: the heap of an empty server plus
+// twice maxmemory, GC runs more often as the heap approaches it. go-memory-limit and gogc override the runtime
+// settings, they are applied whenever maxmemory, go-memory-limit or gogc is changed.
+
+const (
+	// goMemoryLimitFactor leaves room for garbage of the dataset, which is about as large as itself with GOGC=100
+	goMemoryLimitFactor = 2
+	// noMemoryLimit is the limit of go runtime meaning unlimited
+	noMemoryLimit = math.MaxInt64
+)
+
+var (
+	runtimeMemoryMu sync.Mutex
+	// baselineHeap is the heap in use after databases are made, it does not count in maxmemory
+	baselineHeap int64
+	// initial settings of go runtime from environment variables GOGC and GOMEMLIMIT, restored by zero configs
+	initialGCPercent   int
+	initialMemoryLimit int64
+	initRuntimeOnce    sync.Once
+)
+
+// initRuntimeMemory records settings of go runtime and the heap of an empty server, then applies configs
+func initRuntimeMemory() {
+	initRuntimeOnce.Do(func() {
+		initialGCPercent = debug.SetGCPercent(100)
+		debug.SetGCPercent(initialGCPercent)
+		initialMemoryLimit = getMemoryLimit()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		baselineHeap = int64(stats.HeapInuse)
+	})
+	applyRuntimeMemory()
+}
+
+// goMemoryLimit returns the soft memory limit of go runtime according to configs
+func goMemoryLimit() int64 {
+	if config.Properties.GoMemoryLimit > 0 {
+		return int64(config.Properties.GoMemoryLimit)
+	}
+	if maxMemory := int64(config.Properties.MaxMemory); maxMemory > 0 {
+		if maxMemory > (noMemoryLimit-baselineHeap)/goMemoryLimitFactor {
+			return noMemoryLimit
+		}
+		return baselineHeap + maxMemory*goMemoryLimitFactor
+	}
+	return initialMemoryLimit
+}
+
+func goGCPercent() int {
+	if config.Properties.GoGC == 0 {
+		return initialGCPercent
+	}
+	return config.Properties.GoGC
+}
+
+// applyRuntimeMemory sets memory limit and GC percent of go runtime
+func applyRuntimeMemory() {
+	runtimeMemoryMu.Lock()
+	defer runtimeMemoryMu.Unlock()
+	limit := goMemoryLimit()
+	if !setMemoryLimit(limit) && limit != initialMemoryLimit {
+		logger.Warn("go-memory-limit is ignored, it requires go1.19 or later")
+	}
+	debug.SetGCPercent(goGCPercent())
+}
+
+// formatMemoryLimit returns the limit of go runtime in bytes, or unlimited
+func formatMemoryLimit(limit int64) string {
+	if limit == noMemoryLimit {
+		return "unlimited"
+	}
+	return strconv.FormatInt(limit, 10)
+}
@@ -0,0 +1,13 @@
+//go:build !go1.19
+
+package database
+
+// setMemoryLimit sets the soft memory limit of go runtime, returns false if it is not supported
+func setMemoryLimit(limit int64) bool {
+	return false
+}
+
+// getMemoryLimit returns the soft memory limit of go runtime
+func getMemoryLimit() int64 {
+	return noMemoryLimit
+}
@@ -0,0 +1,16 @@
+//go:build go1.19
+
+package database
+
+import "runtime/debug"
+
+// setMemoryLimit sets the soft memory limit of go runtime, returns false if it is not supported
+func setMemoryLimit(limit int64) bool {
+	debug.SetMemoryLimit(limit)
+	return true
+}
+
+// getMemoryLimit returns the soft memory limit of go runtime
+func getMemoryLimit() int64 {
+	return debug.SetMemoryLimit(-1)
+}
@@ -0,0 +1,176 @@
+package database
+
+import (
+	"goRedisPlus/interface/database"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/wildcard"
+	"goRedisPlus/redis/protocol"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Scanning collections:
+// HSCAN, SSCAN and ZSCAN can't visit buckets of go maps in order like redis. Instead, members are visited in the order
+// of their hash, and cursor is the hash where the next call starts. The order never changes however the collection
+// grows, shrinks or converts its encoding, so members in the collection during the whole iteration are returned at
+// least once and the iteration always ends, which are the guarantees of redis. Finding members from the cursor takes a
+// pass over the whole collection, so each call returns at least 1/scanMaxCalls of it to bound the total work, COUNT is
+// just a hint like redis.
+
+// scanMaxCalls is the most calls to iterate a collection regardless of COUNT
+const scanMaxCalls = 16
+
+// optional arguments accepted by some of SCAN commands besides MATCH and COUNT
+const (
+	scanWithType     = 1 << iota // TYPE type of SCAN
+	scanWithNoValues             // NOVALUES of HSCAN
+)
+
+// scanTypes are types accepted by TYPE option, see getTypeName
+var scanTypes = map[string]bool{
+	"string": true,
+	"list":   true,
+	"hash":   true,
+	"set":    true,
+	"zset":   true,
+}
+
+// scanOptions are optional arguments of SCAN commands
+type scanOptions struct {
+	count    int
+	pattern  *wildcard.Pattern // nil matches all
+	typeName string            // empty matches all
+	noValues bool
+}
+
+// parseScanOptions parses command line: [MATCH pattern] [COUNT count] and options of extra
+func parseScanOptions(args [][]byte, extra int) (*scanOptions, protocol.ErrorReply) {
+	opts := &scanOptions{count: defaultScanCount}
+	var err error
+	for i := 0; i < len(args); i += 2 {
+		option := strings.ToUpper(string(args[i]))
+		if option == "NOVALUES" && extra&scanWithNoValues > 0 {
+			opts.noValues = true
+			i-- // a flag without value
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, protocol.MakeSyntaxErrReply()
+		}
+		switch option {
+		case "TYPE":
+			if extra&scanWithType == 0 {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			opts.typeName = strings.ToLower(string(args[i+1]))
+			if !scanTypes[opts.typeName] {
+				return nil, protocol.MakeErrReply("ERR unknown type name '" + string(args[i+1]) + "'")
+			}
+		case "MATCH":
+			opts.pattern, err = wildcard.CompilePattern(string(args[i+1]))
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR illegal wildcard")
+			}
+		case "COUNT":
+			opts.count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if opts.count < 1 {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+		default:
+			return nil, protocol.MakeSyntaxErrReply()
+		}
+	}
+	return opts, nil
+}
+
+// match returns whether member matches MATCH pattern
+func (opts *scanOptions) match(member string) bool {
+	return opts.pattern == nil || opts.pattern.IsMatch(member)
+}
+
+// matchType returns whether key is of the type of TYPE option, invoker needs no lock of key
+func (opts *scanOptions) matchType(db *DB, key string) bool {
+	if opts.typeName == "" {
+		return true
+	}
+	raw, exists := db.data.Get(key)
+	return exists && getTypeName(raw.(*database.DataEntity)) == opts.typeName
+}
+
+// parseCollectionScan parses command line: key cursor [MATCH pattern] [COUNT count] and options of extra
+func parseCollectionScan(args [][]byte, extra int) (uint64, *scanOptions, protocol.ErrorReply) {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return 0, nil, protocol.MakeErrReply("ERR invalid cursor")
+	}
+	opts, errReply := parseScanOptions(args[2:], extra)
+	if errReply != nil {
+		return 0, nil, errReply
+	}
+	return cursor, opts, nil
+}
+
+func makeScanReply(cursor uint64, items [][]byte) redis.Reply {
+	if items == nil {
+		items = [][]byte{}
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(strconv.FormatUint(cursor, 10))),
+		protocol.MakeMultiBulkReply(items),
+	})
+}
+
+// memberHash is FNV-1a hash of member, which decides the order of SCAN
+func memberHash(member string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(member); i++ {
+		hash ^= uint32(member[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+type scanCandidate struct {
+	hash   uint32
+	member string
+}
+
+// scanMembers visits all members of a collection of size by forEach, it returns at least count members whose hash is
+// not less than cursor if there are, including all members of the same hash as the last one, and cursor of the next
+// call, 0 means the iteration is finished
+func scanMembers(cursor uint64, count int, size int, forEach func(consumer func(member string) bool)) ([]string, uint64) {
+	if count < size/scanMaxCalls {
+		count = size / scanMaxCalls
+	}
+	var candidates []scanCandidate
+	forEach(func(member string) bool {
+		if hash := memberHash(member); uint64(hash) >= cursor {
+			candidates = append(candidates, scanCandidate{hash: hash, member: member})
+		}
+		return true
+	})
+	next := uint64(0)
+	if len(candidates) > count {
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].hash < candidates[j].hash
+		})
+		end := count
+		for end < len(candidates) && candidates[end].hash == candidates[count-1].hash {
+			end++
+		}
+		if end < len(candidates) {
+			// greater than hash of members returned, so never 0
+			next = uint64(candidates[end].hash)
+		}
+		candidates = candidates[:end]
+	}
+	members := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		members[i] = candidate.member
+	}
+	return members, next
+}
@@ -6,14 +6,17 @@ import (
 	"goRedisPlus/config"
 	"goRedisPlus/interface/database"
 	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/latency"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/utils"
 	"goRedisPlus/pubsub"
+	"goRedisPlus/redis/connection"
 	"goRedisPlus/redis/protocol"
 	"os"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -34,10 +37,29 @@ type Server struct {
 	role         int32
 	slaveStatus  *slaveStatus
 	masterStatus *masterStatus
+	failover     atomic.Value // *failoverStatus
+	// writeGate is held for reading by writes from clients until they finished, so that pausing writes could wait for
+	// writes in progress, see enterWrite and drainWrites
+	writeGate sync.RWMutex
+
+	// activeExpireOff disables active expire cycle if it is not 0, see DEBUG SET-ACTIVE-EXPIRE
+	activeExpireOff int32
 
 	// hooks
-	insertCallback database.KeyEventCallback
-	deleteCallback database.KeyEventCallback
+	insertCallback        database.KeyEventCallback
+	deleteCallback        database.KeyEventCallback
+	keyspaceEventCallback database.KeyspaceEventCallback
+}
+
+// isSlave returns whether the server is a slave now
+func (server *Server) isSlave() bool {
+	return atomic.LoadInt32(&server.role) == slaveRole
+}
+
+// isFakeConn returns whether c is an internal connection, such as aof loader
+func isFakeConn(c redis.Connection) bool {
+	_, ok := c.(*connection.FakeConn)
+	return ok
 }
 
 func fileExists(filename string) bool {
@@ -56,15 +78,39 @@ func NewStandaloneServer() *Server {
 	if err != nil {
 		panic(fmt.Errorf("create tmp dir failed: %v", err))
 	}
+	if err := initACL(); err != nil {
+		panic(fmt.Errorf("load acl failed: %v", err))
+	}
+	if err := initRenamedCommands(); err != nil {
+		panic(fmt.Errorf("load rename-command failed: %v", err))
+	}
+	outputLimits, err := config.Properties.OutputBufferLimits()
+	if err != nil {
+		panic(fmt.Errorf("load client-output-buffer-limit failed: %v", err))
+	}
+	connection.SetOutputBufferLimits(outputLimits)
+	maxMemoryClients, err := config.Properties.MaxMemoryClientsBytes()
+	if err != nil {
+		panic(fmt.Errorf("load maxmemory-clients failed: %v", err))
+	}
+	connection.SetMaxMemoryClients(maxMemoryClients)
+	latency.SetThreshold(int64(config.Properties.LatencyThreshold))
+	setMaxMemoryPolicy()
+	applyEncodingLimits()
+	startLazyfree()
+	startLazyExpire()
 	// make db set
 	server.dbSet = make([]*atomic.Value, config.Properties.Databases) // 创建16个分数据库
 	for i := range server.dbSet {
 		singleDB := makeDB() // 初始化一个分数据库
 		singleDB.index = i
+		singleDB.isSlave = server.isSlave
+		singleDB.publish = server.publishKeyspaceEvent
 		holder := &atomic.Value{} //atomic.Value 是 Go 语言提供的原子值类型，用于在并发环境中安全地存储和加载值
 		holder.Store(singleDB)
 		server.dbSet[i] = holder
 	}
+	initRuntimeMemory() // after making empty databases, whose heap is the baseline
 	server.hub = pubsub.MakeHub()
 	// record aof
 	// aof 是作用于整个redis的，不是作用于每一个分数据库
@@ -88,7 +134,14 @@ func NewStandaloneServer() *Server {
 	server.slaveStatus = initReplSlaveStatus()
 	server.initMaster()
 	server.startReplCron()
+	server.startDefragCron()
+	server.startActiveExpireCron()
+	server.startGrowShardsCron()
+	startStatsCron()
 	server.role = masterRole // The initialization process does not require atomicity
+	if config.Properties.ReplicaOf != "" {
+		server.setupReplicaOf()
+	}
 	return server
 }
 
@@ -104,6 +157,18 @@ func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.R
 	}()
 
 	cmdName := strings.ToLower(string(cmdLine[0])) // 第一个参数，用来判断是何种命令
+	start := time.Now()
+	rejected := false // refused before executing, see INFO commandstats
+	if !isFakeConn(c) {
+		defer func() {
+			elapsed := time.Since(start)
+			recordCommandStats(cmdName, elapsed, result, rejected)
+			// blocking commands like WAIT wait by design, their latency is not recorded
+			if !rejected && !hasRedisFlag(cmdName, redisFlagBlocking) {
+				latency.Record("command", elapsed)
+			}
+		}()
+	}
 	// ping
 	if cmdName == "ping" {
 		return Ping(c, cmdLine[1:])
@@ -112,36 +177,147 @@ func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.R
 	if cmdName == "auth" {
 		return Auth(c, cmdLine[1:])
 	}
-	if !isAuthenticated(c) {
+	if cmdName == "hello" {
+		return Hello(server, c, cmdLine[1:])
+	}
+	if !IsAuthenticated(c) {
+		rejected = true
 		return protocol.MakeErrReply("NOAUTH Authentication required")
 	}
+	// in cluster mode, permission has been checked by cluster before reaching here
+	if !config.Properties.ClusterEnable {
+		if errReply := CheckPermission(c, cmdLine); errReply != nil {
+			rejected = true
+			if c != nil && c.InMultiState() {
+				c.AddTxError(errReply) // EXEC would be aborted
+			}
+			return errReply
+		}
+	}
 	// info 获取redis server的各种信息
 	if cmdName == "info" {
 		return Info(server, cmdLine[1:])
 	}
 	// 设置主从关系 SLAVEOF masterip masterport
 	// masterip是主服务器的IP地址，masterport是主服务器的端口号。
-	if cmdName == "slaveof" {
+	if cmdName == "slaveof" || cmdName == "replicaof" {
 		if c != nil && c.InMultiState() { // 开启事务的时候不能设置从库
 			return protocol.MakeErrReply("cannot use slave of database within multi")
 		}
 		if len(cmdLine) != 3 {
-			return protocol.MakeArgNumErrReply("SLAVEOF")
+			return protocol.MakeArgNumErrReply(cmdName)
 		}
 		return server.execSlaveOf(c, cmdLine[1:])
 	} else if cmdName == "command" {
 		return execCommand(cmdLine[1:]) // 获取所有命令
+	} else if cmdName == "role" {
+		if len(cmdLine) != 1 {
+			return protocol.MakeArgNumErrReply("role")
+		}
+		return server.execRole(cmdLine[1:])
+	} else if cmdName == "failover" {
+		return server.execFailover(cmdLine[1:])
+	} else if cmdName == "wait" {
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply("wait")
+		}
+		return server.execWait(c, cmdLine[1:])
+	} else if cmdName == "waitaof" {
+		if len(cmdLine) != 4 {
+			return protocol.MakeArgNumErrReply("waitaof")
+		}
+		return server.execWaitAof(c, cmdLine[1:])
+	} else if cmdName == "acl" {
+		return execACL(c, cmdLine[1:])
+	} else if cmdName == "config" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply("config")
+		}
+		return server.execConfig(cmdLine[1:])
+	} else if cmdName == "client" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply("client")
+		}
+		return server.execClient(c, cmdLine[1:])
+	} else if cmdName == "latency" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply("latency")
+		}
+		return execLatency(cmdLine[1:])
+	} else if cmdName == "memory" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply("memory")
+		}
+		return server.execMemory(c, cmdLine[1:])
+	} else if cmdName == "bigkeys" {
+		return server.execBigKeys(cmdLine[1:])
+	} else if cmdName == "hotkeys" {
+		return execHotKeys(cmdLine[1:])
+	} else if cmdName == "shutdown" {
+		return server.execShutdown(cmdLine[1:])
+	} else if cmdName == "debug" {
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply("debug")
+		}
+		return server.execDebug(c, cmdLine[1:])
 	}
 
-	// read only slave 从库只能读
+	// slave could also serve its own slaves (chained replication)
+	if cmdName == "replconf" {
+		return server.execReplConf(c, cmdLine[1:])
+	} else if cmdName == "psync" {
+		if len(cmdLine) != 3 {
+			return protocol.MakeArgNumErrReply("psync")
+		}
+		return server.execPSync(c, cmdLine[1:])
+	}
+
+	// commands are paused by CLIENT PAUSE, and writes are paused during failover as well
+	if !c.IsMaster() && !isFakeConn(c) {
+		if mayWrite(c, cmdName) {
+			server.enterWrite()
+			defer server.writeGate.RUnlock()
+		} else {
+			waitPause(c, cmdName)
+		}
+	}
+	start = time.Now() // time spent in pausing is not latency of command
+
 	role := atomic.LoadInt32(&server.role)
+	// replica-serve-stale-data: refuse data commands while link with master is down
+	if role == slaveRole && !c.IsMaster() && !server.canServeStaleData() && !hasRedisFlag(cmdName, redisFlagStale) {
+		rejected = true
+		return protocol.MakeErrReply("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+	}
+
+	// read only slave 从库只能读
 	if role == slaveRole && !c.IsMaster() {
 		// only allow read only command, forbid all special commands except `auth` and `slaveof`
 		if !isReadOnlyCommand(cmdName) { // 如果是从库，判断是不是只读指令
+			rejected = true
 			return protocol.MakeErrReply("READONLY You can't write against a read only slave.")
 		}
 	}
 
+	// min-replicas-to-write: writes from clients are rejected if there are not enough good slaves
+	if role == masterRole && !c.IsMaster() && !isFakeConn(c) && isWriteCommand(cmdName) {
+		if errReply := server.checkMinReplicas(); errReply != nil {
+			rejected = true
+			return errReply
+		}
+	}
+
+	// evict keys if used memory exceeds maxmemory, commands which may grow memory are refused if nothing could be evicted
+	if !isFakeConn(c) {
+		if server.performEvictions() == evictFail && !c.IsMaster() && isDenyOOMCommand(c, cmdName) {
+			rejected = true
+			if c.InMultiState() {
+				c.AddTxError(errOOM) // EXEC would be aborted
+			}
+			return errOOM
+		}
+	}
+
 	// special commands which cannot execute within transaction
 	if cmdName == "subscribe" {
 		if len(cmdLine) < 2 {
@@ -165,15 +341,20 @@ func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.R
 		}
 		return RewriteAOF(server, cmdLine[1:])
 	} else if cmdName == "flushall" { //
-		return server.flushAll()
+		async, errReply := parseFlushMode(cmdName, cmdLine[1:])
+		if errReply != nil {
+			return errReply
+		}
+		return server.flushAll(async)
 	} else if cmdName == "flushdb" {
-		if !validateArity(1, cmdLine) {
-			return protocol.MakeArgNumErrReply(cmdName)
+		async, errReply := parseFlushMode(cmdName, cmdLine[1:])
+		if errReply != nil {
+			return errReply
 		}
 		if c.InMultiState() {
 			return protocol.MakeErrReply("ERR command 'FlushDB' cannot be used in MULTI")
 		}
-		return server.execFlushDB(c.GetDBIndex())
+		return server.execFlushDB(c.GetDBIndex(), async)
 	} else if cmdName == "save" {
 		return SaveRDB(server, cmdLine[1:])
 	} else if cmdName == "bgsave" {
@@ -191,10 +372,6 @@ func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.R
 			return protocol.MakeArgNumErrReply("copy")
 		}
 		return execCopy(server, c, cmdLine[1:])
-	} else if cmdName == "replconf" {
-		return server.execReplConf(c, cmdLine[1:])
-	} else if cmdName == "psync" {
-		return server.execPSync(c, cmdLine[1:])
 	}
 	// todo: support multi database transaction
 
@@ -210,6 +387,7 @@ func (server *Server) Exec(c redis.Connection, cmdLine [][]byte) (result redis.R
 // AfterClientClose does some clean after client close connection
 func (server *Server) AfterClientClose(c redis.Connection) {
 	pubsub.UnsubscribeAll(server.hub, c)
+	server.forgetSlave(c)
 }
 
 // Close graceful shutdown database
@@ -234,20 +412,49 @@ func execSelect(c redis.Connection, mdb *Server, args [][]byte) redis.Reply {
 	return protocol.MakeOkReply()
 }
 
-func (server *Server) execFlushDB(dbIndex int) redis.Reply {
+// parseFlushMode parses the option of FLUSHALL and FLUSHDB, returns true for ASYNC
+func parseFlushMode(cmdName string, args [][]byte) (bool, redis.Reply) {
+	if len(args) > 1 {
+		return false, protocol.MakeArgNumErrReply(cmdName)
+	}
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "async":
+		return true, nil
+	case "sync":
+		return false, nil
+	}
+	return false, protocol.MakeSyntaxErrReply()
+}
+
+// genFlushCmdLine returns command line of flushing to propagate
+func genFlushCmdLine(cmdName string, async bool) CmdLine {
+	if async {
+		return utils.ToCmdLine(cmdName, "ASYNC")
+	}
+	return utils.ToCmdLine(cmdName)
+}
+
+func (server *Server) execFlushDB(dbIndex int, async bool) redis.Reply {
 	if server.persister != nil {
-		server.persister.SaveCmdLine(dbIndex, utils.ToCmdLine("FlushDB"))
+		server.persister.SaveCmdLine(dbIndex, genFlushCmdLine("FlushDB", async))
 	}
-	return server.flushDB(dbIndex)
+	return server.flushDB(dbIndex, async)
 }
 
-// flushDB flushes the selected database
-func (server *Server) flushDB(dbIndex int) redis.Reply {
+// flushDB flushes the selected database, the flushed one is freed in background if async, see lazyfree.go
+func (server *Server) flushDB(dbIndex int, async bool) redis.Reply {
 	if dbIndex >= len(server.dbSet) || dbIndex < 0 {
 		return protocol.MakeErrReply("ERR DB index is out of range")
 	}
+	oldDB := server.mustSelectDB(dbIndex)
 	newDB := makeDB()
 	server.loadDB(dbIndex, newDB)
+	if async && oldDB.data.Len() > 0 {
+		freeAsync(oldDB)
+	}
 	return &protocol.OkReply{}
 }
 
@@ -258,17 +465,21 @@ func (server *Server) loadDB(dbIndex int, newDB *DB) redis.Reply {
 	oldDB := server.mustSelectDB(dbIndex)
 	newDB.index = dbIndex
 	newDB.addAof = oldDB.addAof // inherit oldDB
+	newDB.isSlave = oldDB.isSlave
+	newDB.publish = oldDB.publish
+	newDB.insertCallback = oldDB.insertCallback
+	newDB.deleteCallback = oldDB.deleteCallback
 	server.dbSet[dbIndex].Store(newDB)
 	return &protocol.OkReply{}
 }
 
 // flushAll flushes all databases.
-func (server *Server) flushAll() redis.Reply {
+func (server *Server) flushAll(async bool) redis.Reply {
 	for i := range server.dbSet {
-		server.flushDB(i)
+		server.flushDB(i, async)
 	}
 	if server.persister != nil {
-		server.persister.SaveCmdLine(0, utils.ToCmdLine("FlushAll"))
+		server.persister.SaveCmdLine(0, genFlushCmdLine("FlushAll", async))
 	}
 	return &protocol.OkReply{}
 }
@@ -328,6 +539,11 @@ func (server *Server) RWUnLocks(dbIndex int, writeKeys []string, readKeys []stri
 	server.mustSelectDB(dbIndex).RWUnLocks(writeKeys, readKeys)
 }
 
+// TryRWLocks lock keys for writing and reading, returns false if failed to lock all of them within timeout
+func (server *Server) TryRWLocks(dbIndex int, writeKeys []string, readKeys []string, timeout time.Duration) bool {
+	return server.mustSelectDB(dbIndex).TryRWLocks(writeKeys, readKeys, timeout)
+}
+
 // GetUndoLogs return rollback commands
 func (server *Server) GetUndoLogs(dbIndex int, cmdLine [][]byte) []CmdLine {
 	return server.mustSelectDB(dbIndex).GetUndoLogs(cmdLine)
@@ -404,32 +620,18 @@ func (server *Server) GetDBSize(dbIndex int) (int, int) {
 
 func (server *Server) startReplCron() {
 	go func(mdb *Server) {
-		ticker := time.Tick(time.Second * 10)
+		ticker := time.Tick(time.Second)
 		for range ticker {
 			mdb.slaveCron()
 			mdb.masterCron()
+			mdb.slaveAckCron()
 		}
 	}(server)
 }
 
-// GetAvgTTL Calculate the average expiration time of keys
-func (server *Server) GetAvgTTL(dbIndex, randomKeyCount int) int64 {
-	var ttlCount int64
-	db := server.mustSelectDB(dbIndex)
-	keys := db.data.RandomKeys(randomKeyCount)
-	for _, k := range keys {
-		t := time.Now()
-		rawExpireTime, ok := db.ttlMap.Get(k)
-		if !ok {
-			continue
-		}
-		expireTime, _ := rawExpireTime.(time.Time)
-		// if the key has already reached its expiration time during calculation, ignore it
-		if expireTime.Sub(t).Microseconds() > 0 {
-			ttlCount += expireTime.Sub(t).Microseconds()
-		}
-	}
-	return ttlCount / int64(len(keys))
+// GetAvgTTL returns the average remaining ttl in milliseconds of keys with ttl
+func (server *Server) GetAvgTTL(dbIndex int) int64 {
+	return server.mustSelectDB(dbIndex).avgTTL()
 }
 
 func (server *Server) SetKeyInsertedCallback(cb database.KeyEventCallback) {
@@ -448,3 +650,21 @@ func (server *Server) SetKeyDeletedCallback(cb database.KeyEventCallback) {
 		db.deleteCallback = cb
 	}
 }
+
+// publishKeyspaceEvent publishes keyspace notification to local subscribers and keyspace event callback
+func (server *Server) publishKeyspaceEvent(channel string, message string) {
+	pubsub.Publish(server.hub, utils.ToCmdLine(channel, message))
+	if cb := server.keyspaceEventCallback; cb != nil {
+		cb(channel, message)
+	}
+}
+
+// SetKeyspaceEventCallback sets callback of keyspace notifications, cluster uses it to forward events to other nodes
+func (server *Server) SetKeyspaceEventCallback(cb database.KeyspaceEventCallback) {
+	server.keyspaceEventCallback = cb
+}
+
+// GetSubscribedChannels returns channels which have subscribers on current server and start with prefix
+func (server *Server) GetSubscribedChannels(prefix string) []string {
+	return pubsub.Channels(server.hub, prefix)
+}
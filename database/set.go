@@ -136,7 +136,8 @@ func execSPop(db *DB, args [][]byte) redis.Reply {
 	}
 
 	if count > 0 {
-		db.addAof(utils.ToCmdLine3("spop", args...))
+		// spop is nondeterministic, propagate the removed members
+		db.addAof(utils.ToCmdLine3("srem", append([][]byte{args[0]}, result...)...))
 	}
 	return protocol.MakeMultiBulkReply(result)
 }
@@ -354,6 +355,29 @@ func execSRandMember(db *DB, args [][]byte) redis.Reply {
 	return &protocol.EmptyMultiBulkReply{}
 }
 
+// execSScan iterates members of set, command line: sscan key cursor [MATCH pattern] [COUNT count]
+func execSScan(db *DB, args [][]byte) redis.Reply {
+	cursor, opts, errReply := parseCollectionScan(args, 0)
+	if errReply != nil {
+		return errReply
+	}
+	set, errReply := db.getAsSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if set == nil {
+		return makeScanReply(0, nil)
+	}
+	members, next := scanMembers(cursor, opts.count, set.Len(), set.ForEach)
+	result := make([][]byte, 0, len(members))
+	for _, member := range members {
+		if opts.match(member) {
+			result = append(result, []byte(member))
+		}
+	}
+	return makeScanReply(next, result)
+}
+
 func init() {
 	registerCommand("SAdd", execSAdd, writeFirstKey, undoSetChange, -3, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM, redisFlagFast}, 1, 1, 1)
@@ -376,9 +400,11 @@ func init() {
 	registerCommand("SUnionStore", execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, -1, 1)
 	registerCommand("SDiff", execSDiff, prepareSetCalculate, nil, -2, flagReadOnly).
-		attachCommandExtra([]string{redisFlagReadonly, redisFlagSortForScript}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagSortForScript}, 1, -1, 1)
 	registerCommand("SDiffStore", execSDiffStore, prepareSetCalculateStore, rollbackFirstKey, -3, flagWrite).
-		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, -1, 1)
 	registerCommand("SRandMember", execSRandMember, readFirstKey, nil, -2, flagReadOnly).
 		attachCommandExtra([]string{redisFlagReadonly, redisFlagRandom}, 1, 1, 1)
+	registerCommand("SScan", execSScan, readFirstKey, nil, -3, flagReadOnly).
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagRandom}, 1, 1, 1)
 }
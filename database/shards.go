@@ -0,0 +1,38 @@
+package database
+
+import (
+	"goRedisPlus/datastruct/dict"
+	"goRedisPlus/lib/logger"
+	"time"
+)
+
+// Adaptive sharding:
+// Dicts of keys are sharded by dict-shards if it is set. Otherwise they start with shards picked by GOMAXPROCS,
+// which is small enough for empty databases but keeps concurrent commands from contending for shard locks, and the
+// cron grows them as keys are added, so that shards stay small for SCAN, defragmentation and lock holders. Growing
+// moves keys shard by shard into a larger table, each holding the lock of only the shard being moved, see dict.Grow.
+
+const growShardsInterval = 100 * time.Millisecond
+
+// startGrowShardsCron grows adaptive dicts of all databases periodically
+func (server *Server) startGrowShardsCron() {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(err)
+			}
+		}()
+		ticker := time.NewTicker(growShardsInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for i := range server.dbSet {
+				db := server.mustSelectDB(i)
+				for _, d := range []*dict.ConcurrentDict{db.data, db.ttlMap, db.versionMap} {
+					// each call moves a batch of shards, snapshots could lock all shards between batches
+					for d.Grow() {
+					}
+				}
+			}
+		}
+	}()
+}
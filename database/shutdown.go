@@ -0,0 +1,46 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/redis/protocol"
+	"goRedisPlus/tcp"
+	"strings"
+)
+
+// execShutdown saves rdb if required, flushes aof and asks tcp server to shut down, command line: SHUTDOWN [NOSAVE|SAVE]
+// Without option, rdb is saved if save points are configured and aof is enabled, because rdb is generated from aof.
+// Nothing is replied if it succeeds, connections are closed and the process exits with code 0.
+func (server *Server) execShutdown(args [][]byte) redis.Reply {
+	if len(args) > 1 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	save := config.Properties.Save != "" && server.persister != nil
+	if len(args) == 1 {
+		switch strings.ToLower(string(args[0])) {
+		case "nosave":
+			save = false
+		case "save":
+			save = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	if save {
+		logger.Info("saving the final rdb snapshot before exiting")
+		if reply := SaveRDB(server, nil); protocol.IsErrorReply(reply) {
+			logger.Error("error trying to save the db, can't exit: " + strings.TrimSpace(string(reply.ToBytes())))
+			return protocol.MakeErrReply("ERR Errors trying to SHUTDOWN. Check logs.")
+		}
+	}
+	if server.persister != nil {
+		if err := server.persister.FlushAndFsync(); err != nil {
+			logger.Error("error trying to flush aof, can't exit: " + err.Error())
+			return protocol.MakeErrReply("ERR Errors trying to SHUTDOWN. Check logs.")
+		}
+	}
+	logger.Info("user requested shutdown...")
+	tcp.Shutdown()
+	return &protocol.NoReply{}
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"goRedisPlus/aof"
+	"goRedisPlus/interface/database"
+	"goRedisPlus/lib/latency"
+	"io"
+	"time"
+)
+
+// In-memory snapshot:
+// Diskless replication and chained replication encode rdb from the in-memory data set instead of loading aof again.
+// Go can't fork like redis, so writers are blocked while the data set is encoded: all shards of every db are locked for
+// reading, commands holding locks finish first and the following writes wait, while reads go on. The snapshot is
+// encoded into memory, so writes are not blocked by sending it, which is much slower than encoding.
+
+// frozenDBs are dbs whose shards are all locked for reading, it implements aof.RDBSource without locking again
+type frozenDBs []*DB
+
+func (dbs frozenDBs) ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	dbs[dbIndex].ForEachWithLock(cb)
+}
+
+func (dbs frozenDBs) GetDBSize(dbIndex int) (int, int) {
+	return dbs[dbIndex].data.Len(), dbs[dbIndex].ttlMap.Len()
+}
+
+// writeSnapshot encodes the data set into rdb, writes are blocked until it finished.
+// hook is invoked after all writes in progress finished, it may record replication offset matching the snapshot
+func (server *Server) writeSnapshot(w io.Writer, hook func()) error {
+	dbs := make(frozenDBs, len(server.dbSet))
+	for i := range server.dbSet {
+		dbs[i] = server.mustSelectDB(i)
+	}
+	start := time.Now()
+	for _, db := range dbs {
+		db.data.RLockAll()
+	}
+	defer func() {
+		for i := len(dbs) - 1; i >= 0; i-- {
+			dbs[i].data.RUnlockAll()
+		}
+		// blocking writes plays the role of fork in redis
+		latency.Record("fork", time.Since(start))
+	}()
+	if hook != nil {
+		hook()
+	}
+	return aof.WriteRDB(w, dbs)
+}
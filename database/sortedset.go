@@ -796,6 +796,36 @@ func execZRevRangeByLex(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(result)
 }
 
+// execZScan iterates members and scores of sortedset, command line: zscan key cursor [MATCH pattern] [COUNT count]
+func execZScan(db *DB, args [][]byte) redis.Reply {
+	cursor, opts, errReply := parseCollectionScan(args, 0)
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return makeScanReply(0, nil)
+	}
+	members, next := scanMembers(cursor, opts.count, int(sortedSet.Len()), func(consumer func(member string) bool) {
+		sortedSet.ForEachByRank(0, sortedSet.Len(), false, func(element *SortedSet.Element) bool {
+			return consumer(element.Member)
+		})
+	})
+	result := make([][]byte, 0, len(members)*2)
+	for _, member := range members {
+		if !opts.match(member) {
+			continue
+		}
+		element, _ := sortedSet.Get(member)
+		score := strconv.FormatFloat(element.Score, 'f', -1, 64)
+		result = append(result, []byte(member), []byte(score))
+	}
+	return makeScanReply(next, result)
+}
+
 func init() {
 	registerCommand("ZAdd", execZAdd, writeFirstKey, undoZAdd, -4, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM, redisFlagFast}, 1, 1, 1)
@@ -835,4 +865,6 @@ func init() {
 		attachCommandExtra([]string{redisFlagWrite}, 1, 1, 1)
 	registerCommand("ZRevRangeByLex", execZRevRangeByLex, readFirstKey, nil, -4, flagReadOnly).
 		attachCommandExtra([]string{redisFlagReadonly}, 1, 1, 1)
+	registerCommand("ZScan", execZScan, readFirstKey, nil, -3, flagReadOnly).
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagRandom}, 1, 1, 1)
 }
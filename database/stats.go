@@ -0,0 +1,78 @@
+package database
+
+import (
+	"goRedisPlus/lib/metric"
+	"goRedisPlus/redis/connection"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counters of INFO stats, they are reset by CONFIG RESETSTAT
+var (
+	keyspaceHits   int64 // lookups of existing keys by read-only commands
+	keyspaceMisses int64 // lookups of missing keys by read-only commands
+	expiredKeys    int64 // keys removed because of ttl
+)
+
+// statsSampleInterval is the period of sampling instantaneous metrics
+const statsSampleInterval = 100 * time.Millisecond
+
+var (
+	opsSampler       = metric.NewSampler()
+	netInputSampler  = metric.NewSampler()
+	netOutputSampler = metric.NewSampler()
+	statsCronOnce    sync.Once
+)
+
+// startStatsCron samples counters for instantaneous metrics of INFO stats,
+// counters are shared by all servers so the cron starts only once
+func startStatsCron() {
+	statsCronOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(statsSampleInterval)
+			defer ticker.Stop()
+			for now := range ticker.C {
+				opsSampler.Sample(atomic.LoadInt64(&connection.TotalCommands), now)
+				netInputSampler.Sample(atomic.LoadInt64(&connection.TotalNetInput), now)
+				netOutputSampler.Sample(atomic.LoadInt64(&connection.TotalNetOutput), now)
+			}
+		}()
+	})
+}
+
+// countKeyspaceLookups counts keys read by read-only commands as keyspace hits or misses
+func (db *DB) countKeyspaceLookups(cmd *command, readKeys []string) {
+	if cmd.flags&flagReadOnly == 0 {
+		return
+	}
+	for _, key := range readKeys {
+		if _, exists := db.lookupEntity(key); exists {
+			atomic.AddInt64(&keyspaceHits, 1)
+		} else {
+			atomic.AddInt64(&keyspaceMisses, 1)
+		}
+	}
+}
+
+// resetKeyspaceStats clears counters and samples of INFO stats kept by database
+func resetKeyspaceStats() {
+	atomic.StoreInt64(&keyspaceHits, 0)
+	atomic.StoreInt64(&keyspaceMisses, 0)
+	atomic.StoreInt64(&expiredKeys, 0)
+	atomic.StoreInt64(&expiredStalePerc, 0)
+	atomic.StoreInt64(&expiredTimeCapCycles, 0)
+	atomic.StoreInt64(&expireCycleTime, 0)
+	atomic.StoreInt64(&evictedKeys, 0)
+	atomic.StoreInt64(&lazyfreedObjects, 0)
+	atomic.StoreInt64(&defragHits, 0)
+	atomic.StoreInt64(&defragMisses, 0)
+	atomic.StoreInt64(&defragKeyHits, 0)
+	atomic.StoreInt64(&defragKeyMisses, 0)
+	atomic.StoreInt64(&defragTime, 0)
+	atomic.StoreInt64(&connection.EvictedClients, 0)
+	opsSampler.Reset()
+	netInputSampler.Reset()
+	netOutputSampler.Reset()
+	resetHotKeys()
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"goRedisPlus/aof"
 	"goRedisPlus/datastruct/bitmap"
+	"goRedisPlus/datastruct/strobj"
 	"goRedisPlus/interface/database"
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/lib/utils"
@@ -18,7 +19,7 @@ func (db *DB) getAsString(key string) ([]byte, protocol.ErrorReply) {
 	if !ok {
 		return nil, nil
 	}
-	bytes, ok := entity.Data.([]byte)
+	bytes, ok := strobj.Bytes(entity.Data)
 	if !ok {
 		return nil, &protocol.WrongTypeErrReply{}
 	}
@@ -179,7 +180,7 @@ func execSet(db *DB, args [][]byte) redis.Reply {
 	}
 	// 接口类型
 	entity := &database.DataEntity{
-		Data: value,
+		Data: strobj.Encode(value),
 	}
 
 	var result int
@@ -220,7 +221,7 @@ func execSetNX(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	value := args[1]
 	entity := &database.DataEntity{
-		Data: value,
+		Data: strobj.Encode(value),
 	}
 	result := db.PutIfAbsent(key, entity)
 	db.addAof(utils.ToCmdLine3("setnx", args...))
@@ -242,13 +243,13 @@ func execSetEX(db *DB, args [][]byte) redis.Reply {
 	ttl := ttlArg * 1000
 
 	entity := &database.DataEntity{
-		Data: value,
+		Data: strobj.Encode(value),
 	}
 
 	db.PutEntity(key, entity)
 	expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
 	db.Expire(key, expireTime)
-	db.addAof(utils.ToCmdLine3("setex", args...))
+	db.addAof(utils.ToCmdLine3("set", args[0], value))
 	db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
 	return &protocol.OkReply{}
 }
@@ -267,13 +268,13 @@ func execPSetEX(db *DB, args [][]byte) redis.Reply {
 	}
 
 	entity := &database.DataEntity{
-		Data: value,
+		Data: strobj.Encode(value),
 	}
 
 	db.PutEntity(key, entity)
 	expireTime := time.Now().Add(time.Duration(ttlArg) * time.Millisecond)
 	db.Expire(key, expireTime)
-	db.addAof(utils.ToCmdLine3("setex", args...))
+	db.addAof(utils.ToCmdLine3("set", args[0], value))
 	db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
 
 	return &protocol.OkReply{}
@@ -309,7 +310,7 @@ func execMSet(db *DB, args [][]byte) redis.Reply {
 
 	for i, key := range keys {
 		value := values[i]
-		db.PutEntity(key, &database.DataEntity{Data: value})
+		db.PutEntity(key, &database.DataEntity{Data: strobj.Encode(value)})
 	}
 	db.addAof(utils.ToCmdLine3("mset", args...))
 	return &protocol.OkReply{}
@@ -371,7 +372,7 @@ func execMSetNX(db *DB, args [][]byte) redis.Reply {
 
 	for i, key := range keys {
 		value := values[i]
-		db.PutEntity(key, &database.DataEntity{Data: value})
+		db.PutEntity(key, &database.DataEntity{Data: strobj.Encode(value)})
 	}
 	db.addAof(utils.ToCmdLine3("msetnx", args...))
 	return protocol.MakeIntReply(1)
@@ -387,7 +388,7 @@ func execGetSet(db *DB, args [][]byte) redis.Reply {
 		return err
 	}
 
-	db.PutEntity(key, &database.DataEntity{Data: value})
+	db.PutEntity(key, &database.DataEntity{Data: strobj.Encode(value)})
 	db.Persist(key) // override ttl
 	db.addAof(utils.ToCmdLine3("set", args...))
 	if old == nil {
@@ -428,13 +429,13 @@ func execIncr(db *DB, args [][]byte) redis.Reply {
 			return protocol.MakeErrReply("ERR value is not an integer or out of range")
 		}
 		db.PutEntity(key, &database.DataEntity{
-			Data: []byte(strconv.FormatInt(val+1, 10)),
+			Data: strobj.Int(val + 1),
 		})
 		db.addAof(utils.ToCmdLine3("incr", args...))
 		return protocol.MakeIntReply(val + 1)
 	}
 	db.PutEntity(key, &database.DataEntity{
-		Data: []byte("1"),
+		Data: strobj.Int(1),
 	})
 	db.addAof(utils.ToCmdLine3("incr", args...))
 	return protocol.MakeIntReply(1)
@@ -460,13 +461,13 @@ func execIncrBy(db *DB, args [][]byte) redis.Reply {
 			return protocol.MakeErrReply("ERR value is not an integer or out of range")
 		}
 		db.PutEntity(key, &database.DataEntity{
-			Data: []byte(strconv.FormatInt(val+delta, 10)),
+			Data: strobj.Int(val + delta),
 		})
 		db.addAof(utils.ToCmdLine3("incrby", args...))
 		return protocol.MakeIntReply(val + delta)
 	}
 	db.PutEntity(key, &database.DataEntity{
-		Data: args[1],
+		Data: strobj.Int(delta),
 	})
 	db.addAof(utils.ToCmdLine3("incrby", args...))
 	return protocol.MakeIntReply(delta)
@@ -492,18 +493,29 @@ func execIncrByFloat(db *DB, args [][]byte) redis.Reply {
 		}
 		resultBytes := []byte(strconv.FormatFloat(val+delta, 'f', -1, 64))
 		db.PutEntity(key, &database.DataEntity{
-			Data: resultBytes,
+			Data: strobj.Encode(resultBytes),
 		})
-		db.addAof(utils.ToCmdLine3("incrbyfloat", args...))
+		db.addSetAofKeepTTL(key, resultBytes)
 		return protocol.MakeBulkReply(resultBytes)
 	}
 	db.PutEntity(key, &database.DataEntity{
-		Data: args[1],
+		Data: strobj.Encode(args[1]),
 	})
-	db.addAof(utils.ToCmdLine3("incrbyfloat", args...))
+	db.addSetAofKeepTTL(key, args[1])
 	return protocol.MakeBulkReply(args[1])
 }
 
+// addSetAofKeepTTL propagates result of float arithmetic as SET, so that replayed value is byte-identical.
+// SET clears ttl, so ttl of the key is propagated again
+func (db *DB) addSetAofKeepTTL(key string, value []byte) {
+	db.addAof(utils.ToCmdLine3("set", []byte(key), value))
+	rawExpireTime, ok := db.ttlMap.Get(key)
+	if ok {
+		expireTime, _ := rawExpireTime.(time.Time)
+		db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
+	}
+}
+
 // execDecr decrements the integer value of a key by one
 func execDecr(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
@@ -518,13 +530,13 @@ func execDecr(db *DB, args [][]byte) redis.Reply {
 			return protocol.MakeErrReply("ERR value is not an integer or out of range")
 		}
 		db.PutEntity(key, &database.DataEntity{
-			Data: []byte(strconv.FormatInt(val-1, 10)),
+			Data: strobj.Int(val - 1),
 		})
 		db.addAof(utils.ToCmdLine3("decr", args...))
 		return protocol.MakeIntReply(val - 1)
 	}
 	entity := &database.DataEntity{
-		Data: []byte("-1"),
+		Data: strobj.Int(-1),
 	}
 	db.PutEntity(key, entity)
 	db.addAof(utils.ToCmdLine3("decr", args...))
@@ -550,14 +562,13 @@ func execDecrBy(db *DB, args [][]byte) redis.Reply {
 			return protocol.MakeErrReply("ERR value is not an integer or out of range")
 		}
 		db.PutEntity(key, &database.DataEntity{
-			Data: []byte(strconv.FormatInt(val-delta, 10)),
+			Data: strobj.Int(val - delta),
 		})
 		db.addAof(utils.ToCmdLine3("decrby", args...))
 		return protocol.MakeIntReply(val - delta)
 	}
-	valueStr := strconv.FormatInt(-delta, 10)
 	db.PutEntity(key, &database.DataEntity{
-		Data: []byte(valueStr),
+		Data: strobj.Int(-delta),
 	})
 	db.addAof(utils.ToCmdLine3("decrby", args...))
 	return protocol.MakeIntReply(-delta)
@@ -825,14 +836,23 @@ func execBitPos(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(offset)
 }
 
+// randomKeyTries is the most keys RANDOMKEY picks before giving up finding one not expired
+const randomKeyTries = 100
+
 // GetRandomKey Randomly return (do not delete) a key from the godis
 func getRandomKey(db *DB, args [][]byte) redis.Reply {
-	k := db.data.RandomKeys(1)
-	if len(k) == 0 {
-		return &protocol.NullBulkReply{}
+	for i := 0; i < randomKeyTries; i++ {
+		k := db.data.RandomKeys(1)
+		if len(k) == 0 {
+			return &protocol.NullBulkReply{}
+		}
+		if db.expireLazily(k[0]) {
+			continue
+		}
+		var key []byte
+		return protocol.MakeBulkReply(strconv.AppendQuote(key, k[0]))
 	}
-	var key []byte
-	return protocol.MakeBulkReply(strconv.AppendQuote(key, k[0]))
+	return &protocol.NullBulkReply{}
 }
 
 func init() {
@@ -847,17 +867,17 @@ func init() {
 	registerCommand("MSet", execMSet, prepareMSet, undoMSet, -3, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, -1, 2)
 	registerCommand("MGet", execMGet, prepareMGet, nil, -2, flagReadOnly).
-		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, -1, 1)
 	registerCommand("MSetNX", execMSetNX, prepareMSet, undoMSet, -3, flagWrite).
-		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, -1, 2)
 	registerCommand("Get", execGet, readFirstKey, nil, 2, flagReadOnly).
 		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, 1, 1)
-	registerCommand("GetEX", execGetEX, writeFirstKey, rollbackFirstKey, -2, flagReadOnly).
-		attachCommandExtra([]string{redisFlagReadonly, redisFlagFast}, 1, 1, 1)
+	registerCommand("GetEX", execGetEX, writeFirstKey, rollbackFirstKey, -2, flagWrite).
+		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
 	registerCommand("GetSet", execGetSet, writeFirstKey, rollbackFirstKey, 3, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, 1, 1)
 	registerCommand("GetDel", execGetDel, writeFirstKey, rollbackFirstKey, 2, flagWrite).
-		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagWrite, redisFlagFast}, 1, 1, 1)
 	registerCommand("Incr", execIncr, writeFirstKey, rollbackFirstKey, 2, flagWrite).
 		attachCommandExtra([]string{redisFlagWrite, redisFlagDenyOOM, redisFlagFast}, 1, 1, 1)
 	registerCommand("IncrBy", execIncrBy, writeFirstKey, rollbackFirstKey, 3, flagWrite).
@@ -884,5 +904,5 @@ func init() {
 	registerCommand("BitPos", execBitPos, readFirstKey, nil, -3, flagReadOnly).
 		attachCommandExtra([]string{redisFlagReadonly}, 1, 1, 1)
 	registerCommand("Randomkey", getRandomKey, readAllKeys, nil, 1, flagReadOnly).
-		attachCommandExtra([]string{redisFlagReadonly, redisFlagRandom}, 1, 1, 1)
+		attachCommandExtra([]string{redisFlagReadonly, redisFlagRandom}, 0, 0, 0)
 }
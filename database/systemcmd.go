@@ -4,11 +4,15 @@ import (
 	"fmt"
 	"goRedisPlus/config"
 	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/timewheel"
+	"goRedisPlus/redis/connection"
 	"goRedisPlus/redis/protocol"
 	"goRedisPlus/tcp"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,139 +27,368 @@ func Ping(c redis.Connection, args [][]byte) redis.Reply {
 	}
 }
 
-// Info the information of the godis server returned by the INFO command
-func Info(db *Server, args [][]byte) redis.Reply {
-	if len(args) == 0 {
-		infoCommandList := [...]string{"server", "client", "cluster", "keyspace"}
-		var allSection []byte
-		for _, s := range infoCommandList {
-			allSection = append(allSection, GenGodisInfoString(s, db)...)
-		}
-		return protocol.MakeBulkReply(allSection)
-	} else if len(args) == 1 {
-		section := strings.ToLower(string(args[0]))
-		switch section {
-		case "server":
-			reply := GenGodisInfoString("server", db)
-			return protocol.MakeBulkReply(reply)
-		case "client":
-			return protocol.MakeBulkReply(GenGodisInfoString("client", db))
-		case "cluster":
-			return protocol.MakeBulkReply(GenGodisInfoString("cluster", db))
-		case "keyspace":
-			return protocol.MakeBulkReply(GenGodisInfoString("keyspace", db))
-		default:
-			return protocol.MakeErrReply("Invalid section for 'info' command")
-		}
-	}
-	return protocol.MakeArgNumErrReply("info")
-}
-
-// Auth validate client's password
+// Auth validate client's password, command line: auth [username] password
+// AUTH with only password authenticates as the default user, whose password is requirepass unless changed by ACL
 func Auth(c redis.Connection, args [][]byte) redis.Reply {
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'auth' command")
 	}
-	// 这里我们没有设置密码
-	if config.Properties.RequirePass == "" {
+	username := defaultUser
+	if len(args) == 2 {
+		username = string(args[0])
+		args = args[1:]
+	} else if user := acl.getUser(defaultUser); user.nopass {
+		// 这里我们没有设置密码
 		return protocol.MakeErrReply("ERR Client sent AUTH, but no password is set")
 	}
-	passwd := string(args[0])
-	c.SetPassword(passwd)
-	if config.Properties.RequirePass != passwd {
-		return protocol.MakeErrReply("ERR invalid password")
+	if errReply := authenticate(c, username, string(args[0])); errReply != nil {
+		return errReply
 	}
 	return &protocol.OkReply{}
 }
 
-func isAuthenticated(c redis.Connection) bool {
-	if config.Properties.RequirePass == "" {
+var errWrongPass = protocol.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+
+// authenticate checks password of user, and binds connection with the user if passed
+func authenticate(c redis.Connection, username string, password string) protocol.ErrorReply {
+	user := acl.getUser(username)
+	if user == nil || !user.enabled || !user.checkPassword(password) {
+		return errWrongPass
+	}
+	c.SetUser(username)
+	return nil
+}
+
+// IsAuthenticated returns whether the connection has authenticated, or needs not to authenticate
+// once authenticated, connection keeps its user until the user is deleted or disabled.
+// Connection which needs not to authenticate is authenticated as the default user, so it stays authenticated
+// after requirepass is set. Fake connections of internal commands such as loading aof are always authenticated.
+func IsAuthenticated(c redis.Connection) bool {
+	if isFakeConn(c) {
 		return true
 	}
-	return c.GetPassword() == config.Properties.RequirePass
+	if c.GetUser() == "" {
+		user := acl.getUser(defaultUser)
+		if user.enabled && user.nopass {
+			c.SetUser(defaultUser)
+			return true
+		}
+		return false
+	}
+	user := getConnUser(c)
+	return user != nil && user.enabled
+}
+
+// Hello switches protocol and authenticates, command line: hello [protover [AUTH username password]]
+// only RESP2 is supported
+func Hello(db *Server, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) > 0 {
+		protoVer, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return protocol.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if protoVer != 2 {
+			return protocol.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+		args = args[1:]
+	}
+	var username, password string
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		if option == "auth" && i+2 < len(args) {
+			username, password = string(args[i+1]), string(args[i+2])
+			i += 2
+			continue
+		}
+		return protocol.MakeErrReply("ERR Syntax error in HELLO option '" + option + "'")
+	}
+	if username != "" {
+		if errReply := authenticate(c, username, password); errReply != nil {
+			return errReply
+		}
+	} else if !IsAuthenticated(c) {
+		return protocol.MakeErrReply("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client")
+	}
+	mode := "standalone"
+	if config.Properties.ClusterEnable {
+		mode = "cluster"
+	}
+	role := "master"
+	if db.isSlave() {
+		role = "replica"
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("server")),
+		protocol.MakeBulkReply([]byte("redis")),
+		protocol.MakeBulkReply([]byte("version")),
+		protocol.MakeBulkReply([]byte(godisVersion)),
+		protocol.MakeBulkReply([]byte("proto")),
+		protocol.MakeIntReply(2),
+		protocol.MakeBulkReply([]byte("mode")),
+		protocol.MakeBulkReply([]byte(mode)),
+		protocol.MakeBulkReply([]byte("role")),
+		protocol.MakeBulkReply([]byte(role)),
+		protocol.MakeBulkReply([]byte("modules")),
+		protocol.MakeEmptyMultiBulkReply(),
+	})
+}
+
+func init() {
+	RegisterInfoSection("server", true, genServerInfo)
+	RegisterInfoSection("clients", true, genClientsInfo)
+	RegisterInfoSection("memory", true, genMemoryInfo)
+	RegisterInfoSection("persistence", true, genPersistenceInfo)
+	RegisterInfoSection("stats", true, genStatsInfo)
+	RegisterInfoSection("cluster", true, genClusterInfo)
+	RegisterInfoSection("keyspace", true, genKeyspaceInfo)
 }
 
-func GenGodisInfoString(section string, db *Server) []byte {
+func genServerInfo(server *Server) []byte {
 	startUpTimeFromNow := getGodisRuninngTime()
-	switch section {
-	case "server":
-		s := fmt.Sprintf("# Server\r\n"+
-			"godis_version:%s\r\n"+
-			//"godis_git_sha1:%s\r\n"+
-			//"godis_git_dirty:%d\r\n"+
-			//"godis_build_id:%s\r\n"+
-			"godis_mode:%s\r\n"+
-			"os:%s %s\r\n"+
-			"arch_bits:%d\r\n"+
-			//"multiplexing_api:%s\r\n"+
-			"go_version:%s\r\n"+
-			"process_id:%d\r\n"+
-			"run_id:%s\r\n"+
-			"tcp_port:%d\r\n"+
-			"uptime_in_seconds:%d\r\n"+
-			"uptime_in_days:%d\r\n"+
-			//"hz:%d\r\n"+
-			//"lru_clock:%d\r\n"+
-			"config_file:%s\r\n",
-			godisVersion,
-			//TODO,
-			//TODO,
-			//TODO,
-			getGodisRunningMode(),
-			runtime.GOOS, runtime.GOARCH,
-			32<<(^uint(0)>>63),
-			//TODO,
-			runtime.Version(),
-			os.Getpid(),
-			config.Properties.RunID,
-			config.Properties.Port,
-			startUpTimeFromNow,
-			startUpTimeFromNow/time.Duration(3600*24),
-			//TODO,
-			//TODO,
-			config.Properties.CfPath)
-		return []byte(s)
-	case "client":
-		s := fmt.Sprintf("# Clients\r\n"+
-			"connected_clients:%d\r\n",
-			//"client_recent_max_input_buffer:%d\r\n"+
-			//"client_recent_max_output_buffer:%d\r\n"+
-			//"blocked_clients:%d\n",
-			tcp.ClientCounter,
-			//TODO,
-			//TODO,
-			//TODO,
-		)
-		return []byte(s)
-	case "cluster":
-		if getGodisRunningMode() == config.ClusterMode {
-			s := fmt.Sprintf("# Cluster\r\n"+
-				"cluster_enabled:%s\r\n",
-				"1",
-			)
-			return []byte(s)
+	s := fmt.Sprintf("# Server\r\n"+
+		"godis_version:%s\r\n"+
+		//"godis_git_sha1:%s\r\n"+
+		//"godis_git_dirty:%d\r\n"+
+		//"godis_build_id:%s\r\n"+
+		"godis_mode:%s\r\n"+
+		"os:%s %s\r\n"+
+		"arch_bits:%d\r\n"+
+		//"multiplexing_api:%s\r\n"+
+		"go_version:%s\r\n"+
+		"process_id:%d\r\n"+
+		"run_id:%s\r\n"+
+		"tcp_port:%d\r\n"+
+		"uptime_in_seconds:%d\r\n"+
+		"uptime_in_days:%d\r\n"+
+		//"hz:%d\r\n"+
+		//"lru_clock:%d\r\n"+
+		"config_file:%s\r\n",
+		godisVersion,
+		//TODO,
+		//TODO,
+		//TODO,
+		getGodisRunningMode(),
+		runtime.GOOS, runtime.GOARCH,
+		32<<(^uint(0)>>63),
+		//TODO,
+		runtime.Version(),
+		os.Getpid(),
+		config.Properties.RunID,
+		config.Properties.Port,
+		startUpTimeFromNow,
+		startUpTimeFromNow/time.Duration(3600*24),
+		//TODO,
+		//TODO,
+		config.Properties.CfPath)
+	return []byte(s)
+}
+
+func genClientsInfo(server *Server) []byte {
+	s := fmt.Sprintf("# Clients\r\n"+
+		"connected_clients:%d\r\n"+
+		//"client_recent_max_input_buffer:%d\r\n"+
+		//"client_recent_max_output_buffer:%d\r\n"+
+		//"blocked_clients:%d\n",
+		"maxclients:%d\r\n",
+		atomic.LoadInt64(&tcp.ClientCounter),
+		//TODO,
+		//TODO,
+		//TODO,
+		config.Properties.MaxClients,
+	)
+	return []byte(s)
+}
+
+// genMemoryInfo reports memory of go runtime, used_memory is the heap in use and used_memory_rss is obtained from OS,
+// used_memory_dataset is the estimated size of keys limited by maxmemory, allocator_* are heap spans of go runtime
+func genMemoryInfo(server *Server) []byte {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	dataset := server.usedMemory()
+	var replicasMemory, normalMemory int64
+	connection.ForEach(func(c *connection.Connection) bool {
+		if c.IsSlave() {
+			replicasMemory += c.Memory()
 		} else {
-			s := fmt.Sprintf("# Cluster\r\n"+
-				"cluster_enabled:%s\r\n",
-				"0",
-			)
-			return []byte(s)
+			normalMemory += c.Memory()
 		}
-	case "keyspace":
-		dbCount := config.Properties.Databases
-		var serv []byte
-		for i := 0; i < dbCount; i++ {
-			keys, expiresKeys := db.GetDBSize(i)
-			if keys != 0 {
-				ttlSampleAverage := db.GetAvgTTL(i, 20)
-				serv = append(serv, getDbSize(i, keys, expiresKeys, ttlSampleAverage)...)
-			}
+		return true
+	})
+	maxMemoryClients, _ := config.Properties.MaxMemoryClientsBytes()
+	s := fmt.Sprintf("# Memory\r\n"+
+		"used_memory:%d\r\n"+
+		"used_memory_human:%s\r\n"+
+		"used_memory_rss:%d\r\n"+
+		"used_memory_rss_human:%s\r\n"+
+		"used_memory_dataset:%d\r\n"+
+		"used_memory_dataset_human:%s\r\n"+
+		"maxmemory:%d\r\n"+
+		"maxmemory_human:%s\r\n"+
+		"maxmemory_policy:%s\r\n"+
+		"maxmemory_clients:%d\r\n"+
+		"mem_clients_slaves:%d\r\n"+
+		"mem_clients_normal:%d\r\n"+
+		"allocator_allocated:%d\r\n"+
+		"allocator_active:%d\r\n"+
+		"allocator_resident:%d\r\n"+
+		"allocator_frag_ratio:%.2f\r\n"+
+		"allocator_frag_bytes:%d\r\n"+
+		"mem_fragmentation_ratio:%.2f\r\n"+
+		"mem_gc_count:%d\r\n"+
+		"mem_gc_pause_total_ms:%d\r\n"+
+		"mem_gc_last_pause_us:%d\r\n"+
+		"mem_gc_cpu_percentage:%.2f\r\n"+
+		"mem_gc_next:%d\r\n"+
+		"mem_gogc:%d\r\n"+
+		"mem_go_memory_limit:%s\r\n"+
+		"mem_allocator:go-%s\r\n"+
+		"lazyfree_pending_objects:%d\r\n"+
+		"active_defrag_running:%d\r\n",
+		stats.HeapAlloc,
+		bytesToHuman(stats.HeapAlloc),
+		stats.Sys,
+		bytesToHuman(stats.Sys),
+		dataset,
+		bytesToHuman(uint64(dataset)),
+		config.Properties.MaxMemory,
+		bytesToHuman(uint64(config.Properties.MaxMemory)),
+		getMaxMemoryPolicy(),
+		maxMemoryClients,
+		replicasMemory,
+		normalMemory,
+		stats.HeapAlloc,
+		stats.HeapInuse,
+		stats.HeapSys-stats.HeapReleased,
+		fragmentationRatio(&stats),
+		stats.HeapInuse-stats.HeapAlloc,
+		float64(stats.Sys)/float64(stats.HeapAlloc),
+		stats.NumGC,
+		stats.PauseTotalNs/1e6,
+		stats.PauseNs[(stats.NumGC+255)%256]/1e3,
+		stats.GCCPUFraction*100,
+		stats.NextGC,
+		goGCPercent(),
+		formatMemoryLimit(getMemoryLimit()),
+		runtime.Version(),
+		atomic.LoadInt64(&lazyfreePendingObjects),
+		atomic.LoadInt32(&defragRunning),
+	)
+	return []byte(s)
+}
+
+func genPersistenceInfo(server *Server) []byte {
+	aofEnabled := 0
+	var aofSize int64
+	if server.persister != nil {
+		aofEnabled = 1
+		if stat, err := os.Stat(config.Properties.AppendFilename); err == nil {
+			aofSize = stat.Size()
+		}
+	}
+	s := fmt.Sprintf("# Persistence\r\n"+
+		"aof_enabled:%d\r\n"+
+		"aof_current_size:%d\r\n",
+		aofEnabled,
+		aofSize,
+	)
+	return []byte(s)
+}
+
+func genStatsInfo(server *Server) []byte {
+	timewheelStats := timewheel.GetStats()
+	s := fmt.Sprintf("# Stats\r\n"+
+		"total_connections_received:%d\r\n"+
+		"total_commands_processed:%d\r\n"+
+		"instantaneous_ops_per_sec:%d\r\n"+
+		"total_net_input_bytes:%d\r\n"+
+		"total_net_output_bytes:%d\r\n"+
+		"instantaneous_input_kbps:%.2f\r\n"+
+		"instantaneous_output_kbps:%.2f\r\n"+
+		"rejected_connections:%d\r\n"+
+		"expired_keys:%d\r\n"+
+		"expired_stale_perc:%.2f\r\n"+
+		"expired_time_cap_reached_count:%d\r\n"+
+		"expire_cycle_cpu_milliseconds:%d\r\n"+
+		"evicted_keys:%d\r\n"+
+		"evicted_clients:%d\r\n"+
+		"keyspace_hits:%d\r\n"+
+		"keyspace_misses:%d\r\n"+
+		"lazyfreed_objects:%d\r\n"+
+		"active_defrag_hits:%d\r\n"+
+		"active_defrag_misses:%d\r\n"+
+		"active_defrag_key_hits:%d\r\n"+
+		"active_defrag_key_misses:%d\r\n"+
+		"total_active_defrag_time:%d\r\n"+
+		"timewheel_jobs_executed:%d\r\n"+
+		"timewheel_jobs_pending:%d\r\n"+
+		"timewheel_queue_overflows:%d\r\n",
+		atomic.LoadInt64(&tcp.AcceptedCounter),
+		atomic.LoadInt64(&connection.TotalCommands),
+		int64(opsSampler.Rate()),
+		atomic.LoadInt64(&connection.TotalNetInput),
+		atomic.LoadInt64(&connection.TotalNetOutput),
+		netInputSampler.Rate()/1024,
+		netOutputSampler.Rate()/1024,
+		atomic.LoadInt64(&tcp.RejectedCounter),
+		atomic.LoadInt64(&expiredKeys),
+		float64(atomic.LoadInt64(&expiredStalePerc))/100,
+		atomic.LoadInt64(&expiredTimeCapCycles),
+		atomic.LoadInt64(&expireCycleTime)/int64(time.Millisecond),
+		atomic.LoadInt64(&evictedKeys),
+		atomic.LoadInt64(&connection.EvictedClients),
+		atomic.LoadInt64(&keyspaceHits),
+		atomic.LoadInt64(&keyspaceMisses),
+		atomic.LoadInt64(&lazyfreedObjects),
+		atomic.LoadInt64(&defragHits),
+		atomic.LoadInt64(&defragMisses),
+		atomic.LoadInt64(&defragKeyHits),
+		atomic.LoadInt64(&defragKeyMisses),
+		atomic.LoadInt64(&defragTime)/int64(time.Millisecond),
+		timewheelStats.Executed,
+		timewheelStats.Pending,
+		timewheelStats.Overflows,
+	)
+	return []byte(s)
+}
+
+func genClusterInfo(server *Server) []byte {
+	enabled := "0"
+	if getGodisRunningMode() == config.ClusterMode {
+		enabled = "1"
+	}
+	s := fmt.Sprintf("# Cluster\r\n"+
+		"cluster_enabled:%s\r\n",
+		enabled,
+	)
+	return []byte(s)
+}
+
+func genKeyspaceInfo(server *Server) []byte {
+	dbCount := config.Properties.Databases
+	keyspaceInfo := []byte("# Keyspace\r\n")
+	for i := 0; i < dbCount; i++ {
+		keys, expiresKeys := server.GetDBSize(i)
+		if keys != 0 {
+			keyspaceInfo = append(keyspaceInfo, getDbSize(i, keys, expiresKeys, server.GetAvgTTL(i))...)
 		}
-		prefix := []byte("# Keyspace\r\n")
-		keyspaceInfo := append(prefix, serv...)
-		return keyspaceInfo
 	}
-	return []byte("")
+	return keyspaceInfo
+}
+
+// bytesToHuman formats bytes like 1.50M
+func bytesToHuman(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T", "P"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", value, units[i])
 }
 
 // getGodisRunningMode return godis running mode
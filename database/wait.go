@@ -0,0 +1,152 @@
+package database
+
+import (
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
+	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/utils"
+	"goRedisPlus/redis/protocol"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const waitPollInterval = 10 * time.Millisecond
+
+var getAckBytes = protocol.MakeMultiBulkReply(utils.ToCmdLine("REPLCONF", "GETACK", "*")).ToBytes()
+
+// execWait blocks until numreplicas slaves have acknowledged all previous writes or timeout reached
+// WAIT numreplicas timeout
+func (server *Server) execWait(c redis.Connection, args [][]byte) redis.Reply {
+	if atomic.LoadInt32(&server.role) == slaveRole {
+		return protocol.MakeErrReply("ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.")
+	}
+	numReplicas, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeoutMs, errReply := parseWaitTimeout(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	// make sure previous writes of this client have been appended into backlog.
+	// Writes are propagated asynchronously, so current offset of backlog is an upper bound of client's last write offset
+	if server.persister != nil {
+		server.persister.Flush()
+	}
+	acked := server.waitSlavesAck(numReplicas, timeoutMs, false)
+	return protocol.MakeIntReply(int64(acked))
+}
+
+// execWaitAof blocks until writes have been fsynced to local aof and aof of numreplicas slaves
+// WAITAOF numlocal numreplicas timeout
+func (server *Server) execWaitAof(c redis.Connection, args [][]byte) redis.Reply {
+	if atomic.LoadInt32(&server.role) == slaveRole {
+		return protocol.MakeErrReply("ERR WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+	}
+	numLocal, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	numReplicas, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeoutMs, errReply := parseWaitTimeout(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	if numLocal > 1 {
+		return protocol.MakeErrReply("ERR value is out of range, must be 0 or 1")
+	}
+	if numLocal > 0 && (!config.Properties.AppendOnly || server.persister == nil) {
+		return protocol.MakeErrReply("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+	var localCount int64
+	if config.Properties.AppendOnly && server.persister != nil {
+		// fsync also makes sure previous writes have been appended into backlog
+		if err := server.persister.FlushAndFsync(); err != nil {
+			logger.Errorf("fsync aof failed: %v", err)
+		} else {
+			localCount = 1
+		}
+	}
+	acked := server.waitSlavesAck(numReplicas, timeoutMs, true)
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeIntReply(localCount),
+		protocol.MakeIntReply(int64(acked)),
+	})
+}
+
+func parseWaitTimeout(arg []byte) (int64, redis.Reply) {
+	timeoutMs, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	if timeoutMs < 0 {
+		return 0, protocol.MakeErrReply("ERR timeout is negative")
+	}
+	return timeoutMs, nil
+}
+
+// waitSlavesAck blocks until numReplicas slaves acknowledged current offset of backlog or timeout reached.
+// timeoutMs == 0 means blocking forever.
+// If fsynced is true, only offsets which have been fsynced into aof of slaves are counted
+func (server *Server) waitSlavesAck(numReplicas int, timeoutMs int64, fsynced bool) int {
+	server.masterStatus.mu.RLock()
+	targetOffset := server.masterStatus.backlog.currentOffset
+	server.masterStatus.mu.RUnlock()
+
+	acked := server.countAckedSlaves(targetOffset, fsynced)
+	if acked >= numReplicas {
+		return acked
+	}
+	// ask slaves to send ack as soon as possible instead of waiting for next ack cron
+	server.requestAckFromSlaves()
+	var deadline time.Time
+	if timeoutMs > 0 {
+		deadline = time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	}
+	for {
+		time.Sleep(waitPollInterval)
+		acked = server.countAckedSlaves(targetOffset, fsynced)
+		if acked >= numReplicas {
+			break
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+	}
+	return acked
+}
+
+// countAckedSlaves returns how many online slaves have acknowledged the given offset
+func (server *Server) countAckedSlaves(offset int64, fsynced bool) int {
+	server.masterStatus.mu.RLock()
+	defer server.masterStatus.mu.RUnlock()
+	count := 0
+	for slave := range server.masterStatus.onlineSlaves {
+		ackOffset := slave.ackOffset
+		if fsynced {
+			ackOffset = slave.aofAckOffset
+		}
+		if ackOffset >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// requestAckFromSlaves sends `REPLCONF GETACK *` to online slaves
+func (server *Server) requestAckFromSlaves() {
+	server.masterStatus.mu.Lock()
+	if len(server.masterStatus.onlineSlaves) == 0 || server.masterStatus.bgSaveState != bgSaveFinish {
+		server.masterStatus.mu.Unlock()
+		return
+	}
+	server.masterStatus.backlog.appendBytes(getAckBytes)
+	server.masterStatus.mu.Unlock()
+	if err := server.masterSendUpdatesToSlave(); err != nil {
+		logger.Errorf("masterSendUpdatesToSlave error: %v", err)
+	}
+}
@@ -2,7 +2,9 @@ package dict
 
 import (
 	"math"
+	"math/bits"
 	"math/rand"
+	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -11,14 +13,46 @@ import (
 
 // ConcurrentDict is thread safe map using sharding lock
 type ConcurrentDict struct {
-	table      []*shard
+	table      atomic.Value // *shardTable
 	count      int32
 	shardCount int
+	// adaptive dicts move keys into a table with more shards as keys grow, see Grow
+	adaptive bool
+	// growMu serializes Grow, Clear and RLockAll, accesses to keys never hold it
+	growMu sync.Mutex
+	// growing is the table keys are being moved to, and growCursor is the next shard to move, guarded by growMu
+	growing    *shardTable
+	growCursor int
+}
+
+type shardTable struct {
+	shards []*shard
+	// gen is greater for tables grown later, shards are locked in order of gen and index, see shard.rank
+	gen uint32
 }
 
 type shard struct {
-	m     map[string]interface{}
+	m map[string]interface{}
+	// peak is the most keys m has held, maps of go never shrink after deletions, see ShrinkShards
+	peak  int
 	mutex sync.RWMutex
+	rank  uint64
+	// next is the table keys of shard have been moved to by Grow, set once holding mutex
+	next atomic.Value // *shardTable
+}
+
+// put inserts a new key into shard, invoker should hold its lock
+func (s *shard) put(key string, val interface{}) {
+	s.m[key] = val
+	if len(s.m) > s.peak {
+		s.peak = len(s.m)
+	}
+}
+
+// forwarded returns the table keys of shard have been moved to, or nil if they are still here
+func (s *shard) forwarded() *shardTable {
+	t, _ := s.next.Load().(*shardTable)
+	return t
 }
 
 func computeCapacity(param int) (size int) {
@@ -37,47 +71,189 @@ func computeCapacity(param int) (size int) {
 	return n + 1
 }
 
-// MakeConcurrent creates ConcurrentDict with the given shard count
-func MakeConcurrent(shardCount int) *ConcurrentDict {
-	shardCount = computeCapacity(shardCount)
-	table := make([]*shard, shardCount)
+func makeTable(shardCount int, shardSize int, gen uint32) *shardTable {
+	table := &shardTable{
+		shards: make([]*shard, shardCount),
+		gen:    gen,
+	}
 	for i := 0; i < shardCount; i++ {
-		table[i] = &shard{
-			m: make(map[string]interface{}),
+		table.shards[i] = &shard{
+			m:    make(map[string]interface{}, shardSize),
+			rank: uint64(gen)<<32 | uint64(i),
 		}
 	}
+	return table
+}
+
+// locate returns the shard holding keys of hashCode, following shards moved to later tables
+func (table *shardTable) locate(hashCode uint32) *shard {
+	for {
+		s := table.shards[hashCode&uint32(len(table.shards)-1)]
+		next := s.forwarded()
+		if next == nil {
+			return s
+		}
+		table = next
+	}
+}
+
+// visit invokes fn with shard of index locked for reading, or with shards its keys have been moved to one by one.
+// It returns false if fn does
+func (table *shardTable) visit(index uint32, fn func(s *shard) bool) bool {
+	s := table.shards[index]
+	s.mutex.RLock()
+	next := s.forwarded()
+	if next == nil {
+		defer s.mutex.RUnlock()
+		return fn(s)
+	}
+	s.mutex.RUnlock()
+	// keys of shard i of n shards go to shard i+k*n
+	for i := index; i < uint32(len(next.shards)); i += uint32(len(table.shards)) {
+		if !next.visit(i, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// MakeConcurrent creates ConcurrentDict with the given shard count
+func MakeConcurrent(shardCount int) *ConcurrentDict {
+	shardCount = computeCapacity(shardCount)
 	d := &ConcurrentDict{
 		count:      0,
-		table:      table,
 		shardCount: shardCount,
 	}
+	d.table.Store(makeTable(shardCount, 0, 0))
 	return d
 }
 
-const prime32 = uint32(16777619)
+const (
+	// adaptiveShardsPerProc is the initial shards of adaptive dicts for each of GOMAXPROCS,
+	// so that concurrent accesses rarely collide on a shard
+	adaptiveShardsPerProc = 64
+	// adaptiveMaxShardKeys is the average keys of shards above which adaptive dicts grow
+	adaptiveMaxShardKeys = 1024
+	// adaptiveGrowShardKeys is the average keys of shards after adaptive dicts grow
+	adaptiveGrowShardKeys = 256
+	// adaptiveMaxShards is the most shards of adaptive dicts
+	adaptiveMaxShards = 1 << 16
+	// adaptiveGrowBatch is the most shards moved by each call of Grow
+	adaptiveGrowBatch = 64
+)
 
-func fnv32(key string) uint32 {
-	hash := uint32(2166136261)
-	for i := 0; i < len(key); i++ {
-		hash *= prime32
-		hash ^= uint32(key[i])
-	}
-	return hash
+// MakeAdaptive creates ConcurrentDict whose shard count is picked by GOMAXPROCS, and grows with keys by Grow
+func MakeAdaptive() *ConcurrentDict {
+	d := MakeConcurrent(runtime.GOMAXPROCS(0) * adaptiveShardsPerProc)
+	d.adaptive = true
+	return d
 }
 
-func (dict *ConcurrentDict) spread(hashCode uint32) uint32 {
+func (dict *ConcurrentDict) loadTable() *shardTable {
+	return dict.table.Load().(*shardTable)
+}
+
+// locate returns the shard holding key, invoker should hold its lock to keep it from being moved
+func (dict *ConcurrentDict) locate(key string) *shard {
 	if dict == nil {
 		panic("dict is nil")
 	}
-	tableSize := uint32(len(dict.table))
-	return (tableSize - 1) & hashCode
+	return dict.loadTable().locate(fnv32(key))
 }
 
-func (dict *ConcurrentDict) getShard(index uint32) *shard {
+// lockKey locks and returns the shard holding key, it is not moved until unlocked
+func (dict *ConcurrentDict) lockKey(key string, write bool) *shard {
 	if dict == nil {
 		panic("dict is nil")
 	}
-	return dict.table[index]
+	hashCode := fnv32(key)
+	table := dict.loadTable()
+	for {
+		s := table.locate(hashCode)
+		if write {
+			s.mutex.Lock()
+		} else {
+			s.mutex.RLock()
+		}
+		next := s.forwarded()
+		if next == nil {
+			return s
+		}
+		// moved before locked
+		if write {
+			s.mutex.Unlock()
+		} else {
+			s.mutex.RUnlock()
+		}
+		table = next
+	}
+}
+
+// ShardCount returns the number of shards
+func (dict *ConcurrentDict) ShardCount() int {
+	return len(dict.loadTable().shards)
+}
+
+// Grow moves keys of an adaptive dict into a table with more shards if its shards hold more than
+// adaptiveMaxShardKeys keys on average. Keys are moved incrementally: each call moves at most adaptiveGrowBatch
+// shards, and each shard is moved holding only its own lock, so accesses to other shards go on. A moved shard
+// forwards to the new table, which replaces the old one once all shards are moved, so an access always finds
+// the only shard holding its key. Grow returns whether the dict is still growing, callers should call it again.
+func (dict *ConcurrentDict) Grow() bool {
+	if !dict.adaptive {
+		return false
+	}
+	dict.growMu.Lock()
+	defer dict.growMu.Unlock()
+	table := dict.loadTable()
+	if dict.growing == nil {
+		shardCount := len(table.shards)
+		if dict.Len() <= shardCount*adaptiveMaxShardKeys || shardCount >= adaptiveMaxShards {
+			return false
+		}
+		shardCount = computeCapacity(dict.Len() / adaptiveGrowShardKeys)
+		if shardCount > adaptiveMaxShards {
+			shardCount = adaptiveMaxShards
+		}
+		if shardCount <= len(table.shards) {
+			return false
+		}
+		dict.growing = makeTable(shardCount, dict.Len()/shardCount, table.gen+1)
+		dict.growCursor = 0
+	}
+	for end := dict.growCursor + adaptiveGrowBatch; dict.growCursor < len(table.shards) && dict.growCursor < end; dict.growCursor++ {
+		table.shards[dict.growCursor].moveTo(dict.growing)
+	}
+	if dict.growCursor >= len(table.shards) {
+		dict.table.Store(dict.growing)
+		dict.growing = nil
+	}
+	return dict.growing != nil
+}
+
+// moveTo moves keys of shard into table. Shards of table receiving them are reachable only through forwarded
+// of this shard, so they are filled without their locks
+func (s *shard) moveTo(table *shardTable) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mask := uint32(len(table.shards) - 1)
+	for key, val := range s.m {
+		table.shards[fnv32(key)&mask].put(key, val)
+	}
+	s.m = nil
+	s.peak = 0
+	s.next.Store(table)
+}
+
+const prime32 = uint32(16777619)
+
+func fnv32(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash *= prime32
+		hash ^= uint32(key[i])
+	}
+	return hash
 }
 
 // Get returns the binding value and whether the key is exist
@@ -85,11 +261,8 @@ func (dict *ConcurrentDict) Get(key string) (val interface{}, exists bool) {
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)
-	index := dict.spread(hashCode)
-	s := dict.getShard(index)
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	s := dict.lockKey(key, false)
+	defer s.mutex.RUnlock()
 	val, exists = s.m[key]
 	return
 }
@@ -98,9 +271,7 @@ func (dict *ConcurrentDict) GetWithLock(key string) (val interface{}, exists boo
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)
-	index := dict.spread(hashCode)
-	s := dict.getShard(index)
+	s := dict.locate(key)
 	val, exists = s.m[key]
 	return
 }
@@ -118,10 +289,7 @@ func (dict *ConcurrentDict) Put(key string, val interface{}) (result int) {
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)
-	index := dict.spread(hashCode)
-	s := dict.getShard(index)
-	s.mutex.Lock()
+	s := dict.lockKey(key, true)
 	defer s.mutex.Unlock()
 
 	if _, ok := s.m[key]; ok {
@@ -129,7 +297,7 @@ func (dict *ConcurrentDict) Put(key string, val interface{}) (result int) {
 		return 0
 	}
 	dict.addCount()
-	s.m[key] = val
+	s.put(key, val)
 	return 1
 }
 
@@ -138,16 +306,14 @@ func (dict *ConcurrentDict) PutWithLock(key string, val interface{}) (result int
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)         // 计算hash值
-	index := dict.spread(hashCode) // 计算属于哪个分片
-	s := dict.getShard(index)      // 得到这个分片
+	s := dict.locate(key)
 
 	if _, ok := s.m[key]; ok {
 		s.m[key] = val
 		return 0
 	}
 	dict.addCount()
-	s.m[key] = val
+	s.put(key, val)
 	return 1
 }
 
@@ -156,16 +322,13 @@ func (dict *ConcurrentDict) PutIfAbsent(key string, val interface{}) (result int
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)
-	index := dict.spread(hashCode)
-	s := dict.getShard(index)
-	s.mutex.Lock()
+	s := dict.lockKey(key, true)
 	defer s.mutex.Unlock()
 
 	if _, ok := s.m[key]; ok {
 		return 0
 	}
-	s.m[key] = val
+	s.put(key, val)
 	dict.addCount()
 	return 1
 }
@@ -174,14 +337,12 @@ func (dict *ConcurrentDict) PutIfAbsentWithLock(key string, val interface{}) (re
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)
-	index := dict.spread(hashCode)
-	s := dict.getShard(index)
+	s := dict.locate(key)
 
 	if _, ok := s.m[key]; ok {
 		return 0
 	}
-	s.m[key] = val
+	s.put(key, val)
 	dict.addCount()
 	return 1
 }
@@ -191,10 +352,7 @@ func (dict *ConcurrentDict) PutIfExists(key string, val interface{}) (result int
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)
-	index := dict.spread(hashCode)
-	s := dict.getShard(index)
-	s.mutex.Lock()
+	s := dict.lockKey(key, true)
 	defer s.mutex.Unlock()
 
 	if _, ok := s.m[key]; ok {
@@ -208,9 +366,7 @@ func (dict *ConcurrentDict) PutIfExistsWithLock(key string, val interface{}) (re
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)
-	index := dict.spread(hashCode)
-	s := dict.getShard(index)
+	s := dict.locate(key)
 
 	if _, ok := s.m[key]; ok {
 		s.m[key] = val
@@ -224,10 +380,7 @@ func (dict *ConcurrentDict) Remove(key string) (val interface{}, result int) {
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)
-	index := dict.spread(hashCode)
-	s := dict.getShard(index)
-	s.mutex.Lock()
+	s := dict.lockKey(key, true)
 	defer s.mutex.Unlock()
 
 	if val, ok := s.m[key]; ok {
@@ -242,9 +395,7 @@ func (dict *ConcurrentDict) RemoveWithLock(key string) (val interface{}, result
 	if dict == nil {
 		panic("dict is nil")
 	}
-	hashCode := fnv32(key)
-	index := dict.spread(hashCode)
-	s := dict.getShard(index)
+	s := dict.locate(key)
 
 	if val, ok := s.m[key]; ok {
 		delete(s.m, key)
@@ -268,23 +419,132 @@ func (dict *ConcurrentDict) ForEach(consumer Consumer) {
 	if dict == nil {
 		panic("dict is nil")
 	}
-
-	for _, s := range dict.table {
-		s.mutex.RLock()
-		f := func() bool {
-			defer s.mutex.RUnlock()
+	table := dict.loadTable()
+	for i := range table.shards {
+		continues := table.visit(uint32(i), func(s *shard) bool {
 			for key, value := range s.m {
-				continues := consumer(key, value)
-				if !continues {
+				if !consumer(key, value) {
 					return false
 				}
 			}
 			return true
+		})
+		if !continues {
+			break
 		}
-		if !f() {
+	}
+}
+
+// currentShards returns shards holding keys in the order of locking, invoker should hold growMu so that none of
+// them is moved. Shards not moved yet come first, then shards of the growing table keys have been moved to
+func (dict *ConcurrentDict) currentShards() []*shard {
+	table := dict.loadTable()
+	shards := make([]*shard, 0, len(table.shards))
+	for _, s := range table.shards {
+		if s.forwarded() == nil {
+			shards = append(shards, s)
+		}
+	}
+	if dict.growing != nil {
+		n := len(table.shards)
+		for i, s := range dict.growing.shards {
+			if table.shards[i%n].forwarded() != nil {
+				shards = append(shards, s)
+			}
+		}
+	}
+	return shards
+}
+
+// ForEachWithLock is like ForEach, but invoker should provide with locks of all shards, see RLockAll
+func (dict *ConcurrentDict) ForEachWithLock(consumer Consumer) {
+	for _, s := range dict.currentShards() {
+		for key, value := range s.m {
+			if !consumer(key, value) {
+				return
+			}
+		}
+	}
+}
+
+// DictScan visits shards from cursor until at least count keys have been visited or all shards have been visited,
+// it returns keys accepted by filter and cursor of the next shard, 0 means the iteration is finished.
+// Like redis, shards are visited in the order of reverse binary cursors: the cursor is incremented from its highest
+// bit. Since shard count is a power of 2 and a key of shard i goes to shard i+k*n when table grows from n shards,
+// shards visited before growing are exactly those whose reversed index is below the cursor in the new table, and
+// vice versa when it shrinks. So keys always in dict during iteration will be returned at least once, however
+// shard count changes between calls, and the iteration always ends. A shard moved by Grow in progress is visited
+// through shards its keys have been moved to, like redis visits both tables during rehashing.
+func (dict *ConcurrentDict) DictScan(cursor int, count int, filter func(key string) bool) ([]string, int) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	table := dict.loadTable()
+	var result []string
+	visited := 0
+	mask := uint32(len(table.shards) - 1)
+	v := uint32(cursor)
+	for {
+		table.visit(v&mask, func(s *shard) bool {
+			for key := range s.m {
+				if filter == nil || filter(key) {
+					result = append(result, key)
+				}
+			}
+			visited += len(s.m)
+			return true
+		})
+		v = nextCursor(v, mask)
+		if v == 0 || visited >= count {
 			break
 		}
 	}
+	return result, int(v)
+}
+
+// nextCursor returns cursor of the shard after v in the order of reversed bits of index, 0 if v is the last one
+func nextCursor(v uint32, mask uint32) uint32 {
+	// set bits above mask so that increment of reversed cursor carries into the highest bit of mask
+	v |= ^mask
+	v = bits.Reverse32(v)
+	v++
+	return bits.Reverse32(v)
+}
+
+const (
+	// shrinkMinPeak is the least peak of shards to shrink, rebuilding small maps frees little
+	shrinkMinPeak = 16
+	// shrinkRatio is the ratio of peak to current keys above which shards are shrunk
+	shrinkRatio = 4
+)
+
+// ShrinkShards visits count shards from cursor, and rebuilds maps of shards holding less than a quarter of their peak.
+// It returns the number of rebuilt shards and cursor of the next shard, 0 means all shards have been visited.
+// Shards moved by Grow are skipped, maps receiving their keys are new.
+func (dict *ConcurrentDict) ShrinkShards(cursor int, count int) (int, int) {
+	if dict == nil {
+		panic("dict is nil")
+	}
+	table := dict.loadTable()
+	shrunk := 0
+	for end := cursor + count; cursor >= 0 && cursor < len(table.shards) && cursor < end; cursor++ {
+		s := table.shards[cursor]
+		s.mutex.Lock()
+		if s.forwarded() == nil && s.peak >= shrinkMinPeak && len(s.m)*shrinkRatio < s.peak {
+			m := make(map[string]interface{}, len(s.m))
+			for key, val := range s.m {
+				m[key] = val
+			}
+			s.m = m
+			s.peak = len(m)
+			shrunk++
+		}
+		s.mutex.Unlock()
+	}
+	if cursor < 0 || cursor >= len(table.shards) {
+		cursor = 0
+	}
+	return shrunk, cursor
 }
 
 // Keys returns all keys in dict
@@ -317,22 +577,34 @@ func (shard *shard) RandomKey() string {
 	return ""
 }
 
+// randomShard picks a shard of table randomly, following shards moved to later tables
+func (table *shardTable) randomShard(nR *rand.Rand) *shard {
+	index := nR.Intn(len(table.shards))
+	for {
+		s := table.shards[index]
+		next := s.forwarded()
+		if next == nil {
+			return s
+		}
+		// keys of shard i of n shards go to shard i+k*n
+		index += nR.Intn(len(next.shards)/len(table.shards)) * len(table.shards)
+		table = next
+	}
+}
+
 // RandomKeys randomly returns keys of the given number, may contain duplicated key
 func (dict *ConcurrentDict) RandomKeys(limit int) []string {
 	size := dict.Len()
 	if limit >= size {
 		return dict.Keys()
 	}
-	shardCount := len(dict.table)
+	table := dict.loadTable()
 
 	result := make([]string, limit)
 	nR := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for i := 0; i < limit; {
-		s := dict.getShard(uint32(nR.Intn(shardCount)))
-		if s == nil {
-			continue
-		}
-		key := s.RandomKey()
+		// key is empty if the shard is moved after picked, then pick again
+		key := table.randomShard(nR).RandomKey()
 		if key != "" {
 			result[i] = key
 			i++
@@ -341,98 +613,205 @@ func (dict *ConcurrentDict) RandomKeys(limit int) []string {
 	return result
 }
 
-// RandomDistinctKeys randomly returns keys of the given number, won't contain duplicated key
+// randomDistinctMaxTries is the max attempts per key of RandomDistinctKeys
+const randomDistinctMaxTries = 16
+
+// RandomDistinctKeys randomly returns keys of the given number, won't contain duplicated key.
+// It returns fewer keys if the dict shrinks below limit concurrently
 func (dict *ConcurrentDict) RandomDistinctKeys(limit int) []string {
 	size := dict.Len()
 	if limit >= size {
 		return dict.Keys()
 	}
-
-	shardCount := len(dict.table)
+	table := dict.loadTable()
 	result := make(map[string]struct{})
 	nR := rand.New(rand.NewSource(time.Now().UnixNano()))
-	for len(result) < limit {
-		shardIndex := uint32(nR.Intn(shardCount))
-		s := dict.getShard(shardIndex)
-		if s == nil {
-			continue
+	// bound the attempts, otherwise it spins forever if the dict shrinks below limit
+	for tries := 0; len(result) < limit && tries < limit*randomDistinctMaxTries; tries++ {
+		if dict.Len() <= len(result) {
+			break
 		}
-		key := s.RandomKey()
+		key := table.randomShard(nR).RandomKey()
 		if key != "" {
 			if _, exists := result[key]; !exists {
 				result[key] = struct{}{}
 			}
 		}
 	}
-	arr := make([]string, limit)
-	i := 0
+	if len(result) < limit {
+		// sampling is unlucky when most of shards are empty, take the rest in order
+		dict.ForEach(func(key string, val interface{}) bool {
+			result[key] = struct{}{}
+			return len(result) < limit
+		})
+	}
+	arr := make([]string, 0, len(result))
 	for k := range result {
-		arr[i] = k
-		i++
+		arr = append(arr, k)
 	}
 	return arr
 }
 
 // Clear removes all keys in dict
 func (dict *ConcurrentDict) Clear() {
-	*dict = *MakeConcurrent(dict.shardCount)
+	dict.growMu.Lock()
+	defer dict.growMu.Unlock()
+	dict.growing = nil
+	dict.table.Store(makeTable(dict.shardCount, 0, 0))
+	atomic.StoreInt32(&dict.count, 0)
 }
 
-func (dict *ConcurrentDict) toLockIndices(keys []string, reverse bool) []uint32 {
-	indexMap := make(map[uint32]struct{})
-	for _, key := range keys {
-		index := dict.spread(fnv32(key))
-		indexMap[index] = struct{}{}
+// shardLock is a shard to lock for a command, and whether to lock it for writing
+type shardLock struct {
+	s     *shard
+	write bool
+}
+
+func (l shardLock) lock() {
+	if l.write {
+		l.s.mutex.Lock()
+	} else {
+		l.s.mutex.RLock()
 	}
-	indices := make([]uint32, 0, len(indexMap))
-	for index := range indexMap {
-		indices = append(indices, index)
+}
+
+func (l shardLock) tryLock() bool {
+	if l.write {
+		return l.s.mutex.TryLock()
 	}
-	sort.Slice(indices, func(i, j int) bool {
-		if !reverse {
-			return indices[i] < indices[j]
-		}
-		return indices[i] > indices[j]
+	return l.s.mutex.TryRLock()
+}
+
+func (l shardLock) unlock() {
+	if l.write {
+		l.s.mutex.Unlock()
+	} else {
+		l.s.mutex.RUnlock()
+	}
+}
+
+// toShardLocks returns shards holding keys without duplicates, sorted by rank which is the order of locking.
+// A shard of both write keys and read keys is locked for writing
+func (dict *ConcurrentDict) toShardLocks(writeKeys []string, readKeys []string) []shardLock {
+	table := dict.loadTable()
+	locks := make([]shardLock, 0, len(writeKeys)+len(readKeys))
+	for _, key := range writeKeys {
+		locks = append(locks, shardLock{s: table.locate(fnv32(key)), write: true})
+	}
+	for _, key := range readKeys {
+		locks = append(locks, shardLock{s: table.locate(fnv32(key))})
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].s.rank < locks[j].s.rank
 	})
-	return indices
+	n := 0
+	for _, l := range locks {
+		if n > 0 && locks[n-1].s == l.s {
+			locks[n-1].write = locks[n-1].write || l.write
+			continue
+		}
+		locks[n] = l
+		n++
+	}
+	return locks[:n]
+}
+
+// anyMoved returns whether any of locked shards was moved before locked, then keys should be located again
+func anyMoved(locks []shardLock) bool {
+	for _, l := range locks {
+		if l.s.forwarded() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func unlockAll(locks []shardLock) {
+	for i := len(locks) - 1; i >= 0; i-- {
+		locks[i].unlock()
+	}
 }
 
-// RWLocks locks write keys and read keys together. allow duplicate keys
+// singleKey returns the only key and whether it is a write key, ok is false if there are more or less keys.
+// Commands of a single key such as GET and SET are the most, they skip sorting and deduplicating locks.
+func singleKey(writeKeys []string, readKeys []string) (key string, write bool, ok bool) {
+	if len(writeKeys) == 1 && len(readKeys) == 0 {
+		return writeKeys[0], true, true
+	}
+	if len(writeKeys) == 0 && len(readKeys) == 1 {
+		return readKeys[0], false, true
+	}
+	return "", false, false
+}
+
+// RWLocks locks write keys and read keys together. allow duplicate keys.
+// Locked shards are not moved by Grow until RWUnLocks, so the same shards are located and unlocked
 func (dict *ConcurrentDict) RWLocks(writeKeys []string, readKeys []string) {
-	keys := append(writeKeys, readKeys...)
-	indices := dict.toLockIndices(keys, false)
-	writeIndexSet := make(map[uint32]struct{})
-	for _, wKey := range writeKeys {
-		idx := dict.spread(fnv32(wKey))
-		writeIndexSet[idx] = struct{}{}
-	}
-	for _, index := range indices {
-		_, w := writeIndexSet[index]
-		mu := &dict.table[index].mutex
-		if w {
-			mu.Lock()
-		} else {
-			mu.RLock()
+	if key, write, ok := singleKey(writeKeys, readKeys); ok {
+		dict.lockKey(key, write)
+		return
+	}
+	for {
+		locks := dict.toShardLocks(writeKeys, readKeys)
+		for _, l := range locks {
+			l.lock()
+		}
+		if !anyMoved(locks) {
+			return
 		}
+		unlockAll(locks)
 	}
 }
 
 // RWUnLocks unlocks write keys and read keys together. allow duplicate keys
 func (dict *ConcurrentDict) RWUnLocks(writeKeys []string, readKeys []string) {
-	keys := append(writeKeys, readKeys...)
-	indices := dict.toLockIndices(keys, true)
-	writeIndexSet := make(map[uint32]struct{})
-	for _, wKey := range writeKeys {
-		idx := dict.spread(fnv32(wKey))
-		writeIndexSet[idx] = struct{}{}
-	}
-	for _, index := range indices {
-		_, w := writeIndexSet[index]
-		mu := &dict.table[index].mutex
-		if w {
-			mu.Unlock()
-		} else {
-			mu.RUnlock()
+	if key, write, ok := singleKey(writeKeys, readKeys); ok {
+		shardLock{s: dict.locate(key), write: write}.unlock()
+		return
+	}
+	unlockAll(dict.toShardLocks(writeKeys, readKeys))
+}
+
+// RLockAll locks all shards for reading, so writers are blocked until RUnlockAll.
+// Shards are locked in the same order as RWLocks, and Grow waits until RUnlockAll
+func (dict *ConcurrentDict) RLockAll() {
+	dict.growMu.Lock()
+	for _, s := range dict.currentShards() {
+		s.mutex.RLock()
+	}
+}
+
+// RUnlockAll unlocks all shards locked by RLockAll
+func (dict *ConcurrentDict) RUnlockAll() {
+	defer dict.growMu.Unlock()
+	shards := dict.currentShards()
+	for i := len(shards) - 1; i >= 0; i-- {
+		shards[i].mutex.RUnlock()
+	}
+}
+
+// TryRWLocks is like RWLocks but gives up after timeout, locks obtained are released if it fails.
+// Locks are taken in the same order as RWLocks, so it won't wait longer than timeout for each other.
+func (dict *ConcurrentDict) TryRWLocks(writeKeys []string, readKeys []string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		locks := dict.toShardLocks(writeKeys, readKeys)
+		for i, l := range locks {
+			backoff := time.Millisecond
+			for !l.tryLock() {
+				if time.Now().After(deadline) {
+					unlockAll(locks[:i])
+					return false
+				}
+				time.Sleep(backoff)
+				if backoff < 10*time.Millisecond {
+					backoff *= 2
+				}
+			}
+		}
+		if !anyMoved(locks) {
+			return true
 		}
+		unlockAll(locks)
 	}
 }
@@ -0,0 +1,237 @@
+package dict
+
+import (
+	"goRedisPlus/datastruct/listpack"
+	"math/rand"
+	"sync/atomic"
+)
+
+// PackedDict is the dict of hashes. Small hashes are encoded as listpack of fields and values in turn, until they
+// have more than hash-max-listpack-entries fields or a field or value longer than hash-max-listpack-value is put,
+// then they are converted to SimpleDict and never converted back, the same as redis. Values must be []byte.
+// It is not thread safe.
+type PackedDict struct {
+	lp     *listpack.Listpack // fields and values are kept in listpack instead of simple if it is not nil
+	simple *SimpleDict
+}
+
+// encodings of PackedDict, see OBJECT ENCODING
+const (
+	EncodingListpack  = "listpack"
+	EncodingHashtable = "hashtable"
+)
+
+// limits of listpack encoded hashes, accessed atomically
+var (
+	maxListpackEntries int64 = 128
+	maxListpackValue   int64 = 64
+)
+
+// SetMaxListpackEntries sets the most fields of hashes encoded as listpack, 0 disables listpack
+func SetMaxListpackEntries(n int) {
+	atomic.StoreInt64(&maxListpackEntries, int64(n))
+}
+
+// SetMaxListpackValue sets the longest field or value of hashes encoded as listpack
+func SetMaxListpackValue(n int) {
+	atomic.StoreInt64(&maxListpackValue, int64(n))
+}
+
+// MakePacked creates a new PackedDict
+func MakePacked() *PackedDict {
+	if atomic.LoadInt64(&maxListpackEntries) > 0 {
+		return &PackedDict{lp: listpack.New()}
+	}
+	return &PackedDict{simple: MakeSimple()}
+}
+
+// Encoding returns the encoding of dict
+func (dict *PackedDict) Encoding() string {
+	if dict.lp != nil {
+		return EncodingListpack
+	}
+	return EncodingHashtable
+}
+
+// Listpack returns the listpack holding fields and values, or nil if the dict is converted to hash table
+func (dict *PackedDict) Listpack() *listpack.Listpack {
+	return dict.lp
+}
+
+// find returns offset of the field, or -1 if it does not exist
+func (dict *PackedDict) find(key string) int {
+	for p := 0; p < dict.lp.Bytes(); p = dict.lp.Next(dict.lp.Next(p)) {
+		if string(dict.lp.Entry(p)) == key {
+			return p
+		}
+	}
+	return -1
+}
+
+// fits returns whether the field and value could be kept in listpack, the field will be new if isNew is true
+func (dict *PackedDict) fits(key string, val interface{}, isNew bool) bool {
+	bytes, ok := val.([]byte)
+	if !ok {
+		return false
+	}
+	maxValue := int(atomic.LoadInt64(&maxListpackValue))
+	if len(key) > maxValue || len(bytes) > maxValue {
+		return false
+	}
+	return !isNew || dict.lp.Len()/2 < int(atomic.LoadInt64(&maxListpackEntries))
+}
+
+// convertToSimple moves fields and values from listpack to SimpleDict
+func (dict *PackedDict) convertToSimple() {
+	simple := MakeSimple()
+	dict.ForEach(func(key string, val interface{}) bool {
+		simple.Put(key, val)
+		return true
+	})
+	dict.simple = simple
+	dict.lp = nil
+}
+
+func copyBytes(data []byte) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
+
+// Get returns the binding value and whether the key is exist
+func (dict *PackedDict) Get(key string) (val interface{}, exists bool) {
+	if dict.lp == nil {
+		return dict.simple.Get(key)
+	}
+	p := dict.find(key)
+	if p < 0 {
+		return nil, false
+	}
+	return copyBytes(dict.lp.Entry(dict.lp.Next(p))), true
+}
+
+// Len returns the number of dict
+func (dict *PackedDict) Len() int {
+	if dict.lp == nil {
+		return dict.simple.Len()
+	}
+	return dict.lp.Len() / 2
+}
+
+// Put puts key value into dict and returns the number of new inserted key-value
+func (dict *PackedDict) Put(key string, val interface{}) (result int) {
+	if dict.lp == nil {
+		return dict.simple.Put(key, val)
+	}
+	p := dict.find(key)
+	if !dict.fits(key, val, p < 0) {
+		dict.convertToSimple()
+		return dict.simple.Put(key, val)
+	}
+	if p < 0 {
+		dict.lp.Append([]byte(key), val.([]byte))
+		return 1
+	}
+	dict.lp.Replace(dict.lp.Next(p), val.([]byte))
+	return 0
+}
+
+// PutIfAbsent puts value if the key is not exists and returns the number of updated key-value
+func (dict *PackedDict) PutIfAbsent(key string, val interface{}) (result int) {
+	if dict.lp == nil {
+		return dict.simple.PutIfAbsent(key, val)
+	}
+	if dict.find(key) >= 0 {
+		return 0
+	}
+	return dict.Put(key, val)
+}
+
+// PutIfExists puts value if the key is exist and returns the number of inserted key-value
+func (dict *PackedDict) PutIfExists(key string, val interface{}) (result int) {
+	if dict.lp == nil {
+		return dict.simple.PutIfExists(key, val)
+	}
+	if dict.find(key) < 0 {
+		return 0
+	}
+	dict.Put(key, val)
+	return 1
+}
+
+// Remove removes the key and return the number of deleted key-value
+func (dict *PackedDict) Remove(key string) (val interface{}, result int) {
+	if dict.lp == nil {
+		return dict.simple.Remove(key)
+	}
+	p := dict.find(key)
+	if p < 0 {
+		return nil, 0
+	}
+	val = copyBytes(dict.lp.Entry(dict.lp.Next(p)))
+	dict.lp.Delete(p, 2)
+	return val, 1
+}
+
+// Keys returns all keys in dict
+func (dict *PackedDict) Keys() []string {
+	if dict.lp == nil {
+		return dict.simple.Keys()
+	}
+	result := make([]string, 0, dict.Len())
+	for p := 0; p < dict.lp.Bytes(); p = dict.lp.Next(dict.lp.Next(p)) {
+		result = append(result, string(dict.lp.Entry(p)))
+	}
+	return result
+}
+
+// ForEach traversal the dict in order of insertion if it is encoded as listpack
+func (dict *PackedDict) ForEach(consumer Consumer) {
+	if dict.lp == nil {
+		dict.simple.ForEach(consumer)
+		return
+	}
+	// entries are copied before visiting since consumer may keep values or modify the dict
+	entries := make([][]byte, 0, dict.lp.Len())
+	for p := 0; p < dict.lp.Bytes(); p = dict.lp.Next(p) {
+		entries = append(entries, copyBytes(dict.lp.Entry(p)))
+	}
+	for i := 0; i < len(entries); i += 2 {
+		if !consumer(string(entries[i]), entries[i+1]) {
+			break
+		}
+	}
+}
+
+// RandomKeys randomly returns keys of the given number, may contain duplicated key
+func (dict *PackedDict) RandomKeys(limit int) []string {
+	if dict.lp == nil {
+		return dict.simple.RandomKeys(limit)
+	}
+	n := dict.Len()
+	result := make([]string, limit)
+	for i := 0; i < limit && n > 0; i++ {
+		result[i] = string(dict.lp.Entry(dict.lp.Seek(2 * rand.Intn(n))))
+	}
+	return result
+}
+
+// RandomDistinctKeys randomly returns keys of the given number, won't contain duplicated key
+func (dict *PackedDict) RandomDistinctKeys(limit int) []string {
+	if dict.lp == nil {
+		return dict.simple.RandomDistinctKeys(limit)
+	}
+	keys := dict.Keys()
+	if limit > len(keys) {
+		limit = len(keys)
+	}
+	rand.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	return keys[:limit]
+}
+
+// Clear removes all keys in dict
+func (dict *PackedDict) Clear() {
+	*dict = *MakePacked()
+}
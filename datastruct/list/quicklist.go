@@ -1,15 +1,62 @@
 package list
 
-import "container/list"
+import (
+	"container/list"
+	"goRedisPlus/datastruct/listpack"
+	"sync"
+	"sync/atomic"
+)
 
 // pageSize must be even
 const pageSize = 1024
 
+const (
+	// mergeThreshold is the length below which a page is merged with an adjacent page also below it
+	mergeThreshold = pageSize / 2
+	// shrinkMinCap is the least capacity of a page worth shrinking if it uses less than a quarter of its capacity
+	shrinkMinCap = 64
+)
+
 // QuickList is a linked list of page (which type is []interface{})
 // QuickList has better performance than LinkedList of Add, Range and memory usage
+// Small lists of []byte are encoded as a single listpack until it exceeds list-max-listpack-size or a value of
+// other type is added, then they are converted to pages and never converted back.
 type QuickList struct {
-	data *list.List // list of []interface{}
-	size int
+	data   *list.List         // list of []interface{}
+	packed *listpack.Listpack // elements are kept in listpack instead of data if it is not nil
+	size   int
+
+	// cache is the last position found, so that accessing elements near it, such as LINDEX of sequential indexes,
+	// doesn't walk from either end of list. It is reset by writes moving elements, and guarded by cacheMu since
+	// readers of a list may find positions concurrently.
+	cacheMu sync.Mutex
+	cache   position
+}
+
+// position is where an element is found in QuickList
+type position struct {
+	valid  bool
+	index  int           // index of the first element of node, or index of the element if list is packed
+	node   *list.Element // nil if list is packed
+	offset int           // offset of the element in listpack
+}
+
+// encodings of QuickList, see OBJECT ENCODING
+const (
+	EncodingListpack  = "listpack"
+	EncodingQuicklist = "quicklist"
+)
+
+// maxListpackSize is list-max-listpack-size, accessed atomically. A positive value is the most elements of lists
+// encoded as listpack, a negative value -n limits the listpack to 2^(n+1) KB, -5 at most, the same as redis.
+var maxListpackSize int64 = -2
+
+// listpackSafetyLimit is the largest value kept in listpack if it is limited by the number of elements
+const listpackSafetyLimit = 8192
+
+// SetMaxListpackSize sets list-max-listpack-size, 0 disables listpack
+func SetMaxListpackSize(n int) {
+	atomic.StoreInt64(&maxListpackSize, int64(n))
 }
 
 // iterator of QuickList, move between [-1, ql.Len()]
@@ -20,14 +67,120 @@ type iterator struct {
 }
 
 func NewQuickList() *QuickList {
+	if atomic.LoadInt64(&maxListpackSize) != 0 {
+		return &QuickList{
+			packed: listpack.New(),
+		}
+	}
 	l := &QuickList{
 		data: list.New(),
 	}
 	return l
 }
 
+// Encoding returns the encoding of list
+func (ql *QuickList) Encoding() string {
+	if ql.packed != nil {
+		return EncodingListpack
+	}
+	return EncodingQuicklist
+}
+
+// Listpack returns the listpack holding elements, or nil if the list is converted to pages
+func (ql *QuickList) Listpack() *listpack.Listpack {
+	return ql.packed
+}
+
+// packedFits returns whether val could be kept in listpack in place of an entry of replaced bytes,
+// replaced is 0 if val is a new element
+func (ql *QuickList) packedFits(val interface{}, replaced int) bool {
+	bytes, ok := val.([]byte)
+	if !ok {
+		return false
+	}
+	limit := atomic.LoadInt64(&maxListpackSize)
+	if limit > 0 {
+		return len(bytes) <= listpackSafetyLimit && (replaced > 0 || int64(ql.size) < limit)
+	}
+	if limit < -5 {
+		limit = -5
+	}
+	size := ql.packed.Bytes() + listpack.EntrySize(len(bytes)) - replaced
+	return limit < 0 && size <= 4096<<(-limit-1)
+}
+
+// unpack moves elements from listpack to pages
+func (ql *QuickList) unpack() {
+	lp := ql.packed
+	ql.data = list.New()
+	ql.packed = nil
+	ql.size = 0
+	ql.resetCache()
+	for p := 0; p < lp.Bytes(); p = lp.Next(p) {
+		ql.Add(copyBytes(lp.Entry(p)))
+	}
+}
+
+// cachedNear returns the cached position and whether it is closer to index than both ends of list
+func (ql *QuickList) cachedNear(index int) (position, bool) {
+	ql.cacheMu.Lock()
+	c := ql.cache
+	ql.cacheMu.Unlock()
+	if !c.valid {
+		return c, false
+	}
+	distance := index - c.index
+	if distance < 0 {
+		distance = -distance
+	}
+	return c, distance < index && distance < ql.size-index
+}
+
+func (ql *QuickList) setCache(c position) {
+	ql.cacheMu.Lock()
+	ql.cache = c
+	ql.cacheMu.Unlock()
+}
+
+func (ql *QuickList) resetCache() {
+	ql.setCache(position{})
+}
+
+// packedSeek returns offset of the element at index in listpack
+func (ql *QuickList) packedSeek(index int) int {
+	lp := ql.packed
+	var p int
+	if c, ok := ql.cachedNear(index); ok {
+		p = c.offset
+		for i := c.index; i < index; i++ {
+			p = lp.Next(p)
+		}
+		for i := c.index; i > index; i-- {
+			p = lp.Prev(p)
+		}
+	} else {
+		p = lp.Seek(index)
+	}
+	ql.setCache(position{valid: true, index: index, offset: p})
+	return p
+}
+
+func copyBytes(data []byte) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
+
 // Add adds value to the tail
 func (ql *QuickList) Add(val interface{}) {
+	if ql.packed != nil {
+		if ql.packedFits(val, 0) {
+			ql.packed.Append(val.([]byte))
+			ql.size++
+			return
+		}
+		ql.unpack()
+	}
 	ql.size++
 	if ql.data.Len() == 0 { // empty list
 		page := make([]interface{}, 0, pageSize) // 双向链表的每一个节点就是一个 固定大小的切片
@@ -38,12 +191,22 @@ func (ql *QuickList) Add(val interface{}) {
 	// assert list.data.Back() != nil
 	backNode := ql.data.Back()
 	backPage := backNode.Value.([]interface{}) // 最后一个节点的value
-	if len(backPage) == cap(backPage) {        // full page, create new page
+	if len(backPage) >= pageSize {             // full page, create new page
 		page := make([]interface{}, 0, pageSize)
 		page = append(page, val)
 		ql.data.PushBack(page)
 		return
 	}
+	if len(backPage) == cap(backPage) {
+		// page is split or shrunk, grow it towards a whole page
+		grown := 2 * cap(backPage)
+		if grown > pageSize {
+			grown = pageSize
+		}
+		page := make([]interface{}, len(backPage), grown)
+		copy(page, backPage)
+		backPage = page
+	}
 	// append into page
 	backPage = append(backPage, val)
 	backNode.Value = backPage
@@ -61,7 +224,23 @@ func (ql *QuickList) find(index int) *iterator {
 	var n *list.Element
 	var page []interface{}
 	var pageBeg int
-	if index < ql.size/2 {
+	if c, ok := ql.cachedNear(index); ok {
+		// search from the cached page
+		n = c.node
+		pageBeg = c.index
+		for pageBeg > index {
+			n = n.Prev()
+			pageBeg -= len(n.Value.([]interface{}))
+		}
+		for {
+			page = n.Value.([]interface{})
+			if pageBeg+len(page) > index {
+				break
+			}
+			pageBeg += len(page)
+			n = n.Next()
+		}
+	} else if index < ql.size/2 {
 		// search from front
 		n = ql.data.Front()
 		pageBeg = 0
@@ -87,6 +266,7 @@ func (ql *QuickList) find(index int) *iterator {
 			n = n.Prev()
 		}
 	}
+	ql.setCache(position{valid: true, index: pageBeg, node: n})
 	pageOffset := index - pageBeg
 	return &iterator{
 		node:   n,
@@ -162,6 +342,9 @@ func (iter *iterator) atBegin() bool {
 
 // Get returns value at the given index
 func (ql *QuickList) Get(index int) (val interface{}) {
+	if ql.packed != nil {
+		return copyBytes(ql.packed.Entry(ql.packedSeek(index)))
+	}
 	iter := ql.find(index)
 	return iter.get()
 }
@@ -173,6 +356,15 @@ func (iter *iterator) set(val interface{}) {
 
 // Set updates value at the given index, the index should between [0, list.size]
 func (ql *QuickList) Set(index int, val interface{}) {
+	if ql.packed != nil {
+		p := ql.packedSeek(index)
+		if ql.packedFits(val, ql.packed.Next(p)-p) {
+			ql.packed.Replace(p, val.([]byte))
+			ql.resetCache() // offsets of following elements may change
+			return
+		}
+		ql.unpack()
+	}
 	iter := ql.find(index)
 	iter.set(val)
 }
@@ -182,8 +374,18 @@ func (ql *QuickList) Insert(index int, val interface{}) {
 		ql.Add(val)
 		return
 	}
+	if ql.packed != nil {
+		if ql.packedFits(val, 0) {
+			ql.packed.Insert(ql.packedSeek(index), val.([]byte))
+			ql.size++
+			ql.resetCache()
+			return
+		}
+		ql.unpack()
+	}
 	iter := ql.find(index)                  // quickList 的find更快
 	page := iter.node.Value.([]interface{}) // 把接口切片取出来
+	ql.resetCache()                         // following elements will be moved
 	if len(page) < pageSize {
 		// insert into not full page
 		page = append(page[:iter.offset+1], page[iter.offset:]...)
@@ -205,6 +407,10 @@ func (ql *QuickList) Insert(index int, val interface{}) {
 		nextPage = append(nextPage[:i+1], nextPage[i:]...) // 插入到后半段
 		nextPage[i] = val
 	}
+	tail := page[len(page):cap(page)]
+	for i := range tail {
+		tail[i] = nil // release values moved to next page
+	}
 	// store current page and next page
 	iter.node.Value = page                   // 前半段
 	ql.data.InsertAfter(nextPage, iter.node) // 把后半段这个节点插入到双向链表中
@@ -215,9 +421,12 @@ func (iter *iterator) remove() interface{} {
 	page := iter.page()
 	val := page[iter.offset]
 	page = append(page[:iter.offset], page[iter.offset+1:]...)
+	page[:len(page)+1][len(page)] = nil // release the removed value
 	if len(page) > 0 {
 		// page is not empty, update iter.offset only
 		iter.node.Value = page
+		iter.rebalance()
+		page = iter.page()
 		if iter.offset == len(page) {
 			// removed page[-1], node should move to next page
 			if iter.node != iter.ql.data.Back() {
@@ -241,11 +450,61 @@ func (iter *iterator) remove() interface{} {
 		}
 	}
 	iter.ql.size--
+	iter.ql.resetCache()
 	return val
 }
 
+// rebalance merges the page of iter with an adjacent page if both of them are below mergeThreshold, otherwise
+// shrinks the page if most of its capacity is unused, so that removing elements releases memory.
+// iter keeps pointing to the same element.
+func (iter *iterator) rebalance() {
+	page := iter.page()
+	if len(page) >= mergeThreshold {
+		return
+	}
+	if next := iter.node.Next(); next != nil {
+		if nextPage := next.Value.([]interface{}); len(nextPage) < mergeThreshold {
+			iter.node.Value = appendPage(page, nextPage)
+			iter.ql.data.Remove(next)
+			return
+		}
+	}
+	if prev := iter.node.Prev(); prev != nil {
+		if prevPage := prev.Value.([]interface{}); len(prevPage) < mergeThreshold {
+			prev.Value = appendPage(prevPage, page)
+			iter.ql.data.Remove(iter.node)
+			iter.node = prev
+			iter.offset += len(prevPage)
+			return
+		}
+	}
+	if cap(page) > shrinkMinCap && len(page) < cap(page)/4 {
+		shrunk := make([]interface{}, len(page), len(page)*2)
+		copy(shrunk, page)
+		iter.node.Value = shrunk
+	}
+}
+
+// appendPage appends elements of b to page a, a is reallocated as a whole page if it has no room for b
+func appendPage(a []interface{}, b []interface{}) []interface{} {
+	if len(a)+len(b) > cap(a) {
+		merged := make([]interface{}, len(a), pageSize)
+		copy(merged, a)
+		a = merged
+	}
+	return append(a, b...)
+}
+
 // Remove removes value at the given index
 func (ql *QuickList) Remove(index int) interface{} {
+	if ql.packed != nil {
+		p := ql.packedSeek(index)
+		val := copyBytes(ql.packed.Entry(p))
+		ql.packed.Delete(p, 1)
+		ql.size--
+		ql.resetCache()
+		return val
+	}
 	iter := ql.find(index)
 	return iter.remove()
 }
@@ -260,7 +519,11 @@ func (ql *QuickList) RemoveLast() interface{} {
 	if ql.Len() == 0 {
 		return nil
 	}
+	if ql.packed != nil {
+		return ql.Remove(ql.size - 1)
+	}
 	ql.size--
+	ql.resetCache()
 	lastNode := ql.data.Back()
 	lastPage := lastNode.Value.([]interface{})
 	if len(lastPage) == 1 {
@@ -268,13 +531,22 @@ func (ql *QuickList) RemoveLast() interface{} {
 		return lastPage[0]
 	}
 	val := lastPage[len(lastPage)-1]
+	lastPage[len(lastPage)-1] = nil // release the removed value
 	lastPage = lastPage[:len(lastPage)-1]
 	lastNode.Value = lastPage
+	iter := &iterator{
+		node: lastNode,
+		ql:   ql,
+	}
+	iter.rebalance()
 	return val
 }
 
 // RemoveAllByVal removes all elements with the given val
 func (ql *QuickList) RemoveAllByVal(expected Expected) int {
+	if ql.packed != nil {
+		return ql.packedRemoveByVal(expected, 0, false)
+	}
 	iter := ql.find(0)
 	removed := 0
 	for !iter.atEnd() {
@@ -291,6 +563,9 @@ func (ql *QuickList) RemoveAllByVal(expected Expected) int {
 // RemoveByVal removes at most `count` values of the specified value in this list
 // scan from left to right
 func (ql *QuickList) RemoveByVal(expected Expected, count int) int {
+	if ql.packed != nil {
+		return ql.packedRemoveByVal(expected, count, false)
+	}
 	if ql.size == 0 {
 		return 0
 	}
@@ -311,6 +586,9 @@ func (ql *QuickList) RemoveByVal(expected Expected, count int) int {
 }
 
 func (ql *QuickList) ReverseRemoveByVal(expected Expected, count int) int {
+	if ql.packed != nil {
+		return ql.packedRemoveByVal(expected, count, true)
+	}
 	if ql.size == 0 {
 		return 0
 	}
@@ -329,6 +607,34 @@ func (ql *QuickList) ReverseRemoveByVal(expected Expected, count int) int {
 	return removed
 }
 
+// packedRemoveByVal removes at most count (0 means all) elements of listpack matching expected, from tail if reverse
+func (ql *QuickList) packedRemoveByVal(expected Expected, count int, reverse bool) int {
+	lp := ql.packed
+	removed := 0
+	if reverse {
+		for p := lp.Prev(lp.Bytes()); p >= 0 && (count <= 0 || removed < count); {
+			prev := lp.Prev(p) // offsets before p are not affected by deleting p
+			if expected(lp.Entry(p)) {
+				lp.Delete(p, 1)
+				removed++
+			}
+			p = prev
+		}
+	} else {
+		for p := 0; p < lp.Bytes() && (count <= 0 || removed < count); {
+			if expected(lp.Entry(p)) {
+				lp.Delete(p, 1)
+				removed++
+			} else {
+				p = lp.Next(p)
+			}
+		}
+	}
+	ql.size -= removed
+	ql.resetCache()
+	return removed
+}
+
 // ForEach visits each element in the list
 // if the consumer returns false, the loop will be break
 func (ql *QuickList) ForEach(consumer Consumer) {
@@ -338,6 +644,15 @@ func (ql *QuickList) ForEach(consumer Consumer) {
 	if ql.Len() == 0 {
 		return
 	}
+	if ql.packed != nil {
+		// elements are copied since consumer may keep them
+		for i, p := 0, 0; p < ql.packed.Bytes(); i, p = i+1, ql.packed.Next(p) {
+			if !consumer(i, copyBytes(ql.packed.Entry(p))) {
+				break
+			}
+		}
+		return
+	}
 	iter := ql.find(0)
 	i := 0
 	for {
@@ -374,6 +689,12 @@ func (ql *QuickList) Range(start int, stop int) []interface{} {
 	}
 	sliceSize := stop - start
 	slice := make([]interface{}, 0, sliceSize)
+	if ql.packed != nil {
+		for p := ql.packedSeek(start); len(slice) < sliceSize; p = ql.packed.Next(p) {
+			slice = append(slice, copyBytes(ql.packed.Entry(p)))
+		}
+		return slice
+	}
 	iter := ql.find(start)
 	i := 0
 	for i < sliceSize {
@@ -383,3 +704,34 @@ func (ql *QuickList) Range(start int, stop int) []interface{} {
 	}
 	return slice
 }
+
+// Capacity returns the number of elements pages could hold without allocating
+func (ql *QuickList) Capacity() int {
+	if ql.packed != nil {
+		return ql.size // listpack has no page
+	}
+	capacity := 0
+	for n := ql.data.Front(); n != nil; n = n.Next() {
+		capacity += cap(n.Value.([]interface{}))
+	}
+	return capacity
+}
+
+// Sparse returns whether more than half of capacity of pages is unused and the unused part exceeds a page,
+// which happens after removing elements from the middle of list or inserting into full pages
+func (ql *QuickList) Sparse() bool {
+	unused := ql.Capacity() - ql.size
+	return unused > pageSize && unused > ql.size
+}
+
+// Compact returns a copy of list packed into full pages, ql itself is not modified
+func (ql *QuickList) Compact() *QuickList {
+	compacted := &QuickList{
+		data: list.New(),
+	}
+	ql.ForEach(func(i int, v interface{}) bool {
+		compacted.Add(v)
+		return true
+	})
+	return compacted
+}
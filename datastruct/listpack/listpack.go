@@ -0,0 +1,193 @@
+package listpack
+
+import "encoding/binary"
+
+// Listpack is a sequence of strings packed back to back in a single byte slice, like listpack of redis. Each entry
+// is the uvarint length of data, the data and the backlen, which is the size of the former two encoded in 7-bit
+// groups from right to left, so that entries can be traversed in both directions. It takes a few bytes of overhead
+// for each entry instead of a slice header, a pointer and an allocation, but insertions and deletions move the tail
+// of the slice and entries are found by traversal, so it is meant for small collections.
+//
+// Entries are addressed by offset: the first entry is at offset 0 and offset Bytes() is the end of listpack.
+// Slices returned by Entry point into the listpack and are only valid until it is modified.
+type Listpack struct {
+	buf   []byte
+	count int
+}
+
+const (
+	// overhead is the size of Listpack struct and slice header
+	overhead = 32
+	// shrinkMinCap is the least capacity worth shrinking if less than a quarter of it is used
+	shrinkMinCap = 256
+)
+
+// New creates an empty Listpack
+func New() *Listpack {
+	return &Listpack{}
+}
+
+// Len returns the number of entries
+func (lp *Listpack) Len() int {
+	return lp.count
+}
+
+// Bytes returns the encoded size of entries, it is also the offset of the end
+func (lp *Listpack) Bytes() int {
+	return len(lp.buf)
+}
+
+// MemoryUsage returns bytes used by the listpack
+func (lp *Listpack) MemoryUsage() int64 {
+	return int64(cap(lp.buf)) + overhead
+}
+
+// EntrySize returns the encoded size of an entry holding data of n bytes
+func EntrySize(n int) int {
+	size := uvarintSize(n) + n
+	return size + uvarintSize(size)
+}
+
+func uvarintSize(n int) int {
+	size := 1
+	for n >= 0x80 {
+		n >>= 7
+		size++
+	}
+	return size
+}
+
+// putEntry encodes data into b, which must be of EntrySize(len(data)) bytes
+func putEntry(b []byte, data []byte) {
+	n := binary.PutUvarint(b, uint64(len(data)))
+	n += copy(b[n:], data)
+	// backlen: the lowest 7-bit group is at the right end and the others extend to the left
+	backlen := n
+	for i := len(b) - 1; i >= n; i-- {
+		b[i] = byte(backlen & 0x7f)
+		if i > n {
+			b[i] |= 0x80
+		}
+		backlen >>= 7
+	}
+}
+
+// Entry returns data of the entry at offset p
+func (lp *Listpack) Entry(p int) []byte {
+	length, n := binary.Uvarint(lp.buf[p:])
+	start := p + n
+	return lp.buf[start : start+int(length) : start+int(length)]
+}
+
+// Next returns offset of the entry after the one at p, or Bytes() if p is the last entry
+func (lp *Listpack) Next(p int) int {
+	length, n := binary.Uvarint(lp.buf[p:])
+	size := n + int(length)
+	return p + size + uvarintSize(size)
+}
+
+// Prev returns offset of the entry before p, p could be Bytes(), returns -1 if p is the first entry
+func (lp *Listpack) Prev(p int) int {
+	if p == 0 {
+		return -1
+	}
+	size, shift := 0, 0
+	i := p - 1
+	for {
+		b := lp.buf[i]
+		size |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+		i--
+	}
+	return i - size
+}
+
+// Seek returns offset of the i-th entry, i within [0, Len()], Seek(Len()) is Bytes()
+func (lp *Listpack) Seek(i int) int {
+	if i < 0 || i > lp.count {
+		panic("index out of bound")
+	}
+	if i <= lp.count/2 {
+		p := 0
+		for ; i > 0; i-- {
+			p = lp.Next(p)
+		}
+		return p
+	}
+	p := len(lp.buf)
+	for i = lp.count - i; i > 0; i-- {
+		p = lp.Prev(p)
+	}
+	return p
+}
+
+// Insert inserts entries before offset p, p is Bytes() to append
+func (lp *Listpack) Insert(p int, entries ...[]byte) {
+	size := 0
+	for _, data := range entries {
+		size += EntrySize(len(data))
+	}
+	end := len(lp.buf)
+	if end+size <= cap(lp.buf) {
+		lp.buf = lp.buf[:end+size]
+	} else {
+		// grow like append, but without copying the tail twice
+		grown := make([]byte, end+size, (end+size)*5/4+16)
+		copy(grown, lp.buf[:p])
+		copy(grown[p+size:], lp.buf[p:end])
+		lp.buf = grown
+		end = p
+	}
+	copy(lp.buf[p+size:], lp.buf[p:end])
+	for _, data := range entries {
+		entrySize := EntrySize(len(data))
+		putEntry(lp.buf[p:p+entrySize], data)
+		p += entrySize
+	}
+	lp.count += len(entries)
+}
+
+// Append appends entries to the tail
+func (lp *Listpack) Append(entries ...[]byte) {
+	lp.Insert(len(lp.buf), entries...)
+}
+
+// Replace replaces data of the entry at offset p
+func (lp *Listpack) Replace(p int, data []byte) {
+	next := lp.Next(p)
+	size := EntrySize(len(data))
+	if size == next-p {
+		putEntry(lp.buf[p:next], data)
+		return
+	}
+	lp.Delete(p, 1)
+	lp.Insert(p, data)
+}
+
+// Delete removes n entries from offset p, the entry following them is at offset p afterwards
+func (lp *Listpack) Delete(p int, n int) {
+	end := p
+	for i := 0; i < n; i++ {
+		end = lp.Next(end)
+	}
+	copy(lp.buf[p:], lp.buf[end:])
+	lp.buf = lp.buf[:len(lp.buf)-(end-p)]
+	lp.count -= n
+	if cap(lp.buf) > shrinkMinCap && len(lp.buf) < cap(lp.buf)/4 {
+		// release capacity left by deletions
+		shrunk := make([]byte, len(lp.buf), len(lp.buf)*2)
+		copy(shrunk, lp.buf)
+		lp.buf = shrunk
+	}
+}
+
+// Get returns a copy of data of the i-th entry
+func (lp *Listpack) Get(i int) []byte {
+	data := lp.Entry(lp.Seek(i))
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
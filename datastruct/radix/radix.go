@@ -0,0 +1,188 @@
+package radix
+
+import "sort"
+
+// Tree is a radix tree of strings, it finds strings by prefix and visits them in lexicographic order.
+// Each edge is labeled with a common part of the strings below it, so a string takes a node at most besides nodes
+// shared with others. It is not thread safe.
+type Tree struct {
+	root node
+	size int
+}
+
+type node struct {
+	label    string  // part of strings between parent and this node, empty for root
+	leaf     bool    // whether a string ends at this node
+	children []*node // sorted by the first byte of label, labels of children never share the first byte
+}
+
+// New creates an empty Tree
+func New() *Tree {
+	return &Tree{}
+}
+
+// Len returns the number of strings
+func (tree *Tree) Len() int {
+	return tree.size
+}
+
+// findChild returns index of the child whose label starts with c, or the index to insert such a child and false
+func (n *node) findChild(c byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].label[0] >= c
+	})
+	return i, i < len(n.children) && n.children[i].label[0] == c
+}
+
+func commonPrefixLen(a string, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// Insert adds s into tree and returns whether it is new
+func (tree *Tree) Insert(s string) bool {
+	n := &tree.root
+	for s != "" {
+		i, found := n.findChild(s[0])
+		if !found {
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = &node{label: s, leaf: true}
+			tree.size++
+			return true
+		}
+		child := n.children[i]
+		common := commonPrefixLen(child.label, s)
+		if common < len(child.label) {
+			// split the edge at the end of common part
+			split := &node{label: child.label[:common], children: []*node{child}}
+			child.label = child.label[common:]
+			n.children[i] = split
+			child = split
+		}
+		n = child
+		s = s[common:]
+	}
+	if n.leaf {
+		return false
+	}
+	n.leaf = true
+	tree.size++
+	return true
+}
+
+// Contains returns whether s is in tree
+func (tree *Tree) Contains(s string) bool {
+	n := &tree.root
+	for s != "" {
+		i, found := n.findChild(s[0])
+		if !found {
+			return false
+		}
+		child := n.children[i]
+		if len(s) < len(child.label) || s[:len(child.label)] != child.label {
+			return false
+		}
+		n = child
+		s = s[len(child.label):]
+	}
+	return n.leaf
+}
+
+// Delete removes s from tree and returns whether it existed
+func (tree *Tree) Delete(s string) bool {
+	var parent *node
+	index := 0 // index of n in children of parent
+	n := &tree.root
+	for s != "" {
+		i, found := n.findChild(s[0])
+		if !found {
+			return false
+		}
+		child := n.children[i]
+		if len(s) < len(child.label) || s[:len(child.label)] != child.label {
+			return false
+		}
+		parent, index, n = n, i, child
+		s = s[len(child.label):]
+	}
+	if !n.leaf {
+		return false
+	}
+	n.leaf = false
+	tree.size--
+	if parent == nil {
+		return true // root
+	}
+	switch len(n.children) {
+	case 0:
+		copy(parent.children[index:], parent.children[index+1:])
+		parent.children[len(parent.children)-1] = nil
+		parent.children = parent.children[:len(parent.children)-1]
+		if parent != &tree.root && !parent.leaf && len(parent.children) == 1 {
+			parent.mergeChild()
+		}
+	case 1:
+		n.mergeChild()
+	}
+	return true
+}
+
+// mergeChild merges the only child into n, n must not be a leaf
+func (n *node) mergeChild() {
+	child := n.children[0]
+	n.label += child.label
+	n.leaf = child.leaf
+	n.children = child.children
+}
+
+// Walk visits strings starting with prefix and greater than after in lexicographic order, until consumer returns
+// false. Empty after visits all of strings with prefix.
+func (tree *Tree) Walk(prefix string, after string, consumer func(s string) bool) {
+	// find the topmost node whose strings all start with prefix
+	n := &tree.root
+	path := ""
+	for len(path) < len(prefix) {
+		rest := prefix[len(path):]
+		i, found := n.findChild(rest[0])
+		if !found {
+			return
+		}
+		child := n.children[i]
+		common := commonPrefixLen(child.label, rest)
+		if common < len(rest) && common < len(child.label) {
+			return
+		}
+		n = child
+		path += child.label
+	}
+	buf := make([]byte, 0, 64)
+	buf = append(buf, path...)
+	walk(n, buf, after, consumer)
+}
+
+// walk visits strings below n, n.label is the end of buf, it returns false if consumer stops the walk
+func walk(n *node, buf []byte, after string, consumer func(s string) bool) bool {
+	if after != "" {
+		s := string(buf)
+		if s > after {
+			after = "" // all strings below n are greater than after
+		} else if len(s) > len(after) || after[:len(s)] != s {
+			return true // all strings below n are less than after
+		}
+	}
+	if n.leaf && after == "" {
+		if !consumer(string(buf)) {
+			return false
+		}
+	}
+	for _, child := range n.children {
+		if !walk(child, append(buf, child.label...), after, consumer) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package set
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// IntSet is a sorted array of distinct integers, like intset of redis. Integers are encoded in the least width of
+// 2, 4 or 8 bytes holding all of them, the width is upgraded when a wider integer is added and never downgraded.
+// Lookups are binary searches and insertions move the tail of array, so it is meant for small sets.
+type IntSet struct {
+	width    int // bytes of each integer
+	contents []byte
+}
+
+// MakeIntSet creates an empty IntSet
+func MakeIntSet() *IntSet {
+	return &IntSet{width: 2}
+}
+
+// widthOf returns the least width holding v
+func widthOf(v int64) int {
+	if v >= math.MinInt16 && v <= math.MaxInt16 {
+		return 2
+	}
+	if v >= math.MinInt32 && v <= math.MaxInt32 {
+		return 4
+	}
+	return 8
+}
+
+// Len returns number of integers in the set
+func (is *IntSet) Len() int {
+	return len(is.contents) / is.width
+}
+
+// Get returns the i-th least integer
+func (is *IntSet) Get(i int) int64 {
+	b := is.contents[i*is.width:]
+	switch is.width {
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(b)))
+	case 4:
+		return int64(int32(binary.LittleEndian.Uint32(b)))
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (is *IntSet) put(i int, v int64) {
+	b := is.contents[i*is.width:]
+	switch is.width {
+	case 2:
+		binary.LittleEndian.PutUint16(b, uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	default:
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	}
+}
+
+// search returns index of v and true, or the index to insert v and false
+func (is *IntSet) search(v int64) (int, bool) {
+	n := is.Len()
+	i := sort.Search(n, func(i int) bool {
+		return is.Get(i) >= v
+	})
+	return i, i < n && is.Get(i) == v
+}
+
+// Has returns true if v exists in the set
+func (is *IntSet) Has(v int64) bool {
+	if widthOf(v) > is.width {
+		return false
+	}
+	_, ok := is.search(v)
+	return ok
+}
+
+// Add adds v into set, returns 1 if it is new
+func (is *IntSet) Add(v int64) int {
+	if width := widthOf(v); width > is.width {
+		is.upgrade(width)
+	}
+	i, ok := is.search(v)
+	if ok {
+		return 0
+	}
+	end := len(is.contents)
+	is.contents = append(is.contents, make([]byte, is.width)...)
+	copy(is.contents[(i+1)*is.width:], is.contents[i*is.width:end])
+	is.put(i, v)
+	return 1
+}
+
+// upgrade re-encodes integers in the wider width
+func (is *IntSet) upgrade(width int) {
+	old := *is
+	is.width = width
+	is.contents = make([]byte, old.Len()*width)
+	for i := 0; i < old.Len(); i++ {
+		is.put(i, old.Get(i))
+	}
+}
+
+// Remove removes v from set, returns 1 if it existed
+func (is *IntSet) Remove(v int64) int {
+	if widthOf(v) > is.width {
+		return 0
+	}
+	i, ok := is.search(v)
+	if !ok {
+		return 0
+	}
+	copy(is.contents[i*is.width:], is.contents[(i+1)*is.width:])
+	is.contents = is.contents[:len(is.contents)-is.width]
+	return 1
+}
+
+// ForEach visits integers in ascending order
+func (is *IntSet) ForEach(consumer func(v int64) bool) {
+	for i := 0; i < is.Len(); i++ {
+		if !consumer(is.Get(i)) {
+			return
+		}
+	}
+}
+
+// RandomMembers randomly returns integers of the given number, may contain duplicated integer
+func (is *IntSet) RandomMembers(limit int) []int64 {
+	n := is.Len()
+	if n == 0 {
+		return nil
+	}
+	result := make([]int64, limit)
+	for i := range result {
+		result[i] = is.Get(rand.Intn(n))
+	}
+	return result
+}
+
+// RandomDistinctMembers randomly returns integers of the given number, won't contain duplicated integer
+func (is *IntSet) RandomDistinctMembers(limit int) []int64 {
+	n := is.Len()
+	if limit > n {
+		limit = n
+	}
+	result := make([]int64, 0, limit)
+	for _, i := range rand.Perm(n)[:limit] {
+		result = append(result, is.Get(i))
+	}
+	return result
+}
+
+// MemoryUsage returns bytes used by the set
+func (is *IntSet) MemoryUsage() int64 {
+	return int64(cap(is.contents)) + 32 // width and slice header
+}
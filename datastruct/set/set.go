@@ -1,16 +1,40 @@
 package set
 
-import "goRedisPlus/datastruct/dict"
+import (
+	"goRedisPlus/datastruct/dict"
+	"strconv"
+	"sync/atomic"
+)
 
-// Set is a set of elements based on hash table
+// Set is a set of elements based on hash table. Sets of integers are encoded as IntSet until they have more than
+// set-max-intset-entries members or a member which is not an integer is added, then they are converted to hash
+// table and never converted back, the same as redis.
 type Set struct {
-	dict dict.Dict
+	dict   dict.Dict
+	intset *IntSet // members are kept in intset instead of dict if it is not nil
+}
+
+// encodings of Set, see OBJECT ENCODING
+const (
+	EncodingIntset    = "intset"
+	EncodingHashtable = "hashtable"
+)
+
+// maxIntsetEntries is the most members of sets encoded as IntSet, accessed atomically
+var maxIntsetEntries int64 = 512
+
+// SetMaxIntsetEntries sets the most members of sets encoded as IntSet, 0 disables IntSet
+func SetMaxIntsetEntries(n int) {
+	atomic.StoreInt64(&maxIntsetEntries, int64(n))
 }
 
 // Make creates a new set
 func Make(members ...string) *Set {
-	set := &Set{
-		dict: dict.MakeSimple(),
+	set := &Set{}
+	if atomic.LoadInt64(&maxIntsetEntries) > 0 {
+		set.intset = MakeIntSet()
+	} else {
+		set.dict = dict.MakeSimple()
 	}
 	for _, member := range members {
 		set.Add(member)
@@ -18,20 +42,73 @@ func Make(members ...string) *Set {
 	return set
 }
 
+// parseInteger returns the integer of member if member is the canonical form of an int64, like string2ll of redis,
+// members such as "+1" and "01" are not integers, otherwise they could not be restored from IntSet
+func parseInteger(member string) (int64, bool) {
+	if len(member) == 0 || len(member) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(member, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	var buf [20]byte
+	return v, string(strconv.AppendInt(buf[:0], v, 10)) == member
+}
+
+func formatInteger(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
+
+// convertToDict moves members from intset to dict
+func (set *Set) convertToDict() {
+	d := dict.MakeSimple()
+	set.intset.ForEach(func(v int64) bool {
+		d.Put(formatInteger(v), nil)
+		return true
+	})
+	set.dict = d
+	set.intset = nil
+}
+
 // Add adds member into set
 func (set *Set) Add(val string) int {
+	if set.intset != nil {
+		v, ok := parseInteger(val)
+		if ok && set.intset.Has(v) {
+			return 0
+		}
+		if ok && int64(set.intset.Len()) < atomic.LoadInt64(&maxIntsetEntries) {
+			return set.intset.Add(v)
+		}
+		set.convertToDict()
+	}
 	return set.dict.Put(val, nil)
 }
 
 // Remove removes member from set
 func (set *Set) Remove(val string) int {
+	if set.intset != nil {
+		v, ok := parseInteger(val)
+		if !ok {
+			return 0
+		}
+		return set.intset.Remove(v)
+	}
 	_, ret := set.dict.Remove(val)
 	return ret
 }
 
 // Has returns true if the val exists in the set
 func (set *Set) Has(val string) bool {
-	if set == nil || set.dict == nil {
+	if set == nil {
+		return false
+	}
+	if set.intset != nil {
+		v, ok := parseInteger(val)
+		return ok && set.intset.Has(v)
+	}
+	if set.dict == nil {
 		return false
 	}
 	_, exists := set.dict.Get(val)
@@ -40,32 +117,53 @@ func (set *Set) Has(val string) bool {
 
 // Len returns number of members in the set
 func (set *Set) Len() int {
-	if set == nil || set.dict == nil {
+	if set == nil {
+		return 0
+	}
+	if set.intset != nil {
+		return set.intset.Len()
+	}
+	if set.dict == nil {
 		return 0
 	}
 	return set.dict.Len()
 }
 
+// Encoding returns EncodingIntset or EncodingHashtable
+func (set *Set) Encoding() string {
+	if set.intset != nil {
+		return EncodingIntset
+	}
+	return EncodingHashtable
+}
+
+// IntSet returns members encoded as IntSet, or nil if the set is a hash table
+func (set *Set) IntSet() *IntSet {
+	return set.intset
+}
+
 // ToSlice convert set to []string
 func (set *Set) ToSlice() []string {
-	slice := make([]string, set.Len())
-	i := 0
-	set.dict.ForEach(func(key string, val interface{}) bool {
-		if i < len(slice) {
-			slice[i] = key
-		} else {
-			// set extended during traversal
-			slice = append(slice, key)
-		}
-		i++
+	slice := make([]string, 0, set.Len())
+	set.ForEach(func(member string) bool {
+		slice = append(slice, member)
 		return true
 	})
 	return slice
 }
 
-// ForEach visits each member in the set
+// ForEach visits each member in the set, members of IntSet are visited in ascending order
 func (set *Set) ForEach(consumer func(member string) bool) {
-	if set == nil || set.dict == nil {
+	if set == nil {
+		return
+	}
+	if set.intset != nil {
+		set.intset.ForEach(func(v int64) bool {
+			return consumer(formatInteger(v))
+		})
+		return
+	}
+	if set.dict == nil {
 		return
 	}
 	set.dict.ForEach(func(key string, val interface{}) bool {
@@ -137,7 +235,13 @@ func Diff(sets ...*Set) *Set {
 
 // RandomMembers randomly returns keys of the given number, may contain duplicated key
 func (set *Set) RandomMembers(limit int) []string {
-	if set == nil || set.dict == nil {
+	if set == nil {
+		return nil
+	}
+	if set.intset != nil {
+		return formatIntegers(set.intset.RandomMembers(limit))
+	}
+	if set.dict == nil {
 		return nil
 	}
 	return set.dict.RandomKeys(limit)
@@ -145,5 +249,16 @@ func (set *Set) RandomMembers(limit int) []string {
 
 // RandomDistinctMembers randomly returns keys of the given number, won't contain duplicated key
 func (set *Set) RandomDistinctMembers(limit int) []string {
+	if set.intset != nil {
+		return formatIntegers(set.intset.RandomDistinctMembers(limit))
+	}
 	return set.dict.RandomDistinctKeys(limit)
 }
+
+func formatIntegers(values []int64) []string {
+	result := make([]string, len(values))
+	for i, v := range values {
+		result[i] = formatInteger(v)
+	}
+	return result
+}
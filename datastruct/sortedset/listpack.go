@@ -0,0 +1,144 @@
+package sortedset
+
+import (
+	"encoding/binary"
+	"goRedisPlus/datastruct/listpack"
+	"math"
+	"sync/atomic"
+)
+
+// Small sorted sets are encoded as listpack of members and scores in turn, sorted by score and member like the
+// skiplist, until they have more than zset-max-listpack-entries members or a member longer than
+// zset-max-listpack-value is added, then they are converted to skiplist and never converted back, the same as redis.
+// Scores are kept as 8 bytes of float64 so that they are restored exactly.
+
+// encodings of SortedSet, see OBJECT ENCODING
+const (
+	EncodingListpack = "listpack"
+	EncodingSkiplist = "skiplist"
+)
+
+// limits of listpack encoded sorted sets, accessed atomically
+var (
+	maxListpackEntries int64 = 128
+	maxListpackValue   int64 = 64
+)
+
+// SetMaxListpackEntries sets the most members of sorted sets encoded as listpack, 0 disables listpack
+func SetMaxListpackEntries(n int) {
+	atomic.StoreInt64(&maxListpackEntries, int64(n))
+}
+
+// SetMaxListpackValue sets the longest member of sorted sets encoded as listpack
+func SetMaxListpackValue(n int) {
+	atomic.StoreInt64(&maxListpackValue, int64(n))
+}
+
+func encodeScore(score float64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(score))
+	return b
+}
+
+func decodeScore(b []byte) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+// packedFind returns offset and score of member in listpack, offset is -1 if it does not exist
+func (sortedSet *SortedSet) packedFind(member string) (int, float64) {
+	lp := sortedSet.packed
+	for p := 0; p < lp.Bytes(); p = lp.Next(p) {
+		next := lp.Next(p)
+		if string(lp.Entry(p)) == member {
+			return p, decodeScore(lp.Entry(next))
+		}
+		p = next
+	}
+	return -1, 0
+}
+
+// packedInsert inserts member which does not exist into listpack keeping the order of skiplist
+func (sortedSet *SortedSet) packedInsert(member string, score float64) {
+	lp := sortedSet.packed
+	p := 0
+	for p < lp.Bytes() {
+		next := lp.Next(p)
+		s := decodeScore(lp.Entry(next))
+		if s > score || (s == score && string(lp.Entry(p)) > member) {
+			break
+		}
+		p = lp.Next(next)
+	}
+	lp.Insert(p, []byte(member), encodeScore(score))
+}
+
+// packedFits returns whether member could be added into listpack
+func (sortedSet *SortedSet) packedFits(member string) bool {
+	return int64(len(member)) <= atomic.LoadInt64(&maxListpackValue) &&
+		int64(sortedSet.packed.Len()/2) < atomic.LoadInt64(&maxListpackEntries)
+}
+
+// packedElements returns all members in listpack in ascending order
+func (sortedSet *SortedSet) packedElements() []*Element {
+	lp := sortedSet.packed
+	elements := make([]*Element, 0, lp.Len()/2)
+	for p := 0; p < lp.Bytes(); p = lp.Next(p) {
+		next := lp.Next(p)
+		elements = append(elements, &Element{
+			Member: string(lp.Entry(p)),
+			Score:  decodeScore(lp.Entry(next)),
+		})
+		p = next
+	}
+	return elements
+}
+
+// packedRangeIndex returns the index range [first, last] of elements within the given border, first > last if
+// there is none, it is equivalent to getFirstInRange and getLastInRange of skiplist
+func packedRangeIndex(elements []*Element, min Border, max Border) (int, int) {
+	if min.isIntersected(max) {
+		return 0, -1
+	}
+	first := 0
+	for first < len(elements) && !min.less(elements[first]) {
+		first++
+	}
+	last := len(elements) - 1
+	for last >= 0 && !max.greater(elements[last]) {
+		last--
+	}
+	return first, last
+}
+
+// packedRemoveByIndex removes elements within index range [start, stop) from listpack
+func (sortedSet *SortedSet) packedRemoveByIndex(start int, stop int) {
+	if start >= stop {
+		return
+	}
+	lp := sortedSet.packed
+	lp.Delete(lp.Seek(2*start), 2*(stop-start))
+}
+
+// convertToSkiplist moves members from listpack to dict and skiplist
+func (sortedSet *SortedSet) convertToSkiplist() {
+	elements := sortedSet.packedElements()
+	sortedSet.packed = nil
+	sortedSet.dict = make(map[string]*Element, len(elements))
+	sortedSet.skiplist = makeSkiplist()
+	for _, element := range elements {
+		sortedSet.Add(element.Member, element.Score)
+	}
+}
+
+// Encoding returns the encoding of sorted set
+func (sortedSet *SortedSet) Encoding() string {
+	if sortedSet.packed != nil {
+		return EncodingListpack
+	}
+	return EncodingSkiplist
+}
+
+// Listpack returns the listpack holding members and scores, or nil if the sorted set is converted to skiplist
+func (sortedSet *SortedSet) Listpack() *listpack.Listpack {
+	return sortedSet.packed
+}
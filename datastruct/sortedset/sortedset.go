@@ -1,15 +1,25 @@
 package sortedset
 
-import "strconv"
+import (
+	"goRedisPlus/datastruct/listpack"
+	"strconv"
+	"sync/atomic"
+)
 
-// SortedSet is a set which keys sorted by bound score
+// SortedSet is a set which keys sorted by bound score, small sets are encoded as listpack, see listpack.go
 type SortedSet struct {
 	dict     map[string]*Element
 	skiplist *skiplist
+	packed   *listpack.Listpack // members are kept in listpack instead of dict and skiplist if it is not nil
 }
 
 // Make makes a new SortedSet
 func Make() *SortedSet {
+	if atomic.LoadInt64(&maxListpackEntries) > 0 {
+		return &SortedSet{
+			packed: listpack.New(),
+		}
+	}
 	return &SortedSet{
 		dict:     make(map[string]*Element),
 		skiplist: makeSkiplist(),
@@ -18,6 +28,21 @@ func Make() *SortedSet {
 
 // Add puts member into set,  and returns whether it has inserted new node
 func (sortedSet *SortedSet) Add(member string, score float64) bool {
+	if sortedSet.packed != nil {
+		p, old := sortedSet.packedFind(member)
+		if p >= 0 {
+			if score != old {
+				sortedSet.packed.Delete(p, 2)
+				sortedSet.packedInsert(member, score)
+			}
+			return false
+		}
+		if sortedSet.packedFits(member) {
+			sortedSet.packedInsert(member, score)
+			return true
+		}
+		sortedSet.convertToSkiplist()
+	}
 	element, ok := sortedSet.dict[member] // 判断元素存不存在
 	sortedSet.dict[member] = &Element{    // 这里就先把map里面内容的先写上了
 		Member: member,
@@ -36,11 +61,21 @@ func (sortedSet *SortedSet) Add(member string, score float64) bool {
 
 // Len returns number of members in set
 func (sortedSet *SortedSet) Len() int64 {
+	if sortedSet.packed != nil {
+		return int64(sortedSet.packed.Len() / 2)
+	}
 	return int64(len(sortedSet.dict))
 }
 
 // Get returns the given member
 func (sortedSet *SortedSet) Get(member string) (element *Element, ok bool) {
+	if sortedSet.packed != nil {
+		p, score := sortedSet.packedFind(member)
+		if p < 0 {
+			return nil, false
+		}
+		return &Element{Member: member, Score: score}, true
+	}
 	element, ok = sortedSet.dict[member]
 	if !ok {
 		return nil, false
@@ -50,6 +85,14 @@ func (sortedSet *SortedSet) Get(member string) (element *Element, ok bool) {
 
 // Remove removes the given member from set
 func (sortedSet *SortedSet) Remove(member string) bool {
+	if sortedSet.packed != nil {
+		p, _ := sortedSet.packedFind(member)
+		if p < 0 {
+			return false
+		}
+		sortedSet.packed.Delete(p, 2)
+		return true
+	}
 	v, ok := sortedSet.dict[member]
 	if ok {
 		sortedSet.skiplist.remove(member, v.Score)
@@ -61,6 +104,18 @@ func (sortedSet *SortedSet) Remove(member string) bool {
 
 // GetRank returns the rank of the given member, sort by ascending order, rank starts from 0
 func (sortedSet *SortedSet) GetRank(member string, desc bool) (rank int64) {
+	if sortedSet.packed != nil {
+		lp := sortedSet.packed
+		for r, p := int64(0), 0; p < lp.Bytes(); r, p = r+1, lp.Next(lp.Next(p)) {
+			if string(lp.Entry(p)) == member {
+				if desc {
+					r = sortedSet.Len() - 1 - r
+				}
+				return r
+			}
+		}
+		return -1
+	}
 	element, ok := sortedSet.dict[member]
 	if !ok {
 		return -1
@@ -83,6 +138,19 @@ func (sortedSet *SortedSet) ForEachByRank(start int64, stop int64, desc bool, co
 	if stop < start || stop > size {
 		panic("illegal end " + strconv.FormatInt(stop, 10))
 	}
+	if sortedSet.packed != nil {
+		elements := sortedSet.packedElements()
+		for i := start; i < stop; i++ {
+			element := elements[i]
+			if desc {
+				element = elements[size-1-i]
+			}
+			if !consumer(element) {
+				break
+			}
+		}
+		return
+	}
 
 	// find start node
 	var node *node
@@ -148,6 +216,21 @@ func (sortedSet *SortedSet) RangeCount(min Border, max Border) int64 {
 
 // ForEach visits members which score or member within the given border
 func (sortedSet *SortedSet) ForEach(min Border, max Border, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
+	if sortedSet.packed != nil {
+		elements := sortedSet.packedElements()
+		first, last := packedRangeIndex(elements, min, max)
+		// A negative limit returns all elements from the offset
+		for i := int64(0); (i < limit || limit < 0) && int64(first)+offset+i <= int64(last); i++ {
+			element := elements[int64(first)+offset+i]
+			if desc {
+				element = elements[int64(last)-offset-i]
+			}
+			if !consumer(element) {
+				break
+			}
+		}
+		return
+	}
 	// find start node
 	var node *node
 	if desc {
@@ -202,6 +285,14 @@ func (sortedSet *SortedSet) Range(min Border, max Border, offset int64, limit in
 
 // RemoveRange removes members which score or member within the given border
 func (sortedSet *SortedSet) RemoveRange(min Border, max Border) int64 {
+	if sortedSet.packed != nil {
+		first, last := packedRangeIndex(sortedSet.packedElements(), min, max)
+		if first > last {
+			return 0
+		}
+		sortedSet.packedRemoveByIndex(first, last+1)
+		return int64(last + 1 - first)
+	}
 	removed := sortedSet.skiplist.RemoveRange(min, max, 0)
 	for _, element := range removed {
 		delete(sortedSet.dict, element.Member)
@@ -210,6 +301,17 @@ func (sortedSet *SortedSet) RemoveRange(min Border, max Border) int64 {
 }
 
 func (sortedSet *SortedSet) PopMin(count int) []*Element {
+	if sortedSet.packed != nil {
+		elements := sortedSet.packedElements()
+		if len(elements) == 0 {
+			return nil
+		}
+		if count <= 0 || count > len(elements) {
+			count = len(elements)
+		}
+		sortedSet.packedRemoveByIndex(0, count)
+		return elements[:count]
+	}
 	first := sortedSet.skiplist.getFirstInRange(scoreNegativeInfBorder, scorePositiveInfBorder)
 	if first == nil {
 		return nil
@@ -228,6 +330,16 @@ func (sortedSet *SortedSet) PopMin(count int) []*Element {
 // RemoveByRank removes member ranking within [start, stop)
 // sort by ascending order and rank starts from 0
 func (sortedSet *SortedSet) RemoveByRank(start int64, stop int64) int64 {
+	if sortedSet.packed != nil {
+		if size := sortedSet.Len(); stop > size {
+			stop = size
+		}
+		if start >= stop {
+			return 0
+		}
+		sortedSet.packedRemoveByIndex(int(start), int(stop))
+		return stop - start
+	}
 	removed := sortedSet.skiplist.RemoveRangeByRank(start+1, stop+1)
 	for _, element := range removed {
 		delete(sortedSet.dict, element.Member)
@@ -0,0 +1,107 @@
+package strobj
+
+import "strconv"
+
+// String values are kept in one of three encodings like redis. Canonical forms of integers are kept as Int, which
+// is boxed in 8 bytes, short strings are kept in the fixed array of Embedded, which is allocated in a single block
+// when it is boxed into an interface, and other strings are kept as []byte, that is a slice header and its backing
+// array. Strings are encoded when they are set as a whole, strings modified in place such as by APPEND are kept
+// as []byte.
+
+// Int is a string holding the canonical form of an integer
+type Int int64
+
+// EmbeddedMax is the longest string kept in Embedded, it makes Embedded fit in a 48 bytes size class
+const EmbeddedMax = 47
+
+// Embedded is a short string kept in a fixed array
+type Embedded struct {
+	n    uint8
+	data [EmbeddedMax]byte
+}
+
+// encodings of strings, see OBJECT ENCODING
+const (
+	EncodingInt    = "int"
+	EncodingEmbstr = "embstr"
+	EncodingRaw    = "raw"
+)
+
+// parseInteger returns the integer of value if value is the canonical form of an int64, like string2ll of redis,
+// values such as "+1" and "01" are not integers, otherwise they could not be restored from Int
+func parseInteger(value []byte) (int64, bool) {
+	if len(value) == 0 || len(value) > 20 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	var buf [20]byte
+	return v, string(strconv.AppendInt(buf[:0], v, 10)) == string(value)
+}
+
+// Encode returns value in the most compact encoding, value is retained only if it is kept as []byte
+func Encode(value []byte) interface{} {
+	if v, ok := parseInteger(value); ok {
+		return Int(v)
+	}
+	if len(value) <= EmbeddedMax {
+		embedded := Embedded{n: uint8(len(value))}
+		copy(embedded.data[:], value)
+		return embedded
+	}
+	return value
+}
+
+// Bytes returns content of data and whether data is a string. Int and Embedded are copied so that the result
+// could be modified by caller, []byte is returned as is.
+func Bytes(data interface{}) ([]byte, bool) {
+	switch val := data.(type) {
+	case []byte:
+		return val, true
+	case Int:
+		return strconv.AppendInt(nil, int64(val), 10), true
+	case Embedded:
+		result := make([]byte, val.n)
+		copy(result, val.data[:val.n])
+		return result, true
+	}
+	return nil, false
+}
+
+// IsString returns whether data is a string in any encoding
+func IsString(data interface{}) bool {
+	switch data.(type) {
+	case []byte, Int, Embedded:
+		return true
+	}
+	return false
+}
+
+// Len returns length of string in bytes, or 0 if data is not a string
+func Len(data interface{}) int {
+	switch val := data.(type) {
+	case []byte:
+		return len(val)
+	case Int:
+		var buf [20]byte
+		return len(strconv.AppendInt(buf[:0], int64(val), 10))
+	case Embedded:
+		return int(val.n)
+	}
+	return 0
+}
+
+// Encoding returns encoding of string, or empty string if data is not a string
+func Encoding(data interface{}) string {
+	switch data.(type) {
+	case []byte:
+		return EncodingRaw
+	case Int:
+		return EncodingInt
+	case Embedded:
+		return EncodingEmbstr
+	}
+	return ""
+}
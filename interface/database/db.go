@@ -21,6 +21,9 @@ type DB interface {
 // may be called concurrently
 type KeyEventCallback func(dbIndex int, key string, entity *DataEntity)
 
+// KeyspaceEventCallback will be called back after a keyspace notification published
+type KeyspaceEventCallback func(channel string, message string)
+
 // DBEngine is the embedding storage engine exposing more methods for complex application
 type DBEngine interface {
 	DB
@@ -30,14 +33,24 @@ type DBEngine interface {
 	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
 	RWLocks(dbIndex int, writeKeys []string, readKeys []string)
 	RWUnLocks(dbIndex int, writeKeys []string, readKeys []string)
+	TryRWLocks(dbIndex int, writeKeys []string, readKeys []string, timeout time.Duration) bool
 	GetDBSize(dbIndex int) (int, int)
 	GetEntity(dbIndex int, key string) (*DataEntity, bool)
 	GetExpiration(dbIndex int, key string) *time.Time
 	SetKeyInsertedCallback(cb KeyEventCallback)
 	SetKeyDeletedCallback(cb KeyEventCallback)
+	SetKeyspaceEventCallback(cb KeyspaceEventCallback)
+	GetSubscribedChannels(prefix string) []string
+	GetReplOffset() int64
 }
 
 // DataEntity stores data bound to a key, including a string, list, hash, set and so on
 type DataEntity struct {
 	Data interface{}
+	// Access is the clock of last access in seconds for LRU eviction, it is read and written atomically
+	Access uint32
+	// Freq is the LFU counter with the time of its last decrement for LFU eviction, it is read and written atomically
+	Freq uint32
+	// Size is the estimated bytes of key and value, updated after every write of the key
+	Size int64
 }
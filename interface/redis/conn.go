@@ -9,6 +9,10 @@ type Connection interface {
 	SetPassword(string)
 	GetPassword() string
 
+	// user of ACL authenticated by AUTH or HELLO, empty means the default user without authentication
+	SetUser(string)
+	GetUser() string
+
 	// client should keep its subscribing channels
 	Subscribe(channel string)
 	UnSubscribe(channel string)
@@ -33,5 +37,26 @@ type Connection interface {
 	SetMaster()
 	IsMaster() bool
 
+	// READONLY/READWRITE in cluster mode
+	SetReadOnly(bool)
+	IsReadOnly() bool
+
 	Name() string
+
+	// metadata of CLIENT command
+	GetID() uint64
+	SetClientName(string)
+	GetClientName() string
+
+	// CLIENT REPLY ON|OFF|SKIP
+	SetReplyMode(mode int)
+	// CLIENT NO-EVICT ON|OFF
+	SetNoEvict(bool)
 }
+
+// reply modes of connection set by CLIENT REPLY
+const (
+	ReplyOn   = iota
+	ReplyOff  // replies are discarded until CLIENT REPLY ON
+	ReplySkip // reply of the next command is discarded
+)
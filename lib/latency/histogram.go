@@ -0,0 +1,102 @@
+package latency
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// Histogram buckets values with log-linear precision like HdrHistogram: values below subBuckets are exact,
+// others are split into subBuckets buckets per power of 2, so the relative error is at most 1/subBuckets.
+const (
+	subBucketBits = 4
+	subBuckets    = 1 << subBucketBits
+	magnitudes    = 36 // values up to 2^(magnitudes+subBucketBits-1), larger ones are put into the last bucket
+	bucketCount   = (magnitudes + 1) * subBuckets
+)
+
+// Histogram counts values without locking, such as latencies in microseconds
+type Histogram struct {
+	counts [bucketCount]int64
+}
+
+// NewHistogram creates an empty Histogram
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+func bucketIndex(value int64) int {
+	if value < subBuckets {
+		if value < 0 {
+			return 0
+		}
+		return int(value)
+	}
+	magnitude := bits.Len64(uint64(value)) - 1 // >= subBucketBits
+	shift := magnitude - subBucketBits
+	index := (shift+1)*subBuckets + int(value>>shift)&(subBuckets-1)
+	if index >= bucketCount {
+		return bucketCount - 1
+	}
+	return index
+}
+
+// bucketUpperBound returns the max value falls into the bucket
+func bucketUpperBound(index int) int64 {
+	if index < subBuckets {
+		return int64(index)
+	}
+	shift := index/subBuckets - 1
+	lower := int64(subBuckets+index%subBuckets) << shift
+	return lower + 1<<shift - 1
+}
+
+// Record adds a value
+func (h *Histogram) Record(value int64) {
+	atomic.AddInt64(&h.counts[bucketIndex(value)], 1)
+}
+
+// Count returns the number of recorded values
+func (h *Histogram) Count() int64 {
+	var total int64
+	for i := range h.counts {
+		total += atomic.LoadInt64(&h.counts[i])
+	}
+	return total
+}
+
+// Percentiles returns the values at given percentiles, such as 50 and 99.9, values are upper bounds of buckets
+func (h *Histogram) Percentiles(percentiles ...float64) []int64 {
+	counts := make([]int64, bucketCount)
+	var total int64
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+		total += counts[i]
+	}
+	result := make([]int64, len(percentiles))
+	if total == 0 {
+		return result
+	}
+	for i, p := range percentiles {
+		rank := int64(math.Ceil(p / 100 * float64(total)))
+		if rank < 1 {
+			rank = 1
+		}
+		var seen int64
+		for index, count := range counts {
+			seen += count
+			if seen >= rank {
+				result[i] = bucketUpperBound(index)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Reset removes all recorded values
+func (h *Histogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+}
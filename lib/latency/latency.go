@@ -0,0 +1,128 @@
+package latency
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// historyLen is the max number of samples kept for each event
+const historyLen = 160
+
+// Sample is the max latency of an event within one second
+type Sample struct {
+	Time    int64 // unix timestamp in seconds
+	Latency int64 // milliseconds
+}
+
+// Event describes the latest and the all-time max latency of an event
+type Event struct {
+	Name   string
+	Latest Sample
+	Max    int64 // milliseconds
+}
+
+type history struct {
+	samples []Sample // in time order, at most historyLen
+	max     int64
+}
+
+var (
+	threshold int64 // milliseconds, 0 means disabled
+
+	mu        sync.Mutex
+	histories = make(map[string]*history)
+)
+
+// SetThreshold sets the min latency in milliseconds to be recorded, 0 disables latency monitor
+func SetThreshold(ms int64) {
+	atomic.StoreInt64(&threshold, ms)
+}
+
+// Threshold returns the min latency in milliseconds to be recorded
+func Threshold() int64 {
+	return atomic.LoadInt64(&threshold)
+}
+
+// Record adds a sample of event if it took no less than threshold
+func Record(event string, elapsed time.Duration) {
+	limit := Threshold()
+	ms := elapsed.Milliseconds()
+	if limit <= 0 || ms < limit {
+		return
+	}
+	now := time.Now().Unix()
+	mu.Lock()
+	defer mu.Unlock()
+	h := histories[event]
+	if h == nil {
+		h = &history{}
+		histories[event] = h
+	}
+	if ms > h.max {
+		h.max = ms
+	}
+	if n := len(h.samples); n > 0 && h.samples[n-1].Time == now {
+		// keep the max latency of a second
+		if ms > h.samples[n-1].Latency {
+			h.samples[n-1].Latency = ms
+		}
+		return
+	}
+	if len(h.samples) == historyLen {
+		copy(h.samples, h.samples[1:])
+		h.samples = h.samples[:historyLen-1]
+	}
+	h.samples = append(h.samples, Sample{Time: now, Latency: ms})
+}
+
+// History returns samples of event in time order
+func History(event string) []Sample {
+	mu.Lock()
+	defer mu.Unlock()
+	h := histories[event]
+	if h == nil {
+		return nil
+	}
+	samples := make([]Sample, len(h.samples))
+	copy(samples, h.samples)
+	return samples
+}
+
+// Latest returns all recorded events sorted by name
+func Latest() []Event {
+	mu.Lock()
+	defer mu.Unlock()
+	events := make([]Event, 0, len(histories))
+	for name, h := range histories {
+		events = append(events, Event{
+			Name:   name,
+			Latest: h.samples[len(h.samples)-1],
+			Max:    h.max,
+		})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Name < events[j].Name
+	})
+	return events
+}
+
+// Reset removes samples of given events, or all events if none is given, and returns the number of removed events
+func Reset(events ...string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) == 0 {
+		n := len(histories)
+		histories = make(map[string]*history)
+		return n
+	}
+	n := 0
+	for _, event := range events {
+		if _, ok := histories[event]; ok {
+			delete(histories, event)
+			n++
+		}
+	}
+	return n
+}
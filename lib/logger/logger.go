@@ -7,7 +7,9 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -42,6 +44,27 @@ const (
 
 const flags = log.LstdFlags
 
+// minLevel is the lowest level to print, logs below it are discarded
+var minLevel int32
+
+// redisLevels maps loglevel of redis.conf to log levels
+var redisLevels = map[string]logLevel{
+	"debug":   DEBUG,
+	"verbose": INFO,
+	"notice":  INFO,
+	"warning": WARNING,
+}
+
+// SetLevel discards logs below the level, level is one of debug, verbose, notice and warning like redis,
+// empty or unknown level means debug
+func SetLevel(level string) {
+	atomic.StoreInt32(&minLevel, int32(redisLevels[strings.ToLower(level)]))
+}
+
+func enabled(level logLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&minLevel)
+}
+
 func init() {
 	logger = log.New(os.Stdout, defaultPrefix, flags)
 }
@@ -77,6 +100,9 @@ func setPrefix(level logLevel) {
 
 // Debug prints debug log
 func Debug(v ...interface{}) {
+	if !enabled(DEBUG) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(DEBUG)
@@ -84,6 +110,9 @@ func Debug(v ...interface{}) {
 }
 
 func Debugf(format string, v ...interface{}) {
+	if !enabled(DEBUG) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(DEBUG)
@@ -92,6 +121,9 @@ func Debugf(format string, v ...interface{}) {
 
 // Info prints normal log
 func Info(v ...interface{}) {
+	if !enabled(INFO) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(INFO)
@@ -100,6 +132,9 @@ func Info(v ...interface{}) {
 
 // Infof prints normal log
 func Infof(format string, v ...interface{}) {
+	if !enabled(INFO) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(INFO)
@@ -108,6 +143,9 @@ func Infof(format string, v ...interface{}) {
 
 // Warn prints warning log
 func Warn(v ...interface{}) {
+	if !enabled(WARNING) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(WARNING)
@@ -116,6 +154,9 @@ func Warn(v ...interface{}) {
 
 // Error prints error log
 func Error(v ...interface{}) {
+	if !enabled(ERROR) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(ERROR)
@@ -123,6 +164,9 @@ func Error(v ...interface{}) {
 }
 
 func Errorf(format string, v ...interface{}) {
+	if !enabled(ERROR) {
+		return
+	}
 	mu.Lock()
 	defer mu.Unlock()
 	setPrefix(ERROR)
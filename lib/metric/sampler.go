@@ -0,0 +1,72 @@
+package metric
+
+import (
+	"sync"
+	"time"
+)
+
+// samplerWindow is the number of recent samples averaged, redis uses 16 samples taken every 100ms
+const samplerWindow = 16
+
+// Sampler estimates the instantaneous per-second rate of an increasing counter,
+// such as commands processed, by averaging the rates between recent samples
+type Sampler struct {
+	mu        sync.Mutex
+	rates     [samplerWindow]float64
+	index     int
+	count     int // number of valid rates, at most samplerWindow
+	lastValue int64
+	lastTime  time.Time
+}
+
+// NewSampler creates a Sampler without samples
+func NewSampler() *Sampler {
+	return &Sampler{}
+}
+
+// Sample records current value of the counter, a decreased counter (e.g. reset) is treated as unchanged
+func (s *Sampler) Sample(value int64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lastTime.IsZero() {
+		elapsed := now.Sub(s.lastTime).Seconds()
+		if elapsed <= 0 {
+			return
+		}
+		delta := value - s.lastValue
+		if delta < 0 {
+			delta = 0
+		}
+		s.rates[s.index] = float64(delta) / elapsed
+		s.index = (s.index + 1) % samplerWindow
+		if s.count < samplerWindow {
+			s.count++
+		}
+	}
+	s.lastValue = value
+	s.lastTime = now
+}
+
+// Rate returns the average per-second rate of recent samples
+func (s *Sampler) Rate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return 0
+	}
+	var sum float64
+	for i := 0; i < s.count; i++ {
+		sum += s.rates[i]
+	}
+	return sum / float64(s.count)
+}
+
+// Reset removes all samples
+func (s *Sampler) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rates = [samplerWindow]float64{}
+	s.index = 0
+	s.count = 0
+	s.lastTime = time.Time{}
+}
@@ -0,0 +1,154 @@
+package metric
+
+import "sort"
+
+// TopK finds the most frequent keys of a stream in bounded memory. Frequencies are estimated by a count-min sketch
+// with conservative update, which never underestimates, and keys with the greatest estimates are kept as candidates.
+// Keys out of candidates are forgotten except for their counters in sketch, so a key becoming hot later still
+// enters candidates once its estimate exceeds the least candidate.
+
+const (
+	sketchDepth = 4
+	sketchWidth = 1024
+)
+
+// TopKItem is a key and its estimated count
+type TopKItem struct {
+	Key   string
+	Count uint32
+}
+
+// TopK is not safe for concurrent use, invoker should provide locks
+type TopK struct {
+	capacity int
+	counters [sketchDepth][sketchWidth]uint32
+	items    map[string]uint32
+	// minKey and minCount are the least candidate, minCount is a lower bound since counts of candidates only grow
+	minKey   string
+	minCount uint32
+	total    uint64
+}
+
+// NewTopK creates a TopK keeping at most capacity keys, capacity is at least 1
+func NewTopK(capacity int) *TopK {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &TopK{
+		capacity: capacity,
+		items:    make(map[string]uint32, capacity),
+	}
+}
+
+func fnv64(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+// sketchIndexes returns the counter of key in each row of sketch by double hashing
+func sketchIndexes(key string) [sketchDepth]uint32 {
+	hash := fnv64(key)
+	h1, h2 := uint32(hash), uint32(hash>>32)|1
+	var indexes [sketchDepth]uint32
+	for i := range indexes {
+		indexes[i] = (h1 + uint32(i)*h2) % sketchWidth
+	}
+	return indexes
+}
+
+// estimate returns the least counter of key, which is never less than its count
+func (t *TopK) estimate(indexes [sketchDepth]uint32) uint32 {
+	estimate := ^uint32(0)
+	for i, index := range indexes {
+		if c := t.counters[i][index]; c < estimate {
+			estimate = c
+		}
+	}
+	return estimate
+}
+
+// Add counts weight occurrences of key and returns its estimated count
+func (t *TopK) Add(key string, weight uint32) uint32 {
+	indexes := sketchIndexes(key)
+	estimate := t.estimate(indexes)
+	if estimate > ^uint32(0)-weight {
+		estimate = ^uint32(0)
+	} else {
+		estimate += weight
+	}
+	// conservative update: counters already above the new estimate are overestimated by other keys
+	for i, index := range indexes {
+		if t.counters[i][index] < estimate {
+			t.counters[i][index] = estimate
+		}
+	}
+	t.total += uint64(weight)
+
+	if _, ok := t.items[key]; ok {
+		t.items[key] = estimate
+		return estimate
+	}
+	if len(t.items) < t.capacity {
+		t.items[key] = estimate
+		if len(t.items) == t.capacity {
+			t.findMin()
+		}
+		return estimate
+	}
+	if estimate <= t.minCount {
+		return estimate
+	}
+	t.findMin()
+	if estimate > t.minCount {
+		delete(t.items, t.minKey)
+		t.items[key] = estimate
+		t.findMin()
+	}
+	return estimate
+}
+
+// findMin finds the least candidate
+func (t *TopK) findMin() {
+	first := true
+	for key, count := range t.items {
+		if first || count < t.minCount {
+			t.minKey, t.minCount = key, count
+			first = false
+		}
+	}
+}
+
+// Total returns the sum of weights added
+func (t *TopK) Total() uint64 {
+	return t.total
+}
+
+// Count returns estimated count of key, keys never added may be overestimated by collisions
+func (t *TopK) Count(key string) uint32 {
+	if count, ok := t.items[key]; ok {
+		return count
+	}
+	return t.estimate(sketchIndexes(key))
+}
+
+// Top returns at most n candidates in descending order of counts
+func (t *TopK) Top(n int) []TopKItem {
+	items := make([]TopKItem, 0, len(t.items))
+	for key, count := range t.items {
+		items = append(items, TopKItem{Key: key, Count: count})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		return items[i].Key < items[j].Key
+	})
+	if len(items) > n {
+		items = items[:n]
+	}
+	return items
+}
@@ -3,6 +3,7 @@ package pool
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 var (
@@ -12,9 +13,34 @@ var (
 
 type request chan interface{}
 
+// createFailed is sent to waiting request if pool failed to create an item for it
+type createFailed struct {
+	err error
+}
+
 type Config struct {
 	MaxIdle   uint
 	MaxActive uint
+
+	MaxIdleTime   time.Duration             // idle items longer than it are destroyed, 0 means no limit
+	MaxLifetime   time.Duration             // items older than it are destroyed instead of reusing, 0 means no limit
+	CheckInterval time.Duration             // interval of examining idle items, 0 disables background examining
+	Check         func(x interface{}) error // health check of idle items, items failed checking are destroyed
+}
+
+// Stats is a snapshot of pool
+type Stats struct {
+	Active    uint   // items created and not destroyed, including idle items
+	Idle      uint   // items in pool
+	Waiting   uint   // requests waiting for items
+	Created   uint64 // items created in total
+	Destroyed uint64 // items destroyed in total
+	Broken    uint64 // items destroyed for failing health check or discarded by user
+}
+
+type idleItem struct {
+	x         interface{}
+	idleSince time.Time
 }
 
 // Pool stores object for reusing, such as redis connection
@@ -22,21 +48,44 @@ type Pool struct {
 	Config
 	factory     func() (interface{}, error)
 	finalizer   func(x interface{})
-	idles       chan interface{}
+	idles       chan *idleItem
 	waitingReqs []request
 	activeCount uint // increases during creating connection, decrease during destroying connection
+	createTime  map[interface{}]time.Time
+	stats       Stats
 	mu          sync.Mutex
 	closed      bool
+	closeChan   chan struct{}
 }
 
 func New(factory func() (interface{}, error), finalizer func(x interface{}), cfg Config) *Pool {
-	return &Pool{
+	pool := &Pool{
 		factory:     factory,
 		finalizer:   finalizer,
-		idles:       make(chan interface{}, cfg.MaxIdle),
+		idles:       make(chan *idleItem, cfg.MaxIdle),
 		waitingReqs: make([]request, 0),
+		createTime:  make(map[interface{}]time.Time),
+		closeChan:   make(chan struct{}),
 		Config:      cfg,
 	}
+	if cfg.CheckInterval > 0 {
+		go pool.examineCron()
+	}
+	return pool
+}
+
+// create makes a new item, invoker should have held a place in activeCount
+func (pool *Pool) create() (interface{}, error) {
+	x, err := pool.factory()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if err != nil {
+		pool.activeCount-- // release the holding place
+		return nil, err
+	}
+	pool.createTime[x] = time.Now()
+	pool.stats.Created++
+	return x, nil
 }
 
 // getOnNoIdle try to create a new connection or waiting for connection being returned
@@ -51,70 +100,223 @@ func (pool *Pool) getOnNoIdle() (interface{}, error) {
 		if !ok {
 			return nil, ErrMax
 		}
+		if failed, ok := x.(*createFailed); ok {
+			return nil, failed.err
+		}
 		return x, nil
 	}
 
 	// create a new connection
 	pool.activeCount++ // hold a place for new connection
 	pool.mu.Unlock()
-	x, err := pool.factory()
-	if err != nil {
-		// create failed return token
-		pool.mu.Lock()
-		pool.activeCount-- // release the holding place
-		pool.mu.Unlock()
-		return nil, err
+	return pool.create()
+}
+
+// tooOld returns whether item exceeds MaxLifetime, invoker should have pool.mu
+func (pool *Pool) tooOld(x interface{}, now time.Time) bool {
+	if pool.MaxLifetime <= 0 {
+		return false
 	}
-	return x, nil
+	createTime, ok := pool.createTime[x]
+	return ok && now.Sub(createTime) > pool.MaxLifetime
+}
+
+// expired returns whether idle item should be destroyed instead of reusing, invoker should have pool.mu
+func (pool *Pool) expired(item *idleItem, now time.Time) bool {
+	if pool.MaxIdleTime > 0 && now.Sub(item.idleSince) > pool.MaxIdleTime {
+		return true
+	}
+	return pool.tooOld(item.x, now)
 }
 
 func (pool *Pool) Get() (interface{}, error) {
+	for {
+		pool.mu.Lock()
+		if pool.closed {
+			pool.mu.Unlock()
+			return nil, ErrClosed
+		}
+
+		select {
+		case item := <-pool.idles:
+			expired := pool.expired(item, time.Now())
+			pool.mu.Unlock()
+			if expired {
+				pool.destroy(item.x, false)
+				continue
+			}
+			return item.x, nil
+		default:
+			// no pooled item, create one
+			return pool.getOnNoIdle()
+		}
+	}
+}
+
+func (pool *Pool) Put(x interface{}) {
 	pool.mu.Lock()
+
 	if pool.closed {
 		pool.mu.Unlock()
-		return nil, ErrClosed
+		pool.finalizer(x)
+		return
+	}
+
+	if pool.tooOld(x, time.Now()) {
+		pool.mu.Unlock()
+		pool.destroy(x, false)
+		return
+	}
+
+	if pool.handOver(x) {
+		pool.mu.Unlock()
+		return
 	}
 
 	select {
-	case item := <-pool.idles:
+	case pool.idles <- &idleItem{x: x, idleSince: time.Now()}:
 		pool.mu.Unlock()
-		return item, nil
+		return
 	default:
-		// no pooled item, create one
-		return pool.getOnNoIdle()
+		// reach max idle, destroy redundant item
+		pool.mu.Unlock()
+		pool.destroy(x, false)
 	}
 }
 
-func (pool *Pool) Put(x interface{}) {
+// Discard destroys a broken item instead of putting it back, a new item will be created for waiting requests
+func (pool *Pool) Discard(x interface{}) {
+	pool.destroy(x, true)
+}
+
+// handOver gives item to the first waiting request, invoker should have pool.mu
+func (pool *Pool) handOver(x interface{}) bool {
+	if len(pool.waitingReqs) == 0 {
+		return false
+	}
+	req := pool.waitingReqs[0]
+	copy(pool.waitingReqs, pool.waitingReqs[1:])
+	pool.waitingReqs = pool.waitingReqs[:len(pool.waitingReqs)-1]
+	req <- x
+	return true
+}
+
+// destroy finalizes item and releases its place, then creates a new item for waiting request if any
+func (pool *Pool) destroy(x interface{}, broken bool) {
 	pool.mu.Lock()
+	pool.activeCount--
+	delete(pool.createTime, x)
+	pool.stats.Destroyed++
+	if broken {
+		pool.stats.Broken++
+	}
+	var req request
+	if !pool.closed && len(pool.waitingReqs) > 0 {
+		req = pool.waitingReqs[0]
+		copy(pool.waitingReqs, pool.waitingReqs[1:])
+		pool.waitingReqs = pool.waitingReqs[:len(pool.waitingReqs)-1]
+		pool.activeCount++ // hold a place for the waiting request
+	}
+	pool.mu.Unlock()
+	pool.finalizer(x)
+	if req != nil {
+		go func() {
+			x, err := pool.create()
+			if err != nil {
+				req <- &createFailed{err: err}
+				return
+			}
+			req <- x
+		}()
+	}
+}
+
+// examineCron destroys idle items which are expired or failed health check periodically
+func (pool *Pool) examineCron() {
+	ticker := time.NewTicker(pool.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pool.examine()
+		case <-pool.closeChan:
+			return
+		}
+	}
+}
 
+func (pool *Pool) examine() {
+	// take out idle items, so that they won't be used during checking
+	var items []*idleItem
+	pool.mu.Lock()
 	if pool.closed {
 		pool.mu.Unlock()
-		pool.finalizer(x)
 		return
 	}
+	for len(items) < cap(pool.idles) {
+		var item *idleItem
+		select {
+		case item = <-pool.idles:
+		default:
+		}
+		if item == nil {
+			break
+		}
+		items = append(items, item)
+	}
+	pool.mu.Unlock()
 
-	if len(pool.waitingReqs) > 0 {
-		req := pool.waitingReqs[0]
-		copy(pool.waitingReqs, pool.waitingReqs[1:])
-		pool.waitingReqs = pool.waitingReqs[:len(pool.waitingReqs)-1]
-		req <- x
+	now := time.Now()
+	for _, item := range items {
+		pool.mu.Lock()
+		expired := pool.expired(item, now)
 		pool.mu.Unlock()
-		return
+		if expired {
+			pool.destroy(item.x, false)
+			continue
+		}
+		if pool.Check != nil {
+			if err := pool.Check(item.x); err != nil {
+				pool.destroy(item.x, true)
+				continue
+			}
+		}
+		pool.requeue(item)
 	}
+}
 
-	select {
-	case pool.idles <- x:
+// requeue puts back idle item without resetting its idle time
+func (pool *Pool) requeue(item *idleItem) {
+	pool.mu.Lock()
+	if pool.closed {
 		pool.mu.Unlock()
+		pool.finalizer(item.x)
 		return
+	}
+	if pool.handOver(item.x) {
+		pool.mu.Unlock()
+		return
+	}
+	select {
+	case pool.idles <- item:
+		pool.mu.Unlock()
 	default:
-		// reach max idle, destroy redundant item
 		pool.mu.Unlock()
-		pool.activeCount--
-		pool.finalizer(x)
+		pool.destroy(item.x, false)
 	}
 }
 
+// Stats returns a snapshot of pool
+func (pool *Pool) Stats() Stats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	stats := pool.stats
+	stats.Active = pool.activeCount
+	stats.Idle = uint(len(pool.idles))
+	stats.Waiting = uint(len(pool.waitingReqs))
+	return stats
+}
+
 func (pool *Pool) Close() {
 	pool.mu.Lock()
 	if pool.closed {
@@ -122,10 +324,11 @@ func (pool *Pool) Close() {
 		return
 	}
 	pool.closed = true
+	close(pool.closeChan)
 	close(pool.idles)
 	pool.mu.Unlock()
 
-	for x := range pool.idles {
-		pool.finalizer(x)
+	for item := range pool.idles {
+		pool.finalizer(item.x)
 	}
 }
@@ -2,7 +2,8 @@ package timewheel
 
 import "time"
 
-var tw = New(time.Second, 3600)
+// tw ticks every millisecond, its wheels span a second, a minute, an hour and a day
+var tw = New(time.Millisecond, 1000, 60, 60, 24)
 
 func init() {
 	tw.Start()
@@ -22,3 +23,8 @@ func At(at time.Time, key string, job func()) {
 func Cancel(key string) {
 	tw.RemoveJob(key)
 }
+
+// GetStats returns counters of jobs
+func GetStats() Stats {
+	return tw.Stats()
+}
@@ -3,77 +3,184 @@ package timewheel
 import (
 	"container/list"
 	"goRedisPlus/lib/logger"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type location struct { // 一个整形位置，一个指针
-	slot  int
-	etask *list.Element // 双向链表中的一个元素
-}
+const (
+	// workerNum is the number of goroutines executing jobs, jobs such as expiring keys may wait for locks
+	workerNum = 64
+	// jobQueueSize is the number of due jobs waiting for workers, more jobs wait in overflow of the wheel
+	jobQueueSize = 4096
+)
 
-// TimeWheel can execute job after waiting given duration
+// states of time wheel
+const (
+	stopped = iota
+	running
+	paused
+)
+
+// TimeWheel can execute job after waiting given duration.
+// It is a hierarchical timing wheel: each slot of wheel 0 spans an interval, and each slot of wheel i spans a whole
+// revolution of wheel i-1. A task is put into the lowest wheel whose revolution covers its delay, at the slot of its
+// expiration. Whenever a slot of wheel i-1 is about to start a revolution, the current slot of wheel i is cascaded:
+// its tasks are put into lower wheels by their remaining delay, so that adding, removing and cascading a task are all
+// O(1). Tasks beyond the revolution of the top wheel are put again when their slot comes round.
+// Due jobs are executed by a fixed pool of workers. When the queue of workers is full, such as a burst of keys
+// expiring at the same time, jobs wait in overflow and are handed to the queue in order as it drains, so that the
+// wheel keeps ticking and accepting tasks without spawning a goroutine for each job.
+// Wheels are guarded by a mutex instead of being owned by the goroutine of ticker, so jobs can be added and removed
+// in any state, even by jobs themselves. Delays count from the time a job is added, regardless of the state: a
+// stopped or paused wheel keeps its tasks, and ticks missed are caught up as soon as it is started or resumed.
 type TimeWheel struct {
-	interval          time.Duration
-	ticker            *time.Ticker
-	slots             []*list.List // 双向链表头节点数组
-	timer             map[string]*location
-	currentPos        int
-	slotNum           int
-	addTaskChannel    chan task
-	removeTaskChannel chan string
-	stopChannel       chan bool
+	mu       sync.Mutex // guards all fields below except counters
+	interval time.Duration
+	wheels   []*wheel
+	timer    map[string]*list.Element // key -> task in slot
+	// startTime is the time of tick 0, ticks are counted by elapsed time so that ticks dropped by ticker are caught up
+	startTime time.Time
+	current   int64 // the last tick handled
+
+	state      int
+	stopTicker chan struct{}   // closed to stop the goroutine of ticker
+	quit       chan struct{}   // closed to stop workers once the queue is drained
+	workers    *sync.WaitGroup // workers started by the last Start
+
+	jobQueue chan func()
+	overflow []func() // jobs waiting for space in jobQueue
+	// counters of jobs, see Stats
+	executed        int64
+	overflows       int64
+	overflowPending int64
+}
+
+// Stats are counters of jobs of time wheel
+type Stats struct {
+	Executed  int64 // jobs finished by workers
+	Pending   int64 // jobs due but waiting for workers
+	Overflows int64 // jobs which found the queue of workers full
+}
+
+type wheel struct {
+	slots []*list.List
+	span  int64 // ticks of a slot
 }
 
 type task struct {
-	delay  time.Duration
-	circle int
-	key    string
-	job    func()
+	delay      time.Duration
+	expiration int64 // tick to execute the job
+	wheel      int   // location of task
+	slot       int
+	key        string
+	job        func()
 }
 
-// New creates a new time wheel
-func New(interval time.Duration, slotNum int) *TimeWheel {
-	if interval <= 0 || slotNum <= 0 {
+// New creates a new stopped time wheel ticking every interval, slotNums are the number of slots of wheels from the
+// lowest
+func New(interval time.Duration, slotNums ...int) *TimeWheel {
+	if interval <= 0 || len(slotNums) == 0 {
 		return nil
 	}
 	tw := &TimeWheel{
-		interval:          interval,
-		slots:             make([]*list.List, slotNum),
-		timer:             make(map[string]*location),
-		currentPos:        0,
-		slotNum:           slotNum,         // 位置数量 3600 前面用new调用 参数3600
-		addTaskChannel:    make(chan task), // 都是无缓冲的channel，阻塞
-		removeTaskChannel: make(chan string),
-		stopChannel:       make(chan bool),
+		interval:  interval,
+		timer:     make(map[string]*list.Element),
+		startTime: time.Now(),
+		jobQueue:  make(chan func(), jobQueueSize),
+	}
+	span := int64(1)
+	for _, slotNum := range slotNums {
+		if slotNum <= 0 {
+			return nil
+		}
+		w := &wheel{
+			slots: make([]*list.List, slotNum),
+			span:  span,
+		}
+		for i := range w.slots {
+			w.slots[i] = list.New()
+		}
+		tw.wheels = append(tw.wheels, w)
+		span *= int64(slotNum)
 	}
-	tw.initSlots()
-
 	return tw
 }
 
-func (tw *TimeWheel) initSlots() {
-	for i := 0; i < tw.slotNum; i++ {
-		tw.slots[i] = list.New() // 创建3600个新的链表
+// Start starts ticker and workers of time wheel, it resumes a paused wheel and does nothing to a running one
+func (tw *TimeWheel) Start() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	switch tw.state {
+	case running:
+		return
+	case stopped:
+		tw.quit = make(chan struct{})
+		tw.workers = &sync.WaitGroup{}
+		tw.workers.Add(workerNum)
+		for i := 0; i < workerNum; i++ {
+			go tw.work(tw.quit, tw.workers)
+		}
 	}
+	tw.startTicker()
 }
 
-// Start starts ticker for time wheel
-func (tw *TimeWheel) Start() {
-	tw.ticker = time.NewTicker(tw.interval) // 一个定时器，每隔internal:1s 时间，发送一个信号
-	go tw.start()
+// Stop stops ticker and waits for jobs due to be finished, tasks not due yet are kept until the wheel is started
+// again. It is idempotent, but must not be called by jobs, which would wait for themselves.
+func (tw *TimeWheel) Stop() {
+	tw.mu.Lock()
+	if tw.state == stopped {
+		tw.mu.Unlock()
+		return
+	}
+	if tw.state == running {
+		close(tw.stopTicker)
+	}
+	tw.state = stopped
+	overflow := tw.overflow
+	tw.overflow = nil
+	quit, workers := tw.quit, tw.workers
+	tw.mu.Unlock()
+
+	// no jobs are due any more, drain overflow without lock as jobs may add jobs
+	for _, job := range overflow {
+		tw.jobQueue <- job
+		atomic.AddInt64(&tw.overflowPending, -1)
+	}
+	close(quit)
+	workers.Wait()
 }
 
-// Stop stops the time wheel
-func (tw *TimeWheel) Stop() {
-	tw.stopChannel <- true
+// Pause stops ticker of a running wheel, so that no more jobs are due until Resume. Jobs already due are still
+// executed by workers.
+func (tw *TimeWheel) Pause() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.state != running {
+		return
+	}
+	close(tw.stopTicker)
+	tw.state = paused
+}
+
+// Resume restarts ticker of a paused wheel, jobs whose delay passed during pause are executed at the next tick
+func (tw *TimeWheel) Resume() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.state != paused {
+		return
+	}
+	tw.startTicker()
 }
 
-// AddJob add new job into pending queue
+// AddJob add new job into pending queue, job with negative delay is executed at the next tick
 func (tw *TimeWheel) AddJob(delay time.Duration, key string, job func()) {
 	if delay < 0 {
-		return
+		delay = 0
 	}
-	tw.addTaskChannel <- task{delay: delay, key: key, job: job}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.addTask(&task{delay: delay, key: key, job: job})
 }
 
 // RemoveJob add remove job from pending queue
@@ -82,95 +189,184 @@ func (tw *TimeWheel) RemoveJob(key string) {
 	if key == "" {
 		return
 	}
-	tw.removeTaskChannel <- key
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.removeTask(key)
 }
 
-func (tw *TimeWheel) start() {
+// Stats returns counters of jobs
+func (tw *TimeWheel) Stats() Stats {
+	return Stats{
+		Executed:  atomic.LoadInt64(&tw.executed),
+		Pending:   int64(len(tw.jobQueue)) + atomic.LoadInt64(&tw.overflowPending),
+		Overflows: atomic.LoadInt64(&tw.overflows),
+	}
+}
+
+// startTicker starts the goroutine of ticker, tw.mu must be held
+func (tw *TimeWheel) startTicker() {
+	tw.state = running
+	tw.stopTicker = make(chan struct{})
+	go tw.tick(time.NewTicker(tw.interval), tw.stopTicker)
+}
+
+func (tw *TimeWheel) tick(ticker *time.Ticker, stop chan struct{}) {
+	defer ticker.Stop()
 	for {
 		select {
-		case <-tw.ticker.C: // 定时器发来的消息
-			tw.tickHandler()
-		case task := <-tw.addTaskChannel: // 添加任务通道的消息
-			tw.addTask(&task)
-		case key := <-tw.removeTaskChannel: // 移除任务通道的消息
-			tw.removeTask(key)
-		case <-tw.stopChannel: // 结束时间轮的消息
-			tw.ticker.Stop()
+		case now := <-ticker.C:
+			tw.mu.Lock()
+			if tw.state == running {
+				tw.feedWorkers()
+				for target := int64(now.Sub(tw.startTime) / tw.interval); tw.current < target; {
+					tw.current++
+					tw.tickHandler()
+				}
+			}
+			tw.mu.Unlock()
+		case <-stop:
 			return
 		}
 	}
 }
 
-func (tw *TimeWheel) tickHandler() {
-	l := tw.slots[tw.currentPos] // 获取一个双向链表
-	if tw.currentPos == tw.slotNum-1 {
-		tw.currentPos = 0
-	} else {
-		tw.currentPos++
+// feedWorkers hands jobs in overflow to workers in order while there is space in queue
+func (tw *TimeWheel) feedWorkers() {
+	for len(tw.overflow) > 0 {
+		select {
+		case tw.jobQueue <- tw.overflow[0]:
+			tw.overflow[0] = nil
+			tw.overflow = tw.overflow[1:]
+			atomic.AddInt64(&tw.overflowPending, -1)
+		default:
+			return
+		}
 	}
-	go tw.scanAndRunTask(l)
 }
 
-func (tw *TimeWheel) scanAndRunTask(l *list.List) {
-	for e := l.Front(); e != nil; { // 从头节点开始一直到nil
-		task := e.Value.(*task) // 类型断言
-		if task.circle > 0 {    // 没有circle++ 计数是因为这里我们对存的数进行--
-			task.circle--
-			e = e.Next() // 下一个节点
+// tickHandler cascades wheels starting new slots at current tick from the top, then runs tasks expiring now
+func (tw *TimeWheel) tickHandler() {
+	for i := len(tw.wheels) - 1; i > 0; i-- {
+		w := tw.wheels[i]
+		if tw.current%w.span == 0 {
+			for _, t := range tw.takeSlot(w, tw.slotOf(w, tw.current)) {
+				tw.place(t)
+			}
+		}
+	}
+	w := tw.wheels[0]
+	for _, t := range tw.takeSlot(w, tw.slotOf(w, tw.current)) {
+		if t.expiration > tw.current {
+			tw.place(t) // beyond the revolution of the top wheel
 			continue
 		}
+		if t.key != "" {
+			delete(tw.timer, t.key)
+		}
+		tw.submit(t.job)
+	}
+}
+
+// submit hands job to workers, or puts it into overflow if the queue is full or other jobs are waiting in overflow
+func (tw *TimeWheel) submit(job func()) {
+	if len(tw.overflow) == 0 {
+		select {
+		case tw.jobQueue <- job:
+			return
+		default:
+		}
+	}
+	tw.overflow = append(tw.overflow, job)
+	atomic.AddInt64(&tw.overflows, 1)
+	atomic.AddInt64(&tw.overflowPending, 1)
+}
 
-		go func() {
-			defer func() {
-				if err := recover(); err != nil {
-					logger.Error(err)
+// work executes jobs in queue until quit is closed and the queue is empty
+func (tw *TimeWheel) work(quit chan struct{}, workers *sync.WaitGroup) {
+	defer workers.Done()
+	for {
+		select {
+		case job := <-tw.jobQueue:
+			tw.runJob(job)
+		case <-quit:
+			for {
+				select {
+				case job := <-tw.jobQueue:
+					tw.runJob(job)
+				default:
+					return
 				}
-			}()
-			job := task.job
-			job()
-		}()
-		next := e.Next()
-		l.Remove(e)
-		if task.key != "" {
-			delete(tw.timer, task.key) // 这里不清楚这个有什么用
+			}
 		}
-		e = next
 	}
 }
 
-func (tw *TimeWheel) addTask(task *task) {
-	pos, circle := tw.getPositionAndCircle(task.delay)
-	task.circle = circle
+func (tw *TimeWheel) runJob(job func()) {
+	defer func() {
+		atomic.AddInt64(&tw.executed, 1)
+		if err := recover(); err != nil {
+			logger.Error(err)
+		}
+	}()
+	job()
+}
+
+func (tw *TimeWheel) slotOf(w *wheel, tick int64) int {
+	return int(tick / w.span % int64(len(w.slots)))
+}
 
-	e := tw.slots[pos].PushBack(task) // 添加到链表结尾
-	loc := &location{
-		slot:  pos,
-		etask: e,
+// takeSlot empties the slot and returns its tasks, tasks are still in timer
+func (tw *TimeWheel) takeSlot(w *wheel, slot int) []*task {
+	l := w.slots[slot]
+	if l.Len() == 0 {
+		return nil
 	}
-	if task.key != "" {
-		_, ok := tw.timer[task.key] // 如果已经有这个key，删掉重新添加
-		if ok {
-			tw.removeTask(task.key)
-		}
+	w.slots[slot] = list.New()
+	tasks := make([]*task, 0, l.Len())
+	for e := l.Front(); e != nil; e = e.Next() {
+		tasks = append(tasks, e.Value.(*task))
 	}
-	tw.timer[task.key] = loc
+	return tasks
 }
 
-func (tw *TimeWheel) getPositionAndCircle(d time.Duration) (pos int, circle int) {
-	delaySeconds := int(d.Seconds())
-	intervalSeconds := int(tw.interval.Seconds())
-	circle = int(delaySeconds / intervalSeconds / tw.slotNum)          // 计算圈数
-	pos = int(tw.currentPos+delaySeconds/intervalSeconds) % tw.slotNum // 计算单圈位置
+// place puts task into the lowest wheel covering its remaining delay, the top wheel if none covers it
+func (tw *TimeWheel) place(t *task) {
+	delay := t.expiration - tw.current
+	level := len(tw.wheels) - 1
+	for i, w := range tw.wheels {
+		if delay < w.span*int64(len(w.slots)) {
+			level = i
+			break
+		}
+	}
+	w := tw.wheels[level]
+	t.wheel = level
+	t.slot = tw.slotOf(w, t.expiration)
+	e := w.slots[t.slot].PushBack(t)
+	if t.key != "" {
+		tw.timer[t.key] = e
+	}
+}
 
-	return
+func (tw *TimeWheel) addTask(t *task) {
+	if t.key != "" {
+		tw.removeTask(t.key) // replace the pending one of the same key
+	}
+	// round up so that job is never executed early, and the current tick has been handled
+	at := time.Since(tw.startTime) + t.delay
+	t.expiration = int64((at + tw.interval - 1) / tw.interval)
+	if t.expiration <= tw.current {
+		t.expiration = tw.current + 1
+	}
+	tw.place(t)
 }
 
 func (tw *TimeWheel) removeTask(key string) {
-	pos, ok := tw.timer[key]
+	e, ok := tw.timer[key]
 	if !ok {
 		return
 	}
-	l := tw.slots[pos.slot]
-	l.Remove(pos.etask)
+	t := e.Value.(*task)
+	tw.wheels[t.wheel].slots[t.slot].Remove(e)
 	delete(tw.timer, key)
 }
@@ -8,7 +8,8 @@ import (
 
 // Pattern represents a wildcard pattern
 type Pattern struct {
-	exp *regexp.Regexp
+	exp    *regexp.Regexp
+	prefix string
 }
 
 var replaceMap = map[byte]string{
@@ -67,10 +68,27 @@ func CompilePattern(src string) (*Pattern, error) {
 		return nil, err
 	}
 	return &Pattern{
-		exp: re,
+		exp:    re,
+		prefix: literalPrefix(src),
 	}, nil
 }
 
+// literalPrefix returns the part of src before the first character which is not matched literally
+func literalPrefix(src string) string {
+	for i := 0; i < len(src); i++ {
+		switch src[i] {
+		case '*', '?', '[', ']', '\\', '^', '(':
+			return src[:i]
+		}
+	}
+	return src
+}
+
+// Prefix returns the literal prefix of pattern, all strings matching the pattern start with it
+func (p *Pattern) Prefix() string {
+	return p.prefix
+}
+
 // IsMatch returns whether the given string matches pattern
 func (p *Pattern) IsMatch(s string) bool {
 	return p.exp.Match([]byte(s))
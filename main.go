@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"goRedisPlus/config"
 	"goRedisPlus/lib/logger"
+	"goRedisPlus/lib/tlsutil"
 	"goRedisPlus/lib/utils"
 	RedisServer "goRedisPlus/redis/server"
 	"goRedisPlus/tcp"
@@ -13,15 +14,32 @@ import (
 var banner = `goRedis prepare to start`
 
 var defaultProperties = &config.ServerProperties{
-	Bind:           "0.0.0.0",
-	Port:           6399,
-	AppendOnly:     true,
-	AppendFilename: "appendonly.aof",
-	MaxClients:     1000,
-	RunID:          utils.RandString(40),
+	Bind:              "0.0.0.0",
+	Port:              6399,
+	ProtectedMode:     true,
+	MinReplicasMaxLag: 10,
+	LatencyTracking:   true,
+	MaxMemoryPolicy:   "noeviction",
+	MaxMemorySamples:  5,
+	MaxMemoryTenacity: 10,
+	MaxMemoryClients:  "0",
+	LFULogFactor:      10,
+	LFUDecayTime:      1,
+	SetMaxIntset:      512,
+	HashMaxListpack:   128,
+	HashListpackValue: 64,
+	ZSetMaxListpack:   128,
+	ZSetListpackValue: 64,
+	ListMaxListpack:   -2,
+	HotKeysSampling:   10,
+	HotKeysInterval:   60,
+	AppendOnly:        true,
+	AppendFilename:    "appendonly.aof",
+	MaxClients:        1000,
+	RunID:             utils.RandString(40),
 }
 
-const configFile string = "redis.conf"
+const defaultConfigFile string = "redis.conf"
 
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
@@ -37,17 +55,50 @@ func main() {
 		Ext:        "log",
 		TimeFormat: "2006-01-02",
 	})
-	// 设置配置文件
+	// 设置配置文件, 环境变量和命令行参数会覆盖配置文件
+	configFile, err := config.ParseOverrides(os.Args[1:])
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if configFile == "" {
+		configFile = defaultConfigFile
+	} else if !fileExists(configFile) {
+		logger.Fatal("config file " + configFile + " not found")
+	}
 	if fileExists(configFile) {
 		config.SetupConfig(configFile)
 	} else {
 		config.Properties = defaultProperties
+		config.ApplyOverrides(config.Properties)
+	}
+	logger.SetLevel(config.Properties.LogLevel)
+	addresses := config.Properties.BindAddresses(config.Properties.Port)
+	tcpConfig := &tcp.Config{
+		Address:   addresses[0],
+		Addresses: addresses,
+		MaxClients: func() int {
+			return config.Properties.MaxClients
+		},
+		MaxClientsPerIP: func() int {
+			return config.Properties.MaxClientsPerIP
+		},
+		AcceptRate: func() (int, int) {
+			return config.Properties.AcceptRateLimit, config.Properties.AcceptBurst
+		},
+	}
+	if config.Properties.TLSEnabled {
+		tlsConfig, err := tlsutil.MakeServerConfig(config.Properties.TLSCertFile, config.Properties.TLSKeyFile,
+			config.Properties.TLSCACertFile, config.Properties.TLSAuthClients)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		tcpConfig.TLSConfig = tlsConfig
 	}
+	handler := RedisServer.MakeHandler()
+	tcpConfig.OnReload = handler.ReloadConfig
 	// 开启监听
-	err := tcp.ListenAndServeWithSignal(&tcp.Config{
-		Address: fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
-	}, RedisServer.MakeHandler())
+	err = tcp.ListenAndServeWithSignal(tcpConfig, handler)
 	if err != nil {
-		logger.Error(err)
+		logger.Fatal(err)
 	}
 }
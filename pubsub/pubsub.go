@@ -6,6 +6,7 @@ import (
 	"goRedisPlus/lib/utils"
 	"goRedisPlus/redis/protocol"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -137,8 +138,9 @@ func Publish(hub *Hub, args [][]byte) redis.Reply {
 	channel := string(args[0])
 	message := args[1]
 
-	hub.subsLocker.Lock(channel)
-	defer hub.subsLocker.UnLock(channel)
+	// publishers only read subscribers, they don't block each other
+	hub.subsLocker.RLock(channel)
+	defer hub.subsLocker.RUnLock(channel)
 
 	raw, ok := hub.subs.Get(channel)
 	if !ok {
@@ -156,3 +158,15 @@ func Publish(hub *Hub, args [][]byte) redis.Reply {
 	})
 	return protocol.MakeIntReply(int64(subscribers.Len()))
 }
+
+// Channels returns channels having subscribers whose name starts with prefix
+func Channels(hub *Hub, prefix string) []string {
+	var channels []string
+	hub.subs.ForEach(func(channel string, val interface{}) bool {
+		if strings.HasPrefix(channel, prefix) {
+			channels = append(channels, channel)
+		}
+		return true
+	})
+	return channels
+}
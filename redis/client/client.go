@@ -1,10 +1,14 @@
 package client
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"goRedisPlus/interface/redis"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/sync/wait"
+	"goRedisPlus/lib/tlsutil"
 	"goRedisPlus/redis/parser"
 	"goRedisPlus/redis/protocol"
 	"net"
@@ -28,8 +32,11 @@ type Client struct {
 	waitingReqs chan *request // waiting response
 	ticker      *time.Ticker
 	addr        string
+	config      *Config
 
 	status  int32
+	closeMu sync.RWMutex    // Close holds it to stop new requests, requests hold its read lock before being sent
+	broken  int32           // 1 if a request failed or timed out, replies of the connection may be mismatched
 	working *sync.WaitGroup // its counter presents unfinished requests(pending and waiting)
 }
 
@@ -43,24 +50,42 @@ type request struct {
 	err       error
 }
 
+// Config stores optional properties of connection
+type Config struct {
+	TLS      *tls.Config // use TLS if not nil
+	User     string      // user of AUTH, empty means default user
+	Password string      // send AUTH after connected if not empty
+}
+
 const (
-	chanSize = 256
-	maxWait  = 3 * time.Second
+	chanSize    = 256
+	maxWait     = 3 * time.Second
+	dialTimeout = 3 * time.Second
 )
 
 // MakeClient creates a new client
 func MakeClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
+	return MakeClientWithConfig(addr, nil)
+}
+
+// MakeClientWithConfig creates a new client, the connection is secured and authenticated according to cfg
+func MakeClientWithConfig(addr string, cfg *Config) (*Client, error) {
+	if cfg == nil {
+		cfg = &Config{}
 	}
-	return &Client{
+	client := &Client{
 		addr:        addr,
-		conn:        conn,
+		config:      cfg,
 		pendingReqs: make(chan *request, chanSize),
 		waitingReqs: make(chan *request, chanSize),
 		working:     &sync.WaitGroup{},
-	}, nil
+	}
+	conn, err := client.dial()
+	if err != nil {
+		return nil, err
+	}
+	client.conn = conn
+	return client, nil
 }
 
 // Start starts asynchronous goroutines
@@ -74,10 +99,15 @@ func (client *Client) Start() {
 
 // Close stops asynchronous goroutines and close connection
 func (client *Client) Close() {
-	atomic.StoreInt32(&client.status, closed)
+	client.closeMu.Lock()
+	if atomic.SwapInt32(&client.status, closed) == closed {
+		client.closeMu.Unlock()
+		return
+	}
 	client.ticker.Stop()
 	// stop new request
 	close(client.pendingReqs)
+	client.closeMu.Unlock()
 
 	// wait stop process
 	client.working.Wait()
@@ -94,7 +124,7 @@ func (client *Client) reconnect() {
 	var conn net.Conn
 	for i := 0; i < 3; i++ {
 		var err error
-		conn, err = net.Dial("tcp", client.addr)
+		conn, err = client.dial()
 		if err != nil {
 			logger.Error("reconnect error: " + err.Error())
 			time.Sleep(time.Second)
@@ -119,6 +149,44 @@ func (client *Client) reconnect() {
 	go client.handleRead()
 }
 
+// dial connects to server and authenticates if password is set
+func (client *Client) dial() (net.Conn, error) {
+	conn, err := tlsutil.Dial(client.addr, client.config.TLS, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if client.config.Password != "" {
+		if err := authenticate(conn, client.config.User, client.config.Password); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// authenticate sends AUTH before any other request, so the reply is the only data received from conn
+func authenticate(conn net.Conn, user string, password string) error {
+	args := [][]byte{[]byte("AUTH"), []byte(password)}
+	if user != "" {
+		args = [][]byte{[]byte("AUTH"), []byte(user), []byte(password)}
+	}
+	_ = conn.SetDeadline(time.Now().Add(maxWait))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+	if _, err := conn.Write(protocol.MakeMultiBulkReply(args).ToBytes()); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("auth failed, resp: %s", strings.TrimSpace(line))
+	}
+	return nil
+}
+
 func (client *Client) heartbeat() {
 	for range client.ticker.C {
 		client.doHeartbeat()
@@ -131,30 +199,53 @@ func (client *Client) handleWrite() {
 	}
 }
 
-// Send sends a request to redis server
-func (client *Client) Send(args [][]byte) redis.Reply {
+// enqueue puts request into pendingReqs unless client is closed, invoker should call working.Done if it returns true
+func (client *Client) enqueue(req *request) bool {
+	client.closeMu.RLock()
+	defer client.closeMu.RUnlock()
 	if atomic.LoadInt32(&client.status) != running {
-		return protocol.MakeErrReply("client closed")
+		return false
 	}
+	client.working.Add(1)
+	client.pendingReqs <- req
+	return true
+}
+
+// Send sends a request to redis server
+func (client *Client) Send(args [][]byte) redis.Reply {
+	return client.SendWithTimeout(args, maxWait)
+}
+
+// SendWithTimeout sends a request to redis server and waits for its reply at most timeout.
+// It is safe to send requests concurrently, they are pipelined on the connection and replies are matched by order.
+func (client *Client) SendWithTimeout(args [][]byte, timeout time.Duration) redis.Reply {
 	req := &request{
 		args:      args,
 		heartbeat: false,
 		waiting:   &wait.Wait{},
 	}
 	req.waiting.Add(1)
-	client.working.Add(1)
+	if !client.enqueue(req) {
+		return protocol.MakeErrReply("client closed")
+	}
 	defer client.working.Done()
-	client.pendingReqs <- req
-	timeout := req.waiting.WaitWithTimeout(maxWait)
-	if timeout {
+	timedOut := req.waiting.WaitWithTimeout(timeout)
+	if timedOut {
+		atomic.StoreInt32(&client.broken, 1)
 		return protocol.MakeErrReply("server time out")
 	}
 	if req.err != nil {
+		atomic.StoreInt32(&client.broken, 1)
 		return protocol.MakeErrReply("request failed " + req.err.Error())
 	}
 	return req.reply
 }
 
+// Broken returns whether the client should not be used any more
+func (client *Client) Broken() bool {
+	return atomic.LoadInt32(&client.broken) == 1 || atomic.LoadInt32(&client.status) != running
+}
+
 func (client *Client) doHeartbeat() {
 	request := &request{
 		args:      [][]byte{[]byte("PING")},
@@ -162,9 +253,10 @@ func (client *Client) doHeartbeat() {
 		waiting:   &wait.Wait{},
 	}
 	request.waiting.Add(1)
-	client.working.Add(1)
+	if !client.enqueue(request) {
+		return
+	}
 	defer client.working.Done()
-	client.pendingReqs <- request
 	request.waiting.WaitWithTimeout(maxWait)
 }
 
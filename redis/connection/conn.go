@@ -1,10 +1,17 @@
 package connection
 
 import (
+	"errors"
+	"fmt"
+	"goRedisPlus/config"
+	"goRedisPlus/interface/redis"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/sync/wait"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +22,10 @@ const (
 	flagMaster
 	// flagMulti means this connection is within a transaction
 	flagMulti
+	// flagReadOnly means client allows reading from replica in cluster mode, see READONLY command
+	flagReadOnly
+	// flagNoEvict means client is never evicted by maxmemory-clients, see CLIENT NO-EVICT
+	flagNoEvict
 )
 
 // Connection represents a connection with a redis-cli
@@ -33,6 +44,8 @@ type Connection struct {
 
 	// password may be changed by CONFIG command during runtime,so store the password
 	password string
+	// user authenticated as
+	user string
 
 	// queued commands for `multi`
 	queue    [][][]byte
@@ -41,14 +54,94 @@ type Connection struct {
 
 	// selected db
 	selectedDB int
+
+	// metadata shown by CLIENT LIST, name and lastCmd are guarded by mu
+	id              uint64
+	name            string
+	lastCmd         string
+	createTime      time.Time
+	lastInteraction int64 // unix milliseconds
+	executing       int32 // 1 while a command is being executed, which may block like WAIT, accessed atomically
+
+	// replyMode is one of redis.ReplyOn, redis.ReplyOff and redis.ReplySkip, see ShouldReply
+	replyMode int
+	// skipping means reply of the current command is discarded because of CLIENT REPLY SKIP
+	skipping bool
+
+	// pendingOutput is size of data being written, which piles up if the client reads slowly, accessed atomically
+	pendingOutput int64
+	// overSoftLimitSince is unix milliseconds when pendingOutput exceeded soft limit, 0 if it is under soft limit
+	overSoftLimitSince int64
+	// outputLimitReached is 1 once the connection is closed for output buffer limits, accessed atomically
+	outputLimitReached int32
+	// queryBuf is size of the command being executed, multiMemory is size of commands queued in MULTI,
+	// they are accessed atomically and counted in memory of client, see evict.go
+	queryBuf    int64
+	multiMemory int64
+	// evicted is 1 once the connection is closed for maxmemory-clients, accessed atomically
+	evicted int32
+
+	// traffic and commands of the connection shown by CLIENT LIST, accessed atomically
+	netInput  int64
+	netOutput int64
+	commands  int64
 }
 
+// totals of all connections since started, accessed atomically, see INFO stats
+var (
+	TotalNetInput  int64
+	TotalNetOutput int64
+	TotalCommands  int64
+)
+
 var connPool = sync.Pool{
 	New: func() interface{} {
 		return &Connection{}
 	},
 }
 
+// lastID is the id of the latest connection, ids are never reused
+var lastID uint64
+
+// registry holds all connections created by NewConn which have not been closed, see ForEach
+var registry = struct {
+	mu    sync.RWMutex
+	conns map[uint64]*Connection
+}{
+	conns: make(map[uint64]*Connection),
+}
+
+// ForEach visits living connections ordered by id, connections will not be closed until it returns
+func ForEach(consumer func(c *Connection) bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	conns := make([]*Connection, 0, len(registry.conns))
+	for _, c := range registry.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].id < conns[j].id
+	})
+	for _, c := range conns {
+		if !consumer(c) {
+			return
+		}
+	}
+}
+
+// Kill closes the living connection with the id, it returns false if no such connection.
+// Only the underlying network connection is closed, so the goroutine serving it finds EOF and cleans up as usual.
+func Kill(id uint64) bool {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	c, ok := registry.conns[id]
+	if !ok {
+		return false
+	}
+	_ = c.conn.Close()
+	return true
+}
+
 // RemoteAddr returns the remote network address
 func (c *Connection) RemoteAddr() string {
 	return c.conn.RemoteAddr().String()
@@ -56,10 +149,22 @@ func (c *Connection) RemoteAddr() string {
 
 // Close disconnect with the client
 func (c *Connection) Close() error {
+	registry.mu.Lock()
+	delete(registry.conns, c.id)
+	registry.mu.Unlock()
 	c.sendingData.WaitWithTimeout(10 * time.Second)
 	_ = c.conn.Close()
+	c.addMemory(-atomic.SwapInt64(&c.queryBuf, 0) - atomic.SwapInt64(&c.multiMemory, 0))
+	c.mu.Lock()
+	c.name = ""
+	c.lastCmd = ""
+	c.mu.Unlock()
+	c.flags = 0
+	c.replyMode = redis.ReplyOn
+	c.skipping = false
 	c.subs = nil
 	c.password = ""
+	c.user = ""
 	c.queue = nil
 	c.watching = nil
 	c.txErrors = nil
@@ -74,11 +179,22 @@ func NewConn(conn net.Conn) *Connection {
 	c, ok := connPool.Get().(*Connection)
 	if !ok {
 		logger.Error("connection pool make wrong type")
-		return &Connection{
-			conn: conn,
-		}
+		c = &Connection{}
 	}
 	c.conn = conn
+	c.id = atomic.AddUint64(&lastID, 1)
+	c.createTime = time.Now()
+	atomic.StoreInt64(&c.lastInteraction, c.createTime.UnixMilli())
+	atomic.StoreInt64(&c.overSoftLimitSince, 0)
+	atomic.StoreInt32(&c.outputLimitReached, 0)
+	atomic.StoreInt32(&c.evicted, 0)
+	atomic.StoreInt32(&c.executing, 0)
+	atomic.StoreInt64(&c.netInput, 0)
+	atomic.StoreInt64(&c.netOutput, 0)
+	atomic.StoreInt64(&c.commands, 0)
+	registry.mu.Lock()
+	registry.conns[c.id] = c
+	registry.mu.Unlock()
 	return c
 }
 
@@ -93,7 +209,186 @@ func (c *Connection) Write(b []byte) (int, error) {
 		c.sendingData.Done()
 	}()
 
-	return c.conn.Write(b)
+	pending := atomic.AddInt64(&c.pendingOutput, int64(len(b)))
+	c.addMemory(int64(len(b)))
+	defer func() {
+		atomic.AddInt64(&c.pendingOutput, -int64(len(b)))
+		c.addMemory(-int64(len(b)))
+	}()
+	if c.checkOutputLimit(pending) {
+		return 0, errOutputLimit
+	}
+	n, err := c.conn.Write(b)
+	atomic.AddInt64(&c.netOutput, int64(n))
+	atomic.AddInt64(&TotalNetOutput, int64(n))
+	return n, err
+}
+
+// Read reads requests from client over tcp connection, bytes read are counted as network input
+func (c *Connection) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	atomic.AddInt64(&c.netInput, int64(n))
+	atomic.AddInt64(&TotalNetInput, int64(n))
+	return n, err
+}
+
+var errOutputLimit = errors.New("client output buffer limit reached")
+
+// outputLimits are limits of client classes, see SetOutputBufferLimits
+var outputLimits atomic.Value // map[string]config.OutputBufferLimit
+
+// SetOutputBufferLimits sets limits of pending output of normal, replica and pubsub clients
+func SetOutputBufferLimits(limits map[string]config.OutputBufferLimit) {
+	outputLimits.Store(limits)
+}
+
+// outputLimitClass returns class of client-output-buffer-limit, masters are never limited
+func (c *Connection) outputLimitClass() string {
+	if c.IsMaster() {
+		return ""
+	}
+	if c.IsSlave() {
+		return "replica"
+	}
+	if c.SubsCount() > 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// checkOutputLimit closes the connection and returns true if pending output exceeds limits
+func (c *Connection) checkOutputLimit(pending int64) bool {
+	limits, _ := outputLimits.Load().(map[string]config.OutputBufferLimit)
+	limit, ok := limits[c.outputLimitClass()]
+	if !ok {
+		return false
+	}
+	exceeded := limit.Hard > 0 && pending > limit.Hard
+	if !exceeded && limit.Soft > 0 && pending > limit.Soft {
+		now := time.Now().UnixMilli()
+		if atomic.CompareAndSwapInt64(&c.overSoftLimitSince, 0, now) {
+			// check again later in case no more output comes
+			id := c.id
+			time.AfterFunc(time.Duration(limit.SoftSeconds)*time.Second, func() {
+				registry.mu.RLock()
+				defer registry.mu.RUnlock()
+				if c2 := registry.conns[id]; c2 != nil {
+					c2.checkOutputLimit(atomic.LoadInt64(&c2.pendingOutput))
+				}
+			})
+		}
+		since := atomic.LoadInt64(&c.overSoftLimitSince)
+		exceeded = since > 0 && now-since >= limit.SoftSeconds*1000
+	} else if !exceeded {
+		atomic.StoreInt64(&c.overSoftLimitSince, 0)
+	}
+	if exceeded && atomic.CompareAndSwapInt32(&c.outputLimitReached, 0, 1) {
+		logger.Warn(fmt.Sprintf("client %s closed for overcoming of output buffer limits, pending output %d bytes",
+			c.RemoteAddr(), pending))
+		_ = c.conn.Close() // goroutine serving it finds EOF and cleans up as usual
+	}
+	return exceeded
+}
+
+// PendingOutput returns size of data being written to the client
+func (c *Connection) PendingOutput() int64 {
+	return atomic.LoadInt64(&c.pendingOutput)
+}
+
+// LocalAddr returns the local network address
+func (c *Connection) LocalAddr() string {
+	return c.conn.LocalAddr().String()
+}
+
+// GetID returns the unique id of connection, see CLIENT ID
+func (c *Connection) GetID() uint64 {
+	return c.id
+}
+
+// SetClientName sets name of connection, see CLIENT SETNAME
+func (c *Connection) SetClientName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.name = name
+}
+
+// GetClientName returns name of connection, see CLIENT GETNAME
+func (c *Connection) GetClientName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// RecordCommand records the command received by connection before executing it,
+// it is shown as cmd and idle by CLIENT LIST, see FinishCommand
+func (c *Connection) RecordCommand(cmdLine [][]byte) {
+	c.mu.Lock()
+	c.lastCmd = strings.ToLower(string(cmdLine[0]))
+	c.mu.Unlock()
+	size := cmdLineSize(cmdLine)
+	atomic.StoreInt64(&c.queryBuf, size)
+	c.addMemory(size)
+	atomic.StoreInt64(&c.lastInteraction, time.Now().UnixMilli())
+	atomic.StoreInt32(&c.executing, 1)
+}
+
+// FinishCommand records the end of executing command
+func (c *Connection) FinishCommand() {
+	c.addMemory(-atomic.SwapInt64(&c.queryBuf, 0))
+	atomic.StoreInt64(&c.lastInteraction, time.Now().UnixMilli())
+	atomic.StoreInt32(&c.executing, 0)
+	atomic.AddInt64(&c.commands, 1)
+	atomic.AddInt64(&TotalCommands, 1)
+}
+
+// Traffic returns bytes read from and written to the client, and number of commands processed
+func (c *Connection) Traffic() (netInput int64, netOutput int64, commands int64) {
+	return atomic.LoadInt64(&c.netInput), atomic.LoadInt64(&c.netOutput), atomic.LoadInt64(&c.commands)
+}
+
+// IsExecuting returns whether the connection is executing a command, it may be blocked by command like WAIT
+func (c *Connection) IsExecuting() bool {
+	return atomic.LoadInt32(&c.executing) == 1
+}
+
+// GetLastCommand returns name of the latest command received
+func (c *Connection) GetLastCommand() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastCmd
+}
+
+// SetReplyMode sets reply mode of following commands, see CLIENT REPLY
+func (c *Connection) SetReplyMode(mode int) {
+	c.replyMode = mode
+}
+
+// ShouldReply returns whether the reply of the current command should be sent, it is called once after each command.
+// The command setting reply mode to off or skip gets no reply as well.
+func (c *Connection) ShouldReply() bool {
+	if c.skipping {
+		c.skipping = false
+		return false
+	}
+	switch c.replyMode {
+	case redis.ReplyOff:
+		return false
+	case redis.ReplySkip:
+		c.replyMode = redis.ReplyOn
+		c.skipping = true // skip the next command
+		return false
+	}
+	return true
+}
+
+// Age returns how long the connection has been established
+func (c *Connection) Age() time.Duration {
+	return time.Since(c.createTime)
+}
+
+// Idle returns how long since the latest command received
+func (c *Connection) Idle() time.Duration {
+	return time.Since(time.UnixMilli(atomic.LoadInt64(&c.lastInteraction)))
 }
 
 func (c *Connection) Name() string {
@@ -154,6 +449,16 @@ func (c *Connection) GetPassword() string {
 	return c.password
 }
 
+// SetUser stores the user authenticated as
+func (c *Connection) SetUser(user string) {
+	c.user = user
+}
+
+// GetUser returns the user authenticated as
+func (c *Connection) GetUser() string {
+	return c.user
+}
+
 // InMultiState tells is connection in an uncommitted transaction
 func (c *Connection) InMultiState() bool {
 	return c.flags&flagMulti > 0
@@ -164,6 +469,7 @@ func (c *Connection) SetMultiState(state bool) {
 	if !state { // reset data when cancel multi
 		c.watching = nil
 		c.queue = nil
+		c.addMemory(-atomic.SwapInt64(&c.multiMemory, 0))
 		c.flags &= ^flagMulti // clean multi flag
 		return
 	}
@@ -178,6 +484,9 @@ func (c *Connection) GetQueuedCmdLine() [][][]byte {
 // EnqueueCmd  enqueues command of current transaction
 func (c *Connection) EnqueueCmd(cmdLine [][]byte) {
 	c.queue = append(c.queue, cmdLine)
+	size := cmdLineSize(cmdLine)
+	atomic.AddInt64(&c.multiMemory, size)
+	c.addMemory(size)
 }
 
 // AddTxError stores syntax error within transaction
@@ -193,6 +502,7 @@ func (c *Connection) GetTxErrors() []error {
 // ClearQueuedCmds clears queued commands of current transaction
 func (c *Connection) ClearQueuedCmds() {
 	c.queue = nil
+	c.addMemory(-atomic.SwapInt64(&c.multiMemory, 0))
 }
 
 // GetWatching returns watching keys and their version code when started watching
@@ -227,4 +537,17 @@ func (c *Connection) SetMaster() {
 
 func (c *Connection) IsMaster() bool {
 	return c.flags&flagMaster > 0
-}
\ No newline at end of file
+}
+
+// SetReadOnly sets whether client allows reading from replica in cluster mode
+func (c *Connection) SetReadOnly(readOnly bool) {
+	if readOnly {
+		c.flags |= flagReadOnly
+	} else {
+		c.flags &= ^flagReadOnly
+	}
+}
+
+func (c *Connection) IsReadOnly() bool {
+	return c.flags&flagReadOnly > 0
+}
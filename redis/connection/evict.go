@@ -0,0 +1,136 @@
+package connection
+
+import (
+	"fmt"
+	"goRedisPlus/lib/logger"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Client eviction:
+// Memory of a client is the sum of its pending output, the command being executed and commands queued in MULTI.
+// Memory of all clients is kept in clientsMemory, once it exceeds maxmemory-clients, clients using the most memory
+// are disconnected until it is within the limit, like redis. Masters, replicas, clients which turned on
+// CLIENT NO-EVICT and clients using less than minEvictableMemory are never evicted.
+
+// minEvictableMemory is the least memory of evictable clients, evicting smaller clients frees little, the same as redis
+const minEvictableMemory = 32 * 1024
+
+var (
+	// maxMemoryClients is the limit of clientsMemory, 0 means unlimited, accessed atomically
+	maxMemoryClients int64
+	// clientsMemory is memory held by all connections created by NewConn, accessed atomically
+	clientsMemory int64
+	// EvictedClients counts clients disconnected by maxmemory-clients, see INFO stats
+	EvictedClients int64
+
+	// clientEvictionMu serializes evictions, so that clients are not evicted for the same excess twice
+	clientEvictionMu sync.Mutex
+)
+
+// SetMaxMemoryClients sets the limit of memory held by all clients, 0 means unlimited
+func SetMaxMemoryClients(limit int64) {
+	atomic.StoreInt64(&maxMemoryClients, limit)
+	evictClients()
+}
+
+// ClientsMemory returns memory held by all clients
+func ClientsMemory() int64 {
+	return atomic.LoadInt64(&clientsMemory)
+}
+
+// Memory returns bytes held by the client, see CLIENT LIST tot-mem
+func (c *Connection) Memory() int64 {
+	return atomic.LoadInt64(&c.pendingOutput) + atomic.LoadInt64(&c.queryBuf) + atomic.LoadInt64(&c.multiMemory)
+}
+
+// CommandMemory returns size of the command being executed and commands queued in MULTI, see CLIENT LIST
+func (c *Connection) CommandMemory() (queryBuf int64, multiMemory int64) {
+	return atomic.LoadInt64(&c.queryBuf), atomic.LoadInt64(&c.multiMemory)
+}
+
+// SetNoEvict protects the client from being evicted by maxmemory-clients, see CLIENT NO-EVICT
+func (c *Connection) SetNoEvict(noEvict bool) {
+	if noEvict {
+		c.flags |= flagNoEvict
+	} else {
+		c.flags &= ^flagNoEvict
+		evictClients()
+	}
+}
+
+// IsNoEvict returns whether the client is protected from maxmemory-clients
+func (c *Connection) IsNoEvict() bool {
+	return c.flags&flagNoEvict > 0
+}
+
+// addMemory accounts delta bytes held by the client, and evicts clients if grown over maxmemory-clients.
+// Fake connections are not accounted, they are not real clients.
+func (c *Connection) addMemory(delta int64) {
+	if delta == 0 || c.id == 0 {
+		return
+	}
+	total := atomic.AddInt64(&clientsMemory, delta)
+	if delta > 0 {
+		if limit := atomic.LoadInt64(&maxMemoryClients); limit > 0 && total > limit {
+			evictClients()
+		}
+	}
+}
+
+func cmdLineSize(cmdLine [][]byte) int64 {
+	size := int64(0)
+	for _, arg := range cmdLine {
+		size += int64(len(arg))
+	}
+	return size
+}
+
+// evictClients disconnects clients using the most memory until memory of all clients is within maxmemory-clients
+func evictClients() {
+	limit := atomic.LoadInt64(&maxMemoryClients)
+	if limit <= 0 || atomic.LoadInt64(&clientsMemory) <= limit {
+		return
+	}
+	clientEvictionMu.Lock()
+	defer clientEvictionMu.Unlock()
+	total := atomic.LoadInt64(&clientsMemory)
+	if total <= limit {
+		return
+	}
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	candidates := make([]*Connection, 0, len(registry.conns))
+	memories := make(map[*Connection]int64, len(registry.conns))
+	for _, c := range registry.conns {
+		if atomic.LoadInt32(&c.evicted) == 1 {
+			// memory of the evicted client will be released soon
+			total -= c.Memory()
+			continue
+		}
+		if c.IsMaster() || c.IsSlave() || c.IsNoEvict() {
+			continue
+		}
+		if memory := c.Memory(); memory >= minEvictableMemory {
+			candidates = append(candidates, c)
+			memories[c] = memory
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return memories[candidates[i]] > memories[candidates[j]]
+	})
+	for _, c := range candidates {
+		if total <= limit {
+			return
+		}
+		if !atomic.CompareAndSwapInt32(&c.evicted, 0, 1) {
+			continue
+		}
+		total -= memories[c]
+		atomic.AddInt64(&EvictedClients, 1)
+		logger.Warn(fmt.Sprintf("client %s evicted for overcoming of maxmemory-clients, using %d bytes",
+			c.RemoteAddr(), memories[c]))
+		_ = c.conn.Close() // goroutine serving it finds EOF and cleans up as usual
+	}
+}
@@ -154,10 +154,21 @@ func parseBulkString(header []byte, reader *bufio.Reader, ch chan<- *Payload) er
 
 // there is no CRLF between RDB and following AOF, therefore it needs to be treated differently
 func parseRDBBulkString(reader *bufio.Reader, ch chan<- *Payload) error {
-	header, err := reader.ReadBytes('\n')
-	header = bytes.TrimSuffix(header, []byte{'\r', '\n'})
-	if len(header) == 0 {
-		return errors.New("empty header")
+	var header []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		// redis-server sends newlines to keep alive while it is generating rdb, skip them
+		header = bytes.TrimRight(line, "\r\n")
+		if len(header) > 0 {
+			break
+		}
+	}
+	if bytes.HasPrefix(header, []byte("$EOF:")) {
+		// diskless replication, rdb ends with the given mark
+		return parseRDBWithEOFMark(header[len("$EOF:"):], reader, ch)
 	}
 	strLen, err := strconv.ParseInt(string(header[1:]), 10, 64)
 	if err != nil || strLen <= 0 {
@@ -174,6 +185,28 @@ func parseRDBBulkString(reader *bufio.Reader, ch chan<- *Payload) error {
 	return nil
 }
 
+// parseRDBWithEOFMark reads rdb until the mark found, it must not read any byte after the mark
+func parseRDBWithEOFMark(mark []byte, reader *bufio.Reader, ch chan<- *Payload) error {
+	if len(mark) == 0 {
+		return errors.New("empty eof mark")
+	}
+	var body []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		body = append(body, b)
+		if len(body) >= len(mark) && b == mark[len(mark)-1] && bytes.HasSuffix(body, mark) {
+			break
+		}
+	}
+	ch <- &Payload{
+		Data: protocol.MakeBulkReply(body[:len(body)-len(mark)]),
+	}
+	return nil
+}
+
 func parseArray(header []byte, reader *bufio.Reader, ch chan<- *Payload) error {
 	nStrs, err := strconv.ParseInt(string(header[1:]), 10, 64)
 	if err != nil || nStrs < 0 {
@@ -2,12 +2,15 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"goRedisPlus/cluster"
 	"goRedisPlus/config"
 	database2 "goRedisPlus/database"
 	"goRedisPlus/interface/database"
 	"goRedisPlus/lib/logger"
 	"goRedisPlus/lib/sync/atomic"
+	"goRedisPlus/lib/timewheel"
+	"goRedisPlus/lib/utils"
 	"goRedisPlus/redis/connection"
 	"goRedisPlus/redis/parser"
 	"goRedisPlus/redis/protocol"
@@ -15,10 +18,24 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	unknownErrReplyBytes = []byte("-ERR unknown\r\n")
+	protectedModeReply   = protocol.MakeErrReply("DENIED Redis is running in protected mode because protected mode is " +
+		"enabled, no bind address was specified, no authentication password is requested to clients. " +
+		"In this mode connections are only accepted from the loopback interface. " +
+		"If you want to connect from external computers to Redis you may adopt one of the following solutions: " +
+		"1) Just disable protected mode sending the command 'CONFIG SET protected-mode no' from the loopback " +
+		"interface by connecting to Redis from the same host the server is running, however MAKE SURE Redis " +
+		"is not publicly accessible from internet if you do so. Use CONFIG REWRITE to make this change permanent. " +
+		"2) Alternatively you can just disable the protected mode by editing the Redis configuration file, " +
+		"and setting the protected mode option to 'no', and then restarting the server. " +
+		"3) If you started the server manually just for testing, restart it with the '--protected-mode no' option. " +
+		"4) Setup a bind address or an authentication password. " +
+		"NOTE: You only need to do one of the above things in order for the server to start accepting " +
+		"connections from the outside.")
 )
 
 // Handler implements tcp.Handler and serves as a redis server
@@ -39,9 +56,40 @@ func MakeHandler() *Handler {
 		// 创建常规的数据库
 		db = database2.NewStandaloneServer()
 	}
-	return &Handler{
+	h := &Handler{
 		db: db,
 	}
+	timewheel.Delay(idleCheckInterval, idleCheckTaskKey, h.closeIdleClients)
+	return h
+}
+
+const (
+	idleCheckInterval = time.Second
+	idleCheckTaskKey  = "idle-clients"
+)
+
+// closeIdleClients closes normal clients idle longer than timeout config, it reschedules itself until handler closed.
+// Replicas, subscribers and clients blocked in commands are never closed for being idle.
+func (h *Handler) closeIdleClients() {
+	if h.closing.Get() {
+		return
+	}
+	defer timewheel.Delay(idleCheckInterval, idleCheckTaskKey, h.closeIdleClients)
+	timeout := time.Duration(config.Properties.Timeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+	h.activeConn.Range(func(key interface{}, val interface{}) bool {
+		client := key.(*connection.Connection)
+		if client.IsMaster() || client.IsSlave() || client.SubsCount() > 0 || client.IsExecuting() {
+			return true
+		}
+		if client.Idle() > timeout {
+			logger.Info("closing idle client " + client.RemoteAddr())
+			connection.Kill(client.GetID())
+		}
+		return true
+	})
 }
 
 func (h *Handler) closeClient(client *connection.Connection) {
@@ -50,6 +98,20 @@ func (h *Handler) closeClient(client *connection.Connection) {
 	h.activeConn.Delete(client)
 }
 
+// isProtected returns whether the connection should be refused by protected-mode: only loopback clients are
+// accepted if the server binds all interfaces and the default user has no password
+func isProtected(conn net.Conn) bool {
+	if !config.Properties.ProtectedMode || !config.Properties.BindsAllInterfaces() || !database2.DefaultUserNoPass() {
+		return false
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && !ip.IsLoopback()
+}
+
 // Handle receives and executes redis commands
 func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 	if h.closing.Get() {
@@ -57,11 +119,16 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 		_ = conn.Close()
 		return
 	}
+	if isProtected(conn) {
+		_, _ = conn.Write(protectedModeReply.ToBytes())
+		_ = conn.Close()
+		return
+	}
 
 	client := connection.NewConn(conn)     // 创建一个连接
 	h.activeConn.Store(client, struct{}{}) // 把这个连接存起来
 
-	ch := parser.ParseStream(conn) // 解析协议收到的数据，数据放到ch中
+	ch := parser.ParseStream(client) // 解析协议收到的数据，数据放到ch中, client counts bytes read
 	for payload := range ch {      // 遍历每一个接受的payload
 		if payload.Err != nil {
 			if payload.Err == io.EOF ||
@@ -91,7 +158,20 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 			logger.Error("require multi bulk protocol")
 			continue
 		}
-		result := h.db.Exec(client, r.Args) //执行接收到的命令
+		// renamed commands are translated here since internal callers of Exec use original names
+		cmdLine, errReply := database2.TranslateCommand(r.Args)
+		if errReply != nil {
+			_, _ = client.Write(errReply.ToBytes())
+			continue
+		}
+		if len(cmdLine) > 0 {
+			client.RecordCommand(cmdLine)
+		}
+		result := h.db.Exec(client, cmdLine) //执行接收到的命令
+		client.FinishCommand()
+		if !client.ShouldReply() {
+			continue // see CLIENT REPLY
+		}
 		if result != nil {
 			_, _ = client.Write(result.ToBytes()) // 把执行的回复写回conn
 		} else {
@@ -100,6 +180,48 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 	}
 }
 
+// secretParams are not printed in logs of reloading config
+var secretParams = map[string]bool{
+	"requirepass":       true,
+	"masterauth":        true,
+	"cluster-auth-pass": true,
+}
+
+// ReloadConfig reads config file again and applies changed params which are mutable at runtime,
+// it is called on SIGHUP. Changes of other params are logged and take effect after restart.
+func (h *Handler) ReloadConfig() {
+	changes, err := config.DiffConfigFile()
+	if err != nil {
+		logger.Error("reload config failed: " + err.Error())
+		return
+	}
+	if len(changes) == 0 {
+		logger.Info("reload config: nothing changed")
+		return
+	}
+	cmdLine := utils.ToCmdLine("CONFIG", "SET")
+	for _, change := range changes {
+		oldValue, newValue := change.OldValue, change.NewValue
+		if secretParams[change.Name] {
+			oldValue, newValue = "******", "******"
+		}
+		if change.Mutable {
+			logger.Info(fmt.Sprintf("reload config: %s changed from '%s' to '%s'", change.Name, oldValue, newValue))
+			cmdLine = append(cmdLine, []byte(change.Name), []byte(change.NewValue))
+		} else {
+			logger.Warn(fmt.Sprintf("reload config: %s changed from '%s' to '%s', it requires restart",
+				change.Name, oldValue, newValue))
+		}
+	}
+	if len(cmdLine) == 2 {
+		return
+	}
+	result := h.db.Exec(connection.NewFakeConn(), cmdLine)
+	if protocol.IsErrorReply(result) {
+		logger.Error("reload config failed: " + strings.TrimSpace(string(result.ToBytes())))
+	}
+}
+
 // Close stops handler
 func (h *Handler) Close() error {
 	logger.Info("handler shutting down...")
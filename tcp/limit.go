@@ -0,0 +1,79 @@
+package tcp
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	perIPLimitReplyBytes = []byte("-ERR max number of clients per IP reached\r\n")
+	acceptRateReplyBytes = []byte("-ERR too many connections in a short time, try again later\r\n")
+)
+
+// acceptLimiter limits concurrent connections of each ip and rate of accepting connections by token bucket
+type acceptLimiter struct {
+	mu         sync.Mutex
+	perIP      map[string]int
+	tokens     float64
+	lastRefill time.Time
+}
+
+func makeAcceptLimiter() *acceptLimiter {
+	return &acceptLimiter{
+		perIP:      make(map[string]int),
+		tokens:     math.Inf(1), // full bucket, capped by burst
+		lastRefill: time.Now(),
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// admit returns reason to reject the connection, or nil if it is admitted. Admitted connection must be released.
+func (limiter *acceptLimiter) admit(conn net.Conn, cfg *Config) []byte {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if cfg.AcceptRate != nil {
+		if rate, burst := cfg.AcceptRate(); rate > 0 {
+			if burst < rate {
+				burst = rate
+			}
+			now := time.Now()
+			limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * float64(rate)
+			if limiter.tokens > float64(burst) {
+				limiter.tokens = float64(burst)
+			}
+			limiter.lastRefill = now
+			if limiter.tokens < 1 {
+				return acceptRateReplyBytes
+			}
+			limiter.tokens--
+		}
+	}
+	ip := remoteIP(conn)
+	if cfg.MaxClientsPerIP != nil {
+		if max := cfg.MaxClientsPerIP(); max > 0 && limiter.perIP[ip] >= max {
+			return perIPLimitReplyBytes
+		}
+	}
+	limiter.perIP[ip]++
+	return nil
+}
+
+// release forgets the closed connection admitted before
+func (limiter *acceptLimiter) release(conn net.Conn) {
+	ip := remoteIP(conn)
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.perIP[ip]--
+	if limiter.perIP[ip] <= 0 {
+		delete(limiter.perIP, ip)
+	}
+}
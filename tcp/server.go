@@ -2,13 +2,16 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"goRedisPlus/interface/tcp"
 	"goRedisPlus/lib/logger"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -16,37 +19,171 @@ import (
 // Config stores tcp server properties
 type Config struct {
 	Address    string        `yaml:"address"`
+	Addresses  []string      `yaml:"addresses"` // listen on all of them, such as ipv4 and ipv6 addresses, Address is used if it is empty
 	MaxConnect uint32        `yaml:"max-connect"`
 	Timeout    time.Duration `yaml:"timeout"`
+	TLSConfig  *tls.Config   `yaml:"-"` // serve with TLS if not nil
+	OnReload   func()        `yaml:"-"` // called on SIGHUP, server shuts down on SIGHUP if it is nil
+	MaxClients func() int    `yaml:"-"` // limit of connected clients read on every connection, nil or <= 0 means unlimited
+	// limit of connected clients from each ip, nil or <= 0 means unlimited
+	MaxClientsPerIP func() int `yaml:"-"`
+	// connections accepted per second on average and at most in a burst, nil or rate <= 0 means unlimited
+	AcceptRate func() (rate int, burst int) `yaml:"-"`
 }
 
-// ClientCounter Record the number of clients in the current Godis server
-var ClientCounter int
+// counters of connections, accessed atomically
+var (
+	// ClientCounter Record the number of clients in the current Godis server
+	ClientCounter int64
+	// AcceptedCounter records connections accepted since started, including rejected ones
+	AcceptedCounter int64
+	// RejectedCounter records connections rejected because of maxclients, per ip limit or accept rate
+	RejectedCounter int64
+)
+
+var maxClientsReplyBytes = []byte("-ERR max number of clients reached\r\n")
+
+// shutdownCh receives requests to shut down server, such as SHUTDOWN command
+var shutdownCh = make(chan struct{}, 1)
+
+// Shutdown asks the server started by ListenAndServeWithSignal to shut down as if it received SIGTERM
+func Shutdown() {
+	select {
+	case shutdownCh <- struct{}{}:
+	default: // shutting down already
+	}
+}
 
 // ListenAndServeWithSignal binds port and handle requests, blocking until receive stop signal
 func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 	closeChan := make(chan struct{})
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
-		sig := <-sigCh
-		switch sig {
-		case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			closeChan <- struct{}{}
+		for {
+			select {
+			case <-shutdownCh:
+				closeChan <- struct{}{}
+				return
+			case sig := <-sigCh:
+				if sig == syscall.SIGHUP && cfg.OnReload != nil {
+					logger.Info("get reload signal")
+					cfg.OnReload()
+					continue
+				}
+				switch sig {
+				case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
+					closeChan <- struct{}{}
+					return
+				}
+			}
 		}
 	}()
-	listener, err := net.Listen("tcp", cfg.Address)
-	if err != nil {
-		return err
+	addresses := cfg.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{cfg.Address}
+	}
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, address := range addresses {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return err
+		}
+		if cfg.TLSConfig != nil {
+			listener = tls.NewListener(listener, cfg.TLSConfig)
+		}
+		listeners = append(listeners, listener)
+	}
+	listener := listeners[0]
+	if len(listeners) > 1 {
+		listener = makeMultiListener(listeners)
 	}
 	//cfg.Address = listener.Addr().String()
-	logger.Info(fmt.Sprintf("bind: %s, start listening...", cfg.Address))
-	ListenAndServe(listener, handler, closeChan)
+	logger.Info(fmt.Sprintf("bind: %s, start listening...", strings.Join(addresses, ", ")))
+	serve(listener, handler, closeChan, cfg)
+	return nil
+}
+
+// multiListener accepts connections from several listeners
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func makeMultiListener(listeners []net.Listener) *multiListener {
+	ml := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+		done:      make(chan struct{}),
+	}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					ml.errs <- err
+					return
+				}
+				select {
+				case ml.conns <- conn:
+				case <-ml.done:
+					_ = conn.Close()
+					return
+				}
+			}
+		}(listener)
+	}
+	return ml
+}
+
+// Accept returns connection accepted by any listener, it returns error once a listener failed
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.conns:
+		return conn, nil
+	case err := <-ml.errs:
+		_ = ml.Close()
+		return nil, err
+	}
+}
+
+// Close closes all listeners
+func (ml *multiListener) Close() error {
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+		for _, listener := range ml.listeners {
+			_ = listener.Close()
+		}
+	})
 	return nil
 }
 
+// Addr returns address of the first listener
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
+
 // ListenAndServe binds port and handle requests, blocking until close
 func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
+	serve(listener, handler, closeChan, &Config{})
+}
+
+// reject writes reason to the connection and closes it, the client is not handled
+func reject(conn net.Conn, reason []byte) {
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write(reason)
+	_ = conn.Close()
+}
+
+// serve handles connections accepted by listener within limits of cfg, blocking until close
+func serve(listener net.Listener, handler tcp.Handler, closeChan <-chan struct{}, cfg *Config) {
 	// listen signal
 	errCh := make(chan error, 1)
 	defer close(errCh)
@@ -63,6 +200,7 @@ func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan
 	}()
 
 	ctx := context.Background()
+	limiter := makeAcceptLimiter()
 	var waitDone sync.WaitGroup
 	for {
 		conn, err := listener.Accept()
@@ -70,14 +208,26 @@ func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan
 			errCh <- err
 			break
 		}
+		atomic.AddInt64(&AcceptedCounter, 1)
+		if cfg.MaxClients != nil && cfg.MaxClients() > 0 && atomic.LoadInt64(&ClientCounter) >= int64(cfg.MaxClients()) {
+			atomic.AddInt64(&RejectedCounter, 1)
+			go reject(conn, maxClientsReplyBytes)
+			continue
+		}
+		if reason := limiter.admit(conn, cfg); reason != nil {
+			atomic.AddInt64(&RejectedCounter, 1)
+			go reject(conn, reason)
+			continue
+		}
 		// handle
 		logger.Info("accept link")
-		ClientCounter++
+		atomic.AddInt64(&ClientCounter, 1)
 		waitDone.Add(1)
 		go func() {
 			defer func() {
 				waitDone.Done()
-				ClientCounter--
+				atomic.AddInt64(&ClientCounter, -1)
+				limiter.release(conn)
 			}()
 			handler.Handle(ctx, conn)
 		}()